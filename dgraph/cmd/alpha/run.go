@@ -139,6 +139,10 @@ they form a Raft group and provide synchronous replication.
 		"A comma separated list of IP ranges you wish to whitelist for performing admin "+
 			"actions (i.e., --whitelist 127.0.0.1:127.0.0.3,0.0.0.7:0.0.0.9)")
 	flag.String("export", "export", "Folder in which to store exports.")
+	flag.Uint64("backup_archive_limit_mb", 10240,
+		"Limit in MiB for the size of a backup archive restored from a tar.gz or zip file once "+
+			"it's extracted into the temporary directory. Set to zero to only limit it to the "+
+			"free disk space.")
 	flag.Int("pending_proposals", 256,
 		"Number of pending mutation proposals. Useful for rate limiting.")
 	flag.String("my", "",
@@ -182,6 +186,12 @@ they form a Raft group and provide synchronous replication.
 	flag.Uint64("normalize_node_limit", 1e4,
 		"Limit for the maximum number of nodes that can be returned in a query that uses the "+
 			"normalize directive.")
+	flag.Uint64("aggregate_buffer_limit", 1e6,
+		"Limit for the maximum number of values that the aggregators of a groupby query can "+
+			"buffer across all of its groups. Set to zero to disable the limit.")
+	flag.Uint64("groupby_group_limit", 1e6,
+		"Limit for the maximum number of groups that a groupby query is estimated to form. "+
+			"Queries over the limit fail before forming the groups. Set to zero to disable it.")
 
 	// TLS configurations
 	flag.String("tls_dir", "", "Path to directory that has TLS certificates and keys.")
@@ -623,6 +633,7 @@ func run() {
 		AbortOlderThan:      abortDur,
 		StartTime:           startTime,
 		LudicrousMode:       Alpha.Conf.GetBool("ludicrous_mode"),
+		BackupArchiveLimit:  cast.ToInt64(Alpha.Conf.GetString("backup_archive_limit_mb")) << 20,
 	}
 	if x.WorkerConfig.EncryptionKey, err = enc.ReadKey(Alpha.Conf); err != nil {
 		glog.Infof("unable to read key %v", err)
@@ -634,6 +645,8 @@ func run() {
 	x.Config.PortOffset = Alpha.Conf.GetInt("port_offset")
 	x.Config.QueryEdgeLimit = cast.ToUint64(Alpha.Conf.GetString("query_edge_limit"))
 	x.Config.NormalizeNodeLimit = cast.ToInt(Alpha.Conf.GetString("normalize_node_limit"))
+	x.Config.AggregateBufferLimit = cast.ToInt(Alpha.Conf.GetString("aggregate_buffer_limit"))
+	x.Config.GroupbyGroupLimit = cast.ToInt(Alpha.Conf.GetString("groupby_group_limit"))
 	x.Config.PollInterval = Alpha.Conf.GetDuration("graphql_poll_interval")
 
 	x.PrintVersion()
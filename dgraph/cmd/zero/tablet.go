@@ -22,6 +22,7 @@ import (
 	"sort"
 	"time"
 
+	"github.com/dgraph-io/dgo/v200/protos/api"
 	"github.com/dgraph-io/dgraph/protos/pb"
 	"github.com/dgraph-io/dgraph/x"
 	humanize "github.com/dustin/go-humanize"
@@ -72,6 +73,41 @@ func (s *Server) rebalanceTablets() {
 	}
 }
 
+// Rebalance moves tablets between the groups until their sizes are balanced, instead of waiting
+// for rebalanceTablets to move one tablet per interval. It's used to spread the predicates after
+// a restore. Each predicate is moved at most once, so that it stops even if the sizes of the
+// tablets keep changing.
+func (s *Server) Rebalance(ctx context.Context, _ *api.Payload) (*pb.RebalanceResponse, error) {
+	if !s.Node.AmLeader() {
+		return nil, errors.Errorf("I am not the Zero leader")
+	}
+
+	resp := &pb.RebalanceResponse{}
+	moved := make(map[string]struct{})
+	for {
+		if err := ctx.Err(); err != nil {
+			return resp, err
+		}
+		predicate, srcGroup, dstGroup := s.chooseTablet()
+		if len(predicate) == 0 {
+			return resp, nil
+		}
+		if _, ok := moved[predicate]; ok {
+			return resp, nil
+		}
+		if err := s.movePredicate(predicate, srcGroup, dstGroup); err != nil {
+			return resp, errors.Wrapf(err, "while moving predicate %s from group %d to %d",
+				predicate, srcGroup, dstGroup)
+		}
+		moved[predicate] = struct{}{}
+		resp.Moves = append(resp.Moves, &pb.TabletMove{
+			Predicate: predicate,
+			SrcGroup:  srcGroup,
+			DstGroup:  dstGroup,
+		})
+	}
+}
+
 // movePredicate is the main entry point for move predicate logic. This Zero must remain the leader
 // for the entire duration of predicate move. If this Zero stops being the leader, the final
 // proposal of reassigning the tablet to the destination would fail automatically.
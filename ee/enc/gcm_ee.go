@@ -0,0 +1,236 @@
+// +build !oss
+
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Dgraph Community License (the "License"); you
+ * may not use this file except in compliance with the License. You
+ * may obtain a copy of the License at
+ *
+ *     https://github.com/dgraph-io/dgraph/blob/master/licenses/DCL.txt
+ */
+
+package enc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/dgraph-io/dgraph/x"
+	"github.com/pkg/errors"
+)
+
+const (
+	// AlgorithmCTR is AES in counter mode, which GetWriter encrypts with. It's the default
+	// algorithm of the backups, and the encrypted backups whose manifest doesn't record an
+	// algorithm were encrypted with it.
+	AlgorithmCTR = "aes-ctr"
+	// AlgorithmGCM is AES in Galois/Counter mode, which also authenticates the data.
+	AlgorithmGCM = "aes-gcm"
+)
+
+// CheckAlgorithm returns an error if data can't be encrypted and decrypted with the given
+// algorithm. An empty algorithm is AlgorithmCTR.
+func CheckAlgorithm(alg string) error {
+	switch alg {
+	case "", AlgorithmCTR, AlgorithmGCM:
+		return nil
+	}
+	return errors.Errorf("unsupported encryption algorithm %q. Supported algorithms are %s "+
+		"and %s", alg, AlgorithmCTR, AlgorithmGCM)
+}
+
+// GetReaderFor wraps the input Reader with a reader that decrypts the data encrypted with the
+// given algorithm, or returns it as is if the key is nil.
+func GetReaderFor(alg string, key x.SensitiveByteSlice, r io.Reader) (io.Reader, error) {
+	if err := CheckAlgorithm(alg); err != nil {
+		return nil, err
+	}
+	if alg == AlgorithmGCM && key != nil {
+		return newGCMReader(key, r)
+	}
+	return GetReader(key, r)
+}
+
+// nopWriteCloser is a writer whose Close does nothing.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// GetWriterFor wraps the input Writer with a writer that encrypts the data with the given
+// algorithm, or returns it as is if the key is nil. Close must be called once all the data is
+// written, it doesn't close the input Writer.
+func GetWriterFor(alg string, key x.SensitiveByteSlice, w io.Writer) (io.WriteCloser, error) {
+	if err := CheckAlgorithm(alg); err != nil {
+		return nil, err
+	}
+	if alg == AlgorithmGCM && key != nil {
+		return GetGCMWriter(key, w)
+	}
+	ew, err := GetWriter(key, w)
+	if err != nil {
+		return nil, err
+	}
+	return nopWriteCloser{ew}, nil
+}
+
+// The data encrypted with AES-GCM is split into chunks of up to gcmChunkSize bytes that are
+// sealed separately, so that it can be streamed. The stream starts with a random nonce prefix
+// and each sealed chunk is preceded by its length. The nonce of a chunk is the prefix followed
+// by the number of the chunk, and the last chunk is sealed with different additional data than
+// the others, so that reordered, dropped or truncated chunks fail to decrypt.
+const (
+	gcmChunkSize   = 64 << 10
+	gcmPrefixSize  = 8
+	gcmCounterSize = 4
+)
+
+var (
+	gcmChunkData = []byte{0}
+	gcmLastData  = []byte{1}
+)
+
+func newGCM(key x.SensitiveByteSlice) (cipher.AEAD, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(c)
+}
+
+// gcmNonce returns the nonce of the chunk with the given number.
+func gcmNonce(prefix []byte, chunk uint32) []byte {
+	nonce := make([]byte, gcmPrefixSize+gcmCounterSize)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[gcmPrefixSize:], chunk)
+	return nonce
+}
+
+// gcmWriter encrypts the data written to it with AES-GCM. Close must be called to write the
+// last chunk.
+type gcmWriter struct {
+	aead   cipher.AEAD
+	prefix []byte
+	chunk  uint32
+	buf    []byte
+	w      io.Writer
+}
+
+// GetGCMWriter wraps a writer that encrypts the data with AES-GCM using the input key on the
+// input Writer. The data can be decrypted with GetReaderFor and AlgorithmGCM.
+func GetGCMWriter(key x.SensitiveByteSlice, w io.Writer) (io.WriteCloser, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, gcmPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+	return &gcmWriter{aead: aead, prefix: prefix, w: w}, nil
+}
+
+func (gw *gcmWriter) Write(p []byte) (int, error) {
+	gw.buf = append(gw.buf, p...)
+	// A full chunk is kept until more data is written, as the last chunk is sealed as such.
+	for len(gw.buf) > gcmChunkSize {
+		if err := gw.seal(gw.buf[:gcmChunkSize], gcmChunkData); err != nil {
+			return 0, err
+		}
+		gw.buf = gw.buf[gcmChunkSize:]
+	}
+	return len(p), nil
+}
+
+// Close writes the last chunk, which may be empty. It doesn't close the underlying writer.
+func (gw *gcmWriter) Close() error {
+	err := gw.seal(gw.buf, gcmLastData)
+	gw.buf = nil
+	return err
+}
+
+func (gw *gcmWriter) seal(plain, data []byte) error {
+	sealed := gw.aead.Seal(nil, gcmNonce(gw.prefix, gw.chunk), plain, data)
+	gw.chunk++
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(sealed)))
+	if _, err := gw.w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := gw.w.Write(sealed)
+	return err
+}
+
+// gcmReader decrypts the data written by a gcmWriter.
+type gcmReader struct {
+	aead   cipher.AEAD
+	prefix []byte
+	chunk  uint32
+	plain  []byte
+	last   bool
+	r      io.Reader
+}
+
+func newGCMReader(key x.SensitiveByteSlice, r io.Reader) (io.Reader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, gcmPrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, errors.Wrapf(err, "unable to get nonce from encrypted backup")
+	}
+	return &gcmReader{aead: aead, prefix: prefix, r: r}, nil
+}
+
+func (gr *gcmReader) Read(p []byte) (int, error) {
+	for len(gr.plain) == 0 {
+		if gr.last {
+			return 0, io.EOF
+		}
+		if err := gr.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, gr.plain)
+	gr.plain = gr.plain[n:]
+	return n, nil
+}
+
+func (gr *gcmReader) open() error {
+	var size [4]byte
+	if _, err := io.ReadFull(gr.r, size[:]); err != nil {
+		if err == io.EOF {
+			return errors.Errorf("encrypted data ends before its last chunk")
+		}
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < uint32(gr.aead.Overhead()) || n > uint32(gcmChunkSize+gr.aead.Overhead()) {
+		return errors.Errorf("invalid size %d of encrypted chunk", n)
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(gr.r, sealed); err != nil {
+		return errors.Wrapf(err, "while reading encrypted chunk")
+	}
+	nonce := gcmNonce(gr.prefix, gr.chunk)
+	plain, err := gr.aead.Open(nil, nonce, sealed, gcmChunkData)
+	if err != nil {
+		if plain, err = gr.aead.Open(nil, nonce, sealed, gcmLastData); err != nil {
+			return errors.Errorf("unable to decrypt chunk %d. Ensure the encryption key is "+
+				"correct", gr.chunk)
+		}
+		gr.last = true
+	}
+	gr.chunk++
+	gr.plain = plain
+	return nil
+}
@@ -0,0 +1,139 @@
+// +build !oss
+
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Dgraph Community License (the "License"); you
+ * may not use this file except in compliance with the License. You
+ * may obtain a copy of the License at
+ *
+ *     https://github.com/dgraph-io/dgraph/blob/master/licenses/DCL.txt
+ */
+
+package enc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func encryptGCM(t *testing.T, key, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := GetGCMWriter(key, &buf)
+	require.NoError(t, err)
+	// Write in uneven pieces so that the chunks don't line up with the writes.
+	for len(data) > 0 {
+		n := 1000
+		if n > len(data) {
+			n = len(data)
+		}
+		_, err := w.Write(data[:n])
+		require.NoError(t, err)
+		data = data[n:]
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestGCMRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+
+	for _, size := range []int{0, 10, gcmChunkSize, gcmChunkSize + 1, 3*gcmChunkSize + 123} {
+		data := make([]byte, size)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+
+		r, err := GetReaderFor(AlgorithmGCM, key, bytes.NewReader(encryptGCM(t, key, data)))
+		require.NoError(t, err)
+		got, err := ioutil.ReadAll(r)
+		require.NoError(t, err, "size %d", size)
+		require.Equal(t, data, got, "size %d", size)
+	}
+}
+
+func TestGCMTamperedData(t *testing.T) {
+	key := make([]byte, 16)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	data := make([]byte, 2*gcmChunkSize+10)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	sealed := encryptGCM(t, key, data)
+
+	read := func(key, sealed []byte) error {
+		r, err := GetReaderFor(AlgorithmGCM, key, bytes.NewReader(sealed))
+		if err != nil {
+			return err
+		}
+		_, err = ioutil.ReadAll(r)
+		return err
+	}
+
+	// Dropping the last chunk leaves the data without its last chunk.
+	lastChunk := 4 + 10 + 16
+	err = read(key, sealed[:len(sealed)-lastChunk])
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "ends before its last chunk")
+
+	corrupted := append([]byte{}, sealed...)
+	corrupted[gcmPrefixSize+4+100] ^= 1
+	err = read(key, corrupted)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unable to decrypt chunk 0")
+
+	other := make([]byte, 16)
+	_, err = rand.Read(other)
+	require.NoError(t, err)
+	err = read(other, sealed)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Ensure the encryption key is correct")
+}
+
+func TestGetReaderForAlgorithm(t *testing.T) {
+	require.NoError(t, CheckAlgorithm(""))
+	require.NoError(t, CheckAlgorithm(AlgorithmCTR))
+	require.NoError(t, CheckAlgorithm(AlgorithmGCM))
+
+	_, err := GetReaderFor("chacha20", nil, bytes.NewReader(nil))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `unsupported encryption algorithm "chacha20"`)
+
+	// The data isn't decrypted without a key, whatever the algorithm.
+	r, err := GetReaderFor(AlgorithmGCM, nil, bytes.NewReader([]byte("plain")))
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte("plain"), got)
+}
+
+func TestGetWriterFor(t *testing.T) {
+	key := make([]byte, 16)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	data := []byte("some backup data")
+
+	for _, alg := range []string{"", AlgorithmCTR, AlgorithmGCM} {
+		var buf bytes.Buffer
+		w, err := GetWriterFor(alg, key, &buf)
+		require.NoError(t, err)
+		_, err = w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		require.NotEqual(t, data, buf.Bytes())
+
+		r, err := GetReaderFor(alg, key, &buf)
+		require.NoError(t, err)
+		got, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, data, got, "algorithm %q", alg)
+	}
+
+	_, err = GetWriterFor("chacha20", key, &bytes.Buffer{})
+	require.Error(t, err)
+}
@@ -250,8 +250,18 @@ loop:
 				}
 				continue
 			}
-			// We will try to parse the constant as an Int first, if that fails we move to float
 			child := &MathTree{}
+			if len(item.Val) > 0 && item.Val[0] == quote {
+				// A quoted value is a string constant, as in cond(a < 18, "minor", "adult").
+				s, err := unquoteIfQuoted(item.Val)
+				if err != nil {
+					return nil, false, err
+				}
+				child.Const = types.Val{Tid: types.StringID, Value: s}
+				valueStack.push(child)
+				continue
+			}
+			// We will try to parse the constant as an Int first, if that fails we move to float
 			i, err := strconv.ParseInt(item.Val, 10, 64)
 			if err != nil {
 				v, err := strconv.ParseFloat(item.Val, 64)
@@ -373,6 +383,8 @@ func (t *MathTree) stringHelper(buf *bytes.Buffer) {
 				t.Const.Value.(float64), 'E', -1, 64))
 		case types.IntID:
 			leafStr, err = buf.WriteString(strconv.FormatInt(t.Const.Value.(int64), 10))
+		case types.StringID:
+			leafStr, err = buf.WriteString(strconv.Quote(t.Const.Value.(string)))
 		}
 		x.Check2(leafStr, err)
 		return
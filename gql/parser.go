@@ -19,12 +19,15 @@ package gql
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dgraph-io/dgraph/lex"
 	"github.com/dgraph-io/dgraph/protos/pb"
+	"github.com/dgraph-io/dgraph/types"
 	"github.com/dgraph-io/dgraph/x"
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
@@ -72,6 +75,7 @@ type GraphQuery struct {
 	Facets           *pb.FacetParams
 	FacetsFilter     *FilterTree
 	GroupbyAttrs     []GroupByAttr
+	Groupby          GroupbyOptions
 	FacetVar         map[string]string
 	FacetsOrder      []*FacetOrder
 
@@ -84,6 +88,76 @@ type GraphQuery struct {
 	IsEmpty bool
 }
 
+// GroupbyOptions holds the options of the @groupby directive, as in @groupby(age, round: 2).
+// The zero value of an option means that it isn't set.
+type GroupbyOptions struct {
+	// Round is the number of decimals that float group keys are rounded to.
+	Round *int
+	// Tiers holds the tiers that numeric group keys are bucketed into.
+	Tiers *GroupbyTiers
+	// Bucket is the width of the buckets that count group keys are put in.
+	Bucket int
+	// Percent is true if each group gets the percentage of the grouped nodes in it.
+	Percent bool
+	// MinMax is the name of the aggregate whose values are normalized to [0, 1] across the
+	// groups.
+	MinMax string
+	// Cumsum is the name of the aggregate whose running total is computed across the groups
+	// ordered by their keys.
+	Cumsum string
+	// Coverage is the share of the total that the largest groups are kept until they cover,
+	// e.g. 0.8. CoverBy is the name of the aggregate the shares are measured with, or empty to
+	// measure them with the number of nodes of the groups.
+	Coverage float64
+	CoverBy  string
+	// Trim and Collapse are true if the string keys are trimmed of their leading and trailing
+	// whitespace and if their runs of whitespace are collapsed into a single space,
+	// respectively.
+	Trim     bool
+	Collapse bool
+	// Summary is true if metrics computed across the groups, like their average size, are
+	// returned along with them. Larger is the number of nodes that the groups counted as large
+	// in the summary have more of.
+	Summary bool
+	Larger  int
+	// Explain is true if the plan of the groupby, like the number of groups estimated before
+	// forming them, is returned along with the groups.
+	Explain bool
+	// MinSize is the number of nodes a group must have to be returned.
+	MinSize int
+	// PageSize is the maximum number of groups returned in a page of the results.
+	PageSize int
+	// After is the token returned with the previous page of the results, after whose last
+	// group the groups are returned.
+	After string
+	// Members is true if the uids of the members of each group are returned, encoded as a uid
+	// pack.
+	Members bool
+	// Combine is true if the nodes of all the uid lists are grouped together instead of
+	// separately for each list.
+	Combine bool
+	// ID is true if each group gets a deterministic id derived from its keys.
+	ID bool
+	// Distinct is true if only the distinct combinations of the keys are returned, without
+	// aggregating anything.
+	Distinct bool
+	// Facet is the facet on the edges of the predicate that the nodes are grouped by instead
+	// of the values of the predicate.
+	Facet string
+	// By is the unit of time that the datetime values of the predicates or of Facet are
+	// truncated to.
+	By string
+	// Geohash is the precision of the geohashes of the cells that the points of the predicates
+	// are grouped by.
+	Geohash int
+	// ValueMap holds the labels that the values of the predicates or of Facet are mapped to
+	// before they're grouped.
+	ValueMap *GroupbyValueMap
+	// Relative holds the buckets that datetime group keys are put in by their age relative to
+	// a reference datetime.
+	Relative *GroupbyRelative
+}
+
 // RecurseArgs stores the arguments needed to process the @recurse directive.
 type RecurseArgs struct {
 	Depth     uint64
@@ -107,6 +181,108 @@ type GroupByAttr struct {
 	Attr  string
 	Alias string
 	Langs []string
+	// Expand holds the argument passed to the expand function. Only _all_ is supported.
+	Expand string
+	// Has is true if the nodes are grouped by whether they have the predicate, as in has(email).
+	Has bool
+	// Lang is true if the nodes are grouped by the language tags of the values of the
+	// predicate, as in lang(name).
+	Lang bool
+	// LangCount is true if the nodes are grouped by the number of distinct languages of the
+	// values of the predicate, as in langcount(name).
+	LangCount bool
+	// Count is true if the nodes are grouped by their number of values or edges of the
+	// predicate, as in count(posts).
+	Count bool
+	// JSONPath is the path of the value that the nodes are grouped by in the JSON stored in
+	// the predicate, as in jsonpath(meta, "$.region").
+	JSONPath string
+	// Strict is true if the values of the predicate that aren't valid JSON fail the query
+	// instead of being skipped, as in jsonpath(meta, "$.region", strict: true).
+	Strict bool
+	// Regex is the regular expression whose first capture group in the value of the predicate
+	// the nodes are grouped by, as in regexcapture(email, "@(.+)$").
+	Regex string
+	// Unmatched is the key of the group of the nodes whose value doesn't match Regex, as in
+	// regexcapture(email, "@(.+)$", unmatched: "other"). They're skipped if it's empty.
+	Unmatched string
+	// MathExp is the math expression whose result the nodes are grouped by, as in
+	// segment: math(cond(a < 18, "minor", "adult")). Its variables are value variables defined
+	// in other blocks.
+	MathExp *MathTree
+	// ValueVar is the value variable whose values the nodes are grouped by, as in val(total).
+	// It's defined in another block, e.g. as an aggregate over the children of the nodes.
+	ValueVar string
+	// InVar is the variable that the nodes are grouped by whether they're in, as in
+	// in(val(cohort)). It can be a uid variable, or a value variable whose nodes are those it
+	// has a value for.
+	InVar string
+	// Compare is the comparison of two predicates whose result the nodes are grouped by, as in
+	// gt(revenue, cost).
+	Compare *GroupbyCompare
+	// Distance is the point that the nodes are grouped by the distance of the point value of
+	// the predicate from, as in distance(location, [37.77, -122.42]).
+	Distance *GroupbyDistance
+}
+
+// GroupbyDistance holds the point that the nodes are grouped by the distance from, as in
+// distance(location, [37.77, -122.42]) with bucket: 1km.
+type GroupbyDistance struct {
+	Lat, Lng float64
+	// Ring is the width in meters of the rings around the point that the distances are rounded
+	// down to, as set by the bucket of the groupby.
+	Ring float64
+}
+
+// GroupbyCompare holds a comparison of the values of two predicates of the grouped nodes, as
+// in gt(revenue, cost, unknown: true).
+type GroupbyCompare struct {
+	// Fn is the comparison, one of eq, ne, lt, le, gt or ge.
+	Fn          string
+	Left, Right string
+	// Unknown is true if the nodes that don't have a value for either predicate are grouped
+	// under unknown instead of being skipped.
+	Unknown bool
+}
+
+// groupbyComparisons holds the comparisons that can be used in countif and as a groupby key.
+var groupbyComparisons = map[string]bool{
+	"eq": true, "ne": true, "lt": true, "le": true, "gt": true, "ge": true,
+}
+
+// GroupbyTiers holds the tiers that numeric group keys are bucketed into, as in
+// @groupby(score, tiers: [0, 50, 80, 100]).
+type GroupbyTiers struct {
+	// Bounds holds the increasing boundaries of the tiers. Each tier includes its lower bound
+	// and excludes its upper bound, except for the last one which includes both.
+	Bounds []float64
+	// Outliers is true if the values outside all the tiers are grouped below the lowest tier
+	// or above the highest one instead of being skipped.
+	Outliers bool
+}
+
+// GroupbyRelative holds the buckets that datetime group keys are put in by their age relative
+// to a reference datetime, as in @groupby(created, relativeTo: now, buckets: [7d, 30d]).
+type GroupbyRelative struct {
+	// To is the reference datetime. It's ignored if Now is true.
+	To time.Time
+	// Now is true if the reference is the time the query is processed at.
+	Now bool
+	// Buckets holds the increasing upper bounds of the buckets. Each bucket includes its upper
+	// bound and excludes the one of the previous bucket.
+	Buckets []time.Duration
+	// Labels holds the labels of the buckets, as they were written in the query.
+	Labels []string
+}
+
+// GroupbyValueMap holds the labels that the values of the predicates are mapped to before
+// they're grouped, as in @groupby(status, valueMap: [1: "active", 2: "churned"]).
+type GroupbyValueMap struct {
+	// Labels maps the values, written as strings, to their labels.
+	Labels map[string]string
+	// Unmapped is the label of the values that aren't in Labels, if set. Otherwise, they're
+	// grouped by their own value.
+	Unmapped string
 }
 
 // FacetOrder stores ordering for single facet key.
@@ -730,6 +906,15 @@ func (gq *GraphQuery) collectVars(v *Vars) {
 	if gq.MathExp != nil {
 		gq.MathExp.collectVars(v)
 	}
+	for _, attr := range gq.GroupbyAttrs {
+		attr.MathExp.collectVars(v)
+		if attr.ValueVar != "" {
+			v.Needs = append(v.Needs, attr.ValueVar)
+		}
+		if attr.InVar != "" {
+			v.Needs = append(v.Needs, attr.InVar)
+		}
+	}
 
 	shortestPathFrom := gq.ShortestPathArgs.From
 	if shortestPathFrom != nil && len(shortestPathFrom.NeedsVar) > 0 {
@@ -2098,6 +2283,10 @@ func tryParseFacetList(it *lex.ItemIterator) (res facetRes, parseOk bool, err er
 func parseGroupby(it *lex.ItemIterator, gq *GraphQuery) error {
 	count := 0
 	expectArg := true
+	// optionSet holds the boolean and integer options that were set, as they can only be set
+	// once.
+	optionSet := make(map[string]bool)
+	var ring float64
 	it.Next()
 	item := it.Item()
 	alias := ""
@@ -2126,6 +2315,387 @@ loop:
 			if err != nil {
 				return err
 			}
+			if isExpandFunc(strings.ToLower(val)) && peekIt[0].Typ == itemLeftRound {
+				if alias != "" {
+					return item.Errorf("expand() cannot have an alias in groupby")
+				}
+				attr, err := parseGroupbyExpand(it)
+				if err != nil {
+					return err
+				}
+				gq.GroupbyAttrs = append(gq.GroupbyAttrs, attr)
+				count++
+				expectArg = false
+				continue
+			}
+			if val == "has" && peekIt[0].Typ == itemLeftRound {
+				attr, err := parseGroupbyHas(it)
+				if err != nil {
+					return err
+				}
+				attr.Alias = alias
+				alias = ""
+				gq.GroupbyAttrs = append(gq.GroupbyAttrs, attr)
+				count++
+				expectArg = false
+				continue
+			}
+			if val == "lang" && peekIt[0].Typ == itemLeftRound {
+				attr, err := parseGroupbyLang(it)
+				if err != nil {
+					return err
+				}
+				attr.Alias = alias
+				alias = ""
+				gq.GroupbyAttrs = append(gq.GroupbyAttrs, attr)
+				count++
+				expectArg = false
+				continue
+			}
+			if val == "langcount" && peekIt[0].Typ == itemLeftRound {
+				attr, err := parseGroupbyLangCount(it)
+				if err != nil {
+					return err
+				}
+				attr.Alias = alias
+				alias = ""
+				gq.GroupbyAttrs = append(gq.GroupbyAttrs, attr)
+				count++
+				expectArg = false
+				continue
+			}
+			if val == "count" && peekIt[0].Typ == itemLeftRound {
+				attr, err := parseGroupbyCount(it)
+				if err != nil {
+					return err
+				}
+				attr.Alias = alias
+				alias = ""
+				gq.GroupbyAttrs = append(gq.GroupbyAttrs, attr)
+				count++
+				expectArg = false
+				continue
+			}
+			if val == "jsonpath" && peekIt[0].Typ == itemLeftRound {
+				attr, err := parseGroupbyJSONPath(it)
+				if err != nil {
+					return err
+				}
+				attr.Alias = alias
+				alias = ""
+				gq.GroupbyAttrs = append(gq.GroupbyAttrs, attr)
+				count++
+				expectArg = false
+				continue
+			}
+			if val == "regexcapture" && peekIt[0].Typ == itemLeftRound {
+				attr, err := parseGroupbyRegexCapture(it)
+				if err != nil {
+					return err
+				}
+				attr.Alias = alias
+				alias = ""
+				gq.GroupbyAttrs = append(gq.GroupbyAttrs, attr)
+				count++
+				expectArg = false
+				continue
+			}
+			if groupbyComparisons[val] && peekIt[0].Typ == itemLeftRound {
+				attr, err := parseGroupbyCompare(it, val)
+				if err != nil {
+					return err
+				}
+				attr.Alias = alias
+				alias = ""
+				gq.GroupbyAttrs = append(gq.GroupbyAttrs, attr)
+				count++
+				expectArg = false
+				continue
+			}
+			if val == "distance" && peekIt[0].Typ == itemLeftRound {
+				attr, err := parseGroupbyDistance(it)
+				if err != nil {
+					return err
+				}
+				attr.Alias = alias
+				alias = ""
+				gq.GroupbyAttrs = append(gq.GroupbyAttrs, attr)
+				count++
+				expectArg = false
+				continue
+			}
+			if val == valueFunc && peekIt[0].Typ == itemLeftRound {
+				attr, err := parseGroupbyVal(it)
+				if err != nil {
+					return err
+				}
+				attr.Alias = alias
+				alias = ""
+				gq.GroupbyAttrs = append(gq.GroupbyAttrs, attr)
+				count++
+				expectArg = false
+				continue
+			}
+			if val == "in" && peekIt[0].Typ == itemLeftRound {
+				attr, err := parseGroupbyIn(it)
+				if err != nil {
+					return err
+				}
+				attr.Alias = alias
+				alias = ""
+				gq.GroupbyAttrs = append(gq.GroupbyAttrs, attr)
+				count++
+				expectArg = false
+				continue
+			}
+			if val == "math" && peekIt[0].Typ == itemLeftRound {
+				if alias == "" {
+					return item.Errorf("math() in groupby must have an alias")
+				}
+				mathExp, again, err := parseMathFunc(it, false)
+				if err != nil {
+					return err
+				}
+				if again {
+					return item.Errorf("Comma encountered in math() at unexpected place.")
+				}
+				attr := GroupByAttr{Alias: alias, MathExp: mathExp}
+				alias = ""
+				gq.GroupbyAttrs = append(gq.GroupbyAttrs, attr)
+				count++
+				expectArg = false
+				continue
+			}
+			if opt, ok := groupbyIntOptions[val]; ok && peekIt[0].Typ == itemColon && alias == "" {
+				v, ok, err := parseGroupbyIntOption(it, val, opt.min, opt.max)
+				if err != nil {
+					return err
+				}
+				if ok {
+					if optionSet[val] {
+						return item.Errorf("%s can only be specified once in groupby", val)
+					}
+					opt.set(&gq.Groupby, v)
+					optionSet[val] = true
+					expectArg = false
+					continue
+				}
+			}
+			if val == "tiers" && peekIt[0].Typ == itemColon && alias == "" {
+				bounds, ok, err := parseGroupbyTiers(it)
+				if err != nil {
+					return err
+				}
+				if ok {
+					if gq.Groupby.Tiers == nil {
+						gq.Groupby.Tiers = &GroupbyTiers{}
+					}
+					if len(gq.Groupby.Tiers.Bounds) > 0 {
+						return item.Errorf("tiers can only be specified once in groupby")
+					}
+					gq.Groupby.Tiers.Bounds = bounds
+					expectArg = false
+					continue
+				}
+			}
+			if val == "bucket" && peekIt[0].Typ == itemColon && alias == "" {
+				width, ok, err := parseGroupbyRing(it)
+				if err != nil {
+					return err
+				}
+				if ok {
+					if optionSet[val] {
+						return item.Errorf("bucket can only be specified once in groupby")
+					}
+					ring = width
+					optionSet[val] = true
+					expectArg = false
+					continue
+				}
+			}
+			if set, ok := groupbyBoolOptions[val]; ok && peekIt[0].Typ == itemColon && alias == "" {
+				v, ok, err := parseGroupbyBoolOption(it)
+				if err != nil {
+					return err
+				}
+				if ok {
+					if optionSet[val] {
+						return item.Errorf("%s can only be specified once in groupby", val)
+					}
+					set(&gq.Groupby, v)
+					optionSet[val] = true
+					expectArg = false
+					continue
+				}
+			}
+			if val == "facet" && peekIt[0].Typ == itemColon && alias == "" {
+				key, ok, err := parseGroupbyFacet(it)
+				if err != nil {
+					return err
+				}
+				if ok {
+					if gq.Groupby.Facet != "" {
+						return item.Errorf("facet can only be specified once in groupby")
+					}
+					gq.Groupby.Facet = key
+					expectArg = false
+					continue
+				}
+			}
+			if val == "by" && peekIt[0].Typ == itemColon && alias == "" {
+				unit, ok, err := parseGroupbyBy(it)
+				if err != nil {
+					return err
+				}
+				if ok {
+					if gq.Groupby.By != "" {
+						return item.Errorf("by can only be specified once in groupby")
+					}
+					gq.Groupby.By = unit
+					expectArg = false
+					continue
+				}
+			}
+			if val == "valueMap" && peekIt[0].Typ == itemColon && alias == "" {
+				labels, ok, err := parseGroupbyValueMap(it)
+				if err != nil {
+					return err
+				}
+				if ok {
+					if gq.Groupby.ValueMap == nil {
+						gq.Groupby.ValueMap = &GroupbyValueMap{}
+					}
+					if len(gq.Groupby.ValueMap.Labels) > 0 {
+						return item.Errorf("valueMap can only be specified once in groupby")
+					}
+					gq.Groupby.ValueMap.Labels = labels
+					expectArg = false
+					continue
+				}
+			}
+			if val == "unmapped" && peekIt[0].Typ == itemColon && alias == "" {
+				label, ok, err := parseGroupbyUnmapped(it)
+				if err != nil {
+					return err
+				}
+				if ok {
+					if gq.Groupby.ValueMap == nil {
+						gq.Groupby.ValueMap = &GroupbyValueMap{}
+					}
+					if gq.Groupby.ValueMap.Unmapped != "" {
+						return item.Errorf("unmapped can only be specified once in groupby")
+					}
+					gq.Groupby.ValueMap.Unmapped = label
+					expectArg = false
+					continue
+				}
+			}
+			if val == "relativeTo" && peekIt[0].Typ == itemColon && alias == "" {
+				to, now, ok, err := parseGroupbyRelativeTo(it)
+				if err != nil {
+					return err
+				}
+				if ok {
+					if gq.Groupby.Relative == nil {
+						gq.Groupby.Relative = &GroupbyRelative{}
+					}
+					if gq.Groupby.Relative.Now || !gq.Groupby.Relative.To.IsZero() {
+						return item.Errorf("relativeTo can only be specified once in groupby")
+					}
+					gq.Groupby.Relative.To = to
+					gq.Groupby.Relative.Now = now
+					expectArg = false
+					continue
+				}
+			}
+			if val == "buckets" && peekIt[0].Typ == itemColon && alias == "" {
+				buckets, labels, ok, err := parseGroupbyBuckets(it)
+				if err != nil {
+					return err
+				}
+				if ok {
+					if gq.Groupby.Relative == nil {
+						gq.Groupby.Relative = &GroupbyRelative{}
+					}
+					if len(gq.Groupby.Relative.Buckets) > 0 {
+						return item.Errorf("buckets can only be specified once in groupby")
+					}
+					gq.Groupby.Relative.Buckets = buckets
+					gq.Groupby.Relative.Labels = labels
+					expectArg = false
+					continue
+				}
+			}
+			if val == "minmax" && peekIt[0].Typ == itemColon && alias == "" {
+				name, ok, err := parseGroupbyMinMax(it)
+				if err != nil {
+					return err
+				}
+				if ok {
+					if gq.Groupby.MinMax != "" {
+						return item.Errorf("minmax can only be specified once in groupby")
+					}
+					gq.Groupby.MinMax = name
+					expectArg = false
+					continue
+				}
+			}
+			if val == "cumulative" && peekIt[0].Typ == itemColon && alias == "" {
+				name, ok, err := parseGroupbyCumulative(it)
+				if err != nil {
+					return err
+				}
+				if ok {
+					if gq.Groupby.Cumsum != "" {
+						return item.Errorf("cumulative can only be specified once in groupby")
+					}
+					gq.Groupby.Cumsum = name
+					expectArg = false
+					continue
+				}
+			}
+			if val == "coverage" && peekIt[0].Typ == itemColon && alias == "" {
+				coverage, ok, err := parseGroupbyCoverage(it)
+				if err != nil {
+					return err
+				}
+				if ok {
+					if gq.Groupby.Coverage != 0 {
+						return item.Errorf("coverage can only be specified once in groupby")
+					}
+					gq.Groupby.Coverage = coverage
+					expectArg = false
+					continue
+				}
+			}
+			if val == "coverageBy" && peekIt[0].Typ == itemColon && alias == "" {
+				name, ok, err := parseGroupbyCoverageBy(it)
+				if err != nil {
+					return err
+				}
+				if ok {
+					if gq.Groupby.CoverBy != "" {
+						return item.Errorf("coverageBy can only be specified once in groupby")
+					}
+					gq.Groupby.CoverBy = name
+					expectArg = false
+					continue
+				}
+			}
+			if val == "after" && peekIt[0].Typ == itemColon && alias == "" {
+				token, ok, err := parseGroupbyAfter(it)
+				if err != nil {
+					return err
+				}
+				if ok {
+					if gq.Groupby.After != "" {
+						return item.Errorf("after can only be specified once in groupby")
+					}
+					gq.Groupby.After = token
+					expectArg = false
+					continue
+				}
+			}
 			if peekIt[0].Typ == itemColon {
 				if alias != "" {
 					return item.Errorf("Expected predicate after %s:", alias)
@@ -2166,19 +2736,1332 @@ loop:
 	if count == 0 {
 		return item.Errorf("Expected atleast one attribute in groupby")
 	}
+	if gq.Groupby.Tiers != nil && len(gq.Groupby.Tiers.Bounds) == 0 {
+		return item.Errorf("outliers can only be specified along with tiers in groupby")
+	}
+	if gq.Groupby.ValueMap != nil && len(gq.Groupby.ValueMap.Labels) == 0 {
+		return item.Errorf("unmapped can only be specified along with valueMap in groupby")
+	}
+	var hasDistance bool
+	for i := range gq.GroupbyAttrs {
+		if dist := gq.GroupbyAttrs[i].Distance; dist != nil {
+			if ring == 0 {
+				return item.Errorf("distance() in groupby requires a bucket with a unit of " +
+					"distance, e.g. bucket: 1km")
+			}
+			dist.Ring = ring
+			hasDistance = true
+		}
+	}
+	if ring != 0 && !hasDistance {
+		return item.Errorf("a bucket with a unit of distance can only be specified along with " +
+			"distance() in groupby")
+	}
+	if gq.Groupby.Bucket != 0 {
+		var hasCount bool
+		for _, attr := range gq.GroupbyAttrs {
+			hasCount = hasCount || attr.Count
+		}
+		if !hasCount {
+			return item.Errorf("bucket can only be specified along with count() in groupby")
+		}
+		if gq.Groupby.Tiers != nil {
+			return item.Errorf("bucket and tiers can't both be specified in groupby")
+		}
+	}
+	if rel := gq.Groupby.Relative; rel != nil {
+		if len(rel.Buckets) == 0 || (!rel.Now && rel.To.IsZero()) {
+			return item.Errorf("relativeTo and buckets must be specified together in groupby")
+		}
+		if gq.Groupby.By != "" {
+			return item.Errorf("by and buckets can't both be specified in groupby")
+		}
+	}
+	if gq.Groupby.Distinct && (gq.Groupby.Percent || gq.Groupby.MinMax != "") {
+		return item.Errorf("distinct can't be specified along with percent or minmax in groupby")
+	}
+	if gq.Groupby.Distinct && gq.Groupby.Cumsum != "" {
+		return item.Errorf("distinct can't be specified along with cumulative in groupby")
+	}
+	if gq.Groupby.Larger != 0 && !gq.Groupby.Summary {
+		return item.Errorf("largerThan can only be specified along with summary in groupby")
+	}
+	if gq.Groupby.CoverBy != "" && gq.Groupby.Coverage == 0 {
+		return item.Errorf("coverageBy can only be specified along with coverage in groupby")
+	}
+	if gq.Groupby.Coverage != 0 {
+		// The groups are ordered by their share of the total to keep the largest ones, which
+		// the options ordering them by their keys would undo.
+		if gq.Groupby.Distinct || gq.Groupby.Cumsum != "" || gq.Groupby.PageSize > 0 ||
+			gq.Groupby.After != "" {
+			return item.Errorf("coverage can't be specified along with distinct, cumulative, " +
+				"pageSize or after in groupby")
+		}
+		for _, attr := range gq.GroupbyAttrs {
+			if attr.Expand != "" {
+				return item.Errorf("coverage can't be specified along with expand() in groupby")
+			}
+		}
+	}
+	if gq.Groupby.Distinct && gq.Groupby.Members {
+		// The distinct groups are deduplicated by their keys, so their members are incomplete.
+		return item.Errorf("distinct can't be specified along with members in groupby")
+	}
+	if gq.Groupby.Facet != "" {
+		attr := gq.GroupbyAttrs[0]
+		if count > 1 || attr.Attr == "" || attr.Has || attr.Lang || attr.LangCount || attr.Count ||
+			attr.JSONPath != "" || attr.Regex != "" || attr.Expand != "" || attr.Distance != nil {
+			return item.Errorf("facet can only be specified when grouping by a single " +
+				"predicate")
+		}
+	}
+	for _, attr := range gq.GroupbyAttrs {
+		if attr.Expand != "" && count > 1 {
+			return item.Errorf("expand() must be the only attribute in groupby")
+		}
+	}
 	return nil
 }
 
-// parseFilter parses the filter directive to produce a QueryFilter / parse tree.
-func parseFilter(it *lex.ItemIterator) (*FilterTree, error) {
-	it.Next()
-	item := it.Item()
-	if item.Typ != itemLeftRound {
-		return nil, item.Errorf("Expected ( after filter directive")
+// groupbyBoolOptions maps the boolean options of the groupby directive, e.g. percent: true, to
+// the functions setting them.
+var groupbyBoolOptions = map[string]func(opts *GroupbyOptions, v bool){
+	"percent":        func(opts *GroupbyOptions, v bool) { opts.Percent = v },
+	"trim":           func(opts *GroupbyOptions, v bool) { opts.Trim = v },
+	"collapseSpaces": func(opts *GroupbyOptions, v bool) { opts.Collapse = v },
+	"summary":        func(opts *GroupbyOptions, v bool) { opts.Summary = v },
+	"explain":        func(opts *GroupbyOptions, v bool) { opts.Explain = v },
+	"combine":        func(opts *GroupbyOptions, v bool) { opts.Combine = v },
+	"groupId":        func(opts *GroupbyOptions, v bool) { opts.ID = v },
+	"members":        func(opts *GroupbyOptions, v bool) { opts.Members = v },
+	"distinct":       func(opts *GroupbyOptions, v bool) { opts.Distinct = v },
+	"outliers": func(opts *GroupbyOptions, v bool) {
+		if opts.Tiers == nil {
+			opts.Tiers = &GroupbyTiers{}
+		}
+		opts.Tiers.Outliers = v
+	},
+}
+
+// parseGroupbyBoolOption parses the value of one of groupbyBoolOptions inside the groupby
+// directive, which is true or false. It returns false without consuming anything if the option
+// is followed by a predicate instead, in which case its name is an alias.
+func parseGroupbyBoolOption(it *lex.ItemIterator) (bool, bool, error) {
+	items, err := it.Peek(2)
+	if err != nil {
+		return false, false, err
+	}
+	if items[1].Typ != itemName || (items[1].Val != "true" && items[1].Val != "false") {
+		return false, false, nil
 	}
+	it.Next() // Consume the itemColon
+	it.Next()
+	return items[1].Val == "true", true, nil
+}
 
-	// opStack is used to collect the operators in right order.
-	opStack := new(filterTreeStack)
+// groupbyIntOption is an integer option of the groupby directive, e.g. round: 2, whose value
+// must be between min and max.
+type groupbyIntOption struct {
+	min, max int
+	set      func(opts *GroupbyOptions, v int)
+}
+
+// groupbyIntOptions maps the integer options of the groupby directive to their bounds and the
+// functions setting them. A bucket that's a distance, e.g. bucket: 1km, is parsed by
+// parseGroupbyRing instead.
+var groupbyIntOptions = map[string]groupbyIntOption{
+	"round":      {0, maxGroupbyRound, func(opts *GroupbyOptions, v int) { opts.Round = &v }},
+	"bucket":     {1, math.MaxInt32, func(opts *GroupbyOptions, v int) { opts.Bucket = v }},
+	"largerThan": {1, math.MaxInt32, func(opts *GroupbyOptions, v int) { opts.Larger = v }},
+	"geohash":    {1, maxGeohashPrecision, func(opts *GroupbyOptions, v int) { opts.Geohash = v }},
+	"minSize":    {1, math.MaxInt32, func(opts *GroupbyOptions, v int) { opts.MinSize = v }},
+	"pageSize":   {1, math.MaxInt32, func(opts *GroupbyOptions, v int) { opts.PageSize = v }},
+}
+
+// parseGroupbyIntOption parses the value of the integer option name inside the groupby
+// directive, which must be between min and max. It returns false without consuming anything if
+// the option isn't followed by an integer, in which case its name is an alias.
+func parseGroupbyIntOption(it *lex.ItemIterator, name string, min, max int) (int, bool, error) {
+	items, err := it.Peek(2)
+	if err != nil {
+		return 0, false, err
+	}
+	if items[1].Typ != itemName {
+		return 0, false, nil
+	}
+	n, err := strconv.Atoi(items[1].Val)
+	if err != nil {
+		return 0, false, nil
+	}
+	it.Next() // Consume the itemColon
+	it.Next()
+	switch {
+	case n >= min && n <= max:
+		return n, true, nil
+	case min == 1 && max == math.MaxInt32:
+		return 0, false, it.Item().Errorf("%s in groupby must be a positive integer, but got %d",
+			name, n)
+	default:
+		return 0, false, it.Item().Errorf("%s in groupby must be between %d and %d, but got %d",
+			name, min, max, n)
+	}
+}
+
+// parseGroupbyExpand parses expand(_all_) inside the groupby directive. Each of the predicates
+// it expands to gets grouped on its own.
+func parseGroupbyExpand(it *lex.ItemIterator) (GroupByAttr, error) {
+	it.Next() // Consume the '('
+	it.Next()
+	item := it.Item()
+	if item.Typ != itemName || item.Val != "_all_" {
+		return GroupByAttr{}, item.Errorf("Only expand(_all_) is supported in groupby")
+	}
+	it.Next()
+	if item = it.Item(); item.Typ != itemRightRound {
+		return GroupByAttr{}, item.Errorf("Expected a right round after expand(_all_)")
+	}
+	return GroupByAttr{Attr: "expand", Expand: "_all_"}, nil
+}
+
+// parseGroupbyHas parses has(predicate) inside the groupby directive. The nodes are grouped
+// by whether they have the predicate or not.
+func parseGroupbyHas(it *lex.ItemIterator) (GroupByAttr, error) {
+	it.Next() // Consume the '('
+	it.Next()
+	item := it.Item()
+	if item.Typ != itemName {
+		return GroupByAttr{}, item.Errorf("Expected a predicate in has() but got: %v", item.Val)
+	}
+	attr := collectName(it, item.Val)
+	it.Next()
+	if item = it.Item(); item.Typ != itemRightRound {
+		return GroupByAttr{}, item.Errorf("Expected a right round after has(%s)", attr)
+	}
+	return GroupByAttr{Attr: attr, Has: true}, nil
+}
+
+// parseGroupbyLang parses lang(predicate) inside the groupby directive. The nodes are grouped
+// by the language tags of the values of the predicate.
+func parseGroupbyLang(it *lex.ItemIterator) (GroupByAttr, error) {
+	it.Next() // Consume the '('
+	it.Next()
+	item := it.Item()
+	if item.Typ != itemName {
+		return GroupByAttr{}, item.Errorf("Expected a predicate in lang() but got: %v", item.Val)
+	}
+	attr := collectName(it, item.Val)
+	it.Next()
+	if item = it.Item(); item.Typ != itemRightRound {
+		return GroupByAttr{}, item.Errorf("Expected a right round after lang(%s)", attr)
+	}
+	return GroupByAttr{Attr: attr, Lang: true}, nil
+}
+
+// parseGroupbyLangCount parses langcount(predicate) inside the groupby directive. The nodes are
+// grouped by the number of distinct languages of the values of the predicate.
+func parseGroupbyLangCount(it *lex.ItemIterator) (GroupByAttr, error) {
+	it.Next() // Consume the '('
+	it.Next()
+	item := it.Item()
+	if item.Typ != itemName {
+		return GroupByAttr{}, item.Errorf("Expected a predicate in langcount() but got: %v",
+			item.Val)
+	}
+	attr := collectName(it, item.Val)
+	it.Next()
+	if item = it.Item(); item.Typ != itemRightRound {
+		return GroupByAttr{}, item.Errorf("Expected a right round after langcount(%s)", attr)
+	}
+	return GroupByAttr{Attr: attr, LangCount: true}, nil
+}
+
+// parseGroupbyVal parses val(x) inside the groupby directive. The nodes are grouped by the
+// values of the value variable x.
+func parseGroupbyVal(it *lex.ItemIterator) (GroupByAttr, error) {
+	it.Next() // Consume the '('
+	it.Next()
+	item := it.Item()
+	if item.Typ != itemName {
+		return GroupByAttr{}, item.Errorf("Expected a variable in val() but got: %v", item.Val)
+	}
+	name := item.Val
+	it.Next()
+	if item = it.Item(); item.Typ != itemRightRound {
+		return GroupByAttr{}, item.Errorf("Expected a right round after val(%s)", name)
+	}
+	return GroupByAttr{ValueVar: name}, nil
+}
+
+// parseGroupbyIn parses in(val(x)) inside the groupby directive. The nodes are grouped by
+// whether they're in the variable x.
+func parseGroupbyIn(it *lex.ItemIterator) (GroupByAttr, error) {
+	it.Next() // Consume the '('
+	it.Next()
+	item := it.Item()
+	if item.Typ != itemName || item.Val != valueFunc {
+		return GroupByAttr{}, item.Errorf("Expected val() in in() but got: %v", item.Val)
+	}
+	if !it.Next() || it.Item().Typ != itemLeftRound {
+		return GroupByAttr{}, it.Item().Errorf("Expected a left round after val in in()")
+	}
+	it.Next()
+	item = it.Item()
+	if item.Typ != itemName {
+		return GroupByAttr{}, item.Errorf("Expected a variable in in(val()) but got: %v",
+			item.Val)
+	}
+	name := item.Val
+	it.Next()
+	if item = it.Item(); item.Typ != itemRightRound {
+		return GroupByAttr{}, item.Errorf("Expected a right round after val(%s)", name)
+	}
+	it.Next()
+	if item = it.Item(); item.Typ != itemRightRound {
+		return GroupByAttr{}, item.Errorf("Expected a right round after in(val(%s))", name)
+	}
+	return GroupByAttr{InVar: name}, nil
+}
+
+// parseGroupbyCount parses count(predicate) inside the groupby directive. The nodes are grouped
+// by their number of values or edges of the predicate.
+func parseGroupbyCount(it *lex.ItemIterator) (GroupByAttr, error) {
+	it.Next() // Consume the '('
+	it.Next()
+	item := it.Item()
+	if item.Typ != itemName {
+		return GroupByAttr{}, item.Errorf("Expected a predicate in count() but got: %v", item.Val)
+	}
+	attr := collectName(it, item.Val)
+	if attr == "uid" {
+		return GroupByAttr{}, item.Errorf("Can't group by count(uid)")
+	}
+	it.Next()
+	if item = it.Item(); item.Typ != itemRightRound {
+		return GroupByAttr{}, item.Errorf("Expected a right round after count(%s)", attr)
+	}
+	return GroupByAttr{Attr: attr, Count: true}, nil
+}
+
+// parseGroupbyJSONPath parses jsonpath(predicate, "path") inside the groupby directive, which
+// can be followed by strict: true. The nodes are grouped by the value at the path in the JSON
+// stored in the predicate.
+func parseGroupbyJSONPath(it *lex.ItemIterator) (GroupByAttr, error) {
+	it.Next() // Consume the '('
+	it.Next()
+	item := it.Item()
+	if item.Typ != itemName {
+		return GroupByAttr{}, item.Errorf("Expected a predicate in jsonpath() but got: %v",
+			item.Val)
+	}
+	attr := GroupByAttr{Attr: collectName(it, item.Val)}
+	it.Next()
+	if item = it.Item(); item.Typ != itemComma {
+		return GroupByAttr{}, item.Errorf("Expected a comma after the predicate in jsonpath(%s)",
+			attr.Attr)
+	}
+	it.Next()
+	item = it.Item()
+	if item.Typ != itemName || len(item.Val) < 2 || item.Val[0] != quote {
+		return GroupByAttr{}, item.Errorf("Expected a quoted path in jsonpath(%s) but got: %v",
+			attr.Attr, item.Val)
+	}
+	path, err := unquoteIfQuoted(item.Val)
+	if err != nil {
+		return GroupByAttr{}, err
+	}
+	attr.JSONPath = path
+
+	it.Next()
+	item = it.Item()
+	if item.Typ == itemComma {
+		it.Next()
+		if item = it.Item(); item.Typ != itemName || item.Val != "strict" {
+			return GroupByAttr{}, item.Errorf("Expected strict in jsonpath(%s) but got: %v",
+				attr.Attr, item.Val)
+		}
+		it.Next()
+		if item = it.Item(); item.Typ != itemColon {
+			return GroupByAttr{}, item.Errorf("Expected a colon after strict in jsonpath(%s)",
+				attr.Attr)
+		}
+		it.Next()
+		item = it.Item()
+		strict, err := strconv.ParseBool(item.Val)
+		if item.Typ != itemName || err != nil {
+			return GroupByAttr{}, item.Errorf("Expected true or false for strict in "+
+				"jsonpath(%s) but got: %v", attr.Attr, item.Val)
+		}
+		attr.Strict = strict
+		it.Next()
+		item = it.Item()
+	}
+	if item.Typ != itemRightRound {
+		return GroupByAttr{}, item.Errorf("Expected a right round after jsonpath(%s)", attr.Attr)
+	}
+	return attr, nil
+}
+
+// parseGroupbyRegexCapture parses regexcapture(predicate, "regex") inside the groupby directive,
+// which can be followed by unmatched: "label". The nodes are grouped by the first capture group
+// of the regex in the value of the predicate.
+func parseGroupbyRegexCapture(it *lex.ItemIterator) (GroupByAttr, error) {
+	it.Next() // Consume the '('
+	it.Next()
+	item := it.Item()
+	if item.Typ != itemName {
+		return GroupByAttr{}, item.Errorf("Expected a predicate in regexcapture() but got: %v",
+			item.Val)
+	}
+	attr := GroupByAttr{Attr: collectName(it, item.Val)}
+	it.Next()
+	if item = it.Item(); item.Typ != itemComma {
+		return GroupByAttr{}, item.Errorf("Expected a comma after the predicate in "+
+			"regexcapture(%s)", attr.Attr)
+	}
+	it.Next()
+	item = it.Item()
+	if item.Typ != itemName || len(item.Val) < 2 || item.Val[0] != quote {
+		return GroupByAttr{}, item.Errorf("Expected a quoted regex in regexcapture(%s) but "+
+			"got: %v", attr.Attr, item.Val)
+	}
+	regex, err := unquoteIfQuoted(item.Val)
+	if err != nil {
+		return GroupByAttr{}, err
+	}
+	if regex == "" {
+		return GroupByAttr{}, item.Errorf("The regex in regexcapture(%s) can't be empty",
+			attr.Attr)
+	}
+	attr.Regex = regex
+
+	it.Next()
+	item = it.Item()
+	if item.Typ == itemComma {
+		it.Next()
+		if item = it.Item(); item.Typ != itemName || item.Val != "unmatched" {
+			return GroupByAttr{}, item.Errorf("Expected unmatched in regexcapture(%s) but "+
+				"got: %v", attr.Attr, item.Val)
+		}
+		it.Next()
+		if item = it.Item(); item.Typ != itemColon {
+			return GroupByAttr{}, item.Errorf("Expected a colon after unmatched in "+
+				"regexcapture(%s)", attr.Attr)
+		}
+		it.Next()
+		item = it.Item()
+		if item.Typ != itemName || len(item.Val) < 2 || item.Val[0] != quote {
+			return GroupByAttr{}, item.Errorf("Expected a quoted label for unmatched in "+
+				"regexcapture(%s) but got: %v", attr.Attr, item.Val)
+		}
+		if attr.Unmatched, err = unquoteIfQuoted(item.Val); err != nil {
+			return GroupByAttr{}, err
+		}
+		it.Next()
+		item = it.Item()
+	}
+	if item.Typ != itemRightRound {
+		return GroupByAttr{}, item.Errorf("Expected a right round after regexcapture(%s)",
+			attr.Attr)
+	}
+	return attr, nil
+}
+
+// parseGroupbyDistance parses distance(predicate, [lat, lng]) inside the groupby directive. The
+// nodes are grouped by the distance of the point value of the predicate from the given point,
+// rounded down to the rings set by the bucket of the groupby.
+func parseGroupbyDistance(it *lex.ItemIterator) (GroupByAttr, error) {
+	it.Next() // Consume the '('
+	it.Next()
+	item := it.Item()
+	if item.Typ != itemName {
+		return GroupByAttr{}, item.Errorf("Expected a predicate in distance() but got: %v",
+			item.Val)
+	}
+	attr := GroupByAttr{Attr: collectName(it, item.Val)}
+	it.Next()
+	if item = it.Item(); item.Typ != itemComma {
+		return GroupByAttr{}, item.Errorf("Expected a comma after the predicate in "+
+			"distance(%s)", attr.Attr)
+	}
+	it.Next()
+	if item = it.Item(); item.Typ != itemLeftSquare {
+		return GroupByAttr{}, item.Errorf("Expected a point like [lat, lng] in distance(%s) "+
+			"but got: %v", attr.Attr, item.Val)
+	}
+
+	var coords []float64
+	expectArg := true
+	for it.Next() {
+		item = it.Item()
+		if item.Typ == itemRightSquare && !expectArg {
+			break
+		}
+		switch {
+		case item.Typ == itemComma && !expectArg:
+			expectArg = true
+		case (item.Typ == itemName || (item.Typ == itemMathOp && item.Val == "-")) && expectArg:
+			val := item.Val
+			if item.Typ == itemMathOp {
+				// The sign of a negative coordinate is lexed on its own.
+				it.Next()
+				val += it.Item().Val
+			}
+			coord, err := strconv.ParseFloat(val, 64)
+			if err != nil || math.IsNaN(coord) {
+				return GroupByAttr{}, item.Errorf("Expected a number in the point of "+
+					"distance(%s) but got: %v", attr.Attr, val)
+			}
+			coords = append(coords, coord)
+			expectArg = false
+		default:
+			return GroupByAttr{}, item.Errorf("Unexpected %v in the point of distance(%s)",
+				item.Val, attr.Attr)
+		}
+	}
+	if item.Typ != itemRightSquare {
+		return GroupByAttr{}, it.Errorf("Expected a right square bracket after the point of "+
+			"distance(%s)", attr.Attr)
+	}
+	if len(coords) != 2 {
+		return GroupByAttr{}, item.Errorf("The point of distance(%s) must be a latitude and a "+
+			"longitude, but got %d numbers", attr.Attr, len(coords))
+	}
+	lat, lng := coords[0], coords[1]
+	if lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return GroupByAttr{}, item.Errorf("The point of distance(%s) must have a latitude "+
+			"between -90 and 90 and a longitude between -180 and 180, but got [%v, %v]",
+			attr.Attr, lat, lng)
+	}
+	attr.Distance = &GroupbyDistance{Lat: lat, Lng: lng}
+
+	it.Next()
+	if item = it.Item(); item.Typ != itemRightRound {
+		return GroupByAttr{}, item.Errorf("Expected a right round after distance(%s)", attr.Attr)
+	}
+	return attr, nil
+}
+
+// parseGroupbyCompare parses a comparison of two predicates like gt(revenue, cost) inside the
+// groupby directive, which can be followed by unknown: true. The nodes are grouped by whether
+// the value of the first predicate compares to the value of the second one as fn says.
+func parseGroupbyCompare(it *lex.ItemIterator, fn string) (GroupByAttr, error) {
+	it.Next() // Consume the '('
+	cmp := &GroupbyCompare{Fn: fn}
+	for i, pred := range []*string{&cmp.Left, &cmp.Right} {
+		it.Next()
+		item := it.Item()
+		if item.Typ != itemName {
+			return GroupByAttr{}, item.Errorf("Expected a predicate in %s() but got: %v",
+				fn, item.Val)
+		}
+		*pred = collectName(it, item.Val)
+		if *pred == "uid" {
+			return GroupByAttr{}, item.Errorf("Can't compare uid in %s() in groupby", fn)
+		}
+		it.Next()
+		if item = it.Item(); i == 0 && item.Typ != itemComma {
+			return GroupByAttr{}, item.Errorf("Expected two predicates in %s(%s)",
+				fn, cmp.Left)
+		}
+	}
+
+	item := it.Item()
+	if item.Typ == itemComma {
+		it.Next()
+		if item = it.Item(); item.Typ != itemName || item.Val != "unknown" {
+			return GroupByAttr{}, item.Errorf("Expected unknown in %s(%s, %s) but got: %v",
+				fn, cmp.Left, cmp.Right, item.Val)
+		}
+		it.Next()
+		if item = it.Item(); item.Typ != itemColon {
+			return GroupByAttr{}, item.Errorf("Expected a colon after unknown in %s(%s, %s)",
+				fn, cmp.Left, cmp.Right)
+		}
+		it.Next()
+		item = it.Item()
+		unknown, err := strconv.ParseBool(item.Val)
+		if item.Typ != itemName || err != nil {
+			return GroupByAttr{}, item.Errorf("Expected true or false for unknown in "+
+				"%s(%s, %s) but got: %v", fn, cmp.Left, cmp.Right, item.Val)
+		}
+		cmp.Unknown = unknown
+		it.Next()
+		item = it.Item()
+	}
+	if item.Typ != itemRightRound {
+		return GroupByAttr{}, item.Errorf("Expected a right round after %s(%s, %s)",
+			fn, cmp.Left, cmp.Right)
+	}
+	return GroupByAttr{Compare: cmp}, nil
+}
+
+// parseGroupbyTopk parses topk(uid, by: val(x), k: N) inside a groupby block into child. The
+// uids of each group are ranked by the value variable x and the N uids with the highest values
+// are returned.
+func parseGroupbyTopk(it *lex.ItemIterator, child *GraphQuery) error {
+	it.Next()
+	if item := it.Item(); item.Typ != itemLeftRound {
+		return item.Errorf("Expected a left round after topk")
+	}
+	it.Next()
+	if item := it.Item(); item.Typ != itemName || item.Val != "uid" {
+		return item.Errorf("Expected uid as the first argument of topk but got: %v", item.Val)
+	}
+
+	var k int
+	for it.Next() {
+		item := it.Item()
+		if item.Typ == itemRightRound {
+			break
+		}
+		if item.Typ != itemComma {
+			return item.Errorf("Expected a comma or a right round in topk but got: %v", item.Val)
+		}
+		it.Next()
+		key := it.Item()
+		it.Next()
+		if it.Item().Typ != itemColon {
+			return key.Errorf("Expected a colon after %v in topk", key.Val)
+		}
+		it.Next()
+		item = it.Item()
+		switch key.Val {
+		case "by":
+			if len(child.NeedsVar) > 0 {
+				return key.Errorf("by can only be given once in topk")
+			}
+			if item.Val != valueFunc {
+				return item.Errorf("Only variables are allowed in the by argument of topk. Got: %v",
+					item.Val)
+			}
+			count, err := parseVarList(it, child)
+			if err != nil {
+				return err
+			}
+			if count != 1 {
+				return it.Errorf("Expected one variable inside val() of topk but got %v", count)
+			}
+			child.NeedsVar[0].Typ = ValueVar
+		case "k":
+			n, err := strconv.Atoi(item.Val)
+			if err != nil || n <= 0 {
+				return item.Errorf("k in topk must be a positive integer but got: %v", item.Val)
+			}
+			k = n
+		default:
+			return key.Errorf("Invalid argument %v in topk", key.Val)
+		}
+	}
+	if it.Item().Typ != itemRightRound {
+		return it.Errorf("Expected a right round after the arguments of topk")
+	}
+	if len(child.NeedsVar) == 0 {
+		return it.Errorf("Expected a value variable to rank by in topk, e.g. by: val(x)")
+	}
+	if k == 0 {
+		return it.Errorf("Expected the number of uids to return in topk, e.g. k: 3")
+	}
+
+	child.Attr = "uid"
+	child.Func = &Function{
+		Name:     "topk",
+		Args:     []Arg{{Value: strconv.Itoa(k)}},
+		NeedsVar: child.NeedsVar,
+	}
+	return nil
+}
+
+// parseGroupbyWpercentile parses wpercentile(val(x), val(w), P) inside a groupby block into
+// child. The P-th percentile of the values of x is computed for each group, weighting each
+// value by the value of w for the same uid.
+func parseGroupbyWpercentile(it *lex.ItemIterator, child *GraphQuery) error {
+	it.Next()
+	if item := it.Item(); item.Typ != itemLeftRound {
+		return item.Errorf("Expected a left round after wpercentile")
+	}
+	for i, what := range []string{"value", "weight"} {
+		if i > 0 {
+			it.Next()
+			if item := it.Item(); item.Typ != itemComma {
+				return item.Errorf("Expected a comma after the value variable of wpercentile")
+			}
+		}
+		it.Next()
+		if item := it.Item(); item.Val != valueFunc {
+			return item.Errorf("Expected the %s variable of wpercentile, e.g. val(x). Got: %v",
+				what, item.Val)
+		}
+		count, err := parseVarList(it, child)
+		if err != nil {
+			return err
+		}
+		if count != 1 {
+			return it.Errorf("Expected one variable inside val() of wpercentile but got %v", count)
+		}
+		child.NeedsVar[i].Typ = ValueVar
+	}
+	it.Next()
+	if item := it.Item(); item.Typ != itemComma {
+		return item.Errorf("Expected a comma after the weight variable of wpercentile")
+	}
+	it.Next()
+	item := it.Item()
+	p, err := strconv.ParseFloat(item.Val, 64)
+	if err != nil || p < 0 || p > 100 {
+		return item.Errorf("The percentile of wpercentile must be a number between 0 and 100. "+
+			"Got: %v", item.Val)
+	}
+	it.Next()
+	if item := it.Item(); item.Typ != itemRightRound {
+		return item.Errorf("Expected a right round after the percentile of wpercentile")
+	}
+
+	child.Attr = "uid"
+	child.Func = &Function{
+		Name:     "wpercentile",
+		Args:     []Arg{{Value: item.Val}},
+		NeedsVar: child.NeedsVar,
+	}
+	return nil
+}
+
+// parseGroupbyCountif parses countif(val(x), op, value) inside a groupby block into child. The
+// nodes of each group whose value of x compares with the value as op says are counted. op is
+// one of eq, ne, lt, le, gt and ge.
+func parseGroupbyCountif(it *lex.ItemIterator, child *GraphQuery) error {
+	it.Next()
+	if item := it.Item(); item.Typ != itemLeftRound {
+		return item.Errorf("Expected a left round after countif")
+	}
+	it.Next()
+	if item := it.Item(); item.Val != valueFunc {
+		return item.Errorf("Expected the variable of countif, e.g. val(x). Got: %v", item.Val)
+	}
+	count, err := parseVarList(it, child)
+	if err != nil {
+		return err
+	}
+	if count != 1 {
+		return it.Errorf("Expected one variable inside val() of countif but got %v", count)
+	}
+	child.NeedsVar[0].Typ = ValueVar
+
+	it.Next()
+	if item := it.Item(); item.Typ != itemComma {
+		return item.Errorf("Expected a comma after the variable of countif")
+	}
+	it.Next()
+	op := it.Item()
+	if !groupbyComparisons[op.Val] {
+		return op.Errorf("The comparison of countif must be one of eq, ne, lt, le, gt or ge. "+
+			"Got: %v", op.Val)
+	}
+	it.Next()
+	if item := it.Item(); item.Typ != itemComma {
+		return item.Errorf("Expected a comma after the comparison of countif")
+	}
+	it.Next()
+	item := it.Item()
+	val := item.Val
+	if item.Typ == itemMathOp && item.Val == "-" {
+		// The sign of a negative value is lexed on its own.
+		it.Next()
+		val += it.Item().Val
+	} else if item.Typ != itemName {
+		return item.Errorf("Expected the value to compare with in countif. Got: %v", item.Val)
+	}
+	if val, err = unquoteIfQuoted(val); err != nil {
+		return err
+	}
+	it.Next()
+	if item := it.Item(); item.Typ != itemRightRound {
+		return item.Errorf("Expected a right round after the value of countif")
+	}
+
+	child.Attr = "uid"
+	child.Func = &Function{
+		Name:     "countif",
+		Args:     []Arg{{Value: op.Val}, {Value: val}},
+		NeedsVar: child.NeedsVar,
+	}
+	return nil
+}
+
+// parseGroupbyMedianuid parses medianuid(val(x)) inside a groupby block into child. The uid of
+// the node of each group with the median value of x is returned.
+func parseGroupbyMedianuid(it *lex.ItemIterator, child *GraphQuery) error {
+	it.Next()
+	if item := it.Item(); item.Typ != itemLeftRound {
+		return item.Errorf("Expected a left round after medianuid")
+	}
+	it.Next()
+	if item := it.Item(); item.Val != valueFunc {
+		return item.Errorf("Expected the variable of medianuid, e.g. val(x). Got: %v", item.Val)
+	}
+	count, err := parseVarList(it, child)
+	if err != nil {
+		return err
+	}
+	if count != 1 {
+		return it.Errorf("Expected one variable inside val() of medianuid but got %v", count)
+	}
+	child.NeedsVar[0].Typ = ValueVar
+	it.Next()
+	if item := it.Item(); item.Typ != itemRightRound {
+		return item.Errorf("Expected a right round after the variable of medianuid")
+	}
+
+	child.Attr = "uid"
+	child.Func = &Function{
+		Name:     "medianuid",
+		NeedsVar: child.NeedsVar,
+	}
+	return nil
+}
+
+// parseGroupbyP2percentile parses p2percentile(val(x), P) inside a groupby block into child.
+// The P-th percentile of the values of x is estimated for each group with the P² algorithm.
+func parseGroupbyP2percentile(it *lex.ItemIterator, child *GraphQuery) error {
+	it.Next()
+	if item := it.Item(); item.Typ != itemLeftRound {
+		return item.Errorf("Expected a left round after p2percentile")
+	}
+	it.Next()
+	if item := it.Item(); item.Val != valueFunc {
+		return item.Errorf("Expected the variable of p2percentile, e.g. val(x). Got: %v",
+			item.Val)
+	}
+	count, err := parseVarList(it, child)
+	if err != nil {
+		return err
+	}
+	if count != 1 {
+		return it.Errorf("Expected one variable inside val() of p2percentile but got %v", count)
+	}
+	child.NeedsVar[0].Typ = ValueVar
+	it.Next()
+	if item := it.Item(); item.Typ != itemComma {
+		return item.Errorf("Expected a comma after the variable of p2percentile")
+	}
+	it.Next()
+	item := it.Item()
+	p, err := strconv.ParseFloat(item.Val, 64)
+	if err != nil || p < 0 || p > 100 {
+		return item.Errorf("The percentile of p2percentile must be a number between 0 and 100. "+
+			"Got: %v", item.Val)
+	}
+	it.Next()
+	if item := it.Item(); item.Typ != itemRightRound {
+		return item.Errorf("Expected a right round after the percentile of p2percentile")
+	}
+
+	child.Attr = "uid"
+	child.Func = &Function{
+		Name:     "p2percentile",
+		Args:     []Arg{{Value: item.Val}},
+		NeedsVar: child.NeedsVar,
+	}
+	return nil
+}
+
+// parseGroupbyRange parses range(val(x)) inside a groupby block into child. The difference
+// between the largest and the smallest values of x is computed for each group.
+func parseGroupbyRange(it *lex.ItemIterator, child *GraphQuery) error {
+	it.Next()
+	if item := it.Item(); item.Typ != itemLeftRound {
+		return item.Errorf("Expected a left round after range")
+	}
+	it.Next()
+	if item := it.Item(); item.Val != valueFunc {
+		return item.Errorf("Expected the variable of range, e.g. val(x). Got: %v", item.Val)
+	}
+	count, err := parseVarList(it, child)
+	if err != nil {
+		return err
+	}
+	if count != 1 {
+		return it.Errorf("Expected one variable inside val() of range but got %v", count)
+	}
+	child.NeedsVar[0].Typ = ValueVar
+	it.Next()
+	if item := it.Item(); item.Typ != itemRightRound {
+		return item.Errorf("Expected a right round after the variable of range")
+	}
+
+	child.Attr = "uid"
+	child.Func = &Function{
+		Name:       "range",
+		NeedsVar:   child.NeedsVar,
+		IsValueVar: true,
+	}
+	return nil
+}
+
+// maxGroupbyRound is the largest number of decimals float group keys can be rounded to. Floats
+// don't have more significant decimal digits than this.
+const maxGroupbyRound = 15
+
+// parseGroupbyRing parses the bucket option inside the groupby directive when it's a distance,
+// e.g. bucket: 1km or bucket: 500m. It's the width in meters of the rings that the distances of
+// distance() are rounded down to. It returns false without consuming anything if bucket isn't
+// followed by a distance, in which case bucket is an alias.
+func parseGroupbyRing(it *lex.ItemIterator) (float64, bool, error) {
+	items, err := it.Peek(2)
+	if err != nil {
+		return 0, false, err
+	}
+	if items[1].Typ != itemName {
+		return 0, false, nil
+	}
+	val, scale := items[1].Val, 1.0
+	switch {
+	case strings.HasSuffix(val, "km"):
+		val, scale = strings.TrimSuffix(val, "km"), 1000
+	case strings.HasSuffix(val, "m"):
+		val = strings.TrimSuffix(val, "m")
+	default:
+		return 0, false, nil
+	}
+	width, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0, false, nil
+	}
+	it.Next() // Consume the itemColon
+	it.Next()
+	width *= scale
+	// The comparison is false for NaN.
+	if !(width >= 1 && width <= maxGroupbyRing) || width != math.Trunc(width) {
+		return 0, false, it.Item().Errorf("bucket in groupby must be a whole number of meters "+
+			"between 1m and %dkm, but got %s", maxGroupbyRing/1000, items[1].Val)
+	}
+	return width, true, nil
+}
+
+// maxGroupbyRing is the largest width in meters of the rings of distance() in groupby. No two
+// points on earth are farther apart than half its circumference, which is about 20,000km.
+const maxGroupbyRing = 20000 * 1000
+
+// parseGroupbyFacet parses the facet option inside the groupby directive, e.g.
+// facet: timestamp, which groups the nodes by the values of the facet on the edges of the
+// predicate instead of the values of the predicate. It returns false without consuming
+// anything if facet isn't followed by a name.
+func parseGroupbyFacet(it *lex.ItemIterator) (string, bool, error) {
+	items, err := it.Peek(2)
+	if err != nil {
+		return "", false, err
+	}
+	if items[1].Typ != itemName {
+		return "", false, nil
+	}
+	it.Next() // Consume the itemColon
+	it.Next()
+	key, err := unquoteIfQuoted(it.Item().Val)
+	if err != nil {
+		return "", false, err
+	}
+	if key == "" {
+		return "", false, it.Item().Errorf("facet in groupby must name a facet")
+	}
+	return key, true, nil
+}
+
+// groupbyTimeUnits holds the units that datetime keys can be truncated to in groupby.
+var groupbyTimeUnits = map[string]bool{
+	"minute": true,
+	"hour":   true,
+	"day":    true,
+	"month":  true,
+	"year":   true,
+}
+
+// parseGroupbyBy parses the by option inside the groupby directive, e.g. by: hour, which
+// truncates the datetime values or facets the nodes are grouped by to the hour. It returns false
+// without consuming anything if by isn't followed by a unit of time, in which case by is an
+// alias.
+func parseGroupbyBy(it *lex.ItemIterator) (string, bool, error) {
+	items, err := it.Peek(2)
+	if err != nil {
+		return "", false, err
+	}
+	if items[1].Typ != itemName || !groupbyTimeUnits[items[1].Val] {
+		return "", false, nil
+	}
+	it.Next() // Consume the itemColon
+	it.Next()
+	return items[1].Val, true, nil
+}
+
+// maxGeohashPrecision is the maximum precision of the geohashes that geo values are grouped by.
+// Its cells are a few centimeters wide, beyond the precision of most coordinates.
+const maxGeohashPrecision = 12
+
+// parseGroupbyRelativeTo parses the relativeTo option inside the groupby directive, which is
+// either now or a quoted datetime, e.g. relativeTo: "2020-01-01". It returns true as second
+// value for now. It returns false without consuming anything if relativeTo is followed by a
+// predicate instead, in which case relativeTo is an alias.
+func parseGroupbyRelativeTo(it *lex.ItemIterator) (time.Time, bool, bool, error) {
+	items, err := it.Peek(2)
+	if err != nil {
+		return time.Time{}, false, false, err
+	}
+	val := items[1].Val
+	if items[1].Typ != itemName || (val != "now" && (len(val) < 2 || val[0] != quote)) {
+		return time.Time{}, false, false, nil
+	}
+	it.Next() // Consume the itemColon
+	it.Next()
+	if val == "now" {
+		return time.Time{}, true, true, nil
+	}
+	val, err = unquoteIfQuoted(val)
+	if err != nil {
+		return time.Time{}, false, false, err
+	}
+	to, err := types.ParseTime(val)
+	if err != nil {
+		return time.Time{}, false, false, it.Item().Errorf("relativeTo in groupby must be now "+
+			"or a datetime, but got: %v", val)
+	}
+	return to, false, true, nil
+}
+
+// groupbyDurationUnits holds the units of the durations of the buckets in groupby.
+var groupbyDurationUnits = map[byte]time.Duration{
+	's': time.Second,
+	'm': time.Minute,
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+}
+
+// parseGroupbyDuration parses a duration of a bucket in groupby, which is a positive integer
+// followed by a unit, e.g. 30d.
+func parseGroupbyDuration(val string) (time.Duration, error) {
+	if len(val) < 2 {
+		return 0, errors.Errorf("Expected a duration like 7d in buckets but got: %v", val)
+	}
+	unit, ok := groupbyDurationUnits[val[len(val)-1]]
+	n, err := strconv.ParseInt(val[:len(val)-1], 10, 64)
+	if !ok || err != nil || n <= 0 {
+		return 0, errors.Errorf("Expected a duration like 7d in buckets but got: %v", val)
+	}
+	if n > math.MaxInt64/int64(unit) {
+		return 0, errors.Errorf("The duration %v in buckets is too long", val)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// parseGroupbyBuckets parses the buckets option inside the groupby directive, e.g.
+// buckets: [7d, 30d, 90d]. It returns the durations along with their labels. It returns false
+// without consuming anything if buckets is followed by a predicate instead, in which case
+// buckets is an alias.
+func parseGroupbyBuckets(it *lex.ItemIterator) ([]time.Duration, []string, bool, error) {
+	items, err := it.Peek(2)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if items[1].Typ != itemLeftSquare {
+		return nil, nil, false, nil
+	}
+	it.Next() // Consume the itemColon
+	it.Next() // Consume the '['
+
+	var buckets []time.Duration
+	var labels []string
+	expectArg := true
+	for it.Next() {
+		item := it.Item()
+		switch {
+		case item.Typ == itemRightSquare && !expectArg:
+			return buckets, labels, true, nil
+		case item.Typ == itemComma && !expectArg:
+			expectArg = true
+		case item.Typ == itemName && expectArg:
+			d, err := parseGroupbyDuration(item.Val)
+			if err != nil {
+				return nil, nil, false, item.Errorf("%s", err)
+			}
+			if len(buckets) > 0 && d <= buckets[len(buckets)-1] {
+				return nil, nil, false, item.Errorf("The durations of buckets must be "+
+					"increasing. Got: %v after %v", item.Val, labels[len(labels)-1])
+			}
+			buckets = append(buckets, d)
+			labels = append(labels, item.Val)
+			expectArg = false
+		default:
+			return nil, nil, false, item.Errorf("Unexpected %v in buckets", item.Val)
+		}
+	}
+	return nil, nil, false, it.Errorf("Expected a right square bracket after buckets")
+}
+
+// parseGroupbyMinMax parses the minmax option inside the groupby directive, e.g.
+// minmax: "avg(age)", which names the aggregate to normalize. It returns false without
+// consuming anything if minmax is followed by a predicate instead, in which case minmax is an
+// alias.
+func parseGroupbyMinMax(it *lex.ItemIterator) (string, bool, error) {
+	items, err := it.Peek(2)
+	if err != nil {
+		return "", false, err
+	}
+	if items[1].Typ != itemName || len(items[1].Val) < 2 || items[1].Val[0] != quote {
+		return "", false, nil
+	}
+	it.Next() // Consume the itemColon
+	it.Next()
+	name, err := unquoteIfQuoted(it.Item().Val)
+	if err != nil {
+		return "", false, err
+	}
+	if name == "" {
+		return "", false, it.Item().Errorf("minmax in groupby must name an aggregate")
+	}
+	return name, true, nil
+}
+
+// parseGroupbyCumulative parses the cumulative option inside the groupby directive, e.g.
+// cumulative: "count", which names the aggregate to accumulate across the groups ordered by
+// their keys. It returns false without consuming anything if cumulative is followed by a
+// predicate instead, in which case cumulative is an alias.
+func parseGroupbyCumulative(it *lex.ItemIterator) (string, bool, error) {
+	items, err := it.Peek(2)
+	if err != nil {
+		return "", false, err
+	}
+	if items[1].Typ != itemName || len(items[1].Val) < 2 || items[1].Val[0] != quote {
+		return "", false, nil
+	}
+	it.Next() // Consume the itemColon
+	it.Next()
+	name, err := unquoteIfQuoted(it.Item().Val)
+	if err != nil {
+		return "", false, err
+	}
+	if name == "" {
+		return "", false, it.Item().Errorf("cumulative in groupby must name an aggregate")
+	}
+	return name, true, nil
+}
+
+// parseGroupbyCoverage parses the coverage option inside the groupby directive, e.g.
+// coverage: 0.8, which keeps the largest groups until they cover that share of the total. It
+// returns false without consuming anything if coverage is followed by a predicate instead, in
+// which case coverage is an alias.
+func parseGroupbyCoverage(it *lex.ItemIterator) (float64, bool, error) {
+	items, err := it.Peek(2)
+	if err != nil {
+		return 0, false, err
+	}
+	if items[1].Typ != itemName {
+		return 0, false, nil
+	}
+	coverage, err := strconv.ParseFloat(items[1].Val, 64)
+	if err != nil {
+		return 0, false, nil
+	}
+	it.Next() // Consume the itemColon
+	it.Next()
+	if coverage <= 0 || coverage > 1 {
+		return 0, false, it.Item().Errorf("coverage in groupby must be a number greater than 0 "+
+			"and at most 1, but got %v", items[1].Val)
+	}
+	return coverage, true, nil
+}
+
+// parseGroupbyCoverageBy parses the coverageBy option inside the groupby directive, e.g.
+// coverageBy: "sum(price)", which names the aggregate that the coverage is measured with
+// instead of the number of nodes of the groups. It returns false without consuming anything if
+// coverageBy is followed by a predicate instead, in which case coverageBy is an alias.
+func parseGroupbyCoverageBy(it *lex.ItemIterator) (string, bool, error) {
+	items, err := it.Peek(2)
+	if err != nil {
+		return "", false, err
+	}
+	if items[1].Typ != itemName || len(items[1].Val) < 2 || items[1].Val[0] != quote {
+		return "", false, nil
+	}
+	it.Next() // Consume the itemColon
+	it.Next()
+	name, err := unquoteIfQuoted(it.Item().Val)
+	if err != nil {
+		return "", false, err
+	}
+	if name == "" {
+		return "", false, it.Item().Errorf("coverageBy in groupby must name an aggregate")
+	}
+	return name, true, nil
+}
+
+// parseGroupbyAfter parses the after option inside the groupby directive, e.g.
+// after: "W3siYXR0ciI6...", whose token was returned with the previous page of the results.
+// It returns false without consuming anything if after isn't followed by a quoted token.
+func parseGroupbyAfter(it *lex.ItemIterator) (string, bool, error) {
+	items, err := it.Peek(2)
+	if err != nil {
+		return "", false, err
+	}
+	if items[1].Typ != itemName || len(items[1].Val) < 2 || items[1].Val[0] != quote {
+		return "", false, nil
+	}
+	it.Next() // Consume the itemColon
+	it.Next()
+	token, err := unquoteIfQuoted(it.Item().Val)
+	if err != nil {
+		return "", false, err
+	}
+	if token == "" {
+		return "", false, it.Item().Errorf("after in groupby must be the token returned " +
+			"with the previous page")
+	}
+	return token, true, nil
+}
+
+// parseGroupbyTiers parses the tiers option inside the groupby directive, e.g.
+// tiers: [0, 50, 80, 100]. It returns false without consuming anything if tiers is followed by
+// a predicate instead, in which case tiers is an alias.
+func parseGroupbyTiers(it *lex.ItemIterator) ([]float64, bool, error) {
+	items, err := it.Peek(2)
+	if err != nil {
+		return nil, false, err
+	}
+	if items[1].Typ != itemLeftSquare {
+		return nil, false, nil
+	}
+	it.Next() // Consume the itemColon
+	it.Next() // Consume the '['
+
+	var bounds []float64
+	expectArg := true
+	for it.Next() {
+		item := it.Item()
+		switch {
+		case item.Typ == itemRightSquare && !expectArg:
+			if len(bounds) < 2 {
+				return nil, false, item.Errorf("Expected atleast two boundaries in tiers")
+			}
+			return bounds, true, nil
+		case item.Typ == itemComma && !expectArg:
+			expectArg = true
+		case (item.Typ == itemName || (item.Typ == itemMathOp && item.Val == "-")) && expectArg:
+			val := item.Val
+			if item.Typ == itemMathOp {
+				// The sign of a negative boundary is lexed on its own.
+				it.Next()
+				val += it.Item().Val
+			}
+			bound, err := strconv.ParseFloat(val, 64)
+			if err != nil || math.IsNaN(bound) {
+				return nil, false, item.Errorf("Expected a number in tiers but got: %v", val)
+			}
+			if len(bounds) > 0 && bound <= bounds[len(bounds)-1] {
+				return nil, false, item.Errorf("The boundaries of tiers must be increasing. "+
+					"Got: %v after %v", val, bounds[len(bounds)-1])
+			}
+			bounds = append(bounds, bound)
+			expectArg = false
+		default:
+			return nil, false, item.Errorf("Unexpected %v in tiers", item.Val)
+		}
+	}
+	return nil, false, it.Errorf("Expected a right square bracket after tiers")
+}
+
+// parseGroupbyValueMap parses the valueMap option inside the groupby directive, e.g.
+// valueMap: [1: "active", 2: "churned"]. It returns the labels of the values, which are keyed
+// by the values written as strings. It returns false without consuming anything if valueMap is
+// followed by a predicate instead, in which case valueMap is an alias.
+func parseGroupbyValueMap(it *lex.ItemIterator) (map[string]string, bool, error) {
+	items, err := it.Peek(2)
+	if err != nil {
+		return nil, false, err
+	}
+	if items[1].Typ != itemLeftSquare {
+		return nil, false, nil
+	}
+	it.Next() // Consume the itemColon
+	it.Next() // Consume the '['
+
+	labels := make(map[string]string)
+	var value string
+	// expect is what comes next: a value, the colon after it or its label.
+	expect := "value"
+	for it.Next() {
+		item := it.Item()
+		switch {
+		case item.Typ == itemRightSquare && expect == "":
+			return labels, true, nil
+		case item.Typ == itemComma && expect == "":
+			expect = "value"
+		case (item.Typ == itemName || (item.Typ == itemMathOp && item.Val == "-")) &&
+			expect == "value":
+			value = item.Val
+			if item.Typ == itemMathOp {
+				// The sign of a negative value is lexed on its own.
+				it.Next()
+				value += it.Item().Val
+			}
+			if value, err = unquoteIfQuoted(value); err != nil {
+				return nil, false, err
+			}
+			if _, ok := labels[value]; ok {
+				return nil, false, item.Errorf("The value %v is mapped more than once in "+
+					"valueMap", value)
+			}
+			expect = "colon"
+		case item.Typ == itemColon && expect == "colon":
+			expect = "label"
+		case item.Typ == itemName && expect == "label":
+			if len(item.Val) < 2 || item.Val[0] != quote {
+				return nil, false, item.Errorf("Expected a quoted label in valueMap but "+
+					"got: %v", item.Val)
+			}
+			label, err := unquoteIfQuoted(item.Val)
+			if err != nil {
+				return nil, false, err
+			}
+			labels[value] = label
+			expect = ""
+		default:
+			return nil, false, item.Errorf("Unexpected %v in valueMap", item.Val)
+		}
+	}
+	return nil, false, it.Errorf("Expected a right square bracket after valueMap")
+}
+
+// parseGroupbyUnmapped parses the unmapped option inside the groupby directive, e.g.
+// unmapped: "unknown", which is the label of the values that aren't in valueMap. It returns
+// false without consuming anything if unmapped is followed by a predicate instead, in which
+// case unmapped is an alias.
+func parseGroupbyUnmapped(it *lex.ItemIterator) (string, bool, error) {
+	items, err := it.Peek(2)
+	if err != nil {
+		return "", false, err
+	}
+	if items[1].Typ != itemName || len(items[1].Val) < 2 || items[1].Val[0] != quote {
+		return "", false, nil
+	}
+	it.Next() // Consume the itemColon
+	it.Next()
+	label, err := unquoteIfQuoted(it.Item().Val)
+	if err != nil {
+		return "", false, err
+	}
+	if label == "" {
+		return "", false, it.Item().Errorf("unmapped in groupby must be a label")
+	}
+	return label, true, nil
+}
+
+// parseFilter parses the filter directive to produce a QueryFilter / parse tree.
+func parseFilter(it *lex.ItemIterator) (*FilterTree, error) {
+	it.Next()
+	item := it.Item()
+	if item.Typ != itemLeftRound {
+		return nil, item.Errorf("Expected ( after filter directive")
+	}
+
+	// opStack is used to collect the operators in right order.
+	opStack := new(filterTreeStack)
 	opStack.push(&FilterTree{Op: "("}) // Push ( onto operator stack.
 	// valueStack is used to collect the values.
 	valueStack := new(filterTreeStack)
@@ -2819,6 +4702,17 @@ func validateEmptyBlockItem(it *lex.ItemIterator, val string) error {
 	return nil
 }
 
+// groupbyFuncs maps the names of the functions other than the aggregators that can only be
+// used inside @groupby, e.g. topk(val(x), 3), to the functions parsing them into a child.
+var groupbyFuncs = map[string]func(it *lex.ItemIterator, child *GraphQuery) error{
+	"topk":         parseGroupbyTopk,
+	"wpercentile":  parseGroupbyWpercentile,
+	"countif":      parseGroupbyCountif,
+	"medianuid":    parseGroupbyMedianuid,
+	"p2percentile": parseGroupbyP2percentile,
+	"range":        parseGroupbyRange,
+}
+
 // godeep constructs the subgraph from the lexed items and a GraphQuery node.
 func godeep(it *lex.ItemIterator, gq *GraphQuery) error {
 	if gq == nil {
@@ -2880,7 +4774,13 @@ func godeep(it *lex.ItemIterator, gq *GraphQuery) error {
 				continue
 			}
 
-			if gq.IsGroupby && (!isAggregator(val) && val != "count" && count != seen) {
+			if gq.IsGroupby && gq.Groupby.Distinct {
+				// A distinct groupby only returns the keys of its groups.
+				return it.Errorf("Aggregates aren't allowed inside a distinct @groupby. Got: %v",
+					val)
+			}
+			if gq.IsGroupby && (!isAggregator(val) && val != "count" &&
+				groupbyFuncs[valLower] == nil && count != seen) {
 				// Only aggregator or count allowed inside the groupby block.
 				return it.Errorf("Only aggregator/count "+
 					"functions allowed inside @groupby. Got: %v", val)
@@ -2909,6 +4809,19 @@ func godeep(it *lex.ItemIterator, gq *GraphQuery) error {
 				gq.Children = append(gq.Children, child)
 				curp = nil
 				continue
+			case gq.IsGroupby && groupbyFuncs[valLower] != nil:
+				child := &GraphQuery{
+					Args:  make(map[string]string),
+					Var:   varName,
+					Alias: alias,
+				}
+				varName, alias = "", ""
+				if err := groupbyFuncs[valLower](it, child); err != nil {
+					return err
+				}
+				gq.Children = append(gq.Children, child)
+				curp = nil
+				continue
 			case isAggregator(valLower):
 				child := &GraphQuery{
 					Attr:       valueFunc,
@@ -2923,6 +4836,13 @@ func godeep(it *lex.ItemIterator, gq *GraphQuery) error {
 					it.Prev()
 					goto Fall
 				}
+				if (valLower == "distinctvalues" || valLower == "tdigest" ||
+					valLower == "countdistinct") && !gq.IsGroupby {
+					return it.Errorf("%s is only allowed inside @groupby", valLower)
+				}
+				if (valLower == "distinctvalues" || valLower == "tdigest") && child.Var != "" {
+					return it.Errorf("%s can't be assigned to a variable", valLower)
+				}
 				it.Next()
 				if gq.IsGroupby {
 					item = it.Item()
@@ -2953,8 +4873,13 @@ func godeep(it *lex.ItemIterator, gq *GraphQuery) error {
 					}
 					child.NeedsVar[len(child.NeedsVar)-1].Typ = ValueVar
 				}
+				args, err := parseAggregatorArgs(it)
+				if err != nil {
+					return err
+				}
 				child.Func = &Function{
 					Name:     valLower,
+					Args:     args,
 					NeedsVar: child.NeedsVar,
 				}
 				it.Next() // Skip the closing ')'
@@ -3213,7 +5138,36 @@ func godeep(it *lex.ItemIterator, gq *GraphQuery) error {
 }
 
 func isAggregator(fname string) bool {
-	return fname == "min" || fname == "max" || fname == "sum" || fname == "avg"
+	return types.IsAggregator(fname)
+}
+
+// parseAggregatorArgs parses the optional arguments that follow the attribute or the
+// value variable of an aggregator, e.g. the trim fraction in trimmedmean(val(x), 0.1).
+// The iterator is left at the last item before the closing bracket of the aggregator.
+func parseAggregatorArgs(it *lex.ItemIterator) ([]Arg, error) {
+	var args []Arg
+	for {
+		items, err := it.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if items[0].Typ != itemComma {
+			return args, nil
+		}
+		it.Next() // Consume the comma.
+		if !it.Next() {
+			return nil, it.Errorf("Expected an argument after comma in aggregator")
+		}
+		item := it.Item()
+		if item.Typ != itemName {
+			return nil, item.Errorf("Expected an argument in aggregator but got: %v", item.Val)
+		}
+		val, err := unquoteIfQuoted(item.Val)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, Arg{Value: val})
+	}
 }
 
 func isExpandFunc(name string) bool {
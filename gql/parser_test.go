@@ -21,10 +21,12 @@ import (
 	"os"
 	"runtime/debug"
 	"testing"
+	"time"
 
 	"github.com/dgraph-io/dgo/v200/protos/api"
 	"github.com/dgraph-io/dgraph/chunker"
 	"github.com/dgraph-io/dgraph/lex"
+	"github.com/dgraph-io/dgraph/types"
 	"github.com/stretchr/testify/require"
 )
 
@@ -3142,6 +3144,1391 @@ func TestParseGroupbyRoot(t *testing.T) {
 	require.Equal(t, "a", res.Query[0].Children[0].Var)
 }
 
+func TestParseGroupbyExpandAll(t *testing.T) {
+	query := `
+	query {
+		me(func: type(CarModel)) @groupby(expand(_all_)) {
+			count(uid)
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "expand", Expand: "_all_"}}, res.Query[0].GroupbyAttrs)
+}
+
+func TestParseGroupbyExpandErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		err string
+	}{
+		{in: `@groupby(expand(CarModel))`, err: "Only expand(_all_) is supported in groupby"},
+		{in: `@groupby(make, expand(_all_))`, err: "expand() must be the only attribute in groupby"},
+		{in: `@groupby(e: expand(_all_))`, err: "expand() cannot have an alias in groupby"},
+	}
+	for _, tc := range tests {
+		query := `{ me(func: type(CarModel)) ` + tc.in + ` { count(uid) } }`
+		_, err := Parse(Request{Str: query})
+		require.Error(t, err, tc.in)
+		require.Contains(t, err.Error(), tc.err, tc.in)
+	}
+}
+
+func TestParseGroupbyHas(t *testing.T) {
+	query := `
+	query {
+		me(func: type(Person)) @groupby(age, onboarded: has(email), has(<~friend>)) {
+			count(uid)
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{
+		{Attr: "age"},
+		{Attr: "email", Alias: "onboarded", Has: true},
+		{Attr: "~friend", Has: true},
+	}, res.Query[0].GroupbyAttrs)
+}
+
+func TestParseGroupbyHasErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		err string
+	}{
+		{in: `@groupby(has())`, err: "Expected a predicate in has()"},
+		{in: `@groupby(has(email, name))`, err: "Expected a right round after has(email)"},
+	}
+	for _, tc := range tests {
+		query := `{ me(func: type(Person)) ` + tc.in + ` { count(uid) } }`
+		_, err := Parse(Request{Str: query})
+		require.Error(t, err, tc.in)
+		require.Contains(t, err.Error(), tc.err, tc.in)
+	}
+}
+
+func TestParseGroupbyLang(t *testing.T) {
+	query := `
+	query {
+		me(func: type(Person)) @groupby(lang(name), locale: lang(<title>)) {
+			count(uid)
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{
+		{Attr: "name", Lang: true},
+		{Attr: "title", Alias: "locale", Lang: true},
+	}, res.Query[0].GroupbyAttrs)
+
+	for in, msg := range map[string]string{
+		`@groupby(lang())`:                   "Expected a predicate in lang()",
+		`@groupby(lang(name, title))`:        "Expected a right round after lang(name)",
+		`@groupby(lang(name), facet: since)`: "facet can only be specified when grouping by",
+	} {
+		query := `{ me(func: type(Person)) ` + in + ` { count(uid) } }`
+		_, err := Parse(Request{Str: query})
+		require.Error(t, err, in)
+		require.Contains(t, err.Error(), msg, in)
+	}
+}
+
+func TestParseGroupbyLangCount(t *testing.T) {
+	query := `
+	query {
+		me(func: type(Person)) @groupby(langcount(name), languages: langcount(<title>)) {
+			count(uid)
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{
+		{Attr: "name", LangCount: true},
+		{Attr: "title", Alias: "languages", LangCount: true},
+	}, res.Query[0].GroupbyAttrs)
+
+	for in, msg := range map[string]string{
+		`@groupby(langcount())`:            "Expected a predicate in langcount()",
+		`@groupby(langcount(name, title))`: "Expected a right round after langcount(name)",
+		`@groupby(langcount(name), facet: since)`: "facet can only be specified when " +
+			"grouping by",
+	} {
+		query := `{ me(func: type(Person)) ` + in + ` { count(uid) } }`
+		_, err := Parse(Request{Str: query})
+		require.Error(t, err, in)
+		require.Contains(t, err.Error(), msg, in)
+	}
+}
+
+func TestParseGroupbyIn(t *testing.T) {
+	query := `
+	query {
+		var(func: type(Person)) @filter(gt(age, 60)) {
+			senior as uid
+		}
+		me(func: type(Person)) @groupby(in(val(senior)), s: in(val(senior))) {
+			count(uid)
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{
+		{InVar: "senior"},
+		{Alias: "s", InVar: "senior"},
+	}, res.Query[1].GroupbyAttrs)
+	require.Equal(t, []string{"senior", "senior"}, res.QueryVars[1].Needs)
+
+	for in, msg := range map[string]string{
+		`@groupby(in(senior))`:         "Expected val() in in()",
+		`@groupby(in(val))`:            "Expected a left round after val in in()",
+		`@groupby(in(val()))`:          "Expected a variable in in(val())",
+		`@groupby(in(val(senior, x)))`: "Expected a right round after val(senior)",
+		`@groupby(in(val(senior), x))`: "Expected a right round after in(val(senior))",
+		`@groupby(in(val(undefined)))`: "undefined",
+	} {
+		query := `{ var(func: type(Person)) { senior as uid }
+			me(func: type(Person)) ` + in + ` { count(uid) } }`
+		_, err := Parse(Request{Str: query})
+		require.Error(t, err, in)
+		require.Contains(t, err.Error(), msg, in)
+	}
+}
+
+func TestParseCustomAggregator(t *testing.T) {
+	query := `
+	query {
+		me(func: type(Person)) @groupby(city) {
+			spread(age)
+		}
+	}
+`
+	_, err := Parse(Request{Str: query})
+	require.Error(t, err)
+
+	types.SetCustomAggregators(func(name string) bool { return name == "spread" })
+	defer types.SetCustomAggregators(nil)
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Len(t, res.Query[0].Children, 1)
+	child := res.Query[0].Children[0]
+	require.Equal(t, "age", child.Attr)
+	require.Equal(t, "spread", child.Func.Name)
+}
+
+func TestParseGroupbyCount(t *testing.T) {
+	query := `
+	query {
+		me(func: type(Person)) @groupby(posts: count(post), count(<~friend>), bucket: 10) {
+			count(uid)
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{
+		{Attr: "post", Alias: "posts", Count: true},
+		{Attr: "~friend", Count: true},
+	}, res.Query[0].GroupbyAttrs)
+	require.Equal(t, 10, res.Query[0].Groupby.Bucket)
+
+	// bucket is an alias when it's followed by a predicate.
+	query = `{ me(func: type(Person)) @groupby(bucket: age) { count(uid) } }`
+	res, err = Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "age", Alias: "bucket"}}, res.Query[0].GroupbyAttrs)
+	require.Zero(t, res.Query[0].Groupby.Bucket)
+}
+
+func TestParseGroupbyPercent(t *testing.T) {
+	query := `{ me(func: type(Person)) @groupby(age, percent: true) { count(uid) } }`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "age"}}, res.Query[0].GroupbyAttrs)
+	require.True(t, res.Query[0].Groupby.Percent)
+
+	// percent is an alias when it's followed by a predicate.
+	query = `{ me(func: type(Person)) @groupby(percent: age) { count(uid) } }`
+	res, err = Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "age", Alias: "percent"}}, res.Query[0].GroupbyAttrs)
+	require.False(t, res.Query[0].Groupby.Percent)
+
+	query = `{ me(func: type(Person)) @groupby(age, percent: true, percent: false) {
+		count(uid) } }`
+	_, err = Parse(Request{Str: query})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "percent can only be specified once in groupby")
+}
+
+func TestParseGroupbyTrimCollapseSpaces(t *testing.T) {
+	query := `{ me(func: type(Person)) @groupby(city, trim: true, collapseSpaces: true) {
+		count(uid) } }`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "city"}}, res.Query[0].GroupbyAttrs)
+	require.True(t, res.Query[0].Groupby.Trim)
+	require.True(t, res.Query[0].Groupby.Collapse)
+
+	// trim and collapseSpaces are aliases when they're followed by a predicate.
+	query = `{ me(func: type(Person)) @groupby(trim: city, collapseSpaces: country) {
+		count(uid) } }`
+	res, err = Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "city", Alias: "trim"},
+		{Attr: "country", Alias: "collapseSpaces"}}, res.Query[0].GroupbyAttrs)
+	require.False(t, res.Query[0].Groupby.Trim)
+	require.False(t, res.Query[0].Groupby.Collapse)
+
+	for in, msg := range map[string]string{
+		`@groupby(city, trim: true, trim: false)`: "trim can only be specified once in groupby",
+		`@groupby(city, collapseSpaces: true, collapseSpaces: true)`: "collapseSpaces can " +
+			"only be specified once in groupby",
+	} {
+		_, err := Parse(Request{Str: `{ me(func: type(Person)) ` + in + ` { count(uid) } }`})
+		require.Error(t, err, in)
+		require.Contains(t, err.Error(), msg, in)
+	}
+}
+
+func TestParseGroupbySummary(t *testing.T) {
+	query := `{ me(func: type(Person)) @groupby(city, summary: true, largerThan: 100) {
+		count(uid) } }`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "city"}}, res.Query[0].GroupbyAttrs)
+	require.True(t, res.Query[0].Groupby.Summary)
+	require.Equal(t, 100, res.Query[0].Groupby.Larger)
+
+	// summary and largerThan are aliases when they're followed by a predicate.
+	query = `{ me(func: type(Person)) @groupby(summary: city, largerThan: country) {
+		count(uid) } }`
+	res, err = Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "city", Alias: "summary"},
+		{Attr: "country", Alias: "largerThan"}}, res.Query[0].GroupbyAttrs)
+	require.False(t, res.Query[0].Groupby.Summary)
+	require.Zero(t, res.Query[0].Groupby.Larger)
+
+	for in, msg := range map[string]string{
+		`@groupby(city, summary: true, summary: true)`: "summary can only be specified once",
+		`@groupby(city, summary: true, largerThan: 1, largerThan: 2)`: "largerThan can only " +
+			"be specified once",
+		`@groupby(city, summary: true, largerThan: 0)`: "largerThan in groupby must be a " +
+			"positive integer",
+		`@groupby(city, largerThan: 10)`: "largerThan can only be specified along with " +
+			"summary",
+		`@groupby(city, summary: false, largerThan: 10)`: "largerThan can only be specified " +
+			"along with summary",
+	} {
+		_, err := Parse(Request{Str: `{ me(func: type(Person)) ` + in + ` { count(uid) } }`})
+		require.Error(t, err, in)
+		require.Contains(t, err.Error(), msg, in)
+	}
+}
+
+func TestParseGroupbyExplain(t *testing.T) {
+	query := `{ me(func: type(Person)) @groupby(city, explain: true) { count(uid) } }`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "city"}}, res.Query[0].GroupbyAttrs)
+	require.True(t, res.Query[0].Groupby.Explain)
+
+	// explain is an alias when it's followed by a predicate.
+	query = `{ me(func: type(Person)) @groupby(explain: city) { count(uid) } }`
+	res, err = Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "city", Alias: "explain"}},
+		res.Query[0].GroupbyAttrs)
+	require.False(t, res.Query[0].Groupby.Explain)
+
+	_, err = Parse(Request{Str: `{ me(func: type(Person)) ` +
+		`@groupby(city, explain: true, explain: false) { count(uid) } }`})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "explain can only be specified once")
+}
+
+func TestParseGroupbyMinMax(t *testing.T) {
+	query := `{ me(func: type(Person)) @groupby(city, minmax: "avg(age)") { avg(age) } }`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "city"}}, res.Query[0].GroupbyAttrs)
+	require.Equal(t, "avg(age)", res.Query[0].Groupby.MinMax)
+
+	// minmax is an alias when it's followed by a predicate.
+	query = `{ me(func: type(Person)) @groupby(minmax: age) { count(uid) } }`
+	res, err = Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "age", Alias: "minmax"}}, res.Query[0].GroupbyAttrs)
+	require.Empty(t, res.Query[0].Groupby.MinMax)
+
+	query = `{ me(func: type(Person)) @groupby(age, minmax: "count", minmax: "count") {
+		count(uid) } }`
+	_, err = Parse(Request{Str: query})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "minmax can only be specified once in groupby")
+}
+
+func TestParseGroupbyCumulative(t *testing.T) {
+	query := `{ me(func: type(User)) @groupby(signup, by: day, cumulative: "count") {
+		count(uid) } }`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "signup"}}, res.Query[0].GroupbyAttrs)
+	require.Equal(t, "count", res.Query[0].Groupby.Cumsum)
+
+	// cumulative is an alias when it's followed by a predicate.
+	query = `{ me(func: type(User)) @groupby(cumulative: signup) { count(uid) } }`
+	res, err = Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "signup", Alias: "cumulative"}},
+		res.Query[0].GroupbyAttrs)
+	require.Empty(t, res.Query[0].Groupby.Cumsum)
+
+	for in, msg := range map[string]string{
+		`@groupby(signup, cumulative: "count", cumulative: "count")`: "cumulative can only be " +
+			"specified once in groupby",
+		`@groupby(signup, cumulative: "")`: "cumulative in groupby must name an aggregate",
+		`@groupby(signup, distinct: true, cumulative: "count")`: "distinct can't be specified " +
+			"along with cumulative in groupby",
+	} {
+		_, err := Parse(Request{Str: `{ me(func: type(User)) ` + in + ` { count(uid) } }`})
+		require.Error(t, err, in)
+		require.Contains(t, err.Error(), msg, in)
+	}
+}
+
+func TestParseGroupbyCoverage(t *testing.T) {
+	query := `{ me(func: type(Order)) @groupby(customer, coverage: 0.8,
+		coverageBy: "sum(price)") { sum(price) } }`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "customer"}}, res.Query[0].GroupbyAttrs)
+	require.Equal(t, 0.8, res.Query[0].Groupby.Coverage)
+	require.Equal(t, "sum(price)", res.Query[0].Groupby.CoverBy)
+
+	// coverage is an alias when it's followed by a predicate.
+	query = `{ me(func: type(Order)) @groupby(coverage: region) { count(uid) } }`
+	res, err = Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "region", Alias: "coverage"}},
+		res.Query[0].GroupbyAttrs)
+	require.Zero(t, res.Query[0].Groupby.Coverage)
+
+	for in, msg := range map[string]string{
+		`@groupby(customer, coverage: 0)`:   "coverage in groupby must be a number greater than 0",
+		`@groupby(customer, coverage: 1.5)`: "coverage in groupby must be a number greater than 0",
+		`@groupby(customer, coverage: 0.8, coverage: 0.9)`: "coverage can only be specified " +
+			"once in groupby",
+		`@groupby(customer, coverageBy: "count")`: "coverageBy can only be specified along " +
+			"with coverage in groupby",
+		`@groupby(customer, coverage: 0.8, coverageBy: "")`: "coverageBy in groupby must name " +
+			"an aggregate",
+		`@groupby(customer, coverage: 0.8, pageSize: 10)`: "coverage can't be specified along " +
+			"with distinct, cumulative, pageSize or after in groupby",
+		`@groupby(customer, coverage: 0.8, cumulative: "count")`: "coverage can't be " +
+			"specified along with distinct, cumulative, pageSize or after in groupby",
+		`@groupby(customer, coverage: 0.8, after: "token")`: "coverage can't be specified " +
+			"along with distinct, cumulative, pageSize or after in groupby",
+		`@groupby(customer, coverage: 0.8, distinct: true)`: "coverage can't be specified " +
+			"along with distinct, cumulative, pageSize or after in groupby",
+		`@groupby(expand(_all_), coverage: 0.8)`: "coverage can't be specified along with " +
+			"expand() in groupby",
+	} {
+		_, err := Parse(Request{Str: `{ me(func: type(Order)) ` + in + ` { count(uid) } }`})
+		require.Error(t, err, in)
+		require.Contains(t, err.Error(), msg, in)
+	}
+}
+
+func TestParseGroupbyMinSize(t *testing.T) {
+	query := `{ me(func: type(Person)) @groupby(city, age, minSize: 10) { count(uid) } }`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "city"}, {Attr: "age"}}, res.Query[0].GroupbyAttrs)
+	require.Equal(t, 10, res.Query[0].Groupby.MinSize)
+
+	// minSize is an alias when it's followed by a predicate.
+	query = `{ me(func: type(Person)) @groupby(minSize: age) { count(uid) } }`
+	res, err = Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "age", Alias: "minSize"}}, res.Query[0].GroupbyAttrs)
+	require.Zero(t, res.Query[0].Groupby.MinSize)
+
+	for in, msg := range map[string]string{
+		`@groupby(age, minSize: 0)`:             "minSize in groupby must be a positive integer",
+		`@groupby(age, minSize: 2, minSize: 3)`: "minSize can only be specified once in groupby",
+	} {
+		_, err := Parse(Request{Str: `{ me(func: type(Person)) ` + in + ` { count(uid) } }`})
+		require.Error(t, err, in)
+		require.Contains(t, err.Error(), msg, in)
+	}
+}
+
+func TestParseGroupbyPaging(t *testing.T) {
+	query := `{ me(func: type(Person)) @groupby(city, pageSize: 10, after: "abc") { count(uid) } }`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "city"}}, res.Query[0].GroupbyAttrs)
+	require.Equal(t, 10, res.Query[0].Groupby.PageSize)
+	require.Equal(t, "abc", res.Query[0].Groupby.After)
+
+	// pageSize is an alias when it's followed by a predicate.
+	query = `{ me(func: type(Person)) @groupby(pageSize: age) { count(uid) } }`
+	res, err = Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "age", Alias: "pageSize"}}, res.Query[0].GroupbyAttrs)
+	require.Zero(t, res.Query[0].Groupby.PageSize)
+
+	for in, msg := range map[string]string{
+		`@groupby(after: name)`:                   "Can't use keyword after as alias in groupby",
+		`@groupby(age, pageSize: 0)`:              "pageSize in groupby must be a positive integer",
+		`@groupby(age, pageSize: 2, pageSize: 3)`: "pageSize can only be specified once in groupby",
+		`@groupby(age, after: "")`:                "after in groupby must be the token returned",
+		`@groupby(age, after: "a", after: "b")`:   "after can only be specified once in groupby",
+	} {
+		_, err := Parse(Request{Str: `{ me(func: type(Person)) ` + in + ` { count(uid) } }`})
+		require.Error(t, err, in)
+		require.Contains(t, err.Error(), msg, in)
+	}
+}
+
+func TestParseGroupbyGeohash(t *testing.T) {
+	query := `{ me(func: has(location)) @groupby(location, geohash: 6) { avg(price) } }`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "location"}}, res.Query[0].GroupbyAttrs)
+	require.Equal(t, 6, res.Query[0].Groupby.Geohash)
+
+	// geohash is an alias when it's followed by a predicate.
+	query = `{ me(func: has(location)) @groupby(geohash: location) { avg(price) } }`
+	res, err = Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "location", Alias: "geohash"}},
+		res.Query[0].GroupbyAttrs)
+	require.Zero(t, res.Query[0].Groupby.Geohash)
+
+	for in, msg := range map[string]string{
+		`@groupby(location, geohash: 0)`:  "geohash in groupby must be between 1 and 12",
+		`@groupby(location, geohash: 13)`: "geohash in groupby must be between 1 and 12",
+		`@groupby(location, geohash: 5, geohash: 6)`: "geohash can only be specified once in " +
+			"groupby",
+	} {
+		_, err := Parse(Request{Str: `{ me(func: has(location)) ` + in + ` { avg(price) } }`})
+		require.Error(t, err, in)
+		require.Contains(t, err.Error(), msg, in)
+	}
+}
+
+func TestParseGroupbyValueMap(t *testing.T) {
+	query := `{ me(func: has(status)) @groupby(status, valueMap: [1: "active", 2: "churned",
+		-1: "deleted", "n/a": "none"], unmapped: "unknown") { count(uid) } }`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "status"}}, res.Query[0].GroupbyAttrs)
+	require.Equal(t, &GroupbyValueMap{
+		Labels: map[string]string{"1": "active", "2": "churned", "-1": "deleted",
+			"n/a": "none"},
+		Unmapped: "unknown",
+	}, res.Query[0].Groupby.ValueMap)
+
+	// valueMap and unmapped are aliases when they're followed by a predicate.
+	query = `{ me(func: has(status)) @groupby(valueMap: status, unmapped: plan) { count(uid) } }`
+	res, err = Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "status", Alias: "valueMap"},
+		{Attr: "plan", Alias: "unmapped"}}, res.Query[0].GroupbyAttrs)
+	require.Nil(t, res.Query[0].Groupby.ValueMap)
+
+	for in, msg := range map[string]string{
+		`@groupby(status, valueMap: [])`:               "Unexpected ] in valueMap",
+		`@groupby(status, valueMap: [1])`:              "Unexpected ] in valueMap",
+		`@groupby(status, valueMap: [1: active])`:      "Expected a quoted label in valueMap",
+		`@groupby(status, valueMap: [1: "a", 1: "b"])`: "The value 1 is mapped more than once",
+		`@groupby(status, valueMap: [1: "a"], valueMap: [2: "b"])`: "valueMap can only be " +
+			"specified once in groupby",
+		`@groupby(status, valueMap: [1: "a"], unmapped: "b", unmapped: "c")`: "unmapped can " +
+			"only be specified once in groupby",
+		`@groupby(status, unmapped: "unknown")`: "unmapped can only be specified along with " +
+			"valueMap in groupby",
+		`@groupby(status, valueMap: [1: "a"], unmapped: "")`: "unmapped in groupby must be a " +
+			"label",
+	} {
+		_, err := Parse(Request{Str: `{ me(func: has(status)) ` + in + ` { count(uid) } }`})
+		require.Error(t, err, in)
+		require.Contains(t, err.Error(), msg, in)
+	}
+}
+
+func TestParseGroupbyMembers(t *testing.T) {
+	query := `{ me(func: type(Person)) @groupby(city, members: true) { count(uid) } }`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "city"}}, res.Query[0].GroupbyAttrs)
+	require.True(t, res.Query[0].Groupby.Members)
+
+	// members is an alias when it's followed by a predicate.
+	query = `{ me(func: type(Person)) @groupby(members: city) { count(uid) } }`
+	res, err = Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "city", Alias: "members"}}, res.Query[0].GroupbyAttrs)
+	require.False(t, res.Query[0].Groupby.Members)
+
+	for in, msg := range map[string]string{
+		`@groupby(city, members: true, members: false)`: "members can only be specified once",
+		`@groupby(city, distinct: true, members: true)`: "distinct can't be specified along " +
+			"with members in groupby",
+	} {
+		_, err := Parse(Request{Str: `{ me(func: type(Person)) ` + in + ` { count(uid) } }`})
+		require.Error(t, err, in)
+		require.Contains(t, err.Error(), msg, in)
+	}
+}
+
+func TestParseGroupbyCombine(t *testing.T) {
+	query := `{ me(func: uid(1)) { friend @groupby(age, combine: true) { count(uid) } } }`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	friend := res.Query[0].Children[0]
+	require.Equal(t, []GroupByAttr{{Attr: "age"}}, friend.GroupbyAttrs)
+	require.True(t, friend.Groupby.Combine)
+
+	// combine is an alias when it's followed by a predicate.
+	query = `{ me(func: uid(1)) { friend @groupby(combine: age) { count(uid) } } }`
+	res, err = Parse(Request{Str: query})
+	require.NoError(t, err)
+	friend = res.Query[0].Children[0]
+	require.Equal(t, []GroupByAttr{{Attr: "age", Alias: "combine"}}, friend.GroupbyAttrs)
+	require.False(t, friend.Groupby.Combine)
+
+	query = `{ me(func: uid(1)) { friend @groupby(age, combine: true, combine: false) {
+		count(uid) } } }`
+	_, err = Parse(Request{Str: query})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "combine can only be specified once in groupby")
+}
+
+func TestParseGroupbyID(t *testing.T) {
+	query := `{ me(func: uid(1)) { friend @groupby(age, groupId: true) { count(uid) } } }`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	friend := res.Query[0].Children[0]
+	require.Equal(t, []GroupByAttr{{Attr: "age"}}, friend.GroupbyAttrs)
+	require.True(t, friend.Groupby.ID)
+
+	// groupId is an alias when it's followed by a predicate.
+	query = `{ me(func: uid(1)) { friend @groupby(groupId: age) { count(uid) } } }`
+	res, err = Parse(Request{Str: query})
+	require.NoError(t, err)
+	friend = res.Query[0].Children[0]
+	require.Equal(t, []GroupByAttr{{Attr: "age", Alias: "groupId"}}, friend.GroupbyAttrs)
+	require.False(t, friend.Groupby.ID)
+
+	query = `{ me(func: uid(1)) { friend @groupby(age, groupId: true, groupId: true) {
+		count(uid) } } }`
+	_, err = Parse(Request{Str: query})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "groupId can only be specified once in groupby")
+}
+
+func TestParseGroupbyDistinct(t *testing.T) {
+	query := `{ me(func: uid(1)) @groupby(distinct: true, name, age) {} }`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	me := res.Query[0]
+	require.Equal(t, []GroupByAttr{{Attr: "name"}, {Attr: "age"}}, me.GroupbyAttrs)
+	require.True(t, me.Groupby.Distinct)
+	require.Empty(t, me.Children)
+
+	// distinct is an alias when it's followed by a predicate.
+	query = `{ me(func: uid(1)) { friend @groupby(distinct: age) { count(uid) } } }`
+	res, err = Parse(Request{Str: query})
+	require.NoError(t, err)
+	friend := res.Query[0].Children[0]
+	require.Equal(t, []GroupByAttr{{Attr: "age", Alias: "distinct"}}, friend.GroupbyAttrs)
+	require.False(t, friend.Groupby.Distinct)
+
+	for query, msg := range map[string]string{
+		`{ me(func: uid(1)) @groupby(age, distinct: true, distinct: true) {} }`: "distinct can " +
+			"only be specified once in groupby",
+		`{ me(func: uid(1)) @groupby(age, distinct: true) { count(uid) } }`: "Aggregates " +
+			"aren't allowed inside a distinct @groupby. Got: count",
+		`{ me(func: uid(1)) @groupby(age, distinct: true, percent: true) {} }`: "distinct " +
+			"can't be specified along with percent or minmax in groupby",
+	} {
+		_, err = Parse(Request{Str: query})
+		require.Error(t, err, query)
+		require.Contains(t, err.Error(), msg, query)
+	}
+}
+
+func TestParseGroupbyVal(t *testing.T) {
+	query := `
+	{
+		var(func: type(User)) {
+			orders {
+				v as value
+			}
+			t as sum(val(v))
+		}
+		me(func: type(User)) @groupby(val(t), spent: val(t), city) {
+			count(uid)
+		}
+	}`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{ValueVar: "t"}, {ValueVar: "t", Alias: "spent"},
+		{Attr: "city"}}, res.Query[1].GroupbyAttrs)
+	// The variable is needed by the groupby block.
+	require.Contains(t, res.QueryVars[1].Needs, "t")
+
+	for in, msg := range map[string]string{
+		`val()`:     "Expected a variable in val()",
+		`val(t, v)`: "Expected a right round after val(t)",
+		`val(x)`:    "Variables are not used properly",
+	} {
+		query := `{ var(func: type(User)) { orders { v as value } t as sum(val(v)) } ` +
+			`me(func: type(User)) @groupby(` + in + `) { count(uid) } }`
+		_, err := Parse(Request{Str: query})
+		require.Error(t, err, in)
+		require.Contains(t, err.Error(), msg, in)
+	}
+}
+
+func TestParseGroupbyFacet(t *testing.T) {
+	query := `{ me(func: uid(1)) @groupby(event, facet: timestamp, by: hour) { count(uid) } }`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "event"}}, res.Query[0].GroupbyAttrs)
+	require.Equal(t, "timestamp", res.Query[0].Groupby.Facet)
+	require.Equal(t, "hour", res.Query[0].Groupby.By)
+
+	// by also truncates the datetime values of the predicates.
+	query = `{ me(func: has(visited_at)) @groupby(visited_at, by: day) { count(uid) } }`
+	res, err = Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "visited_at"}}, res.Query[0].GroupbyAttrs)
+	require.Empty(t, res.Query[0].Groupby.Facet)
+	require.Equal(t, "day", res.Query[0].Groupby.By)
+
+	// by is an alias when it isn't followed by a unit of time.
+	query = `{ me(func: uid(1)) @groupby(by: event, facet: weight) { count(uid) } }`
+	res, err = Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "event", Alias: "by"}}, res.Query[0].GroupbyAttrs)
+	require.Equal(t, "weight", res.Query[0].Groupby.Facet)
+	require.Empty(t, res.Query[0].Groupby.By)
+
+	for in, msg := range map[string]string{
+		`event, facet: a, facet: b`:          "facet can only be specified once in groupby",
+		`event, facet: a, by: hour, by: day`: "by can only be specified once in groupby",
+		`event, name, facet: a`:              "facet can only be specified when grouping by a single",
+		`count(event), facet: a`:             "facet can only be specified when grouping by a single",
+	} {
+		query := `{ me(func: uid(1)) @groupby(` + in + `) { count(uid) } }`
+		_, err := Parse(Request{Str: query})
+		require.Error(t, err, in)
+		require.Contains(t, err.Error(), msg, in)
+	}
+}
+
+func TestParseGroupbyRelative(t *testing.T) {
+	query := `{ me(func: uid(1)) @groupby(created, relativeTo: now, buckets: [7d, 30d, 12w]) {
+		count(uid) } }`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "created"}}, res.Query[0].GroupbyAttrs)
+	day := 24 * time.Hour
+	require.Equal(t, &GroupbyRelative{
+		Now:     true,
+		Buckets: []time.Duration{7 * day, 30 * day, 84 * day},
+		Labels:  []string{"7d", "30d", "12w"},
+	}, res.Query[0].Groupby.Relative)
+
+	query = `{ me(func: uid(1)) @groupby(buckets: [1h], created,
+		relativeTo: "2020-01-02T03:04:05Z") { count(uid) } }`
+	res, err = Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []time.Duration{time.Hour}, res.Query[0].Groupby.Relative.Buckets)
+	require.Equal(t, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		res.Query[0].Groupby.Relative.To.UTC())
+
+	// relativeTo and buckets are aliases when they're followed by a predicate.
+	query = `{ me(func: uid(1)) @groupby(relativeTo: created, buckets: name) { count(uid) } }`
+	res, err = Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "created", Alias: "relativeTo"},
+		{Attr: "name", Alias: "buckets"}}, res.Query[0].GroupbyAttrs)
+	require.Nil(t, res.Query[0].Groupby.Relative)
+
+	for in, msg := range map[string]string{
+		`created, relativeTo: now`:         "relativeTo and buckets must be specified together",
+		`created, buckets: [7d]`:           "relativeTo and buckets must be specified together",
+		`created, relativeTo: "yesterday"`: "relativeTo in groupby must be now or a datetime",
+		`created, relativeTo: now, buckets: [7d], relativeTo: now`: "relativeTo can only be " +
+			"specified once",
+		`created, relativeTo: now, buckets: [7d], buckets: [8d]`: "buckets can only be " +
+			"specified once",
+		`created, relativeTo: now, buckets: [30d, 7d]`: "The durations of buckets must be " +
+			"increasing. Got: 7d after 30d",
+		`created, relativeTo: now, buckets: [7]`:  "Expected a duration like 7d in buckets",
+		`created, relativeTo: now, buckets: [7y]`: "Expected a duration like 7d in buckets",
+		`created, relativeTo: now, buckets: [0d]`: "Expected a duration like 7d in buckets",
+		`created, relativeTo: now, buckets: []`:   "Unexpected ] in buckets",
+		`created, relativeTo: now, buckets: [7d`:  "Unexpected ) in buckets",
+		`event, facet: a, by: hour, relativeTo: now, buckets: [7d]`: "by and buckets can't " +
+			"both be specified",
+	} {
+		query := `{ me(func: uid(1)) @groupby(` + in + `) { count(uid) } }`
+		_, err := Parse(Request{Str: query})
+		require.Error(t, err, in)
+		require.Contains(t, err.Error(), msg, in)
+	}
+}
+
+func TestParseGroupbyMath(t *testing.T) {
+	query := `
+	{
+		var(func: type(Person)) {
+			a as age
+		}
+		me(func: type(Person)) @groupby(segment: math(cond(a < 18, "minor", "adult")), city) {
+			count(uid)
+		}
+	}`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	attrs := res.Query[1].GroupbyAttrs
+	require.Len(t, attrs, 2)
+	require.Equal(t, "segment", attrs[0].Alias)
+	require.Equal(t, "(cond (< a 18) \"minor\" \"adult\")", attrs[0].MathExp.debugString())
+	require.Equal(t, GroupByAttr{Attr: "city"}, attrs[1])
+	// The variables of the expression are needed by the groupby block.
+	require.Equal(t, []string{"a"}, res.QueryVars[1].Needs)
+
+	for in, msg := range map[string]string{
+		`@groupby(math(a + 1))`:        "math() in groupby must have an alias",
+		`@groupby(s: math(a +))`:       "Invalid Math expression",
+		`@groupby(s: math(a, b))`:      "Comma encountered in math() at unexpected place",
+		`@groupby(s: math(foo(a)))`:    "Unknown math function: foo",
+		`@groupby(s: math("unclosed))`: "Unexpected end of input",
+	} {
+		_, err := Parse(Request{Str: `{ me(func: type(Person)) ` + in + ` { count(uid) } }`})
+		require.Error(t, err, in)
+		require.Contains(t, err.Error(), msg, in)
+	}
+}
+
+func TestParseGroupbyCountErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		err string
+	}{
+		{in: `@groupby(count())`, err: "Expected a predicate in count()"},
+		{in: `@groupby(count(uid))`, err: "Can't group by count(uid)"},
+		{in: `@groupby(count(post, name))`, err: "Expected a right round after count(post)"},
+		{in: `@groupby(count(post), bucket: 0)`, err: "bucket in groupby must be a positive"},
+		{in: `@groupby(count(post), bucket: 5, bucket: 10)`,
+			err: "bucket can only be specified once in groupby"},
+		{in: `@groupby(age, bucket: 10)`,
+			err: "bucket can only be specified along with count() in groupby"},
+		{in: `@groupby(count(post), bucket: 10, tiers: [0, 10])`,
+			err: "bucket and tiers can't both be specified in groupby"},
+	}
+	for _, tc := range tests {
+		query := `{ me(func: type(Person)) ` + tc.in + ` { count(uid) } }`
+		_, err := Parse(Request{Str: query})
+		require.Error(t, err, tc.in)
+		require.Contains(t, err.Error(), tc.err, tc.in)
+	}
+}
+
+func TestParseGroupbyTopk(t *testing.T) {
+	query := `
+	{
+		var(func: has(sales)) {
+			s as sales
+		}
+		me(func: has(sales)) @groupby(region) {
+			best as topk(uid, by: val(s), k: 3)
+		}
+		top(func: uid(best)) {
+			name
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Len(t, res.Query[1].Children, 1)
+	child := res.Query[1].Children[0]
+	require.Equal(t, "uid", child.Attr)
+	require.Equal(t, "best", child.Var)
+	require.Equal(t, []VarContext{{Name: "s", Typ: ValueVar}}, child.NeedsVar)
+	require.Equal(t, "topk", child.Func.Name)
+	require.Equal(t, []Arg{{Value: "3"}}, child.Func.Args)
+}
+
+func TestParseGroupbyTopkErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		err string
+	}{
+		{in: `topk(name, by: val(s), k: 3)`, err: "Expected uid as the first argument of topk"},
+		{in: `topk(uid, by: sales, k: 3)`, err: "Only variables are allowed in the by argument"},
+		{in: `topk(uid, by: val(s), k: 0)`, err: "k in topk must be a positive integer"},
+		{in: `topk(uid, k: 3)`, err: "Expected a value variable to rank by in topk"},
+		{in: `topk(uid, by: val(s))`, err: "Expected the number of uids to return in topk"},
+		{in: `topk(uid, by: val(s), n: 3)`, err: "Invalid argument n in topk"},
+	}
+	for _, tc := range tests {
+		query := `{ var(func: has(sales)) { s as sales } ` +
+			`me(func: has(sales)) @groupby(region) { ` + tc.in + ` } }`
+		_, err := Parse(Request{Str: query})
+		require.Error(t, err, tc.in)
+		require.Contains(t, err.Error(), tc.err, tc.in)
+	}
+}
+
+func TestParseGroupbyWpercentile(t *testing.T) {
+	query := `
+	{
+		var(func: has(latency)) {
+			l as latency
+			r as requests
+		}
+		me(func: has(latency)) @groupby(endpoint) {
+			p95: wpercentile(val(l), val(r), 95)
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Len(t, res.Query[1].Children, 1)
+	child := res.Query[1].Children[0]
+	require.Equal(t, "uid", child.Attr)
+	require.Equal(t, "p95", child.Alias)
+	require.Equal(t, []VarContext{{Name: "l", Typ: ValueVar}, {Name: "r", Typ: ValueVar}},
+		child.NeedsVar)
+	require.Equal(t, "wpercentile", child.Func.Name)
+	require.Equal(t, []Arg{{Value: "95"}}, child.Func.Args)
+}
+
+func TestParseGroupbyWpercentileErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		err string
+	}{
+		{in: `wpercentile(latency, val(r), 95)`, err: "Expected the value variable"},
+		{in: `wpercentile(val(l), requests, 95)`, err: "Expected the weight variable"},
+		{in: `wpercentile(val(l, r), val(r), 95)`, err: "Expected one variable inside val()"},
+		{in: `wpercentile(val(l) val(r), 95)`, err: "Expected a comma after the value variable"},
+		{in: `wpercentile(val(l), val(r))`, err: "Expected a comma after the weight variable"},
+		{in: `wpercentile(val(l), val(r), 101)`, err: "must be a number between 0 and 100"},
+		{in: `wpercentile(val(l), val(r), high)`, err: "must be a number between 0 and 100"},
+		{in: `wpercentile(val(l), val(r), 95, 99)`, err: "right round after the percentile"},
+	}
+	for _, tc := range tests {
+		query := `{ var(func: has(latency)) { l as latency r as requests } ` +
+			`me(func: has(latency)) @groupby(endpoint) { ` + tc.in + ` } }`
+		_, err := Parse(Request{Str: query})
+		require.Error(t, err, tc.in)
+		require.Contains(t, err.Error(), tc.err, tc.in)
+	}
+}
+
+func TestParseGroupbyCountif(t *testing.T) {
+	query := `
+	{
+		var(func: has(score)) {
+			s as score
+		}
+		me(func: has(score)) @groupby(class) {
+			passed: countif(val(s), ge, 80)
+			negative: countif(val(s), lt, -1.5)
+			countif(val(s), eq, "A")
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	children := res.Query[1].Children
+	require.Len(t, children, 3)
+	require.Equal(t, "uid", children[0].Attr)
+	require.Equal(t, "passed", children[0].Alias)
+	require.Equal(t, []VarContext{{Name: "s", Typ: ValueVar}}, children[0].NeedsVar)
+	require.Equal(t, "countif", children[0].Func.Name)
+	require.Equal(t, []Arg{{Value: "ge"}, {Value: "80"}}, children[0].Func.Args)
+	require.Equal(t, []Arg{{Value: "lt"}, {Value: "-1.5"}}, children[1].Func.Args)
+	require.Equal(t, []Arg{{Value: "eq"}, {Value: "A"}}, children[2].Func.Args)
+}
+
+func TestParseGroupbyCountifErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		err string
+	}{
+		{in: `countif(score, gt, 80)`, err: "Expected the variable of countif"},
+		{in: `countif(val(s, t), gt, 80)`, err: "Expected one variable inside val()"},
+		{in: `countif(val(s) gt, 80)`, err: "Expected a comma after the variable"},
+		{in: `countif(val(s), above, 80)`, err: "must be one of eq, ne, lt, le, gt or ge"},
+		{in: `countif(val(s), gt 80)`, err: "Expected a comma after the comparison"},
+		{in: `countif(val(s), gt, 80, 90)`, err: "Expected a right round after the value"},
+	}
+	for _, tc := range tests {
+		query := `{ var(func: has(score)) { s as score t as total } ` +
+			`me(func: has(score)) @groupby(class) { ` + tc.in + ` } }`
+		_, err := Parse(Request{Str: query})
+		require.Error(t, err, tc.in)
+		require.Contains(t, err.Error(), tc.err, tc.in)
+	}
+}
+
+func TestParseGroupbyMedianuid(t *testing.T) {
+	query := `
+	{
+		var(func: has(score)) {
+			s as score
+		}
+		me(func: has(score)) @groupby(class) {
+			typical: medianuid(val(s))
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	children := res.Query[1].Children
+	require.Len(t, children, 1)
+	require.Equal(t, "uid", children[0].Attr)
+	require.Equal(t, "typical", children[0].Alias)
+	require.Equal(t, []VarContext{{Name: "s", Typ: ValueVar}}, children[0].NeedsVar)
+	require.Equal(t, "medianuid", children[0].Func.Name)
+	require.Empty(t, children[0].Func.Args)
+
+	for in, msg := range map[string]string{
+		`medianuid(score)`:       "Expected the variable of medianuid",
+		`medianuid(val(s, t))`:   "Expected one variable inside val()",
+		`medianuid(val(s), 0.5)`: "Expected a right round after the variable",
+	} {
+		query := `{ var(func: has(score)) { s as score t as total } ` +
+			`me(func: has(score)) @groupby(class) { ` + in + ` } }`
+		_, err := Parse(Request{Str: query})
+		require.Error(t, err, in)
+		require.Contains(t, err.Error(), msg, in)
+	}
+}
+
+func TestParseGroupbyP2percentile(t *testing.T) {
+	query := `
+	{
+		var(func: has(latency)) {
+			l as latency
+		}
+		me(func: has(latency)) @groupby(endpoint) {
+			p99: p2percentile(val(l), 99)
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	children := res.Query[1].Children
+	require.Len(t, children, 1)
+	require.Equal(t, "uid", children[0].Attr)
+	require.Equal(t, "p99", children[0].Alias)
+	require.Equal(t, []VarContext{{Name: "l", Typ: ValueVar}}, children[0].NeedsVar)
+	require.Equal(t, "p2percentile", children[0].Func.Name)
+	require.Equal(t, []Arg{{Value: "99"}}, children[0].Func.Args)
+
+	for in, msg := range map[string]string{
+		`p2percentile(latency, 99)`:     "Expected the variable of p2percentile",
+		`p2percentile(val(l, m), 99)`:   "Expected one variable inside val()",
+		`p2percentile(val(l))`:          "Expected a comma after the variable",
+		`p2percentile(val(l), 101)`:     "must be a number between 0 and 100",
+		`p2percentile(val(l), 99, 0.5)`: "Expected a right round after the percentile",
+	} {
+		query := `{ var(func: has(latency)) { l as latency m as size } ` +
+			`me(func: has(latency)) @groupby(endpoint) { ` + in + ` } }`
+		_, err := Parse(Request{Str: query})
+		require.Error(t, err, in)
+		require.Contains(t, err.Error(), msg, in)
+	}
+}
+
+func TestParseGroupbyRange(t *testing.T) {
+	query := `
+	{
+		var(func: has(temperature)) {
+			t as temperature
+		}
+		me(func: has(temperature)) @groupby(city) {
+			spread: range(val(t))
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	children := res.Query[1].Children
+	require.Len(t, children, 1)
+	require.Equal(t, "uid", children[0].Attr)
+	require.Equal(t, "spread", children[0].Alias)
+	require.Equal(t, []VarContext{{Name: "t", Typ: ValueVar}}, children[0].NeedsVar)
+	require.Equal(t, "range", children[0].Func.Name)
+	require.True(t, children[0].Func.IsValueVar)
+	require.Empty(t, children[0].Func.Args)
+
+	for in, msg := range map[string]string{
+		`range(temperature)`: "Expected the variable of range",
+		`range(val(t, u))`:   "Expected one variable inside val() of range",
+		`range(val(t), 10)`:  "Expected a right round after the variable of range",
+		`range`:              "Expected a left round after range",
+	} {
+		query := `{ var(func: has(temperature)) { t as temperature u as humidity } ` +
+			`me(func: has(temperature)) @groupby(city) { ` + in + ` } }`
+		_, err := Parse(Request{Str: query})
+		require.Error(t, err, in)
+		require.Contains(t, err.Error(), msg, in)
+	}
+}
+
+func TestParseGroupbyRound(t *testing.T) {
+	query := `
+	query {
+		me(func: has(reading)) @groupby(sensor, round: 2, round: reading) {
+			count(uid)
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "sensor"}, {Attr: "reading", Alias: "round"}},
+		res.Query[0].GroupbyAttrs)
+	require.NotNil(t, res.Query[0].Groupby.Round)
+	require.Equal(t, 2, *res.Query[0].Groupby.Round)
+}
+
+func TestParseGroupbyRoundErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		err string
+	}{
+		{in: `@groupby(reading, round: 16)`, err: "round in groupby must be between 0 and 15"},
+		{in: `@groupby(round: 1, reading, round: 2)`,
+			err: "round can only be specified once in groupby"},
+		{in: `@groupby(round: 2)`, err: "Expected atleast one attribute in groupby"},
+		{in: `@groupby(reading round: 2)`, err: "Expected a comma or right round"},
+	}
+	for _, tc := range tests {
+		query := `{ me(func: has(reading)) ` + tc.in + ` { count(uid) } }`
+		_, err := Parse(Request{Str: query})
+		require.Error(t, err, tc.in)
+		require.Contains(t, err.Error(), tc.err, tc.in)
+	}
+}
+
+func TestParseGroupbyTiers(t *testing.T) {
+	query := `
+	query {
+		me(func: has(score)) @groupby(score, tiers: [-10, 0, 50.5, 80, 100], outliers: true,
+			tiers: name) {
+			count(uid)
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{{Attr: "score"}, {Attr: "name", Alias: "tiers"}},
+		res.Query[0].GroupbyAttrs)
+	require.Equal(t, &GroupbyTiers{Bounds: []float64{-10, 0, 50.5, 80, 100}, Outliers: true},
+		res.Query[0].Groupby.Tiers)
+}
+
+func TestParseGroupbyTiersErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		err string
+	}{
+		{in: `@groupby(score, tiers: [0])`, err: "Expected atleast two boundaries in tiers"},
+		{in: `@groupby(score, tiers: [0, 50, 50])`,
+			err: "The boundaries of tiers must be increasing"},
+		{in: `@groupby(score, tiers: [0, high])`, err: "Expected a number in tiers"},
+		{in: `@groupby(score, tiers: [0 50])`, err: "Unexpected 50 in tiers"},
+		{in: `@groupby(score, tiers: [0, 50], tiers: [0, 80])`,
+			err: "tiers can only be specified once in groupby"},
+		{in: `@groupby(score, outliers: true)`,
+			err: "outliers can only be specified along with tiers in groupby"},
+		{in: `@groupby(score, tiers: [0, 50], outliers: true, outliers: false)`,
+			err: "outliers can only be specified once in groupby"},
+	}
+	for _, tc := range tests {
+		query := `{ me(func: has(score)) ` + tc.in + ` { count(uid) } }`
+		_, err := Parse(Request{Str: query})
+		require.Error(t, err, tc.in)
+		require.Contains(t, err.Error(), tc.err, tc.in)
+	}
+}
+
+func TestParseDistinctValues(t *testing.T) {
+	query := `
+	{
+		me(func: has(status)) @groupby(region) {
+			statuses: distinctvalues(status, 20)
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	child := res.Query[0].Children[0]
+	require.Equal(t, "status", child.Attr)
+	require.Equal(t, "statuses", child.Alias)
+	require.Equal(t, "distinctvalues", child.Func.Name)
+	require.Equal(t, []Arg{{Value: "20"}}, child.Func.Args)
+
+	query = `
+	{
+		var(func: has(status)) {
+			s as status
+		}
+		me() {
+			distinctvalues(val(s), 20)
+		}
+	}
+`
+	_, err = Parse(Request{Str: query})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "distinctvalues is only allowed inside @groupby")
+
+	query = `
+	{
+		me(func: has(status)) @groupby(region) {
+			d as distinctvalues(status, 20)
+		}
+	}
+`
+	_, err = Parse(Request{Str: query})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "distinctvalues can't be assigned to a variable")
+}
+
+func TestParseCountDistinct(t *testing.T) {
+	query := `
+	{
+		me(func: has(visited_at)) @groupby(visited_at, by: day) {
+			dau: countdistinct(visitor)
+			countdistinct(visitor, hll)
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, "day", res.Query[0].Groupby.By)
+	child := res.Query[0].Children[0]
+	require.Equal(t, "visitor", child.Attr)
+	require.Equal(t, "dau", child.Alias)
+	require.Equal(t, "countdistinct", child.Func.Name)
+	require.Empty(t, child.Func.Args)
+	child = res.Query[0].Children[1]
+	require.Equal(t, "visitor", child.Attr)
+	require.Equal(t, "countdistinct", child.Func.Name)
+	require.Equal(t, []Arg{{Value: "hll"}}, child.Func.Args)
+
+	query = `
+	{
+		var(func: has(visitor)) {
+			v as visitor
+		}
+		me() {
+			countdistinct(val(v))
+		}
+	}
+`
+	_, err = Parse(Request{Str: query})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "countdistinct is only allowed inside @groupby")
+}
+
+func TestParseGroupbyJSONPath(t *testing.T) {
+	query := `
+	{
+		me(func: has(meta)) @groupby(region: jsonpath(meta, "$.region"),
+			jsonpath(meta, "$['zone']", strict: true), name) {
+			count(uid)
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{
+		{Attr: "meta", Alias: "region", JSONPath: "$.region"},
+		{Attr: "meta", JSONPath: "$['zone']", Strict: true},
+		{Attr: "name"},
+	}, res.Query[0].GroupbyAttrs)
+
+	for _, tc := range []struct{ in, err string }{
+		{`jsonpath(meta)`, "Expected a comma after the predicate in jsonpath(meta)"},
+		{`jsonpath(meta, region)`, "Expected a quoted path in jsonpath(meta)"},
+		{`jsonpath(meta, "$.a", lax: true)`, "Expected strict in jsonpath(meta)"},
+		{`jsonpath(meta, "$.a", strict: yes)`, "Expected true or false for strict"},
+		{`jsonpath(meta, "$.a" "$.b")`, "Expected a right round after jsonpath(meta)"},
+	} {
+		query := `{ me(func: has(meta)) @groupby(` + tc.in + `) { count(uid) } }`
+		_, err := Parse(Request{Str: query})
+		require.Error(t, err, tc.in)
+		require.Contains(t, err.Error(), tc.err, tc.in)
+	}
+}
+
+func TestParseGroupbyRegexCapture(t *testing.T) {
+	query := `
+	{
+		me(func: has(email)) @groupby(domain: regexcapture(email, "@(.+)$"),
+			regexcapture(email, "^([a-z]+)\\.", unmatched: "other")) {
+			count(uid)
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{
+		{Attr: "email", Alias: "domain", Regex: "@(.+)$"},
+		{Attr: "email", Regex: `^([a-z]+)\.`, Unmatched: "other"},
+	}, res.Query[0].GroupbyAttrs)
+
+	for _, tc := range []struct{ in, err string }{
+		{`regexcapture(email)`, "Expected a comma after the predicate in regexcapture(email)"},
+		{`regexcapture(email, domain)`, "Expected a quoted regex in regexcapture(email)"},
+		{`regexcapture(email, "")`, "The regex in regexcapture(email) can't be empty"},
+		{`regexcapture(email, "@(.+)", other: "x")`, "Expected unmatched in regexcapture(email)"},
+		{`regexcapture(email, "@(.+)", unmatched: other)`, "Expected a quoted label for unmatched"},
+		{`regexcapture(email, "@(.+)" "x")`, "Expected a right round after regexcapture(email)"},
+		{`regexcapture(email, "@(.+)"), facet: weight`,
+			"facet can only be specified when grouping by a single predicate"},
+	} {
+		query := `{ me(func: has(email)) @groupby(` + tc.in + `) { count(uid) } }`
+		_, err := Parse(Request{Str: query})
+		require.Error(t, err, tc.in)
+		require.Contains(t, err.Error(), tc.err, tc.in)
+	}
+}
+
+func TestParseGroupbyDistance(t *testing.T) {
+	query := `
+	{
+		me(func: has(loc)) @groupby(ring: distance(loc, [37.77, -122.42]), bucket: 1.5km,
+			distance(home, [-33.87, 151.21]), city) {
+			count(uid)
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{
+		{Attr: "loc", Alias: "ring", Distance: &GroupbyDistance{Lat: 37.77, Lng: -122.42,
+			Ring: 1500}},
+		{Attr: "home", Distance: &GroupbyDistance{Lat: -33.87, Lng: 151.21, Ring: 1500}},
+		{Attr: "city"},
+	}, res.Query[0].GroupbyAttrs)
+	require.Zero(t, res.Query[0].Groupby.Bucket)
+
+	for _, tc := range []struct{ in, err string }{
+		{`distance(loc)`, "Expected a comma after the predicate in distance(loc)"},
+		{`distance(loc, home)`, "Expected a point like [lat, lng] in distance(loc)"},
+		{`distance(loc, [1]), bucket: 1km`, "must be a latitude and a longitude, but got 1"},
+		{`distance(loc, [1, 2, 3]), bucket: 1km`, "must be a latitude and a longitude"},
+		{`distance(loc, [1, x]), bucket: 1km`, "Expected a number in the point of distance(loc)"},
+		{`distance(loc, [91, 0]), bucket: 1km`, "must have a latitude between -90 and 90"},
+		{`distance(loc, [0, -181]), bucket: 1km`, "and a longitude between -180 and 180"},
+		{`distance(loc, [0, 0] 1km)`, "Expected a right round after distance(loc)"},
+		{`distance(loc, [0, 0])`, "distance() in groupby requires a bucket with a unit"},
+		{`distance(loc, [0, 0]), bucket: 10`, "distance() in groupby requires a bucket"},
+		{`distance(loc, [0, 0]), bucket: 0.5m`, "must be a whole number of meters"},
+		{`distance(loc, [0, 0]), bucket: 0km`, "must be a whole number of meters"},
+		{`distance(loc, [0, 0]), bucket: 30000km`, "between 1m and 20000km, but got 30000km"},
+		{`distance(loc, [0, 0]), bucket: 1km, bucket: 2km`,
+			"bucket can only be specified once in groupby"},
+		{`city, bucket: 1km`, "a bucket with a unit of distance can only be specified along " +
+			"with distance()"},
+		{`distance(loc, [0, 0]), bucket: 1km, facet: weight`,
+			"facet can only be specified when grouping by a single predicate"},
+	} {
+		query := `{ me(func: has(loc)) @groupby(` + tc.in + `) { count(uid) } }`
+		_, err := Parse(Request{Str: query})
+		require.Error(t, err, tc.in)
+		require.Contains(t, err.Error(), tc.err, tc.in)
+	}
+}
+
+func TestParseGroupbyCompare(t *testing.T) {
+	query := `
+	{
+		me(func: has(revenue)) @groupby(profitable: gt(revenue, cost),
+			le(<~owner>, budget, unknown: true), region) {
+			count(uid)
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	require.Equal(t, []GroupByAttr{
+		{Alias: "profitable", Compare: &GroupbyCompare{Fn: "gt", Left: "revenue", Right: "cost"}},
+		{Compare: &GroupbyCompare{Fn: "le", Left: "~owner", Right: "budget", Unknown: true}},
+		{Attr: "region"},
+	}, res.Query[0].GroupbyAttrs)
+
+	for _, tc := range []struct{ in, err string }{
+		{`gt(revenue)`, "Expected two predicates in gt(revenue)"},
+		{`gt(uid, cost)`, "Can't compare uid in gt() in groupby"},
+		{`gt(revenue, cost, strict: true)`, "Expected unknown in gt(revenue, cost)"},
+		{`gt(revenue, cost, unknown: yes)`, "Expected true or false for unknown"},
+		{`gt(revenue, cost, margin)`, "Expected unknown in gt(revenue, cost)"},
+		{`gt(revenue, cost), facet: weight`,
+			"facet can only be specified when grouping by a single predicate"},
+	} {
+		query := `{ me(func: has(revenue)) @groupby(` + tc.in + `) { count(uid) } }`
+		_, err := Parse(Request{Str: query})
+		require.Error(t, err, tc.in)
+		require.Contains(t, err.Error(), tc.err, tc.in)
+	}
+}
+
+func TestParseTdigest(t *testing.T) {
+	query := `
+	{
+		me(func: has(latency)) @groupby(endpoint) {
+			tdigest(latency, 100, 0.5, 0.99)
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	child := res.Query[0].Children[0]
+	require.Equal(t, "latency", child.Attr)
+	require.Equal(t, "tdigest", child.Func.Name)
+	require.Equal(t, []Arg{{Value: "100"}, {Value: "0.5"}, {Value: "0.99"}}, child.Func.Args)
+
+	query = `
+	{
+		me(func: has(latency)) {
+			tdigest(latency, 100, 0.5)
+		}
+	}
+`
+	_, err = Parse(Request{Str: query})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "tdigest is only allowed inside @groupby")
+
+	query = `
+	{
+		me(func: has(latency)) @groupby(endpoint) {
+			d as tdigest(latency, 100, 0.5)
+		}
+	}
+`
+	_, err = Parse(Request{Str: query})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "tdigest can't be assigned to a variable")
+}
+
 func TestParseGroupbyWithCountVar(t *testing.T) {
 	query := `
 	query {
@@ -3249,6 +4636,63 @@ func TestParseGroupbyWithAliasForKey(t *testing.T) {
 	require.Equal(t, "SchooL", res.Query[0].Children[0].GroupbyAttrs[1].Alias)
 }
 
+func TestParseGroupbyAggregatorArgs(t *testing.T) {
+	query := `
+	query {
+		me(func: uid(0x1)) {
+			friends @groupby(school) {
+				trimmedmean(age, 0.1)
+			}
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	agg := res.Query[0].Children[0].Children[0]
+	require.Equal(t, "age", agg.Attr)
+	require.Equal(t, "trimmedmean", agg.Func.Name)
+	require.Equal(t, []Arg{{Value: "0.1"}}, agg.Func.Args)
+}
+
+func TestParseAggregatorArgsWithValueVar(t *testing.T) {
+	query := `
+	query {
+		var(func: uid(0x1)) {
+			friends {
+				a as age
+			}
+		}
+		me() {
+			trimmedmean(val(a), 0.25)
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	agg := res.Query[1].Children[0]
+	require.Equal(t, "trimmedmean", agg.Func.Name)
+	require.Equal(t, "a", agg.Func.NeedsVar[0].Name)
+	require.Equal(t, []Arg{{Value: "0.25"}}, agg.Func.Args)
+}
+
+func TestParseGroupConcatSeparator(t *testing.T) {
+	query := `
+	query {
+		me(func: uid(0x1)) {
+			friends @groupby(school) {
+				groupconcat(name, ", ")
+			}
+		}
+	}
+`
+	res, err := Parse(Request{Str: query})
+	require.NoError(t, err)
+	agg := res.Query[0].Children[0].Children[0]
+	require.Equal(t, "name", agg.Attr)
+	require.Equal(t, "groupconcat", agg.Func.Name)
+	require.Equal(t, []Arg{{Value: ", "}}, agg.Func.Args)
+}
+
 func TestParseGroupbyWithAliasForError(t *testing.T) {
 	query := `
 	query {
@@ -300,10 +300,11 @@ var (
 		resolve.GuardianAuthMW4Mutation,
 	}
 	adminQueryMWConfig = map[string]resolve.QueryMiddlewares{
-		"health":      {resolve.IpWhitelistingMW4Query}, // dgraph handles Guardian auth for health
-		"state":       {resolve.IpWhitelistingMW4Query}, // dgraph handles Guardian auth for state
-		"config":      commonAdminQueryMWs,
-		"listBackups": commonAdminQueryMWs,
+		"health":          {resolve.IpWhitelistingMW4Query}, // dgraph handles Guardian auth for health
+		"state":           {resolve.IpWhitelistingMW4Query}, // dgraph handles Guardian auth for state
+		"config":          commonAdminQueryMWs,
+		"listBackups":     commonAdminQueryMWs,
+		"restoreProgress": commonAdminQueryMWs,
 		// not applying ip whitelisting to keep it in sync with /alter
 		"getGQLSchema": {resolve.GuardianAuthMW4Query},
 		// for queries and mutations related to User/Group, dgraph handles Guardian auth,
@@ -315,13 +316,14 @@ var (
 		"getUser":        {resolve.IpWhitelistingMW4Query},
 	}
 	adminMutationMWConfig = map[string]resolve.MutationMiddlewares{
-		"backup":   commonAdminMutationMWs,
-		"config":   commonAdminMutationMWs,
-		"draining": commonAdminMutationMWs,
-		"export":   commonAdminMutationMWs,
-		"login":    {resolve.IpWhitelistingMW4Mutation},
-		"restore":  commonAdminMutationMWs,
-		"shutdown": commonAdminMutationMWs,
+		"backup":        commonAdminMutationMWs,
+		"cancelRestore": commonAdminMutationMWs,
+		"config":        commonAdminMutationMWs,
+		"draining":      commonAdminMutationMWs,
+		"export":        commonAdminMutationMWs,
+		"login":         {resolve.IpWhitelistingMW4Mutation},
+		"restore":       commonAdminMutationMWs,
+		"shutdown":      commonAdminMutationMWs,
 		// not applying ip whitelisting to keep it in sync with /alter
 		"updateGQLSchema": {resolve.GuardianAuthMW4Mutation},
 		// for queries and mutations related to User/Group, dgraph handles Guardian auth,
@@ -469,13 +471,14 @@ func newAdminResolver(
 func newAdminResolverFactory() resolve.ResolverFactory {
 
 	adminMutationResolvers := map[string]resolve.MutationResolverFunc{
-		"backup":   resolveBackup,
-		"config":   resolveUpdateConfig,
-		"draining": resolveDraining,
-		"export":   resolveExport,
-		"login":    resolveLogin,
-		"restore":  resolveRestore,
-		"shutdown": resolveShutdown,
+		"backup":        resolveBackup,
+		"cancelRestore": resolveCancelRestore,
+		"config":        resolveUpdateConfig,
+		"draining":      resolveDraining,
+		"export":        resolveExport,
+		"login":         resolveLogin,
+		"restore":       resolveRestore,
+		"shutdown":      resolveShutdown,
 	}
 
 	rf := resolverFactoryWithErrorMsg(errResolverNotFound).
@@ -493,6 +496,9 @@ func newAdminResolverFactory() resolve.ResolverFactory {
 		WithQueryResolver("listBackups", func(q schema.Query) resolve.QueryResolver {
 			return resolve.QueryResolverFunc(resolveListBackups)
 		}).
+		WithQueryResolver("restoreProgress", func(q schema.Query) resolve.QueryResolver {
+			return resolve.QueryResolverFunc(resolveRestoreProgress)
+		}).
 		WithMutationResolver("updateGQLSchema", func(m schema.Mutation) resolve.MutationResolver {
 			return resolve.MutationResolverFunc(
 				func(ctx context.Context, m schema.Mutation) (*resolve.Resolved, bool) {
@@ -59,7 +59,9 @@ const adminTypes = `
 	input RestoreInput {
 
 		"""
-		Destination for the backup: e.g. Minio or S3 bucket.
+		Destination for the backup: e.g. Minio or S3 bucket. It can be a comma-separated list
+		of locations holding copies of the backup, which are tried in order until one of them
+		can be read.
 		"""
 		location: String!
 
@@ -120,10 +122,484 @@ const adminTypes = `
 		Set to true to allow backing up to S3 or Minio bucket that requires no credentials.
 		"""	
 		anonymous: Boolean
+
+		"""
+		Set to true to restore from a requester-pays S3 or GCS bucket. The requests to the
+		bucket are sent with the requester-pays header, so the owner of the credentials is
+		charged for them instead of the owner of the bucket.
+		"""
+		requesterPays: Boolean
+
+		"""
+		Set to true to compute a checksum of all the restored data. Clusters restored from
+		the same backup have the same checksum. This reads all the restored data again, so
+		it's expensive for large backups.
+		"""
+		computeChecksum: Boolean
+
+		"""
+		Predicates whose indexes, reverse edges and counts are restored: "all" (the default),
+		"none" or a comma-separated list of predicates. Skipping them makes the restore faster.
+		The skipped indexes are removed from the schema, so the queries that need them fail
+		until they are rebuilt by applying the schema returned in skippedIndexes.
+		"""
+		rebuildIndexes: String
+
+		"""
+		Set to true to only verify the backup and estimate how long restoring it would take.
+		No data is changed.
+		"""
+		dryRun: Boolean
+
+		"""
+		Directory to restore the backup into instead of the cluster, for testing. The Alpha
+		processing the request writes a p directory for each group of the backup under it,
+		like the restore command does. The data of the cluster isn't changed. The directory
+		must be writable and empty or missing.
+		"""
+		targetDir: String
+
+		"""
+		Minimum number of predicates the backup is expected to have, not counting the reserved
+		ones. The restore fails before any data is changed if the backup has fewer, e.g. to
+		avoid restoring an empty or wrong backup by mistake. Zero disables the check.
+		"""
+		minExpectedPredicates: Int
+
+		"""
+		Set to true to skip the predicates that can't be restored, e.g. because their backup
+		file is damaged, instead of failing the restore. The data of the skipped predicates is
+		not restored and they're returned in skippedPredicates.
+		"""
+		skipErrors: Boolean
+
+		"""
+		Constant added to all the restored uids, in decimal or in hex like 0x10000, so that
+		they don't collide with the uids of the existing data, e.g. when merging the data of
+		two clusters. The references between the restored nodes are kept. It must be at least
+		the max uid leased by the cluster.
+		"""
+		uidOffset: String
+
+		"""
+		Types whose definitions are restored. The other types aren't, but the data and the
+		schema of their predicates are, so those predicates can still be queried, untyped.
+		All the types are restored if neither includeTypes nor excludeTypes is set.
+		"""
+		includeTypes: [String!]
+
+		"""
+		Types whose definitions aren't restored. It can't be set along with includeTypes.
+		"""
+		excludeTypes: [String!]
+
+		"""
+		Schema altered once the backup is restored, before the restore completes, e.g. to add
+		an index. It's applied like an alter and the restore waits for its indexes to be built.
+		If it can't be applied, the restore fails with the restored data left in place.
+		"""
+		postRestoreSchema: String
+
+		"""
+		Id of the restore, which can be passed to cancelRestore to cancel it while it runs.
+		If it's not set, it's derived from the location, the backup id and the last backup of
+		the series, so retrying the same restore uses the same id. The id of a cancelled
+		restore can't be reused. A restore sent again with the id of the last restore applied
+		to the cluster completes without restoring the backup again.
+		"""
+		restoreId: String
+
+		"""
+		Set to true to keep a copy of the data of each group until the next restore, so that
+		cancelling the restore rolls the groups back to the data they had before it. Otherwise,
+		cancelling the restore drops all the data of the groups that started it.
+		"""
+		atomic: Boolean
+
+		"""
+		Set to true to move tablets between the groups once the backup is restored, so that
+		the groups have about the same size. The moves are returned in tabletMoves.
+		"""
+		rebalance: Boolean
+
+		"""
+		Set to true, along with dryRun, to read every backup file and verify the checksums
+		of its data, so that damaged files are found before restoring the backup. The
+		damaged files are all reported in the error.
+		"""
+		verifyChecksums: Boolean
+
+		"""
+		Maximum number of backup files verified at a time if verifyChecksums is set. It
+		defaults to the number of CPUs of the Alpha processing the request.
+		"""
+		verifyConcurrency: Int
+
+		"""
+		File or object that the report of a dry run is written to as JSON, e.g.
+		/backups/report.json or s3://bucket/report.json. The report holds the backups
+		that would be restored, the group of each predicate, the predicates the restore
+		would add or drop, the estimate and the checksum verification. It's written even
+		if the dry run fails, along with the error. Can only be set along with dryRun.
+		"""
+		reportPath: String
+
+		"""
+		Size in MiB of the batches that the restored data is buffered in and applied to the
+		DB in, between 1 and 1024. The writes of each batch are waited for before the next
+		one is buffered, so larger batches can restore faster but take more memory. By
+		default, the data of each backup file is applied in a single batch.
+		"""
+		batchSizeMB: Int
+
+		"""
+		Predicates whose values are converted to another type while they're restored, e.g.
+		to restore a predicate stored as a string in the backup as an int. The values that
+		can't be converted are skipped and counted in coercions. The indexes of the coerced
+		predicates aren't restored and are returned in skippedIndexes.
+		"""
+		coerceTypes: [RestoreTypeCoercion!]
+
+		"""
+		Directory of an archived write-ahead log, either the w directory of an Alpha or a
+		directory holding one for each group. The transactions it has that committed after
+		the backup are replayed on top of it, to recover the writes made since. The log must
+		start before the backup ends and the schema can't have been altered since.
+		"""
+		replayWAL: String
+
+		"""
+		Location of a second backup to compare the backup with, e.g. to check that a new
+		backup pipeline produces the same data. Both backups are restored into scratch
+		directories, under targetDir if it's set, and the predicates whose data differs are
+		returned in diff. The data of the cluster isn't changed. Both backups are read with
+		the same credentials and encryption key.
+		"""
+		diffAgainst: String
+
+		"""
+		Backup series of the backup given in diffAgainst. If it's not set, the latest series
+		at its location is used.
+		"""
+		diffAgainstBackupId: String
+
+		"""
+		Set to true for each group to take a snapshot once it has restored the backup, so that
+		the cluster starts from a compacted state instead of taking its first snapshot under
+		load. The restore completes once the snapshots are taken, and they're returned in
+		snapshots.
+		"""
+		snapshot: Boolean
+
+		"""
+		The restore checks that the disk has room for the backup before changing any data, and
+		fails otherwise. The size of the backup is multiplied by this factor, which must be at
+		least 1, to leave room for the files written while restoring it. Defaults to 1.2.
+		"""
+		diskHeadroom: Float
+
+		"""
+		Set to true for each alpha to compact the restored data into a single level of its
+		LSM tree before the restore completes, so that reads are fast right away instead of
+		once the background compactions catch up. This makes the restore take longer. The
+		compaction of each group is returned in compactions.
+		"""
+		compact: Boolean
+
+		"""
+		URL to POST a notification to once the restore completes or fails, with its id, its
+		status and either its result or its error, as JSON. The notification is sent in the
+		background and retried a few times on transient failures, so it doesn't delay the
+		response of the restore.
+		"""
+		callbackUrl: String
+	}
+
+	input RestoreTypeCoercion {
+		"""
+		Predicate whose values are converted.
+		"""
+		predicate: String!
+
+		"""
+		Type the values are converted to, as in the schema, e.g. int. Only the scalar types
+		other than password are supported.
+		"""
+		type: String!
+	}
+
+	input CancelRestoreInput {
+		"""
+		Id of the restore to cancel.
+		"""
+		restoreId: String!
+	}
+
+	type CancelRestorePayload {
+		response: Response
+	}
+
+	type RestoreEstimate {
+		"""
+		Number of backup files that would be ingested.
+		"""
+		numFiles: Int
+
+		"""
+		Total size in bytes of the backup files.
+		"""
+		size: Float
+
+		"""
+		Ingest throughput in bytes per second that the estimate is based on.
+		"""
+		throughput: Float
+
+		"""
+		Whether the throughput was measured by a previous restore processed by this alpha.
+		Otherwise, a conservative default is used.
+		"""
+		measuredThroughput: Boolean
+
+		"""
+		Estimated duration of the restore in seconds. It's only an estimate: the actual
+		duration depends on the data in the backup and the load of the cluster.
+		"""
+		estimatedDuration: Float
+	}
+
+	type RestoreVerification {
+		"""
+		Number of backup files whose checksums were verified.
+		"""
+		filesVerified: Int
+
+		"""
+		Time taken to verify the backup files, in seconds.
+		"""
+		duration: Float
+	}
+
+	type RestoreCoercion {
+		"""
+		Predicate whose values were converted.
+		"""
+		predicate: String
+
+		"""
+		Number of values converted to the new type.
+		"""
+		coerced: Int
+
+		"""
+		Number of values that couldn't be converted and were skipped.
+		"""
+		failed: Int
+	}
+
+	type PredicateDiff {
+		"""
+		Predicate whose data differs between the backups.
+		"""
+		predicate: String
+
+		"""
+		Number of nodes that have the predicate in the backup.
+		"""
+		count: Int
+
+		"""
+		Number of nodes that have the predicate in the backup given in diffAgainst.
+		"""
+		otherCount: Int
+
+		"""
+		SHA-256 checksum of the schema and the data of the predicate in the backup. It's
+		empty if the backup doesn't have the predicate.
+		"""
+		checksum: String
+
+		"""
+		SHA-256 checksum of the schema and the data of the predicate in the backup given in
+		diffAgainst. It's empty if that backup doesn't have the predicate.
+		"""
+		otherChecksum: String
+	}
+
+	type RestoreDiff {
+		"""
+		Location of the backup the backup was compared with.
+		"""
+		location: String
+
+		"""
+		Whether all the predicates have the same data in both backups.
+		"""
+		identical: Boolean
+
+		"""
+		Number of predicates found in either backup.
+		"""
+		predicatesCompared: Int
+
+		"""
+		Predicates whose data differs between the backups.
+		"""
+		predicates: [PredicateDiff]
+	}
+
+	type RestoreCompaction {
+		"""
+		Group whose data was compacted.
+		"""
+		group: Int
+
+		"""
+		Number of tables before and after the compaction.
+		"""
+		tablesBefore: Int
+		tablesAfter: Int
+
+		"""
+		Number of tables or levels that a lookup of a key may have to check, before and after
+		the compaction.
+		"""
+		readAmplificationBefore: Int
+		readAmplificationAfter: Int
+
+		"""
+		Level of the LSM tree that holds the tables after the compaction.
+		"""
+		level: Int
+
+		"""
+		Duration of the compaction in milliseconds.
+		"""
+		durationMs: Int
+	}
+
+	type RestoreIngestion {
+		"""
+		Predicate that was ingested.
+		"""
+		predicate: String
+
+		"""
+		Size in bytes of the keys of the predicate in the backup, including its indexes.
+		"""
+		bytes: Float
+
+		"""
+		Time taken to ingest the predicate, in seconds.
+		"""
+		duration: Float
+	}
+
+	type RestoreSnapshot {
+		"""
+		Group that took the snapshot.
+		"""
+		group: Int
+
+		"""
+		Index of the last Raft entry included in the snapshot.
+		"""
+		index: Int
+	}
+
+	type TabletMove {
+		"""
+		Predicate whose tablet was moved.
+		"""
+		predicate: String
+
+		"""
+		Group that served the tablet before the move.
+		"""
+		fromGroup: Int
+
+		"""
+		Group that serves the tablet after the move.
+		"""
+		toGroup: Int
 	}
 
 	type RestorePayload {
 		response: Response
+
+		"""
+		Id of the restore, which is derived from the location and the backups restored if
+		restoreId wasn't set. Sending the restore again with it completes without restoring
+		the backup again if it was already applied.
+		"""
+		restoreId: String
+
+		"""
+		Location the backup was restored from.
+		"""
+		location: String
+
+		"""
+		SHA-256 checksum of the restored data, if computeChecksum was set.
+		"""
+		checksum: String
+
+		"""
+		Schema of the predicates whose indexes were not restored. Applying it with an alter
+		operation rebuilds them.
+		"""
+		skippedIndexes: [String]
+
+		"""
+		Predicates that couldn't be restored, if skipErrors was set.
+		"""
+		skippedPredicates: [String]
+
+		"""
+		Estimate of how long the restore would take, if dryRun was set.
+		"""
+		estimate: RestoreEstimate
+
+		"""
+		Tablets moved to balance the groups, if rebalance was set.
+		"""
+		tabletMoves: [TabletMove]
+
+		"""
+		Report of the checksum verification of the backup files, if verifyChecksums was set.
+		"""
+		verification: RestoreVerification
+
+		"""
+		Number of values converted for each predicate in coerceTypes.
+		"""
+		coercions: [RestoreCoercion]
+
+		"""
+		Number of transactions of the write-ahead log replayed, if replayWAL was set.
+		"""
+		replayedTransactions: Int
+
+		"""
+		Report of the comparison with the backup given in diffAgainst, if it was set.
+		"""
+		diff: RestoreDiff
+
+		"""
+		Snapshot taken by each group after the restore, if snapshot was set.
+		"""
+		snapshots: [RestoreSnapshot]
+
+		"""
+		Compaction of the restored data by each group, if compact was set.
+		"""
+		compactions: [RestoreCompaction]
+
+		"""
+		Time taken to ingest each predicate of the backup, the slowest first. It helps finding
+		the predicates that make the restore slow, e.g. because of a large index.
+		"""
+		ingestions: [RestoreIngestion]
 	}
 
 	input ListBackupsInput {
@@ -202,6 +678,57 @@ const adminTypes = `
 		The type of backup, either full or incremental.
 		"""
 		type: String
+
+		"""
+		The version of the backup format this backup was written in. Backups written before
+		the version was recorded have version 0.
+		"""
+		version: Int
+	}
+
+	input RestoreProgressInput {
+		"""
+		Id of the restore. The progress of the last restore seen by the alpha is returned if
+		it's not set.
+		"""
+		restoreId: String
+	}
+
+	type RestoreProgress {
+		"""
+		Id of the restore.
+		"""
+		restoreId: String
+
+		"""
+		Status of the restore: RUNNING, SUCCESS, FAILED or CANCELLED.
+		"""
+		status: String
+
+		"""
+		Phase the restore is in, e.g. verifying or ingesting.
+		"""
+		phase: String
+
+		"""
+		Percentage of the backup files ingested.
+		"""
+		percent: Int
+
+		"""
+		Predicate being ingested.
+		"""
+		predicate: String
+
+		"""
+		True once the restore has finished, successfully or not.
+		"""
+		done: Boolean
+
+		"""
+		Error that made the restore fail, if any.
+		"""
+		error: String
 	}
 	
 	type LoginResponse {
@@ -407,6 +934,12 @@ const adminMutations = `
 	"""
 	restore(input: RestoreInput!) : RestorePayload
 
+	"""
+	Cancel a running restore. A restore cancelled while it's ingesting the backup leaves the
+	cluster with incomplete data.
+	"""
+	cancelRestore(input: CancelRestoreInput!) : CancelRestorePayload
+
 	"""
 	Login to Dgraph.  Successful login results in a JWT that can be used in future requests.
 	If login is not successful an error is returned.
@@ -459,4 +992,10 @@ const adminQueries = `
 	"""
 	Get the information about the backups at a given location.
 	"""
-	listBackups(input: ListBackupsInput!) : [Manifest]`
+	listBackups(input: ListBackupsInput!) : [Manifest]
+
+	"""
+	Get the progress of a restore. The alpha that received the restore reports the progress
+	of the whole restore, and the other alphas the progress of their group.
+	"""
+	restoreProgress(input: RestoreProgressInput) : RestoreProgress`
@@ -49,6 +49,7 @@ type manifest struct {
 	BackupNum uint64   `json:"backupNum,omitempty"`
 	Path      string   `json:"path,omitempty"`
 	Encrypted bool     `json:"encrypted,omitempty"`
+	Version   int      `json:"version"`
 }
 
 func resolveListBackups(ctx context.Context, q schema.Query) *resolve.Resolved {
@@ -111,6 +112,7 @@ func convertManifests(manifests []*worker.Manifest) []*manifest {
 			BackupNum: m.BackupNum,
 			Path:      m.Path,
 			Encrypted: m.Encrypted,
+			Version:   m.Version,
 		}
 
 		res[i].Groups = make([]*group, 0)
@@ -17,8 +17,19 @@
 package admin
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
 
 	"github.com/dgraph-io/dgraph/graphql/resolve"
 	"github.com/dgraph-io/dgraph/graphql/schema"
@@ -27,18 +38,53 @@ import (
 )
 
 type restoreInput struct {
-	Location          string
-	BackupId          string
-	EncryptionKeyFile string
-	AccessKey         string
-	SecretKey         string
-	SessionToken      string
-	Anonymous         bool
-	VaultAddr         string
-	VaultRoleIDFile   string
-	VaultSecretIDFile string
-	VaultPath         string
-	VaultField        string
+	Location              string
+	BackupId              string
+	EncryptionKeyFile     string
+	AccessKey             string
+	SecretKey             string
+	SessionToken          string
+	Anonymous             bool
+	RequesterPays         bool
+	Atomic                bool
+	VaultAddr             string
+	VaultRoleIDFile       string
+	VaultSecretIDFile     string
+	VaultPath             string
+	VaultField            string
+	ComputeChecksum       bool
+	RebuildIndexes        string
+	DryRun                bool
+	TargetDir             string
+	MinExpectedPredicates uint32
+	SkipErrors            bool
+	UidOffset             string
+	IncludeTypes          []string
+	ExcludeTypes          []string
+	PostRestoreSchema     string
+	RestoreId             string
+	Rebalance             bool
+	VerifyChecksums       bool
+	VerifyConcurrency     uint32
+	ReportPath            string
+	BatchSizeMB           uint32
+	CoerceTypes           []restoreTypeCoercion
+	ReplayWAL             string
+	DiffAgainst           string
+	DiffAgainstBackupId   string
+	Snapshot              bool
+	DiskHeadroom          float64
+	Compact               bool
+	CallbackUrl           string
+}
+
+type restoreTypeCoercion struct {
+	Predicate string
+	Type      string
+}
+
+type cancelRestoreInput struct {
+	RestoreId string
 }
 
 func resolveRestore(ctx context.Context, m schema.Mutation) (*resolve.Resolved, bool) {
@@ -47,32 +93,258 @@ func resolveRestore(ctx context.Context, m schema.Mutation) (*resolve.Resolved,
 	if err != nil {
 		return resolve.EmptyResult(m, err), false
 	}
+	var uidOffset uint64
+	if input.UidOffset != "" {
+		if uidOffset, err = strconv.ParseUint(input.UidOffset, 0, 64); err != nil {
+			return resolve.EmptyResult(m, errors.Errorf("invalid uidOffset %q: it must be a "+
+				"uid in decimal or in hex", input.UidOffset)), false
+		}
+	}
+	if input.CallbackUrl != "" {
+		if err := checkCallbackURL(input.CallbackUrl); err != nil {
+			return resolve.EmptyResult(m, err), false
+		}
+	}
 
 	req := pb.RestoreRequest{
-		Location:          input.Location,
-		BackupId:          input.BackupId,
-		EncryptionKeyFile: input.EncryptionKeyFile,
-		AccessKey:         input.AccessKey,
-		SecretKey:         input.SecretKey,
-		SessionToken:      input.SessionToken,
-		Anonymous:         input.Anonymous,
-		VaultAddr:         input.VaultAddr,
-		VaultRoleidFile:   input.VaultRoleIDFile,
-		VaultSecretidFile: input.VaultSecretIDFile,
-		VaultPath:         input.VaultPath,
-		VaultField:        input.VaultField,
-	}
-	err = worker.ProcessRestoreRequest(context.Background(), &req)
+		Location:              input.Location,
+		BackupId:              input.BackupId,
+		EncryptionKeyFile:     input.EncryptionKeyFile,
+		AccessKey:             input.AccessKey,
+		SecretKey:             input.SecretKey,
+		SessionToken:          input.SessionToken,
+		Anonymous:             input.Anonymous,
+		RequesterPays:         input.RequesterPays,
+		Atomic:                input.Atomic,
+		VaultAddr:             input.VaultAddr,
+		VaultRoleidFile:       input.VaultRoleIDFile,
+		VaultSecretidFile:     input.VaultSecretIDFile,
+		VaultPath:             input.VaultPath,
+		VaultField:            input.VaultField,
+		ComputeChecksum:       input.ComputeChecksum,
+		RebuildIndexes:        input.RebuildIndexes,
+		DryRun:                input.DryRun,
+		TargetDir:             input.TargetDir,
+		MinExpectedPredicates: input.MinExpectedPredicates,
+		SkipErrors:            input.SkipErrors,
+		UidOffset:             uidOffset,
+		IncludeTypes:          input.IncludeTypes,
+		ExcludeTypes:          input.ExcludeTypes,
+		PostRestoreSchema:     input.PostRestoreSchema,
+		RestoreId:             input.RestoreId,
+		Rebalance:             input.Rebalance,
+		VerifyChecksums:       input.VerifyChecksums,
+		VerifyConcurrency:     input.VerifyConcurrency,
+		ReportPath:            input.ReportPath,
+		BatchSizeMb:           input.BatchSizeMB,
+		ReplayWal:             input.ReplayWAL,
+		DiffAgainst:           input.DiffAgainst,
+		DiffAgainstBackupId:   input.DiffAgainstBackupId,
+		Snapshot:              input.Snapshot,
+		DiskHeadroom:          input.DiskHeadroom,
+		Compact:               input.Compact,
+	}
+	for _, coercion := range input.CoerceTypes {
+		req.CoerceTypes = append(req.CoerceTypes, &pb.TypeCoercion{
+			Predicate: coercion.Predicate,
+			Type:      coercion.Type,
+		})
+	}
+	result, err := worker.ProcessRestoreRequest(context.Background(), &req)
 	if err != nil {
+		notifyRestore(input.CallbackUrl, req.RestoreId, nil, err)
 		return resolve.EmptyResult(m, err), false
 	}
 
+	var res map[string]interface{}
+	switch {
+	case input.DryRun:
+		res = dryRunResponse(result)
+	case input.DiffAgainst != "":
+		res = diffResponse(result)
+	default:
+		res = restoreResponse(input, result)
+	}
+	notifyRestore(input.CallbackUrl, req.RestoreId, res, nil)
+	return &resolve.Resolved{
+		Data:  map[string]interface{}{m.Name(): res},
+		Field: m,
+	}, true
+}
+
+// restoreResponse returns the response to a restore that completed.
+func restoreResponse(input *restoreInput, result *worker.RestoreResult) map[string]interface{} {
+	res := response("Success", "Restore completed.")
+	res["restoreId"] = result.RestoreId
+	res["location"] = result.Location
+	if input.ComputeChecksum {
+		res["checksum"] = result.Checksum
+	}
+	skippedIndexes := make([]interface{}, 0, len(result.SkippedIndexes))
+	for _, s := range result.SkippedIndexes {
+		skippedIndexes = append(skippedIndexes, s)
+	}
+	res["skippedIndexes"] = skippedIndexes
+	skippedPreds := make([]interface{}, 0, len(result.SkippedPredicates))
+	for _, pred := range result.SkippedPredicates {
+		skippedPreds = append(skippedPreds, pred)
+	}
+	res["skippedPredicates"] = skippedPreds
+	tabletMoves := make([]interface{}, 0, len(result.TabletMoves))
+	for _, move := range result.TabletMoves {
+		tabletMoves = append(tabletMoves, map[string]interface{}{
+			"predicate": move.Predicate,
+			"fromGroup": int(move.FromGroup),
+			"toGroup":   int(move.ToGroup),
+		})
+	}
+	res["tabletMoves"] = tabletMoves
+	coercions := make([]interface{}, 0, len(result.Coercions))
+	for _, report := range result.Coercions {
+		coercions = append(coercions, map[string]interface{}{
+			"predicate": report.Predicate,
+			"coerced":   int(report.Coerced),
+			"failed":    int(report.Failed),
+		})
+	}
+	res["coercions"] = coercions
+	res["replayedTransactions"] = result.ReplayedTransactions
+	snapshots := make([]interface{}, 0, len(result.Snapshots))
+	for _, snap := range result.Snapshots {
+		snapshots = append(snapshots, map[string]interface{}{
+			"group": int(snap.Group),
+			"index": int(snap.Index),
+		})
+	}
+	res["snapshots"] = snapshots
+	compactions := make([]interface{}, 0, len(result.Compactions))
+	for _, c := range result.Compactions {
+		compactions = append(compactions, map[string]interface{}{
+			"group":                   int(c.Group),
+			"tablesBefore":            c.TablesBefore,
+			"tablesAfter":             c.TablesAfter,
+			"readAmplificationBefore": c.ReadAmplificationBefore,
+			"readAmplificationAfter":  c.ReadAmplificationAfter,
+			"level":                   c.Level,
+			"durationMs":              int(c.Duration / time.Millisecond),
+		})
+	}
+	res["compactions"] = compactions
+	ingestions := make([]interface{}, 0, len(result.Ingestions))
+	for _, ingestion := range result.Ingestions {
+		ingestions = append(ingestions, map[string]interface{}{
+			"predicate": ingestion.Predicate,
+			"bytes":     float64(ingestion.Bytes),
+			"duration":  ingestion.Duration.Seconds(),
+		})
+	}
+	res["ingestions"] = ingestions
+	return res
+}
+
+func resolveCancelRestore(ctx context.Context, m schema.Mutation) (*resolve.Resolved, bool) {
+	inputByts, err := json.Marshal(m.ArgValue(schema.InputArgName))
+	if err != nil {
+		return resolve.EmptyResult(m, schema.GQLWrapf(err, "couldn't get input argument")),
+			false
+	}
+	var input cancelRestoreInput
+	if err := json.Unmarshal(inputByts, &input); err != nil {
+		return resolve.EmptyResult(m, schema.GQLWrapf(err, "couldn't get input argument")),
+			false
+	}
+
+	if err := worker.CancelRestore(ctx, input.RestoreId); err != nil {
+		return resolve.EmptyResult(m, err), false
+	}
 	return &resolve.Resolved{
-		Data:  map[string]interface{}{m.Name(): response("Success", "Restore completed.")},
+		Data: map[string]interface{}{m.Name(): response("Success",
+			fmt.Sprintf("Restore %s was cancelled.", input.RestoreId))},
 		Field: m,
 	}, true
 }
 
+type restoreProgressInput struct {
+	RestoreId string
+}
+
+func resolveRestoreProgress(ctx context.Context, q schema.Query) *resolve.Resolved {
+	var input restoreProgressInput
+	if arg := q.ArgValue(schema.InputArgName); arg != nil {
+		inputByts, err := json.Marshal(arg)
+		if err != nil {
+			return resolve.EmptyResult(q, schema.GQLWrapf(err, "couldn't get input argument"))
+		}
+		if err := json.Unmarshal(inputByts, &input); err != nil {
+			return resolve.EmptyResult(q, schema.GQLWrapf(err, "couldn't get input argument"))
+		}
+	}
+
+	progress, err := worker.RestoreProgress(input.RestoreId)
+	if err != nil {
+		return resolve.EmptyResult(q, err)
+	}
+	return &resolve.Resolved{
+		Data: map[string]interface{}{q.Name(): map[string]interface{}{
+			"restoreId": progress.RestoreId,
+			"status":    progress.Status,
+			"phase":     progress.Phase,
+			"percent":   int64(progress.Percent),
+			"predicate": progress.Predicate,
+			"done":      progress.Done,
+			"error":     progress.Error,
+		}},
+		Field: q,
+	}
+}
+
+// dryRunResponse returns the response to a dry-run restore with its estimate and the report
+// of its checksum verification.
+func dryRunResponse(result *worker.RestoreResult) map[string]interface{} {
+	res := response("Success", "Restore dry run completed. No data was changed.")
+	res["location"] = result.Location
+	estimate := result.Estimate
+	res["estimate"] = map[string]interface{}{
+		"numFiles":           estimate.NumFiles,
+		"size":               float64(estimate.Size),
+		"throughput":         estimate.Throughput,
+		"measuredThroughput": estimate.Measured,
+		"estimatedDuration":  estimate.Duration.Seconds(),
+	}
+	if v := result.Verification; v != nil {
+		res["verification"] = map[string]interface{}{
+			"filesVerified": v.FilesVerified,
+			"duration":      v.Duration.Seconds(),
+		}
+	}
+	return res
+}
+
+// diffResponse returns the response to a restore that compared the backup with a second one
+// instead of restoring it.
+func diffResponse(result *worker.RestoreResult) map[string]interface{} {
+	res := response("Success", "Backups compared. No data was changed.")
+	res["location"] = result.Location
+	diff := result.Diff
+	preds := make([]interface{}, 0, len(diff.Predicates))
+	for _, d := range diff.Predicates {
+		preds = append(preds, map[string]interface{}{
+			"predicate":     d.Predicate,
+			"count":         int(d.Count),
+			"otherCount":    int(d.OtherCount),
+			"checksum":      d.Checksum,
+			"otherChecksum": d.OtherChecksum,
+		})
+	}
+	res["diff"] = map[string]interface{}{
+		"location":           diff.Location,
+		"identical":          len(diff.Predicates) == 0,
+		"predicatesCompared": diff.PredicatesCompared,
+		"predicates":         preds,
+	}
+	return res
+}
+
 func getRestoreInput(m schema.Mutation) (*restoreInput, error) {
 	inputArg := m.ArgValue(schema.InputArgName)
 	inputByts, err := json.Marshal(inputArg)
@@ -84,3 +356,93 @@ func getRestoreInput(m schema.Mutation) (*restoreInput, error) {
 	err = json.Unmarshal(inputByts, &input)
 	return &input, schema.GQLWrapf(err, "couldn't get input argument")
 }
+
+// restoreCallbackAttempts is the number of times the notification of a restore is sent to its
+// callback URL before giving up, and restoreCallbackBackoff is the wait before the first retry,
+// which doubles before each of the next ones.
+var (
+	restoreCallbackAttempts = 4
+	restoreCallbackBackoff  = time.Second
+)
+
+// restoreCallbackTimeout is the time the receiver of a notification has to respond.
+const restoreCallbackTimeout = 10 * time.Second
+
+// restoreNotification is the notification POSTed to the callback URL of a restore once it's
+// done. Result holds the response of the restore mutation if it succeeded.
+type restoreNotification struct {
+	RestoreId string                 `json:"restoreId,omitempty"`
+	Status    string                 `json:"status"`
+	Error     string                 `json:"error,omitempty"`
+	Result    map[string]interface{} `json:"result,omitempty"`
+}
+
+// checkCallbackURL returns an error if the callback URL of a restore can't be notified.
+func checkCallbackURL(callbackURL string) error {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return errors.Wrapf(err, "invalid callbackUrl %q", callbackURL)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Errorf("invalid callbackUrl %q: it must be an http or https URL",
+			callbackURL)
+	}
+	return nil
+}
+
+// notifyRestore sends the notification of the restore with the given id to its callback URL,
+// if it has one, with either the response of the restore or the error it failed with. It's
+// sent in the background, so the response of the restore isn't delayed by the receiver.
+func notifyRestore(callbackURL, restoreId string, res map[string]interface{}, rerr error) {
+	if callbackURL == "" {
+		return
+	}
+	n := restoreNotification{RestoreId: restoreId, Status: "Success", Result: res}
+	if rerr != nil {
+		n.Status = "Failure"
+		n.Error = rerr.Error()
+	}
+	body, err := json.Marshal(n)
+	if err != nil {
+		glog.Errorf("Cannot encode the notification of restore %s: %v", restoreId, err)
+		return
+	}
+	go func() {
+		if err := postRestoreCallback(callbackURL, body); err != nil {
+			glog.Errorf("Cannot notify %s of restore %s: %v", callbackURL, restoreId, err)
+		}
+	}()
+}
+
+// postRestoreCallback POSTs the notification of a restore to its callback URL. The requests
+// that fail to reach the receiver and the responses with a 429 or 5xx status are transient
+// failures, which are retried with an exponential backoff. Any other failure is returned
+// right away.
+func postRestoreCallback(callbackURL string, body []byte) error {
+	client := &http.Client{Timeout: restoreCallbackTimeout}
+	backoff := restoreCallbackBackoff
+	var err error
+	for attempt := 1; attempt <= restoreCallbackAttempts; attempt++ {
+		if attempt > 1 {
+			glog.Warningf("Retrying the notification to %s in %s: %v", callbackURL, backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var resp *http.Response
+		resp, err = client.Post(callbackURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			return nil
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			err = errors.Errorf("the receiver responded with %s", resp.Status)
+		default:
+			return errors.Errorf("the receiver responded with %s", resp.Status)
+		}
+	}
+	return errors.Wrapf(err, "giving up after %d attempts", restoreCallbackAttempts)
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// callbackReceiver is a mock receiver of the notifications of restores, which responds to the
+// first notifications with the given statuses and to the next ones with 200.
+func callbackReceiver(t *testing.T, statuses ...int) (*httptest.Server, chan restoreNotification) {
+	received := make(chan restoreNotification, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var n restoreNotification
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&n))
+		received <- n
+		if len(statuses) > 0 {
+			w.WriteHeader(statuses[0])
+			statuses = statuses[1:]
+		}
+	}))
+	return srv, received
+}
+
+func receive(t *testing.T, received chan restoreNotification) restoreNotification {
+	select {
+	case n := <-received:
+		return n
+	case <-time.After(10 * time.Second):
+		t.Fatal("no notification received")
+		return restoreNotification{}
+	}
+}
+
+func TestNotifyRestore(t *testing.T) {
+	defer func(b time.Duration) { restoreCallbackBackoff = b }(restoreCallbackBackoff)
+	restoreCallbackBackoff = time.Millisecond
+
+	t.Run("success is retried on transient failures", func(t *testing.T) {
+		srv, received := callbackReceiver(t, http.StatusServiceUnavailable,
+			http.StatusTooManyRequests)
+		defer srv.Close()
+
+		res := response("Success", "Restore completed.")
+		notifyRestore(srv.URL, "restore-1", res, nil)
+		for i := 0; i < 3; i++ {
+			n := receive(t, received)
+			require.Equal(t, "restore-1", n.RestoreId)
+			require.Equal(t, "Success", n.Status)
+			require.Empty(t, n.Error)
+			require.Equal(t, map[string]interface{}{"code": "Success",
+				"message": "Restore completed."}, n.Result["response"])
+		}
+		select {
+		case <-received:
+			t.Fatal("the notification was sent again after the receiver accepted it")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	t.Run("failure is not retried on client errors", func(t *testing.T) {
+		srv, received := callbackReceiver(t, http.StatusBadRequest)
+		defer srv.Close()
+
+		notifyRestore(srv.URL, "restore-2", nil, errors.New("cannot read manifests"))
+		n := receive(t, received)
+		require.Equal(t, "restore-2", n.RestoreId)
+		require.Equal(t, "Failure", n.Status)
+		require.Equal(t, "cannot read manifests", n.Error)
+		require.Nil(t, n.Result)
+		select {
+		case <-received:
+			t.Fatal("the notification was retried after a client error")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
+
+func TestPostRestoreCallbackGivesUp(t *testing.T) {
+	defer func(b time.Duration) { restoreCallbackBackoff = b }(restoreCallbackBackoff)
+	restoreCallbackBackoff = time.Millisecond
+
+	srv, received := callbackReceiver(t, http.StatusInternalServerError,
+		http.StatusInternalServerError, http.StatusInternalServerError,
+		http.StatusInternalServerError)
+	defer srv.Close()
+
+	err := postRestoreCallback(srv.URL, []byte(`{"status":"Success"}`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "giving up after 4 attempts")
+	require.Len(t, received, restoreCallbackAttempts)
+}
+
+func TestCheckCallbackURL(t *testing.T) {
+	require.NoError(t, checkCallbackURL("http://localhost:8000/restored"))
+	require.NoError(t, checkCallbackURL("https://example.com/hooks/restore?token=x"))
+	for _, u := range []string{"localhost:8000", "ftp://example.com/x", "http://", "://x"} {
+		require.Error(t, checkCallbackURL(u), u)
+	}
+}
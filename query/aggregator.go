@@ -19,8 +19,13 @@ package query
 import (
 	"bytes"
 	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/dgraph-io/dgraph/gql"
 	"github.com/dgraph-io/dgraph/protos/pb"
 	"github.com/dgraph-io/dgraph/types"
 	"github.com/dgraph-io/dgraph/x"
@@ -31,6 +36,146 @@ type aggregator struct {
 	name   string
 	result types.Val
 	count  int // used when we need avergae.
+	// comp accumulates the rounding errors of the float additions of sum, avg and sumdistinct,
+	// which are added back to the result of the large sums.
+	comp float64
+	// state holds what the aggregators that keep more than their running result need to
+	// compute it, along with their arguments. It's created by setArgs.
+	state aggregatorState
+	// err is the error found while applying the values, returned by Value.
+	err error
+	// budget limits the values buffered by this aggregator along with the others sharing it.
+	budget *bufferBudget
+	// custom is the instance of the custom aggregator registered under the name, if it isn't
+	// the name of a built-in aggregator.
+	custom CustomAggregator
+}
+
+// bufferBudget caps the total number of values buffered by a set of aggregators, so that
+// a query can't exhaust the memory of the alpha by buffering too many values. The aggregators
+// sharing it can run concurrently.
+type bufferBudget struct {
+	limit int
+	used  int64
+}
+
+// take accounts for one more buffered value. It returns an error if the limit is exceeded.
+// A nil budget or a non-positive limit never runs out.
+func (b *bufferBudget) take() error {
+	if b == nil || b.limit <= 0 {
+		return nil
+	}
+	if atomic.AddInt64(&b.used, 1) > int64(b.limit) {
+		return errors.Errorf("Aggregators in groupby can buffer at most %d values. "+
+			"Use --aggregate_buffer_limit to change the limit", b.limit)
+	}
+	return nil
+}
+
+// weightedValue is a value applied to wpercentile along with its weight.
+type weightedValue struct {
+	value  float64
+	weight float64
+}
+
+// comparisonOps maps the comparisons accepted by countif and by the comparisons of two
+// predicates in groupby to the functions used to compare the values.
+var comparisonOps = map[string]string{
+	"eq": "==",
+	"ne": "!=",
+	"lt": "<",
+	"le": "<=",
+	"gt": ">",
+	"ge": ">=",
+}
+
+// compensatedSumThreshold is the number of float values above which sum and avg add the
+// rounding errors of their additions back to the result, as in the Kahan-Babuska summation.
+// The error of the naive summation grows with the number of values, so the smaller sums are
+// returned as they're accumulated.
+const compensatedSumThreshold = 1000
+
+// defaultGroupConcatLen is the maximum length in bytes of the string returned by groupconcat,
+// unless another one is passed to it. The values that don't fit are left out of the result.
+const defaultGroupConcatLen = 64 << 10
+
+// maxGroupConcatLen is the largest maximum length that can be passed to groupconcat.
+const maxGroupConcatLen = 16 << 20
+
+// isBufferedAggregator returns true if the aggregator needs to buffer all the values
+// before computing its result.
+func isBufferedAggregator(name string) bool {
+	return name == "trimmedmean" || name == "groupconcat" || name == "gini"
+}
+
+// isOrderedAggregator returns true if the result of the aggregator depends on the order the
+// values are applied in.
+func isOrderedAggregator(name string) bool {
+	return name == "first" || name == "last"
+}
+
+// aggregatorState is the state of an aggregator that keeps more than its running result, like
+// the values it buffers or the estimator it feeds.
+type aggregatorState interface {
+	// apply adds val to the state. The errors are recorded in ag.err, to be returned by Value.
+	apply(ag *aggregator, val types.Val)
+	// value returns the result of the aggregator.
+	value(ag *aggregator) (types.Val, error)
+}
+
+// argsParser is implemented by the states of the aggregators that accept extra arguments,
+// which are parsed once, before any value is applied.
+type argsParser interface {
+	parseArgs(args []gql.Arg) error
+}
+
+// aggregatorStates maps the names of the aggregators that keep a state to the functions
+// returning their initial state.
+var aggregatorStates = map[string]func() aggregatorState{
+	"trimmedmean":    func() aggregatorState { return &trimmedMeanState{} },
+	"groupconcat":    func() aggregatorState { return &groupConcatState{} },
+	"gini":           func() aggregatorState { return &giniState{} },
+	"distinctvalues": func() aggregatorState { return &distinctValuesState{} },
+	"countdistinct":  func() aggregatorState { return &countDistinctState{} },
+	"sumdistinct":    func() aggregatorState { return &sumDistinctState{} },
+	"tdigest":        func() aggregatorState { return &tdigestState{} },
+	"wpercentile":    func() aggregatorState { return &weightedPercentileState{} },
+	"p2percentile":   func() aggregatorState { return &p2PercentileState{} },
+	"countif":        func() aggregatorState { return &countifState{} },
+	"medianuid":      func() aggregatorState { return &medianUidState{} },
+	"range":          func() aggregatorState { return &rangeState{} },
+	"hmean":          func() aggregatorState { return &harmonicMeanState{} },
+	"gmean":          func() aggregatorState { return &geometricMeanState{} },
+	"cv":             func() aggregatorState { return &varianceState{} },
+	"sem":            func() aggregatorState { return &varianceState{} },
+}
+
+// setArgs validates the extra arguments passed to the aggregator function and creates the
+// state of the aggregator, if it keeps one, from them.
+func (ag *aggregator) setArgs(args []gql.Arg) error {
+	if newState, ok := aggregatorStates[ag.name]; ok {
+		state := newState()
+		if parser, ok := state.(argsParser); ok {
+			if err := parser.parseArgs(args); err != nil {
+				return err
+			}
+		} else if len(args) > 0 {
+			return errors.Errorf("Aggregator %s doesn't accept any arguments", ag.name)
+		}
+		ag.state = state
+		return nil
+	}
+	if len(args) > 0 {
+		return errors.Errorf("Aggregator %s doesn't accept any arguments", ag.name)
+	}
+	if !isBuiltinAggregatorFn(ag.name) && varAggregators[ag.name] == nil {
+		custom, ok := newCustomAggregator(ag.name)
+		if !ok {
+			return errors.Errorf("Unknown aggregator function %q", ag.name)
+		}
+		ag.custom = custom
+	}
+	return nil
 }
 
 func isUnary(f string) bool {
@@ -474,12 +619,959 @@ func (ag *aggregator) ApplyVal(v types.Val) error {
 	return nil
 }
 
-func (ag *aggregator) Apply(val types.Val) {
+// numeric returns the int or float val as a float. Any other value is recorded as an error.
+func (ag *aggregator) numeric(val types.Val) (float64, bool) {
+	switch val.Tid {
+	case types.IntID:
+		return float64(val.Value.(int64)), true
+	case types.FloatID:
+		return val.Value.(float64), true
+	}
+	ag.err = errors.Errorf("Wrong type %v encountered for func %s. "+
+		"Only int and float values are allowed", val.Tid.Name(), ag.name)
+	return 0, false
+}
+
+// valueBuffer buffers all the values applied to an aggregator that needs to look at the whole
+// set of values before computing its result.
+type valueBuffer struct {
+	vals []types.Val
+}
+
+func (b *valueBuffer) apply(ag *aggregator, val types.Val) {
+	if err := ag.budget.take(); err != nil {
+		ag.err = err
+		b.vals = nil
+		return
+	}
+	b.vals = append(b.vals, val)
+	ag.count++
+}
+
+// trimmedMeanState buffers the values of trimmedmean, which drops the trim fraction of them
+// from each end.
+type trimmedMeanState struct {
+	valueBuffer
+	trim float64
+}
+
+func (s *trimmedMeanState) parseArgs(args []gql.Arg) error {
+	if len(args) != 1 {
+		return errors.Errorf("trimmedmean expects a trim fraction as its second argument")
+	}
+	trim, err := strconv.ParseFloat(args[0].Value, 64)
+	if err != nil {
+		return errors.Wrapf(err, "while parsing trim fraction for trimmedmean")
+	}
+	if trim < 0 || trim >= 0.5 {
+		return errors.Errorf("Trim fraction for trimmedmean must be in [0, 0.5). Got: %v",
+			trim)
+	}
+	s.trim = trim
+	return nil
+}
+
+// value drops the configured fraction of the lowest and highest values and returns the
+// average of the rest.
+func (s *trimmedMeanState) value(ag *aggregator) (types.Val, error) {
+	res := types.Val{Tid: types.FloatID}
+	nums := make([]float64, 0, len(s.vals))
+	for _, v := range s.vals {
+		switch v.Tid {
+		case types.IntID:
+			nums = append(nums, float64(v.Value.(int64)))
+		case types.FloatID:
+			nums = append(nums, v.Value.(float64))
+		default:
+			return res, errors.Errorf("Wrong type %v encountered for func %s", v.Tid, ag.name)
+		}
+	}
+	sort.Float64s(nums)
+
+	k := int(float64(len(nums)) * s.trim)
+	nums = nums[k : len(nums)-k]
+	if len(nums) == 0 {
+		return res, ErrEmptyVal
+	}
+	var sum float64
+	for _, n := range nums {
+		sum += n
+	}
+	res.Value = sum / float64(len(nums))
+	return res, nil
+}
+
+// giniState buffers the values of gini.
+type giniState struct {
+	valueBuffer
+}
+
+// value returns the Gini coefficient of the values, between 0 if they're all equal and 1 if a
+// single value holds the whole sum. It's 0 if there are fewer than two values or if they're
+// all zero, as there's no inequality among them. The coefficient isn't defined for negative
+// values.
+func (s *giniState) value(ag *aggregator) (types.Val, error) {
+	res := types.Val{Tid: types.FloatID, Value: 0.0}
+	nums := make([]float64, 0, len(s.vals))
+	for _, v := range s.vals {
+		var n float64
+		switch v.Tid {
+		case types.IntID:
+			n = float64(v.Value.(int64))
+		case types.FloatID:
+			n = v.Value.(float64)
+		default:
+			return res, errors.Errorf("Wrong type %v encountered for func %s. "+
+				"Only int and float values are allowed", v.Tid.Name(), ag.name)
+		}
+		if n < 0 {
+			return res, errors.Errorf("gini is only defined for non-negative values. Got: %v", n)
+		}
+		nums = append(nums, n)
+	}
+	if len(nums) < 2 {
+		return res, nil
+	}
+	sort.Float64s(nums)
+
+	// With the values sorted in ascending order and ranked from 1, the coefficient is
+	// 2 * sum(rank * value) / (n * sum(value)) - (n + 1) / n.
+	var sum, weighted float64
+	for i, n := range nums {
+		sum += n
+		weighted += float64(i+1) * n
+	}
+	if sum == 0 || math.IsInf(sum, 0) {
+		return res, nil
+	}
+	count := float64(len(nums))
+	g := 2*weighted/(count*sum) - (count+1)/count
+	// Rounding errors can push the coefficient of nearly equal values slightly below zero.
+	res.Value = math.Min(math.Max(g, 0), 1)
+	return res, nil
+}
+
+// groupConcatState buffers the values of groupconcat. sep is the separator the values are
+// joined with, distinct is true if each distinct value is joined once and maxLen is the
+// maximum length in bytes of the result.
+type groupConcatState struct {
+	valueBuffer
+	sep      string
+	distinct bool
+	maxLen   int
+}
+
+// parseArgs parses the arguments of groupconcat: the separator, followed by distinct to join
+// each distinct value once and by the maximum length of the result, in any order, e.g.
+// groupconcat(val(x), ";", distinct, 1024).
+func (s *groupConcatState) parseArgs(args []gql.Arg) error {
+	s.sep = ","
+	s.maxLen = defaultGroupConcatLen
+	if len(args) == 0 {
+		return nil
+	}
+	s.sep = args[0].Value
+	var hasMaxLen bool
+	for _, arg := range args[1:] {
+		if arg.Value == "distinct" && !s.distinct {
+			s.distinct = true
+			continue
+		}
+		n, err := strconv.Atoi(arg.Value)
+		if err != nil || hasMaxLen {
+			return errors.Errorf("groupconcat accepts a separator followed by distinct and the "+
+				"maximum length of its result, but got: %s", arg.Value)
+		}
+		if n < 1 || n > maxGroupConcatLen {
+			return errors.Errorf("The maximum length for groupconcat must be between 1 and %d, "+
+				"but got %d", maxGroupConcatLen, n)
+		}
+		s.maxLen, hasMaxLen = n, true
+	}
+	return nil
+}
+
+// value converts the values to strings, sorts them and joins them with the configured
+// separator, once each if distinct is set. Values are added until the result would exceed
+// the maximum length.
+func (s *groupConcatState) value(ag *aggregator) (types.Val, error) {
+	res := types.Val{Tid: types.StringID}
+	if len(s.vals) == 0 {
+		return res, ErrEmptyVal
+	}
+	strs := make([]string, 0, len(s.vals))
+	for _, v := range s.vals {
+		sv := types.ValueForType(types.StringID)
+		if err := types.Marshal(v, &sv); err != nil {
+			return res, errors.Wrapf(err, "while converting value for func %s", ag.name)
+		}
+		strs = append(strs, sv.Value.(string))
+	}
+	sort.Strings(strs)
+	if s.distinct {
+		strs = dedupSortedStrings(strs)
+	}
+
+	var sb strings.Builder
+	for i, str := range strs {
+		sz := len(str)
+		if i > 0 {
+			sz += len(s.sep)
+		}
+		if sb.Len()+sz > s.maxLen {
+			break
+		}
+		if i > 0 {
+			sb.WriteString(s.sep)
+		}
+		sb.WriteString(str)
+	}
+	res.Value = sb.String()
+	return res, nil
+}
+
+// distinctValuesState keeps the distinct values of distinctvalues, at most limit of them.
+// seen holds their string keys and truncated is true if more distinct values were found.
+type distinctValuesState struct {
+	limit     int
+	seen      map[string]struct{}
+	vals      []types.Val
+	truncated bool
+}
+
+func (s *distinctValuesState) parseArgs(args []gql.Arg) error {
+	if len(args) != 1 {
+		return errors.Errorf("distinctvalues expects the maximum number of values as its " +
+			"second argument")
+	}
+	limit, err := strconv.Atoi(args[0].Value)
+	if err != nil || limit <= 0 {
+		return errors.Errorf("The maximum number of values for distinctvalues must be a "+
+			"positive integer. Got: %v", args[0].Value)
+	}
+	s.limit = limit
+	return nil
+}
+
+// apply keeps val if no value with the same string key was applied before. Once the limit of
+// values is reached, the distinct values that follow are dropped and the result is flagged as
+// truncated.
+func (s *distinctValuesState) apply(ag *aggregator, val types.Val) {
+	sv := types.ValueForType(types.StringID)
+	if err := types.Marshal(val, &sv); err != nil {
+		ag.err = errors.Wrapf(err, "while converting value for func %s", ag.name)
+		return
+	}
+	key := sv.Value.(string)
+	if _, ok := s.seen[key]; ok {
+		return
+	}
+	if len(s.vals) >= s.limit {
+		s.truncated = true
+		return
+	}
+	if err := ag.budget.take(); err != nil {
+		ag.err = err
+		s.vals = nil
+		return
+	}
+	if s.seen == nil {
+		s.seen = make(map[string]struct{})
+	}
+	s.seen[key] = struct{}{}
+	s.vals = append(s.vals, val)
+}
+
+func (s *distinctValuesState) value(ag *aggregator) (types.Val, error) {
+	// The values are read with distinctValues, as they can't be held by a single value.
+	return ag.result, errors.Errorf("distinctvalues is only allowed inside @groupby")
+}
+
+// distinctValues returns the sorted values kept by distinctvalues and whether some distinct
+// values were dropped because of its limit.
+func (ag *aggregator) distinctValues() ([]types.Val, bool, error) {
+	if ag.err != nil {
+		return nil, false, ag.err
+	}
+	s := ag.state.(*distinctValuesState)
+	if len(s.vals) == 0 {
+		return nil, false, ErrEmptyVal
+	}
+	vals := append([]types.Val(nil), s.vals...)
+	sort.SliceStable(vals, func(i, j int) bool {
+		l, _ := types.Less(vals[i], vals[j])
+		return l
+	})
+	return vals, s.truncated, nil
+}
+
+// distinctKey returns the string key that tells the distinct values applied to countdistinct
+// and sumdistinct apart.
+func (ag *aggregator) distinctKey(val types.Val) (string, error) {
+	if val.Tid == types.UidID {
+		return strconv.FormatUint(val.Value.(uint64), 16), nil
+	}
+	sv := types.ValueForType(types.StringID)
+	if err := types.Marshal(val, &sv); err != nil {
+		return "", errors.Wrapf(err, "while converting value for func %s", ag.name)
+	}
+	return sv.Value.(string), nil
+}
+
+// countDistinctState holds the keys of the values counted by countdistinct, or the
+// HyperLogLog estimating their number if the count is approximate.
+type countDistinctState struct {
+	hll  *hyperLogLog
+	seen map[string]struct{}
+}
+
+func (s *countDistinctState) parseArgs(args []gql.Arg) error {
+	if len(args) > 1 || (len(args) == 1 && args[0].Value != "hll") {
+		return errors.Errorf("countdistinct accepts at most hll as its second argument, to " +
+			"estimate the count")
+	}
+	if len(args) == 1 {
+		s.hll = newHyperLogLog()
+	}
+	return nil
+}
+
+// apply counts val if no value with the same key was applied before. The keys of the values
+// counted are kept, so they count towards the buffer limit, unless the count is estimated with
+// a HyperLogLog.
+func (s *countDistinctState) apply(ag *aggregator, val types.Val) {
+	key, err := ag.distinctKey(val)
+	if err != nil {
+		ag.err = err
+		return
+	}
+	if s.hll != nil {
+		s.hll.add([]byte(key))
+		return
+	}
+	if _, ok := s.seen[key]; ok {
+		return
+	}
+	if err := ag.budget.take(); err != nil {
+		ag.err = err
+		s.seen = nil
+		return
+	}
+	if s.seen == nil {
+		s.seen = make(map[string]struct{})
+	}
+	s.seen[key] = struct{}{}
+}
+
+func (s *countDistinctState) value(ag *aggregator) (types.Val, error) {
+	// Unlike most aggregators, there's a result even if no value was applied.
+	if s.hll != nil {
+		return types.Val{Tid: types.IntID, Value: int64(s.hll.estimate())}, nil
+	}
+	return types.Val{Tid: types.IntID, Value: int64(len(s.seen))}, nil
+}
+
+// sumDistinctState holds the keys of the values summed by sumdistinct. The sum is the result
+// of the aggregator.
+type sumDistinctState struct {
+	seen map[string]struct{}
+}
+
+// apply adds val to the sum if no value with the same key was applied before. Only int and
+// float values can be summed. The sum of int values becomes a float if it overflows, as it
+// does once a float value is added to it.
+func (s *sumDistinctState) apply(ag *aggregator, val types.Val) {
+	if val.Tid != types.IntID && val.Tid != types.FloatID {
+		ag.err = errors.Errorf("Wrong type %v encountered for func %s. "+
+			"Only int and float values are allowed", val.Tid.Name(), ag.name)
+		return
+	}
+	key, err := ag.distinctKey(val)
+	if err != nil {
+		ag.err = err
+		return
+	}
+	// The keys of ints and floats may be the same, e.g. for 2 and 2.0, which are the same
+	// amount.
+	if _, ok := s.seen[key]; ok {
+		return
+	}
+	if err := ag.budget.take(); err != nil {
+		ag.err = err
+		s.seen = nil
+		return
+	}
+	if s.seen == nil {
+		s.seen = make(map[string]struct{})
+	}
+	s.seen[key] = struct{}{}
+	ag.count++
+
 	if ag.result.Value == nil {
 		ag.result = val
+		return
+	}
+	if ag.result.Tid == types.IntID && val.Tid == types.IntID {
+		a, b := ag.result.Value.(int64), val.Value.(int64)
+		if s := a + b; (s > a) == (b > 0) {
+			ag.result.Value = s
+			return
+		}
+	}
+	ag.result = types.Val{
+		Tid:   types.FloatID,
+		Value: ag.compensatedAdd(asFloat(ag.result), asFloat(val)),
+	}
+}
+
+func (s *sumDistinctState) value(ag *aggregator) (types.Val, error) {
+	return ag.resultValue()
+}
+
+// asFloat returns the int or float value of val as a float.
+func asFloat(val types.Val) float64 {
+	if val.Tid == types.IntID {
+		return float64(val.Value.(int64))
+	}
+	return val.Value.(float64)
+}
+
+// tdigestState holds the digest summarizing the values of tdigest and the quantiles estimated
+// from it, in the order they were requested.
+type tdigestState struct {
+	digest    *tdigest
+	quantiles []float64
+}
+
+func (s *tdigestState) parseArgs(args []gql.Arg) error {
+	if len(args) < 2 {
+		return errors.Errorf("tdigest expects the compression and at least one quantile " +
+			"after the predicate")
+	}
+	compression, err := strconv.ParseFloat(args[0].Value, 64)
+	if err != nil || compression < minTdigestCompression ||
+		compression > maxTdigestCompression {
+		return errors.Errorf("The compression of tdigest must be a number between %d and "+
+			"%d. Got: %v", minTdigestCompression, maxTdigestCompression, args[0].Value)
+	}
+	seen := make(map[float64]struct{})
+	for _, arg := range args[1:] {
+		q, err := strconv.ParseFloat(arg.Value, 64)
+		if err != nil || q < 0 || q > 1 {
+			return errors.Errorf("The quantiles of tdigest must be numbers between 0 and 1. "+
+				"Got: %v", arg.Value)
+		}
+		if _, ok := seen[q]; ok {
+			return errors.Errorf("Quantile %v is given more than once to tdigest", arg.Value)
+		}
+		seen[q] = struct{}{}
+		s.quantiles = append(s.quantiles, q)
+	}
+	s.digest = newTdigest(compression)
+	return nil
+}
+
+// apply adds val to the digest. Only int and float values can be added.
+func (s *tdigestState) apply(ag *aggregator, val types.Val) {
+	if v, ok := ag.numeric(val); ok {
+		s.digest.add(v)
+	}
+}
+
+func (s *tdigestState) value(ag *aggregator) (types.Val, error) {
+	// The quantiles are read with tdigestQuantiles, as they can't be held by a single value.
+	return ag.result, errors.Errorf("tdigest is only allowed inside @groupby")
+}
+
+// tdigestQuantiles returns the estimates of the quantiles requested from tdigest, named like
+// p50 for the 0.5 quantile.
+func (ag *aggregator) tdigestQuantiles() ([]GroupQuantile, error) {
+	if ag.err != nil {
+		return nil, ag.err
+	}
+	s := ag.state.(*tdigestState)
+	res := make([]GroupQuantile, 0, len(s.quantiles))
+	for _, q := range s.quantiles {
+		v, ok := s.digest.quantile(q)
+		if !ok {
+			return nil, ErrEmptyVal
+		}
+		// Round the percentile to drop the error of the multiplication, e.g. for 0.999.
+		name := "p" + strconv.FormatFloat(math.Round(q*100*1e9)/1e9, 'f', -1, 64)
+		res = append(res, GroupQuantile{Name: name, Quantile: q,
+			Value: types.Val{Tid: types.FloatID, Value: v}})
+	}
+	return res, nil
+}
+
+// weightedPercentileState buffers the values of wpercentile along with their weights, and
+// holds the percentile it computes, between 0 and 100.
+type weightedPercentileState struct {
+	percentile float64
+	weighted   []weightedValue
+}
+
+func (s *weightedPercentileState) parseArgs(args []gql.Arg) error {
+	if len(args) != 1 {
+		return errors.Errorf("wpercentile expects the percentile after the value and weight " +
+			"variables")
+	}
+	p, err := strconv.ParseFloat(args[0].Value, 64)
+	if err != nil || p < 0 || p > 100 {
+		return errors.Errorf("The percentile of wpercentile must be a number between 0 and "+
+			"100. Got: %v", args[0].Value)
+	}
+	s.percentile = p
+	return nil
+}
+
+// apply records an error, as the values of wpercentile are applied along with their weights
+// by applyWeighted.
+func (s *weightedPercentileState) apply(ag *aggregator, val types.Val) {
+	ag.err = errors.Errorf("%s can only aggregate the values of a variable along with their "+
+		"weights", ag.name)
+}
+
+// applyWeighted buffers val along with its weight for wpercentile. Only int and float values
+// and weights are allowed, and the weights can't be negative. Values with a zero weight don't
+// count towards the percentile, so they aren't buffered.
+func (ag *aggregator) applyWeighted(val, weight types.Val) {
+	if ag.err != nil {
+		return
+	}
+	s := ag.state.(*weightedPercentileState)
+	toFloat := func(v types.Val, what string) (float64, bool) {
+		switch v.Tid {
+		case types.IntID:
+			return float64(v.Value.(int64)), true
+		case types.FloatID:
+			return v.Value.(float64), true
+		}
+		ag.err = errors.Errorf("Wrong type %v encountered for the %s of func %s. "+
+			"Only int and float values are allowed", v.Tid.Name(), what, ag.name)
+		return 0, false
+	}
+	v, ok := toFloat(val, "value")
+	if !ok {
+		return
+	}
+	w, ok := toFloat(weight, "weight")
+	if !ok {
+		return
+	}
+	switch {
+	case w < 0 || math.IsNaN(w):
+		ag.err = errors.Errorf("The weights of %s can't be negative. Got: %v", ag.name, w)
+		return
+	case w == 0:
+		return
+	}
+	if err := ag.budget.take(); err != nil {
+		ag.err = err
+		s.weighted = nil
+		return
+	}
+	s.weighted = append(s.weighted, weightedValue{value: v, weight: w})
+}
+
+// value returns the percentile of the values. The values are sorted and their weights are
+// added up until they reach the percentile of the total weight. The value that reaches it is
+// returned.
+func (s *weightedPercentileState) value(ag *aggregator) (types.Val, error) {
+	res := types.Val{Tid: types.FloatID}
+	var total float64
+	for _, wv := range s.weighted {
+		total += wv.weight
+	}
+	if total == 0 {
+		return res, ErrEmptyVal
+	}
+	sort.Slice(s.weighted, func(i, j int) bool {
+		return s.weighted[i].value < s.weighted[j].value
+	})
+
+	target := total * s.percentile / 100
+	var cumulative float64
+	for _, wv := range s.weighted {
+		cumulative += wv.weight
+		if cumulative >= target {
+			res.Value = wv.value
+			return res, nil
+		}
+	}
+	// The rounding of the sum can leave it just below the target for the 100th percentile.
+	res.Value = s.weighted[len(s.weighted)-1].value
+	return res, nil
+}
+
+// countifState holds the comparison of countif, e.g. >, and the value the values are
+// compared with, converted once to each type it can be compared as. The number of values that
+// pass the comparison is the count of the aggregator.
+type countifState struct {
+	cmp        string
+	threshold  string
+	thresholds map[types.TypeID]types.Val
+}
+
+// countifTypes are the types of the values that countif can compare with its threshold.
+var countifTypes = []types.TypeID{types.IntID, types.FloatID, types.StringID, types.DefaultID,
+	types.DateTimeID, types.BoolID}
+
+// parseArgs parses the comparison and the threshold of countif. The threshold is converted to
+// each type of the values it can be compared with, or to a float for the int values if it's
+// fractional. The values of the types it can't be converted to are errors once they're
+// applied.
+func (s *countifState) parseArgs(args []gql.Arg) error {
+	if len(args) != 2 {
+		return errors.Errorf("countif expects a comparison and a value after the variable")
+	}
+	cmp, ok := comparisonOps[args[0].Value]
+	if !ok {
+		return errors.Errorf("The comparison of countif must be one of eq, ne, lt, le, gt "+
+			"or ge. Got: %v", args[0].Value)
+	}
+	s.cmp = cmp
+	s.threshold = args[1].Value
+	s.thresholds = make(map[types.TypeID]types.Val, len(countifTypes))
+	src := types.Val{Tid: types.StringID, Value: []byte(s.threshold)}
+	for _, tid := range countifTypes {
+		if threshold, err := types.Convert(src, tid); err == nil {
+			s.thresholds[tid] = threshold
+		}
+	}
+	if _, ok := s.thresholds[types.IntID]; !ok {
+		if threshold, ok := s.thresholds[types.FloatID]; ok {
+			s.thresholds[types.IntID] = threshold
+		}
+	}
+	return nil
+}
+
+// apply counts val if it passes the comparison. A value that the threshold can't be compared
+// with is an error.
+func (s *countifState) apply(ag *aggregator, val types.Val) {
+	threshold, ok := s.thresholds[val.Tid]
+	if !ok {
+		ag.err = errors.Errorf("The value %q of countif can't be compared with a value of "+
+			"type %v", s.threshold, val.Tid.Name())
+		return
+	}
+	ok, err := compareValues(s.cmp, val, threshold)
+	if err != nil {
+		ag.err = errors.Wrapf(err, "while comparing the values of countif")
+		return
+	}
+	if ok {
 		ag.count++
+	}
+}
+
+func (s *countifState) value(ag *aggregator) (types.Val, error) {
+	// Unlike most aggregators, there's a result even if no value was applied.
+	return types.Val{Tid: types.IntID, Value: int64(ag.count)}, nil
+}
+
+// medianUidState buffers the values of medianuid along with the uids of their nodes.
+type medianUidState struct {
+	ranked []topkItem
+}
+
+// apply records an error, as the values of medianuid are applied along with the uids of their
+// nodes by applyMedianuid.
+func (s *medianUidState) apply(ag *aggregator, val types.Val) {
+	ag.err = errors.Errorf("%s can only aggregate the values of a variable along with their "+
+		"nodes", ag.name)
+}
+
+// applyMedianuid buffers val along with the uid of its node for medianuid. All the values must
+// be of the same type, so that they can be sorted.
+func (ag *aggregator) applyMedianuid(val types.Val, uid uint64) {
+	if ag.err != nil {
+		return
+	}
+	s := ag.state.(*medianUidState)
+	if len(s.ranked) == 0 {
+		if _, err := types.Less(val, val); err != nil {
+			ag.err = errors.Wrapf(err, "while sorting the values of medianuid")
+			return
+		}
+	} else if typ := s.ranked[0].val.Tid; val.Tid != typ {
+		ag.err = errors.Errorf("medianuid can only sort values of the same type. Got: %v and %v",
+			typ.Name(), val.Tid.Name())
+		return
+	}
+	if err := ag.budget.take(); err != nil {
+		ag.err = err
+		s.ranked = nil
+		return
+	}
+	s.ranked = append(s.ranked, topkItem{uid: uid, val: val})
+}
+
+// value returns the uid of the node with the median of the values. The values are sorted
+// along with their uids, the ties broken by uid, and the uid in the middle is returned. For an
+// even number of values, the uid with the lower median is returned.
+func (s *medianUidState) value(ag *aggregator) (types.Val, error) {
+	res := types.Val{Tid: types.UidID}
+	if len(s.ranked) == 0 {
+		return res, ErrEmptyVal
+	}
+	sort.Slice(s.ranked, func(i, j int) bool {
+		a, b := s.ranked[i], s.ranked[j]
+		if l, _ := types.Less(a.val, b.val); l {
+			return true
+		}
+		if l, _ := types.Less(b.val, a.val); l {
+			return false
+		}
+		return a.uid < b.uid
+	})
+	res.Value = s.ranked[(len(s.ranked)-1)/2].uid
+	return res, nil
+}
+
+// p2PercentileState holds the estimator of the percentile of p2percentile.
+type p2PercentileState struct {
+	p2 *psquare
+}
+
+func (s *p2PercentileState) parseArgs(args []gql.Arg) error {
+	if len(args) != 1 {
+		return errors.Errorf("p2percentile expects the percentile after the variable")
+	}
+	p, err := strconv.ParseFloat(args[0].Value, 64)
+	if err != nil || p < 0 || p > 100 {
+		return errors.Errorf("The percentile of p2percentile must be a number between 0 "+
+			"and 100. Got: %v", args[0].Value)
+	}
+	s.p2 = newPsquare(p / 100)
+	return nil
+}
+
+// apply adds val to the estimator. Only int and float values can be added.
+func (s *p2PercentileState) apply(ag *aggregator, val types.Val) {
+	if v, ok := ag.numeric(val); ok {
+		s.p2.add(v)
+	}
+}
+
+// value returns the estimate of the percentile of the values.
+func (s *p2PercentileState) value(ag *aggregator) (types.Val, error) {
+	res := types.Val{Tid: types.FloatID}
+	v, ok := s.p2.quantile()
+	if !ok {
+		return res, ErrEmptyVal
+	}
+	res.Value = v
+	return res, nil
+}
+
+// rangeState holds the smallest and the largest of the values applied to range.
+type rangeState struct {
+	lo types.Val
+	hi types.Val
+}
+
+// apply keeps val if it's the smallest or the largest value. Only int and float values can be
+// applied.
+func (s *rangeState) apply(ag *aggregator, val types.Val) {
+	if val.Tid != types.IntID && val.Tid != types.FloatID {
+		ag.err = errors.Errorf("Wrong type %v encountered for func %s. "+
+			"Only int and float values are allowed", val.Tid.Name(), ag.name)
 		return
 	}
+	if ag.count == 0 || lessNumber(val, s.lo) {
+		s.lo = val
+	}
+	if ag.count == 0 || lessNumber(s.hi, val) {
+		s.hi = val
+	}
+	ag.count++
+}
+
+// lessNumber returns true if the int or float value a is smaller than b. Two ints are compared
+// exactly, an int and a float are compared as floats.
+func lessNumber(a, b types.Val) bool {
+	if a.Tid == types.IntID && b.Tid == types.IntID {
+		return a.Value.(int64) < b.Value.(int64)
+	}
+	return asFloat(a) < asFloat(b)
+}
+
+// value returns the difference between the largest and the smallest values. It's an int if
+// both of them are ints, and a float otherwise.
+func (s *rangeState) value(ag *aggregator) (types.Val, error) {
+	if ag.count == 0 {
+		return ag.result, ErrEmptyVal
+	}
+	if s.lo.Tid == types.IntID && s.hi.Tid == types.IntID {
+		// The difference of two ints may not fit in an int, in which case it's returned as
+		// a float.
+		if diff := s.hi.Value.(int64) - s.lo.Value.(int64); diff >= 0 {
+			return types.Val{Tid: types.IntID, Value: diff}, nil
+		}
+	}
+	return types.Val{Tid: types.FloatID, Value: asFloat(s.hi) - asFloat(s.lo)}, nil
+}
+
+// harmonicMeanState holds the sum of the reciprocals of the values of hmean, which along with
+// their count is all that's needed to compute their mean, so they aren't buffered.
+type harmonicMeanState struct {
+	sum float64
+}
+
+func (s *harmonicMeanState) apply(ag *aggregator, val types.Val) {
+	v, ok := ag.numeric(val)
+	if !ok {
+		return
+	}
+	if v == 0 {
+		ag.err = errors.Errorf("hmean is not defined for values equal to zero")
+		return
+	}
+	s.sum += 1 / v
+	ag.count++
+}
+
+func (s *harmonicMeanState) value(ag *aggregator) (types.Val, error) {
+	res := types.Val{Tid: types.FloatID}
+	if ag.count == 0 {
+		return res, ErrEmptyVal
+	}
+	if s.sum == 0 {
+		return res, errors.Errorf("hmean is not defined for values whose reciprocals " +
+			"add up to zero")
+	}
+	res.Value = float64(ag.count) / s.sum
+	return res, nil
+}
+
+// geometricMeanState holds the sum of the logarithms of the values of gmean.
+type geometricMeanState struct {
+	sum float64
+}
+
+func (s *geometricMeanState) apply(ag *aggregator, val types.Val) {
+	v, ok := ag.numeric(val)
+	if !ok {
+		return
+	}
+	if v <= 0 {
+		ag.err = errors.Errorf("gmean is only defined for positive values. Got: %v", v)
+		return
+	}
+	s.sum += math.Log(v)
+	ag.count++
+}
+
+func (s *geometricMeanState) value(ag *aggregator) (types.Val, error) {
+	res := types.Val{Tid: types.FloatID}
+	if ag.count == 0 {
+		return res, ErrEmptyVal
+	}
+	res.Value = math.Exp(s.sum / float64(ag.count))
+	return res, nil
+}
+
+// varianceState holds the running mean of the values of cv and sem and the sum of the squared
+// differences from it, updated as in Welford's algorithm.
+type varianceState struct {
+	runMean float64
+	m2      float64
+}
+
+func (s *varianceState) apply(ag *aggregator, val types.Val) {
+	v, ok := ag.numeric(val)
+	if !ok {
+		return
+	}
+	delta := v - s.runMean
+	s.runMean += delta / float64(ag.count+1)
+	s.m2 += delta * (v - s.runMean)
+	ag.count++
+}
+
+// value returns the coefficient of variation of the values of cv, i.e. their population
+// standard deviation divided by their mean, or the standard error of the mean of the values
+// of sem, i.e. their sample standard deviation divided by the square root of their count.
+func (s *varianceState) value(ag *aggregator) (types.Val, error) {
+	res := types.Val{Tid: types.FloatID}
+	if ag.count == 0 {
+		return res, ErrEmptyVal
+	}
+	if ag.name == "cv" {
+		if s.runMean == 0 {
+			return res, errors.Errorf("cv is not defined for values whose mean is zero")
+		}
+		res.Value = math.Sqrt(s.m2/float64(ag.count)) / s.runMean
+		return res, nil
+	}
+	// The sample standard deviation of a single value isn't defined, but it's known exactly,
+	// so its error is zero.
+	if ag.count < 2 {
+		res.Value = 0.0
+		return res, nil
+	}
+	stddev := math.Sqrt(s.m2 / float64(ag.count-1))
+	res.Value = stddev / math.Sqrt(float64(ag.count))
+	return res, nil
+}
+
+// applyBitwise combines val into the result of the bitor and bitand aggregators. These
+// aggregators only accept int values. Any other value is recorded as an error.
+func (ag *aggregator) applyBitwise(val types.Val) {
+	if ag.err != nil {
+		return
+	}
+	if val.Tid != types.IntID {
+		ag.err = errors.Errorf("Wrong type %v encountered for func %s. Only int values are allowed",
+			val.Tid.Name(), ag.name)
+		return
+	}
+	ag.count++
+	if ag.result.Value == nil {
+		ag.result = val
+		return
+	}
+	switch ag.name {
+	case "bitor":
+		ag.result.Value = ag.result.Value.(int64) | val.Value.(int64)
+	case "bitand":
+		ag.result.Value = ag.result.Value.(int64) & val.Value.(int64)
+	}
+}
+
+// Apply applies the given value to the aggregator. It returns an error if the aggregator
+// function isn't known.
+func (ag *aggregator) Apply(val types.Val) error {
+	if ag.custom != nil {
+		ag.custom.Apply(val)
+		return nil
+	}
+	if ag.state != nil {
+		if ag.err == nil {
+			ag.state.apply(ag, val)
+		}
+		return nil
+	}
+	if _, ok := aggregatorStates[ag.name]; ok {
+		return errors.Errorf("Aggregator %s is applied before its arguments are set", ag.name)
+	}
+	if ag.name == "countnonnull" {
+		// Only the nodes that have a value are applied, so counting them is enough.
+		ag.count++
+		return nil
+	}
+	if ag.name == "bitor" || ag.name == "bitand" {
+		ag.applyBitwise(val)
+		return nil
+	}
+
+	if ag.result.Value == nil {
+		ag.result = val
+		ag.count++
+		return nil
+	}
 
 	va := ag.result
 	vb := val
@@ -504,19 +1596,57 @@ func (ag *aggregator) Apply(val types.Val) {
 		case va.Tid == types.IntID && vb.Tid == types.IntID:
 			va.Value = va.Value.(int64) + vb.Value.(int64)
 		case va.Tid == types.FloatID && vb.Tid == types.FloatID:
-			va.Value = va.Value.(float64) + vb.Value.(float64)
+			va.Value = ag.compensatedAdd(va.Value.(float64), vb.Value.(float64))
 		}
 		// Skipping the else case since that means the pair cannot be summed.
 		res = va
+	case "any", "first":
+		// The first value applied is kept.
+		res = va
+	case "last":
+		res = vb
 	default:
-		x.Fatalf("Unhandled aggregator function %v", ag.name)
+		return errors.Errorf("Unhandled aggregator function %q", ag.name)
 	}
 	ag.count++
 	ag.result = res
+	return nil
+}
+
+// compensatedAdd returns sum + v and accumulates the rounding error of the addition in comp.
+// Unlike in the Kahan summation, the error is kept apart from the sum, which is the same as
+// the naive one, and the larger of the two operands is used to find it.
+func (ag *aggregator) compensatedAdd(sum, v float64) float64 {
+	t := sum + v
+	if math.Abs(sum) >= math.Abs(v) {
+		ag.comp += (sum - t) + v
+	} else {
+		ag.comp += (v - t) + sum
+	}
+	return t
+}
+
+// compensate adds the rounding errors accumulated by compensatedAdd back to the result of sum,
+// avg and sumdistinct, once enough values were applied for them to matter. The errors are
+// meaningless if the sum overflowed, in which case the result is left as is.
+func (ag *aggregator) compensate() {
+	if (ag.name != "sum" && ag.name != "avg" && ag.name != "sumdistinct") ||
+		ag.result.Tid != types.FloatID || ag.result.Value == nil ||
+		ag.count <= compensatedSumThreshold {
+		return
+	}
+	sum := ag.result.Value.(float64)
+	if math.IsInf(sum, 0) || math.IsNaN(sum) || math.IsInf(ag.comp, 0) ||
+		math.IsNaN(ag.comp) {
+		return
+	}
+	ag.result.Value = sum + ag.comp
+	ag.comp = 0
 }
 
 func (ag *aggregator) ValueMarshalled() (*pb.TaskValue, error) {
 	data := types.ValueForType(types.BinaryID)
+	ag.compensate()
 	ag.divideByCount()
 	res := &pb.TaskValue{ValType: ag.result.Tid.Enum(), Val: x.Nilbyte}
 	if ag.result.Value == nil {
@@ -547,10 +1677,48 @@ func (ag *aggregator) divideByCount() {
 	ag.result.Value = v / float64(ag.count)
 }
 
+// dedupSortedStrings removes the duplicates from the sorted strs in place.
+func dedupSortedStrings(strs []string) []string {
+	if len(strs) == 0 {
+		return strs
+	}
+	out := strs[:1]
+	for _, str := range strs[1:] {
+		if str != out[len(out)-1] {
+			out = append(out, str)
+		}
+	}
+	return out
+}
+
 func (ag *aggregator) Value() (types.Val, error) {
+	if ag.err != nil {
+		return ag.result, ag.err
+	}
+	if ag.custom != nil {
+		res := ag.custom.Result()
+		if res.Value == nil {
+			return res, ErrEmptyVal
+		}
+		return res, nil
+	}
+	if ag.state != nil {
+		return ag.state.value(ag)
+	}
+	if ag.name == "countnonnull" {
+		// Unlike the other aggregators, there's a result even if no value was applied.
+		return types.Val{Tid: types.IntID, Value: int64(ag.count)}, nil
+	}
+	return ag.resultValue()
+}
+
+// resultValue returns the running result of the aggregator, once the rounding errors of sum and
+// avg are added back to it and the sum of avg is divided by the count.
+func (ag *aggregator) resultValue() (types.Val, error) {
 	if ag.result.Value == nil {
 		return ag.result, ErrEmptyVal
 	}
+	ag.compensate()
 	ag.divideByCount()
 	if ag.result.Tid == types.FloatID {
 		switch {
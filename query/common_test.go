@@ -294,6 +294,10 @@ noindex_age                    : int .
 noindex_dob                    : datetime .
 noindex_alive                  : bool .
 noindex_salary                 : float .
+reading                        : float .
+event                          : [uid] .
+visited_at                     : datetime .
+visitor                        : uid .
 language                       : [string] .
 `
 
@@ -635,6 +639,37 @@ func populateCluster() {
 		<203> <owner_name> "Owner of Prius" .
 		<203> <dgraph.type> "Person" .
 
+		<210> <reading> "20.0000001" .
+		<211> <reading> "20.0000002" .
+		<212> <reading> "19.996" .
+		<213> <reading> "21.4" .
+		<214> <reading> "21.449" .
+
+		<220> <event> <230> (timestamp=2020-06-01T10:05:00Z) .
+		<220> <event> <231> (timestamp=2020-06-01T10:55:00Z) .
+		<220> <event> <232> (timestamp=2020-06-01T11:30:00Z) .
+		<221> <event> <231> (timestamp=2020-06-01T10:20:00Z) .
+		<221> <event> <232> (timestamp=2020-06-01T12:00:00Z, weight=3) .
+		<221> <event> <233> .
+		<222> <event> <233> .
+
+		<260> <visited_at> "2020-06-01T08:00:00Z" .
+		<261> <visited_at> "2020-06-01T09:30:00Z" .
+		<262> <visited_at> "2020-06-01T20:00:00Z" .
+		<263> <visited_at> "2020-06-02T07:00:00Z" .
+		<264> <visited_at> "2020-06-02T10:00:00Z" .
+		<265> <visited_at> "2020-06-02T11:00:00Z" .
+		<266> <visited_at> "2020-06-02T12:00:00Z" .
+		<267> <visited_at> "2020-06-03T01:00:00Z" .
+		<260> <visitor> <270> .
+		<261> <visitor> <270> .
+		<262> <visitor> <271> .
+		<263> <visitor> <270> .
+		<264> <visitor> <272> .
+		<265> <visitor> <273> .
+		<266> <visitor> <273> .
+		<267> <visitor> <271> .
+
 		# data for regexp testing
 		_:luke <firstName> "Luke" .
 		_:luke <lastName> "Skywalker" .
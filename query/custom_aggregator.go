@@ -0,0 +1,162 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package query
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/dgraph-io/dgraph/types"
+)
+
+// CustomAggregator is an aggregator that can be used like the built-in ones, e.g. in a
+// groupby or on a value variable, once it's registered with RegisterAggregator.
+//
+// A new aggregator is created for every group or node that the values are aggregated for, and
+// Init is called before its first value is applied.
+type CustomAggregator interface {
+	// Init resets the state of the aggregator.
+	Init()
+	// Apply adds a value to the aggregate. The value has the type of the predicate or of the
+	// value variable that's aggregated.
+	Apply(val types.Val)
+	// Result returns the aggregate of the values applied so far. A result with a nil value
+	// means that there's no aggregate, e.g. because no value was applied.
+	Result() types.Val
+}
+
+// customAggregators maps the lowercase names of the custom aggregators to the functions
+// creating them.
+var customAggregators = struct {
+	sync.RWMutex
+	m map[string]func() CustomAggregator
+}{m: make(map[string]func() CustomAggregator)}
+
+// reservedAggregatorNames holds the names of the functions other than the aggregators of
+// groupby that can be used where aggregators are, and so can't be used by the custom
+// aggregators.
+var reservedAggregatorNames = map[string]bool{
+	"count": true, "val": true, "uid": true, "math": true, "expand": true, "checkpwd": true,
+}
+
+func init() {
+	types.SetCustomAggregators(isCustomAggregator)
+}
+
+// RegisterAggregator registers a custom aggregator under the given name, which is then
+// accepted by queries like the names of the built-in aggregators, e.g. spread(val(x)). The
+// name is case-insensitive. It returns an error if the name is taken by a built-in aggregator,
+// another function or another custom aggregator.
+func RegisterAggregator(name string, newAggregator func() CustomAggregator) error {
+	name = strings.ToLower(name)
+	_, builtin := types.Aggregators[name]
+	builtin = builtin || isTopkFn(name) || varAggregators[name] != nil
+	switch {
+	case name == "":
+		return errors.Errorf("The name of a custom aggregator can't be empty")
+	case newAggregator == nil:
+		return errors.Errorf("Nil function for custom aggregator %s", name)
+	case builtin || reservedAggregatorNames[name]:
+		return errors.Errorf("The name %s is taken by a built-in function", name)
+	}
+
+	customAggregators.Lock()
+	defer customAggregators.Unlock()
+	if _, ok := customAggregators.m[name]; ok {
+		return errors.Errorf("Duplicate custom aggregator: %s", name)
+	}
+	customAggregators.m[name] = newAggregator
+	return nil
+}
+
+// UnregisterAggregator removes the custom aggregator registered under the given name, if any.
+// The queries run afterwards don't accept the name anymore.
+func UnregisterAggregator(name string) {
+	customAggregators.Lock()
+	defer customAggregators.Unlock()
+	delete(customAggregators.m, strings.ToLower(name))
+}
+
+// isCustomAggregator returns true if a custom aggregator is registered under the given name.
+func isCustomAggregator(name string) bool {
+	customAggregators.RLock()
+	defer customAggregators.RUnlock()
+	_, ok := customAggregators.m[strings.ToLower(name)]
+	return ok
+}
+
+// newCustomAggregator returns a new initialized instance of the custom aggregator registered
+// under the given name, and false if there's none.
+func newCustomAggregator(name string) (CustomAggregator, bool) {
+	customAggregators.RLock()
+	newAggregator, ok := customAggregators.m[strings.ToLower(name)]
+	customAggregators.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	ag := newAggregator()
+	ag.Init()
+	return ag, true
+}
+
+// SpreadAggregator is an example of custom aggregator that computes the difference between the
+// largest and the smallest of the int and float values applied to it, as a float. The values
+// of other types are ignored. It isn't registered by default, it can be with
+//
+//	query.RegisterAggregator("spread", func() query.CustomAggregator {
+//		return &query.SpreadAggregator{}
+//	})
+type SpreadAggregator struct {
+	min   float64
+	max   float64
+	count int
+}
+
+// Init resets the aggregator.
+func (s *SpreadAggregator) Init() {
+	*s = SpreadAggregator{}
+}
+
+// Apply adds a value to the spread.
+func (s *SpreadAggregator) Apply(val types.Val) {
+	var v float64
+	switch val.Tid {
+	case types.IntID:
+		v = float64(val.Value.(int64))
+	case types.FloatID:
+		v = val.Value.(float64)
+	default:
+		return
+	}
+	if s.count == 0 || v < s.min {
+		s.min = v
+	}
+	if s.count == 0 || v > s.max {
+		s.max = v
+	}
+	s.count++
+}
+
+// Result returns the spread of the values applied so far, or a nil value if there's none.
+func (s *SpreadAggregator) Result() types.Val {
+	if s.count == 0 {
+		return types.Val{Tid: types.FloatID}
+	}
+	return types.Val{Tid: types.FloatID, Value: s.max - s.min}
+}
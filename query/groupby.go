@@ -17,68 +17,416 @@
 package query
 
 import (
+	"container/heap"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"math"
+	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
 
 	"github.com/dgraph-io/dgraph/algo"
+	"github.com/dgraph-io/dgraph/codec"
+	"github.com/dgraph-io/dgraph/gql"
 	"github.com/dgraph-io/dgraph/protos/pb"
+	"github.com/dgraph-io/dgraph/schema"
 	"github.com/dgraph-io/dgraph/types"
+	"github.com/dgraph-io/dgraph/types/facets"
+	"github.com/dgraph-io/dgraph/x"
+	"github.com/golang/geo/s2"
+	cregexp "github.com/google/codesearch/regexp"
 	"github.com/pkg/errors"
+	"github.com/twpayne/go-geom"
+	otrace "go.opencensus.io/trace"
 )
 
+// groupKeyFilter is a regexp that the keys of a groupby attribute must match.
+type groupKeyFilter struct {
+	// attr is the name of the groupby attribute in the results, i.e. its alias if it has one.
+	attr  string
+	regex *cregexp.Regexp
+}
+
+// extractGroupKeyFilters removes from the filter of a groupby node the regexp functions on the
+// attributes it groups by. They are applied to the group keys after grouping instead of to the
+// nodes, so no index is needed. Only the functions that the rest of the filter is combined
+// with using and are removed.
+func extractGroupKeyFilters(gq *gql.GraphQuery) ([]*groupKeyFilter, error) {
+	if !gq.IsGroupby || gq.Filter == nil {
+		return nil, nil
+	}
+
+	keyAttr := func(ft *gql.FilterTree) (string, bool) {
+		if ft.Func == nil || ft.Func.Name != "regexp" {
+			return "", false
+		}
+		for _, attr := range gq.GroupbyAttrs {
+			if attr.Has || attr.Lang || attr.LangCount || attr.Count || attr.JSONPath != "" ||
+				attr.Regex != "" || attr.MathExp != nil || attr.ValueVar != "" ||
+				attr.Distance != nil || attr.Attr != ft.Func.Attr {
+				continue
+			}
+			if attr.Alias != "" {
+				return attr.Alias, true
+			}
+			return attr.Attr, true
+		}
+		return "", false
+	}
+
+	var filters []*groupKeyFilter
+	extract := func(ft *gql.FilterTree) (bool, error) {
+		attr, ok := keyAttr(ft)
+		if !ok {
+			return false, nil
+		}
+		regex, err := compileGroupKeyRegex(ft.Func)
+		if err != nil {
+			return false, err
+		}
+		filters = append(filters, &groupKeyFilter{attr: attr, regex: regex})
+		return true, nil
+	}
+
+	// remove returns the filter tree without the extracted functions, or nil if none is left.
+	var remove func(ft *gql.FilterTree) (*gql.FilterTree, error)
+	remove = func(ft *gql.FilterTree) (*gql.FilterTree, error) {
+		if ft.Op != "and" {
+			extracted, err := extract(ft)
+			if err != nil || extracted {
+				return nil, err
+			}
+			return ft, nil
+		}
+		children := ft.Child[:0]
+		for _, child := range ft.Child {
+			child, err := remove(child)
+			if err != nil {
+				return nil, err
+			}
+			if child != nil {
+				children = append(children, child)
+			}
+		}
+		switch len(children) {
+		case 0:
+			return nil, nil
+		case 1:
+			return children[0], nil
+		}
+		ft.Child = children
+		return ft, nil
+	}
+
+	filter, err := remove(gq.Filter)
+	if err != nil {
+		return nil, err
+	}
+	gq.Filter = filter
+	return filters, nil
+}
+
+// compileGroupKeyRegex compiles the pattern of a regexp function the same way the worker does
+// when the function is used to filter nodes.
+func compileGroupKeyRegex(fn *gql.Function) (*cregexp.Regexp, error) {
+	if len(fn.Args) != 2 {
+		return nil, errors.Errorf("Function '%s' requires 2 arguments, but got %d",
+			fn.Name, len(fn.Args))
+	}
+	matchType := "(?m)" // this is cregexp library specific
+	switch modifiers := fn.Args[1].Value; modifiers {
+	case "":
+	case "i":
+		matchType = "(?i)" + matchType
+	default:
+		return nil, errors.Errorf("Invalid regexp modifier: %s", modifiers)
+	}
+	return cregexp.Compile(matchType + fn.Args[0].Value)
+}
+
+// applyGroupKeyFilters removes the keys that don't match the regexp filters on their groupby
+// attribute. Only string keys can be filtered.
+func (sg *SubGraph) applyGroupKeyFilters(d *dedup) error {
+	for _, filter := range sg.Params.GroupKeyFilters {
+		for _, group := range d.groups {
+			if group.attr != filter.attr {
+				continue
+			}
+			for strKey, elem := range group.elements {
+				if elem.key.Tid != types.StringID {
+					return errors.Errorf("regexp can only be applied to string keys in groupby, "+
+						"but %s has type %s", filter.attr, elem.key.Tid.Name())
+				}
+				if filter.regex.MatchString(elem.key.Value.(string), true, true) <= 0 {
+					delete(group.elements, strKey)
+				}
+			}
+		}
+	}
+	return nil
+}
+
 type groupPair struct {
 	key  types.Val
 	attr string
+	// lang is the language of the key when grouping by all the languages of a predicate.
+	lang string
+	// child is the node that computed the aggregate. It's nil for the keys.
+	child *SubGraph
+	// uids holds the uids returned by topk for the group, best first.
+	uids []uint64
+	// vals holds the values returned by distinctvalues for the group.
+	vals []types.Val
+	// truncated is true if distinctvalues found more distinct values than it returns.
+	truncated bool
+	// quantiles holds the quantiles estimated by tdigest for the group.
+	quantiles []GroupQuantile
 }
 
 type groupResult struct {
 	keys       []groupPair
 	aggregates []groupPair
 	uids       []uint64
+	// id is the deterministic id of the group, if the groupby asked for it.
+	id string
+	// rank is the position of each of the uids in the order of the edges they were grouped
+	// from, if the edges are ordered by a facet.
+	rank map[uint64]int
+}
+
+// members returns the uids of the group in the order their values are applied to the
+// aggregator with the given name. The values of first and last are applied in the order of
+// the edges if they're ordered by a facet, e.g. with @facets(orderasc: since), and in the
+// order of the uids otherwise, like those of the other aggregators.
+func (grp *groupResult) members(name string) []uint64 {
+	if grp.rank == nil || !isOrderedAggregator(name) {
+		return grp.uids
+	}
+	uids := append([]uint64(nil), grp.uids...)
+	sort.SliceStable(uids, func(i, j int) bool {
+		return grp.rank[uids[i]] < grp.rank[uids[j]]
+	})
+	return uids
+}
+
+// facetRanks returns the position of each of the uids of lists in the order of the edges of
+// sg, if they're ordered by a facet, or else nil. The lists follow each other, and a uid in
+// several lists keeps its first position.
+func (sg *SubGraph) facetRanks(lists []*pb.List) map[uint64]int {
+	if len(sg.Params.FacetsOrder) == 0 {
+		return nil
+	}
+	rank := make(map[uint64]int)
+	for _, ul := range lists {
+		for _, uid := range ul.GetUids() {
+			if _, ok := rank[uid]; !ok {
+				rank[uid] = len(rank)
+			}
+		}
+	}
+	return rank
+}
+
+// aggregateName returns the name of the aggregate computed by a child of a groupby node in the
+// results, i.e. its alias if it has one or else its name in the query, e.g. max(age).
+func aggregateName(child *SubGraph) string {
+	switch {
+	case child.Params.Alias != "":
+		return child.Params.Alias
+	case child.Params.DoCount:
+		return "count"
+	case child.SrcFunc != nil:
+		return aggregateFunc(child)
+	}
+	return ""
 }
 
-func (grp *groupResult) aggregateChild(child *SubGraph) error {
-	fieldName := child.Params.Alias
+// aggregateFunc returns the function of the aggregate computed by a child of a groupby node as
+// written in the query, e.g. max(age) or countif(val(x)).
+func aggregateFunc(child *SubGraph) string {
+	name := child.SrcFunc.Name
+	switch {
+	case isTopkFn(name):
+		return "topk(uid)"
+	case varAggregators[name] != nil:
+		return fmt.Sprintf("%s(val(%s))", name, child.Params.NeedsVar[0].Name)
+	}
+	return fmt.Sprintf("%s(%s)", name, child.Attr)
+}
+
+// aggregateChild returns the aggregate computed by child for the group, or nil if child
+// isn't an aggregate.
+func (grp *groupResult) aggregateChild(child *SubGraph, budget *bufferBudget) (
+	*groupPair, error) {
+	fieldName := aggregateName(child)
 	if child.Params.DoCount {
 		if child.Attr != "uid" {
-			return errors.Errorf("Only uid predicate is allowed in count within groupby")
+			return nil, errors.Errorf("Only uid predicate is allowed in count within groupby")
 		}
-		if fieldName == "" {
-			fieldName = "count"
-		}
-		grp.aggregates = append(grp.aggregates, groupPair{
+		return &groupPair{
 			attr: fieldName,
 			key: types.Val{
 				Tid:   types.IntID,
 				Value: int64(len(grp.uids)),
 			},
-		})
-		return nil
+			child: child,
+		}, nil
 	}
-	if child.SrcFunc != nil && isAggregatorFn(child.SrcFunc.Name) {
-		if fieldName == "" {
-			fieldName = fmt.Sprintf("%s(%s)", child.SrcFunc.Name, child.Attr)
+	if child.SrcFunc != nil && isTopkFn(child.SrcFunc.Name) {
+		uids, err := topkGroup(grp, child)
+		if err != nil {
+			return nil, err
 		}
-		finalVal, err := aggregateGroup(grp, child)
+		return &groupPair{
+			attr:  fieldName,
+			uids:  uids,
+			child: child,
+		}, nil
+	}
+	if child.SrcFunc != nil &&
+		(isAggregatorFn(child.SrcFunc.Name) || varAggregators[child.SrcFunc.Name] != nil) {
+		ag, err := aggregateGroup(grp, child, budget)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		pair := &groupPair{
+			attr:  fieldName,
+			child: child,
+		}
+		switch ag.name {
+		case "distinctvalues":
+			pair.vals, pair.truncated, err = ag.distinctValues()
+		case "tdigest":
+			pair.quantiles, err = ag.tdigestQuantiles()
+		default:
+			pair.key, err = ag.Value()
+		}
+		if err != nil {
+			return nil, err
+		}
+		return pair, nil
+	}
+	return nil, nil
+}
+
+// parallelAggregateMinUids is the number of uids in all the groups from which the children of
+// a groupby are aggregated in parallel. Smaller groupbys aggregate faster than they would
+// start the goroutines.
+const parallelAggregateMinUids = 1000
+
+// aggregateChildren adds the aggregates computed by the children of sg to each of the groups.
+// The children read disjoint values, so for large groups they're aggregated in parallel by a
+// bounded number of goroutines. The aggregates of each group are added in the order of the
+// children, as if they were aggregated one after the other, and the error of the first child
+// that fails is returned.
+func (sg *SubGraph) aggregateChildren(res *groupResults, budget *bufferBudget) error {
+	var children []*SubGraph
+	for _, child := range sg.Children {
+		if !child.Params.IgnoreResult {
+			children = append(children, child)
+		}
+	}
+	// pairs[i][j] is the aggregate of the ith child for the jth group, if it has one.
+	pairs := make([][]*groupPair, len(children))
+	errs := make([]error, len(children))
+	aggregate := func(i int) {
+		pairs[i] = make([]*groupPair, len(res.group))
+		for j, grp := range res.group {
+			pair, err := grp.aggregateChild(children[i], budget)
+			switch {
+			case err == ErrEmptyVal:
+			case err != nil:
+				errs[i] = err
+				return
+			default:
+				pairs[i][j] = pair
+			}
+		}
+	}
+
+	var numUids int
+	for _, grp := range res.group {
+		numUids += len(grp.uids)
+	}
+	workers := runtime.NumCPU()
+	if workers > len(children) {
+		workers = len(children)
+	}
+	if workers < 2 || numUids < parallelAggregateMinUids {
+		for i := range children {
+			aggregate(i)
+			if errs[i] != nil {
+				return errs[i]
+			}
+		}
+	} else {
+		next := make(chan int, len(children))
+		for i := range children {
+			next <- i
+		}
+		close(next)
+		var wg sync.WaitGroup
+		wg.Add(workers)
+		for w := 0; w < workers; w++ {
+			go func() {
+				defer wg.Done()
+				for i := range next {
+					aggregate(i)
+				}
+			}()
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for j, grp := range res.group {
+		for i := range children {
+			if pair := pairs[i][j]; pair != nil {
+				grp.aggregates = append(grp.aggregates, *pair)
+			}
 		}
-		grp.aggregates = append(grp.aggregates, groupPair{
-			attr: fieldName,
-			key:  finalVal,
-		})
 	}
 	return nil
 }
 
+// aggregateOf returns the aggregate computed for the group by the given child.
+func (grp *groupResult) aggregateOf(child *SubGraph) (groupPair, bool) {
+	for _, agg := range grp.aggregates {
+		if agg.child == child {
+			return agg, true
+		}
+	}
+	return groupPair{}, false
+}
+
 type groupResults struct {
 	group []*groupResult
+	// next is the token to pass as the after option of the groupby to get the next page of
+	// the results, if there are more groups after those of this page.
+	next string
+	// summary holds the metrics computed across the groups, if the summary option is set.
+	summary []groupPair
+	// plan describes how the groups were formed, if the explain option is set.
+	plan []groupPair
 }
 
 type groupElements struct {
 	entities *pb.List
 	key      types.Val
+	lang     string
 }
 
 type uniq struct {
@@ -88,6 +436,28 @@ type uniq struct {
 
 type dedup struct {
 	groups []*uniq
+	// round is the number of decimals that float keys are rounded to, if set.
+	round *int
+	// tiers holds the tiers that numeric keys are bucketed into, if set.
+	tiers *gql.GroupbyTiers
+	// bucket is the width of the buckets that count keys are put in, if set.
+	bucket int
+	// relative holds the buckets that datetime keys are put in by their age, if set.
+	relative *gql.GroupbyRelative
+	// by is the unit of time that the datetime values of the predicates are truncated to, if
+	// set.
+	by string
+	// geohash is the precision of the geohashes of the cells that geo keys are grouped by, if
+	// set.
+	geohash int
+	// valueMap holds the labels that the values are mapped to before they're grouped, if set.
+	valueMap *gql.GroupbyValueMap
+	// minSize is the number of uids a group must have to be formed, if set.
+	minSize int
+	// trim and collapse are true if the leading and trailing whitespace of string keys is
+	// trimmed and if their runs of whitespace are collapsed into a single space.
+	trim     bool
+	collapse bool
 }
 
 func (d *dedup) getGroup(attr string) *uniq {
@@ -111,13 +481,40 @@ func (d *dedup) getGroup(attr string) *uniq {
 	return res
 }
 
-func (d *dedup) addValue(attr string, value types.Val, uid uint64) {
+func (d *dedup) addValue(attr, lang string, value types.Val, uid uint64) {
 	cur := d.getGroup(attr)
+	value = d.normalizeString(value)
+	if d.round != nil && value.Tid == types.FloatID {
+		// Values that only differ after the rounded decimals get the same key.
+		value.Value = roundFloat(value.Value.(float64), *d.round)
+	}
+	if d.tiers != nil && (value.Tid == types.IntID || value.Tid == types.FloatID) {
+		f, ok := value.Value.(float64)
+		if !ok {
+			f = float64(value.Value.(int64))
+		}
+		key, ok := tierKey(d.tiers, f)
+		if !ok {
+			// The value is outside all the tiers and outliers are skipped.
+			return
+		}
+		value = types.Val{Tid: types.StringID, Value: key}
+	}
+	if d.relative != nil && value.Tid == types.DateTimeID {
+		value = types.Val{Tid: types.StringID,
+			Value: relativeKey(d.relative, value.Value.(time.Time))}
+	}
 	// Create the string key.
 	var strKey string
-	if value.Tid == types.UidID {
+	switch value.Tid {
+	case types.UidID:
 		strKey = strconv.FormatUint(value.Value.(uint64), 10)
-	} else {
+	case types.DateTimeID:
+		// The key holds the offset of the time along with the instant, so the same instant
+		// in different time zones gets different keys and each group keeps the offset its
+		// values were written with. Unlike MarshalText, Format works for any year.
+		strKey = value.Value.(time.Time).Format(time.RFC3339Nano)
+	default:
 		valC := types.Val{Tid: types.StringID, Value: ""}
 		err := types.Marshal(value, &valC)
 		if err != nil {
@@ -125,259 +522,2030 @@ func (d *dedup) addValue(attr string, value types.Val, uid uint64) {
 		}
 		strKey = valC.Value.(string)
 	}
+	if lang != "" {
+		// Language tags can't contain '@' so the same value in different languages
+		// gets different keys.
+		strKey = lang + "@" + strKey
+	}
 
 	if _, ok := cur.elements[strKey]; !ok {
 		// If this is the first element of the group.
 		cur.elements[strKey] = groupElements{
 			key:      value,
+			lang:     lang,
 			entities: &pb.List{Uids: []uint64{}},
 		}
 	}
 	curEntity := cur.elements[strKey].entities
+	// A node with several edges that get the same key, like the edges whose facets are
+	// truncated to the same hour, is only added once to the group.
+	if n := len(curEntity.Uids); n > 0 && curEntity.Uids[n-1] == uid {
+		return
+	}
 	curEntity.Uids = append(curEntity.Uids, uid)
 }
 
-func aggregateGroup(grp *groupResult, child *SubGraph) (types.Val, error) {
-	ag := aggregator{
-		name: child.SrcFunc.Name,
+// normalizeString returns the canonical form of a string or default value that's grouped with
+// the trim and collapseSpaces options, so that values only differing by their whitespace,
+// e.g. "New  York " and "New York", get the same key. The values of the other types are
+// returned as they are.
+func (d *dedup) normalizeString(val types.Val) types.Val {
+	if (!d.trim && !d.collapse) || (val.Tid != types.StringID && val.Tid != types.DefaultID) {
+		return val
 	}
-	for _, uid := range grp.uids {
-		idx := sort.Search(len(child.SrcUIDs.Uids), func(i int) bool {
-			return child.SrcUIDs.Uids[i] >= uid
-		})
-		if idx == len(child.SrcUIDs.Uids) || child.SrcUIDs.Uids[idx] != uid {
-			continue
-		}
+	s, ok := val.Value.(string)
+	if !ok {
+		return val
+	}
+	if d.trim {
+		s = strings.TrimSpace(s)
+	}
+	if d.collapse {
+		s = collapseSpaces(s)
+	}
+	val.Value = s
+	return val
+}
 
-		if len(child.valueMatrix[idx].Values) == 0 {
+// collapseSpaces replaces each run of whitespace in s with a single space.
+func collapseSpaces(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	space := false
+	for _, r := range s {
+		if unicode.IsSpace(r) {
+			space = true
 			continue
 		}
-		v := child.valueMatrix[idx].Values[0]
-		val, err := convertWithBestEffort(v, child.Attr)
-		if err != nil {
-			continue
+		if space {
+			b.WriteByte(' ')
+			space = false
 		}
-		ag.Apply(val)
+		b.WriteRune(r)
+	}
+	if space {
+		b.WriteByte(' ')
 	}
-	return ag.Value()
+	return b.String()
 }
 
-// formGroup creates all possible groups with the list of uids that belong to that
-// group.
-func (res *groupResults) formGroups(dedupMap dedup, cur *pb.List, groupVal []groupPair) {
-	l := len(groupVal)
-	if len(dedupMap.groups) == 0 || (l != 0 && len(cur.Uids) == 0) {
-		// This group is already empty or no group can be formed. So stop.
-		return
+// tierKey returns the label of the tier that f falls in, e.g. [50, 80). Every tier includes its
+// lower bound and excludes its upper bound, except for the last one which includes both, e.g.
+// [80, 100]. The values outside all the tiers are labeled like < 0 or > 100. It returns false
+// if they are to be skipped.
+func tierKey(tiers *gql.GroupbyTiers, f float64) (string, bool) {
+	bounds := tiers.Bounds
+	last := len(bounds) - 1
+	format := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', -1, 64)
 	}
-
-	if l == len(dedupMap.groups) {
-		a := make([]uint64, len(cur.Uids))
-		b := make([]groupPair, len(groupVal))
-		copy(a, cur.Uids)
-		copy(b, groupVal)
-		res.group = append(res.group, &groupResult{
-			uids: a,
-			keys: b,
-		})
-		return
+	switch {
+	case math.IsNaN(f):
+		return "", false
+	case f < bounds[0]:
+		return "< " + format(bounds[0]), tiers.Outliers
+	case f > bounds[last]:
+		return "> " + format(bounds[last]), tiers.Outliers
 	}
 
-	for _, v := range dedupMap.groups[l].elements {
-		temp := new(pb.List)
-		groupVal = append(groupVal, groupPair{
-			key:  v.key,
-			attr: dedupMap.groups[l].attr,
-		})
-		if l != 0 {
-			algo.IntersectWith(cur, v.entities, temp)
-		} else {
-			temp.Uids = make([]uint64, len(v.entities.Uids))
-			copy(temp.Uids, v.entities.Uids)
-		}
-		res.formGroups(dedupMap, temp, groupVal)
-		groupVal = groupVal[:len(groupVal)-1]
+	// Find the upper bound of the tier, i.e. the first bound greater than f.
+	upper := sort.Search(len(bounds), func(i int) bool { return bounds[i] > f })
+	if upper >= last {
+		return fmt.Sprintf("[%s, %s]", format(bounds[last-1]), format(bounds[last])), true
 	}
+	return fmt.Sprintf("[%s, %s)", format(bounds[upper-1]), format(bounds[upper])), true
 }
 
-func (sg *SubGraph) formResult(ul *pb.List) (*groupResults, error) {
-	var dedupMap dedup
-	res := new(groupResults)
+// relativeKey returns the label of the bucket that the age of t relative to the reference of
+// rel falls in, e.g. 30d. Every bucket includes its upper bound and excludes the one of the
+// previous bucket, so with buckets [7d, 30d] a datetime exactly 7 days old is labeled 7d. The
+// datetimes older than the largest bucket are labeled like > 30d and the ones after the
+// reference are labeled future.
+func relativeKey(rel *gql.GroupbyRelative, t time.Time) string {
+	age := rel.To.Sub(t)
+	if age < 0 {
+		return "future"
+	}
+	i := sort.Search(len(rel.Buckets), func(i int) bool { return rel.Buckets[i] >= age })
+	if i == len(rel.Buckets) {
+		return "> " + rel.Labels[len(rel.Labels)-1]
+	}
+	return rel.Labels[i]
+}
 
-	for _, child := range sg.Children {
-		if !child.Params.IgnoreResult {
-			continue
-		}
+// resolveGroupbyOptions returns opts with the reference of its Relative set to the current time
+// if it's now, so that all the keys of a query are bucketed relative to the same time.
+func resolveGroupbyOptions(opts gql.GroupbyOptions) gql.GroupbyOptions {
+	rel := opts.Relative
+	if rel == nil || !rel.Now {
+		return opts
+	}
+	resolved := *rel
+	resolved.To = time.Now()
+	resolved.Now = false
+	opts.Relative = &resolved
+	return opts
+}
 
-		attr := child.Params.Alias
-		if attr == "" {
-			attr = child.Attr
+// estimateGroups returns an upper bound of the number of groups formed from the keys, without
+// forming them. It's the product of the number of distinct keys of each attribute, capped by
+// the number of key combinations that the nodes have. With expand(_all_), each predicate is
+// grouped on its own, so the number of distinct keys of each one are added up instead.
+func (d *dedup) estimateGroups(expand bool) int {
+	if expand {
+		var n int
+		for _, group := range d.groups {
+			n += len(group.elements)
 		}
-		if len(child.DestUIDs.GetUids()) > 0 {
-			// It's a UID node.
-			for i := 0; i < len(child.uidMatrix); i++ {
-				srcUid := child.SrcUIDs.Uids[i]
-				// Ignore uids which are not part of srcUid.
-				if algo.IndexOf(ul, srcUid) < 0 {
-					continue
-				}
+		return n
+	}
+	if len(d.groups) == 0 {
+		return 0
+	}
 
-				ul := child.uidMatrix[i]
-				for _, uid := range ul.GetUids() {
-					dedupMap.addValue(attr, types.Val{Tid: types.UidID, Value: uid}, srcUid)
-				}
-			}
-		} else {
-			// It's a value node.
-			for i, v := range child.valueMatrix {
-				srcUid := child.SrcUIDs.Uids[i]
-				if len(v.Values) == 0 || algo.IndexOf(ul, srcUid) < 0 {
-					continue
-				}
-				val, err := convertTo(v.Values[0])
-				if err != nil {
-					continue
-				}
-				dedupMap.addValue(attr, val, srcUid)
+	product := 1
+	// combinations holds the number of key combinations of each node that has keys for all the
+	// attributes seen so far.
+	var combinations map[uint64]int
+	for i, group := range d.groups {
+		product = mulCapped(product, len(group.elements))
+		counts := make(map[uint64]int)
+		for _, elem := range group.elements {
+			for _, uid := range elem.entities.Uids {
+				counts[uid]++
 			}
 		}
-	}
-
-	// Create all the groups here.
-	res.formGroups(dedupMap, &pb.List{}, []groupPair{})
-
-	// Go over the groups and aggregate the values.
-	for _, child := range sg.Children {
-		if child.Params.IgnoreResult {
+		if i == 0 {
+			combinations = counts
 			continue
 		}
-		// This is a aggregation node.
-		for _, grp := range res.group {
-			err := grp.aggregateChild(child)
-			if err != nil && err != ErrEmptyVal {
-				return res, err
+		for uid, n := range combinations {
+			if m, ok := counts[uid]; ok {
+				combinations[uid] = mulCapped(n, m)
+			} else {
+				delete(combinations, uid)
 			}
 		}
 	}
-	// Sort to order the groups for determinism.
-	sort.Slice(res.group, func(i, j int) bool {
-		return groupLess(res.group[i], res.group[j])
-	})
 
-	return res, nil
-}
-
-// This function is to use the fillVars. It is similar to formResult, the only difference being
-// that it considers the whole uidMatrix to do the grouping before assigning the variable.
-// TODO - Check if we can reduce this duplication.
-func (sg *SubGraph) fillGroupedVars(doneVars map[string]varValue, path []*SubGraph) error {
-	var childHasVar bool
-	for _, child := range sg.Children {
-		if child.Params.Var != "" {
-			childHasVar = true
-			break
+	var total int
+	for _, n := range combinations {
+		if total += n; total < 0 || total > product {
+			return product
 		}
 	}
+	return total
+}
 
-	if !childHasVar {
-		return nil
+// mulCapped returns a*b for non-negative a and b, or math.MaxInt64 if it overflows.
+func mulCapped(a, b int) int {
+	if a != 0 && b > math.MaxInt64/a {
+		return math.MaxInt64
 	}
+	return a * b
+}
 
-	var pathNode *SubGraph
-	var dedupMap dedup
+// checkGroupEstimate returns an error if a groupby is estimated to form more groups than
+// allowed by x.Config.GroupbyGroupLimit. A limit of zero disables the check.
+func checkGroupEstimate(estimate int) error {
+	limit := x.Config.GroupbyGroupLimit
+	if limit > 0 && estimate > limit {
+		return errors.Errorf("Groupby is estimated to form %d groups, more than the limit of %d. "+
+			"Use --groupby_group_limit to change the limit", estimate, limit)
+	}
+	return nil
+}
 
-	for _, child := range sg.Children {
-		if !child.Params.IgnoreResult {
+// addHasValues adds a bool key for every source uid of the has() child, telling whether the
+// node has any value or edge of its predicate. If ul isn't nil, only its uids are added.
+func (d *dedup) addHasValues(attr string, child *SubGraph, ul *pb.List) {
+	for i, srcUid := range child.SrcUIDs.GetUids() {
+		if ul != nil && algo.IndexOf(ul, srcUid) < 0 {
 			continue
 		}
+		has := i < len(child.counts) && child.counts[i] > 0
+		d.addValue(attr, "", types.Val{Tid: types.BoolID, Value: has}, srcUid)
+	}
+}
 
-		attr := child.Params.Alias
-		if attr == "" {
-			attr = child.Attr
+// noLangKey is the key of the nodes grouped by lang() whose values have no language tag.
+const noLangKey = "none"
+
+// addLangValues adds a string key for every language tag of the values of the lang() child
+// that the source uid has, so a node with values in several languages is added to the group of
+// each of them. The values without a language tag are given the key "none". The nodes without
+// any value are skipped. If ul isn't nil, only its uids are added.
+func (d *dedup) addLangValues(attr string, child *SubGraph, ul *pb.List) {
+	for i, srcUid := range child.SrcUIDs.GetUids() {
+		if ul != nil && algo.IndexOf(ul, srcUid) < 0 {
+			continue
 		}
-		if len(child.DestUIDs.GetUids()) > 0 {
-			// It's a UID node.
-			for i := 0; i < len(child.uidMatrix); i++ {
-				srcUid := child.SrcUIDs.Uids[i]
-				ul := child.uidMatrix[i]
-				for _, uid := range ul.Uids {
-					dedupMap.addValue(attr, types.Val{Tid: types.UidID, Value: uid}, srcUid)
-				}
+		if i >= len(child.LangTags) {
+			continue
+		}
+		// The values of a list predicate all have the same tag, so it's only added once.
+		seen := make(map[string]bool)
+		for _, lang := range child.LangTags[i].GetLang() {
+			if lang == "" {
+				lang = noLangKey
 			}
-			pathNode = child
-		} else {
-			// It's a value node.
-			for i, v := range child.valueMatrix {
-				srcUid := child.SrcUIDs.Uids[i]
-				if len(v.Values) == 0 {
-					continue
-				}
-				val, err := convertTo(v.Values[0])
-				if err != nil {
-					continue
-				}
-				dedupMap.addValue(attr, val, srcUid)
+			if seen[lang] {
+				continue
 			}
+			seen[lang] = true
+			d.addValue(attr, "", types.Val{Tid: types.StringID, Value: lang}, srcUid)
 		}
 	}
+}
 
-	// Create all the groups here.
-	res := new(groupResults)
-	res.formGroups(dedupMap, &pb.List{}, []groupPair{})
+// addInValues adds a bool key for every source uid of the in() child, telling whether the node
+// is in the variable of the child. If ul isn't nil, only its uids are added.
+func (d *dedup) addInValues(attr string, child *SubGraph, ul *pb.List) {
+	for _, srcUid := range child.SrcUIDs.GetUids() {
+		if ul != nil && algo.IndexOf(ul, srcUid) < 0 {
+			continue
+		}
+		in := algo.IndexOf(child.Params.GroupbyIn, srcUid) >= 0
+		d.addValue(attr, "", types.Val{Tid: types.BoolID, Value: in}, srcUid)
+	}
+}
 
-	// Go over the groups and aggregate the values.
-	for _, child := range sg.Children {
-		if child.Params.IgnoreResult {
+// addLangCountValues adds an int key for every source uid of the langcount() child, holding
+// the number of distinct language tags of the values that the node has. The values without a
+// language tag aren't in any language, so they aren't counted, and the nodes without any
+// value are given the key 0. If ul isn't nil, only its uids are added.
+func (d *dedup) addLangCountValues(attr string, child *SubGraph, ul *pb.List) {
+	for i, srcUid := range child.SrcUIDs.GetUids() {
+		if ul != nil && algo.IndexOf(ul, srcUid) < 0 {
 			continue
 		}
-		// This is a aggregation node.
-		for _, grp := range res.group {
-			err := grp.aggregateChild(child)
-			if err != nil && err != ErrEmptyVal {
-				return err
+		langs := make(map[string]struct{})
+		if i < len(child.LangTags) {
+			for _, lang := range child.LangTags[i].GetLang() {
+				if lang != "" {
+					langs[lang] = struct{}{}
+				}
 			}
 		}
-		if child.Params.Var == "" {
+		d.addValue(attr, "", types.Val{Tid: types.IntID, Value: int64(len(langs))}, srcUid)
+	}
+}
+
+// addCountValues adds an int key for every source uid of the count() child, holding the number
+// of values or edges of its predicate that the node has. If a bucket width is set, the key is
+// the lower bound of the bucket the number falls in. The nodes without any are given the key
+// 0. If ul isn't nil, only its uids are added.
+func (d *dedup) addCountValues(attr string, child *SubGraph, ul *pb.List) {
+	for i, srcUid := range child.SrcUIDs.GetUids() {
+		if ul != nil && algo.IndexOf(ul, srcUid) < 0 {
 			continue
 		}
-		chVar := child.Params.Var
-
-		tempMap := make(map[uint64]types.Val)
+		var n int64
+		if i < len(child.counts) {
+			n = int64(child.counts[i])
+		}
+		if d.bucket > 0 {
+			n -= n % int64(d.bucket)
+		}
+		d.addValue(attr, "", types.Val{Tid: types.IntID, Value: n}, srcUid)
+	}
+}
+
+// addMathValues adds the result of the math() child, or the value of the variable of the val()
+// child, as the key of every source uid it has one for. The nodes the expression couldn't be
+// evaluated for and the nodes without a value in the variable are skipped. If ul isn't nil,
+// only its uids are added.
+func (d *dedup) addMathValues(attr string, child *SubGraph, ul *pb.List) {
+	for _, srcUid := range child.SrcUIDs.GetUids() {
+		if ul != nil && algo.IndexOf(ul, srcUid) < 0 {
+			continue
+		}
+		val, ok := child.Params.UidToVal[srcUid]
+		if !ok || val.Value == nil {
+			continue
+		}
+		d.addValue(attr, "", val, srcUid)
+	}
+}
+
+// evalGroupbyMath evaluates the math() attributes of the groupby node for its nodes. The
+// expressions can only be evaluated for the nodes that have a value for all of their
+// variables, so the other nodes are left out of the variables and aren't given a key.
+func (sg *SubGraph) evalGroupbyMath(doneVars map[string]varValue, path []*SubGraph) error {
+	path = append(path, sg)
+	for _, child := range sg.Children {
+		mNode := child.Params.GroupbyMath
+		if mNode == nil {
+			continue
+		}
+		child.Params.UidToVal = nil
+		if err := transformMathVars(mNode, doneVars, path); err != nil {
+			return err
+		}
+
+		var varNodes []*mathTree
+		for _, node := range mNode.extractVarNodes() {
+			if node.Const.Value == nil {
+				varNodes = append(varNodes, node)
+			}
+		}
+		var uids []uint64
+		for _, uid := range child.SrcUIDs.GetUids() {
+			complete := true
+			for _, node := range varNodes {
+				if val, ok := node.Val[uid]; !ok || val.Value == nil {
+					complete = false
+					break
+				}
+			}
+			if complete {
+				uids = append(uids, uid)
+			}
+		}
+		if len(uids) == 0 {
+			continue
+		}
+		// The maps of the variables may be shared with other nodes, so they're copied.
+		for _, node := range varNodes {
+			vals := make(map[uint64]types.Val, len(uids))
+			for _, uid := range uids {
+				vals[uid] = node.Val[uid]
+			}
+			node.Val = vals
+		}
+
+		if err := evalMathTree(mNode); err != nil {
+			return errors.Wrapf(err, "while evaluating %s in groupby", child.Params.Alias)
+		}
+		if mNode.Const.Value != nil {
+			// The expression doesn't depend on the nodes, so they all get the same key.
+			child.Params.UidToVal = make(map[uint64]types.Val, len(uids))
+			for _, uid := range uids {
+				child.Params.UidToVal[uid] = mNode.Const
+			}
+			continue
+		}
+		child.Params.UidToVal = mNode.Val
+	}
+	return nil
+}
+
+// fillGroupbyVals reads the values of the val() attributes of the groupby node from the value
+// variables computed by the blocks that ran before it. This is how nodes are grouped by an
+// aggregate computed in another block, e.g. the total of the orders of each user. The nodes of
+// the variables of the in() attributes are read too.
+func (sg *SubGraph) fillGroupbyVals(doneVars map[string]varValue) error {
+	for _, child := range sg.Children {
+		if name := child.Params.GroupbyInVar; name != "" {
+			v, ok := doneVars[name]
+			if !ok {
+				return errors.Errorf("Variable %s used in groupby is not defined", name)
+			}
+			child.Params.GroupbyIn = varNodes(v)
+			continue
+		}
+		name := child.Params.GroupbyVar
+		if name == "" {
+			continue
+		}
+		v, ok := doneVars[name]
+		if !ok {
+			return errors.Errorf("Variable %s used in groupby is not defined", name)
+		}
+		if len(v.Vals) == 0 && len(v.Uids.GetUids()) > 0 {
+			return errors.Errorf("Only value variables can be used in val() in groupby, but %s "+
+				"is a uid variable", name)
+		}
+		child.Params.UidToVal = v.Vals
+	}
+	return nil
+}
+
+// varNodes returns the sorted uids of the nodes of the variable v. The nodes of a value
+// variable are those it has a value for.
+func varNodes(v varValue) *pb.List {
+	if len(v.Vals) == 0 {
+		return &pb.List{Uids: v.Uids.GetUids()}
+	}
+	uids := make([]uint64, 0, len(v.Vals))
+	for uid := range v.Vals {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return &pb.List{Uids: uids}
+}
+
+// newGroupbyJSONPathChild returns the child of the groupby node sg that fetches the values of
+// the predicate of the jsonpath() attribute attr. Only string predicates can hold JSON.
+func newGroupbyJSONPathChild(sg *SubGraph, attr gql.GroupByAttr) (*SubGraph, error) {
+	jp, err := parseJSONPath(attr.JSONPath)
+	if err != nil {
+		return nil, err
+	}
+	if typ, err := schema.State().TypeOf(attr.Attr); err == nil &&
+		typ != types.StringID && typ != types.DefaultID {
+		return nil, errors.Errorf("jsonpath can only be applied to string predicates, but %s "+
+			"is of type %s", attr.Attr, typ.Name())
+	}
+	alias := attr.Alias
+	if alias == "" {
+		alias = fmt.Sprintf("jsonpath(%s, %s)", attr.Attr, attr.JSONPath)
+	}
+	return &SubGraph{
+		Attr:   attr.Attr,
+		ReadTs: sg.ReadTs,
+		Params: params{
+			Alias:             alias,
+			IgnoreResult:      true,
+			GroupbyJSONPath:   jp,
+			GroupbyJSONStrict: attr.Strict,
+		},
+	}, nil
+}
+
+// newGroupbyRegexCaptureChild returns the child of the groupby node sg that fetches the values
+// of the predicate of the regexcapture() attribute attr. Only string predicates can be matched,
+// and the regex must have a capture group to group the nodes by.
+func newGroupbyRegexCaptureChild(sg *SubGraph, attr gql.GroupByAttr) (*SubGraph, error) {
+	re, err := regexp.Compile(attr.Regex)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid regex in regexcapture(%s)", attr.Attr)
+	}
+	if re.NumSubexp() == 0 {
+		return nil, errors.Errorf("The regex in regexcapture(%s) must have a capture group to "+
+			"group by. Got: %s", attr.Attr, attr.Regex)
+	}
+	if typ, err := schema.State().TypeOf(attr.Attr); err == nil &&
+		typ != types.StringID && typ != types.DefaultID {
+		return nil, errors.Errorf("regexcapture can only be applied to string predicates, but "+
+			"%s is of type %s", attr.Attr, typ.Name())
+	}
+	alias := attr.Alias
+	if alias == "" {
+		alias = fmt.Sprintf("regexcapture(%s, %s)", attr.Attr, attr.Regex)
+	}
+	return &SubGraph{
+		Attr:   attr.Attr,
+		ReadTs: sg.ReadTs,
+		Params: params{
+			Alias:            alias,
+			IgnoreResult:     true,
+			GroupbyRegex:     re,
+			GroupbyUnmatched: attr.Unmatched,
+		},
+	}, nil
+}
+
+// newGroupbyDistanceChild returns the child of the groupby node sg that fetches the values of
+// the predicate of the distance() attribute attr. Only geo predicates hold points.
+func newGroupbyDistanceChild(sg *SubGraph, attr gql.GroupByAttr) (*SubGraph, error) {
+	if typ, err := schema.State().TypeOf(attr.Attr); err == nil &&
+		typ != types.GeoID && typ != types.DefaultID {
+		return nil, errors.Errorf("distance can only be applied to geo predicates, but %s is of "+
+			"type %s", attr.Attr, typ.Name())
+	}
+	alias := attr.Alias
+	if alias == "" {
+		alias = fmt.Sprintf("distance(%s, [%v, %v])", attr.Attr, attr.Distance.Lat,
+			attr.Distance.Lng)
+	}
+	return &SubGraph{
+		Attr:   attr.Attr,
+		ReadTs: sg.ReadTs,
+		Params: params{
+			Alias:           alias,
+			IgnoreResult:    true,
+			GroupbyDistance: attr.Distance,
+		},
+	}, nil
+}
+
+// newGroupbyCompareChildren returns the children of the groupby node sg that fetch the values
+// of the two predicates compared by the attribute attr. The first one is the group key and the
+// second one only holds the values it's compared to.
+func newGroupbyCompareChildren(sg *SubGraph, attr gql.GroupByAttr) []*SubGraph {
+	cmp := attr.Compare
+	alias := attr.Alias
+	if alias == "" {
+		alias = fmt.Sprintf("%s(%s, %s)", cmp.Fn, cmp.Left, cmp.Right)
+	}
+	return []*SubGraph{
+		{
+			Attr:   cmp.Left,
+			ReadTs: sg.ReadTs,
+			Params: params{
+				Alias:          alias,
+				IgnoreResult:   true,
+				GroupbyCompare: cmp,
+			},
+		},
+		{
+			Attr:   cmp.Right,
+			ReadTs: sg.ReadTs,
+			Params: params{
+				IgnoreResult:        true,
+				GroupbyCompareRight: true,
+			},
+		},
+	}
+}
+
+// addCompareValues adds a bool key for every source uid of the child left, telling whether its
+// value compares to the value of the child right as the comparison of left says. Both children
+// are fetched for the same uids. The nodes without a value for either predicate are skipped,
+// or given the key unknown if the comparison says so. If ul isn't nil, only its uids are added.
+func (d *dedup) addCompareValues(attr string, left, right *SubGraph, ul *pb.List) error {
+	cmp := left.Params.GroupbyCompare
+	for i, srcUid := range left.SrcUIDs.GetUids() {
+		if ul != nil && algo.IndexOf(ul, srcUid) < 0 {
+			continue
+		}
+		lv, lok := firstValue(left, i)
+		rv, rok := firstValue(right, i)
+		if !lok || !rok {
+			if cmp.Unknown {
+				d.addValue(attr, "", types.Val{Tid: types.StringID, Value: "unknown"}, srcUid)
+			}
+			continue
+		}
+		ok, err := compareValues(comparisonOps[cmp.Fn], lv, rv)
+		if err != nil {
+			return errors.Wrapf(err, "while comparing %s with %s in groupby", cmp.Left, cmp.Right)
+		}
+		d.addValue(attr, "", types.Val{Tid: types.BoolID, Value: ok}, srcUid)
+	}
+	return nil
+}
+
+// firstValue returns the first value of the value node child for the uid at index idx of its
+// valueMatrix, if there's one.
+func firstValue(child *SubGraph, idx int) (types.Val, bool) {
+	if idx >= len(child.valueMatrix) || len(child.valueMatrix[idx].Values) == 0 {
+		return types.Val{}, false
+	}
+	val, err := convertTo(child.valueMatrix[idx].Values[0])
+	if err != nil {
+		return types.Val{}, false
+	}
+	return val, true
+}
+
+// addJSONPathValues adds the value at the JSON path of the jsonpath() child in the value of
+// its predicate for the uid at index idx of its valueMatrix. Nothing is added if there's no
+// value at the path. Values that aren't valid JSON are skipped too, unless the child is
+// strict, in which case an error is returned.
+func (d *dedup) addJSONPathValues(attr string, child *SubGraph, idx int) error {
+	srcUid := child.SrcUIDs.Uids[idx]
+	if len(child.valueMatrix[idx].Values) == 0 {
+		return nil
+	}
+	val, err := convertTo(child.valueMatrix[idx].Values[0])
+	if err != nil {
+		return nil
+	}
+	data, ok := val.Value.(string)
+	if !ok {
+		return nil
+	}
+	key, ok, err := child.Params.GroupbyJSONPath.extract([]byte(data))
+	switch {
+	case err != nil && child.Params.GroupbyJSONStrict:
+		return errors.Wrapf(err, "value of %s for uid %#x is not valid JSON", child.Attr, srcUid)
+	case err != nil || !ok:
+		return nil
+	}
+	d.addValue(attr, "", key, srcUid)
+	return nil
+}
+
+// addDistanceValues adds the ring around the point of the distance() child that the value of
+// its predicate for the uid at index idx of its valueMatrix falls in. Nothing is added if the
+// value isn't a point with valid coordinates.
+func (d *dedup) addDistanceValues(attr string, child *SubGraph, idx int) {
+	srcUid := child.SrcUIDs.Uids[idx]
+	if len(child.valueMatrix[idx].Values) == 0 {
+		return
+	}
+	val, err := convertTo(child.valueMatrix[idx].Values[0])
+	if err != nil {
+		return
+	}
+	ring, ok := distanceKey(val, child.Params.GroupbyDistance)
+	if !ok {
+		return
+	}
+	d.addValue(attr, "", types.Val{Tid: types.IntID, Value: ring}, srcUid)
+}
+
+// distanceKey returns the lower bound in meters of the ring around the point of dist that the
+// point val falls in, e.g. 2000 for a point 2.5km away with rings 1km wide. The distance is
+// computed by the haversine formula. It returns false if val isn't a point, or if its
+// coordinates are out of range.
+func distanceKey(val types.Val, dist *gql.GroupbyDistance) (int64, bool) {
+	p, ok := val.Value.(*geom.Point)
+	if !ok || p.Empty() {
+		return 0, false
+	}
+	lng, lat := p.X(), p.Y()
+	// The comparisons are false for NaN.
+	if !(lng >= -180 && lng <= 180 && lat >= -90 && lat <= 90) {
+		return 0, false
+	}
+	angle := s2.LatLngFromDegrees(dist.Lat, dist.Lng).Distance(s2.LatLngFromDegrees(lat, lng))
+	meters := float64(types.EarthDistance(angle))
+	return int64(math.Floor(meters/dist.Ring) * dist.Ring), true
+}
+
+// addRegexCaptureValues adds the first capture group of the regex of the regexcapture() child
+// in the value of its predicate for the uid at index idx of its valueMatrix. A value that
+// doesn't match is added under the unmatched key of the child if it has one, and skipped
+// otherwise.
+func (d *dedup) addRegexCaptureValues(attr string, child *SubGraph, idx int) {
+	srcUid := child.SrcUIDs.Uids[idx]
+	if len(child.valueMatrix[idx].Values) == 0 {
+		return
+	}
+	val, err := convertTo(child.valueMatrix[idx].Values[0])
+	if err != nil {
+		return
+	}
+	str, ok := val.Value.(string)
+	if !ok {
+		return
+	}
+	key := child.Params.GroupbyUnmatched
+	// The capture group matched if its start is set, even to an empty string.
+	if m := child.Params.GroupbyRegex.FindStringSubmatchIndex(str); m != nil && m[2] >= 0 {
+		key = str[m[2]:m[3]]
+	} else if key == "" {
+		return
+	}
+	d.addValue(attr, "", types.Val{Tid: types.StringID, Value: key}, srcUid)
+}
+
+// roundFloat rounds f to the given number of decimals.
+func roundFloat(f float64, decimals int) float64 {
+	pow := math.Pow10(decimals)
+	rounded := math.Round(f*pow) / pow
+	if math.IsInf(rounded, 0) || math.IsNaN(rounded) {
+		// f*pow overflowed, so f has no decimals to round.
+		return f
+	}
+	return rounded
+}
+
+// addValues adds the values of the value node child for the uid at index idx of its
+// valueMatrix. If the values of all the languages were fetched, each of them is added as a
+// separate key annotated with its language. Otherwise, only the first value is added. The
+// values are first replaced by their labels if valueMap is set. The datetime values are
+// truncated to the unit of time of by, if set, and the geo values are replaced by the geohash
+// of their cell if geohash is set. The geo values that aren't points with valid coordinates
+// are skipped then.
+func (d *dedup) addValues(attr string, child *SubGraph, idx int) {
+	srcUid := child.SrcUIDs.Uids[idx]
+	for i, tv := range child.valueMatrix[idx].Values {
+		if i > 0 && !child.Params.ExpandAll {
+			break
+		}
+		val, err := convertTo(tv)
+		if err != nil {
+			continue
+		}
+		if d.valueMap != nil {
+			// The labels are looked up by the canonical form of the strings.
+			val = mapValue(d.valueMap, d.normalizeString(val))
+		}
+		if d.by != "" && val.Tid == types.DateTimeID {
+			val.Value = truncateTime(val.Value.(time.Time), d.by)
+		}
+		if d.geohash > 0 && val.Tid == types.GeoID {
+			hash, ok := geohashKey(val, d.geohash)
+			if !ok {
+				continue
+			}
+			val = types.Val{Tid: types.StringID, Value: hash}
+		}
+		var lang string
+		if child.Params.ExpandAll && idx < len(child.LangTags) &&
+			i < len(child.LangTags[idx].Lang) {
+			lang = child.LangTags[idx].Lang[i]
+		}
+		d.addValue(attr, lang, val, srcUid)
+	}
+}
+
+// mapValue returns the label that val is mapped to in vm, as a string value. The values that
+// aren't mapped get the unmapped label of vm if it's set, and are returned as they are
+// otherwise.
+func mapValue(vm *gql.GroupbyValueMap, val types.Val) types.Val {
+	key := types.Val{Tid: types.StringID, Value: ""}
+	if err := types.Marshal(val, &key); err == nil {
+		if label, ok := vm.Labels[key.Value.(string)]; ok {
+			return types.Val{Tid: types.StringID, Value: label}
+		}
+	}
+	if vm.Unmapped != "" {
+		return types.Val{Tid: types.StringID, Value: vm.Unmapped}
+	}
+	return val
+}
+
+// geohashAlphabet is the base 32 alphabet that geohashes are written with.
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohashKey returns the geohash of the given precision of the cell that the point val falls
+// in, e.g. u4pruy for a precision of 6. It returns false if val isn't a point, or if its
+// coordinates are out of range.
+func geohashKey(val types.Val, precision int) (string, bool) {
+	p, ok := val.Value.(*geom.Point)
+	if !ok || p.Empty() {
+		return "", false
+	}
+	lng, lat := p.X(), p.Y()
+	// The comparisons are false for NaN.
+	if !(lng >= -180 && lng <= 180 && lat >= -90 && lat <= 90) {
+		return "", false
+	}
+
+	// The bits of the hash halve the ranges of the longitude and of the latitude in turn,
+	// starting with the longitude, and every 5 bits make a character of the hash.
+	lngRange := [2]float64{-180, 180}
+	latRange := [2]float64{-90, 90}
+	hash := make([]byte, 0, precision)
+	var ch, bits int
+	for even := true; len(hash) < precision; even = !even {
+		v, rng := lat, &latRange
+		if even {
+			v, rng = lng, &lngRange
+		}
+		mid := (rng[0] + rng[1]) / 2
+		ch <<= 1
+		if v >= mid {
+			ch |= 1
+			rng[0] = mid
+		} else {
+			rng[1] = mid
+		}
+		if bits++; bits == 5 {
+			hash = append(hash, geohashAlphabet[ch])
+			ch, bits = 0, 0
+		}
+	}
+	return string(hash), true
+}
+
+// addFacetValues adds the node at idx in the results of child with the values of the facet
+// key on its edges, replaced by their labels if valueMap is set, or truncated to the unit of
+// time by if it's set. The edges without the facet are skipped.
+func (d *dedup) addFacetValues(attr string, child *SubGraph, idx int, key, by string) error {
+	srcUid := child.SrcUIDs.Uids[idx]
+	for _, fs := range child.facetsMatrix[idx].GetFacetsList() {
+		for _, f := range fs.GetFacets() {
+			if f.Key != key {
+				continue
+			}
+			val, err := facets.ValFor(f)
+			if err != nil {
+				return err
+			}
+			if d.valueMap != nil {
+				val = mapValue(d.valueMap, val)
+			} else if by != "" {
+				if val.Tid != types.DateTimeID {
+					return errors.Errorf("The facet %s of predicate %s must be a datetime to "+
+						"be grouped by %s, but got a value of type %s", key, child.Attr, by,
+						val.Tid.Name())
+				}
+				val.Value = truncateTime(val.Value.(time.Time), by)
+			}
+			d.addValue(attr, "", val, srcUid)
+		}
+	}
+	return nil
+}
+
+// truncateTime truncates t to the given unit of time in the time zone of t, so that an hour
+// starts at minute 0 and a day at midnight wherever t was written.
+func truncateTime(t time.Time, unit string) time.Time {
+	switch unit {
+	case "minute":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location())
+	case "hour":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	case "year":
+		return time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, t.Location())
+	}
+	return t
+}
+
+// varAggregators maps the names of the aggregators of groupby that aggregate the values of a
+// variable, e.g. countif(val(x), gt, 10), to the functions applying the value of a node of a
+// group to the aggregator.
+var varAggregators = map[string]func(ag *aggregator, child *SubGraph, uid uint64,
+	val types.Val) error{
+	// Only the extremes of the values are kept.
+	"range": applyVarValue,
+	// The weights of the values come from the second variable of wpercentile.
+	"wpercentile": func(ag *aggregator, child *SubGraph, uid uint64, val types.Val) error {
+		if weight, ok := child.Params.UidToWeight[uid]; ok {
+			ag.applyWeighted(val, weight)
+		}
+		return nil
+	},
+	"countif": applyVarValue,
+	// The values are buffered along with the uids of their nodes to pick the uid with the
+	// median value.
+	"medianuid": func(ag *aggregator, _ *SubGraph, uid uint64, val types.Val) error {
+		ag.applyMedianuid(val, uid)
+		return nil
+	},
+	// The values only move the markers of the estimator, so they aren't buffered.
+	"p2percentile": applyVarValue,
+}
+
+// applyVarValue applies the value of a node to an aggregator of a variable that only needs
+// the value.
+func applyVarValue(ag *aggregator, _ *SubGraph, _ uint64, val types.Val) error {
+	return ag.Apply(val)
+}
+
+// aggregateGroup applies the values of child for the uids in the group to the aggregator of
+// child, and returns the aggregator to read the result from.
+func aggregateGroup(grp *groupResult, child *SubGraph, budget *bufferBudget) (*aggregator, error) {
+	ag := &aggregator{
+		name:   child.SrcFunc.Name,
+		budget: budget,
+	}
+	if err := ag.setArgs(child.SrcFunc.Args); err != nil {
+		return nil, err
+	}
+	if apply, ok := varAggregators[ag.name]; ok {
+		// The values come from the variable of the aggregator. The nodes without a value
+		// aren't aggregated.
+		for _, uid := range grp.uids {
+			if val, ok := child.Params.UidToVal[uid]; ok {
+				if err := apply(ag, child, uid, val); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return ag, nil
+	}
+	if ag.name == "countdistinct" {
+		// All the values of the nodes are counted, or all their edges for a uid predicate.
+		for _, uid := range grp.uids {
+			idx := sort.Search(len(child.SrcUIDs.Uids), func(i int) bool {
+				return child.SrcUIDs.Uids[i] >= uid
+			})
+			if idx == len(child.SrcUIDs.Uids) || child.SrcUIDs.Uids[idx] != uid {
+				continue
+			}
+			if idx < len(child.uidMatrix) {
+				for _, dst := range child.uidMatrix[idx].GetUids() {
+					if err := ag.Apply(types.Val{Tid: types.UidID, Value: dst}); err != nil {
+						return nil, err
+					}
+				}
+			}
+			if idx < len(child.valueMatrix) {
+				for _, v := range child.valueMatrix[idx].Values {
+					val, err := convertWithBestEffort(v, child.Attr)
+					if err != nil {
+						continue
+					}
+					if err := ag.Apply(val); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		return ag, nil
+	}
+	for _, uid := range grp.members(ag.name) {
+		idx := sort.Search(len(child.SrcUIDs.Uids), func(i int) bool {
+			return child.SrcUIDs.Uids[i] >= uid
+		})
+		if idx == len(child.SrcUIDs.Uids) || child.SrcUIDs.Uids[idx] != uid {
+			continue
+		}
+
+		if len(child.valueMatrix[idx].Values) == 0 {
+			continue
+		}
+		v := child.valueMatrix[idx].Values[0]
+		val, err := convertWithBestEffort(v, child.Attr)
+		if err != nil {
+			continue
+		}
+		if err := ag.Apply(val); err != nil {
+			return nil, err
+		}
+		if ag.name == "any" || ag.name == "first" {
+			// The value of any member of the group will do, or that of the first one, so
+			// there's no need to look at the others.
+			break
+		}
+	}
+	return ag, nil
+}
+
+// topkItem is a uid ranked by topk along with the value it's ranked by.
+type topkItem struct {
+	uid uint64
+	val types.Val
+}
+
+// topkWorse returns true if a ranks lower than b. Ties are broken by uid, the lower uid ranks
+// higher so that the results are deterministic.
+func topkWorse(a, b topkItem) bool {
+	if l, _ := types.Less(a.val, b.val); l {
+		return true
+	}
+	if l, _ := types.Less(b.val, a.val); l {
+		return false
+	}
+	return a.uid > b.uid
+}
+
+// topkHeap is a min-heap of the best uids found so far. Its root is the uid that ranks lowest,
+// which is the one replaced when a better uid is found.
+type topkHeap []topkItem
+
+func (h topkHeap) Len() int           { return len(h) }
+func (h topkHeap) Less(i, j int) bool { return topkWorse(h[i], h[j]) }
+func (h topkHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *topkHeap) Push(val interface{}) {
+	*h = append(*h, val.(topkItem))
+}
+
+func (h *topkHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[0 : n-1]
+	return item
+}
+
+// topkGroup returns the k uids of the group with the highest values of the variable child ranks
+// by, best first. Only k uids are kept in memory at any time.
+func topkGroup(grp *groupResult, child *SubGraph) ([]uint64, error) {
+	if len(child.SrcFunc.Args) != 1 {
+		return nil, errors.Errorf("Expected the number of uids to return in topk")
+	}
+	k, err := strconv.Atoi(child.SrcFunc.Args[0].Value)
+	if err != nil || k <= 0 {
+		return nil, errors.Errorf("k in topk must be a positive integer but got: %v",
+			child.SrcFunc.Args[0].Value)
+	}
+
+	h := make(topkHeap, 0, k)
+	var typ types.TypeID
+	for _, uid := range grp.uids {
+		val, ok := child.Params.UidToVal[uid]
+		if !ok {
+			continue
+		}
+		if len(h) == 0 {
+			if _, err := types.Less(val, val); err != nil {
+				return nil, errors.Wrapf(err, "while ranking uids in topk")
+			}
+			typ = val.Tid
+		} else if val.Tid != typ {
+			return nil, errors.Errorf("topk can only rank values of the same type. Got: %v and %v",
+				typ.Name(), val.Tid.Name())
+		}
+
+		item := topkItem{uid: uid, val: val}
+		switch {
+		case len(h) < k:
+			heap.Push(&h, item)
+		case topkWorse(h[0], item):
+			h[0] = item
+			heap.Fix(&h, 0)
+		}
+	}
+	if len(h) == 0 {
+		return nil, ErrEmptyVal
+	}
+
+	uids := make([]uint64, len(h))
+	for i := len(uids) - 1; i >= 0; i-- {
+		uids[i] = heap.Pop(&h).(topkItem).uid
+	}
+	return uids, nil
+}
+
+// formGroup creates all possible groups with the list of uids that belong to that
+// group. The groups with fewer uids than the min size of dedupMap are left out.
+func (res *groupResults) formGroups(dedupMap dedup, cur *pb.List, groupVal []groupPair) {
+	l := len(groupVal)
+	if len(dedupMap.groups) == 0 || (l != 0 && len(cur.Uids) == 0) {
+		// This group is already empty or no group can be formed. So stop.
+		return
+	}
+
+	if l == len(dedupMap.groups) {
+		if len(cur.Uids) < dedupMap.minSize {
+			return
+		}
+		a := make([]uint64, len(cur.Uids))
+		b := make([]groupPair, len(groupVal))
+		copy(a, cur.Uids)
+		copy(b, groupVal)
+		res.group = append(res.group, &groupResult{
+			uids: a,
+			keys: b,
+		})
+		return
+	}
+
+	for _, v := range dedupMap.groups[l].elements {
+		temp := new(pb.List)
+		groupVal = append(groupVal, groupPair{
+			key:  v.key,
+			attr: dedupMap.groups[l].attr,
+			lang: v.lang,
+		})
+		if l != 0 {
+			algo.IntersectWith(cur, v.entities, temp)
+		} else {
+			temp.Uids = make([]uint64, len(v.entities.Uids))
+			copy(temp.Uids, v.entities.Uids)
+		}
+		res.formGroups(dedupMap, temp, groupVal)
+		groupVal = groupVal[:len(groupVal)-1]
+	}
+}
+
+// groupKeys collects the keys of the nodes in ul for each of the attributes they're grouped by.
+// All the nodes are grouped if ul is nil.
+func (sg *SubGraph) groupKeys(ul *pb.List) (dedup, error) {
+	dedupMap := dedup{round: sg.Params.Groupby.Round, tiers: sg.Params.Groupby.Tiers,
+		bucket: sg.Params.Groupby.Bucket, relative: sg.Params.Groupby.Relative,
+		by: sg.Params.Groupby.By, geohash: sg.Params.Groupby.Geohash,
+		valueMap: sg.Params.Groupby.ValueMap, minSize: sg.Params.Groupby.MinSize,
+		trim: sg.Params.Groupby.Trim, collapse: sg.Params.Groupby.Collapse}
+
+	for i, child := range sg.Children {
+		if !child.Params.IgnoreResult || child.Params.GroupbyCompareRight {
+			continue
+		}
+		if err := sg.collectGroupKey(&dedupMap, i, ul); err != nil {
+			return dedupMap, err
+		}
+	}
+	if err := sg.applyGroupKeyFilters(&dedupMap); err != nil {
+		return dedupMap, err
+	}
+	return dedupMap, nil
+}
+
+// inGroupList returns whether the node with the given uid is in ul, which holds all the nodes
+// if it's nil.
+func inGroupList(ul *pb.List, uid uint64) bool {
+	return ul == nil || algo.IndexOf(ul, uid) >= 0
+}
+
+// groupKeyKind is the kind of attribute that nodes are grouped by, which tells how its keys are
+// collected.
+type groupKeyKind int
+
+const (
+	groupKeyHas groupKeyKind = iota
+	groupKeyLang
+	groupKeyLangCount
+	groupKeyIn
+	groupKeyCompare
+	groupKeyCount
+	groupKeyMath
+	groupKeyFacet
+	groupKeyJSONPath
+	groupKeyRegex
+	groupKeyDistance
+	// groupKeyUid groups the nodes by the uids of a uid predicate.
+	groupKeyUid
+	// groupKeyValue groups the nodes by the values of a value predicate.
+	groupKeyValue
+)
+
+// groupKeyKind returns the kind of the attribute of the child of the groupby.
+func (sg *SubGraph) groupKeyKind(child *SubGraph) groupKeyKind {
+	switch {
+	case child.Params.GroupbyHas:
+		return groupKeyHas
+	case child.Params.GroupbyLang:
+		return groupKeyLang
+	case child.Params.GroupbyLangCount:
+		return groupKeyLangCount
+	case child.Params.GroupbyInVar != "":
+		return groupKeyIn
+	case child.Params.GroupbyCompare != nil:
+		return groupKeyCompare
+	case child.Params.GroupbyCount:
+		return groupKeyCount
+	case child.Params.GroupbyMath != nil || child.Params.GroupbyVar != "":
+		return groupKeyMath
+	case sg.Params.Groupby.Facet != "":
+		return groupKeyFacet
+	case child.Params.GroupbyJSONPath != nil:
+		return groupKeyJSONPath
+	case child.Params.GroupbyRegex != nil:
+		return groupKeyRegex
+	case child.Params.GroupbyDistance != nil:
+		return groupKeyDistance
+	case len(child.DestUIDs.GetUids()) > 0:
+		return groupKeyUid
+	default:
+		return groupKeyValue
+	}
+}
+
+// collectGroupKey adds the keys of the nodes in ul for the attribute of the i-th child of the
+// groupby to d. All the nodes are grouped if ul is nil. Both the results and the variables of
+// the groupby collect their keys with it, so that they're grouped the same way.
+func (sg *SubGraph) collectGroupKey(d *dedup, i int, ul *pb.List) error {
+	child := sg.Children[i]
+	attr := child.Params.Alias
+	if attr == "" {
+		attr = child.Attr
+	}
+	switch sg.groupKeyKind(child) {
+	case groupKeyHas:
+		d.addHasValues(attr, child, ul)
+	case groupKeyLang:
+		d.addLangValues(attr, child, ul)
+	case groupKeyLangCount:
+		d.addLangCountValues(attr, child, ul)
+	case groupKeyIn:
+		d.addInValues(attr, child, ul)
+	case groupKeyCompare:
+		return d.addCompareValues(attr, child, sg.Children[i+1], ul)
+	case groupKeyCount:
+		d.addCountValues(attr, child, ul)
+	case groupKeyMath:
+		d.addMathValues(attr, child, ul)
+	case groupKeyFacet:
+		for i := range child.facetsMatrix {
+			if !inGroupList(ul, child.SrcUIDs.Uids[i]) {
+				continue
+			}
+			if err := d.addFacetValues(attr, child, i, sg.Params.Groupby.Facet,
+				sg.Params.Groupby.By); err != nil {
+				return err
+			}
+		}
+	case groupKeyJSONPath:
+		for i := range child.valueMatrix {
+			if !inGroupList(ul, child.SrcUIDs.Uids[i]) {
+				continue
+			}
+			if err := d.addJSONPathValues(attr, child, i); err != nil {
+				return err
+			}
+		}
+	case groupKeyRegex:
+		for i := range child.valueMatrix {
+			if inGroupList(ul, child.SrcUIDs.Uids[i]) {
+				d.addRegexCaptureValues(attr, child, i)
+			}
+		}
+	case groupKeyDistance:
+		for i := range child.valueMatrix {
+			if inGroupList(ul, child.SrcUIDs.Uids[i]) {
+				d.addDistanceValues(attr, child, i)
+			}
+		}
+	case groupKeyUid:
+		// It's a UID node.
+		for i := 0; i < len(child.uidMatrix); i++ {
+			srcUid := child.SrcUIDs.Uids[i]
+			// Ignore uids which are not part of srcUid.
+			if !inGroupList(ul, srcUid) {
+				continue
+			}
+			for _, uid := range child.uidMatrix[i].GetUids() {
+				d.addValue(attr, "", types.Val{Tid: types.UidID, Value: uid}, srcUid)
+			}
+		}
+	default:
+		// It's a value node.
+		for i := range child.valueMatrix {
+			if inGroupList(ul, child.SrcUIDs.Uids[i]) {
+				d.addValues(attr, child, i)
+			}
+		}
+	}
+	return nil
+}
+
+// groupKeyAttrs returns the names of the attributes the nodes are grouped by, in the order of
+// the groupby.
+func (sg *SubGraph) groupKeyAttrs() []string {
+	var attrs []string
+	for _, child := range sg.Children {
+		if !child.Params.IgnoreResult || child.Params.GroupbyCompareRight {
+			continue
+		}
+		attr := child.Params.Alias
+		if attr == "" {
+			attr = child.Attr
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs
+}
+
+// mergeDedups merges the keys collected by groupKeys for several uid lists, so that the nodes
+// of all the lists are grouped together. A node that is in several lists is only counted once.
+// The attributes are ordered like in attrs, which holds all of them in the order of the
+// groupby.
+func mergeDedups(keys []dedup, attrs []string) dedup {
+	if len(keys) == 0 {
+		return dedup{}
+	}
+	merged := dedup{round: keys[0].round, tiers: keys[0].tiers, bucket: keys[0].bucket,
+		relative: keys[0].relative, by: keys[0].by, minSize: keys[0].minSize}
+	// An attribute without any key in a list has no group in its dedup, so the order of the
+	// groups of a single list can't be relied on.
+	present := make(map[string]bool)
+	for _, d := range keys {
+		for _, grp := range d.groups {
+			present[grp.attr] = true
+		}
+	}
+	for _, attr := range attrs {
+		if present[attr] {
+			merged.getGroup(attr)
+		}
+	}
+
+	for _, d := range keys {
+		for _, grp := range d.groups {
+			cur := merged.getGroup(grp.attr)
+			for strKey, elem := range grp.elements {
+				if prev, ok := cur.elements[strKey]; ok {
+					prev.entities = algo.MergeSorted([]*pb.List{prev.entities, elem.entities})
+					cur.elements[strKey] = prev
+					continue
+				}
+				cur.elements[strKey] = groupElements{
+					key:      elem.key,
+					lang:     elem.lang,
+					entities: &pb.List{Uids: append([]uint64(nil), elem.entities.Uids...)},
+				}
+			}
+		}
+	}
+	return merged
+}
+
+// formResult forms the groups from the keys collected by groupKeys and aggregates their values.
+// rank orders the members of the groups for first and last, as returned by facetRanks.
+func (sg *SubGraph) formResult(dedupMap dedup, rank map[uint64]int) (*groupResults, error) {
+	res := new(groupResults)
+	opts := sg.Params.Groupby
+	if opts.Coverage > 0 && (opts.Distinct || opts.Cumsum != "" || opts.PageSize > 0 ||
+		opts.After != "") {
+		// The covered groups are ordered by their shares, which the options ordering the
+		// groups by their keys would undo, so they'd be dropped without a word.
+		return res, errors.Errorf("coverage can't be specified along with distinct, " +
+			"cumulative, pageSize or after in groupby")
+	}
+
+	// Create all the groups here.
+	if sg.isGroupbyExpand() {
+		// Each of the expanded predicates is grouped on its own.
+		for _, group := range dedupMap.groups {
+			res.formGroups(dedup{groups: []*uniq{group}, minSize: dedupMap.minSize},
+				&pb.List{}, []groupPair{})
+		}
+	} else {
+		res.formGroups(dedupMap, &pb.List{}, []groupPair{})
+	}
+	for _, grp := range res.group {
+		grp.rank = rank
+	}
+	if sg.Params.Groupby.Summary {
+		// The summary covers all the groups, not only those of a page.
+		res.summarize(sg.Params.Groupby.Larger)
+	}
+	if sg.Params.Groupby.ID {
 		for _, grp := range res.group {
-			if len(grp.keys) == 0 {
+			id, err := groupID(grp.keys)
+			if err != nil {
+				return res, err
+			}
+			grp.id = id
+		}
+	}
+	if sg.Params.Groupby.Distinct {
+		// Only the keys are returned, so there's nothing to aggregate.
+		if err := res.distinctKeys(); err != nil {
+			return res, err
+		}
+		return res, res.page(sg.Params.Groupby.PageSize, sg.Params.Groupby.After)
+	}
+
+	// Go over the groups and aggregate the values. The values buffered by the aggregators
+	// of all the groups count towards the same limit.
+	budget := &bufferBudget{limit: x.Config.AggregateBufferLimit}
+	if err := sg.aggregateChildren(res, budget); err != nil {
+		return res, err
+	}
+	if sg.Params.Groupby.Percent {
+		res.addPercents()
+	}
+	if sg.Params.Groupby.MinMax != "" {
+		if err := sg.checkAggregateOption(sg.Params.Groupby.MinMax,
+			"to normalize with minmax"); err != nil {
+			return res, err
+		}
+		if err := res.normalizeAggregate(sg.Params.Groupby.MinMax); err != nil {
+			return res, err
+		}
+	}
+	if sg.Params.Groupby.Coverage > 0 {
+		if by := sg.Params.Groupby.CoverBy; by != "" {
+			if err := sg.checkAggregateOption(by, "to measure the coverage by"); err != nil {
+				return res, err
+			}
+		}
+		// The groups are left in the order of their shares. The options that order or page
+		// the groups by their keys were rejected above.
+		return res, res.cover(sg.Params.Groupby.Coverage, sg.Params.Groupby.CoverBy)
+	}
+	if sg.Params.Groupby.Cumsum != "" {
+		if err := sg.checkAggregateOption(sg.Params.Groupby.Cumsum,
+			"to accumulate with cumulative"); err != nil {
+			return res, err
+		}
+		// The running totals follow the order of the keys, which the groups keep in the
+		// results, and are computed before paging so that they include the previous pages.
+		if err := res.accumulateAggregate(sg.Params.Groupby.Cumsum); err != nil {
+			return res, err
+		}
+		return res, res.page(sg.Params.Groupby.PageSize, sg.Params.Groupby.After)
+	}
+	if sg.Params.Groupby.PageSize > 0 || sg.Params.Groupby.After != "" {
+		// The pages are ordered by the keys, which don't change between two requests, unlike
+		// the numbers of nodes of the groups.
+		sort.Slice(res.group, func(i, j int) bool {
+			return compareGroupKeyOrder(res.group[i].keys, res.group[j].keys) < 0
+		})
+		return res, res.page(sg.Params.Groupby.PageSize, sg.Params.Groupby.After)
+	}
+	// Sort to order the groups for determinism.
+	sort.Slice(res.group, func(i, j int) bool {
+		return groupLess(res.group[i], res.group[j])
+	})
+	return res, nil
+}
+
+// groupPageToken holds the keys of the last group of a page of the results of a groupby, as
+// encoded in the token returned to get the next page.
+type groupPageToken struct {
+	Keys []groupPageKey `json:"keys"`
+}
+
+// groupPageKey is a key of the last group of a page, as encoded in its token.
+type groupPageKey struct {
+	Attr  string       `json:"attr"`
+	Lang  string       `json:"lang,omitempty"`
+	Type  types.TypeID `json:"type"`
+	Value []byte       `json:"value"`
+}
+
+// page keeps the groups of a page of the results, which start after the group whose keys are
+// encoded by the token after, if it's set, and have at most size groups, if it's positive.
+// The groups must already be ordered by their keys as by compareGroupKeyOrder. The token only
+// holds the keys of a group, unlike an offset, so a group that's added or removed between two
+// pages, or whose members change, doesn't shift the others. If there are more groups after the
+// page, res.next is set to the token of its last group.
+func (res *groupResults) page(size int, after string) error {
+	if after != "" {
+		last, err := decodeGroupPageToken(after)
+		if err != nil {
+			return err
+		}
+		start := sort.Search(len(res.group), func(i int) bool {
+			return compareGroupKeyOrder(res.group[i].keys, last) > 0
+		})
+		res.group = res.group[start:]
+	}
+	if size > 0 && len(res.group) > size {
+		res.group = res.group[:size]
+		next, err := encodeGroupPageToken(res.group[size-1].keys)
+		if err != nil {
+			return err
+		}
+		res.next = next
+	}
+	return nil
+}
+
+// compareGroupOrder compares two groups to order them as by groupLess, by the attribute of
+// their first key, then by their numbers of nodes, keys and aggregates and then by their keys.
+// It returns a negative number if a is ordered before b, a positive one if it's ordered after b
+// and zero otherwise.
+func compareGroupOrder(a, b *groupResult) int {
+	// Groups formed from different predicates, as with expand(_all_), are kept together.
+	if len(a.keys) > 0 && len(b.keys) > 0 && a.keys[0].attr != b.keys[0].attr {
+		return strings.Compare(a.keys[0].attr, b.keys[0].attr)
+	}
+	switch {
+	case len(a.uids) != len(b.uids):
+		return len(a.uids) - len(b.uids)
+	case len(a.keys) != len(b.keys):
+		return len(a.keys) - len(b.keys)
+	case len(a.aggregates) != len(b.aggregates):
+		return len(a.aggregates) - len(b.aggregates)
+	}
+	if c := compareGroupKeys(a.keys, b.keys); c != 0 {
+		return c
+	}
+	return compareGroupKeyTypes(a.keys, b.keys)
+}
+
+// compareGroupKeyOrder compares the keys of two groups to order them by their keys alone.
+// Unlike compareGroupKeys, the groups can have different keys. They're ordered by the
+// attributes of their keys, then by the number of keys and then by their values. It returns a
+// negative number if a is ordered before b, a positive one if it's ordered after b and zero
+// otherwise.
+func compareGroupKeyOrder(a, b []groupPair) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].attr != b[i].attr {
+			return strings.Compare(a[i].attr, b[i].attr)
+		}
+	}
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	if c := compareGroupKeys(a, b); c != 0 {
+		return c
+	}
+	return compareGroupKeyTypes(a, b)
+}
+
+// compareGroupKeyTypes orders the keys of two groups, which must have as many keys, by their
+// types, as values of different types can't be compared.
+func compareGroupKeyTypes(a, b []groupPair) int {
+	for i := range a {
+		if a[i].key.Tid != b[i].key.Tid {
+			return int(a[i].key.Tid) - int(b[i].key.Tid)
+		}
+	}
+	return 0
+}
+
+// encodeGroupPageToken returns the token of the page that ends with the group with the given
+// keys. The token is opaque to the clients, which pass it back to get the next page.
+func encodeGroupPageToken(keys []groupPair) (string, error) {
+	pageKeys := make([]groupPageKey, 0, len(keys))
+	for _, key := range keys {
+		var value []byte
+		if key.key.Tid == types.UidID {
+			// Uids can't be marshalled, unlike the values of the scalar types.
+			value = make([]byte, 8)
+			binary.BigEndian.PutUint64(value, key.key.Value.(uint64))
+		} else {
+			bv := types.ValueForType(types.BinaryID)
+			if err := types.Marshal(key.key, &bv); err != nil {
+				return "", errors.Wrapf(err, "while encoding the key of the group of %s",
+					key.attr)
+			}
+			value = bv.Value.([]byte)
+		}
+		pageKeys = append(pageKeys, groupPageKey{
+			Attr:  key.attr,
+			Lang:  key.lang,
+			Type:  key.key.Tid,
+			Value: value,
+		})
+	}
+	b, err := json.Marshal(groupPageToken{Keys: pageKeys})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodeGroupPageToken returns the keys of the last group of the page whose token is given.
+func decodeGroupPageToken(token string) ([]groupPair, error) {
+	invalid := errors.Errorf("Invalid after token in groupby: %s", token)
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, invalid
+	}
+	var pageToken groupPageToken
+	if err := json.Unmarshal(b, &pageToken); err != nil {
+		return nil, invalid
+	}
+	keys := make([]groupPair, 0, len(pageToken.Keys))
+	for _, pageKey := range pageToken.Keys {
+		var val types.Val
+		if pageKey.Type == types.UidID {
+			if len(pageKey.Value) != 8 {
+				return nil, invalid
+			}
+			val = types.Val{Tid: types.UidID, Value: binary.BigEndian.Uint64(pageKey.Value)}
+		} else {
+			if val, err = types.Convert(types.Val{Tid: types.BinaryID, Value: pageKey.Value},
+				pageKey.Type); err != nil {
+				return nil, invalid
+			}
+		}
+		keys = append(keys, groupPair{attr: pageKey.Attr, lang: pageKey.Lang, key: val})
+	}
+	return keys, nil
+}
+
+// distinctKeys sorts the groups by their keys and drops the groups whose keys are the same as
+// those of the group before them, so that each combination of the keys is returned once.
+func (res *groupResults) distinctKeys() error {
+	sort.SliceStable(res.group, func(i, j int) bool {
+		return compareGroupKeyOrder(res.group[i].keys, res.group[j].keys) < 0
+	})
+	// The keys are compared by their ids, as keys of different types can't be ordered.
+	var prev string
+	groups := res.group[:0]
+	for i, grp := range res.group {
+		id, err := groupID(grp.keys)
+		if err != nil {
+			return err
+		}
+		if i > 0 && id == prev {
+			continue
+		}
+		prev = id
+		groups = append(groups, grp)
+	}
+	res.group = groups
+	return nil
+}
+
+// encodeGroupMembers returns the uids of the members of a group, which are sorted, encoded as a
+// uid pack like the ones of the posting lists, in base64. It's far more compact than the list
+// of the uids for large groups, and can be decoded with codec.Decode.
+func encodeGroupMembers(uids []uint64) (string, error) {
+	b, err := codec.Encode(uids, 256).Marshal()
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot encode the members of the group")
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// groupID returns the id of the group with the given keys. It's a hash of the names,
+// languages, types and values of the keys, so a group gets the same id in every query that
+// groups by the same attributes, whatever its position in the results.
+func groupID(keys []groupPair) (string, error) {
+	h := sha256.New()
+	writeField := func(field string) {
+		// Each field is prefixed by its length, so that neighbouring fields can't be mistaken
+		// for each other.
+		var buf [binary.MaxVarintLen64]byte
+		h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(field)))])
+		h.Write([]byte(field))
+	}
+	for _, key := range keys {
+		sv := types.ValueForType(types.StringID)
+		if err := types.Marshal(key.key, &sv); err != nil {
+			return "", errors.Wrapf(err, "while computing the id of the group of %s", key.attr)
+		}
+		writeField(key.attr)
+		writeField(key.lang)
+		writeField(key.key.Tid.Name())
+		writeField(sv.Value.(string))
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)[:16]), nil
+}
+
+// checkAggregateOption checks that the aggregate named by an option of a groupby, like minmax,
+// is computed by the block. purpose describes what the option does with it.
+func (sg *SubGraph) checkAggregateOption(name, purpose string) error {
+	if sg.Params.Groupby.Percent && name == "percent" {
+		return nil
+	}
+	for _, child := range sg.Children {
+		if !child.Params.IgnoreResult && aggregateName(child) == name {
+			return nil
+		}
+	}
+	return errors.Errorf("Aggregate %s %s is not in the groupby block", name, purpose)
+}
+
+// normalizeAggregate adds a companion to the aggregate with the given name in every group,
+// holding its value rescaled to [0, 1] by the min and max values of the aggregate across all
+// the groups. The companion is named like the aggregate with a _normalized suffix. If all the
+// groups have the same value, it's normalized to 0. The groups without a value for the
+// aggregate get no companion.
+func (res *groupResults) normalizeAggregate(name string) error {
+	values := make([]float64, len(res.group))
+	found := make([]bool, len(res.group))
+	min, max := math.Inf(1), math.Inf(-1)
+	for i, grp := range res.group {
+		for _, agg := range grp.aggregates {
+			if agg.attr != name {
+				continue
+			}
+			switch agg.key.Tid {
+			case types.IntID:
+				values[i] = float64(agg.key.Value.(int64))
+			case types.FloatID:
+				values[i] = agg.key.Value.(float64)
+			default:
+				return errors.Errorf("Only numeric aggregates can be normalized with minmax, "+
+					"but %s is of type %s", name, agg.key.Tid.Name())
+			}
+			found[i] = true
+			min = math.Min(min, values[i])
+			max = math.Max(max, values[i])
+			break
+		}
+	}
+
+	for i, grp := range res.group {
+		if !found[i] {
+			continue
+		}
+		var normalized float64
+		if max > min {
+			normalized = (values[i] - min) / (max - min)
+		}
+		grp.aggregates = append(grp.aggregates, groupPair{
+			attr: name + "_normalized",
+			key:  types.Val{Tid: types.FloatID, Value: normalized},
+		})
+	}
+	return nil
+}
+
+// accumulateAggregate orders the groups by their keys and adds a companion to the aggregate
+// with the given name in every group, holding the running total of the aggregate over the
+// group and the ones before it. The companion is named like the aggregate with a _cumulative
+// suffix. The total of int aggregates is an int, unless it overflows. The groups formed from
+// different predicates by expand(_all_) have separate totals. The groups without a value for
+// the aggregate get no companion and don't add to the total.
+func (res *groupResults) accumulateAggregate(name string) error {
+	sort.SliceStable(res.group, func(i, j int) bool {
+		return compareGroupKeyOrder(res.group[i].keys, res.group[j].keys) < 0
+	})
+	totals := make(map[string]types.Val)
+	for _, grp := range res.group {
+		for _, agg := range grp.aggregates {
+			if agg.attr != name {
 				continue
 			}
-			if len(grp.keys) > 1 {
-				return errors.Errorf("Expected one UID for var in groupby but got: %d", len(grp.keys))
+			if agg.key.Tid != types.IntID && agg.key.Tid != types.FloatID {
+				return errors.Errorf("Only numeric aggregates can be accumulated with "+
+					"cumulative, but %s is of type %s", name, agg.key.Tid.Name())
 			}
-			uidVal := grp.keys[0].key.Value
-			uid, ok := uidVal.(uint64)
+			attr := grp.keys[0].attr
+			total, ok := totals[attr]
 			if !ok {
-				return errors.Errorf("Vars can be assigned only when grouped by UID attribute")
+				total = types.Val{Tid: types.IntID, Value: int64(0)}
+			}
+			total = addNumbers(total, agg.key)
+			totals[attr] = total
+			grp.aggregates = append(grp.aggregates, groupPair{
+				attr: name + "_cumulative",
+				key:  total,
+			})
+			break
+		}
+	}
+	return nil
+}
+
+// coverageEpsilon is the rounding error allowed when comparing the share covered by the groups
+// with the coverage, so that e.g. groups covering 80 out of 100 nodes cover 0.8.
+const coverageEpsilon = 1e-9
+
+// cover keeps the fewest groups that cover the given share of the total, e.g. 0.8 for the
+// "vital few" groups that make up 80% of it, as in a Pareto analysis. The share of a group is
+// its number of nodes, or its value of the aggregate with the given name if it's set. The
+// groups are ordered by their shares in descending order, ties broken by their keys, and kept
+// until their running total reaches the coverage. Each of them gets a coverage aggregate
+// holding the share of the total covered by it and the ones before it. The groups that don't
+// add to the total, including those without a value for the aggregate, are never kept.
+func (res *groupResults) cover(coverage float64, name string) error {
+	shares := make(map[*groupResult]float64, len(res.group))
+	var total float64
+	for _, grp := range res.group {
+		share := float64(len(grp.uids))
+		if name != "" {
+			share = 0
+			for _, agg := range grp.aggregates {
+				if agg.attr != name {
+					continue
+				}
+				switch agg.key.Tid {
+				case types.IntID, types.FloatID:
+					share = asFloat(agg.key)
+				default:
+					return errors.Errorf("Only numeric aggregates can measure the coverage, "+
+						"but %s is of type %s", name, agg.key.Tid.Name())
+				}
+				if share < 0 {
+					return errors.Errorf("The coverage can't be measured by %s, which is "+
+						"negative for a group: %v", name, share)
+				}
+				break
+			}
+		}
+		shares[grp] = share
+		total += share
+	}
+
+	sort.SliceStable(res.group, func(i, j int) bool {
+		a, b := res.group[i], res.group[j]
+		if shares[a] != shares[b] {
+			return shares[a] > shares[b]
+		}
+		return compareGroupKeyOrder(a.keys, b.keys) < 0
+	})
+	var covered float64
+	kept := res.group[:0]
+	for _, grp := range res.group {
+		if covered >= coverage-coverageEpsilon || shares[grp] == 0 {
+			break
+		}
+		covered += shares[grp] / total
+		grp.aggregates = append(grp.aggregates, groupPair{
+			attr: "coverage",
+			key:  types.Val{Tid: types.FloatID, Value: covered},
+		})
+		kept = append(kept, grp)
+	}
+	res.group = kept
+	return nil
+}
+
+// addNumbers returns the sum of the int or float values a and b. The sum of two ints is an int
+// unless it overflows, in which case it's a float like the other sums.
+func addNumbers(a, b types.Val) types.Val {
+	if a.Tid == types.IntID && b.Tid == types.IntID {
+		ia, ib := a.Value.(int64), b.Value.(int64)
+		if s := ia + ib; (s > ia) == (ib > 0) {
+			return types.Val{Tid: types.IntID, Value: s}
+		}
+	}
+	return types.Val{Tid: types.FloatID, Value: asFloat(a) + asFloat(b)}
+}
+
+// summarize computes metrics across the groups, taking the number of nodes in each group as
+// its size: the number of groups, their average, smallest and largest sizes, and the number
+// of large groups, which have more than larger nodes, if larger is set. The groups formed
+// from different predicates by expand(_all_) are all summarized together.
+func (res *groupResults) summarize(larger int) {
+	if len(res.group) == 0 {
+		return
+	}
+	var total, minSize, maxSize, large int
+	for i, grp := range res.group {
+		size := len(grp.uids)
+		total += size
+		if i == 0 || size < minSize {
+			minSize = size
+		}
+		if size > maxSize {
+			maxSize = size
+		}
+		if larger > 0 && size > larger {
+			large++
+		}
+	}
+	intVal := func(n int) types.Val { return types.Val{Tid: types.IntID, Value: int64(n)} }
+	res.summary = []groupPair{
+		{attr: "groups", key: intVal(len(res.group))},
+		{attr: "avgSize", key: types.Val{Tid: types.FloatID,
+			Value: float64(total) / float64(len(res.group))}},
+		{attr: "minSize", key: intVal(minSize)},
+		{attr: "maxSize", key: intVal(maxSize)},
+	}
+	if larger > 0 {
+		res.summary = append(res.summary, groupPair{attr: "largeGroups", key: intVal(large)})
+	}
+}
+
+// addPercents adds a percent aggregate to every group, holding the percentage of the grouped
+// nodes that are in it. A node in several groups, as when grouping by a uid predicate, counts
+// once for each of them, so that the percentages add up to 100. The groups formed from
+// different predicates by expand(_all_) add up to 100 for each predicate.
+func (res *groupResults) addPercents() {
+	totals := make(map[string]int)
+	for _, grp := range res.group {
+		totals[grp.keys[0].attr] += len(grp.uids)
+	}
+	for _, grp := range res.group {
+		percent := 100 * float64(len(grp.uids)) / float64(totals[grp.keys[0].attr])
+		grp.aggregates = append(grp.aggregates, groupPair{
+			attr: "percent",
+			key:  types.Val{Tid: types.FloatID, Value: percent},
+		})
+	}
+}
+
+// This function is to use the fillVars. It is similar to formResult, the only difference being
+// that it considers the whole uidMatrix to do the grouping before assigning the variable.
+// TODO - Check if we can reduce this duplication.
+func (sg *SubGraph) fillGroupedVars(doneVars map[string]varValue, path []*SubGraph) error {
+	var childHasVar bool
+	for _, child := range sg.Children {
+		if child.Params.Var != "" {
+			childHasVar = true
+			break
+		}
+	}
+
+	if !childHasVar {
+		return nil
+	}
+
+	// The variables are keyed by the uids of the last uid attribute the nodes are grouped by.
+	var pathNode *SubGraph
+	for _, child := range sg.Children {
+		if child.Params.IgnoreResult && !child.Params.GroupbyCompareRight &&
+			sg.groupKeyKind(child) == groupKeyUid {
+			pathNode = child
+		}
+	}
+	dedupMap, err := sg.groupKeys(nil)
+	if err != nil {
+		return err
+	}
+	if err := checkGroupEstimate(dedupMap.estimateGroups(false)); err != nil {
+		return err
+	}
+
+	// Create all the groups here.
+	res := new(groupResults)
+	res.formGroups(dedupMap, &pb.List{}, []groupPair{})
+	rank := sg.facetRanks(sg.uidMatrix)
+	for _, grp := range res.group {
+		grp.rank = rank
+	}
+
+	// Each of the aggregates can be assigned to a variable, e.g. cnt as count(uid) and
+	// total as sum(price), which are all keyed by the uids the nodes are grouped by. The
+	// paths are copied since the caller keeps changing the one it passes in.
+	var groupUids []uint64
+	varPath := append(path[:0:0], path...)
+	varPath = append(varPath, pathNode)
+	topkPath := append(path[:0:0], path...)
+	topkPath = append(topkPath, sg)
+
+	// Go over the groups and aggregate the values. The values buffered by the aggregators
+	// of all the groups count towards the same limit.
+	budget := &bufferBudget{limit: x.Config.AggregateBufferLimit}
+	if err := sg.aggregateChildren(res, budget); err != nil {
+		return err
+	}
+	for _, child := range sg.Children {
+		if child.Params.IgnoreResult || child.Params.Var == "" {
+			continue
+		}
+		chVar := child.Params.Var
+		if child.SrcFunc != nil && isTopkFn(child.SrcFunc.Name) {
+			// The variable holds the uids returned by topk for all the groups.
+			lists := make([]*pb.List, 0, len(res.group))
+			for _, grp := range res.group {
+				if agg, ok := grp.aggregateOf(child); ok {
+					uids := append([]uint64(nil), agg.uids...)
+					sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+					lists = append(lists, &pb.List{Uids: uids})
+				}
 			}
-			// grp.aggregates could be empty if schema conversion failed during aggregation
-			if len(grp.aggregates) > 0 {
-				tempMap[uid] = grp.aggregates[len(grp.aggregates)-1].key
+			doneVars[chVar] = varValue{
+				Uids: algo.MergeSorted(lists),
+				path: topkPath,
+				Vals: make(map[uint64]types.Val),
+			}
+			continue
+		}
+
+		if groupUids == nil {
+			var err error
+			if groupUids, err = res.groupVarUids(); err != nil {
+				return err
+			}
+		}
+		tempMap := make(map[uint64]types.Val)
+		for i, grp := range res.group {
+			if len(grp.keys) == 0 {
+				continue
+			}
+			// The aggregate of the child could be missing if schema conversion failed
+			// during aggregation.
+			if agg, ok := grp.aggregateOf(child); ok {
+				tempMap[groupUids[i]] = agg.key
 			}
 		}
 		doneVars[chVar] = varValue{
 			Vals: tempMap,
-			path: append(path, pathNode),
+			path: varPath,
 		}
 	}
 	return nil
 }
 
-func (sg *SubGraph) processGroupBy(doneVars map[string]varValue, path []*SubGraph) error {
+// groupVarUids returns the uid of each of the groups, which the values of the variables
+// assigned in the groupby are keyed by. The groups must be grouped by a single uid attribute.
+// The groups without any key get no uid.
+func (res *groupResults) groupVarUids() ([]uint64, error) {
+	uids := make([]uint64, len(res.group))
+	for i, grp := range res.group {
+		if len(grp.keys) == 0 {
+			continue
+		}
+		if len(grp.keys) > 1 {
+			return nil, errors.Errorf("Expected one UID for var in groupby but got: %d",
+				len(grp.keys))
+		}
+		uid, ok := grp.keys[0].key.Value.(uint64)
+		if !ok {
+			return nil, errors.Errorf("Vars can be assigned only when grouped by UID attribute")
+		}
+		uids[i] = uid
+	}
+	return uids, nil
+}
+
+func (sg *SubGraph) processGroupBy(ctx context.Context, doneVars map[string]varValue,
+	path []*SubGraph) error {
+	span := otrace.FromContext(ctx)
+	stop := x.SpanTimer(span, "query.processGroupBy: "+sg.Attr)
+	defer stop()
+
+	if err := sg.fillGroupbyVals(doneVars); err != nil {
+		return err
+	}
+	if err := sg.evalGroupbyMath(doneVars, path); err != nil {
+		return err
+	}
+
+	// Estimate the number of groups before forming any of them, so that a groupby over keys
+	// with a high cardinality fails early instead of exhausting the memory of the alpha.
+	plan := sg.groupByPlan()
+	estimates := make([]int, 0, len(sg.uidMatrix))
+	keys := make([]dedup, 0, len(sg.uidMatrix))
 	for _, ul := range sg.uidMatrix {
 		// We need to process groupby for each list as grouping needs to happen for each path of the
 		// tree.
+		d, err := sg.groupKeys(ul)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, d)
+		estimate := d.estimateGroups(sg.isGroupbyExpand())
+		estimates = append(estimates, estimate)
+		plan.uids += len(ul.GetUids())
+		plan.estimatedGroups += estimate
+	}
+	if err := checkGroupEstimate(plan.estimatedGroups); err != nil {
+		return err
+	}
+	plan.cardinalities = keyCardinalities(keys)
 
-		r, err := sg.formResult(ul)
+	if sg.Params.Groupby.Combine && len(keys) > 1 {
+		// The nodes of all the lists form a single set of groups, which every list gets.
+		r, err := sg.formResult(mergeDedups(keys, sg.groupKeyAttrs()),
+			sg.facetRanks(sg.uidMatrix))
 		if err != nil {
 			return err
 		}
-		sg.GroupbyRes = append(sg.GroupbyRes, r)
+		for range keys {
+			sg.GroupbyRes = append(sg.GroupbyRes, r)
+		}
+		plan.groups = len(r.group)
+		if sg.Params.Groupby.Explain {
+			r.plan = plan.values()
+		}
+	} else {
+		for i, d := range keys {
+			r, err := sg.formResult(d, sg.facetRanks(sg.uidMatrix[i:i+1]))
+			if err != nil {
+				return err
+			}
+			sg.GroupbyRes = append(sg.GroupbyRes, r)
+			plan.groups += len(r.group)
+			if sg.Params.Groupby.Explain {
+				// Each list gets the plan of its own groups.
+				listPlan := plan
+				listPlan.uids = len(sg.uidMatrix[i].GetUids())
+				listPlan.estimatedGroups = estimates[i]
+				listPlan.groups = len(r.group)
+				listPlan.cardinalities = keyCardinalities(keys[i : i+1])
+				r.plan = listPlan.values()
+			}
+		}
+	}
+	if span != nil {
+		span.Annotate(plan.attributes(), "Groupby plan")
 	}
 
 	if err := sg.fillGroupedVars(doneVars, path); err != nil {
@@ -390,38 +2558,97 @@ func (sg *SubGraph) processGroupBy(doneVars map[string]varValue, path []*SubGrap
 	return nil
 }
 
-func groupLess(a, b *groupResult) bool {
-	switch {
-	case len(a.uids) < len(b.uids):
-		return true
-	case len(a.uids) != len(b.uids):
-		return false
+// keyCardinalities returns the number of distinct keys of each grouping attribute, e.g.
+// "name: 4, age: 2", in the order of the attributes. The groups are formed from every
+// combination of the keys, so this shows which attribute makes the number of groups explode.
+// With several uid lists, the largest number of keys of the attribute in any of them is used.
+func keyCardinalities(keys []dedup) string {
+	var attrs []string
+	cardinalities := make(map[string]int)
+	for _, d := range keys {
+		for _, group := range d.groups {
+			n, ok := cardinalities[group.attr]
+			if !ok {
+				attrs = append(attrs, group.attr)
+			}
+			if len(group.elements) > n {
+				cardinalities[group.attr] = len(group.elements)
+			}
+		}
 	}
-	switch {
-	case len(a.keys) < len(b.keys):
-		return true
-	case len(a.keys) != len(b.keys):
-		return false
+	parts := make([]string, 0, len(attrs))
+	for _, attr := range attrs {
+		parts = append(parts, fmt.Sprintf("%s: %d", attr, cardinalities[attr]))
 	}
-	switch {
-	case len(a.aggregates) < len(b.aggregates):
-		return true
-	case len(a.aggregates) != len(b.aggregates):
-		return false
+	return strings.Join(parts, ", ")
+}
+
+// groupbyPlan describes how a groupby was processed: the grouping keys, the aggregates
+// computed for each group, the number of uids that were grouped, the number of groups
+// estimated before forming them, the number of groups returned and the number of distinct keys
+// of each grouping attribute. It's annotated on the trace of the query, and returned along
+// with the groups if the explain option is set.
+type groupbyPlan struct {
+	keys            []string
+	aggregates      []string
+	uids            int
+	estimatedGroups int
+	groups          int
+	cardinalities   string
+}
+
+// attributes returns the plan as the attributes of a trace annotation.
+func (p groupbyPlan) attributes() []otrace.Attribute {
+	return []otrace.Attribute{
+		otrace.StringAttribute("keys", strings.Join(p.keys, ", ")),
+		otrace.StringAttribute("aggregates", strings.Join(p.aggregates, ", ")),
+		otrace.Int64Attribute("uids", int64(p.uids)),
+		otrace.Int64Attribute("estimated_groups", int64(p.estimatedGroups)),
+		otrace.Int64Attribute("groups", int64(p.groups)),
+		otrace.StringAttribute("key_cardinalities", p.cardinalities),
 	}
+}
 
-	for i := range a.keys {
-		l, err := types.Less(a.keys[i].key, b.keys[i].key)
-		if err == nil {
-			if l {
-				return l
-			}
-			l, _ = types.Less(b.keys[i].key, a.keys[i].key)
-			if l {
-				return !l
-			}
+// values returns the plan as the values of the object returned next to the groups.
+func (p groupbyPlan) values() []groupPair {
+	strVal := func(s string) types.Val { return types.Val{Tid: types.StringID, Value: s} }
+	intVal := func(n int) types.Val { return types.Val{Tid: types.IntID, Value: int64(n)} }
+	return []groupPair{
+		{attr: "keys", key: strVal(strings.Join(p.keys, ", "))},
+		{attr: "aggregates", key: strVal(strings.Join(p.aggregates, ", "))},
+		{attr: "uids", key: intVal(p.uids)},
+		{attr: "estimatedGroups", key: intVal(p.estimatedGroups)},
+		{attr: "groups", key: intVal(p.groups)},
+		{attr: "keyCardinalities", key: strVal(p.cardinalities)},
+	}
+}
+
+// groupByPlan returns the plan of the groupby with its grouping keys and aggregates, to which
+// the numbers of uids and groups are added as they're processed.
+func (sg *SubGraph) groupByPlan() groupbyPlan {
+	var keys, aggregates []string
+	for _, child := range sg.Children {
+		switch {
+		case child.Params.GroupbyCompareRight:
+		case child.Params.GroupbyCompare != nil:
+			keys = append(keys, child.Params.Alias)
+		case child.Params.IgnoreResult:
+			keys = append(keys, child.Attr)
+		case child.Params.DoCount:
+			aggregates = append(aggregates, fmt.Sprintf("count(%s)", child.Attr))
+		case child.SrcFunc != nil:
+			aggregates = append(aggregates, aggregateFunc(child))
 		}
 	}
+	return groupbyPlan{keys: keys, aggregates: aggregates}
+}
+
+// groupLess orders the groups in the results of a groupby, as by compareGroupOrder and then by
+// their aggregates.
+func groupLess(a, b *groupResult) bool {
+	if c := compareGroupOrder(a, b); c != 0 {
+		return c < 0
+	}
 
 	for i := range a.aggregates {
 		if l, err := types.Less(a.aggregates[i].key, b.aggregates[i].key); err == nil {
@@ -436,3 +2663,269 @@ func groupLess(a, b *groupResult) bool {
 	}
 	return false
 }
+
+// compareGroupKeys compares the keys of two groups, which must have as many keys, one key
+// after the other. It returns a negative number if a is ordered before b, a positive one if
+// it's ordered after b and zero otherwise.
+func compareGroupKeys(a, b []groupPair) int {
+	for i := range a {
+		ak, bk := a[i].key, b[i].key
+		if ak.Tid == types.BoolID && bk.Tid == types.BoolID && ak.Value != bk.Value {
+			// Bools can't be compared by types.Less. Order false before true.
+			if !ak.Value.(bool) {
+				return -1
+			}
+			return 1
+		}
+		if l, err := types.Less(ak, bk); err == nil {
+			if l {
+				return -1
+			}
+			if l, _ = types.Less(bk, ak); l {
+				return 1
+			}
+		}
+		if ak.Tid == types.DateTimeID && bk.Tid == types.DateTimeID {
+			// The same instant in different time zones is ordered by the offset, from west
+			// to east.
+			_, aOffset := ak.Value.(time.Time).Zone()
+			_, bOffset := bk.Value.(time.Time).Zone()
+			if aOffset != bOffset {
+				return aOffset - bOffset
+			}
+		}
+		if a[i].lang != b[i].lang {
+			return strings.Compare(a[i].lang, b[i].lang)
+		}
+	}
+	return 0
+}
+
+// GroupbyAggregate is an aggregate computed for every group of a query built by
+// NewGroupbyQuery.
+type GroupbyAggregate struct {
+	// Func is the name of the aggregator, e.g. "max", or "count" to count the nodes in the group.
+	Func string
+	// Attr is the predicate the aggregator is applied to. It's ignored by count.
+	Attr string
+	// Langs holds the languages of the values the aggregator is applied to.
+	Langs []string
+	// Args holds the extra arguments of the aggregator, e.g. the separator of groupconcat.
+	Args []string
+	// Alias is the name of the aggregate in the results. If it's empty, the aggregate is named
+	// like in a DQL query, e.g. max(age) or count.
+	Alias string
+}
+
+// NewGroupbyQuery builds the query of a block named name that groups the nodes with the given
+// uids by attrs and computes aggs for each group. It's the same query as the DQL block
+// name(func: uid(uids)) @groupby(attrs) { aggs }. The query can be converted with ToSubGraph,
+// and the groups read from the processed SubGraph with GroupRows, or run with RunGroupby.
+func NewGroupbyQuery(name string, uids []uint64, attrs []gql.GroupByAttr,
+	aggs []GroupbyAggregate) (*gql.GraphQuery, error) {
+	if len(uids) == 0 {
+		return nil, errors.Errorf("Expected atleast one uid to group")
+	}
+	if len(attrs) == 0 {
+		return nil, errors.Errorf("Expected atleast one attribute in groupby")
+	}
+
+	gq := &gql.GraphQuery{
+		UID:          uids,
+		Alias:        name,
+		IsGroupby:    true,
+		Func:         &gql.Function{Name: "uid"},
+		Args:         make(map[string]string),
+		GroupbyAttrs: attrs,
+	}
+	for _, agg := range aggs {
+		child := &gql.GraphQuery{
+			Alias: agg.Alias,
+			Args:  make(map[string]string),
+		}
+		switch {
+		case agg.Func == "count":
+			if agg.Attr != "" && agg.Attr != "uid" {
+				return nil, errors.Errorf("Only uid predicate is allowed in count within groupby")
+			}
+			child.Attr = "uid"
+			child.IsCount = true
+		case isAggregatorFn(agg.Func):
+			if agg.Attr == "" {
+				return nil, errors.Errorf("Expected a predicate for aggregator %s", agg.Func)
+			}
+			child.Attr = agg.Attr
+			child.Langs = agg.Langs
+			child.Func = &gql.Function{Name: agg.Func}
+			for _, arg := range agg.Args {
+				child.Func.Args = append(child.Func.Args, gql.Arg{Value: arg})
+			}
+		default:
+			return nil, errors.Errorf("Only aggregator/count functions allowed inside @groupby. "+
+				"Got: %v", agg.Func)
+		}
+		gq.Children = append(gq.Children, child)
+	}
+	return gq, nil
+}
+
+// GroupValue is the value of a key or an aggregate of a group.
+type GroupValue struct {
+	// Name is the name of the attribute or the aggregate, i.e. its alias if it has one.
+	Name string
+	// Lang is the language of the value of a key when grouping by all the languages of a
+	// predicate. The key is named Name@Lang in the JSON results.
+	Lang  string
+	Value types.Val
+	// Uids holds the uids returned by a topk aggregate, best first.
+	Uids []uint64
+	// Values holds the values returned by a distinctvalues aggregate.
+	Values []types.Val
+	// Truncated is true if a distinctvalues aggregate found more distinct values than the
+	// ones in Values.
+	Truncated bool
+	// Quantiles holds the quantiles estimated by a tdigest aggregate.
+	Quantiles []GroupQuantile
+}
+
+// GroupQuantile is a quantile estimated by a tdigest aggregate.
+type GroupQuantile struct {
+	// Name is the name of the quantile in the JSON results, e.g. p99 for the 0.99 quantile.
+	// It's appended to the name of the aggregate, as in tdigest(latency)_p99.
+	Name     string
+	Quantile float64
+	Value    types.Val
+}
+
+// GroupRow is a group formed by a groupby.
+type GroupRow struct {
+	// Keys holds the values the group was formed from, in the order of the groupby attributes.
+	Keys []GroupValue
+	// Aggregates holds the aggregates computed for the group, in the order of the block.
+	Aggregates []GroupValue
+	// Uids holds the uids of the nodes in the group.
+	Uids []uint64
+	// ID is the deterministic id of the group derived from its keys. It's only set if the
+	// groupby has groupId: true.
+	ID string
+}
+
+// Key returns the value of the key with the given name.
+func (row *GroupRow) Key(name string) (types.Val, bool) {
+	return findGroupValue(row.Keys, name)
+}
+
+// Aggregate returns the value of the aggregate with the given name.
+func (row *GroupRow) Aggregate(name string) (types.Val, bool) {
+	return findGroupValue(row.Aggregates, name)
+}
+
+func findGroupValue(vals []GroupValue, name string) (types.Val, bool) {
+	for _, val := range vals {
+		if val.Name == name {
+			return val.Value, true
+		}
+	}
+	return types.Val{}, false
+}
+
+// GroupRows returns the groups formed by a processed groupby SubGraph, in the order they are
+// returned in the JSON results. There's a list of groups for each of the uid lists of the
+// SubGraph. A groupby at the root of a query has a single uid list.
+func (sg *SubGraph) GroupRows() ([][]GroupRow, error) {
+	if !sg.IsGroupBy() {
+		return nil, errors.Errorf("%s is not a groupby", sg.fieldName())
+	}
+
+	toGroupValues := func(pairs []groupPair) []GroupValue {
+		vals := make([]GroupValue, 0, len(pairs))
+		for _, pair := range pairs {
+			vals = append(vals, GroupValue{Name: pair.attr, Lang: pair.lang, Value: pair.key,
+				Uids: pair.uids, Values: pair.vals, Truncated: pair.truncated,
+				Quantiles: pair.quantiles})
+		}
+		return vals
+	}
+
+	rows := make([][]GroupRow, 0, len(sg.GroupbyRes))
+	for _, res := range sg.GroupbyRes {
+		groups := make([]GroupRow, 0, len(res.group))
+		for _, grp := range res.group {
+			groups = append(groups, GroupRow{
+				Keys:       toGroupValues(grp.keys),
+				Aggregates: toGroupValues(grp.aggregates),
+				Uids:       append([]uint64(nil), grp.uids...),
+				ID:         grp.id,
+			})
+		}
+		rows = append(rows, groups)
+	}
+	return rows, nil
+}
+
+// RunGroupby runs the groupby SubGraph sg over the nodes with the given uids at readTs and
+// returns their groups, in the order they are returned in the JSON results. It's meant for
+// embedding the query package, e.g. with a SubGraph built by ToSubGraph from the query of
+// NewGroupbyQuery, without going through a Request. The uids replace the ones of the root
+// function of sg. Since the groupby runs on its own, it can't use variables defined in other
+// blocks.
+func RunGroupby(ctx context.Context, sg *SubGraph, uids []uint64,
+	readTs uint64) ([]GroupRow, error) {
+	if !sg.IsGroupBy() {
+		return nil, errors.Errorf("%s is not a groupby", sg.fieldName())
+	}
+	if len(uids) == 0 {
+		return nil, errors.Errorf("Expected atleast one uid to group")
+	}
+	var needsVar []string
+	var addMathVars func(mt *gql.MathTree)
+	addMathVars = func(mt *gql.MathTree) {
+		if mt.Var != "" {
+			needsVar = append(needsVar, mt.Var)
+		}
+		for _, ch := range mt.Child {
+			addMathVars(ch)
+		}
+	}
+	for _, attr := range sg.Params.GroupbyAttrs {
+		if attr.ValueVar != "" {
+			needsVar = append(needsVar, attr.ValueVar)
+		}
+		if attr.MathExp != nil {
+			addMathVars(attr.MathExp)
+		}
+	}
+	sg.recurse(func(sg *SubGraph) {
+		for _, v := range sg.Params.NeedsVar {
+			needsVar = append(needsVar, v.Name)
+		}
+	})
+	if len(needsVar) > 0 {
+		return nil, errors.Errorf("Variables can't be used by a groupby run on its own. Got: %v",
+			needsVar)
+	}
+
+	sg.SrcFunc = &Function{Name: "uid"}
+	if err := sg.populate(append(uids[:0:0], uids...)); err != nil {
+		return nil, err
+	}
+	sg.GroupbyRes = nil
+	sg.recurse(func(sg *SubGraph) {
+		sg.ReadTs = readTs
+	})
+
+	rch := make(chan error, 1)
+	ProcessGraph(ctx, sg, nil, rch)
+	if err := <-rch; err != nil {
+		return nil, err
+	}
+	if err := sg.populatePostAggregation(ctx, make(map[string]varValue),
+		[]*SubGraph{}, nil); err != nil {
+		return nil, err
+	}
+	rows, err := sg.GroupRows()
+	if err != nil {
+		return nil, err
+	}
+	return rows[0], nil
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package query
+
+import (
+	"math"
+	"math/bits"
+
+	farm "github.com/dgryski/go-farm"
+)
+
+// hllPrecision is the number of bits of the hash that pick the register of a value. With
+// 2^12 registers, the standard error of the estimates is about 1.6%.
+const hllPrecision = 12
+
+// hyperLogLog estimates the number of distinct values of a stream from the longest runs of
+// leading zeros in their hashes. It takes a fixed 4KiB of memory, whatever the number of
+// values. See http://algo.inria.fr/flajolet/Publications/FlFuGaMe07.pdf.
+type hyperLogLog struct {
+	registers []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{registers: make([]uint8, 1<<hllPrecision)}
+}
+
+// add adds the value with the given key.
+func (h *hyperLogLog) add(key []byte) {
+	hash := farm.Fingerprint64(key)
+	idx := hash >> (64 - hllPrecision)
+	// The bit set after the remaining bits bounds the run of zeros if they are all zero.
+	rank := uint8(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+// estimate returns the estimated number of distinct values added.
+func (h *hyperLogLog) estimate() uint64 {
+	m := float64(len(h.registers))
+	var sum float64
+	var zeros int
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	est := alpha * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		// Few registers are set, so linear counting is more accurate.
+		est = m * math.Log(m/float64(zeros))
+	}
+	return uint64(math.Round(est))
+}
@@ -0,0 +1,48 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package query
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHyperLogLogSmall(t *testing.T) {
+	h := newHyperLogLog()
+	require.Equal(t, uint64(0), h.estimate())
+
+	// Few values are counted exactly, and adding a value again doesn't change the count.
+	for i := 0; i < 10; i++ {
+		h.add([]byte(strconv.Itoa(i)))
+		h.add([]byte(strconv.Itoa(i)))
+	}
+	require.Equal(t, uint64(10), h.estimate())
+}
+
+func TestHyperLogLogLarge(t *testing.T) {
+	for _, n := range []int{1000, 50000, 1000000} {
+		h := newHyperLogLog()
+		for i := 0; i < n; i++ {
+			h.add([]byte(strconv.Itoa(i)))
+		}
+		// The standard error is about 1.6%, so the estimates should be well within 5%.
+		require.InEpsilon(t, n, h.estimate(), 0.05, "%d values", n)
+		require.Len(t, h.registers, 1<<hllPrecision)
+	}
+}
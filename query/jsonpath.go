@@ -0,0 +1,147 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package query
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/dgraph-io/dgraph/types"
+)
+
+// jsonPathStep is a step of a JSON path. It selects either a field of an object or an element
+// of an array.
+type jsonPathStep struct {
+	field string
+	// index is the index of the element selected, if isIndex is true.
+	index   int
+	isIndex bool
+}
+
+// jsonPath is a parsed JSON path, like $.address.city, $.tags[0] or $['first name']. Only the
+// paths that select a single value are supported, so there are no wildcards, slices or filters.
+type jsonPath struct {
+	path  string
+	steps []jsonPathStep
+}
+
+// parseJSONPath parses the given JSON path.
+func parseJSONPath(path string) (*jsonPath, error) {
+	invalid := func(format string, args ...interface{}) error {
+		return errors.Errorf("Invalid JSON path %q: %s", path, fmt.Sprintf(format, args...))
+	}
+	if !strings.HasPrefix(path, "$") {
+		return nil, invalid("it must start with $")
+	}
+
+	jp := &jsonPath{path: path}
+	rest := path[1:]
+	for len(rest) > 0 {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, invalid("expected a field name after .")
+			}
+			jp.steps = append(jp.steps, jsonPathStep{field: rest[:end]})
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, invalid("unclosed [")
+			}
+			inside := rest[1:end]
+			if len(inside) >= 2 && (inside[0] == '\'' || inside[0] == '"') &&
+				inside[len(inside)-1] == inside[0] {
+				jp.steps = append(jp.steps, jsonPathStep{field: inside[1 : len(inside)-1]})
+			} else {
+				index, err := strconv.Atoi(inside)
+				if err != nil || index < 0 {
+					return nil, invalid("expected an index or a quoted field name inside [] "+
+						"but got: %s", inside)
+				}
+				jp.steps = append(jp.steps, jsonPathStep{index: index, isIndex: true})
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, invalid("expected . or [ but got: %c", rest[0])
+		}
+	}
+	return jp, nil
+}
+
+// extract returns the value at the path in the given JSON. Strings, numbers and booleans are
+// returned as string, int or float, and bool values. It returns false if there's no value at
+// the path or if the value is null, an object or an array, and an error if data isn't valid
+// JSON.
+func (jp *jsonPath) extract(data []byte) (types.Val, bool, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return types.Val{}, false, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return types.Val{}, false, errors.Errorf("unexpected data after the JSON value")
+	}
+
+	for _, step := range jp.steps {
+		if step.isIndex {
+			arr, ok := v.([]interface{})
+			if !ok || step.index >= len(arr) {
+				return types.Val{}, false, nil
+			}
+			v = arr[step.index]
+			continue
+		}
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return types.Val{}, false, nil
+		}
+		if v, ok = obj[step.field]; !ok {
+			return types.Val{}, false, nil
+		}
+	}
+
+	switch v := v.(type) {
+	case string:
+		return types.Val{Tid: types.StringID, Value: v}, true, nil
+	case bool:
+		return types.Val{Tid: types.BoolID, Value: v}, true, nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return types.Val{Tid: types.IntID, Value: i}, true, nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return types.Val{}, false, nil
+		}
+		return types.Val{Tid: types.FloatID, Value: f}, true, nil
+	default:
+		return types.Val{}, false, nil
+	}
+}
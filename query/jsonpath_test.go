@@ -0,0 +1,129 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package query
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dgraph-io/dgraph/protos/pb"
+	"github.com/dgraph-io/dgraph/task"
+	"github.com/dgraph-io/dgraph/types"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	jp, err := parseJSONPath(`$.address.tags[1]['first name']["x.y"]`)
+	require.NoError(t, err)
+	require.Equal(t, []jsonPathStep{
+		{field: "address"},
+		{field: "tags"},
+		{index: 1, isIndex: true},
+		{field: "first name"},
+		{field: "x.y"},
+	}, jp.steps)
+
+	jp, err = parseJSONPath("$")
+	require.NoError(t, err)
+	require.Empty(t, jp.steps)
+
+	for _, path := range []string{"", "region", "$.", "$..a", "$[0", "$[-1]", "$[*]", "$a"} {
+		_, err := parseJSONPath(path)
+		require.Error(t, err, path)
+		require.Contains(t, err.Error(), "Invalid JSON path", path)
+	}
+}
+
+func TestJSONPathExtract(t *testing.T) {
+	data := []byte(`{"region": "eu", "size": 3, "ratio": 0.5, "beta": true, "none": null,
+		"tags": ["a", "b"], "geo": {"zone": 7}}`)
+	for _, tc := range []struct {
+		path string
+		want types.Val
+		ok   bool
+	}{
+		{"$.region", types.Val{Tid: types.StringID, Value: "eu"}, true},
+		{"$.size", types.Val{Tid: types.IntID, Value: int64(3)}, true},
+		{"$.ratio", types.Val{Tid: types.FloatID, Value: 0.5}, true},
+		{"$.beta", types.Val{Tid: types.BoolID, Value: true}, true},
+		{"$.tags[1]", types.Val{Tid: types.StringID, Value: "b"}, true},
+		{"$.geo.zone", types.Val{Tid: types.IntID, Value: int64(7)}, true},
+		{"$['region']", types.Val{Tid: types.StringID, Value: "eu"}, true},
+		// Missing values, nulls, objects and arrays aren't returned.
+		{"$.missing", types.Val{}, false},
+		{"$.tags[2]", types.Val{}, false},
+		{"$.region.x", types.Val{}, false},
+		{"$.none", types.Val{}, false},
+		{"$.geo", types.Val{}, false},
+		{"$.tags", types.Val{}, false},
+	} {
+		jp, err := parseJSONPath(tc.path)
+		require.NoError(t, err)
+		val, ok, err := jp.extract(data)
+		require.NoError(t, err, tc.path)
+		require.Equal(t, tc.ok, ok, tc.path)
+		require.Equal(t, tc.want, val, tc.path)
+	}
+
+	jp, err := parseJSONPath("$.region")
+	require.NoError(t, err)
+	for _, data := range []string{"eu", `{"region": "eu"`, `{"region": "eu"} {}`} {
+		_, _, err = jp.extract([]byte(data))
+		require.Error(t, err, data)
+	}
+}
+
+func TestAddJSONPathValues(t *testing.T) {
+	jp, err := parseJSONPath("$.region")
+	require.NoError(t, err)
+	child := &SubGraph{
+		Attr:    "meta",
+		SrcUIDs: &pb.List{Uids: []uint64{1, 2, 3, 4, 5}},
+		valueMatrix: []*pb.ValueList{
+			{Values: []*pb.TaskValue{task.FromString(`{"region": "eu"}`)}},
+			{Values: []*pb.TaskValue{task.FromString(`{"region": "us"}`)}},
+			{Values: []*pb.TaskValue{task.FromString(`{"zone": 7}`)}},
+			{Values: []*pb.TaskValue{task.FromString(`not json`)}},
+			{Values: []*pb.TaskValue{task.FromString(`{"region": "eu"}`)}},
+		},
+		Params: params{GroupbyJSONPath: jp},
+	}
+
+	// The nodes without a value at the path or with a value that isn't JSON are skipped.
+	var d dedup
+	for i := range child.valueMatrix {
+		require.NoError(t, d.addJSONPathValues("region", child, i))
+	}
+	res := new(groupResults)
+	res.formGroups(d, &pb.List{}, []groupPair{})
+	sort.Slice(res.group, func(i, j int) bool {
+		return groupLess(res.group[i], res.group[j])
+	})
+	require.Len(t, res.group, 2)
+	require.Equal(t, types.Val{Tid: types.StringID, Value: "us"}, res.group[0].keys[0].key)
+	require.Equal(t, []uint64{2}, res.group[0].uids)
+	require.Equal(t, types.Val{Tid: types.StringID, Value: "eu"}, res.group[1].keys[0].key)
+	require.Equal(t, []uint64{1, 5}, res.group[1].uids)
+
+	// In strict mode, a value that isn't JSON fails the query.
+	child.Params.GroupbyJSONStrict = true
+	err = d.addJSONPathValues("region", child, 3)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "value of meta for uid 0x4 is not valid JSON")
+	require.NoError(t, d.addJSONPathValues("region", child, 2))
+}
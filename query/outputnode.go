@@ -718,21 +718,126 @@ func (sg *SubGraph) addGroupby(enc *encoder, fj fastJsonNode,
 	if len(res.group) == 0 {
 		return nil
 	}
-	g := enc.newNode(enc.idForAttr(fname))
-	for _, grp := range res.group {
-		uc := enc.newNode(enc.idForAttr("@groupby"))
+	addGroup := func(uc fastJsonNode, grp *groupResult) error {
+		if grp.id != "" {
+			id := types.Val{Tid: types.StringID, Value: grp.id}
+			if err := enc.AddValue(uc, enc.idForAttr("groupId"), id); err != nil {
+				return err
+			}
+		}
+		if sg.Params.Groupby.Members {
+			members, err := encodeGroupMembers(grp.uids)
+			if err != nil {
+				return err
+			}
+			val := types.Val{Tid: types.StringID, Value: members}
+			if err := enc.AddValue(uc, enc.idForAttr("@members"), val); err != nil {
+				return err
+			}
+		}
 		for _, it := range grp.keys {
-			if err := enc.AddValue(uc, enc.idForAttr(it.attr), it.key); err != nil {
+			attr := it.attr
+			if it.lang != "" {
+				attr += "@" + it.lang
+			}
+			if err := enc.AddValue(uc, enc.idForAttr(attr), it.key); err != nil {
 				return err
 			}
 		}
 		for _, it := range grp.aggregates {
+			if it.uids != nil {
+				// The uids returned by topk are added as a list of nodes, so that they
+				// look like the uids of any other uid predicate.
+				for _, uid := range it.uids {
+					n := enc.newNode(enc.idForAttr(it.attr))
+					if err := enc.SetUID(n, uid, enc.idForAttr("uid")); err != nil {
+						return err
+					}
+					enc.AddListChild(uc, n)
+				}
+				continue
+			}
+			if it.vals != nil {
+				// The values returned by distinctvalues are added as a list, along with
+				// whether some of them were left out.
+				for _, val := range it.vals {
+					if err := enc.AddListValue(uc, enc.idForAttr(it.attr), val, true); err != nil {
+						return err
+					}
+				}
+				truncated := types.Val{Tid: types.BoolID, Value: it.truncated}
+				if err := enc.AddValue(uc, enc.idForAttr(it.attr+"_truncated"),
+					truncated); err != nil {
+					return err
+				}
+				continue
+			}
+			if it.quantiles != nil {
+				// The quantiles estimated by tdigest are added as a value each, named after
+				// the aggregate and the quantile.
+				for _, q := range it.quantiles {
+					if err := enc.AddValue(uc, enc.idForAttr(it.attr+"_"+q.Name),
+						q.Value); err != nil {
+						return err
+					}
+				}
+				continue
+			}
 			if err := enc.AddValue(uc, enc.idForAttr(it.attr), it.key); err != nil {
 				return err
 			}
 		}
+		return nil
+	}
+
+	if sg.Params.Normalize {
+		// Each group is added as a row with its keys and aggregates, so that it's merged
+		// with the attributes of the parent when the parent is normalized.
+		for _, grp := range res.group {
+			uc := enc.newNode(enc.idForAttr(fname))
+			if err := addGroup(uc, grp); err != nil {
+				return err
+			}
+			enc.AddListChild(fj, uc)
+		}
+		return nil
+	}
+
+	g := enc.newNode(enc.idForAttr(fname))
+	for _, grp := range res.group {
+		uc := enc.newNode(enc.idForAttr("@groupby"))
+		if err := addGroup(uc, grp); err != nil {
+			return err
+		}
 		enc.AddListChild(g, uc)
 	}
+	if res.summary != nil {
+		// The metrics computed across the groups are added as an object next to them.
+		summary := enc.newNode(enc.idForAttr("@groupby_summary"))
+		for _, it := range res.summary {
+			if err := enc.AddValue(summary, enc.idForAttr(it.attr), it.key); err != nil {
+				return err
+			}
+		}
+		enc.AddMapChild(g, summary)
+	}
+	if res.plan != nil {
+		// The plan of the groupby is added as an object next to the groups, like the summary.
+		plan := enc.newNode(enc.idForAttr("@groupby_plan"))
+		for _, it := range res.plan {
+			if err := enc.AddValue(plan, enc.idForAttr(it.attr), it.key); err != nil {
+				return err
+			}
+		}
+		enc.AddMapChild(g, plan)
+	}
+	if res.next != "" {
+		// The token of the next page is returned along with the groups of this one.
+		next := types.Val{Tid: types.StringID, Value: res.next}
+		if err := enc.AddValue(g, enc.idForAttr("@groupby_next"), next); err != nil {
+			return err
+		}
+	}
 	enc.AddListChild(fj, g)
 	return nil
 }
@@ -96,6 +96,75 @@ func TestNormalizeJSONLimit(t *testing.T) {
 	require.Error(t, err, "Couldn't evaluate @normalize directive - too many results")
 }
 
+func TestNormalizeGroupby(t *testing.T) {
+	x.Config.NormalizeNodeLimit = 1e4
+
+	sg := &SubGraph{Params: params{IsGroupBy: true, Normalize: true}}
+	res := &groupResults{group: []*groupResult{
+		{
+			keys: []groupPair{{attr: "age", key: types.Val{Tid: types.IntID, Value: int64(17)}}},
+			aggregates: []groupPair{
+				{attr: "count", key: types.Val{Tid: types.IntID, Value: int64(1)}}},
+		},
+		{
+			keys: []groupPair{{attr: "age", key: types.Val{Tid: types.IntID, Value: int64(15)}}},
+			aggregates: []groupPair{
+				{attr: "count", key: types.Val{Tid: types.IntID, Value: int64(2)}}},
+		},
+	}}
+
+	enc := newEncoder()
+	n := enc.newNode(enc.idForAttr("me"))
+	require.NoError(t, enc.AddValue(n, enc.idForAttr("n"),
+		types.Val{Tid: types.StringID, Value: "Michonne"}))
+	require.NoError(t, sg.addGroupby(enc, n, res, "friend"))
+
+	// Each group becomes a row merged with the attributes of the parent.
+	normalized, err := enc.normalize(n)
+	require.NoError(t, err)
+	var rows []string
+	for _, attrs := range normalized {
+		row := enc.newNode(enc.idForAttr("me"))
+		enc.appendAttrs(row, attrs...)
+		var buf bytes.Buffer
+		require.NoError(t, enc.encode(row, &buf))
+		rows = append(rows, buf.String())
+	}
+	require.Equal(t, []string{
+		`{"age":17,"count":1,"n":"Michonne"}`,
+		`{"age":15,"count":2,"n":"Michonne"}`,
+	}, rows)
+}
+
+func TestGroupbySummaryOutput(t *testing.T) {
+	intVal := func(n int64) types.Val { return types.Val{Tid: types.IntID, Value: n} }
+	res := &groupResults{group: []*groupResult{
+		{
+			keys:       []groupPair{{attr: "age", key: intVal(17)}},
+			aggregates: []groupPair{{attr: "count", key: intVal(1)}},
+			uids:       []uint64{25},
+		},
+		{
+			keys:       []groupPair{{attr: "age", key: intVal(15)}},
+			aggregates: []groupPair{{attr: "count", key: intVal(2)}},
+			uids:       []uint64{23, 24},
+		},
+	}}
+	res.summarize(1)
+
+	// The summary is an object next to the groups.
+	sg := &SubGraph{Params: params{IsGroupBy: true}}
+	enc := newEncoder()
+	n := enc.newNode(enc.idForAttr("_root_"))
+	require.NoError(t, sg.addGroupby(enc, n, res, "me"))
+	var buf bytes.Buffer
+	require.NoError(t, enc.encode(n, &buf))
+	require.JSONEq(t, `{"me":[{
+		"@groupby":[{"age":17,"count":1},{"age":15,"count":2}],
+		"@groupby_summary":{"groups":2,"avgSize":1.5,"minSize":1,"maxSize":2,
+			"largeGroups":1}}]}`, buf.String())
+}
+
 func BenchmarkJsonMarshal(b *testing.B) {
 	inputStrings := [][]string{
 		[]string{"largestring", strings.Repeat("a", 1024)},
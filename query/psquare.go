@@ -0,0 +1,135 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package query
+
+import (
+	"sort"
+)
+
+// psquare estimates a single quantile of a stream of values with the P² algorithm, which
+// keeps five markers whatever the number of values: the min, the max, the estimated quantile
+// and two estimates halfway between it and the extremes. Each value moves the markers towards
+// their desired positions, adjusting their heights along a parabola through their neighbours.
+// See https://www.cse.wustl.edu/~jain/papers/ftp/psqr.pdf.
+type psquare struct {
+	p float64
+	// heights are the values of the markers, which are sorted.
+	heights [5]float64
+	// positions are the ranks of the markers among the values, and desired are the ranks
+	// they should be at, which move by increments for each value.
+	positions  [5]float64
+	desired    [5]float64
+	increments [5]float64
+	count      int
+}
+
+// newPsquare returns an estimator of the p quantile, for p between 0 and 1.
+func newPsquare(p float64) *psquare {
+	return &psquare{
+		p:          p,
+		positions:  [5]float64{1, 2, 3, 4, 5},
+		desired:    [5]float64{1, 1 + 2*p, 1 + 4*p, 3 + 2*p, 5},
+		increments: [5]float64{0, p / 2, p, (1 + p) / 2, 1},
+	}
+}
+
+// add adds a value to the estimator. The first five values become the markers.
+func (ps *psquare) add(v float64) {
+	if ps.count < 5 {
+		ps.heights[ps.count] = v
+		ps.count++
+		if ps.count == 5 {
+			sort.Float64s(ps.heights[:])
+		}
+		return
+	}
+	ps.count++
+
+	// Find the cell of the value, extending the extremes if it's out of them.
+	var k int
+	switch {
+	case v < ps.heights[0]:
+		ps.heights[0] = v
+	case v >= ps.heights[4]:
+		ps.heights[4] = v
+		k = 3
+	default:
+		for v >= ps.heights[k+1] {
+			k++
+		}
+	}
+	for i := k + 1; i < 5; i++ {
+		ps.positions[i]++
+	}
+	for i := range ps.desired {
+		ps.desired[i] += ps.increments[i]
+	}
+
+	// Move the middle markers that are off their desired positions by one.
+	for i := 1; i < 4; i++ {
+		d := ps.desired[i] - ps.positions[i]
+		if (d >= 1 && ps.positions[i+1]-ps.positions[i] > 1) ||
+			(d <= -1 && ps.positions[i-1]-ps.positions[i] < -1) {
+			dir := 1
+			if d < 0 {
+				dir = -1
+			}
+			h := ps.parabolic(i, float64(dir))
+			if ps.heights[i-1] >= h || h >= ps.heights[i+1] {
+				// The parabola would break the order of the markers.
+				h = ps.linear(i, dir)
+			}
+			ps.heights[i] = h
+			ps.positions[i] += float64(dir)
+		}
+	}
+}
+
+// parabolic returns the height of marker i moved by d along the parabola through it and its
+// neighbours.
+func (ps *psquare) parabolic(i int, d float64) float64 {
+	q, n := ps.heights, ps.positions
+	return q[i] + d/(n[i+1]-n[i-1])*((n[i]-n[i-1]+d)*(q[i+1]-q[i])/(n[i+1]-n[i])+
+		(n[i+1]-n[i]-d)*(q[i]-q[i-1])/(n[i]-n[i-1]))
+}
+
+// linear returns the height of marker i moved by d along the line to its neighbour in that
+// direction.
+func (ps *psquare) linear(i, d int) float64 {
+	q, n := ps.heights, ps.positions
+	return q[i] + float64(d)*(q[i+d]-q[i])/(n[i+d]-n[i])
+}
+
+// quantile returns the estimate of the quantile. With up to five values, it's computed exactly
+// from them, interpolating linearly between the two closest. It returns false if no
+// value was added.
+func (ps *psquare) quantile() (float64, bool) {
+	switch {
+	case ps.count == 0:
+		return 0, false
+	case ps.count > 5:
+		return ps.heights[2], true
+	}
+	vals := append([]float64(nil), ps.heights[:ps.count]...)
+	sort.Float64s(vals)
+	rank := ps.p * float64(len(vals)-1)
+	lo := int(rank)
+	if lo == len(vals)-1 {
+		return vals[lo], true
+	}
+	return vals[lo] + (vals[lo+1]-vals[lo])*(rank-float64(lo)), true
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package query
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPsquareSmall(t *testing.T) {
+	ps := newPsquare(0.5)
+	_, ok := ps.quantile()
+	require.False(t, ok)
+
+	// Up to five values, the quantile is interpolated between them.
+	for _, tc := range []struct {
+		vals []float64
+		want float64
+	}{
+		{[]float64{7}, 7},
+		{[]float64{7, 1}, 4},
+		{[]float64{7, 1, 3}, 3},
+		{[]float64{7, 1, 3, 5, 9}, 5},
+	} {
+		ps := newPsquare(0.5)
+		for _, v := range tc.vals {
+			ps.add(v)
+		}
+		got, ok := ps.quantile()
+		require.True(t, ok)
+		require.InDelta(t, tc.want, got, 1e-9, "values %v", tc.vals)
+	}
+
+	ps = newPsquare(0.99)
+	for _, v := range []float64{5, 3, 1, 4, 2} {
+		ps.add(v)
+	}
+	got, _ := ps.quantile()
+	require.InDelta(t, 4.96, got, 1e-9)
+}
+
+func TestPsquareAccuracy(t *testing.T) {
+	const n = 100000
+	r := rand.New(rand.NewSource(1))
+	for _, p := range []float64{0.01, 0.25, 0.5, 0.9, 0.99} {
+		ps := newPsquare(p)
+		for _, i := range r.Perm(n) {
+			ps.add(float64(i) / n)
+		}
+		got, ok := ps.quantile()
+		require.True(t, ok)
+		require.InDelta(t, p, got, 0.001, "quantile %v", p)
+		// The markers stay sorted and hold the extremes.
+		require.True(t, sort.Float64sAreSorted(ps.heights[:]))
+		require.Equal(t, 0.0, ps.heights[0])
+		require.Equal(t, float64(n-1)/n, ps.heights[4])
+	}
+}
+
+func TestPsquareSkewed(t *testing.T) {
+	// Most of the values are small and a few are very large, as with latencies.
+	const n = 50000
+	r := rand.New(rand.NewSource(2))
+	ps := newPsquare(0.99)
+	td := newTdigest(100)
+	for i := 0; i < n; i++ {
+		v := r.ExpFloat64() * 100
+		ps.add(v)
+		td.add(v)
+	}
+	got, ok := ps.quantile()
+	require.True(t, ok)
+	// The 99th percentile of the exponential distribution with a mean of 100 is 460.5, which
+	// both estimators get close to.
+	require.InEpsilon(t, 460.5, got, 0.03)
+	want, _ := td.quantile(0.99)
+	require.InEpsilon(t, want, got, 0.03)
+}
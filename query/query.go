@@ -20,6 +20,7 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -149,6 +150,9 @@ type params struct {
 	// variable that is part of req.Vars. This value variable would have been defined
 	// in some other query.
 	UidToVal map[uint64]types.Val
+	// UidToWeight is the mapping of uid to the weights of the values in UidToVal. It's populated
+	// from the weight variable of wpercentile.
+	UidToWeight map[uint64]types.Val
 
 	// Normalize is true if the @normalize directive is specified.
 	Normalize bool
@@ -189,6 +193,55 @@ type params struct {
 	IsGroupBy bool // True if @groupby is specified.
 	// GroupbyAttrs holds the list of attributes to group by.
 	GroupbyAttrs []gql.GroupByAttr
+	// GroupKeyFilters holds the regexp filters applied to the group keys after grouping.
+	GroupKeyFilters []*groupKeyFilter
+	// Groupby holds the options of the groupby directive. The reference datetime of its
+	// Relative is never now, which is resolved to the time the query is processed at.
+	Groupby gql.GroupbyOptions
+	// GroupbyHas is true for the child of a groupby node that groups the nodes by whether
+	// they have its predicate.
+	GroupbyHas bool
+	// GroupbyLang is true for the child of a groupby node that groups the nodes by the
+	// language tags of the values of its predicate.
+	GroupbyLang bool
+	// GroupbyLangCount is true for the child of a groupby node that groups the nodes by the
+	// number of distinct languages of the values of its predicate.
+	GroupbyLangCount bool
+	// GroupbyCount is true for the child of a groupby node that groups the nodes by their
+	// number of values or edges of its predicate.
+	GroupbyCount bool
+	// GroupbyJSONPath is set for the child of a groupby node that groups the nodes by the value
+	// at the path in the JSON stored in its predicate.
+	GroupbyJSONPath *jsonPath
+	// GroupbyJSONStrict is true if the values of the predicate of GroupbyJSONPath that aren't
+	// valid JSON fail the query instead of being skipped.
+	GroupbyJSONStrict bool
+	// GroupbyRegex is set for the child of a groupby node that groups the nodes by the first
+	// capture group of the regex in the value of its predicate.
+	GroupbyRegex *regexp.Regexp
+	// GroupbyUnmatched is the key of the group of the nodes whose value doesn't match
+	// GroupbyRegex. They're skipped if it's empty.
+	GroupbyUnmatched string
+	// GroupbyDistance is set for the child of a groupby node that groups the nodes by the ring
+	// around a point that the point value of its predicate falls in.
+	GroupbyDistance *gql.GroupbyDistance
+	// GroupbyMath is set for the child of a groupby node that groups the nodes by the result
+	// of a math expression.
+	GroupbyMath *mathTree
+	// GroupbyVar is set for the child of a groupby node that groups the nodes by the values of
+	// a value variable.
+	GroupbyVar string
+	// GroupbyInVar is set for the child of a groupby node that groups the nodes by whether
+	// they're in a variable, and GroupbyIn holds the sorted uids of the nodes of the variable.
+	GroupbyInVar string
+	GroupbyIn    *pb.List
+	// GroupbyCompare is set for the child of a groupby node that groups the nodes by the
+	// comparison of its values with the values of the next child, whose GroupbyCompareRight
+	// is true.
+	GroupbyCompare *gql.GroupbyCompare
+	// GroupbyCompareRight is true for the child of a groupby node that holds the values the
+	// values of the child before it are compared to. It isn't a group key on its own.
+	GroupbyCompareRight bool
 
 	// ParentIds is a stack that is maintained and passed down to children.
 	ParentIds []uint64
@@ -545,6 +598,7 @@ func treeCopy(gq *gql.GraphQuery, sg *SubGraph) error {
 			Order:        gchild.Order,
 			Var:          gchild.Var,
 			GroupbyAttrs: gchild.GroupbyAttrs,
+			Groupby:      resolveGroupbyOptions(gchild.Groupby),
 			IsGroupBy:    gchild.IsGroupby,
 			IsInternal:   gchild.IsInternal,
 		}
@@ -600,6 +654,10 @@ func treeCopy(gq *gql.GraphQuery, sg *SubGraph) error {
 			}
 			dst.createSrcFunction(gchild.Func)
 		}
+		if gchild.Func != nil &&
+			(isTopkFn(gchild.Func.Name) || varAggregators[gchild.Func.Name] != nil) {
+			dst.createSrcFunction(gchild.Func)
+		}
 
 		if gchild.Filter != nil {
 			dstf := &SubGraph{}
@@ -696,6 +754,12 @@ func (args *params) fill(gq *gql.GraphQuery) error {
 		}
 		args.Count = int(first)
 	}
+
+	filters, err := extractGroupKeyFilters(gq)
+	if err != nil {
+		return err
+	}
+	args.GroupKeyFilters = filters
 	return nil
 }
 
@@ -770,6 +834,7 @@ func newGraph(ctx context.Context, gq *gql.GraphQuery) (*SubGraph, error) {
 		ShortestPathArgs: gq.ShortestPathArgs,
 		Var:              gq.Var,
 		GroupbyAttrs:     gq.GroupbyAttrs,
+		Groupby:          resolveGroupbyOptions(gq.Groupby),
 		IsGroupBy:        gq.IsGroupby,
 	}
 
@@ -973,8 +1038,28 @@ func evalLevelAgg(
 		ag := aggregator{
 			name: sg.SrcFunc.Name,
 		}
-		for _, val := range vals {
-			ag.Apply(val)
+		if err := ag.setArgs(sg.SrcFunc.Args); err != nil {
+			return nil, err
+		}
+		if isOrderedAggregator(ag.name) {
+			// The values of the variable aren't ordered, so first and last take them in
+			// the order of the uids.
+			uids := make([]uint64, 0, len(vals))
+			for uid := range vals {
+				uids = append(uids, uid)
+			}
+			sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+			for _, uid := range uids {
+				if err := ag.Apply(vals[uid]); err != nil {
+					return nil, err
+				}
+			}
+		} else {
+			for _, val := range vals {
+				if err := ag.Apply(val); err != nil {
+					return nil, err
+				}
+			}
 		}
 		v, err := ag.Value()
 		if err != nil && err != ErrEmptyVal {
@@ -1015,9 +1100,14 @@ func evalLevelAgg(
 		ag := aggregator{
 			name: sg.SrcFunc.Name,
 		}
+		if err := ag.setArgs(sg.SrcFunc.Args); err != nil {
+			return nil, err
+		}
 		for _, uid := range list.Uids {
 			if val, ok := vals[uid]; ok {
-				ag.Apply(val)
+				if err := ag.Apply(val); err != nil {
+					return nil, err
+				}
 			}
 		}
 		v, err := ag.Value()
@@ -1082,8 +1172,12 @@ func (fromNode *varValue) transformTo(toPath []*SubGraph) (map[uint64]types.Val,
 			for j := 0; j < len(ul.Uids); j++ {
 				dstUid := ul.Uids[j]
 				ag := aggregator{name: "sum"}
-				ag.Apply(curVal)
-				ag.Apply(tempMap[dstUid])
+				if err := ag.Apply(curVal); err != nil {
+					return nil, err
+				}
+				if err := ag.Apply(tempMap[dstUid]); err != nil {
+					return nil, err
+				}
 				val, err := ag.Value()
 				if err != nil {
 					continue
@@ -1098,7 +1192,12 @@ func (fromNode *varValue) transformTo(toPath []*SubGraph) (map[uint64]types.Val,
 
 // transformVars transforms all the variables to the variable at the lowest level
 func (sg *SubGraph) transformVars(doneVars map[string]varValue, path []*SubGraph) error {
-	mNode := sg.MathExp
+	return transformMathVars(sg.MathExp, doneVars, path)
+}
+
+// transformMathVars transforms all the variables of the math tree mNode to the variable at the
+// lowest level.
+func transformMathVars(mNode *mathTree, doneVars map[string]varValue, path []*SubGraph) error {
 	mvarList := mNode.extractVarNodes()
 	for i := 0; i < len(mvarList); i++ {
 		mt := mvarList[i]
@@ -1120,8 +1219,8 @@ func (sg *SubGraph) transformVars(doneVars map[string]varValue, path []*SubGraph
 	return nil
 }
 
-func (sg *SubGraph) valueVarAggregation(doneVars map[string]varValue, path []*SubGraph,
-	parent *SubGraph) error {
+func (sg *SubGraph) valueVarAggregation(ctx context.Context, doneVars map[string]varValue,
+	path []*SubGraph, parent *SubGraph) error {
 	if !sg.IsInternal() && !sg.IsGroupBy() && !sg.Params.IsEmpty {
 		return nil
 	}
@@ -1133,7 +1232,7 @@ func (sg *SubGraph) valueVarAggregation(doneVars map[string]varValue, path []*Su
 
 	switch {
 	case sg.IsGroupBy():
-		if err := sg.processGroupBy(doneVars, path); err != nil {
+		if err := sg.processGroupBy(ctx, doneVars, path); err != nil {
 			return err
 		}
 	case sg.SrcFunc != nil && !parent.IsGroupBy() && isAggregatorFn(sg.SrcFunc.Name):
@@ -1227,18 +1326,18 @@ func (sg *SubGraph) valueVarAggregation(doneVars map[string]varValue, path []*Su
 	return nil
 }
 
-func (sg *SubGraph) populatePostAggregation(doneVars map[string]varValue, path []*SubGraph,
-	parent *SubGraph) error {
+func (sg *SubGraph) populatePostAggregation(ctx context.Context, doneVars map[string]varValue,
+	path []*SubGraph, parent *SubGraph) error {
 	for idx := 0; idx < len(sg.Children); idx++ {
 		child := sg.Children[idx]
 		path = append(path, sg)
-		err := child.populatePostAggregation(doneVars, path, sg)
+		err := child.populatePostAggregation(ctx, doneVars, path, sg)
 		path = path[:len(path)-1]
 		if err != nil {
 			return err
 		}
 	}
-	return sg.valueVarAggregation(doneVars, path, parent)
+	return sg.valueVarAggregation(ctx, doneVars, path, parent)
 }
 
 // Filters might have updated the destuids. facetMatrix should also be updated to exclude uids that
@@ -1553,8 +1652,12 @@ func (sg *SubGraph) populateFacetVars(doneVars map[string]varValue, sgPath []*Su
 							"facet var encountered.")
 					}
 					ag := aggregator{name: "sum"}
-					ag.Apply(pVal)
-					ag.Apply(nVal)
+					if err := ag.Apply(pVal); err != nil {
+						return err
+					}
+					if err := ag.Apply(nVal); err != nil {
+						return err
+					}
 					fVal, err := ag.Value()
 					if err != nil {
 						continue
@@ -1640,12 +1743,17 @@ func (sg *SubGraph) fillVars(mp map[string]varValue) error {
 	var lists []*pb.List
 	// Go through all the variables in NeedsVar and see if we have a value for them in the map. If
 	// we do, then we store that value in the appropriate variable inside SubGraph.
-	for _, v := range sg.Params.NeedsVar {
+	for i, v := range sg.Params.NeedsVar {
 		l, ok := mp[v.Name]
 		if !ok {
 			continue
 		}
 		switch {
+		case i == 1 && v.Typ == gql.ValueVar && sg.SrcFunc != nil &&
+			sg.SrcFunc.Name == "wpercentile":
+			// The second variable of wpercentile holds the weights of the values.
+			sg.Params.UidToWeight = l.Vals
+
 		case (v.Typ == gql.AnyVar || v.Typ == gql.ListVar) && l.strList != nil:
 			// This is for the case when we use expand(val(x)) with a value variable.
 			// We populate the list of values into ExpandPreds and use that for the expand query
@@ -1921,6 +2029,40 @@ func expandSubgraph(ctx context.Context, sg *SubGraph) ([]*SubGraph, error) {
 	return out, nil
 }
 
+// addGroupbyExpandChildren adds a groupby child for each of the scalar predicates in the types of
+// the nodes at this level. The values in all the languages and all the elements of list
+// predicates are fetched so that each of them becomes a separate group key.
+func (sg *SubGraph) addGroupbyExpandChildren(ctx context.Context) error {
+	typeNames, err := getNodeTypes(ctx, sg)
+	if err != nil {
+		return err
+	}
+	preds := uniquePreds(getPredicatesFromTypes(typeNames))
+	sort.Strings(preds)
+	for _, pred := range preds {
+		typ, err := schema.State().TypeOf(pred)
+		if err != nil || typ == types.UidID || typ == types.PasswordID {
+			continue
+		}
+		sg.Children = append(sg.Children, &SubGraph{
+			Attr:   pred,
+			ReadTs: sg.ReadTs,
+			Params: params{
+				IgnoreResult: true,
+				Langs:        []string{"*"},
+			},
+		})
+	}
+	return nil
+}
+
+// isGroupbyExpand returns true if the nodes are grouped by expand(_all_). In that case, each of
+// the expanded predicates is grouped on its own instead of together with the others.
+func (sg *SubGraph) isGroupbyExpand() bool {
+	attrs := sg.Params.GroupbyAttrs
+	return len(attrs) == 1 && attrs[0].Expand != ""
+}
+
 // ProcessGraph processes the SubGraph instance accumulating result for the query
 // from different instances. Note: taskQuery is nil for root node.
 func ProcessGraph(ctx context.Context, sg, parent *SubGraph, rch chan error) {
@@ -2165,16 +2307,200 @@ func ProcessGraph(ctx context.Context, sg, parent *SubGraph, rch chan error) {
 	if sg.IsGroupBy() {
 		// Add the attrs required by groupby nodes
 		for _, it := range sg.Params.GroupbyAttrs {
+			if it.Expand != "" {
+				if err = sg.addGroupbyExpandChildren(ctx); err != nil {
+					rch <- err
+					return
+				}
+				continue
+			}
+			if it.Has {
+				// Only the number of values or edges of each node is needed to know
+				// whether it has the predicate. Values in any language are counted.
+				alias := it.Alias
+				if alias == "" {
+					alias = fmt.Sprintf("has(%s)", it.Attr)
+				}
+				sg.Children = append(sg.Children, &SubGraph{
+					Attr:   it.Attr,
+					ReadTs: sg.ReadTs,
+					Params: params{
+						Alias:        alias,
+						IgnoreResult: true,
+						DoCount:      true,
+						ExpandAll:    true,
+						GroupbyHas:   true,
+					},
+				})
+				continue
+			}
+			if it.Lang {
+				alias := it.Alias
+				if alias == "" {
+					alias = fmt.Sprintf("lang(%s)", it.Attr)
+				}
+				// The values in all the languages are fetched along with their tags.
+				sg.Children = append(sg.Children, &SubGraph{
+					Attr:   it.Attr,
+					ReadTs: sg.ReadTs,
+					Params: params{
+						Alias:        alias,
+						IgnoreResult: true,
+						Langs:        []string{"*"},
+						ExpandAll:    true,
+						GroupbyLang:  true,
+					},
+				})
+				continue
+			}
+			if it.LangCount {
+				alias := it.Alias
+				if alias == "" {
+					alias = fmt.Sprintf("langcount(%s)", it.Attr)
+				}
+				// Like lang(), the values in all the languages are fetched along with their
+				// tags, which are then counted.
+				sg.Children = append(sg.Children, &SubGraph{
+					Attr:   it.Attr,
+					ReadTs: sg.ReadTs,
+					Params: params{
+						Alias:            alias,
+						IgnoreResult:     true,
+						Langs:            []string{"*"},
+						ExpandAll:        true,
+						GroupbyLangCount: true,
+					},
+				})
+				continue
+			}
+			if it.Count {
+				alias := it.Alias
+				if alias == "" {
+					alias = fmt.Sprintf("count(%s)", it.Attr)
+				}
+				sg.Children = append(sg.Children, &SubGraph{
+					Attr:   it.Attr,
+					ReadTs: sg.ReadTs,
+					Params: params{
+						Alias:        alias,
+						IgnoreResult: true,
+						DoCount:      true,
+						GroupbyCount: true,
+					},
+				})
+				continue
+			}
+			if it.MathExp != nil {
+				mathExp := &mathTree{}
+				if err = mathCopy(mathExp, it.MathExp); err != nil {
+					rch <- err
+					return
+				}
+				// The expression is evaluated by the groupby node from the value variables
+				// it uses, so there is nothing to fetch.
+				sg.Children = append(sg.Children, &SubGraph{
+					Attr:   "math",
+					ReadTs: sg.ReadTs,
+					Params: params{
+						Alias:        it.Alias,
+						IgnoreResult: true,
+						IsInternal:   true,
+						GroupbyMath:  mathExp,
+					},
+				})
+				continue
+			}
+			if it.ValueVar != "" {
+				alias := it.Alias
+				if alias == "" {
+					alias = fmt.Sprintf("val(%s)", it.ValueVar)
+				}
+				// The values are read from the variable by the groupby node, so there is
+				// nothing to fetch.
+				sg.Children = append(sg.Children, &SubGraph{
+					Attr:   "val",
+					ReadTs: sg.ReadTs,
+					Params: params{
+						Alias:        alias,
+						IgnoreResult: true,
+						IsInternal:   true,
+						GroupbyVar:   it.ValueVar,
+					},
+				})
+				continue
+			}
+			if it.InVar != "" {
+				alias := it.Alias
+				if alias == "" {
+					alias = fmt.Sprintf("in(val(%s))", it.InVar)
+				}
+				// The nodes of the variable are read by the groupby node, so there is nothing
+				// to fetch.
+				sg.Children = append(sg.Children, &SubGraph{
+					Attr:   "in",
+					ReadTs: sg.ReadTs,
+					Params: params{
+						Alias:        alias,
+						IgnoreResult: true,
+						IsInternal:   true,
+						GroupbyInVar: it.InVar,
+					},
+				})
+				continue
+			}
+			if it.Compare != nil {
+				sg.Children = append(sg.Children, newGroupbyCompareChildren(sg, it)...)
+				continue
+			}
+			if it.JSONPath != "" {
+				child, err := newGroupbyJSONPathChild(sg, it)
+				if err != nil {
+					rch <- err
+					return
+				}
+				sg.Children = append(sg.Children, child)
+				continue
+			}
+			if it.Regex != "" {
+				child, err := newGroupbyRegexCaptureChild(sg, it)
+				if err != nil {
+					rch <- err
+					return
+				}
+				sg.Children = append(sg.Children, child)
+				continue
+			}
+			if it.Distance != nil {
+				child, err := newGroupbyDistanceChild(sg, it)
+				if err != nil {
+					rch <- err
+					return
+				}
+				sg.Children = append(sg.Children, child)
+				continue
+			}
+			// Grouping by attr@. fans out to the values in all the languages, each of
+			// them becoming a separate group key. Fetch all of them.
+			langs := it.Langs
+			if len(langs) == 1 && langs[0] == "." {
+				langs = []string{"*"}
+			}
 			// TODO - Throw error if Attr is of list type.
-			sg.Children = append(sg.Children, &SubGraph{
+			child := &SubGraph{
 				Attr:   it.Attr,
 				ReadTs: sg.ReadTs,
 				Params: params{
 					Alias:        it.Alias,
 					IgnoreResult: true,
-					Langs:        it.Langs,
+					Langs:        langs,
 				},
-			})
+			}
+			if sg.Params.Groupby.Facet != "" {
+				child.Params.Facet = &pb.FacetParams{
+					Param: []*pb.FacetParam{{Key: sg.Params.Groupby.Facet}},
+				}
+			}
+			sg.Children = append(sg.Children, child)
 		}
 	}
 
@@ -2492,11 +2818,20 @@ func isInequalityFn(f string) bool {
 }
 
 func isAggregatorFn(f string) bool {
-	switch f {
-	case "min", "max", "sum", "avg":
-		return true
-	}
-	return false
+	return types.IsAggregator(f)
+}
+
+// isBuiltinAggregatorFn returns true for the aggregators implemented by Dgraph, which take
+// precedence over the custom aggregators registered with RegisterAggregator.
+func isBuiltinAggregatorFn(f string) bool {
+	_, ok := types.Aggregators[f]
+	return ok
+}
+
+// isTopkFn returns true for topk, which returns the uids of each group of a groupby with the
+// highest values of a variable.
+func isTopkFn(f string) bool {
+	return f == "topk"
 }
 
 func isUidFnWithoutVar(f *gql.Function) bool {
@@ -2707,7 +3042,7 @@ func (req *Request) ProcessQuery(ctx context.Context) (err error) {
 			if err := sg.populateVarMap(req.Vars, sgPath); err != nil {
 				return err
 			}
-			if err := sg.populatePostAggregation(req.Vars, []*SubGraph{}, nil); err != nil {
+			if err := sg.populatePostAggregation(ctx, req.Vars, []*SubGraph{}, nil); err != nil {
 				return err
 			}
 		}
@@ -18,15 +18,30 @@ package query
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
 	"os"
+	"regexp"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/twpayne/go-geom"
 
 	"github.com/dgraph-io/dgo/v200"
+	"github.com/dgraph-io/dgraph/codec"
 	"github.com/dgraph-io/dgraph/gql"
+	"github.com/dgraph-io/dgraph/protos/pb"
+	"github.com/dgraph-io/dgraph/task"
 	"github.com/dgraph-io/dgraph/testutil"
+	"github.com/dgraph-io/dgraph/types"
 	"github.com/dgraph-io/dgraph/x"
+	otrace "go.opencensus.io/trace"
 )
 
 func TestGetUID(t *testing.T) {
@@ -1380,6 +1395,41 @@ func TestGroupByRootAlias2(t *testing.T) {
 	require.JSONEq(t, `{"data":{"me":[{"@groupby":[{"Age":17,"Count":1},{"Age":19,"Count":1},{"Age":38,"Count":1},{"Age":15,"Count":2}]}]}}`, js)
 }
 
+func TestGroupByNormalize(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name) @normalize {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[
+		{"name":"Colin","count":1},
+		{"name":"Bob","count":2},
+		{"name":"Elizabeth","count":2},
+		{"name":"Alice","count":3}]}}`, js)
+}
+
+func TestGroupByNormalizeParent(t *testing.T) {
+	query := `
+		{
+			me(func: uid(1)) @normalize {
+				n: name
+				friend @groupby(age) {
+					count(uid)
+				}
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[
+		{"n":"Michonne","age":17,"count":1},
+		{"n":"Michonne","age":19,"count":1},
+		{"n":"Michonne","age":15,"count":2}]}}`, js)
+}
+
 func TestGroupBy_RepeatAttr(t *testing.T) {
 	query := `
 	{
@@ -1446,6 +1496,28 @@ func TestGroupByCountval(t *testing.T) {
 		js)
 }
 
+func TestGroupByVarFirstAggregate(t *testing.T) {
+	query := `
+		{
+			var(func: uid(1)) {
+				friend @groupby(school) {
+					a as count(uid)
+					max(name)
+				}
+			}
+
+			order(func :uid(a), orderdesc: val(a)) {
+				name
+				val(a)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t,
+		`{"data": {"order":[{"name":"School B","val(a)":3},{"name":"School A","val(a)":2}]}}`,
+		js)
+}
+
 func TestGroupByAggval(t *testing.T) {
 	query := `
 		{
@@ -1473,6 +1545,3661 @@ func TestGroupByAggval(t *testing.T) {
 		js)
 }
 
+func TestGroupByMultipleVars(t *testing.T) {
+	query := `
+		{
+			var(func: uid(1)) {
+				friend @groupby(school) {
+					cnt as count(uid)
+					total as sum(age)
+					oldest as max(age)
+				}
+			}
+
+			schools(func: uid(cnt), orderdesc: val(cnt)) {
+				name
+				val(cnt)
+				val(total)
+				val(oldest)
+				diff: math(total - cnt)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data": {"schools":[
+		{"name":"School B","val(cnt)":3,"val(total)":34,"val(oldest)":19,"diff":31},
+		{"name":"School A","val(cnt)":2,"val(total)":32,"val(oldest)":17,"diff":30}]}}`, js)
+}
+
+func TestGroupVarUids(t *testing.T) {
+	uidKey := func(uid uint64) []groupPair {
+		return []groupPair{{attr: "school", key: types.Val{Tid: types.UidID, Value: uid}}}
+	}
+	res := &groupResults{group: []*groupResult{
+		{keys: uidKey(5001)},
+		{},
+		{keys: uidKey(5000)},
+	}}
+	uids, err := res.groupVarUids()
+	require.NoError(t, err)
+	require.Equal(t, []uint64{5001, 0, 5000}, uids)
+
+	res.group[1].keys = []groupPair{{attr: "age", key: types.Val{Tid: types.IntID,
+		Value: int64(15)}}}
+	_, err = res.groupVarUids()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Vars can be assigned only when grouped by UID attribute")
+
+	res.group[1].keys = append(uidKey(5002), uidKey(5003)...)
+	_, err = res.groupVarUids()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Expected one UID for var in groupby but got: 2")
+}
+
+func TestGroupByDistinct(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(distinct: true, name, age) {}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Alice","age":25},
+		{"name":"Alice","age":75},
+		{"name":"Bob","age":25},
+		{"name":"Bob","age":75},
+		{"name":"Colin","age":25},
+		{"name":"Elizabeth","age":25},
+		{"name":"Elizabeth","age":75}]}]}}`, js)
+}
+
+func TestGroupBySumDistinct(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name) {
+					sum(age)
+					sumdistinct(age)
+				}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Alice","sum(age)":175,"sumdistinct(age)":100},
+		{"name":"Bob","sum(age)":100,"sumdistinct(age)":100},
+		{"name":"Colin","sum(age)":25,"sumdistinct(age)":25},
+		{"name":"Elizabeth","sum(age)":100,"sumdistinct(age)":100}]}]}}`, js)
+}
+
+func TestGroupByValueMap(t *testing.T) {
+	run := func(options string) string {
+		query := `
+			{
+				me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+					@groupby(age, ` + options + `) {
+					count(uid)
+				}
+			}
+		`
+		return processQueryNoErr(t, query)
+	}
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"age":"old","count":4},
+		{"age":"young","count":4}]}]}}`, run(`valueMap: [25: "young", 75: "old"]`))
+
+	// The values that aren't mapped are grouped by their own value, or get the unmapped label.
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"age":75,"count":4},
+		{"age":"young","count":4}]}]}}`, run(`valueMap: [25: "young"]`))
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"age":"other","count":4},
+		{"age":"young","count":4}]}]}}`, run(`valueMap: [25: "young"], unmapped: "other"`))
+}
+
+func TestGroupByPaging(t *testing.T) {
+	type groupsResult struct {
+		Data struct {
+			Me []struct {
+				Groups []map[string]interface{} `json:"@groupby"`
+				Next   string                   `json:"@groupby_next"`
+			} `json:"me"`
+		} `json:"data"`
+	}
+	run := func(options string) ([]string, string) {
+		query := `
+			{
+				me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+					@groupby(name, age` + options + `) {
+					count(uid)
+				}
+			}
+		`
+		var res groupsResult
+		require.NoError(t, json.Unmarshal([]byte(processQueryNoErr(t, query)), &res))
+		if len(res.Data.Me) == 0 {
+			return nil, ""
+		}
+		var groups []string
+		for _, grp := range res.Data.Me[0].Groups {
+			groups = append(groups, fmt.Sprintf("%v/%v/%v", grp["name"], grp["age"],
+				grp["count"]))
+		}
+		return groups, res.Data.Me[0].Next
+	}
+
+	all, next := run("")
+	require.Len(t, all, 7)
+	require.Empty(t, next)
+
+	var paged []string
+	var pages int
+	options := ", pageSize: 3"
+	for {
+		groups, next := run(options)
+		require.LessOrEqual(t, len(groups), 3)
+		paged = append(paged, groups...)
+		pages++
+		if next == "" {
+			break
+		}
+		options = fmt.Sprintf(`, pageSize: 3, after: "%s"`, next)
+	}
+	require.Equal(t, 3, pages)
+	// The pages are ordered by the keys, without duplicates or gaps. As all the groups have a
+	// node, it's also the order of the unpaged groups.
+	require.Equal(t, all, paged)
+	require.Equal(t, []string{"Alice/25/1", "Alice/75/1", "Bob/25/1", "Bob/75/1", "Colin/25/1",
+		"Elizabeth/25/1", "Elizabeth/75/1"}, paged)
+	require.ElementsMatch(t, all, paged)
+}
+
+func TestGeohashKey(t *testing.T) {
+	point := func(lng, lat float64) types.Val {
+		return types.Val{Tid: types.GeoID, Value: geom.NewPointFlat(geom.XY, []float64{lng, lat})}
+	}
+	for _, tc := range []struct {
+		lng, lat  float64
+		precision int
+		hash      string
+	}{
+		{10.40744, 57.64911, 11, "u4pruydqqvj"},
+		{10.40744, 57.64911, 6, "u4pruy"},
+		{-5.6, 42.6, 5, "ezs42"},
+		{-122.082506, 37.4249518, 5, "9q9hv"},
+		{-180, -90, 3, "000"},
+		{180, 90, 3, "zzz"},
+	} {
+		hash, ok := geohashKey(point(tc.lng, tc.lat), tc.precision)
+		require.True(t, ok)
+		require.Equal(t, tc.hash, hash)
+	}
+
+	// The points with invalid coordinates and the other shapes are skipped.
+	for _, val := range []types.Val{
+		point(-181, 0), point(0, 90.5), point(math.NaN(), 0),
+		{Tid: types.GeoID, Value: geom.NewPolygonFlat(geom.XY,
+			[]float64{0, 0, 1, 0, 1, 1, 0, 0}, []int{8})},
+	} {
+		_, ok := geohashKey(val, 6)
+		require.False(t, ok)
+	}
+}
+
+func TestDistanceKey(t *testing.T) {
+	point := func(lng, lat float64) types.Val {
+		return types.Val{Tid: types.GeoID, Value: geom.NewPointFlat(geom.XY, []float64{lng, lat})}
+	}
+	london := &gql.GroupbyDistance{Lat: 51.5074, Lng: -0.1278, Ring: 1000}
+	origin := &gql.GroupbyDistance{Ring: 500}
+	for _, tc := range []struct {
+		val  types.Val
+		dist *gql.GroupbyDistance
+		ring int64
+	}{
+		// Paris is about 343.56km from London.
+		{point(2.3522, 48.8566), london, 343000},
+		{point(-0.1278, 51.5074), london, 0},
+		{point(0.005, 0), origin, 500},
+		{point(0, 0.008), origin, 500},
+		{point(0.01, 0), origin, 1000},
+		{point(0.03, 0), origin, 3000},
+		{point(180, 0), &gql.GroupbyDistance{Ring: 1000 * 1000}, 20000 * 1000},
+	} {
+		ring, ok := distanceKey(tc.val, tc.dist)
+		require.True(t, ok)
+		require.Equal(t, tc.ring, ring)
+	}
+
+	// The points with invalid coordinates and the other shapes are skipped.
+	for _, val := range []types.Val{
+		point(-181, 0), point(0, 90.5), point(math.NaN(), 0),
+		{Tid: types.GeoID, Value: geom.NewPolygonFlat(geom.XY,
+			[]float64{0, 0, 1, 0, 1, 1, 0, 0}, []int{8})},
+	} {
+		_, ok := distanceKey(val, origin)
+		require.False(t, ok)
+	}
+}
+
+func TestMapValue(t *testing.T) {
+	vm := &gql.GroupbyValueMap{Labels: map[string]string{"1": "active", "2.5": "half",
+		"true": "yes", "n/a": "none"}}
+	for _, tc := range []struct {
+		val   types.Val
+		label string
+	}{
+		{types.Val{Tid: types.IntID, Value: int64(1)}, "active"},
+		{types.Val{Tid: types.FloatID, Value: 2.5}, "half"},
+		{types.Val{Tid: types.BoolID, Value: true}, "yes"},
+		{types.Val{Tid: types.StringID, Value: "n/a"}, "none"},
+	} {
+		require.Equal(t, types.Val{Tid: types.StringID, Value: tc.label}, mapValue(vm, tc.val))
+	}
+
+	unmapped := types.Val{Tid: types.IntID, Value: int64(3)}
+	require.Equal(t, unmapped, mapValue(vm, unmapped))
+	vm.Unmapped = "unknown"
+	require.Equal(t, types.Val{Tid: types.StringID, Value: "unknown"}, mapValue(vm, unmapped))
+}
+
+func TestGroupByTrimCollapseSpaces(t *testing.T) {
+	triples := `
+		<60011> <room> "Main  Hall" .
+		<60012> <room> " Main Hall" .
+		<60013> <room> "Main Hall\t" .
+		<60014> <room> "main hall" .
+		<60015> <room> "Library" .
+		<60016> <room> "  Library  " .
+	`
+	require.NoError(t, addTriplesToCluster(triples))
+	defer deleteTriplesInCluster(triples)
+
+	run := func(options string) string {
+		query := `
+			{
+				me(func: uid(60011, 60012, 60013, 60014, 60015, 60016))
+					@groupby(room` + options + `) {
+					count(uid)
+				}
+			}
+		`
+		return processQueryNoErr(t, query)
+	}
+	// Only the whitespace is normalized, the case is kept.
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"room":"main hall","count":1},
+		{"room":"Library","count":2},
+		{"room":"Main Hall","count":3}]}]}}`, run(", trim: true, collapseSpaces: true"))
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"room":"Main  Hall","count":1},
+		{"room":"main hall","count":1},
+		{"room":"Library","count":2},
+		{"room":"Main Hall","count":2}]}]}}`, run(", trim: true"))
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"room":"  Library  ","count":1},
+		{"room":" Main Hall","count":1},
+		{"room":"Library","count":1},
+		{"room":"Main Hall","count":1},
+		{"room":"Main Hall ","count":1},
+		{"room":"main hall","count":1}]}]}}`, run(", collapseSpaces: true"))
+}
+
+func TestNormalizeString(t *testing.T) {
+	str := func(v string) types.Val { return types.Val{Tid: types.StringID, Value: v} }
+	both := &dedup{trim: true, collapse: true}
+	for in, want := range map[string]string{
+		"":                     "",
+		"   ":                  "",
+		"New York":             "New York",
+		"  New \t York\n":      "New York",
+		"São\u00a0\u00a0Paulo": "São Paulo",
+	} {
+		require.Equal(t, str(want), both.normalizeString(str(in)), "%q", in)
+	}
+	messy := str("  New \t York\n")
+	require.Equal(t, " New York ", (&dedup{collapse: true}).normalizeString(messy).Value)
+	require.Equal(t, "New \t York", (&dedup{trim: true}).normalizeString(messy).Value)
+	require.Equal(t, str("  a  "), (&dedup{}).normalizeString(str("  a  ")))
+
+	// The default values are normalized too, but not the values of the other types.
+	require.Equal(t, types.Val{Tid: types.DefaultID, Value: "a b"},
+		both.normalizeString(types.Val{Tid: types.DefaultID, Value: " a  b "}))
+	require.Equal(t, types.Val{Tid: types.IntID, Value: int64(1)},
+		both.normalizeString(types.Val{Tid: types.IntID, Value: int64(1)}))
+
+	// The values that only differ by their whitespace are grouped under the canonical form,
+	// which labels are looked up by.
+	d := &dedup{trim: true, collapse: true,
+		valueMap: &gql.GroupbyValueMap{Labels: map[string]string{"New York": "NY"}}}
+	d.addValue("city", "", str(" New  York"), 1)
+	d.addValue("city", "", str("New York "), 2)
+	d.addValue("city", "", str("Boston"), 3)
+	require.Len(t, d.getGroup("city").elements, 2)
+	require.Equal(t, []uint64{1, 2}, d.getGroup("city").elements["New York"].entities.Uids)
+	require.Equal(t, str("NY"), mapValue(d.valueMap, d.normalizeString(str(" New \t York "))))
+}
+
+func TestGroupByGeohash(t *testing.T) {
+	// The polygons are skipped, and the Googleplex and the Shoreline Amphitheater are in the
+	// same cell.
+	query := `
+		{
+			me(func: uid(5101, 5102, 5103, 5104, 5105, 5106, 5107)) @groupby(geometry, geohash: 5) {
+				count(uid)
+				min(name)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"geometry":"9q9j6","count":1,"min(name)":"San Carlos Airport"},
+		{"geometry":"9q9hv","count":2,"min(name)":"Googleplex"}]}]}}`, js)
+}
+
+func TestGroupByDistance(t *testing.T) {
+	// The points are on the equator, 556m, 890m, 1112m, 1668m and 3336m away from [0, 0], and
+	// the polygon of 60036 is skipped.
+	triples := `
+		<60031> <loc> "{'type':'Point', 'coordinates':[0.005, 0]}"^^<geo:geojson> .
+		<60032> <loc> "{'type':'Point', 'coordinates':[0, 0.008]}"^^<geo:geojson> .
+		<60033> <loc> "{'type':'Point', 'coordinates':[0.01, 0]}"^^<geo:geojson> .
+		<60034> <loc> "{'type':'Point', 'coordinates':[0.015, 0]}"^^<geo:geojson> .
+		<60035> <loc> "{'type':'Point', 'coordinates':[0.03, 0]}"^^<geo:geojson> .
+		<60036> <loc> "{'type':'Polygon', 'coordinates':[[[0,0],[1,0],[0,1],[0,0]]]}"^^<geo:geojson> .
+	`
+	require.NoError(t, addTriplesToCluster(triples))
+	defer deleteTriplesInCluster(triples)
+
+	query := `
+		{
+			me(func: uid(60031, 60032, 60033, 60034, 60035, 60036))
+				@groupby(ring: distance(loc, [0, 0]), bucket: 1km) {
+					count(uid)
+				}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"ring":3000,"count":1},
+		{"ring":0,"count":2},
+		{"ring":1000,"count":2}]}]}}`, js)
+
+	query = `
+		{
+			me(func: uid(60031, 60032, 60033, 60034, 60035, 60036))
+				@groupby(distance(loc, [0, 0]), bucket: 500m) {
+					count(uid)
+				}
+		}
+	`
+	js = processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"distance(loc, [0, 0])":1000,"count":1},
+		{"distance(loc, [0, 0])":1500,"count":1},
+		{"distance(loc, [0, 0])":3000,"count":1},
+		{"distance(loc, [0, 0])":500,"count":2}]}]}}`, js)
+}
+
+func TestGroupMembers(t *testing.T) {
+	decode := func(members string) []uint64 {
+		b, err := base64.StdEncoding.DecodeString(members)
+		require.NoError(t, err)
+		var pack pb.UidPack
+		require.NoError(t, pack.Unmarshal(b))
+		return codec.Decode(&pack, 0)
+	}
+
+	// The uids of a large group span several blocks of the pack.
+	var uids []uint64
+	for uid := uint64(1); uid <= 10000; uid += 3 {
+		uids = append(uids, uid)
+	}
+	members, err := encodeGroupMembers(uids)
+	require.NoError(t, err)
+	require.Equal(t, uids, decode(members))
+	require.Less(t, len(members), len(uids)*8)
+
+	members, err = encodeGroupMembers([]uint64{0x2a})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0x2a}, decode(members))
+}
+
+func TestGroupByMembers(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name, members: true) {
+					count(uid)
+				}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	var res struct {
+		Data struct {
+			Me []struct {
+				Groups []struct {
+					Name    string `json:"name"`
+					Count   int    `json:"count"`
+					Members string `json:"@members"`
+				} `json:"@groupby"`
+			} `json:"me"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(js), &res))
+	require.Len(t, res.Data.Me, 1)
+
+	members := make(map[string][]uint64)
+	for _, grp := range res.Data.Me[0].Groups {
+		b, err := base64.StdEncoding.DecodeString(grp.Members)
+		require.NoError(t, err)
+		var pack pb.UidPack
+		require.NoError(t, pack.Unmarshal(b))
+		members[grp.Name] = codec.Decode(&pack, 0)
+		require.Len(t, members[grp.Name], grp.Count)
+	}
+	require.Equal(t, map[string][]uint64{
+		"Alice":     {10000, 10002, 10004},
+		"Bob":       {10003, 10005},
+		"Colin":     {10006},
+		"Elizabeth": {10001, 10007},
+	}, members)
+}
+
+func TestGroupPage(t *testing.T) {
+	group := func(name string, age int64, uids ...uint64) *groupResult {
+		return &groupResult{uids: uids, keys: []groupPair{
+			{attr: "name", key: types.Val{Tid: types.StringID, Value: name}},
+			{attr: "age", key: types.Val{Tid: types.IntID, Value: age}},
+		}}
+	}
+	groups := func() []*groupResult {
+		return []*groupResult{
+			group("Bob", 25, 1, 2, 3),
+			group("Alice", 75, 4),
+			group("Colin", 25, 5),
+			group("Alice", 25, 6, 7),
+			group("Bob", 75, 8, 9),
+		}
+	}
+	names := func(res *groupResults) []string {
+		var out []string
+		for _, grp := range res.group {
+			out = append(out, fmt.Sprintf("%v/%v", grp.keys[0].key.Value, grp.keys[1].key.Value))
+		}
+		return out
+	}
+
+	// sorted returns the results with the groups ordered by their keys, as formResult orders
+	// them when they're paged.
+	sorted := func(groups []*groupResult) *groupResults {
+		sort.Slice(groups, func(i, j int) bool {
+			return compareGroupKeyOrder(groups[i].keys, groups[j].keys) < 0
+		})
+		return &groupResults{group: groups}
+	}
+
+	res := sorted(groups())
+	require.NoError(t, res.page(2, ""))
+	require.Equal(t, []string{"Alice/25", "Alice/75"}, names(res))
+	require.NotEmpty(t, res.next)
+
+	// A group added before the end of the page doesn't shift the next page.
+	res2 := sorted(append(groups(), group("Aaron", 30, 10)))
+	require.NoError(t, res2.page(2, res.next))
+	require.Equal(t, []string{"Bob/25", "Bob/75"}, names(res2))
+	require.NotEmpty(t, res2.next)
+
+	res3 := sorted(groups())
+	require.NoError(t, res3.page(2, res2.next))
+	require.Equal(t, []string{"Colin/25"}, names(res3))
+	require.Empty(t, res3.next)
+
+	// Without a page size, all the groups after the token are returned.
+	res4 := sorted(groups())
+	require.NoError(t, res4.page(0, res.next))
+	require.Equal(t, []string{"Bob/25", "Bob/75", "Colin/25"}, names(res4))
+	require.Empty(t, res4.next)
+
+	// The members of the groups change between two pages. Alice/25 and Bob/75 lose their
+	// members and Colin/25 gains some, which would reorder the groups by their numbers of nodes,
+	// but no group is skipped or repeated.
+	changed := func() []*groupResult {
+		return []*groupResult{
+			group("Bob", 25, 1, 2, 3),
+			group("Alice", 75, 4),
+			group("Colin", 25, 5, 6, 7, 8),
+			group("Alice", 25, 9),
+			group("Bob", 75, 10),
+		}
+	}
+	res5 := sorted(changed())
+	require.NoError(t, res5.page(2, res.next))
+	require.Equal(t, []string{"Bob/25", "Bob/75"}, names(res5))
+	res6 := sorted(changed())
+	require.NoError(t, res6.page(2, res5.next))
+	require.Equal(t, []string{"Colin/25"}, names(res6))
+
+	// Without a page size or a token, the groups are left as they are.
+	res7 := &groupResults{group: groups()}
+	require.NoError(t, res7.page(0, ""))
+	require.Equal(t, []string{"Bob/25", "Alice/75", "Colin/25", "Alice/25", "Bob/75"},
+		names(res7))
+	require.Empty(t, res7.next)
+
+	// The keys of all the types round-trip through the tokens.
+	when := time.Date(2020, 5, 1, 10, 0, 0, 0, time.FixedZone("", 5*3600))
+	keys := []groupPair{
+		{attr: "friend", key: types.Val{Tid: types.UidID, Value: uint64(0x2a)}},
+		{attr: "since", key: types.Val{Tid: types.DateTimeID, Value: when}},
+		{attr: "name", lang: "en", key: types.Val{Tid: types.StringID, Value: "Alice"}},
+		{attr: "score", key: types.Val{Tid: types.FloatID, Value: 1.5}},
+		{attr: "active", key: types.Val{Tid: types.BoolID, Value: true}},
+	}
+	token, err := encodeGroupPageToken(keys)
+	require.NoError(t, err)
+	decoded, err := decodeGroupPageToken(token)
+	require.NoError(t, err)
+	require.Zero(t, compareGroupKeyOrder(keys, decoded))
+	_, offset := decoded[1].key.Value.(time.Time).Zone()
+	require.Equal(t, 5*3600, offset)
+
+	for _, token := range []string{"!", "bm90IGpzb24", base64.RawURLEncoding.EncodeToString(
+		[]byte(`{"keys":[{"attr":"friend","type":7,"value":"AQ"}]}`))} {
+		_, err := decodeGroupPageToken(token)
+		require.Error(t, err, token)
+		require.Contains(t, err.Error(), "Invalid after token in groupby", token)
+	}
+}
+
+func TestDistinctKeys(t *testing.T) {
+	group := func(name string, age int64, uids ...uint64) *groupResult {
+		return &groupResult{uids: uids, keys: []groupPair{
+			{attr: "name", key: types.Val{Tid: types.StringID, Value: name}},
+			{attr: "age", key: types.Val{Tid: types.IntID, Value: age}},
+		}}
+	}
+	res := &groupResults{group: []*groupResult{
+		group("Bob", 25, 1, 2, 3),
+		group("Alice", 75, 4),
+		group("Bob", 25, 5),
+		group("Alice", 25, 6, 7),
+		group("Alice", 75, 8, 9),
+	}}
+	require.NoError(t, res.distinctKeys())
+
+	type tuple struct {
+		name string
+		age  int64
+	}
+	var tuples []tuple
+	for _, grp := range res.group {
+		tuples = append(tuples, tuple{grp.keys[0].key.Value.(string),
+			grp.keys[1].key.Value.(int64)})
+	}
+	require.Equal(t, []tuple{{"Alice", 25}, {"Alice", 75}, {"Bob", 25}}, tuples)
+}
+
+func TestGroupByTrimmedMean(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name) {
+				trimmedmean(age, 0.34)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Colin","trimmedmean(age)":25},
+		{"name":"Bob","trimmedmean(age)":50},
+		{"name":"Elizabeth","trimmedmean(age)":50},
+		{"name":"Alice","trimmedmean(age)":75}]}]}}`, js)
+}
+
+func TestGroupByTrimmedMeanNoTrim(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10001, 10003, 10005, 10007)) @groupby(name) {
+				trimmedmean(age, 0)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Bob","trimmedmean(age)":50},
+		{"name":"Elizabeth","trimmedmean(age)":50}]}]}}`, js)
+}
+
+func TestGroupByTrimmedMeanInvalidFraction(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002)) @groupby(name) {
+				trimmedmean(age, 0.5)
+			}
+		}
+	`
+	_, err := processQuery(context.Background(), t, query)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Trim fraction for trimmedmean must be in [0, 0.5)")
+}
+
+func TestGroupByHmeanGmean(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name) {
+				hmean(age)
+				gmean(age)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Colin","hmean(age)":25.000000,"gmean(age)":25.000000},
+		{"name":"Bob","hmean(age)":37.500000,"gmean(age)":43.301270},
+		{"name":"Elizabeth","hmean(age)":37.500000,"gmean(age)":43.301270},
+		{"name":"Alice","hmean(age)":45.000000,"gmean(age)":52.002096}]}]}}`, js)
+}
+
+func TestGroupByTopk(t *testing.T) {
+	query := `
+		{
+			var(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007)) {
+				a as age
+			}
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name) {
+				top as topk(uid, by: val(a), k: 2)
+			}
+			oldest(func: uid(top)) {
+				name
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Colin","topk(uid)":[{"uid":"0x2716"}]},
+		{"name":"Bob","topk(uid)":[{"uid":"0x2713"},{"uid":"0x2715"}]},
+		{"name":"Elizabeth","topk(uid)":[{"uid":"0x2711"},{"uid":"0x2717"}]},
+		{"name":"Alice","topk(uid)":[{"uid":"0x2712"},{"uid":"0x2714"}]}]}],
+		"oldest":[{"name":"Elizabeth"},{"name":"Alice"},{"name":"Bob"},{"name":"Alice"},
+		{"name":"Bob"},{"name":"Colin"},{"name":"Elizabeth"}]}}`, js)
+}
+
+func TestGroupByWpercentile(t *testing.T) {
+	query := `
+		{
+			var(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007)) {
+				a as age
+				w as math(a / 25)
+			}
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name) {
+				wpercentile(val(a), val(w), 40)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Colin","wpercentile(val(a))":25},
+		{"name":"Bob","wpercentile(val(a))":75},
+		{"name":"Elizabeth","wpercentile(val(a))":75},
+		{"name":"Alice","wpercentile(val(a))":75}]}]}}`, js)
+}
+
+func TestGroupByCountif(t *testing.T) {
+	query := `
+		{
+			var(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007)) {
+				a as age
+			}
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name) {
+				count(uid)
+				passed: countif(val(a), gt, 50)
+				countif(val(a), le, 25.5)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Colin","count":1,"passed":0,"countif(val(a))":1},
+		{"name":"Bob","count":2,"passed":1,"countif(val(a))":1},
+		{"name":"Elizabeth","count":2,"passed":1,"countif(val(a))":1},
+		{"name":"Alice","count":3,"passed":2,"countif(val(a))":1}]}]}}`, js)
+}
+
+func TestGroupByMedianuid(t *testing.T) {
+	query := `
+		{
+			var(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007)) {
+				a as age
+			}
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name) {
+				medianuid(val(a))
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	// Bob and Elizabeth have two nodes each, the one with the lower age is returned.
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Colin","medianuid(val(a))":"0x2716"},
+		{"name":"Bob","medianuid(val(a))":"0x2715"},
+		{"name":"Elizabeth","medianuid(val(a))":"0x2717"},
+		{"name":"Alice","medianuid(val(a))":"0x2712"}]}]}}`, js)
+}
+
+func TestGroupByP2percentile(t *testing.T) {
+	query := `
+		{
+			var(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007)) {
+				a as age
+			}
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name) {
+				p2percentile(val(a), 50)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	// The groups are small enough for the percentiles to be exact.
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Colin","p2percentile(val(a))":25.000000},
+		{"name":"Bob","p2percentile(val(a))":50.000000},
+		{"name":"Elizabeth","p2percentile(val(a))":50.000000},
+		{"name":"Alice","p2percentile(val(a))":75.000000}]}]}}`, js)
+}
+
+func TestP2percentileAggregator(t *testing.T) {
+	ag := aggregator{name: "p2percentile"}
+	require.NoError(t, ag.setArgs([]gql.Arg{{Value: "90"}}))
+	_, err := ag.Value()
+	require.Equal(t, ErrEmptyVal, err)
+
+	for i := 1; i <= 1000; i++ {
+		if i%2 == 0 {
+			ag.Apply(types.Val{Tid: types.IntID, Value: int64(i)})
+		} else {
+			ag.Apply(types.Val{Tid: types.FloatID, Value: float64(i)})
+		}
+	}
+	res, err := ag.Value()
+	require.NoError(t, err)
+	require.Equal(t, types.FloatID, res.Tid)
+	require.InDelta(t, 900, res.Value.(float64), 5)
+
+	ag.Apply(types.Val{Tid: types.StringID, Value: "slow"})
+	_, err = ag.Value()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Only int and float values are allowed")
+
+	for _, arg := range []string{"", "-1", "100.5", "high"} {
+		ag := aggregator{name: "p2percentile"}
+		args := []gql.Arg{{Value: arg}}
+		if arg == "" {
+			args = nil
+		}
+		require.Error(t, ag.setArgs(args), arg)
+	}
+}
+
+func TestGroupByRange(t *testing.T) {
+	query := `
+		{
+			var(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007)) {
+				a as age
+			}
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name) {
+				spread: range(val(a))
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	// The range of a group with a single value is 0.
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Colin","spread":0},
+		{"name":"Bob","spread":50},
+		{"name":"Elizabeth","spread":50},
+		{"name":"Alice","spread":50}]}]}}`, js)
+}
+
+func TestRangeAggregator(t *testing.T) {
+	intVal := func(v int64) types.Val { return types.Val{Tid: types.IntID, Value: v} }
+	floatVal := func(v float64) types.Val { return types.Val{Tid: types.FloatID, Value: v} }
+	child := &SubGraph{
+		SrcFunc: &Function{Name: "range", IsValueVar: true},
+		Params: params{UidToVal: map[uint64]types.Val{
+			1: intVal(20),
+			2: floatVal(-1.5),
+			3: intVal(7),
+			4: floatVal(12.25),
+			5: intVal(math.MinInt64),
+			6: intVal(math.MaxInt64),
+			7: {Tid: types.StringID, Value: "warm"},
+		}},
+	}
+	rangeOf := func(uids ...uint64) (types.Val, error) {
+		ag, err := aggregateGroup(&groupResult{uids: uids}, child, nil)
+		require.NoError(t, err)
+		return ag.Value()
+	}
+
+	for _, tc := range []struct {
+		uids []uint64
+		want types.Val
+	}{
+		// The range of ints is an int, and a float as soon as one of the extremes is a float.
+		{[]uint64{1, 3}, intVal(13)},
+		{[]uint64{1, 2, 3}, floatVal(21.5)},
+		{[]uint64{2, 4}, floatVal(13.75)},
+		{[]uint64{1, 3, 4}, intVal(13)},
+		// A single value has a range of 0, of its own type.
+		{[]uint64{3}, intVal(0)},
+		{[]uint64{4}, floatVal(0)},
+		// A range that doesn't fit in an int is returned as a float.
+		{[]uint64{5, 6}, floatVal(float64(math.MaxInt64) - float64(math.MinInt64))},
+	} {
+		res, err := rangeOf(tc.uids...)
+		require.NoError(t, err, tc.uids)
+		require.Equal(t, tc.want, res, tc.uids)
+	}
+
+	// The nodes without a value are left out, and a group without any has no range.
+	_, err := rangeOf(8, 9)
+	require.Equal(t, ErrEmptyVal, err)
+	res, err := rangeOf(1, 8, 3)
+	require.NoError(t, err)
+	require.Equal(t, intVal(13), res)
+
+	_, err = rangeOf(1, 7)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Only int and float values are allowed")
+}
+
+func TestGroupByDailyActiveUsers(t *testing.T) {
+	query := `
+		{
+			me(func: has(visited_at)) @groupby(day: visited_at, by: day) {
+				visits: count(uid)
+				dau: countdistinct(visitor)
+				approx: countdistinct(visitor, hll)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"day":"2020-06-03T00:00:00Z","visits":1,"dau":1,"approx":1},
+		{"day":"2020-06-01T00:00:00Z","visits":3,"dau":2,"approx":2},
+		{"day":"2020-06-02T00:00:00Z","visits":4,"dau":3,"approx":3}]}]}}`, js)
+}
+
+func TestTopkGroup(t *testing.T) {
+	intVal := func(v int64) types.Val { return types.Val{Tid: types.IntID, Value: v} }
+	child := &SubGraph{
+		SrcFunc: &Function{Name: "topk", Args: []gql.Arg{{Value: "2"}}},
+		Params: params{UidToVal: map[uint64]types.Val{
+			1: intVal(10),
+			2: intVal(30),
+			3: intVal(20),
+			4: intVal(30),
+			5: intVal(30),
+		}},
+	}
+
+	uids, err := topkGroup(&groupResult{uids: []uint64{1, 2, 3, 4, 5, 6}}, child)
+	require.NoError(t, err)
+	// Ties are broken by uid.
+	require.Equal(t, []uint64{2, 4}, uids)
+
+	uids, err = topkGroup(&groupResult{uids: []uint64{1, 3, 6}}, child)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{3, 1}, uids)
+
+	_, err = topkGroup(&groupResult{uids: []uint64{6, 7}}, child)
+	require.Equal(t, ErrEmptyVal, err)
+
+	child.Params.UidToVal[6] = types.Val{Tid: types.FloatID, Value: 1.5}
+	_, err = topkGroup(&groupResult{uids: []uint64{1, 6}}, child)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "topk can only rank values of the same type")
+}
+
+func TestGroupByTiers(t *testing.T) {
+	query := `
+		{
+			me(func: uid(1, 23, 24, 25, 31, 10000, 10001)) @groupby(age, tiers: [15, 19, 38]) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"age":"[15, 19)","count":3},
+		{"age":"[19, 38]","count":3}]}]}}`, js)
+}
+
+func TestGroupByTiersWithOutliers(t *testing.T) {
+	query := `
+		{
+			me(func: uid(1, 23, 24, 25, 31, 10000, 10001))
+				@groupby(age, tiers: [16, 19, 38], outliers: true) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"age":"> 38","count":1},
+		{"age":"[16, 19)","count":1},
+		{"age":"< 16","count":2},
+		{"age":"[19, 38]","count":3}]}]}}`, js)
+}
+
+func TestTierKey(t *testing.T) {
+	tiers := &gql.GroupbyTiers{Bounds: []float64{0, 50, 80, 100}}
+	tests := []struct {
+		in  float64
+		key string
+		ok  bool
+	}{
+		{in: 0, key: "[0, 50)", ok: true},
+		{in: 49.99, key: "[0, 50)", ok: true},
+		{in: 50, key: "[50, 80)", ok: true},
+		{in: 80, key: "[80, 100]", ok: true},
+		{in: 100, key: "[80, 100]", ok: true},
+		{in: -0.5, key: "< 0", ok: false},
+		{in: 100.5, key: "> 100", ok: false},
+		{in: math.NaN(), key: "", ok: false},
+	}
+	for _, tc := range tests {
+		key, ok := tierKey(tiers, tc.in)
+		require.Equal(t, tc.key, key, "%v", tc.in)
+		require.Equal(t, tc.ok, ok, "%v", tc.in)
+	}
+
+	tiers.Outliers = true
+	key, ok := tierKey(tiers, -0.5)
+	require.True(t, ok)
+	require.Equal(t, "< 0", key)
+
+	var d dedup
+	d.tiers = &gql.GroupbyTiers{Bounds: []float64{1.5, 2.5}}
+	d.addValue("score", "", types.Val{Tid: types.IntID, Value: int64(2)}, 1)
+	d.addValue("score", "", types.Val{Tid: types.FloatID, Value: 2.5}, 2)
+	d.addValue("score", "", types.Val{Tid: types.IntID, Value: int64(3)}, 3)
+	require.Len(t, d.groups, 1)
+	require.Len(t, d.groups[0].elements, 1)
+	require.Equal(t, []uint64{1, 2}, d.groups[0].elements["[1.5, 2.5]"].entities.Uids)
+}
+
+func TestGroupByDistinctValues(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(age) {
+				distinctvalues(name, 3)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"age":25,"distinctvalues(name)":["Alice","Bob","Colin"],
+			"distinctvalues(name)_truncated":true},
+		{"age":75,"distinctvalues(name)":["Alice","Bob","Elizabeth"],
+			"distinctvalues(name)_truncated":false}]}]}}`, js)
+}
+
+func TestDistinctValuesAggregator(t *testing.T) {
+	strVal := func(v string) types.Val { return types.Val{Tid: types.StringID, Value: v} }
+	ag := aggregator{name: "distinctvalues"}
+	require.NoError(t, ag.setArgs([]gql.Arg{{Value: "2"}}))
+	_, _, err := ag.distinctValues()
+	require.Equal(t, ErrEmptyVal, err)
+
+	ag.Apply(strVal("open"))
+	ag.Apply(strVal("closed"))
+	ag.Apply(strVal("open"))
+	vals, truncated, err := ag.distinctValues()
+	require.NoError(t, err)
+	require.False(t, truncated)
+	require.Equal(t, []types.Val{strVal("closed"), strVal("open")}, vals)
+
+	ag.Apply(strVal("pending"))
+	ag.Apply(strVal("closed"))
+	vals, truncated, err = ag.distinctValues()
+	require.NoError(t, err)
+	require.True(t, truncated)
+	require.Equal(t, []types.Val{strVal("closed"), strVal("open")}, vals)
+
+	for _, args := range [][]gql.Arg{nil, {{Value: "0"}}, {{Value: "many"}}} {
+		ag := aggregator{name: "distinctvalues"}
+		require.Error(t, ag.setArgs(args))
+	}
+}
+
+func TestMeanAggregators(t *testing.T) {
+	apply := func(name string, vals ...types.Val) (types.Val, error) {
+		ag := aggregator{name: name}
+		if err := ag.setArgs(nil); err != nil {
+			return types.Val{}, err
+		}
+		for _, val := range vals {
+			ag.Apply(val)
+		}
+		return ag.Value()
+	}
+	intVal := func(v int64) types.Val { return types.Val{Tid: types.IntID, Value: v} }
+	floatVal := func(v float64) types.Val { return types.Val{Tid: types.FloatID, Value: v} }
+
+	res, err := apply("hmean", intVal(1), floatVal(4), intVal(4))
+	require.NoError(t, err)
+	require.Equal(t, types.Val{Tid: types.FloatID, Value: 2.0}, res)
+	res, err = apply("gmean", intVal(2), floatVal(8))
+	require.NoError(t, err)
+	require.Equal(t, types.FloatID, res.Tid)
+	require.InDelta(t, 4.0, res.Value, 1e-9)
+
+	for _, name := range []string{"hmean", "gmean"} {
+		_, err = apply(name)
+		require.Equal(t, ErrEmptyVal, err, name)
+		_, err = apply(name, types.Val{Tid: types.StringID, Value: "a"})
+		require.Error(t, err, name)
+		require.Contains(t, err.Error(), "Only int and float values are allowed", name)
+	}
+
+	_, err = apply("hmean", intVal(2), intVal(0))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "hmean is not defined for values equal to zero")
+	_, err = apply("hmean", intVal(2), intVal(-2))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "reciprocals add up to zero")
+	_, err = apply("gmean", intVal(2), floatVal(-0.5))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "gmean is only defined for positive values. Got: -0.5")
+}
+
+func TestGroupByGini(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name) {
+				gini(age)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Colin","gini(age)":0.000000},
+		{"name":"Bob","gini(age)":0.250000},
+		{"name":"Elizabeth","gini(age)":0.250000},
+		{"name":"Alice","gini(age)":0.190476}]}]}}`, js)
+}
+
+func TestGiniAggregator(t *testing.T) {
+	apply := func(vals ...types.Val) (types.Val, error) {
+		ag := aggregator{name: "gini"}
+		require.NoError(t, ag.setArgs(nil))
+		for _, val := range vals {
+			ag.Apply(val)
+		}
+		return ag.Value()
+	}
+	intVal := func(v int64) types.Val { return types.Val{Tid: types.IntID, Value: v} }
+	floatVal := func(v float64) types.Val { return types.Val{Tid: types.FloatID, Value: v} }
+
+	// Empty and single-value groups, and groups of zeros, have no inequality.
+	for _, vals := range [][]types.Val{nil, {intVal(40)}, {intVal(0), floatVal(0)}} {
+		res, err := apply(vals...)
+		require.NoError(t, err)
+		require.Equal(t, types.Val{Tid: types.FloatID, Value: 0.0}, res)
+	}
+
+	res, err := apply(intVal(10), floatVal(10), intVal(10))
+	require.NoError(t, err)
+	require.InDelta(t, 0.0, res.Value, 1e-9)
+	res, err = apply(intVal(0), intVal(0), intVal(0), floatVal(100))
+	require.NoError(t, err)
+	require.InDelta(t, 0.75, res.Value, 1e-9)
+	res, err = apply(intVal(5), intVal(1), intVal(3), intVal(2), intVal(4))
+	require.NoError(t, err)
+	require.Equal(t, types.FloatID, res.Tid)
+	require.InDelta(t, 4.0/15, res.Value, 1e-9)
+
+	_, err = apply(intVal(2), intVal(-1))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "gini is only defined for non-negative values. Got: -1")
+	_, err = apply(intVal(2), types.Val{Tid: types.StringID, Value: "a"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Only int and float values are allowed")
+}
+
+func TestGroupBySem(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name) {
+				sem(age)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Colin","sem(age)":0.000000},
+		{"name":"Bob","sem(age)":25.000000},
+		{"name":"Elizabeth","sem(age)":25.000000},
+		{"name":"Alice","sem(age)":16.666667}]}]}}`, js)
+}
+
+func TestSemAggregator(t *testing.T) {
+	apply := func(vals ...types.Val) (types.Val, error) {
+		ag := aggregator{name: "sem"}
+		require.NoError(t, ag.setArgs(nil))
+		for _, val := range vals {
+			ag.Apply(val)
+		}
+		return ag.Value()
+	}
+	intVal := func(v int64) types.Val { return types.Val{Tid: types.IntID, Value: v} }
+	floatVal := func(v float64) types.Val { return types.Val{Tid: types.FloatID, Value: v} }
+
+	_, err := apply()
+	require.Equal(t, ErrEmptyVal, err)
+	res, err := apply(intVal(40))
+	require.NoError(t, err)
+	require.Equal(t, types.Val{Tid: types.FloatID, Value: 0.0}, res)
+
+	// The sample standard deviation of 2, 4, 4, 4, 5, 5, 7, 9 is sqrt(32/7).
+	res, err = apply(intVal(2), floatVal(4), intVal(4), intVal(4), floatVal(5), intVal(5),
+		intVal(7), intVal(9))
+	require.NoError(t, err)
+	require.Equal(t, types.FloatID, res.Tid)
+	require.InDelta(t, math.Sqrt(32.0/7)/math.Sqrt(8), res.Value, 1e-9)
+
+	_, err = apply(intVal(2), types.Val{Tid: types.StringID, Value: "a"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Only int and float values are allowed")
+}
+
+func TestCustomAggregator(t *testing.T) {
+	newSpread := func() CustomAggregator { return &SpreadAggregator{} }
+	require.NoError(t, RegisterAggregator("Spread", newSpread))
+	defer UnregisterAggregator("spread")
+	require.True(t, isAggregatorFn("spread"))
+	require.True(t, types.IsAggregator("spread"))
+	require.False(t, isBuiltinAggregatorFn("spread"))
+
+	// The names of the built-in functions and of the registered aggregators are taken.
+	for _, name := range []string{"spread", "sum", "range", "topk", "count", ""} {
+		require.Error(t, RegisterAggregator(name, newSpread), name)
+	}
+
+	apply := func(vals ...types.Val) (types.Val, error) {
+		ag := aggregator{name: "spread"}
+		require.NoError(t, ag.setArgs(nil))
+		require.NotNil(t, ag.custom)
+		for _, val := range vals {
+			ag.Apply(val)
+		}
+		return ag.Value()
+	}
+	intVal := func(v int64) types.Val { return types.Val{Tid: types.IntID, Value: v} }
+	floatVal := func(v float64) types.Val { return types.Val{Tid: types.FloatID, Value: v} }
+
+	_, err := apply()
+	require.Equal(t, ErrEmptyVal, err)
+	res, err := apply(intVal(7))
+	require.NoError(t, err)
+	require.Equal(t, types.Val{Tid: types.FloatID, Value: 0.0}, res)
+	// The values of other types are ignored by spread.
+	res, err = apply(intVal(7), floatVal(-1.5), types.Val{Tid: types.StringID, Value: "a"},
+		intVal(20))
+	require.NoError(t, err)
+	require.Equal(t, types.Val{Tid: types.FloatID, Value: 21.5}, res)
+
+	ag := aggregator{name: "spread"}
+	err = ag.setArgs([]gql.Arg{{Value: "1"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Aggregator spread doesn't accept any arguments")
+
+	// Every group gets its own instance of the aggregator.
+	intTaskValue := func(v int64) *pb.TaskValue {
+		out := types.ValueForType(types.BinaryID)
+		require.NoError(t, types.Marshal(intVal(v), &out))
+		return &pb.TaskValue{ValType: pb.Posting_ValType(types.IntID), Val: out.Value.([]byte)}
+	}
+	grp := &groupResult{uids: []uint64{1, 2}}
+	child := &SubGraph{
+		Attr:    "age",
+		SrcFunc: &Function{Name: "spread"},
+		SrcUIDs: &pb.List{Uids: []uint64{1, 2, 3}},
+		valueMatrix: []*pb.ValueList{
+			{Values: []*pb.TaskValue{intTaskValue(38)}},
+			{Values: []*pb.TaskValue{intTaskValue(15)}},
+			{Values: []*pb.TaskValue{intTaskValue(99)}},
+		},
+	}
+	first, err := aggregateGroup(grp, child, nil)
+	require.NoError(t, err)
+	second, err := aggregateGroup(&groupResult{uids: []uint64{3}}, child, nil)
+	require.NoError(t, err)
+	res, err = first.Value()
+	require.NoError(t, err)
+	require.Equal(t, types.Val{Tid: types.FloatID, Value: 23.0}, res)
+	res, err = second.Value()
+	require.NoError(t, err)
+	require.Equal(t, types.Val{Tid: types.FloatID, Value: 0.0}, res)
+
+	UnregisterAggregator("spread")
+	require.False(t, isAggregatorFn("spread"))
+	require.False(t, types.IsAggregator("spread"))
+
+	// An aggregator unregistered since the query was parsed is reported, not ignored.
+	ag = aggregator{name: "spread"}
+	err = ag.setArgs(nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `Unknown aggregator function "spread"`)
+	_, err = aggregateGroup(grp, child, nil)
+	require.Error(t, err)
+	err = (&aggregator{name: "spread", result: intVal(1)}).Apply(intVal(2))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `Unhandled aggregator function "spread"`)
+}
+
+func TestGroupByCv(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name) {
+				cv(age)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Colin","cv(age)":0.000000},
+		{"name":"Bob","cv(age)":0.500000},
+		{"name":"Elizabeth","cv(age)":0.500000},
+		{"name":"Alice","cv(age)":0.404061}]}]}}`, js)
+}
+
+func TestCvAggregator(t *testing.T) {
+	apply := func(vals ...float64) (types.Val, error) {
+		ag := aggregator{name: "cv"}
+		require.NoError(t, ag.setArgs(nil))
+		for _, val := range vals {
+			ag.Apply(types.Val{Tid: types.FloatID, Value: val})
+		}
+		return ag.Value()
+	}
+
+	// The population standard deviation of these values is 2 and their mean is 5.
+	res, err := apply(2, 4, 4, 4, 5, 5, 7, 9)
+	require.NoError(t, err)
+	require.Equal(t, types.FloatID, res.Tid)
+	require.InDelta(t, 0.4, res.Value, 1e-9)
+
+	// Uniform values on [0, 1) have a mean of 1/2 and a standard deviation of 1/sqrt(12).
+	vals := make([]float64, 0, 100000)
+	for i := 0; i < 100000; i++ {
+		vals = append(vals, float64(i)/100000)
+	}
+	res, err = apply(vals...)
+	require.NoError(t, err)
+	require.InDelta(t, 2/math.Sqrt(12), res.Value, 1e-4)
+
+	// Scaling the values doesn't change their coefficient of variation.
+	res, err = apply(20, 40, 40, 40, 50, 50, 70, 90)
+	require.NoError(t, err)
+	require.InDelta(t, 0.4, res.Value, 1e-9)
+
+	// Values that are all the same don't vary.
+	res, err = apply(3, 3, 3)
+	require.NoError(t, err)
+	require.InDelta(t, 0.0, res.Value, 1e-9)
+
+	// Ints and floats can be mixed.
+	ag := aggregator{name: "cv"}
+	require.NoError(t, ag.setArgs(nil))
+	ag.Apply(types.Val{Tid: types.IntID, Value: int64(1)})
+	ag.Apply(types.Val{Tid: types.FloatID, Value: 3.0})
+	res, err = ag.Value()
+	require.NoError(t, err)
+	require.InDelta(t, 0.5, res.Value, 1e-9)
+
+	_, err = apply()
+	require.Equal(t, ErrEmptyVal, err)
+	_, err = apply(-1, 1)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cv is not defined for values whose mean is zero")
+	ag = aggregator{name: "cv"}
+	require.NoError(t, ag.setArgs(nil))
+	ag.Apply(types.Val{Tid: types.StringID, Value: "a"})
+	_, err = ag.Value()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Only int and float values are allowed")
+}
+
+func TestGroupByTdigest(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name) {
+				tdigest(age, 100, 0.5, 1)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Colin","tdigest(age)_p50":25.000000,"tdigest(age)_p100":25.000000},
+		{"name":"Bob","tdigest(age)_p50":50.000000,"tdigest(age)_p100":75.000000},
+		{"name":"Elizabeth","tdigest(age)_p50":50.000000,"tdigest(age)_p100":75.000000},
+		{"name":"Alice","tdigest(age)_p50":75.000000,"tdigest(age)_p100":75.000000}]}]}}`, js)
+}
+
+func TestGroupByAny(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name) {
+				any(age)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	// The age of the member of each group with the lowest uid is returned.
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Colin","any(age)":25},
+		{"name":"Bob","any(age)":75},
+		{"name":"Elizabeth","any(age)":75},
+		{"name":"Alice","any(age)":25}]}]}}`, js)
+}
+
+func TestFirstLastAggregator(t *testing.T) {
+	strVal := func(v string) types.Val { return types.Val{Tid: types.StringID, Value: v} }
+	for name, want := range map[string]string{"first": "Alice", "last": "Colin"} {
+		ag := aggregator{name: name}
+		require.NoError(t, ag.setArgs(nil))
+		_, err := ag.Value()
+		require.Equal(t, ErrEmptyVal, err)
+
+		ag.Apply(strVal("Alice"))
+		ag.Apply(strVal("Bob"))
+		ag.Apply(strVal("Colin"))
+		res, err := ag.Value()
+		require.NoError(t, err)
+		require.Equal(t, strVal(want), res)
+	}
+}
+
+func TestAggregateGroupFacetOrder(t *testing.T) {
+	child := &SubGraph{
+		Attr:    "p",
+		SrcUIDs: &pb.List{Uids: []uint64{1, 2, 3}},
+	}
+	for _, uid := range child.SrcUIDs.Uids {
+		child.valueMatrix = append(child.valueMatrix,
+			&pb.ValueList{Values: []*pb.TaskValue{task.FromInt(10 * int(uid))}})
+	}
+	aggregate := func(grp *groupResult, name string) types.Val {
+		child.SrcFunc = &Function{Name: name}
+		ag, err := aggregateGroup(grp, child, nil)
+		require.NoError(t, err)
+		val, err := ag.Value()
+		require.NoError(t, err)
+		return val
+	}
+	intVal := func(v int64) types.Val { return types.Val{Tid: types.IntID, Value: v} }
+
+	// The members are in the order of the uids, unless the edges are ordered by a facet.
+	grp := &groupResult{uids: []uint64{1, 2, 3}}
+	require.Equal(t, intVal(10), aggregate(grp, "first"))
+	require.Equal(t, intVal(30), aggregate(grp, "last"))
+
+	grp.rank = map[uint64]int{2: 0, 3: 1, 1: 2}
+	require.Equal(t, intVal(20), aggregate(grp, "first"))
+	require.Equal(t, intVal(10), aggregate(grp, "last"))
+	// The other aggregators don't depend on the order of the members.
+	require.Equal(t, intVal(10), aggregate(grp, "min"))
+	require.Equal(t, []uint64{1, 2, 3}, grp.uids)
+}
+
+func TestGroupByPercent(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name, percent: true) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Colin","count":1,"percent":12.5},
+		{"name":"Bob","count":2,"percent":25},
+		{"name":"Elizabeth","count":2,"percent":25},
+		{"name":"Alice","count":3,"percent":37.5}]}]}}`, js)
+}
+
+func TestAddPercents(t *testing.T) {
+	group := func(attr string, uids ...uint64) *groupResult {
+		return &groupResult{keys: []groupPair{{attr: attr}}, uids: uids}
+	}
+	res := &groupResults{group: []*groupResult{
+		group("name", 1), group("name", 2), group("name", 3),
+		group("age", 1, 2), group("age", 3, 4, 5, 6, 7, 8),
+	}}
+	res.addPercents()
+
+	// The groups of each predicate add up to 100, up to the rounding of the floats.
+	var names float64
+	for _, grp := range res.group[:3] {
+		require.Len(t, grp.aggregates, 1)
+		require.Equal(t, "percent", grp.aggregates[0].attr)
+		require.Equal(t, types.FloatID, grp.aggregates[0].key.Tid)
+		names += grp.aggregates[0].key.Value.(float64)
+	}
+	require.InDelta(t, 100, names, 1e-9)
+	require.Equal(t, 25.0, res.group[3].aggregates[0].key.Value)
+	require.Equal(t, 75.0, res.group[4].aggregates[0].key.Value)
+}
+
+func TestGroupByMinMax(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name, minmax: "count") {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Colin","count":1,"count_normalized":0},
+		{"name":"Bob","count":2,"count_normalized":0.5},
+		{"name":"Elizabeth","count":2,"count_normalized":0.5},
+		{"name":"Alice","count":3,"count_normalized":1}]}]}}`, js)
+
+	query = `
+		{
+			me(func: uid(10000, 10001)) @groupby(name, minmax: "max(age)") {
+				count(uid)
+			}
+		}
+	`
+	_, err := processQuery(context.Background(), t, query)
+	require.Error(t, err)
+	require.Contains(t, err.Error(),
+		"Aggregate max(age) to normalize with minmax is not in the groupby block")
+}
+
+func TestGroupByCumulative(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name, cumulative: "sum(age)") {
+				count(uid)
+				sum(age)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Alice","count":3,"sum(age)":175,"sum(age)_cumulative":175},
+		{"name":"Bob","count":2,"sum(age)":100,"sum(age)_cumulative":275},
+		{"name":"Colin","count":1,"sum(age)":25,"sum(age)_cumulative":300},
+		{"name":"Elizabeth","count":2,"sum(age)":100,"sum(age)_cumulative":400}]}]}}`, js)
+
+	query = `
+		{
+			me(func: uid(10000, 10001)) @groupby(name, cumulative: "max(age)") {
+				count(uid)
+			}
+		}
+	`
+	_, err := processQuery(context.Background(), t, query)
+	require.Error(t, err)
+	require.Contains(t, err.Error(),
+		"Aggregate max(age) to accumulate with cumulative is not in the groupby block")
+}
+
+func TestAccumulateAggregate(t *testing.T) {
+	group := func(attr string, key int64, aggs ...groupPair) *groupResult {
+		return &groupResult{
+			keys:       []groupPair{{attr: attr, key: types.Val{Tid: types.IntID, Value: key}}},
+			aggregates: aggs,
+		}
+	}
+	sum := func(v interface{}) groupPair {
+		if i, ok := v.(int); ok {
+			return groupPair{attr: "sum", key: types.Val{Tid: types.IntID, Value: int64(i)}}
+		}
+		return groupPair{attr: "sum", key: types.Val{Tid: types.FloatID, Value: v}}
+	}
+	cumulative := func(grp *groupResult) interface{} {
+		agg := grp.aggregates[len(grp.aggregates)-1]
+		require.Equal(t, "sum_cumulative", agg.attr)
+		return agg.key.Value
+	}
+
+	// The groups are ordered by their keys before they're accumulated.
+	res := &groupResults{group: []*groupResult{
+		group("day", 3, sum(4)), group("day", 1, sum(1)), group("day", 2), group("day", 4, sum(2.5)),
+	}}
+	require.NoError(t, res.accumulateAggregate("sum"))
+	require.Equal(t, int64(1), cumulative(res.group[0]))
+	// The group without a value for the aggregate gets no companion.
+	require.Empty(t, res.group[1].aggregates)
+	require.Equal(t, int64(5), cumulative(res.group[2]))
+	require.Equal(t, 7.5, cumulative(res.group[3]))
+
+	// The groups of different predicates have separate totals, and an int total that
+	// overflows becomes a float.
+	res = &groupResults{group: []*groupResult{
+		group("a", 1, sum(math.MaxInt64)), group("a", 2, sum(1)), group("b", 1, sum(3)),
+	}}
+	require.NoError(t, res.accumulateAggregate("sum"))
+	require.Equal(t, int64(math.MaxInt64), cumulative(res.group[0]))
+	require.Equal(t, float64(math.MaxInt64)+1, cumulative(res.group[1]))
+	require.Equal(t, int64(3), cumulative(res.group[2]))
+
+	res = &groupResults{group: []*groupResult{group("a", 1, groupPair{attr: "min(name)",
+		key: types.Val{Tid: types.StringID, Value: "Alice"}})}}
+	err := res.accumulateAggregate("min(name)")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Only numeric aggregates can be accumulated with cumulative")
+}
+
+func TestGroupByCoverage(t *testing.T) {
+	// Out of the 8 nodes, Alice has 3 and Bob and Elizabeth 2, so the first two cover 62.5%.
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name, coverage: 0.5) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Alice","count":3,"coverage":0.375},
+		{"name":"Bob","count":2,"coverage":0.625}]}]}}`, js)
+
+	// Out of the total age of 400, Alice has 175 and Bob and Elizabeth 100.
+	query = `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name, coverage: 0.8, coverageBy: "sum(age)") {
+				sum(age)
+			}
+		}
+	`
+	js = processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Alice","sum(age)":175,"coverage":0.4375},
+		{"name":"Bob","sum(age)":100,"coverage":0.6875},
+		{"name":"Elizabeth","sum(age)":100,"coverage":0.9375}]}]}}`, js)
+
+	query = `
+		{
+			me(func: uid(10000, 10001)) @groupby(name, coverage: 0.8, coverageBy: "max(age)") {
+				count(uid)
+			}
+		}
+	`
+	_, err := processQuery(context.Background(), t, query)
+	require.Error(t, err)
+	require.Contains(t, err.Error(),
+		"Aggregate max(age) to measure the coverage by is not in the groupby block")
+}
+
+func TestCoverGroups(t *testing.T) {
+	group := func(key string, size int, aggs ...groupPair) *groupResult {
+		return &groupResult{
+			keys:       []groupPair{{attr: "k", key: types.Val{Tid: types.StringID, Value: key}}},
+			uids:       make([]uint64, size),
+			aggregates: aggs,
+		}
+	}
+	keys := func(res *groupResults) []string {
+		var keys []string
+		for _, grp := range res.group {
+			keys = append(keys, grp.keys[0].key.Value.(string))
+		}
+		return keys
+	}
+	coverage := func(grp *groupResult) float64 {
+		agg := grp.aggregates[len(grp.aggregates)-1]
+		require.Equal(t, "coverage", agg.attr)
+		return agg.key.Value.(float64)
+	}
+
+	// A Pareto distribution of 100 nodes, where two of the six groups hold 80% of them.
+	pareto := func() *groupResults {
+		return &groupResults{group: []*groupResult{
+			group("c", 10), group("f", 2), group("a", 50), group("d", 5), group("b", 30),
+			group("e", 3),
+		}}
+	}
+	res := pareto()
+	require.NoError(t, res.cover(0.8, ""))
+	require.Equal(t, []string{"a", "b"}, keys(res))
+	require.InDelta(t, 0.5, coverage(res.group[0]), 1e-12)
+	require.InDelta(t, 0.8, coverage(res.group[1]), 1e-12)
+
+	res = pareto()
+	require.NoError(t, res.cover(0.81, ""))
+	require.Equal(t, []string{"a", "b", "c"}, keys(res))
+	res = pareto()
+	require.NoError(t, res.cover(1, ""))
+	require.Equal(t, []string{"a", "b", "c", "d", "e", "f"}, keys(res))
+
+	// The shares can come from an aggregate, ties are broken by the keys and the groups that
+	// don't add to the total are dropped.
+	sum := func(v interface{}) groupPair {
+		if i, ok := v.(int); ok {
+			return groupPair{attr: "sum", key: types.Val{Tid: types.IntID, Value: int64(i)}}
+		}
+		return groupPair{attr: "sum", key: types.Val{Tid: types.FloatID, Value: v}}
+	}
+	res = &groupResults{group: []*groupResult{
+		group("z", 1, sum(2.5)), group("y", 9, sum(0)), group("x", 1, sum(5)), group("w", 9),
+		group("v", 1, sum(2.5)),
+	}}
+	require.NoError(t, res.cover(1, "sum"))
+	require.Equal(t, []string{"x", "v", "z"}, keys(res))
+	require.InDelta(t, 1, coverage(res.group[2]), 1e-12)
+
+	res = &groupResults{group: []*groupResult{group("a", 1, sum(-1))}}
+	err := res.cover(0.5, "sum")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "which is negative for a group")
+	res = &groupResults{group: []*groupResult{group("a", 1, groupPair{attr: "min(name)",
+		key: types.Val{Tid: types.StringID, Value: "Alice"}})}}
+	err = res.cover(0.5, "min(name)")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Only numeric aggregates can measure the coverage")
+
+	// The options ordering or paging the groups by their keys fail instead of being ignored,
+	// even if the query wasn't parsed.
+	for _, opts := range []gql.GroupbyOptions{
+		{Coverage: 0.8, Cumsum: "count"},
+		{Coverage: 0.8, PageSize: 2},
+		{Coverage: 0.8, After: "token"},
+		{Coverage: 0.8, Distinct: true},
+	} {
+		sg := &SubGraph{Params: params{Groupby: opts}}
+		_, err := sg.formResult(dedup{}, nil)
+		require.Error(t, err, "%+v", opts)
+		require.Contains(t, err.Error(), "coverage can't be specified along with distinct, "+
+			"cumulative, pageSize or after in groupby")
+	}
+}
+
+// aggregateFixture returns a groupby with the given number of sum children over groups of the
+// given size. The values of the nth child are n times the uids of the nodes.
+func aggregateFixture(numChildren, numGroups, groupSize int) (*SubGraph, *groupResults) {
+	var uids []uint64
+	res := &groupResults{}
+	for g := 0; g < numGroups; g++ {
+		grp := &groupResult{}
+		for u := 0; u < groupSize; u++ {
+			uid := uint64(g*groupSize + u + 1)
+			grp.uids = append(grp.uids, uid)
+			uids = append(uids, uid)
+		}
+		res.group = append(res.group, grp)
+	}
+	sg := &SubGraph{}
+	for n := 1; n <= numChildren; n++ {
+		child := &SubGraph{
+			Attr:    fmt.Sprintf("p%d", n),
+			SrcFunc: &Function{Name: "sum"},
+			SrcUIDs: &pb.List{Uids: uids},
+		}
+		for _, uid := range uids {
+			child.valueMatrix = append(child.valueMatrix,
+				&pb.ValueList{Values: []*pb.TaskValue{task.FromInt(n * int(uid))}})
+		}
+		sg.Children = append(sg.Children, child)
+	}
+	return sg, res
+}
+
+func TestAggregateChildren(t *testing.T) {
+	// The small groupby is aggregated serially and the large one in parallel, both add the
+	// aggregates in the order of the children.
+	for _, groupSize := range []int{10, 1000} {
+		sg, res := aggregateFixture(20, 3, groupSize)
+		require.NoError(t, sg.aggregateChildren(res, nil))
+		for g, grp := range res.group {
+			require.Len(t, grp.aggregates, 20)
+			first := g*groupSize + 1
+			sum := int64((first + first + groupSize - 1) * groupSize / 2)
+			for n, agg := range grp.aggregates {
+				require.Equal(t, fmt.Sprintf("sum(p%d)", n+1), agg.attr)
+				require.Equal(t, types.Val{Tid: types.IntID, Value: int64(n+1) * sum}, agg.key)
+			}
+		}
+	}
+
+	// The error of the first child that fails is returned.
+	sg, res := aggregateFixture(20, 3, 1000)
+	sg.Children[5] = &SubGraph{Attr: "name", Params: params{DoCount: true}}
+	sg.Children[12].SrcFunc.Args = []gql.Arg{{Value: "1"}}
+	err := sg.aggregateChildren(res, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Only uid predicate is allowed in count within groupby")
+}
+
+func BenchmarkAggregateChildren(b *testing.B) {
+	for _, groupSize := range []int{100, 10000} {
+		b.Run(fmt.Sprintf("groupSize=%d", groupSize), func(b *testing.B) {
+			sg, res := aggregateFixture(20, 10, groupSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, grp := range res.group {
+					grp.aggregates = grp.aggregates[:0]
+				}
+				if err := sg.aggregateChildren(res, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizeAggregate(t *testing.T) {
+	group := func(aggs ...groupPair) *groupResult {
+		return &groupResult{aggregates: aggs}
+	}
+	avg := func(f float64) groupPair {
+		return groupPair{attr: "avg", key: types.Val{Tid: types.FloatID, Value: f}}
+	}
+	res := &groupResults{group: []*groupResult{
+		group(avg(10)), group(avg(20)), group(avg(15)), group(),
+	}}
+	require.NoError(t, res.normalizeAggregate("avg"))
+	normalized := func(grp *groupResult) interface{} {
+		return grp.aggregates[len(grp.aggregates)-1].key.Value
+	}
+	require.Equal(t, 0.0, normalized(res.group[0]))
+	require.Equal(t, 1.0, normalized(res.group[1]))
+	require.Equal(t, 0.5, normalized(res.group[2]))
+	require.Equal(t, "avg_normalized", res.group[2].aggregates[1].attr)
+	// The group without a value for the aggregate gets no companion.
+	require.Empty(t, res.group[3].aggregates)
+
+	// All the groups are normalized to 0 if they have the same value.
+	res = &groupResults{group: []*groupResult{group(avg(7)), group(avg(7))}}
+	require.NoError(t, res.normalizeAggregate("avg"))
+	require.Equal(t, 0.0, normalized(res.group[1]))
+
+	res = &groupResults{group: []*groupResult{group(groupPair{attr: "min(name)",
+		key: types.Val{Tid: types.StringID, Value: "Alice"}})}}
+	err := res.normalizeAggregate("min(name)")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Only numeric aggregates can be normalized with minmax")
+}
+
+func TestGroupByMinSize(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name, age, minSize: 2) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Alice","age":75,"count":2}]}]}}`, js)
+}
+
+func TestFormGroupsMinSize(t *testing.T) {
+	strVal := func(v string) types.Val { return types.Val{Tid: types.StringID, Value: v} }
+	d := dedup{minSize: 2}
+	for i, color := range []string{"red", "red", "red", "blue", "blue"} {
+		d.addValue("color", "", strVal(color), uint64(i+1))
+	}
+	for i, size := range []string{"S", "S", "L", "S", "L"} {
+		d.addValue("size", "", strVal(size), uint64(i+1))
+	}
+
+	// Of the four combinations, only red and S has more than one member.
+	res := new(groupResults)
+	res.formGroups(d, &pb.List{}, []groupPair{})
+	require.Len(t, res.group, 1)
+	require.Equal(t, []uint64{1, 2}, res.group[0].uids)
+	require.Equal(t, strVal("red"), res.group[0].keys[0].key)
+	require.Equal(t, strVal("S"), res.group[0].keys[1].key)
+
+	d.minSize = 0
+	res = new(groupResults)
+	res.formGroups(d, &pb.List{}, []groupPair{})
+	require.Len(t, res.group, 4)
+}
+
+func TestGroupByMath(t *testing.T) {
+	query := `
+		{
+			var(func: uid(10000, 10001, 10002, 10003, 10005)) {
+				a as age
+			}
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(segment: math(cond(a < 50, "young", "old"))) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"segment":"young","count":2},
+		{"segment":"old","count":3}]}]}}`, js)
+}
+
+func TestEvalGroupbyMath(t *testing.T) {
+	intVal := func(v int64) types.Val { return types.Val{Tid: types.IntID, Value: v} }
+	strVal := func(v string) types.Val { return types.Val{Tid: types.StringID, Value: v} }
+	child := &SubGraph{
+		SrcUIDs: &pb.List{Uids: []uint64{1, 2, 3, 4}},
+		Params: params{
+			Alias: "segment",
+			GroupbyMath: &mathTree{Fn: "cond", Child: []*mathTree{
+				{Fn: "<", Child: []*mathTree{{Var: "a"}, {Var: "b"}}},
+				{Const: strVal("lower")},
+				{Const: strVal("higher")},
+			}},
+		},
+	}
+	sg := &SubGraph{Children: []*SubGraph{child}}
+	doneVars := map[string]varValue{
+		"a": {Vals: map[uint64]types.Val{1: intVal(10), 2: intVal(30), 3: intVal(20)}},
+		"b": {Vals: map[uint64]types.Val{1: intVal(20), 2: intVal(20), 4: intVal(20)}},
+	}
+	require.NoError(t, sg.evalGroupbyMath(doneVars, nil))
+
+	// The nodes 3 and 4 miss one of the variables, so they're skipped.
+	require.Equal(t, map[uint64]types.Val{1: strVal("lower"), 2: strVal("higher")},
+		child.Params.UidToVal)
+	require.Len(t, doneVars["a"].Vals, 3)
+
+	var d dedup
+	d.addMathValues("segment", child, &pb.List{Uids: []uint64{2, 3, 4}})
+	require.Len(t, d.groups, 1)
+	require.Len(t, d.groups[0].elements, 1)
+	require.Equal(t, []uint64{2}, d.groups[0].elements["higher"].entities.Uids)
+}
+
+func TestGroupByCombine(t *testing.T) {
+	query := `
+		{
+			me(func: uid(1, 23, 31)) {
+				name
+				friend @groupby(age, combine: true) {
+					count(uid)
+				}
+			}
+		}
+	`
+	// The friends of all the nodes are grouped together, and Glenn Rhee, who is a friend of
+	// both Michonne and Andrea, is only counted once.
+	groups := `[{"@groupby":[{"age":17,"count":1},{"age":19,"count":1},{"age":38,"count":1},
+		{"age":15,"count":2}]}]`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"name":"Michonne","friend":`+groups+`},
+		{"name":"Rick Grimes","friend":`+groups+`},{"name":"Andrea","friend":`+groups+`}]}}`, js)
+}
+
+func TestGroupByValueVar(t *testing.T) {
+	// The nodes are grouped by the total age of their friends, computed in another block.
+	query := `
+		{
+			var(func: uid(1, 23, 31)) {
+				friend {
+					a as age
+				}
+				total as sum(val(a))
+			}
+			me(func: uid(1, 23, 31)) @groupby(val(total)) {
+				count(uid)
+			}
+			tiered(func: uid(1, 23, 31)) @groupby(total: val(total), tiers: [0, 50, 100]) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{
+		"me":[{"@groupby":[
+			{"val(total)":15,"count":1},
+			{"val(total)":38,"count":1},
+			{"val(total)":66,"count":1}]}],
+		"tiered":[{"@groupby":[
+			{"total":"[50, 100]","count":1},
+			{"total":"[0, 50)","count":2}]}]}}`, js)
+}
+
+func TestGroupByInVar(t *testing.T) {
+	// The nodes are grouped by whether they're friends of 1, and by whether they're in the
+	// value variable of the nodes younger than 18.
+	query := `
+		{
+			var(func: uid(1)) {
+				cohort as friend
+			}
+			var(func: uid(1, 23, 24, 25, 31)) @filter(lt(age, 18)) {
+				young as age
+			}
+			me(func: uid(1, 23, 24, 25, 31)) @groupby(in(val(cohort))) {
+				count(uid)
+			}
+			minors(func: uid(1, 23, 24, 25, 31)) @groupby(minor: in(val(young))) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{
+		"me":[{"@groupby":[
+			{"in(val(cohort))":false,"count":1},
+			{"in(val(cohort))":true,"count":4}]}],
+		"minors":[{"@groupby":[
+			{"minor":false,"count":2},
+			{"minor":true,"count":3}]}]}}`, js)
+}
+
+func TestGroupBySummary(t *testing.T) {
+	// The ages are 38, 15, 15, 17 and 19, so the nodes form a group of 2 and three of 1.
+	query := `
+		{
+			me(func: uid(1, 23, 24, 25, 31)) @groupby(age, summary: true, largerThan: 1) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{
+		"@groupby":[
+			{"age":17,"count":1},
+			{"age":19,"count":1},
+			{"age":38,"count":1},
+			{"age":15,"count":2}],
+		"@groupby_summary":{"groups":4,"avgSize":1.25,"minSize":1,"maxSize":2,
+			"largeGroups":1}}]}}`, js)
+
+	// The summary covers the groups of all the pages, and large groups are only counted
+	// with largerThan.
+	query = `
+		{
+			me(func: uid(1, 23, 24, 25, 31)) @groupby(age, summary: true, pageSize: 1) {
+				count(uid)
+			}
+		}
+	`
+	var res struct {
+		Data struct {
+			Me []struct {
+				Groups  []map[string]interface{} `json:"@groupby"`
+				Summary map[string]interface{}   `json:"@groupby_summary"`
+			} `json:"me"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(processQueryNoErr(t, query)), &res))
+	require.Len(t, res.Data.Me, 1)
+	require.Len(t, res.Data.Me[0].Groups, 1)
+	require.Equal(t, map[string]interface{}{
+		"groups": float64(4), "avgSize": 1.25, "minSize": float64(1), "maxSize": float64(2),
+	}, res.Data.Me[0].Summary)
+}
+
+func TestGroupSummarize(t *testing.T) {
+	res := &groupResults{}
+	for _, size := range []int{1, 150, 3, 220, 6} {
+		res.group = append(res.group, &groupResult{uids: make([]uint64, size)})
+	}
+	res.summarize(100)
+	summary := make(map[string]interface{})
+	for _, it := range res.summary {
+		summary[it.attr] = it.key.Value
+	}
+	require.Equal(t, map[string]interface{}{
+		"groups":      int64(5),
+		"avgSize":     float64(76),
+		"minSize":     int64(1),
+		"maxSize":     int64(220),
+		"largeGroups": int64(2),
+	}, summary)
+
+	// There's nothing to summarize without groups.
+	res = &groupResults{}
+	res.summarize(100)
+	require.Nil(t, res.summary)
+}
+
+func TestFillGroupbyIn(t *testing.T) {
+	child := &SubGraph{
+		SrcUIDs: &pb.List{Uids: []uint64{1, 2, 3, 4}},
+		Params:  params{GroupbyInVar: "cohort"},
+	}
+	sg := &SubGraph{Children: []*SubGraph{child}}
+	groups := func() map[bool][]uint64 {
+		var d dedup
+		d.addInValues("in", child, nil)
+		got := make(map[bool][]uint64)
+		for _, elem := range d.getGroup("in").elements {
+			got[elem.key.Value.(bool)] = elem.entities.Uids
+		}
+		return got
+	}
+
+	// The nodes of a uid variable.
+	require.NoError(t, sg.fillGroupbyVals(map[string]varValue{
+		"cohort": {Uids: &pb.List{Uids: []uint64{2, 4, 9}}}}))
+	require.Equal(t, map[bool][]uint64{true: {2, 4}, false: {1, 3}}, groups())
+
+	// The nodes a value variable has a value for.
+	intVal := types.Val{Tid: types.IntID, Value: int64(1)}
+	require.NoError(t, sg.fillGroupbyVals(map[string]varValue{
+		"cohort": {Vals: map[uint64]types.Val{3: intVal, 1: intVal}}}))
+	require.Equal(t, map[bool][]uint64{true: {1, 3}, false: {2, 4}}, groups())
+
+	// No node is in an empty variable.
+	require.NoError(t, sg.fillGroupbyVals(map[string]varValue{"cohort": {}}))
+	require.Equal(t, map[bool][]uint64{false: {1, 2, 3, 4}}, groups())
+
+	err := sg.fillGroupbyVals(map[string]varValue{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Variable cohort used in groupby is not defined")
+}
+
+func TestGroupByFacet(t *testing.T) {
+	// The nodes are grouped by the hour of the timestamp facet on their event edges. A node
+	// with several events in the same hour is counted once, and the edges without the facet
+	// are skipped.
+	query := `
+		{
+			me(func: uid(220, 221, 222)) @groupby(event, facet: timestamp, by: hour) {
+				count(uid)
+			}
+			weight(func: uid(220, 221, 222)) @groupby(w: event, facet: weight) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{
+		"me":[{"@groupby":[
+			{"event":"2020-06-01T11:00:00Z","count":1},
+			{"event":"2020-06-01T12:00:00Z","count":1},
+			{"event":"2020-06-01T10:00:00Z","count":2}]}],
+		"weight":[{"@groupby":[{"w":3,"count":1}]}]}}`, js)
+
+	// Only datetime facets can be truncated.
+	query = `
+		{
+			me(func: uid(220, 221, 222)) @groupby(event, facet: weight, by: hour) {
+				count(uid)
+			}
+		}
+	`
+	_, err := processQuery(context.Background(), t, query)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "The facet weight of predicate event must be a datetime")
+}
+
+func TestTruncateTime(t *testing.T) {
+	loc := time.FixedZone("", 5*3600+1800)
+	ts := time.Date(2020, time.June, 17, 10, 42, 31, 500, loc)
+	for unit, want := range map[string]time.Time{
+		"minute": time.Date(2020, time.June, 17, 10, 42, 0, 0, loc),
+		"hour":   time.Date(2020, time.June, 17, 10, 0, 0, 0, loc),
+		"day":    time.Date(2020, time.June, 17, 0, 0, 0, 0, loc),
+		"month":  time.Date(2020, time.June, 1, 0, 0, 0, 0, loc),
+		"year":   time.Date(2020, time.January, 1, 0, 0, 0, 0, loc),
+	} {
+		// The time is truncated in its own time zone.
+		require.True(t, want.Equal(truncateTime(ts, unit)), unit)
+		require.Equal(t, loc, truncateTime(ts, unit).Location(), unit)
+	}
+}
+
+func TestGroupByRelative(t *testing.T) {
+	// The dobs are 0 and 1 day, about 8 and 12 months, and 9 years before the reference.
+	query := `
+		{
+			me(func: uid(1, 23, 24, 25, 31))
+				@groupby(dob, relativeTo: "1910-01-02", buckets: [1d, 30d, 52w]) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"dob":"> 52w","count":1},
+		{"dob":"1d","count":2},
+		{"dob":"52w","count":2}]}]}}`, js)
+}
+
+func TestRelativeKey(t *testing.T) {
+	day := 24 * time.Hour
+	ref := time.Date(2020, time.June, 30, 12, 0, 0, 0, time.UTC)
+	rel := &gql.GroupbyRelative{
+		To:      ref,
+		Buckets: []time.Duration{7 * day, 30 * day, 90 * day},
+		Labels:  []string{"7d", "30d", "90d"},
+	}
+	tests := []struct {
+		age time.Duration
+		key string
+	}{
+		{age: 0, key: "7d"},
+		{age: 7 * day, key: "7d"},
+		{age: 7*day + time.Nanosecond, key: "30d"},
+		{age: 30 * day, key: "30d"},
+		{age: 90 * day, key: "90d"},
+		{age: 90*day + time.Second, key: "> 90d"},
+		{age: 400 * day, key: "> 90d"},
+		{age: -time.Second, key: "future"},
+	}
+	for _, tc := range tests {
+		require.Equal(t, tc.key, relativeKey(rel, ref.Add(-tc.age)), "%v", tc.age)
+	}
+
+	// The age doesn't depend on the time zone of the datetime.
+	loc := time.FixedZone("", -5*3600)
+	require.Equal(t, "7d", relativeKey(rel, ref.Add(-7*day).In(loc)))
+
+	// Only datetime keys are bucketed.
+	var d dedup
+	d.relative = rel
+	d.addValue("created", "", types.Val{Tid: types.DateTimeID, Value: ref.Add(-day)}, 1)
+	d.addValue("created", "", types.Val{Tid: types.IntID, Value: int64(5)}, 2)
+	require.Len(t, d.groups, 1)
+	require.Contains(t, d.groups[0].elements, "7d")
+	require.Contains(t, d.groups[0].elements, "5")
+
+	// now is resolved once to the current time.
+	resolved := resolveGroupbyOptions(gql.GroupbyOptions{Relative: &gql.GroupbyRelative{Now: true}})
+	require.False(t, resolved.Relative.Now)
+	require.WithinDuration(t, time.Now(), resolved.Relative.To, time.Minute)
+	require.Equal(t, rel, resolveGroupbyOptions(gql.GroupbyOptions{Relative: rel}).Relative)
+}
+
+func TestFillGroupbyVals(t *testing.T) {
+	intVal := func(v int64) types.Val { return types.Val{Tid: types.IntID, Value: v} }
+	child := &SubGraph{Params: params{GroupbyVar: "total"}}
+	sg := &SubGraph{Children: []*SubGraph{{Attr: "name"}, child}}
+
+	vals := map[uint64]types.Val{1: intVal(66), 23: intVal(38)}
+	require.NoError(t, sg.fillGroupbyVals(map[string]varValue{"total": {Vals: vals}}))
+	require.Equal(t, vals, child.Params.UidToVal)
+
+	err := sg.fillGroupbyVals(map[string]varValue{
+		"total": {Uids: &pb.List{Uids: []uint64{1}}, Vals: map[uint64]types.Val{}}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "total is a uid variable")
+
+	err = sg.fillGroupbyVals(map[string]varValue{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Variable total used in groupby is not defined")
+}
+
+func TestGroupByID(t *testing.T) {
+	groupIDs := func(query string) map[float64]string {
+		js := processQueryNoErr(t, query)
+		var res struct {
+			Data struct {
+				Me []struct {
+					Friend []struct {
+						Groups []struct {
+							GroupID string  `json:"groupId"`
+							Age     float64 `json:"age"`
+						} `json:"@groupby"`
+					} `json:"friend"`
+				} `json:"me"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(js), &res))
+		require.Len(t, res.Data.Me, 1)
+		require.Len(t, res.Data.Me[0].Friend, 1)
+		ids := make(map[float64]string)
+		for _, grp := range res.Data.Me[0].Friend[0].Groups {
+			require.Len(t, grp.GroupID, 32)
+			ids[grp.Age] = grp.GroupID
+		}
+		return ids
+	}
+
+	all := groupIDs(`{ me(func: uid(1)) { friend @groupby(age, groupId: true) { count(uid) } } }`)
+	require.Len(t, all, 3)
+	require.NotEqual(t, all[17], all[19])
+	// The groups keep their ids when they're formed again, even at other positions.
+	require.Equal(t, all, groupIDs(
+		`{ me(func: uid(1)) { friend @groupby(age, groupId: true) { count(uid) } } }`))
+	some := groupIDs(`{ me(func: uid(1)) {
+		friend @filter(uid(25, 31)) @groupby(age, groupId: true) { count(uid) } } }`)
+	require.Equal(t, map[float64]string{17: all[17], 19: all[19]}, some)
+}
+
+func TestGroupIDs(t *testing.T) {
+	intVal := func(v int64) types.Val { return types.Val{Tid: types.IntID, Value: v} }
+	strVal := func(v string) types.Val { return types.Val{Tid: types.StringID, Value: v} }
+	id := func(keys ...groupPair) string {
+		id, err := groupID(keys)
+		require.NoError(t, err)
+		return id
+	}
+
+	base := id(groupPair{attr: "age", key: intVal(15)}, groupPair{attr: "city", key: strVal("NY")})
+	require.Equal(t, base,
+		id(groupPair{attr: "age", key: intVal(15)}, groupPair{attr: "city", key: strVal("NY")}))
+	for _, other := range []string{
+		id(groupPair{attr: "age", key: intVal(16)}, groupPair{attr: "city", key: strVal("NY")}),
+		id(groupPair{attr: "city", key: strVal("NY")}, groupPair{attr: "age", key: intVal(15)}),
+		id(groupPair{attr: "age", key: strVal("15")}, groupPair{attr: "city", key: strVal("NY")}),
+		id(groupPair{attr: "age", key: intVal(15)},
+			groupPair{attr: "city", lang: "en", key: strVal("NY")}),
+		// The length of each field is hashed, so the fields can't run into each other.
+		id(groupPair{attr: "age", key: intVal(15)}, groupPair{attr: "cityN", key: strVal("Y")}),
+	} {
+		require.NotEqual(t, base, other)
+	}
+}
+
+func TestMergeDedups(t *testing.T) {
+	strVal := func(v string) types.Val { return types.Val{Tid: types.StringID, Value: v} }
+	var first, second dedup
+	first.addValue("color", "", strVal("red"), 1)
+	first.addValue("color", "", strVal("red"), 2)
+	first.addValue("size", "", strVal("S"), 1)
+	first.addValue("size", "", strVal("S"), 2)
+	// The second list has no color, so its dedup starts with size.
+	second.addValue("size", "", strVal("S"), 2)
+	second.addValue("size", "", strVal("L"), 3)
+
+	merged := mergeDedups([]dedup{second, first}, []string{"color", "size"})
+	require.Len(t, merged.groups, 2)
+	require.Equal(t, "color", merged.groups[0].attr)
+	require.Equal(t, "size", merged.groups[1].attr)
+	require.Equal(t, []uint64{1, 2}, merged.groups[0].elements["red"].entities.Uids)
+	require.Equal(t, []uint64{1, 2}, merged.groups[1].elements["S"].entities.Uids)
+	require.Equal(t, []uint64{3}, merged.groups[1].elements["L"].entities.Uids)
+	// The dedups that were merged are left as they were.
+	require.Equal(t, []uint64{2}, second.groups[0].elements["S"].entities.Uids)
+
+	res := new(groupResults)
+	res.formGroups(merged, &pb.List{}, []groupPair{})
+	require.Len(t, res.group, 1)
+	require.Equal(t, []uint64{1, 2}, res.group[0].uids)
+}
+
+func TestAnyAggregator(t *testing.T) {
+	strVal := func(v string) types.Val { return types.Val{Tid: types.StringID, Value: v} }
+	ag := aggregator{name: "any"}
+	require.NoError(t, ag.setArgs(nil))
+	_, err := ag.Value()
+	require.Equal(t, ErrEmptyVal, err)
+
+	ag.Apply(strVal("Alice"))
+	ag.Apply(strVal("Bob"))
+	res, err := ag.Value()
+	require.NoError(t, err)
+	require.Equal(t, strVal("Alice"), res)
+
+	ag = aggregator{name: "any"}
+	require.Error(t, ag.setArgs([]gql.Arg{{Value: "1"}}))
+}
+
+func TestTdigestAggregator(t *testing.T) {
+	ag := aggregator{name: "tdigest"}
+	require.NoError(t, ag.setArgs([]gql.Arg{{Value: "100"}, {Value: "0.5"}, {Value: "0.999"}}))
+	_, err := ag.tdigestQuantiles()
+	require.Equal(t, ErrEmptyVal, err)
+
+	for i := 1; i <= 1000; i++ {
+		if i%2 == 0 {
+			ag.Apply(types.Val{Tid: types.IntID, Value: int64(i)})
+		} else {
+			ag.Apply(types.Val{Tid: types.FloatID, Value: float64(i)})
+		}
+	}
+	quantiles, err := ag.tdigestQuantiles()
+	require.NoError(t, err)
+	require.Len(t, quantiles, 2)
+	require.Equal(t, "p50", quantiles[0].Name)
+	require.InDelta(t, 500.5, quantiles[0].Value.Value, 5)
+	require.Equal(t, "p99.9", quantiles[1].Name)
+	require.InDelta(t, 999.5, quantiles[1].Value.Value, 1)
+
+	_, err = ag.Value()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "tdigest is only allowed inside @groupby")
+
+	ag.Apply(types.Val{Tid: types.StringID, Value: "slow"})
+	_, err = ag.tdigestQuantiles()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Only int and float values are allowed")
+
+	for _, args := range [][]gql.Arg{
+		nil,
+		{{Value: "100"}},
+		{{Value: "5"}, {Value: "0.5"}},
+		{{Value: "high"}, {Value: "0.5"}},
+		{{Value: "100"}, {Value: "1.5"}},
+		{{Value: "100"}, {Value: "0.5"}, {Value: "0.50"}},
+	} {
+		ag := aggregator{name: "tdigest"}
+		require.Error(t, ag.setArgs(args))
+	}
+}
+
+func TestCompensatedSum(t *testing.T) {
+	floatVal := func(v float64) types.Val { return types.Val{Tid: types.FloatID, Value: v} }
+	sum := func(name string, n int) (float64, float64) {
+		ag := aggregator{name: name}
+		var naive float64
+		for i := 0; i < n; i++ {
+			ag.Apply(floatVal(0.1))
+			naive += 0.1
+		}
+		res, err := ag.Value()
+		require.NoError(t, err)
+		return res.Value.(float64), naive
+	}
+
+	// The naive sum of many values drifts from the exact one, unlike the compensated sum.
+	res, naive := sum("sum", 10000)
+	require.NotEqual(t, 1000.0, naive)
+	require.Equal(t, 1000.0, res)
+	res, _ = sum("avg", 10000)
+	require.Equal(t, 0.1, res)
+
+	// The small sums are returned as they're naively accumulated.
+	res, naive = sum("sum", 10)
+	require.Equal(t, naive, res)
+
+	// The rounding errors of an overflowing sum are ignored.
+	ag := aggregator{name: "sum"}
+	for i := 0; i <= compensatedSumThreshold; i++ {
+		ag.Apply(floatVal(math.MaxFloat64))
+	}
+	val, err := ag.Value()
+	require.NoError(t, err)
+	require.Equal(t, floatVal(math.MaxFloat64), val)
+}
+
+func TestWpercentileAggregator(t *testing.T) {
+	intVal := func(v int64) types.Val { return types.Val{Tid: types.IntID, Value: v} }
+	floatVal := func(v float64) types.Val { return types.Val{Tid: types.FloatID, Value: v} }
+	ag := aggregator{name: "wpercentile"}
+	require.NoError(t, ag.setArgs([]gql.Arg{{Value: "95"}}))
+	_, err := ag.Value()
+	require.Equal(t, ErrEmptyVal, err)
+
+	// Values with a zero weight don't count.
+	ag.applyWeighted(intVal(1000), intVal(0))
+	_, err = ag.Value()
+	require.Equal(t, ErrEmptyVal, err)
+
+	ag.applyWeighted(floatVal(200), intVal(4))
+	ag.applyWeighted(intVal(10), intVal(90))
+	ag.applyWeighted(intVal(50), floatVal(6))
+	res, err := ag.Value()
+	require.NoError(t, err)
+	require.Equal(t, floatVal(50), res)
+
+	ag = aggregator{name: "wpercentile"}
+	require.NoError(t, ag.setArgs([]gql.Arg{{Value: "100"}}))
+	ag.applyWeighted(intVal(10), floatVal(0.1))
+	ag.applyWeighted(intVal(20), floatVal(0.2))
+	res, err = ag.Value()
+	require.NoError(t, err)
+	require.Equal(t, floatVal(20), res)
+
+	ag.applyWeighted(intVal(30), intVal(-1))
+	_, err = ag.Value()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "can't be negative")
+
+	ag = aggregator{name: "wpercentile"}
+	require.NoError(t, ag.setArgs([]gql.Arg{{Value: "50"}}))
+	ag.applyWeighted(types.Val{Tid: types.StringID, Value: "slow"}, intVal(1))
+	_, err = ag.Value()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Only int and float values are allowed")
+
+	for _, args := range [][]gql.Arg{nil, {{Value: "-1"}}, {{Value: "100.5"}}, {{Value: "p95"}},
+		{{Value: "50"}, {Value: "95"}}} {
+		ag := aggregator{name: "wpercentile"}
+		require.Error(t, ag.setArgs(args))
+	}
+}
+
+func TestCountDistinctAggregator(t *testing.T) {
+	intVal := func(v int64) types.Val { return types.Val{Tid: types.IntID, Value: v} }
+	uidVal := func(v uint64) types.Val { return types.Val{Tid: types.UidID, Value: v} }
+	countDistinct := func(args []gql.Arg, budget *bufferBudget,
+		vals ...types.Val) (types.Val, error) {
+		ag := aggregator{name: "countdistinct", budget: budget}
+		require.NoError(t, ag.setArgs(args))
+		for _, v := range vals {
+			ag.Apply(v)
+		}
+		return ag.Value()
+	}
+
+	res, err := countDistinct(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, intVal(0), res)
+
+	vals := []types.Val{uidVal(1), uidVal(2), uidVal(1), uidVal(3), uidVal(2)}
+	res, err = countDistinct(nil, nil, vals...)
+	require.NoError(t, err)
+	require.Equal(t, intVal(3), res)
+	res, err = countDistinct([]gql.Arg{{Value: "hll"}}, nil, vals...)
+	require.NoError(t, err)
+	require.Equal(t, intVal(3), res)
+
+	res, err = countDistinct(nil, nil, types.Val{Tid: types.StringID, Value: "a"},
+		types.Val{Tid: types.StringID, Value: "b"}, types.Val{Tid: types.StringID, Value: "a"})
+	require.NoError(t, err)
+	require.Equal(t, intVal(2), res)
+
+	// The keys of the distinct values count towards the buffer limit, unless hll is used.
+	_, err = countDistinct(nil, &bufferBudget{limit: 2}, vals...)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Aggregators in groupby can buffer at most 2 values")
+	res, err = countDistinct([]gql.Arg{{Value: "hll"}}, &bufferBudget{limit: 2}, vals...)
+	require.NoError(t, err)
+	require.Equal(t, intVal(3), res)
+
+	for _, args := range [][]gql.Arg{{{Value: "exact"}}, {{Value: "hll"}, {Value: "hll"}}} {
+		ag := aggregator{name: "countdistinct"}
+		require.Error(t, ag.setArgs(args))
+	}
+}
+
+func TestSumDistinctAggregator(t *testing.T) {
+	intVal := func(v int64) types.Val { return types.Val{Tid: types.IntID, Value: v} }
+	floatVal := func(v float64) types.Val { return types.Val{Tid: types.FloatID, Value: v} }
+	sumDistinct := func(budget *bufferBudget, vals ...types.Val) (types.Val, error) {
+		ag := aggregator{name: "sumdistinct", budget: budget}
+		require.NoError(t, ag.setArgs(nil))
+		for _, v := range vals {
+			ag.Apply(v)
+		}
+		return ag.Value()
+	}
+
+	_, err := sumDistinct(nil)
+	require.Equal(t, ErrEmptyVal, err)
+
+	// The repeated amounts are only counted once.
+	res, err := sumDistinct(nil, intVal(120), intVal(80), intVal(120), intVal(35), intVal(80))
+	require.NoError(t, err)
+	require.Equal(t, intVal(235), res)
+	res, err = sumDistinct(nil, floatVal(9.5), floatVal(0.25), floatVal(9.5))
+	require.NoError(t, err)
+	require.Equal(t, floatVal(9.75), res)
+	res, err = sumDistinct(nil, intVal(2), floatVal(0.5), intVal(2))
+	require.NoError(t, err)
+	require.Equal(t, floatVal(2.5), res)
+
+	// The sum becomes a float rather than wrapping around when it overflows.
+	res, err = sumDistinct(nil, intVal(math.MaxInt64), intVal(1), intVal(math.MaxInt64))
+	require.NoError(t, err)
+	require.Equal(t, floatVal(float64(math.MaxInt64)+1), res)
+	res, err = sumDistinct(nil, intVal(math.MinInt64), intVal(-1))
+	require.NoError(t, err)
+	require.Equal(t, floatVal(float64(math.MinInt64)-1), res)
+
+	// The keys of the distinct values count towards the buffer limit.
+	_, err = sumDistinct(&bufferBudget{limit: 2}, intVal(1), intVal(2), intVal(1), intVal(3))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Aggregators in groupby can buffer at most 2 values")
+
+	_, err = sumDistinct(nil, intVal(2), types.Val{Tid: types.StringID, Value: "a"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Only int and float values are allowed")
+}
+
+func TestCountifAggregator(t *testing.T) {
+	intVal := func(v int64) types.Val { return types.Val{Tid: types.IntID, Value: v} }
+	countif := func(cmp, threshold string, vals ...types.Val) (types.Val, error) {
+		ag := aggregator{name: "countif"}
+		require.NoError(t, ag.setArgs([]gql.Arg{{Value: cmp}, {Value: threshold}}))
+		for _, v := range vals {
+			ag.Apply(v)
+		}
+		return ag.Value()
+	}
+
+	// Unlike the other aggregators, countif has a result even if no value was applied.
+	res, err := countif("gt", "80")
+	require.NoError(t, err)
+	require.Equal(t, intVal(0), res)
+
+	scores := []types.Val{intVal(70), intVal(80), intVal(90)}
+	for cmp, want := range map[string]int64{
+		"eq": 1, "ne": 2, "lt": 1, "le": 2, "gt": 1, "ge": 2,
+	} {
+		res, err := countif(cmp, "80", scores...)
+		require.NoError(t, err, cmp)
+		require.Equal(t, intVal(want), res, cmp)
+	}
+
+	// Int values are compared with fractional thresholds as floats.
+	res, err = countif("gt", "79.5", scores...)
+	require.NoError(t, err)
+	require.Equal(t, intVal(2), res)
+
+	res, err = countif("eq", "A", types.Val{Tid: types.StringID, Value: "A"},
+		types.Val{Tid: types.StringID, Value: "B"})
+	require.NoError(t, err)
+	require.Equal(t, intVal(1), res)
+
+	_, err = countif("gt", "high", scores...)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `The value "high" of countif can't be compared`)
+
+	for _, args := range [][]gql.Arg{nil, {{Value: "gt"}}, {{Value: "above"}, {Value: "1"}},
+		{{Value: "gt"}, {Value: "1"}, {Value: "2"}}} {
+		ag := aggregator{name: "countif"}
+		require.Error(t, ag.setArgs(args))
+	}
+
+	// The threshold is converted once by setArgs rather than for every value.
+	ag := aggregator{name: "countif"}
+	require.NoError(t, ag.setArgs([]gql.Arg{{Value: "gt"}, {Value: "79.5"}}))
+	state := ag.state.(*countifState)
+	require.Equal(t, types.Val{Tid: types.FloatID, Value: 79.5}, state.thresholds[types.IntID])
+	require.Equal(t, types.Val{Tid: types.FloatID, Value: 79.5}, state.thresholds[types.FloatID])
+	_, ok := state.thresholds[types.DateTimeID]
+	require.False(t, ok)
+
+	// The state of an aggregator is created along with its arguments.
+	ag = aggregator{name: "countif"}
+	err = ag.Apply(intVal(1))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Aggregator countif is applied before its arguments are set")
+}
+
+func TestMedianuidAggregator(t *testing.T) {
+	intVal := func(v int64) types.Val { return types.Val{Tid: types.IntID, Value: v} }
+	uidVal := func(v uint64) types.Val { return types.Val{Tid: types.UidID, Value: v} }
+	medianuid := func(vals map[uint64]types.Val) (types.Val, error) {
+		ag := aggregator{name: "medianuid"}
+		require.NoError(t, ag.setArgs(nil))
+		for uid, v := range vals {
+			ag.applyMedianuid(v, uid)
+		}
+		return ag.Value()
+	}
+
+	_, err := medianuid(nil)
+	require.Equal(t, ErrEmptyVal, err)
+
+	res, err := medianuid(map[uint64]types.Val{1: intVal(30), 2: intVal(10), 3: intVal(20)})
+	require.NoError(t, err)
+	require.Equal(t, uidVal(3), res)
+
+	// The lower median is returned for an even number of values, and ties are broken by uid.
+	res, err = medianuid(map[uint64]types.Val{
+		1: intVal(40), 2: intVal(10), 3: intVal(20), 4: intVal(30)})
+	require.NoError(t, err)
+	require.Equal(t, uidVal(3), res)
+	res, err = medianuid(map[uint64]types.Val{7: intVal(5), 4: intVal(5), 9: intVal(5)})
+	require.NoError(t, err)
+	require.Equal(t, uidVal(7), res)
+
+	_, err = medianuid(map[uint64]types.Val{
+		1: intVal(1), 2: {Tid: types.StringID, Value: "a"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "medianuid can only sort values of the same type")
+}
+
+func TestGroupByGroupConcat(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(age) {
+				groupconcat(name, ", ")
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"age":25,"groupconcat(name)":"Alice, Bob, Colin, Elizabeth"},
+		{"age":75,"groupconcat(name)":"Alice, Alice, Bob, Elizabeth"}]}]}}`, js)
+}
+
+func TestGroupByGroupConcatInvalidArgs(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001)) @groupby(age) {
+				groupconcat(name, ", ", "x")
+			}
+		}
+	`
+	_, err := processQuery(context.Background(), t, query)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "groupconcat accepts a separator followed by distinct")
+}
+
+func TestGroupConcatMaxLen(t *testing.T) {
+	ag := aggregator{name: "groupconcat"}
+	require.NoError(t, ag.setArgs([]gql.Arg{{Value: "|"}}))
+	long := strings.Repeat("a", defaultGroupConcatLen-2)
+	ag.Apply(types.Val{Tid: types.StringID, Value: "b"})
+	ag.Apply(types.Val{Tid: types.StringID, Value: "c"})
+	ag.Apply(types.Val{Tid: types.StringID, Value: long})
+
+	// The last value doesn't fit and is left out.
+	res, err := ag.Value()
+	require.NoError(t, err)
+	require.Equal(t, long+"|b", res.Value)
+}
+
+func TestGroupConcatDistinctMaxLen(t *testing.T) {
+	ag := aggregator{name: "groupconcat"}
+	require.NoError(t, ag.setArgs([]gql.Arg{{Value: ", "}, {Value: "distinct"}, {Value: "11"}}))
+	for _, name := range []string{"Bob", "Alice", "Bob", "Colin", "Alice"} {
+		ag.Apply(types.Val{Tid: types.StringID, Value: name})
+	}
+
+	// The duplicates are joined once and Colin doesn't fit in 11 bytes.
+	res, err := ag.Value()
+	require.NoError(t, err)
+	require.Equal(t, "Alice, Bob", res.Value)
+
+	for _, args := range [][]gql.Arg{
+		{{Value: ","}, {Value: "0"}},
+		{{Value: ","}, {Value: "distinct"}, {Value: "distinct"}},
+		{{Value: ","}, {Value: "5"}, {Value: "6"}},
+	} {
+		ag := aggregator{name: "groupconcat"}
+		require.Error(t, ag.setArgs(args), "%v", args)
+	}
+}
+
+func TestGroupByAggregateBufferLimit(t *testing.T) {
+	defer func(limit int) { x.Config.AggregateBufferLimit = limit }(x.Config.AggregateBufferLimit)
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(age) {
+				groupconcat(name, ", ")
+			}
+		}
+	`
+	// The groups buffer eight values in total, so a limit of seven is exceeded even
+	// though no group buffers more than four.
+	x.Config.AggregateBufferLimit = 7
+	_, err := processQuery(context.Background(), t, query)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Aggregators in groupby can buffer at most 7 values")
+
+	x.Config.AggregateBufferLimit = 8
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"age":25,"groupconcat(name)":"Alice, Bob, Colin, Elizabeth"},
+		{"age":75,"groupconcat(name)":"Alice, Alice, Bob, Elizabeth"}]}]}}`, js)
+}
+
+func TestAggregatorBufferBudget(t *testing.T) {
+	budget := &bufferBudget{limit: 3}
+	first := aggregator{name: "trimmedmean", budget: budget}
+	second := aggregator{name: "trimmedmean", budget: budget}
+	for _, ag := range []*aggregator{&first, &second} {
+		require.NoError(t, ag.setArgs([]gql.Arg{{Value: "0"}}))
+	}
+	first.Apply(types.Val{Tid: types.IntID, Value: int64(1)})
+	first.Apply(types.Val{Tid: types.IntID, Value: int64(2)})
+	res, err := first.Value()
+	require.NoError(t, err)
+	require.Equal(t, 1.5, res.Value)
+
+	// The second aggregator shares the budget, so it runs out after one more value.
+	second.Apply(types.Val{Tid: types.IntID, Value: int64(3)})
+	second.Apply(types.Val{Tid: types.IntID, Value: int64(4)})
+	_, err = second.Value()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "at most 3 values")
+	require.Nil(t, second.state.(*trimmedMeanState).vals)
+
+	// Without a limit, nothing is capped.
+	unlimited := aggregator{name: "trimmedmean", budget: &bufferBudget{}}
+	require.NoError(t, unlimited.setArgs([]gql.Arg{{Value: "0"}}))
+	for i := 0; i < 10; i++ {
+		unlimited.Apply(types.Val{Tid: types.IntID, Value: int64(i)})
+	}
+	_, err = unlimited.Value()
+	require.NoError(t, err)
+}
+
+func TestGroupByAllLanguages(t *testing.T) {
+	query := `
+		{
+			me(func: uid(3501, 4100)) @groupby(name@.) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Alex","count":1},
+		{"name@en":"Alex","count":1},
+		{"name@en":"Artem Tkachenko","count":1},
+		{"name@ru":"Артём Ткаченко","count":1}]}]}}`, js)
+}
+
+func TestGroupByExpandAll(t *testing.T) {
+	query := `
+		{
+			me(func: uid(200, 201, 202)) @groupby(expand(_all_)) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"make":"Toyota","count":1},
+		{"make":"Ford","count":2},
+		{"model":"Prius","count":1},
+		{"model@jp":"プリウス","count":1},
+		{"model":"Focus","count":2},
+		{"name":"Car","count":1},
+		{"year":2008,"count":1},
+		{"year":2009,"count":2}]}]}}`, js)
+}
+
+func TestGroupByKeyRegexp(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name) @filter(regexp(name, /^[a-c]/i)) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Colin","count":1},
+		{"name":"Bob","count":2},
+		{"name":"Alice","count":3}]}]}}`, js)
+}
+
+func TestGroupByKeyRegexpNotString(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002)) @groupby(age) @filter(regexp(age, /^2/)) {
+				count(uid)
+			}
+		}
+	`
+	_, err := processQuery(context.Background(), t, query)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "regexp can only be applied to string keys in groupby")
+}
+
+func TestGroupByHas(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(has(salary)) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"has(salary)":true,"count":2},
+		{"has(salary)":false,"count":6}]}]}}`, js)
+}
+
+func TestGroupByHasWithAlias(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(age, paid: has(salary)) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"age":25,"paid":true,"count":1},
+		{"age":75,"paid":true,"count":1},
+		{"age":25,"paid":false,"count":3},
+		{"age":75,"paid":false,"count":3}]}]}}`, js)
+}
+
+func TestGroupByHasUidPredicate(t *testing.T) {
+	query := `
+		{
+			me(func: uid(1, 23, 24, 25, 31)) @groupby(has(friend)) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"has(friend)":false,"count":2},
+		{"has(friend)":true,"count":3}]}]}}`, js)
+}
+
+func TestGroupByLang(t *testing.T) {
+	query := `
+		{
+			me(func: uid(3500, 3501, 3502, 3503, 4098, 4099, 4100)) @groupby(lang(name)) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"lang(name)":"ko","count":1},
+		{"lang(name)":"ru","count":1},
+		{"lang(name)":"hi","count":2},
+		{"lang(name)":"none","count":3},
+		{"lang(name)":"en","count":6}]}]}}`, js)
+}
+
+func TestGroupByLangWithAlias(t *testing.T) {
+	query := `
+		{
+			me(func: uid(3501, 3502, 3503)) @groupby(locale: lang(name)) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"locale":"hi","count":2},
+		{"locale":"none","count":2},
+		{"locale":"en","count":3}]}]}}`, js)
+}
+
+func TestGroupByLangCount(t *testing.T) {
+	// The value without a language tag isn't counted and 60025 has no name at all.
+	triples := `
+		<60021> <name> "One"@en .
+		<60022> <name> "Two"@en .
+		<60022> <name> "Deux"@fr .
+		<60022> <name> "Two" .
+		<60023> <name> "Three"@en .
+		<60023> <name> "Trois"@fr .
+		<60023> <name> "Drei"@de .
+		<60024> <name> "Zero" .
+	`
+	require.NoError(t, addTriplesToCluster(triples))
+	defer deleteTriplesInCluster(triples)
+
+	query := `
+		{
+			me(func: uid(60021, 60022, 60023, 60024, 60025)) @groupby(langcount(name)) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"langcount(name)":1,"count":1},
+		{"langcount(name)":2,"count":1},
+		{"langcount(name)":3,"count":1},
+		{"langcount(name)":0,"count":2}]}]}}`, js)
+
+	query = `
+		{
+			me(func: uid(60022, 60023)) @groupby(languages: langcount(name)) {
+				count(uid)
+			}
+		}
+	`
+	js = processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"languages":2,"count":1},
+		{"languages":3,"count":1}]}]}}`, js)
+}
+
+func TestAddLangCountValues(t *testing.T) {
+	child := &SubGraph{
+		SrcUIDs: &pb.List{Uids: []uint64{1, 2, 3, 4, 5}},
+		LangTags: []*pb.LangList{
+			{Lang: []string{"en"}},
+			{Lang: []string{"", "en", "fr"}},
+			{Lang: []string{"de", "en", "fr"}},
+			{Lang: []string{""}},
+		},
+	}
+	var d dedup
+	d.addLangCountValues("langcount(name)", child, nil)
+	got := make(map[int64][]uint64)
+	for _, elem := range d.getGroup("langcount(name)").elements {
+		got[elem.key.Value.(int64)] = elem.entities.Uids
+	}
+	require.Equal(t, map[int64][]uint64{0: {4, 5}, 1: {1}, 2: {2}, 3: {3}}, got)
+
+	// Only the uids in the list are added.
+	d = dedup{}
+	d.addLangCountValues("langcount(name)", child, &pb.List{Uids: []uint64{2, 3}})
+	require.Len(t, d.getGroup("langcount(name)").elements, 2)
+}
+
+func TestGroupByCount(t *testing.T) {
+	query := `
+		{
+			me(func: uid(1, 23, 24, 25, 31)) @groupby(count(friend)) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"count(friend)":5,"count":1},
+		{"count(friend)":0,"count":2},
+		{"count(friend)":1,"count":2}]}]}}`, js)
+}
+
+func TestGroupByCountBucket(t *testing.T) {
+	// The nodes without friends are in the first bucket.
+	query := `
+		{
+			me(func: uid(1, 23, 24, 25, 31)) @groupby(friends: count(friend), bucket: 2) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"friends":4,"count":1},
+		{"friends":0,"count":4}]}]}}`, js)
+}
+
+func TestGroupByRound(t *testing.T) {
+	query := `
+		{
+			me(func: uid(210, 211, 212, 213, 214)) @groupby(reading, round: 2) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"reading":21.400000,"count":1},
+		{"reading":21.450000,"count":1},
+		{"reading":20.000000,"count":3}]}]}}`, js)
+}
+
+func TestGroupByRoundNotFloat(t *testing.T) {
+	query := `
+		{
+			me(func: uid(200, 201, 202)) @groupby(year, round: 0) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"year":2008,"count":1},
+		{"year":2009,"count":2}]}]}}`, js)
+}
+
+func TestNewGroupbyQuery(t *testing.T) {
+	gq, err := NewGroupbyQuery("me", []uint64{1, 2},
+		[]gql.GroupByAttr{{Attr: "age", Alias: "a"}, {Attr: "name", Langs: []string{"en"}}},
+		[]GroupbyAggregate{
+			{Func: "count"},
+			{Func: "max", Attr: "name", Alias: "m"},
+			{Func: "groupconcat", Attr: "name", Args: []string{"|"}},
+		})
+	require.NoError(t, err)
+
+	// The query is the same as the one parsed from DQL.
+	res, err := gql.Parse(gql.Request{Str: `{
+		me(func: uid(1, 2)) @groupby(a: age, name@en) {
+			count(uid)
+			m: max(name)
+			groupconcat(name, "|")
+		}
+	}`})
+	require.NoError(t, err)
+	require.Equal(t, res.Query[0], gq)
+
+	sg, err := ToSubGraph(context.Background(), gq)
+	require.NoError(t, err)
+	require.True(t, sg.IsGroupBy())
+}
+
+func TestNewGroupbyQueryErrors(t *testing.T) {
+	attrs := []gql.GroupByAttr{{Attr: "age"}}
+	tests := []struct {
+		uids  []uint64
+		attrs []gql.GroupByAttr
+		agg   GroupbyAggregate
+		err   string
+	}{
+		{attrs: attrs, agg: GroupbyAggregate{Func: "count"}, err: "Expected atleast one uid"},
+		{uids: []uint64{1}, agg: GroupbyAggregate{Func: "count"},
+			err: "Expected atleast one attribute in groupby"},
+		{uids: []uint64{1}, attrs: attrs, agg: GroupbyAggregate{Func: "count", Attr: "name"},
+			err: "Only uid predicate is allowed in count within groupby"},
+		{uids: []uint64{1}, attrs: attrs, agg: GroupbyAggregate{Func: "max"},
+			err: "Expected a predicate for aggregator max"},
+		{uids: []uint64{1}, attrs: attrs, agg: GroupbyAggregate{Func: "name", Attr: "name"},
+			err: "Only aggregator/count functions allowed inside @groupby"},
+	}
+	for _, tc := range tests {
+		_, err := NewGroupbyQuery("me", tc.uids, tc.attrs, []GroupbyAggregate{tc.agg})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), tc.err)
+	}
+}
+
+func TestAddHasValues(t *testing.T) {
+	child := &SubGraph{
+		SrcUIDs: &pb.List{Uids: []uint64{1, 2, 3, 4, 5}},
+		counts:  []uint32{2, 0, 1, 0, 3},
+	}
+	// Only the uids in the list are grouped.
+	var d dedup
+	d.addHasValues("has(email)", child, &pb.List{Uids: []uint64{1, 2, 3, 4}})
+
+	res := new(groupResults)
+	res.formGroups(d, &pb.List{}, []groupPair{})
+	sort.Slice(res.group, func(i, j int) bool {
+		return groupLess(res.group[i], res.group[j])
+	})
+	require.Len(t, res.group, 2)
+	require.Equal(t, types.Val{Tid: types.BoolID, Value: false}, res.group[0].keys[0].key)
+	require.Equal(t, []uint64{2, 4}, res.group[0].uids)
+	require.Equal(t, types.Val{Tid: types.BoolID, Value: true}, res.group[1].keys[0].key)
+	require.Equal(t, []uint64{1, 3}, res.group[1].uids)
+}
+
+func TestAddCompareValues(t *testing.T) {
+	cmp := &gql.GroupbyCompare{Fn: "gt", Left: "revenue", Right: "cost"}
+	uids := &pb.List{Uids: []uint64{1, 2, 3, 4, 5, 6}}
+	left := &SubGraph{
+		Attr:    "revenue",
+		SrcUIDs: uids,
+		valueMatrix: []*pb.ValueList{
+			{Values: []*pb.TaskValue{task.FromInt(120)}},
+			{Values: []*pb.TaskValue{task.FromFloat(80.5)}},
+			{Values: []*pb.TaskValue{task.FromInt(100)}},
+			{},
+			{Values: []*pb.TaskValue{task.FromInt(50)}},
+			{Values: []*pb.TaskValue{task.FromInt(70)}},
+		},
+		Params: params{GroupbyCompare: cmp},
+	}
+	right := &SubGraph{
+		Attr:    "cost",
+		SrcUIDs: uids,
+		valueMatrix: []*pb.ValueList{
+			{Values: []*pb.TaskValue{task.FromFloat(100.5)}},
+			{Values: []*pb.TaskValue{task.FromInt(90)}},
+			{Values: []*pb.TaskValue{task.FromInt(100)}},
+			{Values: []*pb.TaskValue{task.FromInt(10)}},
+			{},
+			{Values: []*pb.TaskValue{task.FromInt(20)}},
+		},
+		Params: params{GroupbyCompareRight: true},
+	}
+
+	groups := func(d dedup) map[types.Val][]uint64 {
+		res := new(groupResults)
+		res.formGroups(d, &pb.List{}, []groupPair{})
+		uids := make(map[types.Val][]uint64)
+		for _, grp := range res.group {
+			uids[grp.keys[0].key] = grp.uids
+		}
+		return uids
+	}
+	yes := types.Val{Tid: types.BoolID, Value: true}
+	no := types.Val{Tid: types.BoolID, Value: false}
+	unknown := types.Val{Tid: types.StringID, Value: "unknown"}
+
+	// The nodes without a value for either predicate are skipped and only the uids in the
+	// list are grouped.
+	var d dedup
+	require.NoError(t, d.addCompareValues("gt(revenue, cost)", left, right,
+		&pb.List{Uids: []uint64{1, 2, 3, 4, 5}}))
+	require.Equal(t, map[types.Val][]uint64{yes: {1}, no: {2, 3}}, groups(d))
+
+	// With unknown, they're grouped under unknown instead.
+	cmp.Unknown = true
+	d = dedup{}
+	require.NoError(t, d.addCompareValues("gt(revenue, cost)", left, right, nil))
+	require.Equal(t, map[types.Val][]uint64{yes: {1, 6}, no: {2, 3}, unknown: {4, 5}},
+		groups(d))
+
+	// Values that can't be compared fail the query.
+	right.valueMatrix[0] = &pb.ValueList{Values: []*pb.TaskValue{task.FromString("high")}}
+	d = dedup{}
+	err := d.addCompareValues("gt(revenue, cost)", left, right, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "while comparing revenue with cost in groupby")
+}
+
+func TestGroupByJSONPath(t *testing.T) {
+	// The names aren't JSON, so no node has a value at the path.
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002)) @groupby(region: jsonpath(name, "$.region")) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.NotContains(t, js, "region")
+
+	query = `
+		{
+			me(func: uid(10000, 10001, 10002))
+				@groupby(jsonpath(name, "$.region", strict: true)) {
+				count(uid)
+			}
+		}
+	`
+	_, err := processQuery(context.Background(), t, query)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "value of name for uid 0x2710 is not valid JSON")
+
+	query = `
+		{
+			me(func: uid(10000, 10001, 10002)) @groupby(jsonpath(age, "$.region")) {
+				count(uid)
+			}
+		}
+	`
+	_, err = processQuery(context.Background(), t, query)
+	require.Error(t, err)
+	require.Contains(t, err.Error(),
+		"jsonpath can only be applied to string predicates, but age is of type int")
+
+	query = `
+		{
+			me(func: uid(10000, 10001, 10002)) @groupby(jsonpath(name, "region")) {
+				count(uid)
+			}
+		}
+	`
+	_, err = processQuery(context.Background(), t, query)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `Invalid JSON path "region": it must start with $`)
+}
+
+func TestGroupByRegexCapture(t *testing.T) {
+	triples := `
+		<50001> <email> "alice@example.com" .
+		<50002> <email> "bob@example.com" .
+		<50003> <email> "colin@dgraph.io" .
+		<50004> <email> "invalid" .
+	`
+	require.NoError(t, addTriplesToCluster(triples))
+	defer deleteTriplesInCluster(triples)
+
+	query := `
+		{
+			me(func: uid(50001, 50002, 50003, 50004)) @groupby(domain: regexcapture(email, "@(.+)$")) {
+				count(uid)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"domain":"dgraph.io","count":1},
+		{"domain":"example.com","count":2}]}]}}`, js)
+
+	// The emails that don't match are grouped under the unmatched label.
+	query = `
+		{
+			me(func: uid(50001, 50002, 50003, 50004))
+				@groupby(regexcapture(email, "@(.+)$", unmatched: "none")) {
+				count(uid)
+			}
+		}
+	`
+	js = processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"regexcapture(email, @(.+)$)":"dgraph.io","count":1},
+		{"regexcapture(email, @(.+)$)":"none","count":1},
+		{"regexcapture(email, @(.+)$)":"example.com","count":2}]}]}}`, js)
+
+	for regex, msg := range map[string]string{
+		`@.+$`:  "The regex in regexcapture(email) must have a capture group to group by",
+		`@(.+$`: "invalid regex in regexcapture(email)",
+	} {
+		query = `{ me(func: uid(50001)) @groupby(regexcapture(email, "` + regex + `")) ` +
+			`{ count(uid) } }`
+		_, err := processQuery(context.Background(), t, query)
+		require.Error(t, err, regex)
+		require.Contains(t, err.Error(), msg, regex)
+	}
+}
+
+func TestAddRegexCaptureValues(t *testing.T) {
+	child := &SubGraph{
+		SrcUIDs: &pb.List{Uids: []uint64{1, 2, 3, 4}},
+		valueMatrix: []*pb.ValueList{
+			{Values: []*pb.TaskValue{task.FromString("order-2020-17")}},
+			{Values: []*pb.TaskValue{task.FromString("order-")}},
+			{Values: []*pb.TaskValue{task.FromString("refund")}},
+			{},
+		},
+		Params: params{GroupbyRegex: regexp.MustCompile(`^order-(\d*)`)},
+	}
+	keys := func(unmatched string) map[string][]uint64 {
+		child.Params.GroupbyUnmatched = unmatched
+		var d dedup
+		for i := range child.valueMatrix {
+			d.addRegexCaptureValues("id", child, i)
+		}
+		res := make(map[string][]uint64)
+		for k, el := range d.getGroup("id").elements {
+			res[k] = el.entities.Uids
+		}
+		return res
+	}
+
+	// Only the first capture group is kept, and it can be empty.
+	require.Equal(t, map[string][]uint64{"2020": {1}, "": {2}}, keys(""))
+	require.Equal(t, map[string][]uint64{"2020": {1}, "": {2}, "other": {3}}, keys("other"))
+}
+
+func TestAddCountValues(t *testing.T) {
+	child := &SubGraph{
+		SrcUIDs: &pb.List{Uids: []uint64{1, 2, 3, 4, 5}},
+		counts:  []uint32{12, 0, 19, 5, 25},
+	}
+	// Only the uids in the list are grouped, and the counts are put in buckets of 10.
+	d := dedup{bucket: 10}
+	d.addCountValues("count(post)", child, &pb.List{Uids: []uint64{1, 2, 3, 4}})
+
+	res := new(groupResults)
+	res.formGroups(d, &pb.List{}, []groupPair{})
+	sort.Slice(res.group, func(i, j int) bool {
+		return groupLess(res.group[i], res.group[j])
+	})
+	require.Len(t, res.group, 2)
+	require.Equal(t, types.Val{Tid: types.IntID, Value: int64(0)}, res.group[0].keys[0].key)
+	require.Equal(t, []uint64{2, 4}, res.group[0].uids)
+	require.Equal(t, types.Val{Tid: types.IntID, Value: int64(10)}, res.group[1].keys[0].key)
+	require.Equal(t, []uint64{1, 3}, res.group[1].uids)
+}
+
+func TestGroupByDatetimeOffsets(t *testing.T) {
+	var d dedup
+	for i, val := range []string{
+		"2020-01-01T10:00:00+02:00",
+		"2020-01-01T08:00:00Z",
+		"2020-01-01T09:00:00+02:00",
+		"2020-01-01T03:00:00-05:00",
+		"2020-01-01T10:00:00+02:00",
+	} {
+		tm, err := time.Parse(time.RFC3339, val)
+		require.NoError(t, err)
+		d.addValue("when", "", types.Val{Tid: types.DateTimeID, Value: tm}, uint64(i+1))
+	}
+	// Times that can't be marshaled to text are grouped too.
+	d.addValue("when", "", types.Val{Tid: types.DateTimeID,
+		Value: time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC)}, 6)
+
+	res := new(groupResults)
+	res.formGroups(d, &pb.List{}, []groupPair{})
+	sort.Slice(res.group, func(i, j int) bool {
+		return groupLess(res.group[i], res.group[j])
+	})
+
+	// The same instant in different time zones is grouped separately, and each group keeps
+	// the offset of its values. The groups with the same number of uids are ordered
+	// chronologically and then by offset.
+	var keys []string
+	var uids [][]uint64
+	for _, grp := range res.group {
+		keys = append(keys, grp.keys[0].key.Value.(time.Time).Format(time.RFC3339))
+		uids = append(uids, grp.uids)
+	}
+	require.Equal(t, []string{
+		"2020-01-01T09:00:00+02:00",
+		"2020-01-01T03:00:00-05:00",
+		"2020-01-01T08:00:00Z",
+		"10000-01-01T00:00:00Z",
+		"2020-01-01T10:00:00+02:00",
+	}, keys)
+	require.Equal(t, [][]uint64{{3}, {4}, {2}, {6}, {1, 5}}, uids)
+}
+
+func TestGroupRows(t *testing.T) {
+	sg := &SubGraph{Params: params{IsGroupBy: true}}
+	sg.GroupbyRes = []*groupResults{{group: []*groupResult{
+		{
+			keys: []groupPair{{attr: "name", lang: "en",
+				key: types.Val{Tid: types.StringID, Value: "Alice"}}},
+			aggregates: []groupPair{{attr: "count",
+				key: types.Val{Tid: types.IntID, Value: int64(2)}}},
+			uids: []uint64{1, 3},
+		},
+	}}}
+
+	rows, err := sg.GroupRows()
+	require.NoError(t, err)
+	require.Equal(t, [][]GroupRow{{{
+		Keys: []GroupValue{{Name: "name", Lang: "en",
+			Value: types.Val{Tid: types.StringID, Value: "Alice"}}},
+		Aggregates: []GroupValue{{Name: "count",
+			Value: types.Val{Tid: types.IntID, Value: int64(2)}}},
+		Uids: []uint64{1, 3},
+	}}}, rows)
+
+	key, ok := rows[0][0].Key("name")
+	require.True(t, ok)
+	require.Equal(t, "Alice", key.Value)
+	count, ok := rows[0][0].Aggregate("count")
+	require.True(t, ok)
+	require.Equal(t, int64(2), count.Value)
+	_, ok = rows[0][0].Aggregate("max(age)")
+	require.False(t, ok)
+
+	_, err = (&SubGraph{Attr: "name"}).GroupRows()
+	require.Error(t, err)
+}
+
+func TestRunGroupbyErrors(t *testing.T) {
+	ctx := context.Background()
+	_, err := RunGroupby(ctx, &SubGraph{Attr: "name"}, []uint64{1}, 1)
+	require.EqualError(t, err, "name is not a groupby")
+
+	sg := &SubGraph{Params: params{IsGroupBy: true}}
+	_, err = RunGroupby(ctx, sg, nil, 1)
+	require.EqualError(t, err, "Expected atleast one uid to group")
+
+	res, err := gql.Parse(gql.Request{Str: `{
+		var(func: uid(1)) { a as age }
+		me(func: uid(1)) @groupby(val(a)) { count(uid) }
+	}`})
+	require.NoError(t, err)
+	sg, err = ToSubGraph(ctx, res.Query[1])
+	require.NoError(t, err)
+	_, err = RunGroupby(ctx, sg, []uint64{1}, 1)
+	require.EqualError(t, err, "Variables can't be used by a groupby run on its own. Got: [a]")
+}
+
+func ExampleRunGroupby() {
+	ctx := context.Background()
+	gq, err := NewGroupbyQuery("me", []uint64{1}, []gql.GroupByAttr{{Attr: "name"}},
+		[]GroupbyAggregate{{Func: "count"}, {Func: "max", Attr: "age"}})
+	if err != nil {
+		log.Fatal(err)
+	}
+	sg, err := ToSubGraph(ctx, gq)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rows, err := RunGroupby(ctx, sg, []uint64{1, 23, 24, 25, 31}, math.MaxUint64)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, row := range rows {
+		name, _ := row.Key("name")
+		count, _ := row.Aggregate("count")
+		age, _ := row.Aggregate("max(age)")
+		fmt.Println(name.Value, count.Value, age.Value)
+	}
+}
+
+func TestExtractGroupKeyFilters(t *testing.T) {
+	res, err := gql.Parse(gql.Request{Str: `{
+		me(func: uid(1)) @groupby(n: name, age)
+			@filter(regexp(name, /^a/) and has(age) and regexp(nick, /^b/)) {
+			count(uid)
+		}
+	}`})
+	require.NoError(t, err)
+	gq := res.Query[0]
+
+	filters, err := extractGroupKeyFilters(gq)
+	require.NoError(t, err)
+	require.Len(t, filters, 1)
+	require.Equal(t, "n", filters[0].attr)
+
+	// The filters on other predicates are still applied to the nodes.
+	require.Equal(t, "and", gq.Filter.Op)
+	require.Len(t, gq.Filter.Child, 2)
+	require.Equal(t, "has", gq.Filter.Child[0].Func.Name)
+	require.Equal(t, "nick", gq.Filter.Child[1].Func.Attr)
+}
+
+func TestGroupByBitwise(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name) {
+				bitor(age)
+				bitand(age)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Colin","bitor(age)":25,"bitand(age)":25},
+		{"name":"Bob","bitor(age)":91,"bitand(age)":9},
+		{"name":"Elizabeth","bitor(age)":91,"bitand(age)":9},
+		{"name":"Alice","bitor(age)":91,"bitand(age)":9}]}]}}`, js)
+}
+
+func TestBitwiseAggregatorWrongType(t *testing.T) {
+	query := `
+		{
+			me(func: uid(1)) {
+				friend {
+					n as name
+				}
+				bitor(val(n))
+			}
+		}
+	`
+	_, err := processQuery(context.Background(), t, query)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Wrong type string encountered for func bitor")
+}
+
+func TestGroupByCountNonNull(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name) {
+				count(uid)
+				countnonnull(salary)
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Colin","count":1,"countnonnull(salary)":0},
+		{"name":"Bob","count":2,"countnonnull(salary)":0},
+		{"name":"Elizabeth","count":2,"countnonnull(salary)":0},
+		{"name":"Alice","count":3,"countnonnull(salary)":2}]}]}}`, js)
+}
+
+func TestCountNonNullValueVar(t *testing.T) {
+	query := `
+		{
+			var(func: uid(10000, 10001, 10002, 10003)) {
+				s as salary
+			}
+
+			me() {
+				countnonnull(val(s))
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"countnonnull(val(s))":2}]}}`, js)
+}
+
+func TestCountNonNullAggregator(t *testing.T) {
+	ag := aggregator{name: "countnonnull"}
+	require.NoError(t, ag.setArgs(nil))
+	res, err := ag.Value()
+	require.NoError(t, err)
+	require.Equal(t, types.Val{Tid: types.IntID, Value: int64(0)}, res)
+
+	ag.Apply(types.Val{Tid: types.StringID, Value: "a"})
+	ag.Apply(types.Val{Tid: types.BoolID, Value: false})
+	res, err = ag.Value()
+	require.NoError(t, err)
+	require.Equal(t, types.Val{Tid: types.IntID, Value: int64(2)}, res)
+}
+
+func TestEstimateGroups(t *testing.T) {
+	var d dedup
+	require.Equal(t, 0, d.estimateGroups(false))
+
+	age := func(v int64) types.Val { return types.Val{Tid: types.IntID, Value: v} }
+	name := func(v string) types.Val { return types.Val{Tid: types.StringID, Value: v} }
+	// The uids are added in order like when they're read from the value matrix.
+	d.addValue("age", "", age(25), 1)
+	d.addValue("age", "", age(25), 2)
+	d.addValue("age", "", age(25), 3)
+	d.addValue("age", "", age(75), 4)
+	d.addValue("age", "", age(75), 5)
+	d.addValue("name", "", name("a"), 1)
+	d.addValue("name", "", name("b"), 2)
+	d.addValue("name", "", name("a"), 4)
+	d.addValue("name", "", name("c"), 5)
+	d.addValue("name", "", name("d"), 6)
+
+	// There are 2 * 4 combinations of keys, but only 4 of them are held by nodes with both.
+	require.Equal(t, 4, d.estimateGroups(false))
+	res := new(groupResults)
+	res.formGroups(d, &pb.List{}, []groupPair{})
+	require.Len(t, res.group, 4)
+
+	// Each predicate is grouped on its own with expand(_all_).
+	require.Equal(t, 6, d.estimateGroups(true))
+
+	// A node with several values of a list predicate is in several groups.
+	d.addValue("name", "", name("b"), 1)
+	require.Equal(t, 5, d.estimateGroups(false))
+}
+
+func TestGroupByGroupLimit(t *testing.T) {
+	defer func(limit int) { x.Config.GroupbyGroupLimit = limit }(x.Config.GroupbyGroupLimit)
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name) {
+				count(uid)
+			}
+		}
+	`
+	x.Config.GroupbyGroupLimit = 3
+	_, err := processQuery(context.Background(), t, query)
+	require.Error(t, err)
+	require.Contains(t, err.Error(),
+		"Groupby is estimated to form 4 groups, more than the limit of 3")
+
+	x.Config.GroupbyGroupLimit = 4
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"@groupby":[
+		{"name":"Colin","count":1},
+		{"name":"Bob","count":2},
+		{"name":"Elizabeth","count":2},
+		{"name":"Alice","count":3}]}]}}`, js)
+}
+
+func TestGroupByPlan(t *testing.T) {
+	sg := &SubGraph{
+		Attr: "friend",
+		Children: []*SubGraph{
+			{Attr: "school", Params: params{IgnoreResult: true}},
+			{Attr: "age", Params: params{IgnoreResult: true}},
+			{Attr: "uid", Params: params{DoCount: true}},
+			{Attr: "name", SrcFunc: &Function{Name: "min"}},
+		},
+	}
+
+	plan := sg.groupByPlan()
+	plan.uids, plan.estimatedGroups, plan.groups = 5, 6, 4
+	plan.cardinalities = "school: 3, age: 2"
+	require.Equal(t, []otrace.Attribute{
+		otrace.StringAttribute("keys", "school, age"),
+		otrace.StringAttribute("aggregates", "count(uid), min(name)"),
+		otrace.Int64Attribute("uids", 5),
+		otrace.Int64Attribute("estimated_groups", 6),
+		otrace.Int64Attribute("groups", 4),
+		otrace.StringAttribute("key_cardinalities", "school: 3, age: 2"),
+	}, plan.attributes())
+
+	strVal := func(s string) types.Val { return types.Val{Tid: types.StringID, Value: s} }
+	intVal := func(n int64) types.Val { return types.Val{Tid: types.IntID, Value: n} }
+	require.Equal(t, []groupPair{
+		{attr: "keys", key: strVal("school, age")},
+		{attr: "aggregates", key: strVal("count(uid), min(name)")},
+		{attr: "uids", key: intVal(5)},
+		{attr: "estimatedGroups", key: intVal(6)},
+		{attr: "groups", key: intVal(4)},
+		{attr: "keyCardinalities", key: strVal("school: 3, age: 2")},
+	}, plan.values())
+}
+
+func TestGroupByExplain(t *testing.T) {
+	query := `
+		{
+			me(func: uid(10000, 10001, 10002, 10003, 10004, 10005, 10006, 10007))
+				@groupby(name, explain: true) {
+				count(uid)
+			}
+		}
+	`
+	var res struct {
+		Data struct {
+			Me []struct {
+				Groups []map[string]interface{} `json:"@groupby"`
+				Plan   struct {
+					Keys             string `json:"keys"`
+					Aggregates       string `json:"aggregates"`
+					Uids             int    `json:"uids"`
+					EstimatedGroups  int    `json:"estimatedGroups"`
+					Groups           int    `json:"groups"`
+					KeyCardinalities string `json:"keyCardinalities"`
+				} `json:"@groupby_plan"`
+			} `json:"me"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(processQueryNoErr(t, query)), &res))
+	require.Len(t, res.Data.Me, 1)
+	plan := res.Data.Me[0].Plan
+	require.Equal(t, "name", plan.Keys)
+	require.Equal(t, "count(uid)", plan.Aggregates)
+	require.Equal(t, 8, plan.Uids)
+	require.Equal(t, len(res.Data.Me[0].Groups), plan.Groups)
+	require.GreaterOrEqual(t, plan.EstimatedGroups, plan.Groups)
+	require.Equal(t, fmt.Sprintf("name: %d", plan.Groups), plan.KeyCardinalities)
+}
+
+func TestKeyCardinalities(t *testing.T) {
+	strVal := func(v string) types.Val { return types.Val{Tid: types.StringID, Value: v} }
+	var first, second dedup
+	for i, name := range []string{"Alice", "Bob", "Alice", "Colin"} {
+		first.addValue("name", "", strVal(name), uint64(i+1))
+		first.addValue("country", "", strVal("UK"), uint64(i+1))
+	}
+	for i, name := range []string{"Dave", "Eve"} {
+		second.addValue("name", "", strVal(name), uint64(i+10))
+		second.addValue("country", "", strVal(name), uint64(i+10))
+	}
+
+	// The largest number of keys of each attribute in any of the lists is returned.
+	require.Equal(t, "name: 3, country: 2", keyCardinalities([]dedup{first, second}))
+	require.Equal(t, "", keyCardinalities(nil))
+}
+
 func TestGroupByAlias(t *testing.T) {
 	query := `
 		{
@@ -2246,3 +2246,55 @@ func TestCountFacetsFilteringScalarListPredicate(t *testing.T) {
 		}
 	}`, js)
 }
+
+func TestGroupByFirstLastFacetOrder(t *testing.T) {
+	// The uids of the friends are in the opposite order of the since facet of their edges.
+	triples := `
+		<60001> <friend> <60002> (since = 2010-01-02T15:04:05) .
+		<60001> <friend> <60003> (since = 2008-01-02T15:04:05) .
+		<60001> <friend> <60004> (since = 2006-01-02T15:04:05) .
+		<60001> <friend> <60005> (since = 2004-01-02T15:04:05) .
+		<60002> <name> "Ann" .
+		<60003> <name> "Ben" .
+		<60004> <name> "Cat" .
+		<60005> <name> "Dan" .
+		<60002> <room> "north" .
+		<60003> <room> "south" .
+		<60004> <room> "north" .
+		<60005> <room> "south" .
+	`
+	require.NoError(t, addTriplesToCluster(triples))
+	defer deleteTriplesInCluster(triples)
+
+	// The members of each group are taken in the order of the since facet.
+	query := `
+		{
+			me(func: uid(60001)) {
+				friend @facets(orderasc: since) @groupby(room) {
+					first(name)
+					last(name)
+				}
+			}
+		}
+	`
+	js := processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"friend":[{"@groupby":[
+		{"room":"north","first(name)":"Cat","last(name)":"Ann"},
+		{"room":"south","first(name)":"Dan","last(name)":"Ben"}]}]}]}}`, js)
+
+	// Without an order, they're taken in the order of the uids.
+	query = `
+		{
+			me(func: uid(60001)) {
+				friend @groupby(room) {
+					first(name)
+					last(name)
+				}
+			}
+		}
+	`
+	js = processQueryNoErr(t, query)
+	require.JSONEq(t, `{"data":{"me":[{"friend":[{"@groupby":[
+		{"room":"north","first(name)":"Ann","last(name)":"Cat"},
+		{"room":"south","first(name)":"Ben","last(name)":"Dan"}]}]}]}}`, js)
+}
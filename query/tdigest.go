@@ -0,0 +1,153 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package query
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	// minTdigestCompression and maxTdigestCompression bound the compression of the t-digests
+	// built by the tdigest aggregator.
+	minTdigestCompression = 10
+	maxTdigestCompression = 10000
+)
+
+// centroid summarizes a set of values by their mean and their number.
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// tdigest is a merging t-digest, which estimates the quantiles of a stream of values from a
+// sorted list of centroids. The centroids near the extremes hold fewer values than the ones
+// near the median, so the extreme quantiles are estimated more accurately. The number of
+// centroids is bounded by about the compression, whatever the number of values.
+// See https://arxiv.org/abs/1902.04023.
+type tdigest struct {
+	compression float64
+	// centroids is sorted by mean.
+	centroids []centroid
+	// buffer holds the values added since the last merge.
+	buffer []float64
+	count  float64
+	min    float64
+	max    float64
+}
+
+func newTdigest(compression float64) *tdigest {
+	return &tdigest{
+		compression: compression,
+		min:         math.Inf(1),
+		max:         math.Inf(-1),
+	}
+}
+
+// add adds a value to the digest. The values are buffered and merged into the centroids once
+// the buffer is full.
+func (td *tdigest) add(v float64) {
+	td.buffer = append(td.buffer, v)
+	td.count++
+	td.min = math.Min(td.min, v)
+	td.max = math.Max(td.max, v)
+	if len(td.buffer) >= int(5*td.compression) {
+		td.merge()
+	}
+}
+
+// scale maps a quantile to the k scale, on which every centroid spans at most one unit. The
+// scale is steeper near the extremes, so the centroids there are smaller.
+func (td *tdigest) scale(q float64) float64 {
+	return td.compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+// scaleInverse maps a value of the k scale back to a quantile.
+func (td *tdigest) scaleInverse(k float64) float64 {
+	if k >= td.compression/4 {
+		return 1
+	}
+	return (math.Sin(k*2*math.Pi/td.compression) + 1) / 2
+}
+
+// merge merges the buffered values into the centroids. Neighbouring centroids are merged as
+// long as the merged one doesn't span more than one unit of the k scale.
+func (td *tdigest) merge() {
+	if len(td.buffer) == 0 {
+		return
+	}
+	all := make([]centroid, 0, len(td.centroids)+len(td.buffer))
+	all = append(all, td.centroids...)
+	for _, v := range td.buffer {
+		all = append(all, centroid{mean: v, weight: 1})
+	}
+	td.buffer = td.buffer[:0]
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+
+	merged := all[:1]
+	var weightSoFar float64
+	limit := td.count * td.scaleInverse(td.scale(0)+1)
+	for _, c := range all[1:] {
+		cur := &merged[len(merged)-1]
+		if weightSoFar+cur.weight+c.weight <= limit {
+			cur.mean += (c.mean - cur.mean) * c.weight / (cur.weight + c.weight)
+			cur.weight += c.weight
+			continue
+		}
+		weightSoFar += cur.weight
+		limit = td.count * td.scaleInverse(td.scale(weightSoFar/td.count)+1)
+		merged = append(merged, c)
+	}
+	td.centroids = merged
+}
+
+// quantile returns the estimate of the q quantile of the values, for q between 0 and 1. The
+// values between the centers of neighbouring centroids are interpolated linearly. It returns
+// false if no value was added.
+func (td *tdigest) quantile(q float64) (float64, bool) {
+	td.merge()
+	if len(td.centroids) == 0 {
+		return 0, false
+	}
+	switch {
+	case q <= 0:
+		return td.min, true
+	case q >= 1:
+		return td.max, true
+	case len(td.centroids) == 1:
+		return td.centroids[0].mean, true
+	}
+
+	rank := q * td.count
+	first := td.centroids[0]
+	if rank < first.weight/2 {
+		// The values below the center of the first centroid lie between the min and it.
+		return td.min + (first.mean-td.min)*rank/(first.weight/2), true
+	}
+	center := first.weight / 2
+	for i := 0; i < len(td.centroids)-1; i++ {
+		cur, next := td.centroids[i], td.centroids[i+1]
+		nextCenter := center + (cur.weight+next.weight)/2
+		if rank < nextCenter {
+			return cur.mean + (next.mean-cur.mean)*(rank-center)/(nextCenter-center), true
+		}
+		center = nextCenter
+	}
+	// The values above the center of the last centroid lie between it and the max.
+	last := td.centroids[len(td.centroids)-1]
+	return last.mean + (td.max-last.mean)*(rank-center)/(last.weight/2), true
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package query
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTdigestSmall(t *testing.T) {
+	td := newTdigest(100)
+	_, ok := td.quantile(0.5)
+	require.False(t, ok)
+
+	// A few values are kept as they are, so their quantiles are interpolated between them.
+	for _, v := range []float64{5, 3, 1, 4, 2} {
+		td.add(v)
+	}
+	for _, tc := range []struct{ q, want float64 }{
+		{0, 1}, {0.1, 1}, {0.25, 1.75}, {0.5, 3}, {0.75, 4.25}, {1, 5},
+	} {
+		got, ok := td.quantile(tc.q)
+		require.True(t, ok)
+		require.InDelta(t, tc.want, got, 1e-9, "quantile %v", tc.q)
+	}
+}
+
+func TestTdigestAccuracy(t *testing.T) {
+	const n = 100000
+	r := rand.New(rand.NewSource(1))
+	td := newTdigest(100)
+	for _, i := range r.Perm(n) {
+		td.add(float64(i) / n)
+	}
+	// The error is smaller towards the extremes, where the centroids hold fewer values.
+	for _, tc := range []struct{ q, delta float64 }{
+		{0.01, 0.001}, {0.25, 0.01}, {0.5, 0.01}, {0.9, 0.005}, {0.99, 0.001}, {0.999, 0.0002},
+	} {
+		got, ok := td.quantile(tc.q)
+		require.True(t, ok)
+		require.InDelta(t, tc.q, got, tc.delta, "quantile %v", tc.q)
+	}
+	require.LessOrEqual(t, len(td.centroids), 100)
+
+	// The values of a skewed stream are estimated as accurately, relative to their rank.
+	td = newTdigest(100)
+	for _, i := range r.Perm(n) {
+		x := float64(i) / n
+		td.add(x * x * x)
+	}
+	for _, q := range []float64{0.5, 0.99} {
+		got, ok := td.quantile(q)
+		require.True(t, ok)
+		require.InDelta(t, q*q*q, got, 3*q*q*0.01, "quantile %v", q)
+	}
+}
@@ -230,6 +230,138 @@ func TestBackupFilesystem(t *testing.T) {
 	dirCleanup(t)
 }
 
+func TestRestoreRebalance(t *testing.T) {
+	conn, err := grpc.Dial(testutil.SockAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	dg := dgo.NewDgraphClient(api.NewDgraphClient(conn))
+
+	ctx := context.Background()
+	require.NoError(t, dg.Alter(ctx, &api.Operation{DropAll: true}))
+
+	// Add predicates of about the same size.
+	var preds []string
+	var schema, nquads strings.Builder
+	for i := 1; i <= 6; i++ {
+		pred := fmt.Sprintf("rebalance%d", i)
+		preds = append(preds, pred)
+		schema.WriteString(pred + ": string .\n")
+		for j := 0; j < 500; j++ {
+			fmt.Fprintf(&nquads, "_:n%d <%s> \"%s %d\" .\n", j, pred,
+				strings.Repeat("value ", 20), j)
+		}
+	}
+	require.NoError(t, dg.Alter(ctx, &api.Operation{Schema: schema.String()}))
+	_, err = dg.NewTxn().Mutate(ctx, &api.Mutation{
+		CommitNow: true,
+		SetNquads: []byte(nquads.String()),
+	})
+	require.NoError(t, err)
+
+	// Serve all the predicates from the first group, so the backup restores them there.
+	state, err := testutil.GetState()
+	require.NoError(t, err)
+	for _, pred := range preds {
+		if _, ok := state.Groups["1"].Tablets[pred]; ok {
+			continue
+		}
+		resp, err := http.Get("http://" + testutil.SockAddrZeroHttp +
+			"/moveTablet?tablet=" + pred + "&group=1")
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	backupDir := alphaBackupDir + "/rebalance"
+	copyDir := "./data/rebalance_copy"
+	defer func() {
+		require.NoError(t, testutil.DockerExec(alphaContainers[0], "rm", "-rf", backupDir))
+		require.NoError(t, os.RemoveAll(copyDir))
+	}()
+	require.NoError(t, testutil.DockerExec(alphaContainers[0], "rm", "-rf", backupDir))
+	require.NoError(t, os.RemoveAll(copyDir))
+
+	adminRequest := func(query string) string {
+		b, err := json.Marshal(testutil.GraphQLParams{Query: query})
+		require.NoError(t, err)
+		resp, err := http.Post("http://localhost:8180/admin", "application/json",
+			bytes.NewBuffer(b))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		buf, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(buf)
+	}
+	require.Contains(t, adminRequest(fmt.Sprintf(`mutation {
+		backup(input: {destination: "%s", forceFull: true}) {
+			response { code message }
+		}
+	}`, backupDir)), "Backup completed.")
+
+	// Get the id of the backup from its manifest.
+	require.NoError(t, testutil.DockerCp(alphaContainers[0]+":"+backupDir, copyDir))
+	manifests := x.WalkPathFunc(copyDir, func(path string, isdir bool) bool {
+		return !isdir && strings.HasSuffix(path, "manifest.json")
+	})
+	require.Len(t, manifests, 1)
+	b, err := ioutil.ReadFile(manifests[0])
+	require.NoError(t, err)
+	var manifest worker.Manifest
+	require.NoError(t, json.Unmarshal(b, &manifest))
+	// The size of the data is recorded to check the disk space before restoring it.
+	require.NotZero(t, manifest.Size)
+
+	res := adminRequest(fmt.Sprintf(`mutation {
+		restore(input: {location: "%s", backupId: "%s", rebalance: true}) {
+			response { code message }
+			tabletMoves { predicate fromGroup toGroup }
+		}
+	}`, backupDir, manifest.BackupId))
+	require.Contains(t, res, "Restore completed.")
+
+	var restoreResp struct {
+		Data struct {
+			Restore struct {
+				TabletMoves []struct {
+					Predicate string
+					FromGroup int
+					ToGroup   int
+				}
+			}
+		}
+	}
+	require.NoError(t, json.Unmarshal([]byte(res), &restoreResp))
+	moves := restoreResp.Data.Restore.TabletMoves
+	require.NotEmpty(t, moves, "no tablets were moved: %s", res)
+	for _, move := range moves {
+		require.Contains(t, preds, move.Predicate)
+		require.Equal(t, 1, move.FromGroup)
+		require.NotEqual(t, 1, move.ToGroup)
+	}
+
+	// Every group serves some of the restored predicates.
+	state, err = testutil.GetState()
+	require.NoError(t, err)
+	require.Len(t, state.Groups, 3)
+	for gid, group := range state.Groups {
+		var served int
+		for _, pred := range preds {
+			if _, ok := group.Tablets[pred]; ok {
+				served++
+			}
+		}
+		require.Greater(t, served, 0, "group %s serves none of the restored predicates", gid)
+	}
+
+	// The moved predicates have all their data.
+	for _, move := range moves {
+		resp, err := dg.NewReadOnlyTxn().Query(ctx, fmt.Sprintf(`{
+			q(func: has(%s)) { count(uid) }
+		}`, move.Predicate))
+		require.NoError(t, err)
+		testutil.CompareJSON(t, `{"q": [{"count": 500}]}`, string(resp.Json))
+	}
+}
+
 func runBackup(t *testing.T, numExpectedFiles, numExpectedDirs int) []string {
 	return runBackupInternal(t, false, numExpectedFiles, numExpectedDirs)
 }
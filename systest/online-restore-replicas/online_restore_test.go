@@ -0,0 +1,108 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/dgraph-io/dgo/v200"
+	"github.com/dgraph-io/dgo/v200/protos/api"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"github.com/dgraph-io/dgraph/testutil"
+)
+
+// alphas are the gRPC addresses of the alphas of the two groups of three replicas each.
+var alphas = []string{
+	"localhost:9180", "localhost:9182", "localhost:9183",
+	"localhost:9184", "localhost:9185", "localhost:9186",
+}
+
+func TestRestoreWithReplicas(t *testing.T) {
+	conn, err := grpc.Dial(testutil.SockAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	dg := dgo.NewDgraphClient(api.NewDgraphClient(conn))
+	require.NoError(t, dg.Alter(context.Background(), &api.Operation{DropAll: true}))
+
+	// The backup was taken in a cluster with three groups. Its predicates are restored into
+	// the two groups of this cluster, and every replica must restore the same ones.
+	restoreRequest := `mutation restore() {
+		 restore(input: {location: "/data/backup-3groups", backupId: "three_groups"}) {
+			response {
+				code
+				message
+			}
+		}
+	}`
+
+	adminUrl := "http://localhost:8180/admin"
+	params := testutil.GraphQLParams{
+		Query: restoreRequest,
+	}
+	b, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	resp, err := http.Post(adminUrl, "application/json", bytes.NewBuffer(b))
+	require.NoError(t, err)
+	buf, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(buf), "Restore completed.")
+
+	// Each predicate is served by exactly one group.
+	state, err := testutil.GetState()
+	require.NoError(t, err)
+	served := make(map[string]string)
+	for gid, group := range state.Groups {
+		for pred := range group.Tablets {
+			other, ok := served[pred]
+			require.False(t, ok, "predicate %s is served by groups %s and %s", pred, other, gid)
+			served[pred] = gid
+		}
+	}
+	for _, pred := range []string{"name", "age", "friend"} {
+		require.Contains(t, served, pred)
+	}
+
+	// Every alpha returns the whole restored data, whichever replica serves the query.
+	for _, addr := range alphas {
+		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		require.NoError(t, err)
+		dg := dgo.NewDgraphClient(api.NewDgraphClient(conn))
+
+		queryResp, err := dg.NewReadOnlyTxn().BestEffort().Query(context.Background(), `{
+		  q(func: has(name), orderasc: name) {
+			name
+			age
+			friend(orderasc: name) {
+			  name
+			}
+		  }
+		}`)
+		require.NoError(t, err, "querying alpha %s", addr)
+		require.JSONEq(t, `{"q":[
+			{"name": "Alice", "age": 20, "friend": [{"name": "Bob"}, {"name": "Carol"}]},
+			{"name": "Bob", "age": 30, "friend": [{"name": "Carol"}]},
+			{"name": "Carol", "age": 40}
+		]}`, string(queryResp.Json), "querying alpha %s", addr)
+		require.NoError(t, conn.Close())
+	}
+}
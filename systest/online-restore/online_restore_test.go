@@ -19,12 +19,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"path"
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/dgraph-io/dgo/v200"
 	"github.com/dgraph-io/dgo/v200/protos/api"
@@ -36,15 +38,25 @@ import (
 )
 
 func sendRestoreRequest(t *testing.T) {
-	restoreRequest := `mutation restore() {
+	sendRestoreRequestWithId(t, "")
+}
+
+// sendRestoreRequestWithId restores the backup with the given restore id, or a generated one if
+// it's empty.
+func sendRestoreRequestWithId(t *testing.T, restoreId string) {
+	var idArg string
+	if restoreId != "" {
+		idArg = fmt.Sprintf(", restoreId: %q", restoreId)
+	}
+	restoreRequest := fmt.Sprintf(`mutation restore() {
 		 restore(input: {location: "/data/backup", backupId: "heuristic_sammet9",
-		 	encryptionKeyFile: "/data/keys/enc_key"}) {
+		 	encryptionKeyFile: "/data/keys/enc_key"%s}) {
 			response {
 				code
 				message
 			}
 		}
-	}`
+	}`, idArg)
 
 	adminUrl := "http://localhost:8180/admin"
 	params := testutil.GraphQLParams{
@@ -137,6 +149,636 @@ func TestBasicRestore(t *testing.T) {
 	runMutations(t, dg)
 }
 
+func TestQueryRightAfterRestore(t *testing.T) {
+	conn, err := grpc.Dial(testutil.SockAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	dg := dgo.NewDgraphClient(api.NewDgraphClient(conn))
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, dg.Alter(ctx, &api.Operation{DropAll: true}))
+
+		// The queries are sent as soon as the restore completes and must see all the
+		// restored data.
+		sendRestoreRequest(t)
+		runQueries(t, dg)
+	}
+}
+
+func TestRestoreRetry(t *testing.T) {
+	testRestoreRetry(t, "retried-restore")
+}
+
+// TestRestoreRetryWithoutId checks that sending the same restore again is detected with the id
+// derived from the backup.
+func TestRestoreRetryWithoutId(t *testing.T) {
+	testRestoreRetry(t, "")
+}
+
+func testRestoreRetry(t *testing.T, restoreId string) {
+	conn, err := grpc.Dial(testutil.SockAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	dg := dgo.NewDgraphClient(api.NewDgraphClient(conn))
+
+	ctx := context.Background()
+	require.NoError(t, dg.Alter(ctx, &api.Operation{DropAll: true}))
+	sendRestoreRequestWithId(t, restoreId)
+
+	_, err = dg.NewTxn().Mutate(ctx, &api.Mutation{
+		SetNquads: []byte(`<0x1> <retried> "kept" .`),
+		CommitNow: true,
+	})
+	require.NoError(t, err)
+
+	// Sending the request again with the same id should not ingest the backup again,
+	// which would drop the data added after the first restore.
+	sendRestoreRequestWithId(t, restoreId)
+	resp, err := dg.NewTxn().Query(ctx, `{
+	  q(func: has(retried)) {
+		retried
+	  }
+	}`)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"q":[{"retried":"kept"}]}`, string(resp.Json))
+	runQueries(t, dg)
+}
+
+func TestRestoreToFewerGroups(t *testing.T) {
+	conn, err := grpc.Dial(testutil.SockAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	dg := dgo.NewDgraphClient(api.NewDgraphClient(conn))
+
+	ctx := context.Background()
+	require.NoError(t, dg.Alter(ctx, &api.Operation{DropAll: true}))
+
+	// The backup was taken in a cluster with three groups. All of its predicates
+	// should be restored into the only group of this cluster.
+	restoreRequest := `mutation restore() {
+		 restore(input: {location: "/data/backup-3groups", backupId: "three_groups"}) {
+			response {
+				code
+				message
+			}
+		}
+	}`
+
+	adminUrl := "http://localhost:8180/admin"
+	params := testutil.GraphQLParams{
+		Query: restoreRequest,
+	}
+	b, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	resp, err := http.Post(adminUrl, "application/json", bytes.NewBuffer(b))
+	require.NoError(t, err)
+	buf, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(buf), "Restore completed.")
+
+	queryResp, err := dg.NewTxn().Query(ctx, `{
+	  q(func: has(name), orderasc: name) {
+		name
+		age
+		friend(orderasc: name) {
+		  name
+		}
+	  }
+	}`)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"q":[
+		{"name": "Alice", "age": 20, "friend": [{"name": "Bob"}, {"name": "Carol"}]},
+		{"name": "Bob", "age": 30, "friend": [{"name": "Carol"}]},
+		{"name": "Carol", "age": 40}
+	]}`, string(queryResp.Json))
+}
+
+func TestRestoreChecksum(t *testing.T) {
+	conn, err := grpc.Dial(testutil.SockAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	dg := dgo.NewDgraphClient(api.NewDgraphClient(conn))
+
+	restoreWithChecksum := func() string {
+		ctx := context.Background()
+		require.NoError(t, dg.Alter(ctx, &api.Operation{DropAll: true}))
+
+		restoreRequest := `mutation restore() {
+			 restore(input: {location: "/data/backup", backupId: "heuristic_sammet9",
+			 	encryptionKeyFile: "/data/keys/enc_key", computeChecksum: true}) {
+				response {
+					code
+					message
+				}
+				checksum
+			}
+		}`
+
+		adminUrl := "http://localhost:8180/admin"
+		params := testutil.GraphQLParams{
+			Query: restoreRequest,
+		}
+		b, err := json.Marshal(params)
+		require.NoError(t, err)
+
+		resp, err := http.Post(adminUrl, "application/json", bytes.NewBuffer(b))
+		require.NoError(t, err)
+		buf, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(buf), "Restore completed.")
+
+		var res struct {
+			Data struct {
+				Restore struct {
+					Checksum string
+				}
+			}
+		}
+		require.NoError(t, json.Unmarshal(buf, &res))
+		require.Len(t, res.Data.Restore.Checksum, 64)
+		return res.Data.Restore.Checksum
+	}
+
+	// Restoring the same backup again gives the same data.
+	require.Equal(t, restoreWithChecksum(), restoreWithChecksum())
+	runQueries(t, dg)
+}
+
+func TestRestoreWithSnapshot(t *testing.T) {
+	conn, err := grpc.Dial(testutil.SockAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	dg := dgo.NewDgraphClient(api.NewDgraphClient(conn))
+
+	ctx := context.Background()
+	require.NoError(t, dg.Alter(ctx, &api.Operation{DropAll: true}))
+
+	restoreRequest := `mutation restore() {
+		 restore(input: {location: "/data/backup", backupId: "heuristic_sammet9",
+		 	encryptionKeyFile: "/data/keys/enc_key", snapshot: true}) {
+			response {
+				code
+				message
+			}
+			snapshots {
+				group
+				index
+			}
+		}
+	}`
+
+	adminUrl := "http://localhost:8180/admin"
+	params := testutil.GraphQLParams{
+		Query: restoreRequest,
+	}
+	b, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	resp, err := http.Post(adminUrl, "application/json", bytes.NewBuffer(b))
+	require.NoError(t, err)
+	buf, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(buf), "Restore completed.")
+
+	var res struct {
+		Data struct {
+			Restore struct {
+				Snapshots []struct {
+					Group int
+					Index int
+				}
+			}
+		}
+	}
+	require.NoError(t, json.Unmarshal(buf, &res))
+	// The only group of the cluster took a snapshot that includes the restore.
+	snapshots := res.Data.Restore.Snapshots
+	require.Len(t, snapshots, 1)
+	require.Equal(t, 1, snapshots[0].Group)
+	require.Greater(t, snapshots[0].Index, 0)
+	runQueries(t, dg)
+	runMutations(t, dg)
+}
+
+func TestRestoreWithCompaction(t *testing.T) {
+	conn, err := grpc.Dial(testutil.SockAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	dg := dgo.NewDgraphClient(api.NewDgraphClient(conn))
+
+	ctx := context.Background()
+	require.NoError(t, dg.Alter(ctx, &api.Operation{DropAll: true}))
+
+	restoreRequest := `mutation restore() {
+		 restore(input: {location: "/data/backup", backupId: "heuristic_sammet9",
+		 	encryptionKeyFile: "/data/keys/enc_key", compact: true}) {
+			response {
+				code
+				message
+			}
+			compactions {
+				group
+				readAmplificationBefore
+				readAmplificationAfter
+			}
+		}
+	}`
+
+	adminUrl := "http://localhost:8180/admin"
+	params := testutil.GraphQLParams{
+		Query: restoreRequest,
+	}
+	b, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	resp, err := http.Post(adminUrl, "application/json", bytes.NewBuffer(b))
+	require.NoError(t, err)
+	buf, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(buf), "Restore completed.")
+
+	var res struct {
+		Data struct {
+			Restore struct {
+				Compactions []struct {
+					Group                   int
+					ReadAmplificationBefore int
+					ReadAmplificationAfter  int
+				}
+			}
+		}
+	}
+	require.NoError(t, json.Unmarshal(buf, &res))
+	// The only group of the cluster compacted the restored data.
+	compactions := res.Data.Restore.Compactions
+	require.Len(t, compactions, 1)
+	require.Equal(t, 1, compactions[0].Group)
+	require.LessOrEqual(t, compactions[0].ReadAmplificationAfter,
+		compactions[0].ReadAmplificationBefore)
+	runQueries(t, dg)
+	runMutations(t, dg)
+}
+
+func TestRestoreIngestions(t *testing.T) {
+	conn, err := grpc.Dial(testutil.SockAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	dg := dgo.NewDgraphClient(api.NewDgraphClient(conn))
+
+	ctx := context.Background()
+	require.NoError(t, dg.Alter(ctx, &api.Operation{DropAll: true}))
+
+	restoreRequest := `mutation restore() {
+		 restore(input: {location: "/data/backup", backupId: "heuristic_sammet9",
+		 	encryptionKeyFile: "/data/keys/enc_key"}) {
+			response {
+				code
+				message
+			}
+			ingestions {
+				predicate
+				bytes
+				duration
+			}
+		}
+	}`
+
+	adminUrl := "http://localhost:8180/admin"
+	params := testutil.GraphQLParams{
+		Query: restoreRequest,
+	}
+	b, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	resp, err := http.Post(adminUrl, "application/json", bytes.NewBuffer(b))
+	require.NoError(t, err)
+	buf, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(buf), "Restore completed.")
+
+	var res struct {
+		Data struct {
+			Restore struct {
+				Ingestions []struct {
+					Predicate string
+					Bytes     float64
+					Duration  float64
+				}
+			}
+		}
+	}
+	require.NoError(t, json.Unmarshal(buf, &res))
+	ingestions := res.Data.Restore.Ingestions
+	require.NotEmpty(t, ingestions)
+	for i, ingestion := range ingestions {
+		require.NotEmpty(t, ingestion.Predicate)
+		require.Greater(t, ingestion.Bytes, float64(0), ingestion.Predicate)
+		require.Greater(t, ingestion.Duration, float64(0), ingestion.Predicate)
+		// The slowest predicates come first.
+		if i > 0 {
+			require.LessOrEqual(t, ingestion.Duration, ingestions[i-1].Duration)
+		}
+	}
+	runQueries(t, dg)
+	runMutations(t, dg)
+}
+
+func TestRestoreWithoutIndexes(t *testing.T) {
+	conn, err := grpc.Dial(testutil.SockAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	dg := dgo.NewDgraphClient(api.NewDgraphClient(conn))
+
+	ctx := context.Background()
+	require.NoError(t, dg.Alter(ctx, &api.Operation{DropAll: true}))
+
+	restoreRequest := `mutation restore() {
+		 restore(input: {location: "/data/backup", backupId: "heuristic_sammet9",
+		 	encryptionKeyFile: "/data/keys/enc_key", rebuildIndexes: "none"}) {
+			response {
+				code
+				message
+			}
+			skippedIndexes
+		}
+	}`
+
+	adminUrl := "http://localhost:8180/admin"
+	params := testutil.GraphQLParams{
+		Query: restoreRequest,
+	}
+	b, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	resp, err := http.Post(adminUrl, "application/json", bytes.NewBuffer(b))
+	require.NoError(t, err)
+	buf, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(buf), "Restore completed.")
+
+	var res struct {
+		Data struct {
+			Restore struct {
+				SkippedIndexes []string
+			}
+		}
+	}
+	require.NoError(t, json.Unmarshal(buf, &res))
+	require.NotEmpty(t, res.Data.Restore.SkippedIndexes)
+
+	// Queries that need a skipped index fail instead of returning wrong results.
+	_, err = dg.NewTxn().Query(ctx, `{ q(func: eq(name@en, "Blade Runner")) { uid } }`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is not indexed")
+
+	// Restore the backup with its indexes so the other tests see the full data.
+	require.NoError(t, dg.Alter(ctx, &api.Operation{DropAll: true}))
+	sendRestoreRequest(t)
+	runQueries(t, dg)
+}
+
+func TestRestoreWithPostRestoreSchema(t *testing.T) {
+	conn, err := grpc.Dial(testutil.SockAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	dg := dgo.NewDgraphClient(api.NewDgraphClient(conn))
+
+	ctx := context.Background()
+	require.NoError(t, dg.Alter(ctx, &api.Operation{DropAll: true}))
+
+	sendRequest := func(schema string) string {
+		restoreRequest := `mutation restore($schema: String) {
+			 restore(input: {location: "/data/backup", backupId: "heuristic_sammet9",
+			 	encryptionKeyFile: "/data/keys/enc_key", postRestoreSchema: $schema}) {
+				response {
+					code
+					message
+				}
+			}
+		}`
+
+		adminUrl := "http://localhost:8180/admin"
+		params := testutil.GraphQLParams{
+			Query:     restoreRequest,
+			Variables: map[string]interface{}{"schema": schema},
+		}
+		b, err := json.Marshal(params)
+		require.NoError(t, err)
+
+		resp, err := http.Post(adminUrl, "application/json", bytes.NewBuffer(b))
+		require.NoError(t, err)
+		buf, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(buf)
+	}
+
+	// An invalid schema aborts the restore before any data is changed.
+	require.Contains(t, sendRequest("name: strin ."), "invalid post-restore schema")
+
+	// The trigram index added after the restore can be used right after it completes.
+	require.Contains(t, sendRequest("name: string @index(exact, term, trigram) @lang ."),
+		"Restore completed.")
+	resp, err := dg.NewTxn().Query(ctx,
+		`{ q(func: regexp(name@en, /^Blade Runner$/)) { name@en } }`)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"q":[{"name@en":"Blade Runner"}]}`, string(resp.GetJson()))
+
+	// Restore the backup with its own schema so the other tests see the original indexes.
+	require.NoError(t, dg.Alter(ctx, &api.Operation{DropAll: true}))
+	sendRestoreRequest(t)
+	runQueries(t, dg)
+}
+
+func TestCancelRestore(t *testing.T) {
+	conn, err := grpc.Dial(testutil.SockAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	dg := dgo.NewDgraphClient(api.NewDgraphClient(conn))
+
+	ctx := context.Background()
+	require.NoError(t, dg.Alter(ctx, &api.Operation{DropAll: true}))
+
+	sendRequest := func(query string) string {
+		adminUrl := "http://localhost:8180/admin"
+		params := testutil.GraphQLParams{
+			Query: query,
+		}
+		b, err := json.Marshal(params)
+		require.NoError(t, err)
+
+		resp, err := http.Post(adminUrl, "application/json", bytes.NewBuffer(b))
+		require.NoError(t, err)
+		buf, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(buf)
+	}
+	restoreRequest := `mutation restore() {
+		 restore(input: {location: "/data/backup", backupId: "heuristic_sammet9",
+		 	encryptionKeyFile: "/data/keys/enc_key", restoreId: "cancel-test"}) {
+			response {
+				code
+				message
+			}
+		}
+	}`
+	cancelRequest := `mutation cancelRestore() {
+		 cancelRestore(input: {restoreId: "cancel-test"}) {
+			response {
+				code
+				message
+			}
+		}
+	}`
+
+	// Start the restore and cancel it until it stops.
+	restoreCh := make(chan string, 1)
+	go func() {
+		restoreCh <- sendRequest(restoreRequest)
+	}()
+	var restoreResp string
+	for restoreResp == "" {
+		require.Contains(t, sendRequest(cancelRequest), "Restore cancel-test was cancelled.")
+		select {
+		case restoreResp = <-restoreCh:
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	require.Contains(t, restoreResp, "was cancelled")
+	require.NotContains(t, restoreResp, "Restore completed.")
+
+	// The id of a cancelled restore can't be reused.
+	require.Contains(t, sendRequest(restoreRequest), "restore cancel-test was already cancelled")
+
+	// Restoring the backup again brings the cluster back to a complete state.
+	require.NoError(t, dg.Alter(ctx, &api.Operation{DropAll: true}))
+	sendRestoreRequest(t)
+	runQueries(t, dg)
+
+	// An atomic restore that's cancelled is rolled back to the data the cluster had before.
+	_, err = dg.NewTxn().Mutate(ctx, &api.Mutation{
+		SetNquads: []byte(`<0x1> <beforeAtomic> "kept" .`),
+		CommitNow: true,
+	})
+	require.NoError(t, err)
+	atomicRequest := strings.Replace(restoreRequest, `restoreId: "cancel-test"`,
+		`restoreId: "atomic-cancel-test", atomic: true`, 1)
+	atomicCancel := strings.Replace(cancelRequest, "cancel-test", "atomic-cancel-test", 1)
+	go func() {
+		restoreCh <- sendRequest(atomicRequest)
+	}()
+	restoreResp = ""
+	for restoreResp == "" {
+		require.Contains(t, sendRequest(atomicCancel),
+			"Restore atomic-cancel-test was cancelled.")
+		select {
+		case restoreResp = <-restoreCh:
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	require.Contains(t, restoreResp, "was cancelled")
+	resp, err := dg.NewTxn().Query(ctx, `{
+	  q(func: has(beforeAtomic)) {
+		beforeAtomic
+	  }
+	}`)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"q":[{"beforeAtomic":"kept"}]}`, string(resp.Json))
+	runQueries(t, dg)
+}
+
+func TestRestoreDryRun(t *testing.T) {
+	conn, err := grpc.Dial(testutil.SockAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	dg := dgo.NewDgraphClient(api.NewDgraphClient(conn))
+
+	ctx := context.Background()
+	require.NoError(t, dg.Alter(ctx, &api.Operation{DropAll: true}))
+	sendRestoreRequest(t)
+
+	restoreRequest := `mutation restore() {
+		 restore(input: {location: "/data/backup", backupId: "heuristic_sammet9",
+		 	encryptionKeyFile: "/data/keys/enc_key", dryRun: true}) {
+			response {
+				code
+				message
+			}
+			estimate {
+				numFiles
+				size
+				throughput
+				measuredThroughput
+				estimatedDuration
+			}
+		}
+	}`
+
+	adminUrl := "http://localhost:8180/admin"
+	params := testutil.GraphQLParams{
+		Query: restoreRequest,
+	}
+	b, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	resp, err := http.Post(adminUrl, "application/json", bytes.NewBuffer(b))
+	require.NoError(t, err)
+	buf, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(buf), "Restore dry run completed.")
+
+	var res struct {
+		Data struct {
+			Restore struct {
+				Estimate struct {
+					NumFiles           int
+					Size               float64
+					Throughput         float64
+					MeasuredThroughput bool
+					EstimatedDuration  float64
+				}
+			}
+		}
+	}
+	require.NoError(t, json.Unmarshal(buf, &res))
+	estimate := res.Data.Restore.Estimate
+	require.NotZero(t, estimate.NumFiles)
+	require.NotZero(t, estimate.Size)
+	// The restore above measured the throughput of this alpha.
+	require.True(t, estimate.MeasuredThroughput)
+	require.InDelta(t, estimate.Size/estimate.Throughput, estimate.EstimatedDuration, 1e-6)
+
+	// The data restored before is left untouched.
+	runQueries(t, dg)
+}
+
+func TestRestoreMinExpectedPredicates(t *testing.T) {
+	conn, err := grpc.Dial(testutil.SockAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	dg := dgo.NewDgraphClient(api.NewDgraphClient(conn))
+
+	ctx := context.Background()
+	require.NoError(t, dg.Alter(ctx, &api.Operation{DropAll: true}))
+	sendRestoreRequest(t)
+
+	restoreRequest := `mutation restore() {
+		 restore(input: {location: "/data/backup", backupId: "heuristic_sammet9",
+		 	encryptionKeyFile: "/data/keys/enc_key", minExpectedPredicates: 1000}) {
+			response {
+				code
+				message
+			}
+		}
+	}`
+
+	adminUrl := "http://localhost:8180/admin"
+	params := testutil.GraphQLParams{
+		Query: restoreRequest,
+	}
+	b, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	resp, err := http.Post(adminUrl, "application/json", bytes.NewBuffer(b))
+	require.NoError(t, err)
+	buf, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(buf),
+		"backup at /data/backup has 17 predicates, fewer than the 1000 expected")
+
+	// The restore was aborted before changing the data restored before.
+	runQueries(t, dg)
+}
+
 func TestInvalidBackupId(t *testing.T) {
 	restoreRequest := `mutation restore() {
 		 restore(input: {location: "/data/backup", backupId: "bad-backup-id",
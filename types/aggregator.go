@@ -0,0 +1,97 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package types
+
+// Aggregators maps the names of the built-in aggregators to the functions telling whether they
+// can be applied to the values of a type. It's the list of the aggregators that the parser, the
+// query processing and the workers accept.
+var Aggregators = map[string]func(typ TypeID) bool{
+	"min":            isOrderable,
+	"max":            isOrderable,
+	"groupconcat":    isConcatenable,
+	"distinctvalues": isConcatenable,
+	"sum":            isNumeric,
+	"avg":            isNumeric,
+	"trimmedmean":    isNumeric,
+	"hmean":          isNumeric,
+	"gmean":          isNumeric,
+	"cv":             isNumeric,
+	"tdigest":        isNumeric,
+	"gini":           isNumeric,
+	"sem":            isNumeric,
+	"sumdistinct":    isNumeric,
+	"bitor":          func(typ TypeID) bool { return typ == IntID },
+	"bitand":         func(typ TypeID) bool { return typ == IntID },
+	"countnonnull":   TypeID.IsScalar,
+	// The values of password predicates are never returned.
+	"any":   isReturnable,
+	"first": isReturnable,
+	"last":  isReturnable,
+	// countdistinct counts the edges of uid predicates as well as the values of the others.
+	"countdistinct": func(typ TypeID) bool { return typ != PasswordID },
+}
+
+func isOrderable(typ TypeID) bool {
+	return typ == IntID || typ == FloatID || typ == DateTimeID || typ == StringID ||
+		typ == DefaultID
+}
+
+func isConcatenable(typ TypeID) bool {
+	return isOrderable(typ) || typ == BoolID
+}
+
+func isNumeric(typ TypeID) bool {
+	return typ == IntID || typ == FloatID
+}
+
+func isReturnable(typ TypeID) bool {
+	return typ.IsScalar() && typ != PasswordID
+}
+
+// IsAggregator returns true if name is the name of a built-in aggregator or of a custom one.
+func IsAggregator(name string) bool {
+	_, ok := Aggregators[name]
+	return ok || isCustomAggregator(name)
+}
+
+// CanAggregate returns true if the aggregator with the given name can be applied to the values
+// of typ. The custom aggregators get the values of all the scalar types, except those of
+// password predicates, which are never returned.
+func CanAggregate(name string, typ TypeID) bool {
+	if canAggregate, ok := Aggregators[name]; ok {
+		return canAggregate(typ)
+	}
+	return isCustomAggregator(name) && isReturnable(typ)
+}
+
+// isCustomAggregator returns true if a custom aggregator is registered under the given name.
+var isCustomAggregator = noCustomAggregator
+
+func noCustomAggregator(string) bool {
+	return false
+}
+
+// SetCustomAggregators sets the function telling whether a custom aggregator is registered under
+// a name, so that the parser and the workers accept the names of the custom aggregators like
+// those of the built-in ones. It's set by the query package, which holds the custom aggregators.
+// A nil function means that there's none.
+func SetCustomAggregators(isCustom func(name string) bool) {
+	if isCustom == nil {
+		isCustom = noCustomAggregator
+	}
+	isCustomAggregator = isCustom
+}
@@ -0,0 +1,49 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanAggregate(t *testing.T) {
+	tests := []struct {
+		name string
+		typ  TypeID
+		want bool
+	}{
+		{"min", DateTimeID, true},
+		{"min", BoolID, false},
+		{"groupconcat", BoolID, true},
+		{"sum", StringID, false},
+		{"bitor", FloatID, false},
+		{"countnonnull", PasswordID, true},
+		{"first", PasswordID, false},
+		{"countdistinct", UidID, true},
+		{"countdistinct", PasswordID, false},
+		{"max", UidID, false},
+		{"unknown", IntID, false},
+	}
+	for _, tc := range tests {
+		require.Equal(t, tc.want, CanAggregate(tc.name, tc.typ), "%s on %s", tc.name,
+			tc.typ.Name())
+	}
+	require.True(t, IsAggregator("countdistinct"))
+	require.False(t, IsAggregator("topk"))
+}
@@ -0,0 +1,313 @@
+// +build !oss
+
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Dgraph Community License (the "License"); you
+ * may not use this file except in compliance with the License. You
+ * may obtain a copy of the License at
+ *
+ *     https://github.com/dgraph-io/dgraph/blob/master/licenses/DCL.txt
+ */
+
+package worker
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+
+	"github.com/dgraph-io/dgraph/x"
+)
+
+// backupArchives holds the directories that the backup archives read by the file handler were
+// extracted into, by the path of the archive. An archive is extracted once, however many times
+// the restores read its location, and it's removed once every restore that acquired it with
+// acquireBackupArchive released it.
+var backupArchives = struct {
+	sync.Mutex
+	dirs map[string]*extractedArchive
+}{dirs: make(map[string]*extractedArchive)}
+
+// extractedArchive is a backup archive extracted into a temporary directory. The size and the
+// modification time of the archive tell whether it was replaced since it was extracted, and refs
+// is the number of callers that hold it.
+type extractedArchive struct {
+	dir     string
+	size    int64
+	modTime time.Time
+	refs    int
+}
+
+// archiveDiskSpace returns the disk space available to extract the backup archives into.
+var archiveDiskSpace = diskSpace
+
+// isBackupArchive returns true if the path of a backup location is a tar.gz or zip archive of
+// the backup instead of a directory.
+func isBackupArchive(path string) bool {
+	return isTarGzArchive(path) || strings.HasSuffix(path, ".zip")
+}
+
+func isTarGzArchive(path string) bool {
+	return strings.HasSuffix(path, ".tar.gz") || strings.HasSuffix(path, ".tgz")
+}
+
+// acquireBackupArchive extracts the backup archive at the given location, unless it's already
+// extracted, and holds the directory it's extracted into until the returned function is called.
+// It does nothing for locations that aren't archives. The files of an archive are only read
+// while it's held, so that a restore never removes the files another one is reading.
+func acquireBackupArchive(location string) (func(), error) {
+	uri, err := url.Parse(location)
+	if err != nil || (uri.Scheme != "" && uri.Scheme != "file") || !isBackupArchive(uri.Path) {
+		// The backup handler reports the invalid locations.
+		return func() {}, nil
+	}
+	path := uri.Path
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read backup archive")
+	}
+
+	backupArchives.Lock()
+	defer backupArchives.Unlock()
+	a, ok := backupArchives.dirs[path]
+	if !ok || a.size != fi.Size() || !a.modTime.Equal(fi.ModTime()) {
+		// The archive is extracted again if it was replaced. The previous directory is removed
+		// once the callers that hold it release it.
+		dir, err := extractBackupArchiveDir(path)
+		if err != nil {
+			return nil, err
+		}
+		a = &extractedArchive{dir: dir, size: fi.Size(), modTime: fi.ModTime()}
+		backupArchives.dirs[path] = a
+	}
+	a.refs++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { releaseBackupArchive(path, a) })
+	}, nil
+}
+
+// releaseBackupArchive releases a hold of the backup archive at the given path, removing the
+// directory it was extracted into once it isn't held anymore.
+func releaseBackupArchive(path string, a *extractedArchive) {
+	backupArchives.Lock()
+	defer backupArchives.Unlock()
+	if a.refs--; a.refs > 0 {
+		return
+	}
+	if err := os.RemoveAll(a.dir); err != nil {
+		glog.Warningf("Cannot remove the extracted backup archive %s: %v", a.dir, err)
+	}
+	if backupArchives.dirs[path] == a {
+		delete(backupArchives.dirs, path)
+	}
+}
+
+// backupArchiveDir returns the directory the backup archive at the given path was extracted
+// into. The archive must be held with acquireBackupArchive.
+func backupArchiveDir(path string) (string, error) {
+	backupArchives.Lock()
+	defer backupArchives.Unlock()
+	a, ok := backupArchives.dirs[path]
+	if !ok {
+		return "", errors.Errorf("backup archive %s is read before it's extracted", path)
+	}
+	return a.dir, nil
+}
+
+// extractBackupArchiveDir extracts the backup archive at the given path into a new temporary
+// directory and returns it.
+func extractBackupArchiveDir(path string) (string, error) {
+	dir, err := ioutil.TempDir("", "dgraph-backup-archive-")
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot create directory to extract backup archive")
+	}
+	start := time.Now()
+	if err := extractBackupArchive(path, dir); err != nil {
+		x.Ignore(os.RemoveAll(dir))
+		return "", errors.Wrapf(err, "cannot extract backup archive %s", path)
+	}
+	if err := checkArchiveManifests(dir); err != nil {
+		x.Ignore(os.RemoveAll(dir))
+		return "", errors.Wrapf(err, "invalid backup archive %s", path)
+	}
+	glog.Infof("Extracted backup archive %s into %s in %s", path, dir, time.Since(start))
+	return dir, nil
+}
+
+// extractBackupArchive extracts the tar.gz or zip archive at the given path into dir. The files
+// are streamed out of the archive one at a time, and the extraction fails once they take more
+// space than is available in dir, or more than x.WorkerConfig.BackupArchiveLimit if it's set,
+// instead of filling up the disk.
+func extractBackupArchive(path, dir string) error {
+	avail, err := archiveDiskSpace(dir)
+	if err != nil {
+		return errors.Wrapf(err, "cannot read the disk space available to extract the "+
+			"backup archive")
+	}
+	w := &archiveWriter{dir: dir, avail: int64(avail)}
+	if limit := x.WorkerConfig.BackupArchiveLimit; limit > 0 && limit < w.avail {
+		w.avail = limit
+	}
+	if isTarGzArchive(path) {
+		return w.extractTarGz(path)
+	}
+	return w.extractZip(path)
+}
+
+// archiveWriter writes the files extracted from a backup archive under dir. avail is the
+// number of bytes that can be written in total, and written is the number of bytes written so
+// far.
+type archiveWriter struct {
+	dir     string
+	avail   int64
+	written int64
+}
+
+func (w *archiveWriter) extractTarGz(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := w.mkdir(hdr.Name); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := w.writeFile(hdr.Name, tr); err != nil {
+				return err
+			}
+		default:
+			// Backups only hold directories and regular files.
+			glog.Warningf("Skipping %s in backup archive, which is not a regular file", hdr.Name)
+		}
+	}
+}
+
+func (w *archiveWriter) extractZip(path string) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			if err := w.mkdir(f.Name); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			err := func() error {
+				r, err := f.Open()
+				if err != nil {
+					return err
+				}
+				defer r.Close()
+				return w.writeFile(f.Name, r)
+			}()
+			if err != nil {
+				return err
+			}
+		default:
+			glog.Warningf("Skipping %s in backup archive, which is not a regular file", f.Name)
+		}
+	}
+	return nil
+}
+
+// target returns the path the entry with the given name in the archive is extracted to. Names
+// that would be extracted out of dir are rejected.
+func (w *archiveWriter) target(name string) (string, error) {
+	path := filepath.Join(w.dir, filepath.FromSlash(name))
+	if path != w.dir && !strings.HasPrefix(path, w.dir+string(filepath.Separator)) {
+		return "", errors.Errorf("the backup archive holds a file outside of it: %s", name)
+	}
+	return path, nil
+}
+
+func (w *archiveWriter) mkdir(name string) error {
+	path, err := w.target(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(path, 0700)
+}
+
+func (w *archiveWriter) writeFile(name string, r io.Reader) error {
+	path, err := w.target(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// One more byte than what's left is copied to tell whether the file fits.
+	n, err := io.Copy(f, io.LimitReader(r, w.avail-w.written+1))
+	if err != nil {
+		return err
+	}
+	if w.written += n; w.written > w.avail {
+		return errors.Errorf("the extracted backup doesn't fit in the %d bytes available in %s. "+
+			"Use --backup_archive_limit_mb to change the limit", w.avail, w.dir)
+	}
+	return nil
+}
+
+// checkArchiveManifests returns an error if the backup extracted into dir doesn't have a valid
+// manifest, i.e. the archive doesn't hold a backup.
+func checkArchiveManifests(dir string) error {
+	suffix := filepath.Join(string(filepath.Separator), backupManifest)
+	paths := x.WalkPathFunc(dir, func(path string, isdir bool) bool {
+		return !isdir && strings.HasSuffix(path, suffix)
+	})
+	if len(paths) == 0 {
+		return errors.Errorf("no %s found in the backup archive", backupManifest)
+	}
+	h := &fileHandler{}
+	for _, path := range paths {
+		var m Manifest
+		if err := h.readManifest(path, &m); err != nil {
+			rel, _ := filepath.Rel(dir, path)
+			return errors.Wrapf(err, "cannot read %s in the backup archive", rel)
+		}
+	}
+	return nil
+}
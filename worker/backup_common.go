@@ -18,10 +18,19 @@ package worker
 
 import (
 	"sync"
+	"time"
 
 	"github.com/dgraph-io/dgraph/protos/pb"
 )
 
+// backupVersion is the version of the format of the backups written by this version of Dgraph.
+// It's stored in the manifest so that a restore knows how to read the backup. Backups written
+// before versions were added don't have one in their manifest and have version 0. Version 1
+// only started recording the version, so the backups of both versions are read the same way.
+// A version that changes the format of the keys and values must convert the older backups
+// while they're loaded.
+const backupVersion = 1
+
 // predicateSet is a map whose keys are predicates. It is meant to be used as a set.
 type predicateSet map[string]struct{}
 
@@ -52,6 +61,14 @@ type Manifest struct {
 	Path string `json:"-"`
 	// Encrypted indicates whether this backup was encrypted or not.
 	Encrypted bool `json:"encrypted"`
+	// Algorithm is the algorithm this backup was encrypted with, if it was encrypted. Backups
+	// taken before it was recorded were encrypted with AES-CTR.
+	Algorithm string `json:"algorithm,omitempty"`
+	// Version is the version of the backup format this backup was written in.
+	Version int `json:"version"`
+	// Size is the size in bytes of the data in this backup before it was compressed, summed
+	// over the groups. It's zero for the backups taken before it was recorded.
+	Size uint64 `json:"size,omitempty"`
 }
 
 func (m *Manifest) getPredsInGroup(gid uint32) predicateSet {
@@ -67,13 +84,144 @@ func (m *Manifest) getPredsInGroup(gid uint32) predicateSet {
 	return predSet
 }
 
+// RestoreResult holds the outcome of an online restore.
+type RestoreResult struct {
+	// RestoreId is the id of the restore, which is generated if the request didn't have one.
+	RestoreId string
+	// Checksum is the checksum of all the restored data, if it was requested.
+	Checksum string
+	// SkippedIndexes holds the original schema of the predicates whose indexes were not
+	// restored. Applying it with an alter operation rebuilds them.
+	SkippedIndexes []string
+	// SkippedPredicates holds the predicates that couldn't be restored, if errors were skipped.
+	SkippedPredicates []string
+	// Location is the location the backup was restored from, which is the first reachable
+	// one if several were given.
+	Location string
+	// Estimate holds the report of a dry-run restore. It's nil otherwise.
+	Estimate *RestoreEstimate
+	// TabletMoves holds the tablets moved to balance the groups, if rebalancing was requested.
+	TabletMoves []TabletMove
+	// Verification holds the report of the checksum verification of a dry-run restore, if it
+	// was requested.
+	Verification *RestoreVerification
+	// Coercions holds the number of values converted for each predicate whose type was
+	// coerced.
+	Coercions []CoercionReport
+	// ReplayedTransactions is the number of transactions of the write-ahead log replayed on
+	// top of the backup, if a log was given.
+	ReplayedTransactions int
+	// Diff holds the report of the comparison with a second backup, if one was given. The
+	// backup isn't restored then.
+	Diff *RestoreDiff
+	// Snapshots holds the snapshot taken by each group once it restored the backup, ordered by
+	// group, if snapshots were requested.
+	Snapshots []GroupSnapshot
+	// Compactions holds the compaction of the restored data by each group, ordered by group,
+	// if compacting it was requested.
+	Compactions []GroupCompaction
+	// Ingestions holds the time taken to ingest each predicate of the backup and its size,
+	// the slowest first.
+	Ingestions []PredicateIngestion
+}
+
+// PredicateIngestion is the time taken by a restore to ingest the keys of a predicate and
+// their size in bytes, which includes its indexes.
+type PredicateIngestion struct {
+	Predicate string
+	Bytes     uint64
+	Duration  time.Duration
+}
+
+// GroupSnapshot is the snapshot taken by a group after a restore, with the index of the last
+// Raft entry it includes.
+type GroupSnapshot struct {
+	Group uint32
+	Index uint64
+}
+
+// GroupCompaction is the compaction of the data restored by a group. The read amplification
+// is the number of tables or levels that a lookup of a key may have to check, before and after
+// the compaction, and Level is the level of the LSM tree that holds the tables after it.
+type GroupCompaction struct {
+	Group                   uint32
+	TablesBefore            int
+	TablesAfter             int
+	ReadAmplificationBefore int
+	ReadAmplificationAfter  int
+	Level                   int
+	Duration                time.Duration
+}
+
+// RestoreDiff is the report of the comparison of a backup with a second one.
+type RestoreDiff struct {
+	// Location is the location of the second backup.
+	Location string
+	// PredicatesCompared is the number of predicates found in either backup.
+	PredicatesCompared int
+	// Predicates holds the predicates whose data differs between the backups, ordered by
+	// name. The backups are identical if it's empty.
+	Predicates []PredicateDiff
+}
+
+// PredicateDiff is a predicate whose data differs between a backup and a second one. The
+// counts are the numbers of nodes that have the predicate, and the checksums are those of its
+// schema and all its keys. The checksum is empty if the predicate isn't in the backup.
+type PredicateDiff struct {
+	Predicate     string
+	Count         uint64
+	OtherCount    uint64
+	Checksum      string
+	OtherChecksum string
+}
+
+// CoercionReport is the number of values of a predicate converted to another type by a
+// restore, and of the values that couldn't be converted and were skipped.
+type CoercionReport struct {
+	Predicate string
+	Coerced   uint64
+	Failed    uint64
+}
+
+// TabletMove is a tablet moved from a group to another.
+type TabletMove struct {
+	Predicate string
+	FromGroup uint32
+	ToGroup   uint32
+}
+
+// RestoreEstimate is the report of a dry-run restore. It estimates how long restoring the
+// backup would take from the size of its files and the ingest throughput of this alpha.
+type RestoreEstimate struct {
+	// NumFiles is the number of backup files that would be ingested.
+	NumFiles int
+	// Size is the total size in bytes of the backup files.
+	Size int64
+	// Throughput is the ingest throughput in bytes per second used for the estimate.
+	Throughput float64
+	// Measured is true if the throughput was measured by a previous restore processed by
+	// this alpha. Otherwise, a conservative default is used.
+	Measured bool
+	// Duration is the estimated duration of the restore.
+	Duration time.Duration
+}
+
+// RestoreVerification is the report of the checksum verification of the files of a backup.
+type RestoreVerification struct {
+	// FilesVerified is the number of backup files whose checksums were verified.
+	FilesVerified int
+	// Duration is the time taken to verify all the files.
+	Duration time.Duration
+}
+
 // Credentials holds the credentials needed to perform a backup operation.
 // If these credentials are missing the default credentials will be used.
 type Credentials struct {
-	AccessKey    string
-	SecretKey    string
-	SessionToken string
-	Anonymous    bool
+	AccessKey     string
+	SecretKey     string
+	SessionToken  string
+	Anonymous     bool
+	RequesterPays bool
 }
 
 func (creds *Credentials) isAnonymous() bool {
@@ -92,3 +240,14 @@ func GetCredentialsFromRequest(req *pb.BackupRequest) *Credentials {
 		Anonymous:    req.GetAnonymous(),
 	}
 }
+
+// restoreCredentials extracts the credentials from a restore request.
+func restoreCredentials(req *pb.RestoreRequest) *Credentials {
+	return &Credentials{
+		AccessKey:     req.GetAccessKey(),
+		SecretKey:     req.GetSecretKey(),
+		SessionToken:  req.GetSessionToken(),
+		Anonymous:     req.GetAnonymous(),
+		RequesterPays: req.GetRequesterPays(),
+	}
+}
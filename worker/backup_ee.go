@@ -18,6 +18,7 @@ import (
 	"sort"
 	"time"
 
+	"github.com/dgraph-io/dgraph/ee/enc"
 	"github.com/dgraph-io/dgraph/posting"
 	"github.com/dgraph-io/dgraph/protos/pb"
 	"github.com/dgraph-io/dgraph/x"
@@ -155,25 +156,32 @@ func ProcessBackupRequest(ctx context.Context, req *pb.BackupRequest, forceFull
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	errCh := make(chan error, len(state.Groups))
+	type backupResult struct {
+		res *pb.Status
+		err error
+	}
+	resCh := make(chan backupResult, len(state.Groups))
 	for _, gid := range groups {
 		br := proto.Clone(req).(*pb.BackupRequest)
 		br.GroupId = gid
 		br.Predicates = predMap[gid]
 		go func(req *pb.BackupRequest) {
-			_, err := BackupGroup(ctx, req)
-			errCh <- err
+			res, err := BackupGroup(ctx, req)
+			resCh <- backupResult{res: res, err: err}
 		}(br)
 	}
 
+	var size uint64
 	for range groups {
-		if err := <-errCh; err != nil {
-			glog.Errorf("Error received during backup: %v", err)
-			return err
+		result := <-resCh
+		if result.err != nil {
+			glog.Errorf("Error received during backup: %v", result.err)
+			return result.err
 		}
+		size += result.res.GetUncompressedSize()
 	}
 
-	m := Manifest{Since: req.ReadTs, Groups: predMap}
+	m := Manifest{Since: req.ReadTs, Groups: predMap, Version: backupVersion, Size: size}
 	if req.SinceTs == 0 {
 		m.Type = "full"
 		m.BackupId = x.GetRandomName(1)
@@ -184,6 +192,9 @@ func ProcessBackupRequest(ctx context.Context, req *pb.BackupRequest, forceFull
 		m.BackupNum = latestManifest.BackupNum + 1
 	}
 	m.Encrypted = (x.WorkerConfig.EncryptionKey != nil)
+	if m.Encrypted {
+		m.Algorithm = enc.AlgorithmCTR
+	}
 
 	bp := NewBackupProcessor(nil, req)
 	return bp.CompleteBackup(ctx, &m)
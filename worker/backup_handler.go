@@ -17,6 +17,7 @@ import (
 	"io"
 	"net/url"
 
+	"github.com/dgraph-io/dgraph/ee/enc"
 	"github.com/dgraph-io/dgraph/protos/pb"
 
 	"github.com/pkg/errors"
@@ -47,6 +48,17 @@ const (
 	// because it used by subsequent incremental backups.
 	// "groups" are the group IDs that participated.
 	backupManifest = `manifest.json`
+
+	// backupManifestIndex is the name of the index of the manifests, written at the root of
+	// the backup location. It lists the manifests of all the backups along with their paths,
+	// so that they can be found without scanning the location, which is slow for locations
+	// with many backups. The location is scanned if it has no index.
+	backupManifestIndex = `manifests.json`
+
+	// backupLatestManifest is the name of the file written at the root of the backup location
+	// with the path of the manifest of the latest backup, relative to the location. It's
+	// written before the manifest, so an index that doesn't list it is out of date.
+	backupLatestManifest = `latest_manifest`
 )
 
 // UriHandler interface is implemented by URI scheme handlers.
@@ -81,10 +93,17 @@ type UriHandler interface {
 	Load(*url.URL, string, loadFn) LoadResult
 
 	// Verify checks that the specified backup can be restored to a cluster with the
-	// given groups. The last manifest of that backup should have the same number of
-	// groups as given list of groups.
+	// given groups. The number of groups in the backup and the cluster can differ.
 	Verify(*url.URL, string, []uint32) error
 
+	// Size returns the total size in bytes of the backup files that Load would read for
+	// the given backup series.
+	Size(*url.URL, string) (int64, error)
+
+	// OpenBackupFile opens the backup file or object at the given path for reading. The path
+	// is the one Load reads the file from, i.e. next to the manifest of its backup.
+	OpenBackupFile(*url.URL, string) (io.ReadCloser, error)
+
 	// ListManifests will scan the provided URI and return the paths to the manifests stored
 	// in that location.
 	ListManifests(*url.URL) ([]string, error)
@@ -92,6 +111,26 @@ type UriHandler interface {
 	// ReadManifest will read the manifest at the given location and load it into the given
 	// Manifest object.
 	ReadManifest(string, *Manifest) error
+
+	// ReadManifestIndex returns the content of the index of the manifests stored in the
+	// provided URI, or nil if there's no index.
+	ReadManifestIndex(*url.URL) ([]byte, error)
+
+	// WriteManifestIndex replaces the index of the manifests stored in the provided URI with
+	// the given content.
+	WriteManifestIndex(*url.URL, []byte) error
+
+	// ReadLatestManifest returns the path of the manifest of the latest backup stored in the
+	// provided URI, relative to it, or an empty string if it wasn't recorded.
+	ReadLatestManifest(*url.URL) (string, error)
+
+	// WriteLatestManifest records the path of the manifest of the latest backup stored in
+	// the provided URI, relative to it.
+	WriteLatestManifest(*url.URL, string) error
+
+	// WriteFile writes the given content to the file or object at the provided URI, replacing
+	// it if it exists.
+	WriteFile(*url.URL, []byte) error
 }
 
 // getHandler returns a UriHandler for the URI scheme.
@@ -142,9 +181,12 @@ func NewUriHandler(uri *url.URL, creds *Credentials) (UriHandler, error) {
 }
 
 // loadFn is a function that will receive the current file being read.
-// A reader, the backup groupId, and a map whose keys are the predicates to restore
-// are passed as arguments.
-type loadFn func(reader io.Reader, groupId int, preds predicateSet) (uint64, error)
+// A reader, the backup groupId, a map whose keys are the predicates to restore and
+// the manifest of the backup the file belongs to are passed as arguments. The manifest
+// holds the version of the backup format the file was written in and the algorithm it
+// was encrypted with.
+type loadFn func(reader io.Reader, groupId int, preds predicateSet,
+	manifest *Manifest) (uint64, error)
 
 // LoadBackup will scan location l for backup files in the given backup series and load them
 // sequentially. Returns the maximum Since value on success, otherwise an error.
@@ -192,19 +234,19 @@ func ListBackupManifests(l string, creds *Credentials) (map[string]*Manifest, er
 		return nil, errors.Errorf("Unsupported URI: %v", uri)
 	}
 
-	paths, err := h.ListManifests(uri)
+	release, err := acquireBackupArchive(l)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	manifests, err := readManifests(h, uri)
 	if err != nil {
 		return nil, err
 	}
 
 	listedManifests := make(map[string]*Manifest)
-	for _, path := range paths {
-		var m Manifest
-		if err := h.ReadManifest(path, &m); err != nil {
-			return nil, errors.Wrapf(err, "While reading %q", path)
-		}
-		m.Path = path
-		listedManifests[path] = &m
+	for _, m := range manifests {
+		listedManifests[m.Path] = m
 	}
 
 	return listedManifests, nil
@@ -265,6 +307,20 @@ func verifyManifests(manifests []*Manifest) error {
 			return errors.Errorf("found a manifest with backup number %d but expected %d",
 				manifest.BackupNum, backupNum)
 		}
+
+		if manifest.Version > backupVersion {
+			return errors.Errorf("backup number %d of series %s was written in version %d of "+
+				"the backup format, but this version of Dgraph can only restore backups up to "+
+				"version %d. Use a newer version of Dgraph to restore it",
+				manifest.BackupNum, manifest.BackupId, manifest.Version, backupVersion)
+		}
+
+		if manifest.Encrypted {
+			if err := enc.CheckAlgorithm(manifest.Algorithm); err != nil {
+				return errors.Wrapf(err, "cannot decrypt backup number %d of series %s",
+					manifest.BackupNum, manifest.BackupId)
+			}
+		}
 	}
 
 	return nil
@@ -274,8 +330,9 @@ func backupName(since uint64, groupId uint32) string {
 	return fmt.Sprintf(backupNameFmt, since, groupId)
 }
 
-// verifyGroupsInBackup checks that the groups in the last manifest match the groups in
-// the current cluster.  If they don't match, the backup cannot be restored to the cluster.
+// verifyGroupsInBackup checks that the last manifest contains the predicates of at least one
+// group. The groups in the backup don't need to match the groups in the current cluster
+// because the predicates are re-sharded according to the cluster's membership on restore.
 func verifyGroupsInBackup(manifests []*Manifest, currentGroups []uint32) error {
 	var maxBackupNum uint64
 	var lastManifest *Manifest
@@ -286,14 +343,11 @@ func verifyGroupsInBackup(manifests []*Manifest, currentGroups []uint32) error {
 		}
 	}
 
-	if len(currentGroups) != len(lastManifest.Groups) {
-		return errors.Errorf("groups in cluster and latest backup manifest differ")
+	if lastManifest == nil || len(lastManifest.Groups) == 0 {
+		return errors.Errorf("latest backup manifest does not contain any groups")
 	}
-
-	for _, group := range currentGroups {
-		if _, ok := lastManifest.Groups[group]; !ok {
-			return errors.Errorf("groups in cluster and latest backup manifest differ")
-		}
+	if len(currentGroups) == 0 {
+		return errors.Errorf("cannot restore backup to a cluster with no groups")
 	}
 	return nil
 }
@@ -13,9 +13,44 @@
 package worker
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/dgraph-io/badger/v2"
+	bpb "github.com/dgraph-io/badger/v2/pb"
+	"github.com/dgryski/go-farm"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/raft/raftpb"
+
+	"github.com/dgraph-io/dgraph/codec"
+	"github.com/dgraph-io/dgraph/ee/enc"
+	"github.com/dgraph-io/dgraph/posting"
+	"github.com/dgraph-io/dgraph/protos/pb"
+	"github.com/dgraph-io/dgraph/raftwal"
+	"github.com/dgraph-io/dgraph/schema"
+	"github.com/dgraph-io/dgraph/types"
+	"github.com/dgraph-io/dgraph/x"
 )
 
 func TestGetHandler(t *testing.T) {
@@ -138,3 +173,2286 @@ func TestFilterManifestDifferentSeries(t *testing.T) {
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "found a manifest with backup ID")
 }
+
+func TestVerifyGroupsInBackupDifferentGroups(t *testing.T) {
+	manifests := []*Manifest{
+		{
+			Type:      "full",
+			BackupId:  "aa",
+			BackupNum: 1,
+			Groups: map[uint32][]string{
+				1: {"name"},
+				2: {"age"},
+				3: {"friend"},
+			},
+		},
+	}
+	require.NoError(t, verifyGroupsInBackup(manifests, []uint32{1}))
+
+	manifests[0].Groups = nil
+	err := verifyGroupsInBackup(manifests, []uint32{1})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "does not contain any groups")
+}
+
+func TestRestoreGroupMap(t *testing.T) {
+	manifest := &Manifest{
+		Groups: map[uint32][]string{
+			1: {"name", "dgraph.type"},
+			2: {"age"},
+			3: {"friend"},
+			4: {"email"},
+		},
+	}
+
+	// All the predicates are restored into the only group.
+	state := &pb.MembershipState{Groups: map[uint32]*pb.Group{1: {}}}
+	require.Equal(t, map[string]uint32{
+		"name": 1, "dgraph.type": 1, "age": 1, "friend": 1, "email": 1,
+	}, restoreGroupMap(manifest, state))
+
+	// Existing groups are kept and the missing ones are spread in order.
+	state = &pb.MembershipState{Groups: map[uint32]*pb.Group{1: {}, 2: {}}}
+	require.Equal(t, map[string]uint32{
+		"name": 1, "dgraph.type": 1, "age": 2, "friend": 1, "email": 2,
+	}, restoreGroupMap(manifest, state))
+
+	// Predicates stay in the group that serves their tablet.
+	state = &pb.MembershipState{Groups: map[uint32]*pb.Group{
+		1: {},
+		2: {Tablets: map[string]*pb.Tablet{"name": {GroupId: 2, Predicate: "name"}}},
+	}}
+	require.Equal(t, map[string]uint32{
+		"name": 2, "dgraph.type": 1, "age": 2, "friend": 1, "email": 2,
+	}, restoreGroupMap(manifest, state))
+}
+
+func TestRequestGroupMap(t *testing.T) {
+	manifest := &Manifest{
+		Groups: map[uint32][]string{
+			1: {"name", "dgraph.type"},
+			2: {"age"},
+		},
+	}
+
+	// The groups assigned in the request are used as they are.
+	state := &pb.MembershipState{Groups: map[uint32]*pb.Group{1: {}, 2: {}}}
+	req := &pb.RestoreRequest{
+		PredicateGroups: predicateGroupList(restoreGroupMap(manifest, state)),
+	}
+	require.Equal(t, []*pb.PredicateGroup{
+		{Predicate: "age", GroupId: 2},
+		{Predicate: "dgraph.type", GroupId: 1},
+		{Predicate: "name", GroupId: 1},
+	}, req.PredicateGroups)
+	require.Equal(t, map[string]uint32{
+		"name": 1, "dgraph.type": 1, "age": 2,
+	}, requestGroupMap(req, manifest))
+}
+
+func TestRestoreProgressTracker(t *testing.T) {
+	tracker := startRestoreProgress("r1", true)
+	progress := tracker.get()
+	require.Equal(t, "verifying", progress.Phase)
+	require.Equal(t, "RUNNING", progress.Status)
+	require.Equal(t, "r1", progress.RestoreId)
+	require.False(t, progress.Done)
+
+	tracker.setPhase("ingesting")
+	progress, err := RestoreProgress("r1")
+	require.NoError(t, err)
+	require.Equal(t, "ingesting", progress.Phase)
+
+	tracker.finish(nil)
+	progress = tracker.get()
+	require.True(t, progress.Done)
+	require.Equal(t, "done", progress.Phase)
+	require.Equal(t, "SUCCESS", progress.Status)
+	require.Equal(t, uint32(100), progress.Percent)
+
+	// A failed restore reports its error.
+	tracker = startRestoreProgress("r2", true)
+	tracker.finish(errors.New("cannot read manifest"))
+	progress = tracker.get()
+	require.True(t, progress.Done)
+	require.Equal(t, "failed", progress.Phase)
+	require.Equal(t, "FAILED", progress.Status)
+	require.Equal(t, "cannot read manifest", progress.Error)
+
+	// A cancelled restore is reported as such.
+	tracker = startRestoreProgress("r3", true)
+	cancelRestoreLocally("r3")
+	tracker.finish(cancelledRestoreError(&pb.RestoreRequest{RestoreId: "r3"}, true))
+	progress = tracker.get()
+	require.True(t, progress.Done)
+	require.Equal(t, "cancelled", progress.Phase)
+	require.Equal(t, "CANCELLED", progress.Status)
+	require.Contains(t, progress.Error, "restore r3 was cancelled")
+
+	// The progress of each restore is kept apart, and the last one is returned by default.
+	progress, err = RestoreProgress("")
+	require.NoError(t, err)
+	require.Equal(t, "r3", progress.RestoreId)
+	progress, err = RestoreProgress("r1")
+	require.NoError(t, err)
+	require.Equal(t, "SUCCESS", progress.Status)
+	_, err = RestoreProgress("r4")
+	require.EqualError(t, err, "restore r4 wasn't seen by this alpha")
+
+	// A restore started again with the same id doesn't report the earlier progress.
+	startRestoreProgress("r1", false)
+	progress, err = RestoreProgress("r1")
+	require.NoError(t, err)
+	require.False(t, progress.Done)
+	require.Equal(t, "RUNNING", progress.Status)
+
+	// Only the progress of the last restores is kept.
+	for i := 0; i < maxRestoreProgresses; i++ {
+		startRestoreProgress(fmt.Sprintf("more-%d", i), true)
+	}
+	_, err = RestoreProgress("r1")
+	require.Error(t, err)
+}
+
+func TestWatchRestoreProgress(t *testing.T) {
+	tracker := startRestoreProgress("watch-1", true)
+	progress, updated := tracker.watch()
+	require.Equal(t, "verifying", progress.Phase)
+	select {
+	case <-updated:
+		t.Fatal("the watch channel was closed before the progress changed")
+	default:
+	}
+
+	tracker.setPhase("ingesting")
+	select {
+	case <-updated:
+	case <-time.After(time.Second):
+		t.Fatal("the watch channel wasn't closed after the progress changed")
+	}
+	progress, updated = tracker.watch()
+	require.Equal(t, "ingesting", progress.Phase)
+
+	tracker.finish(nil)
+	<-updated
+	progress, _ = tracker.watch()
+	require.True(t, progress.Done)
+}
+
+func TestCancelRestore(t *testing.T) {
+	req := &pb.RestoreRequest{RestoreId: "cancel-1"}
+	require.NoError(t, checkRestoreCancelled(req))
+
+	cancelRestoreLocally("cancel-1")
+	require.Equal(t, errRestoreCancelled, checkRestoreCancelled(req))
+	require.NoError(t, checkRestoreCancelled(&pb.RestoreRequest{RestoreId: "cancel-2"}))
+
+	// A restore without an id can't be cancelled.
+	require.False(t, restoreCancelled(""))
+
+	// A restore cancelled before it's proposed doesn't change any data.
+	require.EqualError(t, cancelledRestoreError(req, false),
+		"restore cancel-1 was cancelled before any data was changed")
+	require.Contains(t, cancelledRestoreError(req, true).Error(),
+		"dropped all their data")
+	req.Atomic = true
+	require.Contains(t, cancelledRestoreError(req, true).Error(), "rolled it back")
+}
+
+func TestGroupRestoreState(t *testing.T) {
+	defer loadRestoreState(&pb.Snapshot{})
+	loadRestoreState(&pb.Snapshot{
+		RestoreId:         "state-1",
+		StartedRestore:    "state-2",
+		AtomicRestore:     true,
+		CancelledRestores: []string{"state-0"},
+	})
+	require.True(t, restoreApplied("state-1"))
+	require.False(t, restoreApplied("state-2"))
+	require.True(t, restoreCancelled("state-0"))
+
+	// A cancellation of a restore the group didn't start only skips its proposals.
+	require.NoError(t, handleCancelRestoreProposal(context.Background(),
+		&pb.CancelRestoreRequest{RestoreId: "state-3", GroupId: 1}))
+	require.True(t, restoreCancelledInGroup("state-3"))
+
+	var snap pb.Snapshot
+	saveRestoreState(&snap)
+	require.Equal(t, "state-1", snap.RestoreId)
+	require.Equal(t, "state-2", snap.StartedRestore)
+	require.True(t, snap.AtomicRestore)
+	require.Equal(t, []string{"state-0", "state-3"}, snap.CancelledRestores)
+
+	// Dropping the data forgets the restores, but not their cancellations.
+	resetGroupRestore()
+	saveRestoreState(&snap)
+	require.Equal(t, pb.Snapshot{CancelledRestores: []string{"state-0", "state-3"}}, snap)
+}
+
+func TestPredicateChecksum(t *testing.T) {
+	checksum := func(version uint64, value string) []byte {
+		dir, err := ioutil.TempDir("", "checksum_")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		db, err := badger.OpenManaged(badger.DefaultOptions(dir))
+		require.NoError(t, err)
+		defer db.Close()
+
+		txn := db.NewTransactionAt(version, true)
+		require.NoError(t, txn.Set(x.DataKey("name", 1), []byte(value)))
+		require.NoError(t, txn.Set(x.DataKey("age", 1), []byte("20")))
+		require.NoError(t, txn.CommitAt(version, nil))
+
+		res, err := predicateChecksum(db, "name", version)
+		require.NoError(t, err)
+		return res
+	}
+
+	// The version the data was restored at doesn't change the checksum.
+	require.Equal(t, checksum(5, "Alice"), checksum(9, "Alice"))
+	require.NotEqual(t, checksum(5, "Alice"), checksum(5, "Bob"))
+}
+
+func TestRestoredTabletSizes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tablet_sizes_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := badger.OpenManaged(badger.DefaultOptions(dir))
+	require.NoError(t, err)
+	defer db.Close()
+
+	txn := db.NewTransactionAt(5, true)
+	for uid := uint64(1); uid <= 10; uid++ {
+		require.NoError(t, txn.Set(x.DataKey("name", uid), []byte("Alice")))
+	}
+	require.NoError(t, txn.Set(x.DataKey("age", 1), []byte("20")))
+	require.NoError(t, txn.CommitAt(5, nil))
+
+	tablets, err := restoredTabletSizes(db, 2, []string{"name", "age", "friend"}, 5)
+	require.NoError(t, err)
+	require.Len(t, tablets, 3)
+	for pred, tablet := range tablets {
+		require.Equal(t, pred, tablet.Predicate)
+		require.Equal(t, uint32(2), tablet.GroupId)
+	}
+	// The sizes of the data still in the memtables are counted.
+	require.Greater(t, tablets["name"].Space, tablets["age"].Space)
+	require.Greater(t, tablets["age"].Space, int64(0))
+	require.Equal(t, int64(0), tablets["friend"].Space)
+}
+
+func TestRestoreChecksum(t *testing.T) {
+	a := &pb.PredicateChecksum{Predicate: "age", Checksum: []byte{1}}
+	n := &pb.PredicateChecksum{Predicate: "name", Checksum: []byte{2}}
+
+	// The checksum doesn't depend on the order in which the groups returned the predicates.
+	require.Equal(t,
+		restoreChecksum([]*pb.PredicateChecksum{a, n}),
+		restoreChecksum([]*pb.PredicateChecksum{n, a}))
+	require.NotEqual(t,
+		restoreChecksum([]*pb.PredicateChecksum{a, n}),
+		restoreChecksum([]*pb.PredicateChecksum{a}))
+}
+
+func TestIndexesToSkip(t *testing.T) {
+	preds := []string{"age", "friend", "name"}
+	tests := []struct {
+		in   string
+		skip predicateSet
+	}{
+		{in: "", skip: predicateSet{}},
+		{in: "all", skip: predicateSet{}},
+		{in: "none", skip: predicateSet{"age": {}, "friend": {}, "name": {}}},
+		{in: "name, friend", skip: predicateSet{"age": {}}},
+	}
+	for _, tc := range tests {
+		skip, err := indexesToSkip(tc.in, preds)
+		require.NoError(t, err, tc.in)
+		require.Equal(t, tc.skip, skip, tc.in)
+	}
+
+	_, err := indexesToSkip("name,,age", preds)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid list of predicates")
+}
+
+func TestDropSkippedIndexes(t *testing.T) {
+	schema.Init(pstore)
+	defer func() {
+		// Other tests iterate over all the schema keys in the store.
+		require.NoError(t, pstore.DropPrefix(x.SchemaKey("restore_indexed")))
+		require.NoError(t, pstore.DropPrefix(x.SchemaKey("restore_plain")))
+	}()
+	indexed := &pb.SchemaUpdate{
+		Predicate: "restore_indexed",
+		ValueType: pb.Posting_STRING,
+		Directive: pb.SchemaUpdate_INDEX,
+		Tokenizer: []string{"exact"},
+		Upsert:    true,
+	}
+	plain := &pb.SchemaUpdate{Predicate: "restore_plain", ValueType: pb.Posting_INT}
+	require.NoError(t, updateSchema(proto.Clone(indexed).(*pb.SchemaUpdate)))
+	require.NoError(t, updateSchema(proto.Clone(plain).(*pb.SchemaUpdate)))
+
+	skipped, err := dropSkippedIndexes(predicateSet{"restore_indexed": {}, "restore_plain": {}})
+	require.NoError(t, err)
+	// Only the predicate that had an index is reported, with its original schema.
+	require.Len(t, skipped, 1)
+	require.Equal(t, indexed.Tokenizer, skipped[0].Tokenizer)
+	require.True(t, skipped[0].Upsert)
+
+	// The index is flagged as missing so that queries don't use it.
+	require.False(t, schema.State().IsIndexed(context.Background(), "restore_indexed"))
+	require.NoError(t, schema.Load("restore_indexed"))
+	require.False(t, schema.State().IsIndexed(context.Background(), "restore_indexed"))
+}
+
+func TestFilterManifestNewerVersion(t *testing.T) {
+	manifests := []*Manifest{
+		{
+			Type:      "full",
+			BackupId:  "aa",
+			BackupNum: 1,
+		},
+		{
+			Type:      "incremental",
+			BackupId:  "aa",
+			BackupNum: 2,
+			Version:   backupVersion + 1,
+		},
+	}
+	_, err := filterManifests(manifests, "aa")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "can only restore backups up to version")
+}
+
+func TestRestoreOlderVersion(t *testing.T) {
+	// The fixture was written before the version of the backup format was recorded.
+	dir, err := ioutil.TempDir("", "restore_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	res := RunRestore(dir, "testdata/backup-v0", "", nil)
+	require.NoError(t, res.Err)
+	require.Equal(t, uint64(100), res.Version)
+
+	db, err := badger.OpenManaged(badger.DefaultOptions(filepath.Join(dir, "p1")))
+	require.NoError(t, err)
+	defer db.Close()
+
+	txn := db.NewTransactionAt(math.MaxUint64, false)
+	defer txn.Discard()
+	for uid, name := range map[uint64]string{1: "Alice", 2: "Bob"} {
+		item, err := txn.Get(x.DataKey("name", uid))
+		require.NoError(t, err)
+		var pl pb.PostingList
+		require.NoError(t, item.Value(func(val []byte) error {
+			return pl.Unmarshal(val)
+		}))
+		require.Len(t, pl.Postings, 1)
+		require.Equal(t, name, string(pl.Postings[0].Value))
+	}
+	_, err = txn.Get(x.SchemaKey("name"))
+	require.NoError(t, err)
+}
+
+func TestRestoreNewerVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Copy the fixture, recording a version this binary doesn't know about in its manifest.
+	src := "testdata/backup-v0/dgraph.20200601.120000.000"
+	dst := filepath.Join(dir, "dgraph.20200601.120000.000")
+	require.NoError(t, os.Mkdir(dst, 0700))
+	data, err := ioutil.ReadFile(filepath.Join(src, backupName(100, 1)))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dst, backupName(100, 1)), data, 0600))
+	manifest := Manifest{Type: "full", Since: 100, Groups: map[uint32][]string{1: {"name"}},
+		BackupId: "legacy_format", BackupNum: 1, Version: backupVersion + 1}
+	data, err = json.Marshal(&manifest)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dst, backupManifest), data, 0600))
+
+	res := RunRestore(filepath.Join(dir, "p"), dir, "", nil)
+	require.Error(t, res.Err)
+	require.Contains(t, res.Err.Error(), "can only restore backups up to version")
+}
+
+// writeEncryptedBackup writes the data as the backup file of group 1 in a new backup of the
+// series in dir, encrypted with the given algorithm, along with its manifest.
+func writeEncryptedBackup(t *testing.T, dir string, manifest *Manifest, key, data []byte) {
+	var buf bytes.Buffer
+	w, err := enc.GetWriterFor(manifest.Algorithm, key, &buf)
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	backupDir := filepath.Join(dir, fmt.Sprintf("dgraph.20200601.12000%d.000", manifest.BackupNum))
+	require.NoError(t, os.Mkdir(backupDir, 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(backupDir, backupName(manifest.Since, 1)),
+		buf.Bytes(), 0600))
+	manifest.Encrypted = true
+	data, err = json.Marshal(manifest)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(backupDir, backupManifest), data, 0600))
+}
+
+func TestRestoreMixedEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+	require.NoError(t, err)
+	groups := map[uint32][]string{1: {"name"}}
+
+	// The full backup was taken before the algorithm was recorded in the manifests, so it's
+	// encrypted with AES-CTR, and the incremental backup is encrypted with AES-GCM.
+	full, err := ioutil.ReadFile(filepath.Join("testdata/backup-v0/dgraph.20200601.120000.000",
+		backupName(100, 1)))
+	require.NoError(t, err)
+	writeEncryptedBackup(t, dir, &Manifest{Type: "full", Since: 100, Groups: groups,
+		BackupId: "mixed", BackupNum: 1}, key, full)
+
+	pl := &pb.BackupPostingList{Postings: []*pb.Posting{{Value: []byte("Carol")}}}
+	val, err := pl.Marshal()
+	require.NoError(t, err)
+	parsedKey, err := x.Parse(x.DataKey("name", 3))
+	require.NoError(t, err)
+	backupKey, err := parsedKey.ToBackupKey().Marshal()
+	require.NoError(t, err)
+	var list bytes.Buffer
+	writeBackupList(t, &list, &bpb.KV{Key: backupKey, Value: val, Version: 150,
+		UserMeta: []byte{posting.BitCompletePosting}})
+	var incremental bytes.Buffer
+	gzw := gzip.NewWriter(&incremental)
+	_, err = gzw.Write(list.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, gzw.Close())
+	writeEncryptedBackup(t, dir, &Manifest{Type: "incremental", Since: 200, Groups: groups,
+		BackupId: "mixed", BackupNum: 2, Version: backupVersion, Algorithm: enc.AlgorithmGCM},
+		key, incremental.Bytes())
+
+	pdir := filepath.Join(dir, "p")
+	res := RunRestore(pdir, dir, "", key)
+	require.NoError(t, res.Err)
+	require.Equal(t, uint64(200), res.Version)
+
+	db, err := badger.OpenManaged(badger.DefaultOptions(filepath.Join(pdir, "p1")).
+		WithEncryptionKey(key).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+	txn := db.NewTransactionAt(math.MaxUint64, false)
+	defer txn.Discard()
+	for uid, name := range map[uint64]string{1: "Alice", 2: "Bob", 3: "Carol"} {
+		item, err := txn.Get(x.DataKey("name", uid))
+		require.NoError(t, err)
+		var pl pb.PostingList
+		require.NoError(t, item.Value(func(val []byte) error {
+			return pl.Unmarshal(val)
+		}))
+		require.Len(t, pl.Postings, 1)
+		require.Equal(t, name, string(pl.Postings[0].Value))
+	}
+}
+
+func TestFilterManifestUnsupportedAlgorithm(t *testing.T) {
+	manifests := []*Manifest{
+		{
+			Type:      "full",
+			BackupId:  "aa",
+			BackupNum: 1,
+			Encrypted: true,
+		},
+		{
+			Type:      "incremental",
+			BackupId:  "aa",
+			BackupNum: 2,
+			Encrypted: true,
+			Algorithm: "chacha20",
+		},
+	}
+	_, err := filterManifests(manifests, "aa")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot decrypt backup number 2 of series aa: "+
+		`unsupported encryption algorithm "chacha20"`)
+}
+
+func TestBackupSize(t *testing.T) {
+	uri, err := url.Parse("testdata/backup-v0")
+	require.NoError(t, err)
+	size, err := (&fileHandler{}).Size(uri, "")
+	require.NoError(t, err)
+
+	fi, err := os.Stat(filepath.Join("testdata/backup-v0/dgraph.20200601.120000.000",
+		backupName(100, 1)))
+	require.NoError(t, err)
+	require.Equal(t, fi.Size(), size)
+}
+
+func TestBackupFilePaths(t *testing.T) {
+	uri, err := url.Parse("testdata/backup-v0")
+	require.NoError(t, err)
+	manifests, err := (&fileHandler{}).GetManifests(uri, "")
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join("testdata/backup-v0/dgraph.20200601.120000.000",
+		backupName(100, 1))}, backupFilePaths(manifests))
+}
+
+// writeBackupFiles writes n gzip files of random data to dir, like the files of a backup, and
+// returns their paths.
+func writeBackupFiles(t testing.TB, dir string, n, size int) []string {
+	paths := make([]string, 0, n)
+	data := make([]byte, size)
+	for i := 0; i < n; i++ {
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		gzw := gzip.NewWriter(&buf)
+		_, err = gzw.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, gzw.Close())
+		path := filepath.Join(dir, backupName(uint64(i+1), 1))
+		require.NoError(t, ioutil.WriteFile(path, buf.Bytes(), 0600))
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func TestVerifyBackupFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	uri, err := url.Parse(dir)
+	require.NoError(t, err)
+
+	paths := writeBackupFiles(t, dir, 50, 1<<10)
+	res, err := verifyBackupFiles(context.Background(), &fileHandler{}, uri, paths, nil, nil, 4)
+	require.NoError(t, err)
+	require.Equal(t, 50, res.FilesVerified)
+
+	// The files are verified one at a time if the concurrency isn't positive.
+	res, err = verifyBackupFiles(context.Background(), &fileHandler{}, uri, paths, nil, nil, 0)
+	require.NoError(t, err)
+	require.Equal(t, 50, res.FilesVerified)
+
+	// Damage the CRC-32 of two files and remove a third one. All of them are reported.
+	for _, path := range paths[10:12] {
+		data, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		data[len(data)-8] ^= 0xff
+		require.NoError(t, ioutil.WriteFile(path, data, 0600))
+	}
+	require.NoError(t, os.Remove(paths[20]))
+	_, err = verifyBackupFiles(context.Background(), &fileHandler{}, uri, paths, nil, nil, 4)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "3 of 50 backup files failed the checksum verification")
+	require.Contains(t, err.Error(), paths[10]+": gzip: invalid checksum")
+	require.Contains(t, err.Error(), paths[11]+": gzip: invalid checksum")
+	require.Contains(t, err.Error(), "Failed to open")
+
+	// A cancelled verification fails.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = verifyBackupFiles(ctx, &fileHandler{}, uri, paths[:10], nil, nil, 4)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "context canceled")
+}
+
+func BenchmarkVerifyBackupFiles(b *testing.B) {
+	dir, err := ioutil.TempDir("", "verify_")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+	uri, err := url.Parse(dir)
+	require.NoError(b, err)
+	paths := writeBackupFiles(b, dir, 64, 1<<20)
+
+	for _, concurrency := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := verifyBackupFiles(context.Background(), &fileHandler{}, uri, paths,
+					nil, nil, concurrency)
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+func TestEstimateRestore(t *testing.T) {
+	defer func(throughput float64) {
+		ingestThroughput.bytesPerSec = throughput
+	}(ingestThroughput.bytesPerSec)
+
+	// Without a measured throughput, the default one is used.
+	ingestThroughput.bytesPerSec = 0
+	estimate := estimateRestore(2, 8*defaultIngestThroughput)
+	require.Equal(t, &RestoreEstimate{
+		NumFiles:   2,
+		Size:       8 * defaultIngestThroughput,
+		Throughput: defaultIngestThroughput,
+		Duration:   8 * time.Second,
+	}, estimate)
+
+	// Invalid measurements are ignored.
+	recordIngestThroughput(0, time.Second)
+	recordIngestThroughput(100, 0)
+	require.False(t, estimateRestore(2, 100).Measured)
+
+	recordIngestThroughput(1000, 2*time.Second)
+	estimate = estimateRestore(3, 1500)
+	require.True(t, estimate.Measured)
+	require.Equal(t, float64(500), estimate.Throughput)
+	require.Equal(t, 3*time.Second, estimate.Duration)
+}
+
+func TestRestoreLocationFallback(t *testing.T) {
+	// The primary location answers every request with a 404.
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	primary := "minio://" + strings.TrimPrefix(srv.URL, "http://") + "/dgraph?secure=false"
+
+	req := &pb.RestoreRequest{
+		Location:  primary + ", testdata/backup-v0",
+		Anonymous: true,
+	}
+	location, release, err := restoreLocation(req)
+	require.NoError(t, err)
+	require.Equal(t, "testdata/backup-v0", location)
+	release()
+
+	req.Location = primary + ",testdata/missing"
+	_, _, err = restoreLocation(req)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot restore from any of the locations")
+	require.Contains(t, err.Error(), "testdata/missing")
+
+	// A single location is used as is, so its errors are reported by the restore.
+	req.Location = "testdata/missing"
+	location, release, err = restoreLocation(req)
+	require.NoError(t, err)
+	require.Equal(t, "testdata/missing", location)
+	release()
+}
+
+func TestDefaultRestoreId(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeManifest(t, dir, "20200601.120000.000", &Manifest{Type: "full", Since: 100,
+		BackupId: "series", BackupNum: 1})
+
+	// Retrying the same request gives the same id.
+	req := &pb.RestoreRequest{Location: dir}
+	id, err := defaultRestoreId(req, nil)
+	require.NoError(t, err)
+	retried, err := defaultRestoreId(req, nil)
+	require.NoError(t, err)
+	require.Equal(t, id, retried)
+
+	// A newer backup of the series is a different restore.
+	writeManifest(t, dir, "20200602.120000.000", &Manifest{Type: "incremental", Since: 200,
+		BackupId: "series", BackupNum: 2})
+	newer, err := defaultRestoreId(req, nil)
+	require.NoError(t, err)
+	require.NotEqual(t, id, newer)
+
+	// There's no id to derive for a series that isn't at the location.
+	req.BackupId = "other"
+	_, err = defaultRestoreId(req, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no backup manifests found")
+}
+
+// requesterPaysServer mocks a requester-pays bucket named dgraph holding a manifest index.
+// The requests without the requester-pays header are denied like S3 denies them, and the
+// signed requests must sign the header.
+func requesterPaysServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if r.Header.Get("X-Amz-Request-Payer") != "requester" ||
+			(auth != "" && !strings.Contains(auth, "x-amz-request-payer")) {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>`+
+				`<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+			return
+		}
+		_, location := r.URL.Query()["location"]
+		switch {
+		case location:
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>`+
+				`<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">`+
+				`</LocationConstraint>`)
+		case r.URL.Path == "/dgraph/"+backupManifestIndex:
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			w.Header().Set("ETag", `"index"`)
+			fmt.Fprint(w, "[]")
+		case r.URL.Path == "/dgraph" || r.URL.Path == "/dgraph/":
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestRequesterPays(t *testing.T) {
+	srv := requesterPaysServer(t)
+	defer srv.Close()
+	uri, err := url.Parse("minio://" + strings.TrimPrefix(srv.URL, "http://") +
+		"/dgraph?secure=false")
+	require.NoError(t, err)
+
+	for _, anonymous := range []bool{false, true} {
+		creds := &Credentials{AccessKey: "key", SecretKey: "secret", Anonymous: anonymous}
+		_, err = (&s3Handler{creds: creds}).ReadManifestIndex(uri)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "if the bucket is requester-pays, "+
+			"retry with requesterPays set")
+
+		creds.RequesterPays = true
+		b, err := (&s3Handler{creds: creds}).ReadManifestIndex(uri)
+		require.NoError(t, err)
+		require.Equal(t, "[]", string(b))
+	}
+
+	// A bucket that denies the requester-pays requests too lacks the permissions.
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	creds := &Credentials{AccessKey: "key", SecretKey: "secret", RequesterPays: true}
+	_, err = (&s3Handler{creds: creds}).ReadManifestIndex(uri)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "even though the requests were sent as requester-pays")
+}
+
+func TestSignatureRegion(t *testing.T) {
+	require.Equal(t, "us-west-2", signatureRegion("AWS4-HMAC-SHA256 "+
+		"Credential=key/20200601/us-west-2/s3/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, Signature=abc"))
+	require.Equal(t, "", signatureRegion("AWS key:signature"))
+}
+
+// writeBulkShard writes a shard of bulk loader output with the given names and the schema
+// of the name predicate, like the bulk loader does.
+func writeBulkShard(t *testing.T, dir string, shard int, gid uint32, pred string,
+	names map[uint64]string) {
+	pdir := filepath.Join(dir, strconv.Itoa(shard), "p")
+	require.NoError(t, os.MkdirAll(pdir, 0700))
+	db, err := badger.OpenManaged(badger.DefaultOptions(pdir).WithLogger(nil))
+	require.NoError(t, err)
+
+	txn := db.NewTransactionAt(math.MaxUint64, true)
+	schemaVal, err := (&pb.SchemaUpdate{Predicate: pred, ValueType: pb.Posting_STRING}).Marshal()
+	require.NoError(t, err)
+	require.NoError(t, txn.SetEntry(badger.NewEntry(x.SchemaKey(pred), schemaVal).
+		WithMeta(posting.BitSchemaPosting)))
+	typeVal, err := (&pb.TypeUpdate{TypeName: "Person"}).Marshal()
+	require.NoError(t, err)
+	require.NoError(t, txn.SetEntry(badger.NewEntry(x.TypeKey("Person"), typeVal).
+		WithMeta(posting.BitSchemaPosting)))
+	require.NoError(t, txn.CommitAt(1, nil))
+
+	txn = db.NewTransactionAt(math.MaxUint64, true)
+	for uid, name := range names {
+		pl := &pb.PostingList{Postings: []*pb.Posting{{Uid: math.MaxUint64,
+			Value: []byte(name), ValType: pb.Posting_STRING}}}
+		val, err := pl.Marshal()
+		require.NoError(t, err)
+		require.NoError(t, txn.SetEntry(badger.NewEntry(x.DataKey(pred, uid), val).
+			WithMeta(posting.BitCompletePosting)))
+	}
+	require.NoError(t, txn.CommitAt(2, nil))
+	require.NoError(t, db.Close())
+	require.NoError(t, x.WriteGroupIdFile(pdir, gid))
+}
+
+func TestBulkOutputDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bulk_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeBulkShard(t, dir, 1, 2, "age", map[uint64]string{3: "30"})
+	writeBulkShard(t, dir, 0, 1, "name", map[uint64]string{1: "Alice"})
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "tmp"), 0700))
+
+	dirs, err := bulkOutputDirs(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(dir, "0", "p"), filepath.Join(dir, "1", "p")}, dirs)
+	dirs, err = bulkOutputDirs("file://" + dir)
+	require.NoError(t, err)
+	require.Len(t, dirs, 2)
+
+	// Backups and missing directories aren't bulk loader output.
+	dirs, err = bulkOutputDirs("testdata/backup-v0")
+	require.NoError(t, err)
+	require.Empty(t, dirs)
+	dirs, err = bulkOutputDirs("testdata/missing")
+	require.NoError(t, err)
+	require.Empty(t, dirs)
+
+	manifest, err := bulkOutputManifest(dirs, nil)
+	require.NoError(t, err)
+	require.Empty(t, manifest.Groups)
+	dirs, err = bulkOutputDirs(dir)
+	require.NoError(t, err)
+	manifest, err = bulkOutputManifest(dirs, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[uint32][]string{1: {"name"}, 2: {"age"}}, manifest.Groups)
+}
+
+func TestLoadFromBulkOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bulk_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeBulkShard(t, dir, 0, 1, "name", map[uint64]string{1: "Alice", 7: "Bob"})
+
+	pdir, err := ioutil.TempDir("", "restore_")
+	require.NoError(t, err)
+	defer os.RemoveAll(pdir)
+	db, err := badger.OpenManaged(badger.DefaultOptions(pdir).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+
+	var restored []string
+	maxUid, err := loadFromBulkOutput(db, filepath.Join(dir, "0", "p"), nil, 10,
+		predicateSet{"name": struct{}{}}, nil, nil, func(pred string) {
+			restored = append(restored, pred)
+		})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), maxUid)
+	require.Equal(t, []string{"name"}, restored)
+
+	txn := db.NewTransactionAt(math.MaxUint64, false)
+	defer txn.Discard()
+	for uid, name := range map[uint64]string{1: "Alice", 7: "Bob"} {
+		item, err := txn.Get(x.DataKey("name", uid))
+		require.NoError(t, err)
+		require.Equal(t, uint64(10), item.Version())
+		require.Equal(t, posting.BitCompletePosting, item.UserMeta())
+		var pl pb.PostingList
+		require.NoError(t, item.Value(func(val []byte) error {
+			return pl.Unmarshal(val)
+		}))
+		require.Len(t, pl.Postings, 1)
+		require.Equal(t, name, string(pl.Postings[0].Value))
+	}
+	// The schema and the types keep their version.
+	item, err := txn.Get(x.SchemaKey("name"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), item.Version())
+	item, err = txn.Get(x.TypeKey("Person"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), item.Version())
+
+	// Only the types are loaded when none of the predicates belong to the group.
+	pdir2, err := ioutil.TempDir("", "restore_")
+	require.NoError(t, err)
+	defer os.RemoveAll(pdir2)
+	db2, err := badger.OpenManaged(badger.DefaultOptions(pdir2).WithLogger(nil))
+	require.NoError(t, err)
+	defer db2.Close()
+	maxUid, err = loadFromBulkOutput(db2, filepath.Join(dir, "0", "p"), nil, 10,
+		predicateSet{}, nil, nil, nil)
+	require.NoError(t, err)
+	require.Zero(t, maxUid)
+	txn2 := db2.NewTransactionAt(math.MaxUint64, false)
+	defer txn2.Discard()
+	_, err = txn2.Get(x.DataKey("name", 1))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+	_, err = txn2.Get(x.TypeKey("Person"))
+	require.NoError(t, err)
+}
+
+func TestRestoreToDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The target directory is created if it's missing.
+	target := filepath.Join(dir, "target")
+	req := &pb.RestoreRequest{Location: "testdata/backup-v0", TargetDir: target}
+	res, err := restoreToDir(req)
+	require.NoError(t, err)
+	require.Equal(t, "testdata/backup-v0", res.Location)
+
+	db, err := badger.OpenManaged(badger.DefaultOptions(filepath.Join(target, "p1")).
+		WithLogger(nil))
+	require.NoError(t, err)
+	txn := db.NewTransactionAt(math.MaxUint64, false)
+	_, err = txn.Get(x.DataKey("name", 1))
+	require.NoError(t, err)
+	txn.Discard()
+	require.NoError(t, db.Close())
+
+	// A directory that isn't empty isn't overwritten.
+	_, err = restoreToDir(req)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is not empty")
+
+	// The target directory must be a directory that can be created.
+	file := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(file, nil, 0600))
+	err = checkTargetDir(filepath.Join(file, "target"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot create target directory")
+}
+
+// packBackup packs the files of the backup at dir into a tar.gz or a zip archive at path,
+// depending on its extension. The files are put under a directory named after the backup.
+func packBackup(t *testing.T, dir, path string) {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var add func(name string, b []byte)
+	if strings.HasSuffix(path, ".zip") {
+		zw := zip.NewWriter(f)
+		defer func() { require.NoError(t, zw.Close()) }()
+		add = func(name string, b []byte) {
+			w, err := zw.Create(name)
+			require.NoError(t, err)
+			_, err = w.Write(b)
+			require.NoError(t, err)
+		}
+	} else {
+		gz := gzip.NewWriter(f)
+		tw := tar.NewWriter(gz)
+		defer func() {
+			require.NoError(t, tw.Close())
+			require.NoError(t, gz.Close())
+		}()
+		add = func(name string, b []byte) {
+			require.NoError(t, tw.WriteHeader(&tar.Header{
+				Name: name, Mode: 0600, Size: int64(len(b)), Typeflag: tar.TypeReg,
+			}))
+			_, err := tw.Write(b)
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(filepath.Dir(dir), file)
+		require.NoError(t, err)
+		b, err := ioutil.ReadFile(file)
+		require.NoError(t, err)
+		add(filepath.ToSlash(rel), b)
+		return nil
+	}))
+}
+
+func TestRestoreFromArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"backup.tar.gz", "backup.tgz", "backup.zip"} {
+		archive := filepath.Join(dir, name)
+		packBackup(t, "testdata/backup-v0", archive)
+
+		pdir := filepath.Join(dir, "p-"+name)
+		res := RunRestore(pdir, archive, "", nil)
+		require.NoError(t, res.Err, name)
+		require.Equal(t, uint64(100), res.Version, name)
+
+		db, err := badger.OpenManaged(badger.DefaultOptions(filepath.Join(pdir, "p1")).
+			WithLogger(nil))
+		require.NoError(t, err)
+		txn := db.NewTransactionAt(math.MaxUint64, false)
+		_, err = txn.Get(x.DataKey("name", 1))
+		require.NoError(t, err, name)
+		txn.Discard()
+		require.NoError(t, db.Close())
+	}
+
+	// The extracted archives are removed once the restore is done.
+	backupArchives.Lock()
+	require.Empty(t, backupArchives.dirs)
+	backupArchives.Unlock()
+}
+
+func TestBackupArchiveErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// An archive without a manifest doesn't hold a backup.
+	empty := filepath.Join(dir, "empty")
+	require.NoError(t, os.MkdirAll(filepath.Join(empty, "dgraph.20200601.120000.000"), 0700))
+	require.NoError(t, ioutil.WriteFile(
+		filepath.Join(empty, "dgraph.20200601.120000.000", "r100-g1.backup"), []byte("x"), 0600))
+	packBackup(t, empty, filepath.Join(dir, "empty.zip"))
+	_, err = acquireBackupArchive(filepath.Join(dir, "empty.zip"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no manifest.json found in the backup archive")
+
+	// The manifests must be valid.
+	invalid := filepath.Join(dir, "invalid")
+	require.NoError(t, os.MkdirAll(filepath.Join(invalid, "dgraph.20200601.120000.000"), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(invalid, "dgraph.20200601.120000.000",
+		backupManifest), []byte("{"), 0600))
+	packBackup(t, invalid, filepath.Join(dir, "invalid.tar.gz"))
+	_, err = acquireBackupArchive(filepath.Join(dir, "invalid.tar.gz"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot read invalid/dgraph.20200601.120000.000/manifest.json")
+
+	// The files can't be extracted out of the directory of the archive.
+	f, err := os.Create(filepath.Join(dir, "escape.zip"))
+	require.NoError(t, err)
+	zw := zip.NewWriter(f)
+	_, err = zw.Create("../escape")
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	require.NoError(t, f.Close())
+	_, err = acquireBackupArchive(filepath.Join(dir, "escape.zip"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "holds a file outside of it: ../escape")
+
+	// The extracted files must fit in the available disk space.
+	defer func(fn func(string) (uint64, error)) { archiveDiskSpace = fn }(archiveDiskSpace)
+	archiveDiskSpace = func(string) (uint64, error) { return 100, nil }
+	backup := filepath.Join(dir, "backup.zip")
+	packBackup(t, "testdata/backup-v0", backup)
+	_, err = acquireBackupArchive(backup)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "doesn't fit in the 100 bytes available")
+
+	// And in the configured limit.
+	archiveDiskSpace = func(string) (uint64, error) { return 1 << 20, nil }
+	defer func(limit int64) { x.WorkerConfig.BackupArchiveLimit = limit }(
+		x.WorkerConfig.BackupArchiveLimit)
+	x.WorkerConfig.BackupArchiveLimit = 50
+	_, err = acquireBackupArchive(backup)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "doesn't fit in the 50 bytes available")
+	x.WorkerConfig.BackupArchiveLimit = 0
+
+	// An archive isn't extracted without a limit.
+	archiveDiskSpace = func(string) (uint64, error) { return 0, errors.Errorf("statfs failed") }
+	_, err = acquireBackupArchive(backup)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "statfs failed")
+
+	// An archive is only read once it's extracted.
+	_, err = backupArchiveDir(backup)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is read before it's extracted")
+}
+
+func TestAcquireBackupArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	backup := filepath.Join(dir, "backup.zip")
+	packBackup(t, "testdata/backup-v0", backup)
+
+	// Locations that aren't archives are left alone.
+	release, err := acquireBackupArchive("testdata/backup-v0")
+	require.NoError(t, err)
+	release()
+
+	// The archive is only extracted once for all the callers that hold it, e.g. a dry run
+	// and a restore of the same archive.
+	releaseDryRun, err := acquireBackupArchive(backup)
+	require.NoError(t, err)
+	extracted, err := backupArchiveDir(backup)
+	require.NoError(t, err)
+	releaseRestore, err := acquireBackupArchive(backup)
+	require.NoError(t, err)
+	again, err := backupArchiveDir(backup)
+	require.NoError(t, err)
+	require.Equal(t, extracted, again)
+
+	// The dry run finishing doesn't remove the files the restore reads.
+	releaseDryRun()
+	releaseDryRun()
+	_, err = os.Stat(extracted)
+	require.NoError(t, err)
+	res := RunRestore(filepath.Join(dir, "p"), backup, "", nil)
+	require.NoError(t, res.Err)
+
+	// They're removed once the last caller releases them.
+	releaseRestore()
+	_, err = os.Stat(extracted)
+	require.True(t, os.IsNotExist(err))
+	_, err = backupArchiveDir(backup)
+	require.Error(t, err)
+}
+
+func TestCheckPredicateCount(t *testing.T) {
+	// A backup taken right after the cluster started only has the reserved predicates and
+	// maybe a few others.
+	manifest := &Manifest{Groups: map[uint32][]string{
+		1: {"dgraph.type", "dgraph.graphql.schema", "name"},
+		2: {"dgraph.graphql.xid"},
+	}}
+	req := &pb.RestoreRequest{Location: "/backups", MinExpectedPredicates: 100}
+	err := checkPredicateCount(req, manifest)
+	require.Error(t, err)
+	require.Contains(t, err.Error(),
+		"backup at /backups has 1 predicates, fewer than the 100 expected")
+
+	req.MinExpectedPredicates = 1
+	require.NoError(t, checkPredicateCount(req, manifest))
+	req.MinExpectedPredicates = 0
+	require.NoError(t, checkPredicateCount(req, &Manifest{}))
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	// Mock a disk with 1000 bytes available.
+	defer func(f func(string) (uint64, error)) { availableDiskSpace = f }(availableDiskSpace)
+	availableDiskSpace = func(dir string) (uint64, error) {
+		return 1000, nil
+	}
+
+	manifests := []*Manifest{{Since: 1, Size: 500}, {Since: 2, Size: 400}}
+	require.NoError(t, checkDiskSpace("/data/p", manifests, 1.1))
+	err := checkDiskSpace("/data/p", manifests, 0)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "insufficient disk space to restore the backup: /data/p "+
+		"has 1000 bytes available but the restore needs 1080 bytes")
+	manifests = append(manifests, &Manifest{Since: 3, Size: 200})
+	err = checkDiskSpace("/data/p", manifests, 1)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "needs 1100 bytes (1100 bytes of data with a headroom of 1)")
+
+	// The check is skipped for backups taken before their size was recorded.
+	manifests = append(manifests, &Manifest{Since: 4})
+	require.NoError(t, checkDiskSpace("/data/p", manifests, 1))
+
+	// A restore into a directory is aborted before it writes any data.
+	dir, err := ioutil.TempDir("", "restore_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeNameBackup(t, filepath.Join(dir, "backup"), map[uint64]string{1: "Alice"}, nil)
+	path := filepath.Join(dir, "backup", "dgraph.20200601.120000.000", backupManifest)
+	var manifest Manifest
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &manifest))
+	manifest.Size = 2000
+	data, err = json.Marshal(&manifest)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, data, 0600))
+
+	target := filepath.Join(dir, "target")
+	req := &pb.RestoreRequest{Location: filepath.Join(dir, "backup"), TargetDir: target}
+	_, err = restoreToDir(req)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "insufficient disk space")
+	entries, err := ioutil.ReadDir(target)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestCompactRestoredData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compact_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Without compactions, every memtable flushed when the DB is closed becomes a table of
+	// level 0, as happens when a restore writes faster than the compactions keep up.
+	opt := badger.DefaultOptions(dir).WithLogger(nil).WithNumCompactors(0).
+		WithKeepL0InMemory(false).WithCompactL0OnClose(false)
+	for i := 0; i < 6; i++ {
+		db, err := badger.OpenManaged(opt)
+		require.NoError(t, err)
+		txn := db.NewTransactionAt(math.MaxUint64, true)
+		for uid := uint64(1); uid <= 100; uid++ {
+			key := x.DataKey("name", uint64(i)*100+uid)
+			require.NoError(t, txn.SetEntry(badger.NewEntry(key, []byte("Alice"))))
+		}
+		require.NoError(t, txn.CommitAt(uint64(i+1), nil))
+		require.NoError(t, db.Close())
+	}
+
+	db, err := badger.OpenManaged(opt)
+	require.NoError(t, err)
+	defer db.Close()
+	stats, err := compactRestoredData(db)
+	require.NoError(t, err)
+	require.Equal(t, uint32(6), stats.TablesBefore)
+	require.Equal(t, uint32(6), stats.ReadAmplificationBefore)
+	// A lookup only checks the level holding all the tables after the compaction.
+	require.Equal(t, uint32(1), stats.ReadAmplificationAfter)
+	require.Equal(t, uint32(1), stats.Level)
+	require.NotZero(t, stats.TablesAfter)
+
+	txn := db.NewTransactionAt(math.MaxUint64, false)
+	defer txn.Discard()
+	for _, uid := range []uint64{1, 250, 600} {
+		_, err := txn.Get(x.DataKey("name", uid))
+		require.NoError(t, err)
+	}
+}
+
+func TestLsmShape(t *testing.T) {
+	tables := []badger.TableInfo{{Level: 0}, {Level: 0}, {Level: 2}, {Level: 2}, {Level: 4}}
+	numTables, readAmp, level := lsmShape(tables)
+	require.Equal(t, uint32(5), numTables)
+	require.Equal(t, uint32(4), readAmp)
+	require.Equal(t, uint32(4), level)
+}
+
+// writeBackupList appends a list of key-value pairs to w in the format of a backup file.
+func writeBackupList(t testing.TB, w *bytes.Buffer, kvs ...*bpb.KV) {
+	list := &bpb.KVList{Kv: kvs}
+	require.NoError(t, binary.Write(w, binary.LittleEndian, uint64(list.Size())))
+	data, err := list.Marshal()
+	require.NoError(t, err)
+	w.Write(data)
+}
+
+func TestLoadFromBackupSkipErrors(t *testing.T) {
+	backupKV := func(key []byte, value []byte) *bpb.KV {
+		parsedKey, err := x.Parse(key)
+		require.NoError(t, err)
+		backupKey, err := parsedKey.ToBackupKey().Marshal()
+		require.NoError(t, err)
+		return &bpb.KV{Key: backupKey, Value: value, Version: 1,
+			UserMeta: []byte{posting.BitCompletePosting}}
+	}
+	pl := &pb.BackupPostingList{Postings: []*pb.Posting{{Value: []byte("Alice")}}}
+	good, err := pl.Marshal()
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	writeBackupList(t, &buf,
+		backupKV(x.DataKey("broken", 1), []byte("not a posting list")),
+		backupKV(x.DataKey("broken", 2), good),
+		backupKV(x.DataKey("name", 1), good))
+	preds := predicateSet{"broken": {}, "name": {}}
+
+	dir, err := ioutil.TempDir("", "restore_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := badger.OpenManaged(badger.DefaultOptions(dir).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Without skipped, the first error fails the load.
+	_, err = loadFromBackup(db, bytes.NewReader(buf.Bytes()), backupVersion, 10, 0, preds, nil,
+		nil, nil, nil, nil, 0, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "while reading backup posting list")
+
+	skipped := make(predicateSet)
+	_, err = loadFromBackup(db, bytes.NewReader(buf.Bytes()), backupVersion, 10, 0, preds, nil,
+		skipped, nil, nil, nil, 0, nil)
+	require.NoError(t, err)
+	require.Equal(t, predicateSet{"broken": {}}, skipped)
+
+	txn := db.NewTransactionAt(math.MaxUint64, false)
+	defer txn.Discard()
+	_, err = txn.Get(x.DataKey("name", 1))
+	require.NoError(t, err)
+	// The keys of a skipped predicate that follow the error are not loaded.
+	_, err = txn.Get(x.DataKey("broken", 2))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+}
+
+func TestLoadFromBackupIngestStats(t *testing.T) {
+	backupKV := func(key []byte, value string) *bpb.KV {
+		parsedKey, err := x.Parse(key)
+		require.NoError(t, err)
+		backupKey, err := parsedKey.ToBackupKey().Marshal()
+		require.NoError(t, err)
+		pl := &pb.BackupPostingList{Postings: []*pb.Posting{{Value: []byte(value)}}}
+		val, err := pl.Marshal()
+		require.NoError(t, err)
+		return &bpb.KV{Key: backupKey, Value: val, Version: 1,
+			UserMeta: []byte{posting.BitCompletePosting}}
+	}
+	var buf bytes.Buffer
+	writeBackupList(t, &buf,
+		backupKV(x.DataKey("bio", 1), strings.Repeat("a", 1000)),
+		backupKV(x.DataKey("bio", 2), strings.Repeat("b", 1000)),
+		backupKV(x.IndexKey("bio", "a"), ""),
+		backupKV(x.DataKey("name", 1), "Alice"))
+	writeBackupList(t, &buf, backupKV(x.DataKey("name", 2), "Bob"))
+	preds := predicateSet{"bio": {}, "name": {}}
+
+	dir, err := ioutil.TempDir("", "restore_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := badger.OpenManaged(badger.DefaultOptions(dir).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+
+	stats := newIngestStats()
+	_, err = loadFromBackup(db, bytes.NewReader(buf.Bytes()), backupVersion, 10, 0, preds, nil,
+		nil, nil, nil, stats, 0, nil)
+	require.NoError(t, err)
+	ingestions := stats.report()
+	require.Len(t, ingestions, 2)
+	sizes := make(map[string]uint64)
+	for _, ingestion := range ingestions {
+		require.NotZero(t, ingestion.DurationNs, ingestion.Predicate)
+		sizes[ingestion.Predicate] = ingestion.Bytes
+	}
+	// The size of a predicate includes its index keys, and a predicate that spans several
+	// lists of the backup is recorded as a whole.
+	require.Greater(t, sizes["bio"], uint64(2000))
+	require.Greater(t, sizes["name"], uint64(0))
+	require.Less(t, sizes["name"], uint64(200))
+	require.GreaterOrEqual(t, ingestions[0].DurationNs, ingestions[1].DurationNs)
+
+	// Loading another file with the same predicates adds to their ingestion.
+	_, err = loadFromBackup(db, bytes.NewReader(buf.Bytes()), backupVersion, 10, 0, preds, nil,
+		nil, nil, nil, stats, 0, nil)
+	require.NoError(t, err)
+	for _, ingestion := range stats.report() {
+		require.Equal(t, 2*sizes[ingestion.Predicate], ingestion.Bytes)
+	}
+}
+
+// writeBioBackup writes a backup of n values of the bio predicate of size bytes each.
+func writeBioBackup(t testing.TB, n, size int) *bytes.Buffer {
+	var buf bytes.Buffer
+	var kvs []*bpb.KV
+	for uid := 1; uid <= n; uid++ {
+		parsedKey, err := x.Parse(x.DataKey("bio", uint64(uid)))
+		require.NoError(t, err)
+		backupKey, err := parsedKey.ToBackupKey().Marshal()
+		require.NoError(t, err)
+		pl := &pb.BackupPostingList{Postings: []*pb.Posting{
+			{Value: bytes.Repeat([]byte{byte('a' + uid%26)}, size)}}}
+		val, err := pl.Marshal()
+		require.NoError(t, err)
+		kvs = append(kvs, &bpb.KV{Key: backupKey, Value: val, Version: 1,
+			UserMeta: []byte{posting.BitCompletePosting}})
+		if len(kvs) == 100 {
+			writeBackupList(t, &buf, kvs...)
+			kvs = kvs[:0]
+		}
+	}
+	if len(kvs) > 0 {
+		writeBackupList(t, &buf, kvs...)
+	}
+	return &buf
+}
+
+func TestLoadFromBackupBatchSize(t *testing.T) {
+	buf := writeBioBackup(t, 250, 1000)
+	preds := predicateSet{"bio": {}}
+
+	// The same data is restored whatever the size of the batches.
+	for _, batchSize := range []int64{0, 1, 10 << 10, 1 << 20} {
+		dir, err := ioutil.TempDir("", "restore_")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		db, err := badger.OpenManaged(badger.DefaultOptions(dir).WithLogger(nil))
+		require.NoError(t, err)
+		defer db.Close()
+
+		maxUid, err := loadFromBackup(db, bytes.NewReader(buf.Bytes()), backupVersion, 10, 0,
+			preds, nil, nil, nil, nil, nil, batchSize, nil)
+		require.NoError(t, err)
+		require.Equal(t, uint64(250), maxUid)
+
+		txn := db.NewTransactionAt(math.MaxUint64, false)
+		for uid := uint64(1); uid <= 250; uid++ {
+			item, err := txn.Get(x.DataKey("bio", uid))
+			require.NoError(t, err, "batch size %d, uid %d", batchSize, uid)
+			require.Equal(t, uint64(10), item.Version())
+		}
+		txn.Discard()
+	}
+}
+
+func TestRestoreLoader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := badger.OpenManaged(badger.DefaultOptions(dir).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+
+	visible := func(key []byte) bool {
+		txn := db.NewTransactionAt(math.MaxUint64, false)
+		defer txn.Discard()
+		_, err := txn.Get(key)
+		return err == nil
+	}
+	kv := func(key string) *bpb.KV {
+		return &bpb.KV{Key: []byte(key), Value: bytes.Repeat([]byte("v"), 500), Version: 1}
+	}
+
+	// A batch is applied once it reaches the batch size, and the last one when the load is
+	// finished.
+	loader := newRestoreLoader(db, 1000)
+	require.NoError(t, loader.set(kv("a")))
+	require.False(t, visible([]byte("a")))
+	require.NoError(t, loader.set(kv("b")))
+	require.True(t, visible([]byte("a")))
+	require.True(t, visible([]byte("b")))
+	require.NoError(t, loader.set(kv("c")))
+	require.False(t, visible([]byte("c")))
+	require.NoError(t, loader.finish())
+	require.True(t, visible([]byte("c")))
+
+	// Without a batch size, the data is only applied when the load is finished.
+	loader = newRestoreLoader(db, 0)
+	for _, key := range []string{"d", "e", "f"} {
+		require.NoError(t, loader.set(kv(key)))
+	}
+	require.False(t, visible([]byte("d")))
+	require.NoError(t, loader.finish())
+	require.True(t, visible([]byte("d")))
+	require.True(t, visible([]byte("f")))
+}
+
+// BenchmarkLoadFromBackupBatchSize reports the throughput of the restore of 32MiB of data for
+// several batch sizes.
+func BenchmarkLoadFromBackupBatchSize(b *testing.B) {
+	buf := writeBioBackup(b, 32<<10, 1<<10)
+	preds := predicateSet{"bio": {}}
+
+	for _, batchSizeMB := range []int64{1, 4, 16, 64, 0} {
+		b.Run(fmt.Sprintf("batchSizeMB=%d", batchSizeMB), func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "restore_")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+			db, err := badger.OpenManaged(badger.DefaultOptions(dir).WithLogger(nil))
+			require.NoError(b, err)
+			defer db.Close()
+
+			b.SetBytes(int64(buf.Len()))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := loadFromBackup(db, bytes.NewReader(buf.Bytes()), backupVersion,
+					uint64(i+1), 0, preds, nil, nil, nil, nil, nil, batchSizeMB<<20, nil)
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+func TestSortIngestions(t *testing.T) {
+	ingestions := []*pb.PredicateIngestion{
+		{Predicate: "a", Bytes: 10, DurationNs: 5},
+		{Predicate: "b", Bytes: 10, DurationNs: 50},
+		{Predicate: "c", Bytes: 30, DurationNs: 5},
+		{Predicate: "d", Bytes: 10, DurationNs: 5},
+	}
+	sortIngestions(ingestions)
+	var order []string
+	for _, ingestion := range ingestions {
+		order = append(order, ingestion.Predicate)
+	}
+	require.Equal(t, []string{"b", "c", "a", "d"}, order)
+
+	// A nil ingestStats records nothing.
+	var stats *ingestStats
+	stats.record("a", 1, time.Second)
+	require.Nil(t, stats.report())
+}
+
+func TestLoadFromBackupUidOffset(t *testing.T) {
+	backupKV := func(key []byte, pl *pb.BackupPostingList) *bpb.KV {
+		parsedKey, err := x.Parse(key)
+		require.NoError(t, err)
+		backupKey, err := parsedKey.ToBackupKey().Marshal()
+		require.NoError(t, err)
+		val, err := pl.Marshal()
+		require.NoError(t, err)
+		return &bpb.KV{Key: backupKey, Value: val, Version: 1,
+			UserMeta: []byte{posting.BitCompletePosting}}
+	}
+	name := &pb.BackupPostingList{
+		Uids: []uint64{math.MaxUint64},
+		Postings: []*pb.Posting{{Uid: math.MaxUint64, Value: []byte("Alice"),
+			ValType: pb.Posting_STRING, PostingType: pb.Posting_VALUE}},
+	}
+	var buf bytes.Buffer
+	writeBackupList(t, &buf,
+		backupKV(x.DataKey("friend", 1), &pb.BackupPostingList{Uids: []uint64{2, 3}}),
+		backupKV(x.DataKey("name", 1), name),
+		backupKV(x.IndexKey("name", "alice"), &pb.BackupPostingList{Uids: []uint64{1}}),
+		backupKV(x.ReverseKey("friend", 2), &pb.BackupPostingList{Uids: []uint64{1}}))
+	preds := predicateSet{"friend": {}, "name": {}}
+
+	dir, err := ioutil.TempDir("", "restore_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := badger.OpenManaged(badger.DefaultOptions(dir).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+
+	maxUid, err := loadFromBackup(db, bytes.NewReader(buf.Bytes()), backupVersion, 10, 100,
+		preds, nil, nil, nil, nil, nil, 0, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(102), maxUid)
+
+	txn := db.NewTransactionAt(math.MaxUint64, false)
+	defer txn.Discard()
+	read := func(key []byte) *pb.PostingList {
+		item, err := txn.Get(key)
+		require.NoError(t, err)
+		var pl pb.PostingList
+		require.NoError(t, item.Value(func(val []byte) error {
+			return pl.Unmarshal(val)
+		}))
+		return &pl
+	}
+	// The references between the restored nodes still point to the same nodes.
+	require.Equal(t, []uint64{102, 103}, codec.Decode(read(x.DataKey("friend", 101)).Pack, 0))
+	require.Equal(t, []uint64{101}, codec.Decode(read(x.ReverseKey("friend", 102)).Pack, 0))
+	require.Equal(t, []uint64{101}, codec.Decode(read(x.IndexKey("name", "alice")).Pack, 0))
+	// The uids of the postings of values are fingerprints, which are kept.
+	pl := read(x.DataKey("name", 101))
+	require.Len(t, pl.Postings, 1)
+	require.Equal(t, uint64(math.MaxUint64), pl.Postings[0].Uid)
+	require.Equal(t, "Alice", string(pl.Postings[0].Value))
+	_, err = txn.Get(x.DataKey("name", 1))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+
+	// The offset can't overflow the uid space.
+	_, err = loadFromBackup(db, bytes.NewReader(buf.Bytes()), backupVersion, 10,
+		math.MaxUint64-2, preds, nil, nil, nil, nil, nil, 0, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "overflows the uid space")
+}
+
+func TestCheckUidOffset(t *testing.T) {
+	req := &pb.RestoreRequest{UidOffset: 0x1000}
+	err := checkUidOffset(req, 0x2000)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "uid offset 0x1000 is below the uids leased up to 0x2000")
+
+	require.NoError(t, checkUidOffset(req, 0x1000))
+	req.UidOffset = 0
+	require.NoError(t, checkUidOffset(req, 0x2000))
+}
+
+func TestLoadFromBackupTypes(t *testing.T) {
+	backupKV := func(key []byte, value []byte, meta byte) *bpb.KV {
+		parsedKey, err := x.Parse(key)
+		require.NoError(t, err)
+		backupKey, err := parsedKey.ToBackupKey().Marshal()
+		require.NoError(t, err)
+		return &bpb.KV{Key: backupKey, Value: value, Version: 1, UserMeta: []byte{meta}}
+	}
+	typeKV := func(name string, fields ...string) *bpb.KV {
+		update := &pb.TypeUpdate{TypeName: name}
+		for _, field := range fields {
+			update.Fields = append(update.Fields, &pb.SchemaUpdate{Predicate: field})
+		}
+		val, err := update.Marshal()
+		require.NoError(t, err)
+		return backupKV(x.TypeKey(name), val, posting.BitSchemaPosting)
+	}
+	pl := &pb.BackupPostingList{Postings: []*pb.Posting{{Value: []byte("Alice")}}}
+	name, err := pl.Marshal()
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	writeBackupList(t, &buf,
+		backupKV(x.DataKey("name", 1), name, posting.BitCompletePosting),
+		typeKV("Film", "title"),
+		typeKV("Person", "name"))
+	preds := predicateSet{"name": {}}
+
+	dir, err := ioutil.TempDir("", "restore_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := badger.OpenManaged(badger.DefaultOptions(dir).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+
+	restoredTypes := func(types *typeFilter) []string {
+		_, err := loadFromBackup(db, bytes.NewReader(buf.Bytes()), backupVersion, 10, 0, preds,
+			nil, nil, types, nil, nil, 0, nil)
+		require.NoError(t, err)
+
+		txn := db.NewTransactionAt(math.MaxUint64, false)
+		defer txn.Discard()
+		// The predicates are restored whatever types are selected.
+		_, err = txn.Get(x.DataKey("name", 1))
+		require.NoError(t, err)
+		var names []string
+		for _, typ := range []string{"Film", "Person"} {
+			if _, err := txn.Get(x.TypeKey(typ)); err == nil {
+				names = append(names, typ)
+			} else {
+				require.Equal(t, badger.ErrKeyNotFound, err)
+			}
+		}
+		return names
+	}
+	require.Equal(t, []string{"Film", "Person"}, restoredTypes(nil))
+	require.Equal(t, []string{"Person"},
+		restoredTypes(&typeFilter{include: map[string]struct{}{"Person": {}}}))
+	require.Equal(t, []string{"Film"},
+		restoredTypes(&typeFilter{exclude: map[string]struct{}{"Person": {}}}))
+	require.Empty(t, restoredTypes(&typeFilter{include: map[string]struct{}{"Other": {}}}))
+}
+
+func TestNewTypeCoercion(t *testing.T) {
+	coerce, err := newTypeCoercion(nil)
+	require.NoError(t, err)
+	require.Nil(t, coerce)
+	require.False(t, coerce.coerces("age"))
+
+	coerce, err = newTypeCoercion([]*pb.TypeCoercion{{Predicate: " age ", Type: "int"}})
+	require.NoError(t, err)
+	require.True(t, coerce.coerces("age"))
+	require.False(t, coerce.coerces("name"))
+
+	for _, tc := range []struct {
+		coercions []*pb.TypeCoercion
+		err       string
+	}{
+		{[]*pb.TypeCoercion{{Predicate: "", Type: "int"}}, "the predicates to coerce can't be empty"},
+		{[]*pb.TypeCoercion{{Predicate: "age", Type: "integer"}},
+			`cannot coerce predicate age to type "integer"`},
+		{[]*pb.TypeCoercion{{Predicate: "friend", Type: "uid"}},
+			`cannot coerce predicate friend to type "uid"`},
+		{[]*pb.TypeCoercion{{Predicate: "age", Type: "int"}, {Predicate: "age", Type: "float"}},
+			"predicate age can only be coerced once"},
+	} {
+		_, err := newTypeCoercion(tc.coercions)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), tc.err)
+	}
+}
+
+func TestLoadFromBackupCoerceTypes(t *testing.T) {
+	backupKV := func(key []byte, value []byte, meta byte) *bpb.KV {
+		parsedKey, err := x.Parse(key)
+		require.NoError(t, err)
+		backupKey, err := parsedKey.ToBackupKey().Marshal()
+		require.NoError(t, err)
+		return &bpb.KV{Key: backupKey, Value: value, Version: 1, UserMeta: []byte{meta}}
+	}
+	schemaKV := func(update *pb.SchemaUpdate) *bpb.KV {
+		val, err := update.Marshal()
+		require.NoError(t, err)
+		return backupKV(x.SchemaKey(update.Predicate), val, posting.BitSchemaPosting)
+	}
+	dataKV := func(key []byte, values ...string) *bpb.KV {
+		pl := &pb.BackupPostingList{}
+		for _, val := range values {
+			uid := uint64(math.MaxUint64)
+			if len(values) > 1 {
+				uid = farm.Fingerprint64([]byte(val))
+			}
+			pl.Uids = append(pl.Uids, uid)
+			pl.Postings = append(pl.Postings, &pb.Posting{Uid: uid, Value: []byte(val),
+				ValType: pb.Posting_STRING, PostingType: pb.Posting_VALUE})
+		}
+		sort.Slice(pl.Postings, func(i, j int) bool { return pl.Postings[i].Uid < pl.Postings[j].Uid })
+		sort.Slice(pl.Uids, func(i, j int) bool { return pl.Uids[i] < pl.Uids[j] })
+		val, err := pl.Marshal()
+		require.NoError(t, err)
+		return backupKV(key, val, posting.BitCompletePosting)
+	}
+	// The numbers were stored as strings in the backup.
+	var buf bytes.Buffer
+	writeBackupList(t, &buf,
+		schemaKV(&pb.SchemaUpdate{Predicate: "age", ValueType: pb.Posting_STRING,
+			Directive: pb.SchemaUpdate_INDEX, Tokenizer: []string{"exact"}}),
+		schemaKV(&pb.SchemaUpdate{Predicate: "scores", ValueType: pb.Posting_STRING,
+			List: true}),
+		dataKV(x.DataKey("age", 1), "42"),
+		dataKV(x.DataKey("age", 2), "7"),
+		dataKV(x.DataKey("age", 3), "unknown"),
+		dataKV(x.IndexKey("age", "42"), ""),
+		dataKV(x.DataKey("name", 1), "Alice"),
+		dataKV(x.DataKey("scores", 1), "1", "01", "2"))
+	preds := predicateSet{"age": {}, "name": {}, "scores": {}}
+
+	dir, err := ioutil.TempDir("", "restore_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := badger.OpenManaged(badger.DefaultOptions(dir).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+
+	coerce, err := newTypeCoercion([]*pb.TypeCoercion{
+		{Predicate: "age", Type: "int"},
+		{Predicate: "scores", Type: "int"},
+	})
+	require.NoError(t, err)
+	_, err = loadFromBackup(db, bytes.NewReader(buf.Bytes()), backupVersion, 10, 0, preds,
+		nil, nil, nil, coerce, nil, 0, nil)
+	require.NoError(t, err)
+	require.Equal(t, []*pb.CoercionReport{
+		{Predicate: "age", Coerced: 2, Failed: 1},
+		{Predicate: "scores", Coerced: 3},
+	}, coerce.report())
+
+	txn := db.NewTransactionAt(math.MaxUint64, false)
+	defer txn.Discard()
+	values := func(key []byte) []interface{} {
+		item, err := txn.Get(key)
+		require.NoError(t, err)
+		var pl pb.PostingList
+		require.NoError(t, item.Value(func(val []byte) error {
+			return pl.Unmarshal(val)
+		}))
+		vals := []interface{}{}
+		for _, p := range pl.Postings {
+			val, err := types.Convert(types.Val{Tid: types.TypeID(p.ValType), Value: p.Value},
+				types.TypeID(p.ValType))
+			require.NoError(t, err)
+			vals = append(vals, val.Value)
+		}
+		return vals
+	}
+	require.Equal(t, []interface{}{int64(42)}, values(x.DataKey("age", 1)))
+	require.Equal(t, []interface{}{int64(7)}, values(x.DataKey("age", 2)))
+	// The values that can't be converted are skipped.
+	require.Empty(t, values(x.DataKey("age", 3)))
+	// The values of a list that become equal once converted are only kept once.
+	scores := values(x.DataKey("scores", 1))
+	require.ElementsMatch(t, []interface{}{int64(1), int64(2)}, scores)
+	// The predicates that aren't coerced are restored as they are.
+	require.Equal(t, []interface{}{"Alice"}, values(x.DataKey("name", 1)))
+	// The index keys were computed from the strings, so they aren't restored.
+	_, err = txn.Get(x.IndexKey("age", "42"))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+
+	item, err := txn.Get(x.SchemaKey("age"))
+	require.NoError(t, err)
+	var update pb.SchemaUpdate
+	require.NoError(t, item.Value(func(val []byte) error {
+		return update.Unmarshal(val)
+	}))
+	require.Equal(t, pb.Posting_INT, update.ValueType)
+	require.Equal(t, pb.SchemaUpdate_NONE, update.Directive)
+	require.Empty(t, update.Tokenizer)
+
+	// A uid predicate can't be coerced.
+	buf.Reset()
+	writeBackupList(t, &buf,
+		schemaKV(&pb.SchemaUpdate{Predicate: "age", ValueType: pb.Posting_UID}))
+	_, err = loadFromBackup(db, bytes.NewReader(buf.Bytes()), backupVersion, 10, 0, preds,
+		nil, nil, nil, coerce, nil, 0, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot coerce predicate age, which is a uid predicate")
+}
+
+func TestRestoreTypeFilter(t *testing.T) {
+	types, err := restoreTypeFilter(&pb.RestoreRequest{})
+	require.NoError(t, err)
+	require.Nil(t, types)
+
+	types, err = restoreTypeFilter(&pb.RestoreRequest{IncludeTypes: []string{"Person", " Film"}})
+	require.NoError(t, err)
+	require.True(t, types.restores("Film"))
+	require.False(t, types.restores("Country"))
+
+	types, err = restoreTypeFilter(&pb.RestoreRequest{ExcludeTypes: []string{"Person"}})
+	require.NoError(t, err)
+	require.False(t, types.restores("Person"))
+	require.True(t, types.restores("Film"))
+
+	_, err = restoreTypeFilter(&pb.RestoreRequest{IncludeTypes: []string{"Person"},
+		ExcludeTypes: []string{"Film"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "includeTypes and excludeTypes can't both be set")
+	_, err = restoreTypeFilter(&pb.RestoreRequest{IncludeTypes: []string{""}})
+	require.Error(t, err)
+}
+
+func TestParsePostRestoreSchema(t *testing.T) {
+	result, err := parsePostRestoreSchema(&pb.RestoreRequest{})
+	require.NoError(t, err)
+	require.Nil(t, result)
+
+	result, err = parsePostRestoreSchema(&pb.RestoreRequest{PostRestoreSchema: `
+		name: string @index(exact) .
+		type Person {
+			name: string
+		}`})
+	require.NoError(t, err)
+	require.Len(t, result.Preds, 1)
+	require.Equal(t, "name", result.Preds[0].Predicate)
+	require.Len(t, result.Types, 1)
+
+	for schema, msg := range map[string]string{
+		`name: strin .`:           "invalid post-restore schema",
+		`dgraph.type: int .`:      "can't alter the reserved predicate dgraph.type",
+		`dgraph.custom: string .`: "can't alter the reserved predicate dgraph.custom",
+		`type dgraph.Custom {
+			name: string
+		}`: "can't alter the reserved type dgraph.Custom",
+	} {
+		_, err := parsePostRestoreSchema(&pb.RestoreRequest{PostRestoreSchema: schema})
+		require.Error(t, err, schema)
+		require.Contains(t, err.Error(), msg, schema)
+	}
+}
+
+// writeWAL writes a write-ahead log of the given group with an entry for each proposal. The
+// log starts at the given read timestamp if it's not zero, as if a snapshot was taken.
+func writeWAL(t *testing.T, dir string, gid uint32, readTs uint64, proposals []*pb.Proposal) {
+	db, err := badger.Open(badger.LSMOnlyOptions(dir).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+	store := raftwal.Init(db, 1, gid)
+	defer store.Closer.SignalAndWait()
+
+	entries := make([]raftpb.Entry, 0, len(proposals)+1)
+	// The entries before the snapshot are discarded, so there's always one to take it at.
+	entries = append(entries, raftpb.Entry{Index: 1, Term: 1})
+	for i, proposal := range proposals {
+		data, err := proposal.Marshal()
+		require.NoError(t, err)
+		entries = append(entries, raftpb.Entry{Index: uint64(i + 2), Term: 1, Data: data})
+	}
+	require.NoError(t, store.Save(&raftpb.HardState{Term: 1, Commit: uint64(len(entries))},
+		entries, nil))
+	if readTs > 0 {
+		data, err := (&pb.Snapshot{Index: 1, ReadTs: readTs}).Marshal()
+		require.NoError(t, err)
+		require.NoError(t, store.CreateSnapshot(1, &raftpb.ConfState{}, data))
+	}
+}
+
+func walMutation(startTs uint64, uid uint64, attr, value string) *pb.Proposal {
+	return &pb.Proposal{Mutations: &pb.Mutations{StartTs: startTs, Edges: []*pb.DirectedEdge{{
+		Entity:    uid,
+		Attr:      attr,
+		Value:     []byte(value),
+		ValueType: pb.Posting_STRING,
+		Op:        pb.DirectedEdge_SET,
+	}}}}
+}
+
+func walCommits(commits ...uint64) *pb.Proposal {
+	delta := &pb.OracleDelta{}
+	for i := 0; i < len(commits); i += 2 {
+		delta.Txns = append(delta.Txns, &pb.TxnStatus{StartTs: commits[i],
+			CommitTs: commits[i+1]})
+	}
+	return &pb.Proposal{Delta: delta}
+}
+
+func TestReadWALTxns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The backup ends at timestamp 10. The transaction at 5 is in it, the one at 13 was
+	// aborted and the one at 11 has mutations in both groups.
+	writeWAL(t, filepath.Join(dir, "g1"), 1, 0, []*pb.Proposal{
+		{Mutations: &pb.Mutations{StartTs: 3, Schema: []*pb.SchemaUpdate{
+			{Predicate: "name", ValueType: pb.Posting_STRING}}}},
+		walMutation(5, 1, "name", "Alice"),
+		walCommits(5, 8),
+		walMutation(12, 2, "name", "Bob"),
+		walMutation(11, 3, "name", "Carol"),
+		walMutation(13, 4, "name", "Dave"),
+		walCommits(12, 15, 11, 16, 13, 0),
+	})
+	writeWAL(t, filepath.Join(dir, "g2"), 2, 0, []*pb.Proposal{
+		walMutation(11, 3, "age", "30"),
+		walCommits(12, 15, 11, 16, 13, 0),
+	})
+
+	txns, err := readWALTxns(dir, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, txns, 2)
+	require.Equal(t, uint64(12), txns[0].startTs)
+	require.Equal(t, uint64(15), txns[0].commitTs)
+	require.Len(t, txns[0].edges, 1)
+	require.Equal(t, []byte("Bob"), txns[0].edges[0].Value)
+	require.Equal(t, uint64(11), txns[1].startTs)
+	require.Equal(t, uint64(16), txns[1].commitTs)
+	var attrs []string
+	for _, edge := range txns[1].edges {
+		attrs = append(attrs, edge.Attr)
+	}
+	sort.Strings(attrs)
+	require.Equal(t, []string{"age", "name"}, attrs)
+
+	// A single log can be given as well.
+	txns, err = readWALTxns(filepath.Join(dir, "g2"), nil, 10)
+	require.NoError(t, err)
+	require.Len(t, txns, 1)
+
+	_, err = readWALTxns(filepath.Join(dir, "missing"), nil, 10)
+	require.Error(t, err)
+}
+
+func TestReadWALTxnsValidation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The log starts at timestamp 20, so it only replays on top of backups that end later.
+	writeWAL(t, filepath.Join(dir, "late"), 1, 20, []*pb.Proposal{
+		walMutation(22, 1, "name", "Alice"),
+		walCommits(22, 23),
+	})
+	_, err = readWALTxns(filepath.Join(dir, "late"), nil, 10)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "starts at timestamp 20, after the backup ends at "+
+		"timestamp 10")
+	txns, err := readWALTxns(filepath.Join(dir, "late"), nil, 21)
+	require.NoError(t, err)
+	require.Len(t, txns, 1)
+
+	writeWAL(t, filepath.Join(dir, "drop"), 1, 0, []*pb.Proposal{
+		walMutation(12, 1, "name", "Alice"),
+		{Mutations: &pb.Mutations{StartTs: 14, DropOp: pb.Mutations_DATA}},
+	})
+	_, err = readWALTxns(filepath.Join(dir, "drop"), nil, 10)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "data was dropped at timestamp 14")
+	_, err = readWALTxns(filepath.Join(dir, "drop"), nil, 14)
+	require.NoError(t, err)
+}
+
+func TestReplayWALTxns(t *testing.T) {
+	txns := []*walTxn{
+		{startTs: 12, commitTs: 15, edges: walMutation(12, 2, "name", "Bob").Mutations.Edges},
+		{startTs: 11, commitTs: 16, edges: walMutation(11, 2, "name", "Carol").Mutations.Edges},
+	}
+	// The transactions are replayed in commit order, so the last write of a value wins.
+	names := make(map[uint64]string)
+	apply := func(_ context.Context, txn *walTxn) error {
+		for _, edge := range txn.edges {
+			names[edge.Entity] = string(edge.Value)
+		}
+		return nil
+	}
+	n, err := replayWALTxns(context.Background(), txns, apply)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Equal(t, map[uint64]string{2: "Carol"}, names)
+
+	failing := func(_ context.Context, txn *walTxn) error {
+		if txn.commitTs == 16 {
+			return errors.Errorf("conflict")
+		}
+		return nil
+	}
+	n, err = replayWALTxns(context.Background(), txns, failing)
+	require.Error(t, err)
+	require.Equal(t, 1, n)
+	require.Contains(t, err.Error(), "committed at timestamp 16")
+}
+
+// writeManifest writes the manifest of a backup taken at the given time into its directory
+// under dir, after recording it as the latest backup, as a backup does. It returns the request
+// of the backup and the manifests of the index to update.
+func writeManifest(t *testing.T, dir, unixTs string, manifest *Manifest) (*pb.BackupRequest,
+	[]*Manifest) {
+	uri, err := url.Parse(dir)
+	require.NoError(t, err)
+	req := &pb.BackupRequest{UnixTs: unixTs}
+	indexed, err := markLatestManifest(&fileHandler{}, uri, req)
+	require.NoError(t, err)
+
+	backupDir := filepath.Join(dir, fmt.Sprintf(backupPathFmt, unixTs))
+	require.NoError(t, os.MkdirAll(backupDir, 0700))
+	data, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(backupDir, backupManifest), data, 0600))
+	return req, indexed
+}
+
+func TestManifestIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	uri, err := url.Parse(dir)
+	require.NoError(t, err)
+	h := &fileHandler{}
+
+	series := func(manifests []*Manifest) []string {
+		var ids []string
+		for _, m := range manifests {
+			ids = append(ids, fmt.Sprintf("%s/%d", m.BackupId, m.BackupNum))
+		}
+		return ids
+	}
+	full := func(id string) *Manifest {
+		return &Manifest{Type: "full", Since: 10, BackupId: id, BackupNum: 1}
+	}
+	incremental := func(id string, num uint64) *Manifest {
+		return &Manifest{Type: "incremental", Since: 10 * num, BackupId: id, BackupNum: num}
+	}
+
+	// Without an index, the manifests are found by scanning the location.
+	writeManifest(t, dir, "20200101.000000.000", full("a"))
+	writeManifest(t, dir, "20200102.000000.000", incremental("a", 2))
+	req, indexed := writeManifest(t, dir, "20200103.000000.000", full("b"))
+	require.Nil(t, indexed)
+	manifests, err := h.GetManifests(uri, "a")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/1", "a/2"}, series(manifests))
+	listed, err := ListBackupManifests(dir, nil)
+	require.NoError(t, err)
+	require.Len(t, listed, 3)
+
+	// The first backup that updates the index builds it from all the manifests.
+	require.NoError(t, updateManifestIndex(h, uri, req, full("b"), indexed))
+	indexed, err = readManifestIndex(h, uri)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/1", "a/2", "b/1"}, series(indexed))
+	require.Equal(t, filepath.Join(dir, "dgraph.20200101.000000.000", backupManifest),
+		indexed[0].Path)
+
+	// The next ones are added to it without scanning, so the manifests are found even if
+	// only the index lists them.
+	req, indexed = writeManifest(t, dir, "20200104.000000.000", incremental("b", 2))
+	require.Len(t, indexed, 3)
+	require.NoError(t, updateManifestIndex(h, uri, req, incremental("b", 2), indexed))
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "dgraph.20200101.000000.000")))
+	listed, err = ListBackupManifests(dir, nil)
+	require.NoError(t, err)
+	require.Len(t, listed, 4)
+	manifests, err = h.GetManifests(uri, "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"b/1", "b/2"}, series(manifests))
+	// Adding a manifest again doesn't list it twice.
+	req, indexed = writeManifest(t, dir, "20200104.000000.000", incremental("b", 2))
+	require.NoError(t, updateManifestIndex(h, uri, req, incremental("b", 2), indexed))
+	indexed, err = readManifestIndex(h, uri)
+	require.NoError(t, err)
+	require.Len(t, indexed, 4)
+
+	// A backup that wasn't added to the index makes the next one rebuild it.
+	writeManifest(t, dir, "20200105.000000.000", incremental("b", 3))
+	req, indexed = writeManifest(t, dir, "20200106.000000.000", incremental("b", 4))
+	require.Nil(t, indexed)
+	require.NoError(t, updateManifestIndex(h, uri, req, incremental("b", 4), indexed))
+	indexed, err = readCurrentManifestIndex(h, uri)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/2", "b/1", "b/2", "b/3", "b/4"}, series(indexed))
+
+	// A location whose index can't be read is scanned.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, backupManifestIndex),
+		[]byte("{"), 0600))
+	listed, err = ListBackupManifests(dir, nil)
+	require.NoError(t, err)
+	require.Len(t, listed, 5)
+	// And the next backup rebuilds it.
+	req, indexed = writeManifest(t, dir, "20200106.000000.000", incremental("b", 4))
+	require.NoError(t, updateManifestIndex(h, uri, req, incremental("b", 4), indexed))
+	indexed, err = readManifestIndex(h, uri)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/2", "b/1", "b/2", "b/3", "b/4"}, series(indexed))
+}
+
+func TestStaleManifestIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	uri, err := url.Parse(dir)
+	require.NoError(t, err)
+	h := &fileHandler{}
+
+	full := func(id string) *Manifest {
+		return &Manifest{Type: "full", Since: 10, BackupId: id, BackupNum: 1}
+	}
+	req, indexed := writeManifest(t, dir, "20200101.000000.000", full("a"))
+	require.NoError(t, updateManifestIndex(h, uri, req, full("a"), indexed))
+	_, err = readCurrentManifestIndex(h, uri)
+	require.NoError(t, err)
+
+	// The latest backup was written but couldn't be added to the index. The index is still
+	// valid, and the series it lists is complete, but the latest backup must be restored.
+	writeManifest(t, dir, "20200102.000000.000", full("b"))
+	_, err = readCurrentManifestIndex(h, uri)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "the manifest index doesn't list")
+	manifests, err := h.GetManifests(uri, "")
+	require.NoError(t, err)
+	require.Len(t, manifests, 1)
+	require.Equal(t, "b", manifests[0].BackupId)
+	listed, err := ListBackupManifests(dir, nil)
+	require.NoError(t, err)
+	require.Len(t, listed, 2)
+
+	// An index written before the latest backup was recorded can't be checked, so it isn't
+	// used either.
+	require.NoError(t, os.Remove(filepath.Join(dir, backupLatestManifest)))
+	_, err = readCurrentManifestIndex(h, uri)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "the latest backup isn't recorded")
+
+	// The next backup rebuilds the index.
+	req, indexed = writeManifest(t, dir, "20200103.000000.000", full("c"))
+	require.Nil(t, indexed)
+	require.NoError(t, updateManifestIndex(h, uri, req, full("c"), indexed))
+	indexed, err = readCurrentManifestIndex(h, uri)
+	require.NoError(t, err)
+	require.Len(t, indexed, 3)
+}
+
+// writeNameBackup writes a full backup of group 1 to dir whose name and age predicates hold
+// the given values, keyed by uid.
+func writeNameBackup(t *testing.T, dir string, names map[uint64]string, ages map[uint64]int) {
+	backupKV := func(key []byte, value []byte) *bpb.KV {
+		parsedKey, err := x.Parse(key)
+		require.NoError(t, err)
+		backupKey, err := parsedKey.ToBackupKey().Marshal()
+		require.NoError(t, err)
+		pl := &pb.BackupPostingList{Postings: []*pb.Posting{{Value: value}}}
+		data, err := pl.Marshal()
+		require.NoError(t, err)
+		return &bpb.KV{Key: backupKey, Value: data, Version: 1,
+			UserMeta: []byte{posting.BitCompletePosting}}
+	}
+	var kvs []*bpb.KV
+	preds := []string{"name"}
+	for uid, name := range names {
+		kvs = append(kvs, backupKV(x.DataKey("name", uid), []byte(name)))
+	}
+	for uid, age := range ages {
+		kvs = append(kvs, backupKV(x.DataKey("age", uid), []byte(strconv.Itoa(age))))
+	}
+	if len(ages) > 0 {
+		preds = append(preds, "age")
+	}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	var list bytes.Buffer
+	writeBackupList(t, &list, kvs...)
+	_, err := gw.Write(list.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	backupDir := filepath.Join(dir, "dgraph.20200601.120000.000")
+	require.NoError(t, os.MkdirAll(backupDir, 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(backupDir, backupName(100, 1)),
+		buf.Bytes(), 0600))
+	manifest := Manifest{Type: "full", Since: 100, Groups: map[uint32][]string{1: preds},
+		BackupId: "diff", BackupNum: 1, Version: backupVersion}
+	data, err := json.Marshal(&manifest)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(backupDir, backupManifest), data, 0600))
+}
+
+func TestRestoreDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	names := map[uint64]string{1: "Alice", 2: "Bob"}
+	writeNameBackup(t, filepath.Join(dir, "a"), names, nil)
+	writeNameBackup(t, filepath.Join(dir, "same"), names, nil)
+	writeNameBackup(t, filepath.Join(dir, "other"),
+		map[uint64]string{1: "Alice", 2: "Robert", 3: "Carol"}, map[uint64]int{1: 30})
+
+	// The scratch directories are created under the target directory and removed.
+	scratch := filepath.Join(dir, "scratch")
+	req := &pb.RestoreRequest{Location: filepath.Join(dir, "a"),
+		DiffAgainst: filepath.Join(dir, "same"), TargetDir: scratch}
+	res, err := restoreDiff(req)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "same"), res.Diff.Location)
+	require.Equal(t, 1, res.Diff.PredicatesCompared)
+	require.Empty(t, res.Diff.Predicates)
+	entries, err := ioutil.ReadDir(scratch)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	req.DiffAgainst = filepath.Join(dir, "other")
+	req.DiffAgainstBackupId = "diff"
+	res, err = restoreDiff(req)
+	require.NoError(t, err)
+	require.Equal(t, 2, res.Diff.PredicatesCompared)
+	require.Len(t, res.Diff.Predicates, 2)
+	age, name := res.Diff.Predicates[0], res.Diff.Predicates[1]
+	require.Equal(t, "age", age.Predicate)
+	require.Zero(t, age.Count)
+	require.Empty(t, age.Checksum)
+	require.Equal(t, uint64(1), age.OtherCount)
+	require.NotEmpty(t, age.OtherChecksum)
+	require.Equal(t, "name", name.Predicate)
+	require.Equal(t, uint64(2), name.Count)
+	require.Equal(t, uint64(3), name.OtherCount)
+	require.NotEqual(t, name.Checksum, name.OtherChecksum)
+
+	// A backup that can't be restored fails the comparison.
+	req.DiffAgainst = filepath.Join(dir, "missing")
+	_, err = restoreDiff(req)
+	require.Error(t, err)
+
+	// The options that change what's restored can't be used.
+	err = checkDiffRequest(&pb.RestoreRequest{DiffAgainst: "b", Rebalance: true}, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "rebalancing is not supported when comparing backups")
+	require.NoError(t, checkDiffRequest(&pb.RestoreRequest{DiffAgainst: "b",
+		RebuildIndexes: "all"}, nil))
+}
+
+func TestRestoreReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore_report_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	manifests := []*Manifest{
+		{Type: "full", BackupNum: 1, Since: 10, Path: "dgraph.1", Version: 2103,
+			Groups: map[uint32][]string{1: {"name", "dgraph.type"}}},
+		{Type: "incremental", BackupNum: 2, Since: 20, Path: "dgraph.2", Version: 2103,
+			Encrypted: true, Groups: map[uint32][]string{1: {"name", "dgraph.type"}, 2: {"age"}}},
+	}
+	state := &pb.MembershipState{Groups: map[uint32]*pb.Group{
+		1: {Tablets: map[string]*pb.Tablet{
+			"name":        {GroupId: 1, Predicate: "name"},
+			"email":       {GroupId: 1, Predicate: "email"},
+			"dgraph.user": {GroupId: 1, Predicate: "dgraph.user"},
+		}},
+		2: {},
+	}}
+
+	req := &pb.RestoreRequest{Location: "/backups", BackupId: "b1",
+		ReportPath: filepath.Join(dir, "reports", "report.json")}
+	report := newRestoreReport(req)
+	report.setBackup(manifests, state)
+	report.setEstimate(&RestoreEstimate{NumFiles: 3, Size: 1 << 20, Throughput: 1 << 20,
+		Duration: 2 * time.Second})
+	report.setVerification(&RestoreVerification{FilesVerified: 3, Duration: time.Second})
+	require.NoError(t, writeRestoreReport(req, report, nil))
+
+	// The parent directories of the report are created and the report is valid JSON.
+	b, err := ioutil.ReadFile(req.ReportPath)
+	require.NoError(t, err)
+	require.True(t, json.Valid(b))
+	var got restoreReport
+	require.NoError(t, json.Unmarshal(b, &got))
+	require.True(t, got.Valid)
+	require.Empty(t, got.Error)
+	require.Equal(t, "/backups", got.Location)
+	require.Equal(t, "b1", got.BackupId)
+	require.Len(t, got.Backups, 2)
+	require.Equal(t, "incremental", got.Backups[1].Type)
+	require.True(t, got.Backups[1].Encrypted)
+	require.Equal(t, []reportPredicate{
+		{Predicate: "age", Group: 2},
+		{Predicate: "dgraph.type", Group: 1},
+		{Predicate: "name", Group: 1},
+	}, got.Predicates)
+	require.Equal(t, 3, got.NumPredicates)
+	require.Equal(t, map[uint32]int{1: 2, 2: 1}, got.GroupPredicates)
+	require.Equal(t, &reportSchemaDiff{Added: []string{"age"}, Dropped: []string{"email"}},
+		got.SchemaDiff)
+	require.Equal(t, 3, got.Estimate.NumFiles)
+	require.Equal(t, 2.0, got.Estimate.EstimatedDuration)
+	require.Equal(t, 3, got.Verification.FilesVerified)
+
+	// The report of a failed dry run holds the error and replaces the previous one.
+	report = newRestoreReport(req)
+	report.setBackup(manifests, state)
+	require.NoError(t, writeRestoreReport(req, report, errors.New("backup is damaged")))
+	b, err = ioutil.ReadFile(req.ReportPath)
+	require.NoError(t, err)
+	var fields map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &fields))
+	require.Equal(t, false, fields["valid"])
+	require.Equal(t, "backup is damaged", fields["error"])
+	require.NotContains(t, fields, "estimate")
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "reports"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
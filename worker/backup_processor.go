@@ -113,6 +113,9 @@ func (pr *BackupProcessor) WriteBackup(ctx context.Context) (*pb.Status, error)
 	}
 
 	var maxVersion uint64
+	// size is the number of bytes written before they're compressed. It's recorded in the
+	// manifest to check that a restore of the backup fits in the disk.
+	var size uint64
 
 	newhandler, err := enc.GetWriter(x.WorkerConfig.EncryptionKey, handler)
 	if err != nil {
@@ -152,6 +155,8 @@ func (pr *BackupProcessor) WriteBackup(ctx context.Context) (*pb.Status, error)
 				maxVersion = kv.Version
 			}
 		}
+		// writeKVList writes the size of the list before the list.
+		size += 8 + uint64(list.Size())
 		return writeKVList(list, gzWriter)
 	}
 
@@ -176,7 +181,7 @@ func (pr *BackupProcessor) WriteBackup(ctx context.Context) (*pb.Status, error)
 		return &emptyRes, err
 	}
 	glog.Infof("Backup complete: group %d at %d", pr.Request.GroupId, pr.Request.ReadTs)
-	return &emptyRes, nil
+	return &pb.Status{UncompressedSize: size}, nil
 }
 
 // CompleteBackup will finalize a backup by writing the manifest at the backup destination.
@@ -195,6 +200,11 @@ func (pr *BackupProcessor) CompleteBackup(ctx context.Context, manifest *Manifes
 		return err
 	}
 
+	indexed, err := markLatestManifest(handler, uri, pr.Request)
+	if err != nil {
+		return err
+	}
+
 	if err := handler.CreateManifest(uri, pr.Request); err != nil {
 		return err
 	}
@@ -206,6 +216,12 @@ func (pr *BackupProcessor) CompleteBackup(ctx context.Context, manifest *Manifes
 	if err = handler.Close(); err != nil {
 		return err
 	}
+
+	if err := updateManifestIndex(handler, uri, pr.Request, manifest, indexed); err != nil {
+		return errors.Wrapf(err, "the backup was written but the manifest index couldn't be "+
+			"updated. The location is scanned instead of reading %s until the next backup "+
+			"rebuilds it", backupManifestIndex)
+	}
 	glog.Infof("Backup completed OK.")
 	return nil
 }
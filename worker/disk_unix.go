@@ -1,5 +1,7 @@
+// +build !windows
+
 /*
- * Copyright 2017-2018 Dgraph Labs, Inc. and Contributors
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -16,23 +18,17 @@
 
 package worker
 
-import "github.com/dgraph-io/dgraph/types"
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
 
-func couldApplyAggregatorOn(agrtr string, typ types.TypeID) bool {
-	if !typ.IsScalar() {
-		return false
-	}
-	switch agrtr {
-	case "min", "max":
-		return (typ == types.IntID ||
-			typ == types.FloatID ||
-			typ == types.DateTimeID ||
-			typ == types.StringID ||
-			typ == types.DefaultID)
-	case "sum", "avg":
-		return (typ == types.IntID ||
-			typ == types.FloatID)
-	default:
-		return false
+// diskSpace returns the number of bytes available to this process in the disk of the given
+// directory.
+func diskSpace(dir string) (uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, errors.Wrapf(err, "cannot get the disk space of %s", dir)
 	}
+	return st.Bavail * uint64(st.Bsize), nil
 }
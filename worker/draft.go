@@ -290,12 +290,14 @@ func (n *node) applyMutations(ctx context.Context, proposal *pb.Proposal) (rerr
 	if proposal.Mutations.DropOp == pb.Mutations_DATA {
 		// Ensures nothing get written to disk due to commit proposals.
 		posting.Oracle().ResetTxns()
+		resetGroupRestore()
 		return posting.DeleteData()
 	}
 
 	if proposal.Mutations.DropOp == pb.Mutations_ALL {
 		// Ensures nothing get written to disk due to commit proposals.
 		posting.Oracle().ResetTxns()
+		resetGroupRestore()
 		schema.State().DeleteAll()
 
 		if err := posting.DeleteAll(); err != nil {
@@ -381,6 +383,7 @@ func (n *node) applyMutations(ctx context.Context, proposal *pb.Proposal) (rerr
 				return err
 			}
 			span.Annotatef(nil, "Deleting predicate: %s", edge.Attr)
+			resetGroupRestore()
 			return posting.DeletePredicate(ctx, edge.Attr)
 		}
 		// Don't derive schema when doing deletion.
@@ -566,6 +569,9 @@ func (n *node) applyCommitted(proposal *pb.Proposal) error {
 		n.elog.Printf("Creating snapshot: %+v", snap)
 		glog.Infof("Creating snapshot at index: %d. ReadTs: %d.\n", snap.Index, snap.ReadTs)
 
+		// The state of the restores applied by the group isn't kept in the data, so it's
+		// saved with the snapshot.
+		saveRestoreState(snap)
 		data, err := snap.Marshal()
 		x.Check(err)
 		for {
@@ -604,6 +610,22 @@ func (n *node) applyCommitted(proposal *pb.Proposal) error {
 				{StartTs: ts, CommitTs: ts},
 			},
 		})
+
+	case proposal.CancelRestore != nil:
+		// Undoing a restore changes all the data, like the restore itself.
+		x.UpdateDrainingMode(true)
+		defer x.UpdateDrainingMode(false)
+
+		// The cancellation must be applied by all the replicas, so it waits for the task of
+		// the restore it cancels to be removed instead of failing.
+		closer, err := n.startTask(opRestore)
+		for err != nil {
+			time.Sleep(100 * time.Millisecond)
+			closer, err = n.startTask(opRestore)
+		}
+		defer closer.Done()
+
+		return handleCancelRestoreProposal(ctx, proposal.CancelRestore)
 	}
 	x.Fatalf("Unknown proposal: %+v", proposal)
 	return nil
@@ -1095,6 +1117,7 @@ func (n *node) Run() {
 						glog.Errorf("While retrieving snapshot, error: %v. Retrying...", err)
 						time.Sleep(100 * time.Millisecond) // Wait for a bit.
 					}
+					loadRestoreState(&snap)
 					glog.Infof("---> SNAPSHOT: %+v. Group %d. DONE.\n", snap, n.gid)
 
 					// Set node to healthy state here.
@@ -1591,6 +1614,10 @@ func (n *node) InitAndStartNode() {
 			// zero-member Raft group.
 			n.SetConfState(&sp.Metadata.ConfState)
 
+			var snap pb.Snapshot
+			x.Check(snap.Unmarshal(sp.Data))
+			loadRestoreState(&snap)
+
 			members := groups().members(n.gid)
 			for _, id := range sp.Metadata.ConfState.Nodes {
 				m, ok := members[id]
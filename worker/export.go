@@ -278,6 +278,15 @@ func (e *exporter) toRDF() (*bpb.KVList, error) {
 }
 
 func toSchema(attr string, update *pb.SchemaUpdate) (*bpb.KVList, error) {
+	kv := &bpb.KV{
+		Value:   []byte(schemaString(attr, update)),
+		Version: 2, // Schema value
+	}
+	return listWrap(kv), nil
+}
+
+// schemaString returns the schema of the predicate in the format used by alter operations.
+func schemaString(attr string, update *pb.SchemaUpdate) string {
 	// bytes.Buffer never returns error for any of the writes. So, we don't need to check them.
 	var buf bytes.Buffer
 	x.Check2(buf.WriteRune('<'))
@@ -309,11 +318,7 @@ func toSchema(attr string, update *pb.SchemaUpdate) (*bpb.KVList, error) {
 		x.Check2(buf.WriteString(" @upsert"))
 	}
 	x.Check2(buf.WriteString(" . \n"))
-	kv := &bpb.KV{
-		Value:   buf.Bytes(),
-		Version: 2, // Schema value
-	}
-	return listWrap(kv), nil
+	return buf.String()
 }
 
 func toType(attr string, update pb.TypeUpdate) (*bpb.KVList, error) {
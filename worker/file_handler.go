@@ -15,6 +15,7 @@ package worker
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
@@ -113,33 +114,13 @@ func (h *fileHandler) GetManifests(uri *url.URL, backupId string) ([]*Manifest,
 	if !pathExist(uri.Path) {
 		return nil, errors.Errorf("The path %q does not exist or it is inaccessible.", uri.Path)
 	}
-
-	suffix := filepath.Join(string(filepath.Separator), backupManifest)
-	paths := x.WalkPathFunc(uri.Path, func(path string, isdir bool) bool {
-		return !isdir && strings.HasSuffix(path, suffix)
-	})
-	if len(paths) == 0 {
-		return nil, errors.Errorf("No manifests found at path: %s", uri.Path)
-	}
-	sort.Strings(paths)
-
-	// Read and filter the files to get the list of files to consider for this restore operation.
-
-	var manifests []*Manifest
-	for _, path := range paths {
-		var m Manifest
-		if err := h.readManifest(path, &m); err != nil {
-			return nil, errors.Wrapf(err, "While reading %q", path)
-		}
-		m.Path = path
-		manifests = append(manifests, &m)
-	}
-	manifests, err := filterManifests(manifests, backupId)
+	uri, err := h.extractedURI(uri)
 	if err != nil {
 		return nil, err
 	}
 
-	return manifests, nil
+	// Read and filter the files to get the list of files to consider for this restore operation.
+	return seriesManifests(h, uri, backupId)
 }
 
 // Load uses tries to load any backup files found.
@@ -173,7 +154,7 @@ func (h *fileHandler) Load(uri *url.URL, backupId string, fn loadFn) LoadResult
 			// of the last backup.
 			predSet := manifests[len(manifests)-1].getPredsInGroup(gid)
 
-			groupMaxUid, err := fn(fp, int(gid), predSet)
+			groupMaxUid, err := fn(fp, int(gid), predSet, manifest)
 			if err != nil {
 				return LoadResult{0, 0, err}
 			}
@@ -187,6 +168,41 @@ func (h *fileHandler) Load(uri *url.URL, backupId string, fn loadFn) LoadResult
 	return LoadResult{since, maxUid, nil}
 }
 
+// Size returns the total size of the backup files that would be loaded.
+func (h *fileHandler) Size(uri *url.URL, backupId string) (int64, error) {
+	manifests, err := h.GetManifests(uri, backupId)
+	if err != nil {
+		return 0, errors.Wrapf(err, "cannot retrieve manifests")
+	}
+
+	var size int64
+	for _, manifest := range manifests {
+		if manifest.Since == 0 || len(manifest.Groups) == 0 {
+			continue
+		}
+
+		path := filepath.Dir(manifest.Path)
+		for gid := range manifest.Groups {
+			file := filepath.Join(path, backupName(manifest.Since, gid))
+			fi, err := os.Stat(file)
+			if err != nil {
+				return 0, errors.Wrapf(err, "Failed to stat %q", file)
+			}
+			size += fi.Size()
+		}
+	}
+	return size, nil
+}
+
+// OpenBackupFile opens the backup file at the given path.
+func (h *fileHandler) OpenBackupFile(uri *url.URL, path string) (io.ReadCloser, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to open %q", path)
+	}
+	return fp, nil
+}
+
 // Verify performs basic checks to decide whether the specified backup can be restored
 // to a live cluster.
 func (h *fileHandler) Verify(uri *url.URL, backupId string, currentGroups []uint32) error {
@@ -207,6 +223,10 @@ func (h *fileHandler) ListManifests(uri *url.URL) ([]string, error) {
 	if !pathExist(uri.Path) {
 		return nil, errors.Errorf("The path %q does not exist or it is inaccessible.", uri.Path)
 	}
+	uri, err := h.extractedURI(uri)
+	if err != nil {
+		return nil, err
+	}
 
 	suffix := filepath.Join(string(filepath.Separator), backupManifest)
 	manifests := x.WalkPathFunc(uri.Path, func(path string, isdir bool) bool {
@@ -223,6 +243,66 @@ func (h *fileHandler) ReadManifest(path string, m *Manifest) error {
 	return h.readManifest(path, m)
 }
 
+// ReadManifestIndex reads the index of the manifests at the root of the location. The paths of
+// the index are relative to the location, so the manifests of an archive are listed by
+// scanning the directory it's extracted into instead.
+func (h *fileHandler) ReadManifestIndex(uri *url.URL) ([]byte, error) {
+	if isBackupArchive(uri.Path) {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(uri.Path, backupManifestIndex))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return b, err
+}
+
+// WriteManifestIndex writes the index of the manifests at the root of the location. It's
+// written to a temporary file that replaces the index, so that a failed write doesn't leave
+// a partial index behind.
+func (h *fileHandler) WriteManifestIndex(uri *url.URL, b []byte) error {
+	path := filepath.Join(uri.Path, backupManifestIndex)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ReadLatestManifest reads the path of the manifest of the latest backup from the root of the
+// location.
+func (h *fileHandler) ReadLatestManifest(uri *url.URL) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(uri.Path, backupLatestManifest))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(b), err
+}
+
+// WriteLatestManifest writes the path of the manifest of the latest backup at the root of the
+// location, replacing the previous one at once like the index.
+func (h *fileHandler) WriteLatestManifest(uri *url.URL, path string) error {
+	dst := filepath.Join(uri.Path, backupLatestManifest)
+	tmp := dst + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(path), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// WriteFile writes b to the file at the path of the URI, creating its directory if needed. The
+// file is replaced at once, so that it's never left half written.
+func (h *fileHandler) WriteFile(uri *url.URL, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(uri.Path), 0700); err != nil {
+		return err
+	}
+	tmp := uri.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, uri.Path)
+}
+
 func (h *fileHandler) Close() error {
 	if h.fp == nil {
 		return nil
@@ -239,6 +319,21 @@ func (h *fileHandler) Write(b []byte) (int, error) {
 	return h.fp.Write(b)
 }
 
+// extractedURI returns the URI of the directory the backup archive at the given URI is
+// extracted into, or the URI itself if it's not an archive.
+func (h *fileHandler) extractedURI(uri *url.URL) (*url.URL, error) {
+	if !isBackupArchive(uri.Path) {
+		return uri, nil
+	}
+	dir, err := backupArchiveDir(uri.Path)
+	if err != nil {
+		return nil, err
+	}
+	extracted := *uri
+	extracted.Path = dir
+	return &extracted, nil
+}
+
 // pathExist checks if a path (file or dir) is found at target.
 // Returns true if found, false otherwise.
 func pathExist(path string) bool {
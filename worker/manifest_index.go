@@ -0,0 +1,227 @@
+// +build !oss
+
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Dgraph Community License (the "License"); you
+ * may not use this file except in compliance with the License. You
+ * may obtain a copy of the License at
+ *
+ *     https://github.com/dgraph-io/dgraph/blob/master/licenses/DCL.txt
+ */
+
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+
+	"github.com/dgraph-io/dgraph/protos/pb"
+)
+
+// manifestIndex is the content of the index of the manifests of a backup location.
+type manifestIndex struct {
+	Manifests []manifestIndexEntry `json:"manifests"`
+}
+
+// manifestIndexEntry is a manifest listed in the index along with its path.
+type manifestIndexEntry struct {
+	// Path is the path of the manifest relative to the location, so that the backups can be
+	// moved to another location along with the index.
+	Path     string    `json:"path"`
+	Manifest *Manifest `json:"manifest"`
+}
+
+// locationBase returns the path that the paths of the manifests at the location start with,
+// i.e. the directory of the location, or the prefix of the objects of a bucket.
+func locationBase(uri *url.URL) string {
+	switch uri.Scheme {
+	case "minio", "s3":
+		parts := strings.Split(strings.TrimPrefix(uri.Path, "/"), "/")
+		return filepath.Join(parts[1:]...)
+	}
+	return uri.Path
+}
+
+// readManifests returns the manifests at the location ordered by path. They're read from the
+// index of the location if it has an up to date one, and otherwise from the manifests found by
+// scanning it.
+func readManifests(h UriHandler, uri *url.URL) ([]*Manifest, error) {
+	manifests, err := readCurrentManifestIndex(h, uri)
+	if err != nil {
+		glog.Warningf("Cannot use the manifest index at %s. Scanning the location "+
+			"instead: %v", uri, err)
+	}
+	if err == nil && manifests != nil {
+		return manifests, nil
+	}
+	return scanManifests(h, uri)
+}
+
+// scanManifests reads all the manifests found at the location, ordered by path.
+func scanManifests(h UriHandler, uri *url.URL) ([]*Manifest, error) {
+	paths, err := h.ListManifests(uri)
+	if err != nil {
+		return nil, err
+	}
+	manifests := make([]*Manifest, 0, len(paths))
+	for _, path := range paths {
+		var m Manifest
+		if err := h.ReadManifest(path, &m); err != nil {
+			return nil, errors.Wrapf(err, "While reading %q", path)
+		}
+		m.Path = path
+		manifests = append(manifests, &m)
+	}
+	return manifests, nil
+}
+
+// readManifestIndex returns the manifests listed in the index of the location, ordered by
+// path. It returns nil if the location has no index.
+func readManifestIndex(h UriHandler, uri *url.URL) ([]*Manifest, error) {
+	b, err := h.ReadManifestIndex(uri)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	var index manifestIndex
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, errors.Wrapf(err, "invalid manifest index")
+	}
+	if len(index.Manifests) == 0 {
+		return nil, errors.Errorf("the manifest index lists no manifest")
+	}
+
+	base := locationBase(uri)
+	manifests := make([]*Manifest, 0, len(index.Manifests))
+	for _, entry := range index.Manifests {
+		if entry.Manifest == nil || entry.Path == "" {
+			return nil, errors.Errorf("the manifest index has an entry without a manifest")
+		}
+		entry.Manifest.Path = filepath.Join(base, entry.Path)
+		manifests = append(manifests, entry.Manifest)
+	}
+	sort.Slice(manifests, func(i, j int) bool {
+		return manifests[i].Path < manifests[j].Path
+	})
+	return manifests, nil
+}
+
+// readCurrentManifestIndex returns the manifests listed in the index of the location, as
+// readManifestIndex does, after checking that the index lists the manifest of the latest
+// backup recorded at the location. As it's recorded before the manifest is written, an index
+// that doesn't list it is out of date, e.g. because it couldn't be updated after a backup, and
+// an error is returned. Only the path of the latest manifest is read, so the location isn't
+// listed.
+func readCurrentManifestIndex(h UriHandler, uri *url.URL) ([]*Manifest, error) {
+	manifests, err := readManifestIndex(h, uri)
+	if err != nil || manifests == nil {
+		return manifests, err
+	}
+	latest, err := h.ReadLatestManifest(uri)
+	if err != nil {
+		return nil, err
+	}
+	if latest == "" {
+		return nil, errors.Errorf("the latest backup isn't recorded in %s",
+			backupLatestManifest)
+	}
+	latest = filepath.Clean(filepath.Join(locationBase(uri), latest))
+	for _, m := range manifests {
+		if filepath.Clean(m.Path) == latest {
+			return manifests, nil
+		}
+	}
+	return nil, errors.Errorf("the manifest index doesn't list %s", latest)
+}
+
+// seriesManifests returns the manifests of the backups to restore for the given series, as
+// filterManifests does. If the index of the location is out of date, or the manifests it lists
+// don't form a valid series, all the manifests found by scanning the location are used instead.
+func seriesManifests(h UriHandler, uri *url.URL, backupId string) ([]*Manifest, error) {
+	manifests, err := readCurrentManifestIndex(h, uri)
+	if err != nil {
+		glog.Warningf("Cannot use the manifest index at %s. Scanning the location "+
+			"instead: %v", uri, err)
+	}
+	if err == nil && manifests != nil {
+		filtered, err := filterManifests(manifests, backupId)
+		if err == nil {
+			return filtered, nil
+		}
+		glog.Warningf("The manifest index at %s is out of date. Scanning the location "+
+			"instead: %v", uri, err)
+	}
+
+	if manifests, err = scanManifests(h, uri); err != nil {
+		return nil, err
+	}
+	return filterManifests(manifests, backupId)
+}
+
+// markLatestManifest records the manifest of the backup written for req as the latest one at
+// the location. It's called before the manifest is written, so that an index that isn't updated
+// once it's written is known to be out of date. It returns the manifests of the index if it was
+// up to date until then, or nil if it must be rebuilt.
+func markLatestManifest(h UriHandler, uri *url.URL, req *pb.BackupRequest) ([]*Manifest, error) {
+	indexed, err := readCurrentManifestIndex(h, uri)
+	if err != nil {
+		glog.Warningf("Cannot use the manifest index at %s. Rebuilding it: %v", uri, err)
+		indexed = nil
+	}
+	path := filepath.Join(fmt.Sprintf(backupPathFmt, req.UnixTs), backupManifest)
+	if err := h.WriteLatestManifest(uri, path); err != nil {
+		return nil, errors.Wrapf(err, "cannot record the latest backup")
+	}
+	return indexed, nil
+}
+
+// updateManifestIndex adds the manifest of the backup written for req to the index of the
+// location, whose manifests were returned by markLatestManifest. If they're nil, the index is
+// built from all the manifests found by scanning the location, which include the new one.
+func updateManifestIndex(h UriHandler, uri *url.URL, req *pb.BackupRequest, manifest *Manifest,
+	indexed []*Manifest) error {
+	base := locationBase(uri)
+	path := filepath.Join(base, fmt.Sprintf(backupPathFmt, req.UnixTs), backupManifest)
+	manifests := indexed
+	if manifests == nil {
+		var err error
+		if manifests, err = scanManifests(h, uri); err != nil {
+			return err
+		}
+	} else {
+		found := false
+		for _, m := range manifests {
+			found = found || m.Path == path
+		}
+		// The backup may be retried with the same directory, whose manifest is then
+		// already listed.
+		if !found {
+			manifest.Path = path
+			manifests = append(manifests, manifest)
+		}
+	}
+
+	var index manifestIndex
+	for _, m := range manifests {
+		rel, err := filepath.Rel(base, m.Path)
+		if err != nil {
+			return errors.Wrapf(err, "cannot add manifest %s to the index", m.Path)
+		}
+		index.Manifests = append(index.Manifests, manifestIndexEntry{Path: rel, Manifest: m})
+	}
+	sort.Slice(index.Manifests, func(i, j int) bool {
+		return index.Manifests[i].Path < index.Manifests[j].Path
+	})
+	b, err := json.Marshal(&index)
+	if err != nil {
+		return err
+	}
+	return h.WriteManifestIndex(uri, b)
+}
@@ -26,17 +26,53 @@ import (
 	"github.com/golang/glog"
 )
 
-func ProcessRestoreRequest(ctx context.Context, req *pb.RestoreRequest) error {
+func ProcessRestoreRequest(ctx context.Context, req *pb.RestoreRequest) (*RestoreResult, error) {
 	glog.Warningf("Restore failed: %v", x.ErrNotSupported)
-	return x.ErrNotSupported
+	return nil, x.ErrNotSupported
 }
 
 // Restore implements the Worker interface.
-func (w *grpcWorker) Restore(ctx context.Context, req *pb.RestoreRequest) (*pb.Status, error) {
+func (w *grpcWorker) Restore(ctx context.Context, req *pb.RestoreRequest) (
+	*pb.RestoreResponse, error) {
 	glog.Warningf("Restore failed: %v", x.ErrNotSupported)
+	return &pb.RestoreResponse{}, x.ErrNotSupported
+}
+
+// RestoreProgress returns the progress of the restore with the given id on this alpha.
+func RestoreProgress(restoreId string) (*pb.RestoreProgress, error) {
+	return nil, x.ErrNotSupported
+}
+
+// WatchRestore implements the Worker interface.
+func (w *grpcWorker) WatchRestore(req *pb.RestoreProgressRequest,
+	stream pb.Worker_WatchRestoreServer) error {
+	glog.Warningf("Watch restore failed: %v", x.ErrNotSupported)
+	return x.ErrNotSupported
+}
+
+// CancelRestore cancels the restore with the given id on all the alphas of the cluster.
+func CancelRestore(ctx context.Context, restoreId string) error {
+	glog.Warningf("Cancel restore failed: %v", x.ErrNotSupported)
+	return x.ErrNotSupported
+}
+
+// CancelRestore implements the Worker interface.
+func (w *grpcWorker) CancelRestore(ctx context.Context, req *pb.CancelRestoreRequest) (
+	*pb.Status, error) {
+	glog.Warningf("Cancel restore failed: %v", x.ErrNotSupported)
 	return &pb.Status{}, x.ErrNotSupported
 }
 
 func handleRestoreProposal(ctx context.Context, req *pb.RestoreRequest) error {
 	return nil
 }
+
+func resetGroupRestore() {}
+
+func saveRestoreState(snap *pb.Snapshot) {}
+
+func loadRestoreState(snap *pb.Snapshot) {}
+
+func handleCancelRestoreProposal(ctx context.Context, req *pb.CancelRestoreRequest) error {
+	return nil
+}
@@ -15,93 +15,1644 @@ package worker
 import (
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/dgraph-io/badger/v2"
+	"github.com/dgraph-io/dgo/v200/protos/api"
 	"github.com/dgraph-io/dgraph/conn"
 	"github.com/dgraph-io/dgraph/ee/enc"
 	"github.com/dgraph-io/dgraph/posting"
 	"github.com/dgraph-io/dgraph/protos/pb"
 	"github.com/dgraph-io/dgraph/schema"
+	"github.com/dgraph-io/dgraph/x"
 
+	"github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
+// restoreLock serializes the restore requests processed by this alpha.
+var restoreLock sync.Mutex
+
+// groupRestore holds the state of the restores of the group of this alpha. It's only changed
+// when the entries of the Raft log are applied, so it's the same on all the replicas of the
+// group, and it's saved in the snapshots of the group so that it survives restarts.
+var groupRestore struct {
+	sync.Mutex
+	// applied is the id of the last restore applied by the group. A request that is retried
+	// with the same id is reported as completed without ingesting the backup again.
+	applied string
+	// started is the id of the last restore started by the group, which a cancellation of the
+	// restore undoes. It's rolled back from the data saved before it started if atomic is set.
+	started string
+	atomic  bool
+	// cancelled holds the ids of the restores cancelled in the group, whose proposals are
+	// skipped.
+	cancelled map[string]struct{}
+}
+
+// restoredPreds holds the predicates restored into this group by the last restore proposal
+// applied by this alpha, so that the result can be reported once the proposal is done.
+var restoredPreds struct {
+	sync.Mutex
+	restoreTs uint64
+	preds     []string
+	// skippedIndexes holds the original schema of the predicates whose indexes were skipped.
+	skippedIndexes []*pb.SchemaUpdate
+	// skippedPreds holds the predicates that couldn't be restored when errors are skipped.
+	skippedPreds []string
+	// coercions holds the number of values converted for each coerced predicate.
+	coercions []*pb.CoercionReport
+	// compaction holds the compaction of the restored data, if it was requested.
+	compaction *pb.CompactionStats
+	// ingestions holds the time taken to ingest each restored predicate, the slowest first.
+	ingestions []*pb.PredicateIngestion
+}
+
+// defaultIngestThroughput is the ingest throughput in bytes of backup files per second used
+// to estimate the duration of a restore when none has been measured. It's on the low end of
+// the throughput of a restore so that the estimates are conservative.
+const defaultIngestThroughput = 4 << 20
+
+// ingestThroughput holds the throughput in bytes of backup files per second measured by the
+// last restore ingested by this alpha. It's zero if none has been measured yet.
+var ingestThroughput struct {
+	sync.Mutex
+	bytesPerSec float64
+}
+
+// recordIngestThroughput records the throughput of a restore that ingested size bytes of
+// backup files in the given time.
+func recordIngestThroughput(size int64, elapsed time.Duration) {
+	if size <= 0 || elapsed <= 0 {
+		return
+	}
+	ingestThroughput.Lock()
+	defer ingestThroughput.Unlock()
+	ingestThroughput.bytesPerSec = float64(size) / elapsed.Seconds()
+}
+
+// estimateRestore estimates how long it would take to ingest numFiles backup files of the
+// given total size, using the last measured throughput if there's one.
+func estimateRestore(numFiles int, size int64) *RestoreEstimate {
+	ingestThroughput.Lock()
+	throughput := ingestThroughput.bytesPerSec
+	ingestThroughput.Unlock()
+
+	estimate := &RestoreEstimate{
+		NumFiles:   numFiles,
+		Size:       size,
+		Throughput: throughput,
+		Measured:   throughput > 0,
+	}
+	if !estimate.Measured {
+		estimate.Throughput = defaultIngestThroughput
+	}
+	estimate.Duration = time.Duration(float64(size) / estimate.Throughput * float64(time.Second))
+	return estimate
+}
+
+// restoreReport is the report of a dry-run restore, written as JSON to the report path of the
+// request so that the checks of a restore can be audited before it's run. It's filled in as
+// the checks pass, so the report of a failed dry run shows how far it got along with its error.
+type restoreReport struct {
+	Time     time.Time `json:"time"`
+	Location string    `json:"location"`
+	BackupId string    `json:"backup_id,omitempty"`
+	// Valid is true if all the checks passed, i.e. the backup can be restored.
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+	// Backups holds the backups of the series that would be restored, in order.
+	Backups []reportBackup `json:"backups,omitempty"`
+	// Predicates holds the predicates of the backup and the group of the cluster each one
+	// would be restored into, ordered by name.
+	Predicates []reportPredicate `json:"predicates,omitempty"`
+	// NumPredicates is the number of predicates of the backup, and GroupPredicates the number
+	// of them restored into each group.
+	NumPredicates   int            `json:"num_predicates"`
+	GroupPredicates map[uint32]int `json:"group_predicates,omitempty"`
+	// SchemaDiff compares the predicates of the backup with those of the cluster.
+	SchemaDiff   *reportSchemaDiff   `json:"schema_diff,omitempty"`
+	Estimate     *reportEstimate     `json:"estimate,omitempty"`
+	Verification *reportVerification `json:"verification,omitempty"`
+}
+
+type reportBackup struct {
+	BackupNum uint64 `json:"backup_num"`
+	Type      string `json:"type"`
+	Since     uint64 `json:"since"`
+	Path      string `json:"path"`
+	Size      uint64 `json:"size,omitempty"`
+	Encrypted bool   `json:"encrypted"`
+	Version   int    `json:"version"`
+}
+
+type reportPredicate struct {
+	Predicate string `json:"predicate"`
+	Group     uint32 `json:"group"`
+}
+
+// reportSchemaDiff holds the predicates that a restore would add to the cluster, and those of
+// the cluster that it would drop since the backup doesn't have them. The reserved predicates
+// aren't compared.
+type reportSchemaDiff struct {
+	Added   []string `json:"added"`
+	Dropped []string `json:"dropped"`
+}
+
+type reportEstimate struct {
+	NumFiles           int     `json:"num_files"`
+	Size               int64   `json:"size"`
+	Throughput         float64 `json:"throughput"`
+	MeasuredThroughput bool    `json:"measured_throughput"`
+	EstimatedDuration  float64 `json:"estimated_duration_seconds"`
+}
+
+type reportVerification struct {
+	FilesVerified int     `json:"files_verified"`
+	Duration      float64 `json:"duration_seconds"`
+}
+
+func newRestoreReport(req *pb.RestoreRequest) *restoreReport {
+	return &restoreReport{
+		Time:     time.Now().UTC(),
+		Location: req.Location,
+		BackupId: req.BackupId,
+	}
+}
+
+// setBackup records the backups of the series that would be restored, the last of which has
+// the predicates that are restored, and compares them with the predicates of the cluster in
+// the given membership state.
+func (r *restoreReport) setBackup(manifests []*Manifest, state *pb.MembershipState) {
+	r.Backups = r.Backups[:0]
+	for _, m := range manifests {
+		r.Backups = append(r.Backups, reportBackup{
+			BackupNum: m.BackupNum,
+			Type:      m.Type,
+			Since:     m.Since,
+			Path:      m.Path,
+			Size:      m.Size,
+			Encrypted: m.Encrypted,
+			Version:   m.Version,
+		})
+	}
+
+	predGroups := restoreGroupMap(manifests[len(manifests)-1], state)
+	r.Predicates = r.Predicates[:0]
+	r.GroupPredicates = make(map[uint32]int)
+	diff := &reportSchemaDiff{Added: []string{}, Dropped: []string{}}
+	for pred, gid := range predGroups {
+		r.Predicates = append(r.Predicates, reportPredicate{Predicate: pred, Group: gid})
+		r.GroupPredicates[gid]++
+	}
+	sort.Slice(r.Predicates, func(i, j int) bool {
+		return r.Predicates[i].Predicate < r.Predicates[j].Predicate
+	})
+	r.NumPredicates = len(r.Predicates)
+
+	clusterPreds := make(predicateSet)
+	for _, group := range state.GetGroups() {
+		for pred := range group.GetTablets() {
+			clusterPreds[pred] = struct{}{}
+			if _, ok := predGroups[pred]; !ok && !x.IsReservedPredicate(pred) {
+				diff.Dropped = append(diff.Dropped, pred)
+			}
+		}
+	}
+	for pred := range predGroups {
+		if _, ok := clusterPreds[pred]; !ok && !x.IsReservedPredicate(pred) {
+			diff.Added = append(diff.Added, pred)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Dropped)
+	r.SchemaDiff = diff
+}
+
+func (r *restoreReport) setEstimate(estimate *RestoreEstimate) {
+	r.Estimate = &reportEstimate{
+		NumFiles:           estimate.NumFiles,
+		Size:               estimate.Size,
+		Throughput:         estimate.Throughput,
+		MeasuredThroughput: estimate.Measured,
+		EstimatedDuration:  estimate.Duration.Seconds(),
+	}
+}
+
+func (r *restoreReport) setVerification(v *RestoreVerification) {
+	r.Verification = &reportVerification{
+		FilesVerified: v.FilesVerified,
+		Duration:      v.Duration.Seconds(),
+	}
+}
+
+// writeRestoreReport writes the report of a dry run to the report path of the request, which
+// can be a file or an object in a bucket like the location of a backup. dryRunErr is the error
+// the dry run failed with, if any.
+func writeRestoreReport(req *pb.RestoreRequest, report *restoreReport, dryRunErr error) error {
+	report.Valid = dryRunErr == nil
+	if dryRunErr != nil {
+		report.Error = dryRunErr.Error()
+	}
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "cannot encode the restore report")
+	}
+	uri, err := url.Parse(req.ReportPath)
+	if err != nil {
+		return errors.Wrapf(err, "cannot parse the report path")
+	}
+	creds := restoreCredentials(req)
+	handler, err := NewUriHandler(uri, creds)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create handler for the report path")
+	}
+	if err := handler.WriteFile(uri, b); err != nil {
+		return errors.Wrapf(err, "cannot write the restore report to %s", req.ReportPath)
+	}
+	return nil
+}
+
+// restoreDryRun verifies that the backup can be restored to the cluster and estimates how
+// long the restore would take. No data is changed. The checks that pass are recorded in the
+// report.
+func restoreDryRun(ctx context.Context, req *pb.RestoreRequest,
+	report *restoreReport) (*RestoreResult, error) {
+	if err := UpdateMembershipState(ctx); err != nil {
+		return nil, errors.Wrapf(err, "cannot update membership state before restore")
+	}
+	var currentGroups []uint32
+	for gid := range GetMembershipState().GetGroups() {
+		currentGroups = append(currentGroups, gid)
+	}
+
+	creds := restoreCredentials(req)
+	if err := VerifyBackup(req.Location, req.BackupId, creds, currentGroups); err != nil {
+		return nil, errors.Wrapf(err, "failed to verify backup")
+	}
+
+	uri, err := url.Parse(req.Location)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse backup location")
+	}
+	handler, err := NewUriHandler(uri, creds)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot create backup handler")
+	}
+	manifests, err := handler.GetManifests(uri, req.BackupId)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot get backup manifests")
+	}
+	if len(manifests) == 0 {
+		return nil, errors.Errorf("no backup manifests found at location %s", req.Location)
+	}
+	report.setBackup(manifests, GetMembershipState())
+	if err := checkPredicateCount(req, manifests[len(manifests)-1]); err != nil {
+		return nil, err
+	}
+	if req.ReplayWal != "" {
+		key, err := restoreEncKey(req)
+		if err != nil {
+			return nil, err
+		}
+		since := manifests[len(manifests)-1].Since
+		if _, err := readWALTxns(req.ReplayWal, key, since); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkUidOffset(req, GetMembershipState().GetMaxLeaseId()); err != nil {
+		return nil, err
+	}
+	size, err := handler.Size(uri, req.BackupId)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot get the size of the backup")
+	}
+	result := &RestoreResult{Estimate: estimateRestore(numBackupFiles(manifests), size)}
+	report.setEstimate(result.Estimate)
+	if req.VerifyChecksums {
+		key, err := restoreEncKey(req)
+		if err != nil {
+			return nil, err
+		}
+		concurrency := int(req.VerifyConcurrency)
+		if concurrency == 0 {
+			concurrency = runtime.NumCPU()
+		}
+		result.Verification, err = verifyBackupFiles(ctx, handler, uri,
+			backupFilePaths(manifests), backupFileAlgorithms(manifests), key, concurrency)
+		if err != nil {
+			return nil, err
+		}
+		report.setVerification(result.Verification)
+	}
+	return result, nil
+}
+
+// checkPredicateCount returns an error if the backup described by the given manifest has fewer
+// predicates than the minimum expected by the request. The reserved predicates aren't counted,
+// as even an empty backup has them. This guards against restoring the wrong backup, e.g. an
+// empty one, onto a cluster with data.
+func checkPredicateCount(req *pb.RestoreRequest, manifest *Manifest) error {
+	if req.MinExpectedPredicates == 0 {
+		return nil
+	}
+	var count int
+	for _, preds := range manifest.Groups {
+		for _, pred := range preds {
+			if !x.IsReservedPredicate(pred) {
+				count++
+			}
+		}
+	}
+	if count < int(req.MinExpectedPredicates) {
+		return errors.Errorf("backup at %s has %d predicates, fewer than the %d expected. "+
+			"Aborting the restore", req.Location, count, req.MinExpectedPredicates)
+	}
+	return nil
+}
+
+// checkUidOffset returns an error if the uids shifted by the uid offset of the request could
+// collide with the uids already leased, which are at most maxLeased. The restored uids are at
+// least one more than the offset, so they can't collide if it's at least maxLeased.
+func checkUidOffset(req *pb.RestoreRequest, maxLeased uint64) error {
+	if req.UidOffset == 0 || req.UidOffset >= maxLeased {
+		return nil
+	}
+	return errors.Errorf("uid offset %#x is below the uids leased up to %#x, so the restored "+
+		"uids could collide with the existing ones. Use an offset of at least %#x",
+		req.UidOffset, maxLeased, maxLeased)
+}
+
+// restoreLocation returns the location to restore the backup from. The location of the request
+// can be a comma-separated list of locations holding copies of the backup, which are tried in
+// order. The first one whose manifests can be read is used, so that a restore can fall back to
+// another copy when the primary location is unreachable. If the location is a backup archive,
+// it's held until the returned function is called.
+func restoreLocation(req *pb.RestoreRequest) (string, func(), error) {
+	creds := restoreCredentials(req)
+	var locations []string
+	for _, location := range strings.Split(req.Location, ",") {
+		if location = strings.TrimSpace(location); location != "" {
+			locations = append(locations, location)
+		}
+	}
+	if len(locations) == 0 {
+		return "", nil, errors.Errorf("no location given for the restore")
+	}
+	if len(locations) == 1 {
+		release, err := acquireBackupArchive(locations[0])
+		if err != nil {
+			return "", nil, err
+		}
+		return locations[0], release, nil
+	}
+
+	var errs []string
+	for _, location := range locations {
+		release, err := acquireBackupArchive(location)
+		if err == nil {
+			if err = checkRestoreLocation(location, req.BackupId, creds); err == nil {
+				return location, release, nil
+			}
+			release()
+		}
+		glog.Warningf("Cannot restore from location %s, trying the next one: %v", location, err)
+		errs = append(errs, fmt.Sprintf("%s: %v", location, err))
+	}
+	return "", nil, errors.Errorf("cannot restore from any of the locations: %s",
+		strings.Join(errs, "; "))
+}
+
+// checkRestoreLocation returns an error if the manifests of the backup can't be read from the
+// given location.
+func checkRestoreLocation(location, backupId string, creds *Credentials) error {
+	uri, err := url.Parse(location)
+	if err != nil {
+		return errors.Wrapf(err, "cannot parse backup location")
+	}
+	handler, err := NewUriHandler(uri, creds)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create backup handler")
+	}
+	manifests, err := handler.GetManifests(uri, backupId)
+	if err != nil {
+		return errors.Wrapf(err, "cannot get backup manifests")
+	}
+	if len(manifests) == 0 {
+		return errors.Errorf("no backup manifests found")
+	}
+	return nil
+}
+
+// parsePostRestoreSchema parses the schema to alter after the restore, so that an invalid
+// schema fails the restore before any data is changed. Like an alter, it can't change the
+// reserved predicates and types, except that the pre-defined predicates can be given unchanged.
+// It returns nil if the request has no such schema.
+func parsePostRestoreSchema(req *pb.RestoreRequest) (*schema.ParsedSchema, error) {
+	if req.PostRestoreSchema == "" {
+		return nil, nil
+	}
+	result, err := schema.Parse(req.PostRestoreSchema)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid post-restore schema")
+	}
+	for _, update := range result.Preds {
+		if schema.IsPreDefinedPredicateChanged(update.Predicate, update) ||
+			(x.IsReservedPredicate(update.Predicate) &&
+				!x.IsPreDefinedPredicate(update.Predicate)) {
+			return nil, errors.Errorf("the post-restore schema can't alter the reserved "+
+				"predicate %s", update.Predicate)
+		}
+	}
+	for _, typ := range result.Types {
+		if x.IsReservedType(typ.TypeName) {
+			return nil, errors.Errorf("the post-restore schema can't alter the reserved type %s",
+				typ.TypeName)
+		}
+	}
+	return result, nil
+}
+
+// applyPostRestoreSchema alters the schema of the restored cluster with the post-restore
+// schema of the request and waits until the indexes it adds are built, so that they can be
+// used as soon as the restore completes.
+func applyPostRestoreSchema(ctx context.Context, req *pb.RestoreRequest) error {
+	result, err := parsePostRestoreSchema(req)
+	if err != nil {
+		return err
+	}
+	m := &pb.Mutations{
+		StartTs: State.GetTimestamp(false),
+		Schema:  result.Preds,
+		Types:   result.Types,
+	}
+	if _, err := MutateOverNetwork(ctx, m); err != nil {
+		return err
+	}
+	for schema.State().IndexingInProgress() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	return nil
+}
+
+// defaultRestoreId returns the id of a restore sent without one. It's derived from the
+// location, the backup id and the number of the last backup of the series, so that a request
+// retried as is is recognized as the restore already applied, while restoring a newer backup
+// of the same series isn't.
+func defaultRestoreId(req *pb.RestoreRequest, bulkDirs []string) (string, error) {
+	// The output of the bulk loader isn't a series of backups.
+	var backupNum uint64
+	if len(bulkDirs) == 0 {
+		uri, err := url.Parse(req.Location)
+		if err != nil {
+			return "", errors.Wrapf(err, "cannot parse backup location")
+		}
+		handler, err := NewUriHandler(uri, restoreCredentials(req))
+		if err != nil {
+			return "", errors.Wrapf(err, "cannot create backup handler")
+		}
+		manifests, err := handler.GetManifests(uri, req.BackupId)
+		if err != nil {
+			return "", errors.Wrapf(err, "cannot get backup manifests")
+		}
+		if len(manifests) == 0 {
+			return "", errors.Errorf("no backup manifests found at location %s", req.Location)
+		}
+		backupNum = manifests[len(manifests)-1].BackupNum
+	}
+	// The location is hashed as it can hold credentials, e.g. in the query of an S3 URL.
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%d", req.Location, req.BackupId, backupNum)
+	return "restore-" + hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// restoreApplied returns whether the restore with the given id is the last one applied by the
+// group of this alpha.
+func restoreApplied(restoreId string) bool {
+	groupRestore.Lock()
+	defer groupRestore.Unlock()
+	return restoreId != "" && groupRestore.applied == restoreId
+}
+
+// restoreCancelledInGroup returns whether the group of this alpha applied the cancellation of
+// the restore with the given id.
+func restoreCancelledInGroup(restoreId string) bool {
+	groupRestore.Lock()
+	defer groupRestore.Unlock()
+	_, ok := groupRestore.cancelled[restoreId]
+	return ok
+}
+
+// resetGroupRestore forgets the last restore applied by the group. It's called when data is
+// dropped so that restoring the same backup again ingests it, and the data saved to roll the
+// restore back is removed as it no longer matches the data of the group.
+func resetGroupRestore() {
+	groupRestore.Lock()
+	defer groupRestore.Unlock()
+	groupRestore.applied = ""
+	groupRestore.started = ""
+	groupRestore.atomic = false
+	if err := os.Remove(rollbackPath()); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("Cannot remove the data saved to roll back a restore: %v", err)
+	}
+}
+
+// saveRestoreState records the restore state of the group in a snapshot that is being created.
+func saveRestoreState(snap *pb.Snapshot) {
+	groupRestore.Lock()
+	defer groupRestore.Unlock()
+	snap.RestoreId = groupRestore.applied
+	snap.StartedRestore = groupRestore.started
+	snap.AtomicRestore = groupRestore.atomic
+	snap.CancelledRestores = snap.CancelledRestores[:0]
+	for id := range groupRestore.cancelled {
+		snap.CancelledRestores = append(snap.CancelledRestores, id)
+	}
+	sort.Strings(snap.CancelledRestores)
+}
+
+// loadRestoreState sets the restore state of the group from its snapshot, when the alpha
+// restarts or receives the snapshot from the leader.
+func loadRestoreState(snap *pb.Snapshot) {
+	groupRestore.Lock()
+	defer groupRestore.Unlock()
+	groupRestore.applied = snap.GetRestoreId()
+	groupRestore.started = snap.GetStartedRestore()
+	groupRestore.atomic = snap.GetAtomicRestore()
+	groupRestore.cancelled = make(map[string]struct{}, len(snap.GetCancelledRestores()))
+	for _, id := range snap.GetCancelledRestores() {
+		groupRestore.cancelled[id] = struct{}{}
+	}
+}
+
+// restoreProgressTracker keeps the progress of a restore on this alpha, either because the
+// alpha processes the request or because its group applies the restore.
+type restoreProgressTracker struct {
+	sync.Mutex
+	// progress is replaced on every update, so it can be read after releasing the lock.
+	progress *pb.RestoreProgress
+	// updated is closed and replaced on every update, to wake up the streams watching the
+	// progress.
+	updated chan struct{}
+	// coordinated is set if this alpha processes the request, in which case the progress is
+	// finished once all the groups are done instead of when the group of this alpha is.
+	coordinated bool
+}
+
+// maxRestoreProgresses is the number of restores whose progress is kept by an alpha.
+const maxRestoreProgresses = 16
+
+// restoreProgresses holds the progress of the last restores seen by this alpha by restore id,
+// so that the progress of a restore is never mixed up with the one of an earlier restore.
+var restoreProgresses struct {
+	sync.Mutex
+	trackers map[string]*restoreProgressTracker
+	// ids holds the ids of the restores, the oldest first.
+	ids []string
+}
+
+// startRestoreProgress starts tracking the progress of the restore with the given id, replacing
+// the progress of an earlier restore with the same id.
+func startRestoreProgress(restoreId string, coordinated bool) *restoreProgressTracker {
+	t := &restoreProgressTracker{
+		progress: &pb.RestoreProgress{Phase: "verifying", RestoreId: restoreId,
+			Status: "RUNNING"},
+		updated:     make(chan struct{}),
+		coordinated: coordinated,
+	}
+	restoreProgresses.Lock()
+	defer restoreProgresses.Unlock()
+	if restoreProgresses.trackers == nil {
+		restoreProgresses.trackers = make(map[string]*restoreProgressTracker)
+	}
+	if _, ok := restoreProgresses.trackers[restoreId]; ok {
+		for i, id := range restoreProgresses.ids {
+			if id == restoreId {
+				restoreProgresses.ids = append(restoreProgresses.ids[:i],
+					restoreProgresses.ids[i+1:]...)
+				break
+			}
+		}
+	}
+	restoreProgresses.trackers[restoreId] = t
+	restoreProgresses.ids = append(restoreProgresses.ids, restoreId)
+	if len(restoreProgresses.ids) > maxRestoreProgresses {
+		delete(restoreProgresses.trackers, restoreProgresses.ids[0])
+		restoreProgresses.ids = restoreProgresses.ids[1:]
+	}
+	return t
+}
+
+// restoreProgressOf returns the tracker of the progress of the restore with the given id. The
+// progress of a restore that isn't tracked is discarded.
+func restoreProgressOf(restoreId string) *restoreProgressTracker {
+	restoreProgresses.Lock()
+	t, ok := restoreProgresses.trackers[restoreId]
+	restoreProgresses.Unlock()
+	if !ok {
+		return &restoreProgressTracker{progress: &pb.RestoreProgress{RestoreId: restoreId},
+			updated: make(chan struct{})}
+	}
+	return t
+}
+
+// RestoreProgress returns the progress of the restore with the given id on this alpha, or of the
+// last restore it has seen if the id is empty. The alpha that processes the request reports the
+// progress of the whole restore, and the other alphas the progress of their group.
+func RestoreProgress(restoreId string) (*pb.RestoreProgress, error) {
+	t, err := trackedRestoreProgress(restoreId)
+	if err != nil {
+		return nil, err
+	}
+	return t.get(), nil
+}
+
+// WatchRestore streams the progress of the restore with the given id on this alpha, or of the
+// last restore it has seen if the id is empty. The progress is sent right away and then every
+// time it changes, until the restore is done or the client closes the stream. The changes made
+// while an update is being sent are sent at once.
+func (w *grpcWorker) WatchRestore(req *pb.RestoreProgressRequest,
+	stream pb.Worker_WatchRestoreServer) error {
+	t, err := trackedRestoreProgress(req.GetRestoreId())
+	if err != nil {
+		return err
+	}
+	for {
+		progress, updated := t.watch()
+		if err := stream.Send(progress); err != nil {
+			return err
+		}
+		if progress.Done {
+			return nil
+		}
+		select {
+		case <-updated:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// trackedRestoreProgress returns the tracker of the progress of the restore with the given id,
+// or of the last restore seen by this alpha if the id is empty.
+func trackedRestoreProgress(restoreId string) (*restoreProgressTracker, error) {
+	restoreProgresses.Lock()
+	if restoreId == "" && len(restoreProgresses.ids) > 0 {
+		restoreId = restoreProgresses.ids[len(restoreProgresses.ids)-1]
+	}
+	t, ok := restoreProgresses.trackers[restoreId]
+	restoreProgresses.Unlock()
+	if !ok {
+		if restoreId == "" {
+			return nil, errors.Errorf("no restore was seen by this alpha")
+		}
+		return nil, errors.Errorf("restore %s wasn't seen by this alpha", restoreId)
+	}
+	return t, nil
+}
+
+func (t *restoreProgressTracker) update(fn func(progress *pb.RestoreProgress)) {
+	t.Lock()
+	defer t.Unlock()
+	progress := proto.Clone(t.progress).(*pb.RestoreProgress)
+	fn(progress)
+	t.progress = progress
+	close(t.updated)
+	t.updated = make(chan struct{})
+}
+
+func (t *restoreProgressTracker) get() *pb.RestoreProgress {
+	t.Lock()
+	defer t.Unlock()
+	return t.progress
+}
+
+// watch returns the current progress and a channel that's closed once it changes.
+func (t *restoreProgressTracker) watch() (*pb.RestoreProgress, <-chan struct{}) {
+	t.Lock()
+	defer t.Unlock()
+	return t.progress, t.updated
+}
+
+func (t *restoreProgressTracker) setPhase(phase string) {
+	t.update(func(progress *pb.RestoreProgress) {
+		progress.Phase = phase
+		progress.Predicate = ""
+	})
+}
+
+func (t *restoreProgressTracker) finish(err error) {
+	t.update(func(progress *pb.RestoreProgress) {
+		progress.Done = true
+		progress.Predicate = ""
+		if err != nil {
+			progress.Phase, progress.Status = "failed", "FAILED"
+			if restoreCancelled(progress.RestoreId) {
+				progress.Phase, progress.Status = "cancelled", "CANCELLED"
+			}
+			progress.Error = err.Error()
+			return
+		}
+		progress.Phase, progress.Status = "done", "SUCCESS"
+		progress.Percent = 100
+	})
+}
+
+// errRestoreCancelled is returned by a restore that stops because it was cancelled.
+var errRestoreCancelled = errors.New("the restore was cancelled")
+
+// cancelledRestores holds the ids of the restores cancelled on this alpha. It's set as soon as
+// the cancellation is received, before it's applied by the groups, so that a restore being
+// ingested stops early. The data of the groups is only changed by applying the cancellation.
+var cancelledRestores struct {
+	sync.Mutex
+	ids map[string]struct{}
+}
+
+func cancelRestoreLocally(restoreId string) {
+	cancelledRestores.Lock()
+	defer cancelledRestores.Unlock()
+	if cancelledRestores.ids == nil {
+		cancelledRestores.ids = make(map[string]struct{})
+	}
+	cancelledRestores.ids[restoreId] = struct{}{}
+}
+
+func restoreCancelled(restoreId string) bool {
+	if restoreId == "" {
+		return false
+	}
+	cancelledRestores.Lock()
+	_, ok := cancelledRestores.ids[restoreId]
+	cancelledRestores.Unlock()
+	return ok || restoreCancelledInGroup(restoreId)
+}
+
+// checkRestoreCancelled returns errRestoreCancelled if the restore was cancelled. It's called
+// between the steps of a restore, so a cancelled restore stops at the next one.
+func checkRestoreCancelled(req *pb.RestoreRequest) error {
+	if restoreCancelled(req.RestoreId) {
+		return errRestoreCancelled
+	}
+	return nil
+}
+
+// CancelRestore cancels the restore with the given id. The alphas of the cluster stop the
+// restore as soon as they receive the cancellation, and a cancellation is proposed to every
+// group so that all its replicas undo the restore the same way: a restore that wasn't started
+// is skipped, and one that was is rolled back if it's atomic, or else the data of the group is
+// dropped.
+func CancelRestore(ctx context.Context, restoreId string) error {
+	if restoreId == "" {
+		return errors.Errorf("the id of the restore to cancel can't be empty")
+	}
+	if restoreApplied(restoreId) {
+		return errors.Errorf("restore %s already completed", restoreId)
+	}
+	cancelRestoreLocally(restoreId)
+
+	var failed []string
+	for _, group := range GetMembershipState().GetGroups() {
+		for _, member := range group.GetMembers() {
+			if member.Addr == x.WorkerConfig.MyAddr {
+				continue
+			}
+			pl, err := conn.GetPools().Get(member.Addr)
+			if err == nil {
+				c := pb.NewWorkerClient(pl.Get())
+				_, err = c.CancelRestore(ctx, &pb.CancelRestoreRequest{RestoreId: restoreId})
+			}
+			if err != nil {
+				glog.Errorf("Cannot cancel restore %s on alpha %s: %v", restoreId,
+					member.Addr, err)
+				failed = append(failed, member.Addr)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		glog.Warningf("Restore %s is only cancelled on alphas %s once their groups apply "+
+			"the cancellation", restoreId, strings.Join(failed, ", "))
+	}
+
+	var errs []string
+	for gid := range GetMembershipState().GetGroups() {
+		req := &pb.CancelRestoreRequest{RestoreId: restoreId, GroupId: gid}
+		if err := proposeCancelRestoreOrSend(ctx, req); err != nil {
+			errs = append(errs, fmt.Sprintf("group %d: %v", gid, err))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errors.Errorf("cannot cancel restore %s in all the groups: %s", restoreId,
+			strings.Join(errs, "; "))
+	}
+	glog.Infof("Restore %s was cancelled.", restoreId)
+	return nil
+}
+
+func proposeCancelRestoreOrSend(ctx context.Context, req *pb.CancelRestoreRequest) error {
+	if groups().ServesGroup(req.GroupId) {
+		_, err := (&grpcWorker{}).CancelRestore(ctx, req)
+		return err
+	}
+	pl := groups().Leader(req.GroupId)
+	if pl == nil {
+		return conn.ErrNoConnection
+	}
+	_, err := pb.NewWorkerClient(pl.Get()).CancelRestore(ctx, req)
+	return err
+}
+
+// CancelRestore implements the Worker interface.
+func (w *grpcWorker) CancelRestore(ctx context.Context, req *pb.CancelRestoreRequest) (
+	*pb.Status, error) {
+	if req.RestoreId == "" {
+		return &pb.Status{}, errors.Errorf("the id of the restore to cancel can't be empty")
+	}
+	cancelRestoreLocally(req.RestoreId)
+	if req.GroupId == 0 {
+		glog.Infof("Restore %s was cancelled on this alpha.", req.RestoreId)
+		return &pb.Status{}, nil
+	}
+	if !groups().ServesGroup(req.GroupId) {
+		return &pb.Status{}, errors.Errorf("this server doesn't serve group id: %v",
+			req.GroupId)
+	}
+	if err := groups().Node.proposeAndWait(ctx, &pb.Proposal{CancelRestore: req}); err != nil {
+		return &pb.Status{}, errors.Wrapf(err, "cannot propose the cancellation of restore %s",
+			req.RestoreId)
+	}
+	return &pb.Status{}, nil
+}
+
+// proposeRestoreCancellation proposes the cancellation of a restore to the group of this alpha
+// without waiting for it. It's called by a replica that stopped ingesting the restore because it
+// was cancelled, so that the group undoes the restore even if the cancellation that stopped it
+// isn't proposed.
+func proposeRestoreCancellation(req *pb.RestoreRequest) {
+	n := groups().Node
+	data, err := (&pb.Proposal{CancelRestore: &pb.CancelRestoreRequest{
+		RestoreId: req.RestoreId,
+		GroupId:   req.GroupId,
+	}}).Marshal()
+	if err == nil {
+		err = n.Raft().Propose(n.ctx, data)
+	}
+	if err != nil {
+		glog.Errorf("Cannot propose the cancellation of restore %s: %v", req.RestoreId, err)
+	}
+}
+
+// handleCancelRestoreProposal applies the cancellation of a restore to the group. The restore
+// is undone if it's the last one the group started: its data is rolled back if the restore is
+// atomic, otherwise the data of the group is dropped, as it could hold any part of the backup.
+// Later proposals of the restore are skipped.
+func handleCancelRestoreProposal(ctx context.Context, req *pb.CancelRestoreRequest) error {
+	if req == nil {
+		return errors.Errorf("nil cancel restore request")
+	}
+	cancelRestoreLocally(req.RestoreId)
+	groupRestore.Lock()
+	if groupRestore.cancelled == nil {
+		groupRestore.cancelled = make(map[string]struct{})
+	}
+	groupRestore.cancelled[req.RestoreId] = struct{}{}
+	started, atomic := groupRestore.started == req.RestoreId, groupRestore.atomic
+	groupRestore.Unlock()
+	if !started {
+		glog.Infof("Restore %s was cancelled before group %d started it.", req.RestoreId,
+			req.GroupId)
+		return nil
+	}
+
+	posting.Oracle().ResetTxns()
+	var rolledBack bool
+	if atomic {
+		// The replicas must all end up with the same data, so the data is dropped if it
+		// can't be rolled back.
+		if err := rollbackRestore(); err != nil {
+			glog.Errorf("Cannot roll back restore %s, dropping the data of group %d instead: %v",
+				req.RestoreId, req.GroupId, err)
+		} else {
+			rolledBack = true
+			glog.Infof("Restore %s was cancelled and rolled back by group %d.", req.RestoreId,
+				req.GroupId)
+		}
+	}
+	if !rolledBack {
+		resetGroupRestore()
+		schema.State().DeleteAll()
+		if err := posting.DeleteAll(); err != nil {
+			return errors.Wrapf(err, "cannot drop the data of cancelled restore %s",
+				req.RestoreId)
+		}
+		glog.Infof("Restore %s was cancelled and the data of group %d was dropped.",
+			req.RestoreId, req.GroupId)
+	}
+
+	// A snapshot prevents the restore and its cancellation from being replayed.
+	if err := groups().Node.proposeSnapshot(1); err != nil {
+		return errors.Wrapf(err, "cannot propose snapshot after cancelling restore %s",
+			req.RestoreId)
+	}
+	return nil
+}
+
+// rollbackPath returns the path of the file holding the data of the group as it was before
+// the last atomic restore it started.
+func rollbackPath() string {
+	return filepath.Clean(Config.PostingDir) + ".restore-rollback"
+}
+
+// saveRollback saves the data of the group before an atomic restore drops it. The data is
+// encrypted with the key of the alpha, if it has one. It's written next to the rollback path,
+// as dropping the data of the group removes the data saved for the previous restore.
+func saveRollback() error {
+	f, err := os.Create(rollbackPath() + ".tmp")
+	if err != nil {
+		return errors.Wrapf(err, "cannot create file to save the data of the group")
+	}
+	w, err := enc.GetWriter(x.WorkerConfig.EncryptionKey, f)
+	if err == nil {
+		_, err = pstore.Backup(w, 0)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return errors.Wrapf(err, "cannot save the data of the group")
+}
+
+// rollbackRestore replaces the data of the group with the data saved before the last atomic
+// restore it started.
+func rollbackRestore() error {
+	f, err := os.Open(rollbackPath())
+	if err != nil {
+		return errors.Wrapf(err, "cannot open the data saved before the restore")
+	}
+	defer f.Close()
+	r, err := enc.GetReader(x.WorkerConfig.EncryptionKey, f)
+	if err != nil {
+		return err
+	}
+	schema.State().DeleteAll()
+	if err := posting.DeleteAll(); err != nil {
+		return err
+	}
+	if err := pstore.Load(r, 16); err != nil {
+		return errors.Wrapf(err, "cannot load the data saved before the restore")
+	}
+	if err := schema.LoadFromDb(); err != nil {
+		return errors.Wrapf(err, "cannot load schema after rolling back the restore")
+	}
+	// The saved data is removed along with the state of the restore.
+	resetGroupRestore()
+	return nil
+}
+
+// cancelledRestoreError returns the error reported by a cancelled restore. Once the restore
+// was proposed, the groups could have started it and then undone it.
+func cancelledRestoreError(req *pb.RestoreRequest, proposed bool) error {
+	if !proposed {
+		return errors.Errorf("restore %s was cancelled before any data was changed",
+			req.RestoreId)
+	}
+	if req.Atomic {
+		return errors.Errorf("restore %s was cancelled and the groups that started it "+
+			"rolled it back", req.RestoreId)
+	}
+	return errors.Errorf("restore %s was cancelled while the backup was being restored, so "+
+		"the groups that started it dropped all their data. Restore a backup again before "+
+		"using the cluster", req.RestoreId)
+}
+
 // ProcessRestoreRequest verifies the backup data and sends a restore proposal to each group.
-func ProcessRestoreRequest(ctx context.Context, req *pb.RestoreRequest) error {
+func ProcessRestoreRequest(ctx context.Context, req *pb.RestoreRequest) (
+	result *RestoreResult, rerr error) {
 	if req == nil {
-		return errors.Errorf("restore request cannot be nil")
+		return nil, errors.Errorf("restore request cannot be nil")
+	}
+	if _, err := indexesToSkip(req.RebuildIndexes, nil); err != nil {
+		return nil, err
+	}
+	if _, err := restoreTypeFilter(req); err != nil {
+		return nil, err
+	}
+	if _, err := parsePostRestoreSchema(req); err != nil {
+		return nil, err
+	}
+	if _, err := newTypeCoercion(req.CoerceTypes); err != nil {
+		return nil, err
+	}
+	// A backup archive is extracted once while the restore is checked, and it's held until
+	// the restore is done so that another restore can't remove it.
+	location, release, err := restoreLocation(req)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	req.Location = location
+	bulkDirs, err := bulkOutputDirs(req.Location)
+	if err != nil {
+		return nil, err
+	}
+	if req.DryRun && len(bulkDirs) > 0 {
+		return nil, errors.Errorf("dry runs are not supported when restoring the output of " +
+			"the bulk loader")
+	}
+	if req.UidOffset > 0 && len(bulkDirs) > 0 {
+		return nil, errors.Errorf("a uid offset is not supported when restoring the output " +
+			"of the bulk loader")
+	}
+	if len(req.CoerceTypes) > 0 && len(bulkDirs) > 0 {
+		return nil, errors.Errorf("coercing the types of predicates is not supported when " +
+			"restoring the output of the bulk loader")
+	}
+	if req.ReplayWal != "" && len(bulkDirs) > 0 {
+		return nil, errors.Errorf("replaying a write-ahead log is not supported when " +
+			"restoring the output of the bulk loader")
+	}
+	if req.UidOffset > 0 && req.TargetDir != "" {
+		return nil, errors.Errorf("a uid offset is not supported when restoring into a " +
+			"target directory")
+	}
+	if (len(req.IncludeTypes) > 0 || len(req.ExcludeTypes) > 0) && req.TargetDir != "" {
+		return nil, errors.Errorf("selecting the types is not supported when restoring into " +
+			"a target directory")
+	}
+	if len(req.CoerceTypes) > 0 && req.TargetDir != "" {
+		return nil, errors.Errorf("coercing the types of predicates is not supported when " +
+			"restoring into a target directory")
+	}
+	if req.Rebalance && req.TargetDir != "" {
+		return nil, errors.Errorf("rebalancing is not supported when restoring into a " +
+			"target directory")
+	}
+	if req.ReplayWal != "" && req.TargetDir != "" {
+		return nil, errors.Errorf("replaying a write-ahead log is not supported when " +
+			"restoring into a target directory")
+	}
+	if req.ReplayWal != "" && req.UidOffset > 0 {
+		return nil, errors.Errorf("replaying a write-ahead log is not supported along with " +
+			"a uid offset")
+	}
+	if req.PostRestoreSchema != "" && req.TargetDir != "" {
+		return nil, errors.Errorf("a post-restore schema is not supported when restoring into " +
+			"a target directory")
+	}
+	if req.Snapshot && req.TargetDir != "" {
+		return nil, errors.Errorf("taking a snapshot is not supported when restoring into a " +
+			"target directory")
+	}
+	if req.Compact && req.TargetDir != "" {
+		return nil, errors.Errorf("compacting the restored data is not supported when " +
+			"restoring into a target directory")
+	}
+	if req.DiskHeadroom != 0 && req.DiskHeadroom < 1 {
+		return nil, errors.Errorf("the disk headroom must be at least 1, but got %v",
+			req.DiskHeadroom)
+	}
+	if req.BatchSizeMb > maxRestoreBatchSizeMB {
+		return nil, errors.Errorf("the batch size must be between 1 and %d MiB, but got %d",
+			maxRestoreBatchSizeMB, req.BatchSizeMb)
+	}
+	if req.VerifyChecksums && !req.DryRun {
+		return nil, errors.Errorf("the checksums of the backup files can only be verified " +
+			"in a dry run")
+	}
+	if req.ReportPath != "" && !req.DryRun {
+		return nil, errors.Errorf("a report can only be written for a dry run")
+	}
+	if req.Atomic && (req.DryRun || req.TargetDir != "" || req.DiffAgainst != "") {
+		return nil, errors.Errorf("only a restore into the cluster can be atomic")
+	}
+	if req.DiffAgainst != "" {
+		if err := checkDiffRequest(req, bulkDirs); err != nil {
+			return nil, err
+		}
+	}
+	if req.DryRun {
+		report := newRestoreReport(req)
+		result, err := restoreDryRun(ctx, req, report)
+		if req.ReportPath != "" {
+			if werr := writeRestoreReport(req, report, err); werr != nil {
+				if err != nil {
+					glog.Errorf("Cannot write the report of the failed dry run: %v", werr)
+					return nil, err
+				}
+				return nil, werr
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		result.Location = location
+		return result, nil
+	}
+
+	if req.RestoreId == "" {
+		if req.RestoreId, err = defaultRestoreId(req, bulkDirs); err != nil {
+			return nil, err
+		}
+	}
+	if restoreCancelled(req.RestoreId) {
+		return nil, errors.Errorf("restore %s was already cancelled", req.RestoreId)
+	}
+
+	restoreLock.Lock()
+	defer restoreLock.Unlock()
+
+	// proposed is set once the restore is proposed to the groups, which can change their data.
+	var proposed bool
+	progress := startRestoreProgress(req.RestoreId, true)
+	defer func() {
+		if rerr != nil && restoreCancelled(req.RestoreId) {
+			rerr = cancelledRestoreError(req, proposed)
+		}
+		progress.finish(rerr)
+		if result != nil {
+			result.RestoreId = req.RestoreId
+		}
+	}()
+
+	if req.DiffAgainst != "" {
+		// Both backups are restored into scratch directories, so the target directory only
+		// holds them.
+		return restoreDiff(req)
+	}
+	if req.TargetDir != "" {
+		if len(bulkDirs) > 0 {
+			return nil, errors.Errorf("the output of the bulk loader can't be restored into " +
+				"a target directory")
+		}
+		return restoreToDir(req)
+	}
+	// A retried request isn't restored again if the group of this alpha already applied it.
+	if restoreApplied(req.RestoreId) {
+		glog.Infof("Restore %s was already applied. Skipping.", req.RestoreId)
+		return &RestoreResult{Location: req.Location}, nil
 	}
 
 	if err := UpdateMembershipState(ctx); err != nil {
-		return errors.Wrapf(err, "cannot update membership state before restore")
+		return nil, errors.Wrapf(err, "cannot update membership state before restore")
 	}
 	memState := GetMembershipState()
+	if err := checkUidOffset(req, memState.GetMaxLeaseId()); err != nil {
+		return nil, err
+	}
 
 	currentGroups := make([]uint32, 0)
 	for gid := range memState.GetGroups() {
 		currentGroups = append(currentGroups, gid)
 	}
 
-	creds := Credentials{
-		AccessKey:    req.AccessKey,
-		SecretKey:    req.SecretKey,
-		SessionToken: req.SessionToken,
-		Anonymous:    req.Anonymous,
+	var manifest *Manifest
+	if len(bulkDirs) > 0 {
+		// The output of the bulk loader has no manifest to verify. Reading the one built
+		// from its shards checks that they can be opened.
+		encKey, err := restoreEncKey(req)
+		if err != nil {
+			return nil, err
+		}
+		if manifest, err = bulkOutputManifest(bulkDirs, encKey); err != nil {
+			return nil, err
+		}
+	} else {
+		creds := restoreCredentials(req)
+		if err := VerifyBackup(req.Location, req.BackupId, creds, currentGroups); err != nil {
+			return nil, errors.Wrapf(err, "failed to verify backup")
+		}
+
+		uri, err := url.Parse(req.Location)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot parse backup location")
+		}
+		handler, err := NewUriHandler(uri, creds)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot create backup handler")
+		}
+		manifests, err := handler.GetManifests(uri, req.BackupId)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot get backup manifests")
+		}
+		if len(manifests) == 0 {
+			return nil, errors.Errorf("no backup manifests found at location %s", req.Location)
+		}
+		manifest = manifests[len(manifests)-1]
+		if err := checkDiskSpace(Config.PostingDir, manifests, req.DiskHeadroom); err != nil {
+			return nil, err
+		}
 	}
-	if err := VerifyBackup(req.Location, req.BackupId, &creds, currentGroups); err != nil {
-		return errors.Wrapf(err, "failed to verify backup")
+	if err := checkPredicateCount(req, manifest); err != nil {
+		return nil, err
+	}
+	// The predicates are assigned to the groups once, here, and sent along with the request.
+	// The membership state is updated asynchronously by Zero, so the groups and their replicas
+	// could otherwise compute different assignments while applying the proposal.
+	req.PredicateGroups = predicateGroupList(restoreGroupMap(manifest, memState))
+	// The log is read before the restore is proposed, so that a log that can't be replayed
+	// doesn't leave the cluster with the backup alone.
+	var walTxns []*walTxn
+	if req.ReplayWal != "" {
+		encKey, err := restoreEncKey(req)
+		if err != nil {
+			return nil, err
+		}
+		if walTxns, err = readWALTxns(req.ReplayWal, encKey, manifest.Since); err != nil {
+			return nil, err
+		}
 	}
-
 	if err := FillRestoreCredentials(req.Location, req); err != nil {
-		return errors.Wrapf(err, "cannot fill restore proposal with the right credentials")
+		return nil, errors.Wrapf(err, "cannot fill restore proposal with the right credentials")
 	}
 	req.RestoreTs = State.GetTimestamp(false)
 
+	if err := checkRestoreCancelled(req); err != nil {
+		return nil, err
+	}
+	proposed = true
+	progress.setPhase("proposing")
+
 	// TODO: prevent partial restores when proposeRestoreOrSend only sends the restore
 	// request to a subset of groups.
-	errCh := make(chan error, len(currentGroups))
+	type proposalResult struct {
+		gid uint32
+		res *pb.RestoreResponse
+		err error
+	}
+	resCh := make(chan proposalResult, len(currentGroups))
 	for _, gid := range currentGroups {
 		reqCopy := proto.Clone(req).(*pb.RestoreRequest)
 		reqCopy.GroupId = gid
 
 		go func() {
-			errCh <- proposeRestoreOrSend(ctx, reqCopy)
+			res, err := proposeRestoreOrSend(ctx, reqCopy)
+			resCh <- proposalResult{gid: reqCopy.GroupId, res: res, err: err}
 		}()
 	}
 
+	var checksums []*pb.PredicateChecksum
+	var skippedIndexes []*pb.SchemaUpdate
+	var skippedPreds []string
+	var coercions []*pb.CoercionReport
+	var ingestions []*pb.PredicateIngestion
+	var snapshots []GroupSnapshot
+	var compactions []GroupCompaction
 	for range currentGroups {
-		if err := <-errCh; err != nil {
-			return errors.Wrapf(err, "cannot complete restore proposal")
+		proposal := <-resCh
+		if proposal.err != nil {
+			return nil, errors.Wrapf(proposal.err, "cannot complete restore proposal")
+		}
+		checksums = append(checksums, proposal.res.GetChecksums()...)
+		skippedIndexes = append(skippedIndexes, proposal.res.GetSkippedIndexes()...)
+		skippedPreds = append(skippedPreds, proposal.res.GetSkippedPredicates()...)
+		coercions = append(coercions, proposal.res.GetCoercions()...)
+		ingestions = append(ingestions, proposal.res.GetIngestions()...)
+		if req.Snapshot {
+			snapshots = append(snapshots, GroupSnapshot{
+				Group: proposal.gid,
+				Index: proposal.res.GetSnapshotIndex(),
+			})
+		}
+		if stats := proposal.res.GetCompaction(); stats != nil {
+			compactions = append(compactions, GroupCompaction{
+				Group:                   proposal.gid,
+				TablesBefore:            int(stats.TablesBefore),
+				TablesAfter:             int(stats.TablesAfter),
+				ReadAmplificationBefore: int(stats.ReadAmplificationBefore),
+				ReadAmplificationAfter:  int(stats.ReadAmplificationAfter),
+				Level:                   int(stats.Level),
+				Duration:                time.Duration(stats.DurationMs) * time.Millisecond,
+			})
+		}
+	}
+
+	progress.setPhase("syncing")
+	if err := syncRestoreTs(ctx, req.RestoreTs); err != nil {
+		return nil, errors.Wrapf(err, "cannot sync timestamps after restore")
+	}
+
+	var replayed int
+	if req.ReplayWal != "" {
+		progress.setPhase("replaying write-ahead log")
+		if replayed, err = replayWALTxns(ctx, walTxns, applyWALTxn); err != nil {
+			// Like with the post-restore schema, the restore isn't recorded as applied, so
+			// retrying it restores the backup and replays the log again.
+			return nil, errors.Wrapf(err, "the backup was restored but only %d of the %d "+
+				"transactions of the write-ahead log were replayed", replayed, len(walTxns))
+		}
+	}
+
+	if req.PostRestoreSchema != "" {
+		progress.setPhase("altering schema")
+		if err := applyPostRestoreSchema(ctx, req); err != nil {
+			// The data was already replaced, so there's nothing to roll back to. The restore
+			// is reported as failed and isn't recorded as applied, so retrying it restores
+			// the backup again.
+			return nil, errors.Wrapf(err, "the backup was restored but the post-restore "+
+				"schema couldn't be applied, so the cluster has the restored data without it")
+		}
+	}
+
+	var moves []*pb.TabletMove
+	if req.Rebalance {
+		progress.setPhase("rebalancing")
+		if moves, err = rebalanceAfterRestore(ctx); err != nil {
+			// Like with the post-restore schema, the restore isn't recorded as applied, so
+			// retrying it restores the backup and rebalances the tablets again.
+			return nil, errors.Wrapf(err, "the backup was restored but the tablets couldn't "+
+				"be rebalanced")
+		}
+	}
+
+	result = &RestoreResult{Location: location, ReplayedTransactions: replayed}
+	for _, move := range moves {
+		result.TabletMoves = append(result.TabletMoves, TabletMove{
+			Predicate: move.Predicate,
+			FromGroup: move.SrcGroup,
+			ToGroup:   move.DstGroup,
+		})
+	}
+	if req.ComputeChecksum {
+		result.Checksum = restoreChecksum(checksums)
+	}
+	sort.Slice(skippedIndexes, func(i, j int) bool {
+		return skippedIndexes[i].Predicate < skippedIndexes[j].Predicate
+	})
+	for _, update := range skippedIndexes {
+		result.SkippedIndexes = append(result.SkippedIndexes,
+			strings.TrimSpace(schemaString(update.Predicate, update)))
+	}
+	sort.Strings(skippedPreds)
+	result.SkippedPredicates = skippedPreds
+	// Each predicate is restored by a single group, so there's a report per predicate.
+	sort.Slice(coercions, func(i, j int) bool {
+		return coercions[i].Predicate < coercions[j].Predicate
+	})
+	for _, report := range coercions {
+		result.Coercions = append(result.Coercions, CoercionReport{
+			Predicate: report.Predicate,
+			Coerced:   report.Coerced,
+			Failed:    report.Failed,
+		})
+	}
+	// The groups ingest their predicates in parallel, so the slowest ones are sorted across
+	// all of them.
+	sortIngestions(ingestions)
+	for _, ingestion := range ingestions {
+		result.Ingestions = append(result.Ingestions, PredicateIngestion{
+			Predicate: ingestion.Predicate,
+			Bytes:     ingestion.Bytes,
+			Duration:  time.Duration(ingestion.DurationNs),
+		})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Group < snapshots[j].Group
+	})
+	result.Snapshots = snapshots
+	sort.Slice(compactions, func(i, j int) bool {
+		return compactions[i].Group < compactions[j].Group
+	})
+	result.Compactions = compactions
+	return result, nil
+}
+
+// restoreToDir restores the backup into a p directory for each of its groups under the target
+// directory of the request, like the restore command does. The data of the cluster isn't
+// changed, so there's nothing to propose to the groups.
+func restoreToDir(req *pb.RestoreRequest) (*RestoreResult, error) {
+	if err := checkTargetDir(req.TargetDir); err != nil {
+		return nil, err
+	}
+	uri, err := url.Parse(req.Location)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse backup location")
+	}
+	handler, err := NewUriHandler(uri, restoreCredentials(req))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot create backup handler")
+	}
+	manifests, err := handler.GetManifests(uri, req.BackupId)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot get backup manifests")
+	}
+	if err := checkDiskSpace(req.TargetDir, manifests, req.DiskHeadroom); err != nil {
+		return nil, err
+	}
+	key, err := restoreEncKey(req)
+	if err != nil {
+		return nil, err
+	}
+	restoreProgressOf(req.RestoreId).setPhase("ingesting")
+	if res := RunRestore(req.TargetDir, req.Location, req.BackupId, key); res.Err != nil {
+		return nil, errors.Wrapf(res.Err, "cannot restore backup into %s", req.TargetDir)
+	}
+	return &RestoreResult{Location: req.Location}, nil
+}
+
+// checkTargetDir returns an error if the backup can't be restored into the given directory.
+// It must be writable and either missing or empty, so that existing data, like the p
+// directory of this alpha, isn't overwritten.
+func checkTargetDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrapf(err, "cannot create target directory %s", dir)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Wrapf(err, "cannot read target directory %s", dir)
+	}
+	if len(entries) > 0 {
+		return errors.Errorf("target directory %s is not empty", dir)
+	}
+	f, err := ioutil.TempFile(dir, "restore-check-")
+	if err != nil {
+		return errors.Wrapf(err, "target directory %s is not writable", dir)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "target directory %s is not writable", dir)
+	}
+	return os.Remove(f.Name())
+}
+
+// defaultDiskHeadroom is the factor the size of a backup is multiplied by when checking that
+// it fits in the disk, if the restore request doesn't set one. It leaves room for the files
+// written by the compactions during the restore.
+const defaultDiskHeadroom = 1.2
+
+// maxRestoreBatchSizeMB is the largest batch, in MiB, that the restored data can be buffered in
+// before it's applied. The batch is held in the memory of each alpha until its writes are done,
+// so larger batches risk running out of memory.
+const maxRestoreBatchSizeMB = 1024
+
+// availableDiskSpace returns the number of bytes available in the disk of the given directory.
+// Tests replace it to mock the disk.
+var availableDiskSpace = diskSpace
+
+// backupSize returns the size in bytes of the data in the given backups before it was
+// compressed. It returns false if the size of any of them wasn't recorded in its manifest.
+func backupSize(manifests []*Manifest) (uint64, bool) {
+	var size uint64
+	for _, m := range manifests {
+		if m.Size == 0 {
+			return 0, false
 		}
+		size += m.Size
 	}
+	return size, true
+}
 
+// checkDiskSpace returns an error if the disk of the given directory doesn't have room for the
+// data in the given backups, multiplied by the headroom factor. This is checked before the
+// restore changes any data, so that it doesn't run out of disk halfway and leave the cluster
+// with a partial restore. The check is skipped if the size of the backups or the disk space
+// is unknown.
+func checkDiskSpace(dir string, manifests []*Manifest, headroom float64) error {
+	size, ok := backupSize(manifests)
+	if !ok {
+		glog.Warningf("The size of the backup isn't recorded in its manifests. Skipping the " +
+			"disk space check.")
+		return nil
+	}
+	if headroom == 0 {
+		headroom = defaultDiskHeadroom
+	}
+	available, err := availableDiskSpace(dir)
+	if err != nil {
+		glog.Warningf("Skipping the disk space check: %v", err)
+		return nil
+	}
+	required := uint64(float64(size) * headroom)
+	if available < required {
+		return errors.Errorf("insufficient disk space to restore the backup: %s has %d bytes "+
+			"available but the restore needs %d bytes (%d bytes of data with a headroom of "+
+			"%v)", dir, available, required, size, headroom)
+	}
 	return nil
 }
 
-func proposeRestoreOrSend(ctx context.Context, req *pb.RestoreRequest) error {
+// syncRestoreTs moves the max assigned timestamp of the cluster past the timestamp the data
+// was restored at and waits for this alpha to see it. It's called once all the groups have
+// applied the restore. The alphas apply the timestamps they get from Zero in the same Raft log
+// as the restore, so a query that reads at a later timestamp sees all the restored data.
+func syncRestoreTs(ctx context.Context, restoreTs uint64) error {
+	ts := State.GetTimestamp(true)
+	if ts <= restoreTs {
+		return errors.Errorf("expected a timestamp past the restore ts %d but got %d",
+			restoreTs, ts)
+	}
+	return posting.Oracle().WaitForTs(ctx, ts)
+}
+
+// restoreChecksum combines the checksums of the restored predicates into a single one. The
+// predicates are sorted so that the result doesn't depend on the group that restored them.
+func restoreChecksum(checksums []*pb.PredicateChecksum) string {
+	sort.Slice(checksums, func(i, j int) bool {
+		return checksums[i].Predicate < checksums[j].Predicate
+	})
+	h := sha256.New()
+	for _, c := range checksums {
+		writeChecksumField(h, []byte(c.Predicate))
+		writeChecksumField(h, c.Checksum)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeChecksumField writes b to the hash prefixed by its length, so that the boundaries
+// between consecutive fields are part of the hash.
+func writeChecksumField(h hash.Hash, b []byte) {
+	var sz [8]byte
+	binary.BigEndian.PutUint64(sz[:], uint64(len(b)))
+	h.Write(sz[:])
+	h.Write(b)
+}
+
+// predicateChecksum returns a SHA-256 hash of the schema and all the keys of the predicate as
+// of readTs. The keys are hashed in order along with their values and user meta, but not their
+// versions, so the data restored from the same backup always has the same checksum.
+func predicateChecksum(db *badger.DB, pred string, readTs uint64) ([]byte, error) {
+	txn := db.NewTransactionAt(readTs, false)
+	defer txn.Discard()
+
+	h := sha256.New()
+	hashItem := func(item *badger.Item) error {
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		writeChecksumField(h, item.Key())
+		writeChecksumField(h, val)
+		h.Write([]byte{item.UserMeta()})
+		return nil
+	}
+
+	item, err := txn.Get(x.SchemaKey(pred))
+	switch {
+	case err == badger.ErrKeyNotFound:
+	case err != nil:
+		return nil, err
+	default:
+		if err := hashItem(item); err != nil {
+			return nil, err
+		}
+	}
+
+	itOpt := badger.DefaultIteratorOptions
+	itOpt.Prefix = x.PredicatePrefix(pred)
+	it := txn.NewIterator(itOpt)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		if err := hashItem(it.Item()); err != nil {
+			return nil, err
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+func proposeRestoreOrSend(ctx context.Context, req *pb.RestoreRequest) (
+	*pb.RestoreResponse, error) {
 	if groups().ServesGroup(req.GetGroupId()) {
-		_, err := (&grpcWorker{}).Restore(ctx, req)
-		return err
+		return (&grpcWorker{}).Restore(ctx, req)
 	}
 
 	pl := groups().Leader(req.GetGroupId())
 	if pl == nil {
-		return conn.ErrNoConnection
+		return nil, conn.ErrNoConnection
 	}
 	con := pl.Get()
 	c := pb.NewWorkerClient(con)
 
-	_, err := c.Restore(ctx, req)
-	return err
+	return c.Restore(ctx, req)
 }
 
 // Restore implements the Worker interface.
-func (w *grpcWorker) Restore(ctx context.Context, req *pb.RestoreRequest) (*pb.Status, error) {
-	var emptyRes pb.Status
+func (w *grpcWorker) Restore(ctx context.Context, req *pb.RestoreRequest) (
+	*pb.RestoreResponse, error) {
+	var emptyRes pb.RestoreResponse
 	if !groups().ServesGroup(req.GroupId) {
 		return &emptyRes, errors.Errorf("this server doesn't serve group id: %v", req.GroupId)
 	}
@@ -116,17 +1667,163 @@ func (w *grpcWorker) Restore(ctx context.Context, req *pb.RestoreRequest) (*pb.S
 	if err != nil {
 		return &emptyRes, errors.Wrapf(err, "cannot propose restore request")
 	}
+	// The restore proposal was applied, so it's at or below this index.
+	restoreIdx := groups().Node.Applied.DoneUntil()
+
+	restoredPreds.Lock()
+	preds, restoreTs := restoredPreds.preds, restoredPreds.restoreTs
+	skippedIndexes, skippedPreds := restoredPreds.skippedIndexes, restoredPreds.skippedPreds
+	coercions, compaction := restoredPreds.coercions, restoredPreds.compaction
+	ingestions := restoredPreds.ingestions
+	restoredPreds.Unlock()
+	if restoreTs != req.RestoreTs {
+		return &emptyRes, errors.Errorf("cannot find the predicates restored at ts %d",
+			req.RestoreTs)
+	}
+
+	res := &pb.RestoreResponse{
+		SkippedIndexes:    skippedIndexes,
+		SkippedPredicates: skippedPreds,
+		Coercions:         coercions,
+		Compaction:        compaction,
+		Ingestions:        ingestions,
+	}
+	if req.ComputeChecksum {
+		for _, pred := range preds {
+			checksum, err := predicateChecksum(pstore, pred, req.RestoreTs)
+			if err != nil {
+				return &emptyRes, errors.Wrapf(err, "cannot compute checksum of predicate %s",
+					pred)
+			}
+			res.Checksums = append(res.Checksums, &pb.PredicateChecksum{
+				Predicate: pred,
+				Checksum:  checksum,
+			})
+		}
+	}
+	if req.Snapshot {
+		restoreProgressOf(req.RestoreId).setPhase("snapshotting")
+		res.SnapshotIndex, err = waitForRestoreSnapshot(ctx, groups().Node, restoreIdx,
+			req.RestoreTs)
+		if err != nil {
+			return &emptyRes, errors.Wrapf(err, "cannot take snapshot after restore")
+		}
+	}
+	return res, nil
+}
+
+// restoreSnapshotInterval is how often the snapshot taken after a restore is proposed again
+// if it doesn't include the restore yet.
+const restoreSnapshotInterval = time.Second
+
+// waitForRestoreSnapshot proposes a snapshot of the group that includes the restore applied at
+// the given Raft index and timestamp, and waits until it's created. It returns the index of the
+// snapshot.
+func waitForRestoreSnapshot(ctx context.Context, n *node, index, restoreTs uint64) (
+	uint64, error) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	var proposed time.Time
+	for {
+		snap, err := n.Store.Snapshot()
+		if err != nil {
+			return 0, err
+		}
+		if snap.Metadata.Index >= index {
+			return snap.Metadata.Index, nil
+		}
+		// A snapshot stops before the entries of the pending transactions, so it may take
+		// a few proposals until one gets past the given index.
+		if time.Since(proposed) >= restoreSnapshotInterval {
+			if err := proposeRestoreSnapshot(n, index, restoreTs); err != nil {
+				return 0, err
+			}
+			proposed = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
 
-	return &emptyRes, nil
+// proposeRestoreSnapshot proposes a snapshot like proposeSnapshot does. A snapshot that includes
+// the restore is read at the timestamp of the restore at least, so that the followers that
+// catch up from it get the restored data. If no transaction was committed since the last
+// snapshot, e.g. because the cluster was only restored, there's no snapshot to calculate, so
+// the snapshot is taken at the restore. The restore dropped all the data and aborted all the
+// transactions before it, so nothing before it is lost.
+func proposeRestoreSnapshot(n *node, index, restoreTs uint64) error {
+	snap, err := n.calculateSnapshot(0, 0)
+	if err != nil {
+		return err
+	}
+	if snap == nil {
+		snap = &pb.Snapshot{Context: n.RaftContext, Index: index}
+	}
+	if snap.Index >= index {
+		snap.ReadTs = x.Max(snap.ReadTs, restoreTs)
+	}
+	data, err := (&pb.Proposal{Snapshot: snap}).Marshal()
+	if err != nil {
+		return err
+	}
+	return n.Raft().Propose(n.ctx, data)
 }
 
 // TODO(DGRAPH-1232): Ensure all groups receive the restore proposal.
-func handleRestoreProposal(ctx context.Context, req *pb.RestoreRequest) error {
+func handleRestoreProposal(ctx context.Context, req *pb.RestoreRequest) (rerr error) {
 	if req == nil {
 		return errors.Errorf("nil restore request")
 	}
+	progress := restoreProgressOf(req.RestoreId)
+	if !progress.coordinated {
+		// The alphas that only apply the restore track the progress of their group.
+		progress = startRestoreProgress(req.RestoreId, false)
+		defer func() {
+			progress.finish(rerr)
+		}()
+	}
+
+	// A restore cancelled before this group started it doesn't change any data. The group
+	// applied the cancellation, so all its replicas skip the restore.
+	if restoreCancelledInGroup(req.RestoreId) {
+		return errRestoreCancelled
+	}
+	// The same restore can be proposed again when a request is retried.
+	if restoreApplied(req.RestoreId) {
+		glog.Infof("Restore %s was already applied by group %d. Skipping.", req.RestoreId,
+			req.GroupId)
+		return nil
+	}
+	// A replica that stops ingesting because it received the cancellation proposes it, so
+	// that the group undoes the restore even if the cancellation isn't proposed by the alpha
+	// that received it.
+	defer func() {
+		if errors.Cause(rerr) == errRestoreCancelled {
+			proposeRestoreCancellation(req)
+		}
+	}()
+
+	// The archive is held until the backup is loaded, so that another restore can't remove
+	// it in the meantime.
+	release, err := acquireBackupArchive(req.Location)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if req.Atomic {
+		progress.setPhase("saving rollback")
+		if err := saveRollback(); err != nil {
+			return err
+		}
+	}
 
 	// Drop all the current data. This also cancels all existing transactions.
+	progress.setPhase("dropping")
 	dropProposal := pb.Proposal{
 		Mutations: &pb.Mutations{
 			GroupId: req.GroupId,
@@ -137,38 +1834,75 @@ func handleRestoreProposal(ctx context.Context, req *pb.RestoreRequest) error {
 	if err := groups().Node.applyMutations(ctx, &dropProposal); err != nil {
 		return err
 	}
-
-	// TODO: after the drop, the tablets for the predicates stored in this group's
-	// backup could be in a different group. The tablets need to be moved.
+	if req.Atomic {
+		// The saved data is only kept once the data of the previous restore is dropped.
+		if err := os.Rename(rollbackPath()+".tmp", rollbackPath()); err != nil {
+			return errors.Wrapf(err, "cannot keep the data saved before the restore")
+		}
+	}
+	groupRestore.Lock()
+	groupRestore.started = req.RestoreId
+	groupRestore.atomic = req.Atomic
+	groupRestore.Unlock()
 
 	// Reset tablets and set correct tablets to match the restored backup.
-	creds := &Credentials{
-		AccessKey:    req.AccessKey,
-		SecretKey:    req.SecretKey,
-		SessionToken: req.SessionToken,
-		Anonymous:    req.Anonymous,
-	}
-	uri, err := url.Parse(req.Location)
+	bulkDirs, err := bulkOutputDirs(req.Location)
 	if err != nil {
-		return errors.Wrapf(err, "cannot parse backup location")
+		return err
 	}
-	handler, err := NewUriHandler(uri, creds)
-	if err != nil {
-		return errors.Wrapf(err, "cannot create backup handler")
+	var manifest *Manifest
+	var manifests []*Manifest
+	var handler UriHandler
+	var uri *url.URL
+	if len(bulkDirs) > 0 {
+		encKey, err := restoreEncKey(req)
+		if err != nil {
+			return err
+		}
+		if manifest, err = bulkOutputManifest(bulkDirs, encKey); err != nil {
+			return err
+		}
+	} else {
+		creds := restoreCredentials(req)
+		if uri, err = url.Parse(req.Location); err != nil {
+			return errors.Wrapf(err, "cannot parse backup location")
+		}
+		if handler, err = NewUriHandler(uri, creds); err != nil {
+			return errors.Wrapf(err, "cannot create backup handler")
+		}
+		if manifests, err = handler.GetManifests(uri, req.BackupId); err != nil {
+			return errors.Wrapf(err, "cannot get backup manifests")
+		}
+		if len(manifests) == 0 {
+			return errors.Errorf("no backup manifests found at location %s", req.Location)
+		}
+		manifest = manifests[len(manifests)-1]
 	}
 
-	manifests, err := handler.GetManifests(uri, req.BackupId)
+	// The backup could have been taken in a cluster with a different number of groups.
+	// Re-shard the predicates as assigned by the alpha that received the request.
+	predGroups := requestGroupMap(req, manifest)
+	var preds []string
+	for pred, gid := range predGroups {
+		if gid == req.GroupId {
+			preds = append(preds, pred)
+		}
+	}
+	sort.Strings(preds)
+	skipIndexes, err := indexesToSkip(req.RebuildIndexes, preds)
 	if err != nil {
-		return errors.Wrapf(err, "cannot get backup manifests")
+		return err
 	}
-	if len(manifests) == 0 {
-		return errors.Errorf("no backup manifests found at location %s", req.Location)
+	coerce, err := newTypeCoercion(req.CoerceTypes)
+	if err != nil {
+		return err
 	}
-	lastManifest := manifests[len(manifests)-1]
-	preds, ok := lastManifest.Groups[req.GroupId]
-	if !ok {
-		return errors.Errorf("backup manifest does not contain information for group ID %d",
-			req.GroupId)
+	// The indexes of the coerced predicates were computed from the values before they were
+	// converted, so they're not restored.
+	for _, pred := range preds {
+		if coerce.coerces(pred) {
+			skipIndexes[pred] = struct{}{}
+		}
 	}
 	for _, pred := range preds {
 		if tablet, err := groups().Tablet(pred); err != nil {
@@ -179,14 +1913,64 @@ func handleRestoreProposal(ctx context.Context, req *pb.RestoreRequest) error {
 	}
 
 	// Write restored values to disk and update the UID lease.
-	if err := writeBackup(ctx, req); err != nil {
-		return errors.Wrapf(err, "cannot write backup")
+	start := time.Now()
+	stats := newIngestStats()
+	var skipped predicateSet
+	if len(bulkDirs) > 0 {
+		skipped, err = writeBulkOutput(ctx, req, predGroups, skipIndexes, bulkDirs, manifest)
+		if err != nil {
+			return errors.Wrapf(err, "cannot write bulk loader output")
+		}
+	} else {
+		skipped, err = writeBackup(ctx, req, predGroups, skipIndexes, coerce, stats,
+			numBackupFiles(manifests))
+		if err != nil {
+			return errors.Wrapf(err, "cannot write backup")
+		}
+		// Measure the ingest throughput to estimate the duration of future restores.
+		if size, err := handler.Size(uri, req.BackupId); err != nil {
+			glog.Warningf("Cannot get the size of the restored backup: %v", err)
+		} else {
+			recordIngestThroughput(size, time.Since(start))
+		}
 	}
 
 	// Load schema back.
+	progress.setPhase("loading schema")
+	skippedIndexes, err := dropSkippedIndexes(skipIndexes)
+	if err != nil {
+		return errors.Wrapf(err, "cannot remove the skipped indexes from the schema")
+	}
+	var compaction *pb.CompactionStats
+	if req.Compact {
+		progress.setPhase("compacting")
+		if compaction, err = compactRestoredData(pstore); err != nil {
+			return err
+		}
+	}
+	var restored, skippedPreds []string
+	for _, pred := range preds {
+		if _, ok := skipped[pred]; ok {
+			skippedPreds = append(skippedPreds, pred)
+		} else {
+			restored = append(restored, pred)
+		}
+	}
+	restoredPreds.Lock()
+	restoredPreds.restoreTs = req.RestoreTs
+	restoredPreds.preds = restored
+	restoredPreds.skippedIndexes = skippedIndexes
+	restoredPreds.skippedPreds = skippedPreds
+	restoredPreds.coercions = coerce.report()
+	restoredPreds.compaction = compaction
+	restoredPreds.ingestions = stats.report()
+	restoredPreds.Unlock()
 	if err := schema.LoadFromDb(); err != nil {
 		return errors.Wrapf(err, "cannot load schema after restore")
 	}
+	groupRestore.Lock()
+	groupRestore.applied = req.RestoreId
+	groupRestore.Unlock()
 
 	// Propose a snapshot immediately after all the work is done to prevent the restore
 	// from being replayed.
@@ -198,9 +1982,102 @@ func handleRestoreProposal(ctx context.Context, req *pb.RestoreRequest) error {
 	if err := UpdateMembershipState(ctx); err != nil {
 		return errors.Wrapf(err, "cannot update membership state after restore")
 	}
+
+	// Zero balances the groups by the sizes of their tablets, which the leader otherwise only
+	// reports periodically. Report the sizes of the restored tablets now so that they can be
+	// rebalanced as soon as the restore completes.
+	if req.Rebalance && groups().Node.AmLeader() {
+		tablets, err := restoredTabletSizes(pstore, req.GroupId, restored, req.RestoreTs)
+		if err != nil {
+			return errors.Wrapf(err, "cannot calculate the sizes of the restored tablets")
+		}
+		if err := groups().doSendMembership(tablets); err != nil {
+			return errors.Wrapf(err, "cannot send the sizes of the restored tablets to Zero")
+		}
+	}
 	return nil
 }
 
+// restoreCompactionWorkers is the number of goroutines that compact the restored data.
+const restoreCompactionWorkers = 4
+
+// compactRestoredData compacts the LSM tree of db until all its tables are in a single level,
+// and returns its state before and after. The restored data is otherwise spread across the
+// levels until the background compactions catch up, so that reads have to check more tables.
+// The compactions are done by Badger, which picks the level the tables end up in: the deepest
+// one that holds data, or level 1 if only level 0 had too many tables.
+func compactRestoredData(db *badger.DB) (*pb.CompactionStats, error) {
+	start := time.Now()
+	stats := &pb.CompactionStats{}
+	stats.TablesBefore, stats.ReadAmplificationBefore, _ = lsmShape(db.Tables(false))
+	if err := db.Flatten(restoreCompactionWorkers); err != nil {
+		return nil, errors.Wrapf(err, "cannot compact the restored data")
+	}
+	stats.TablesAfter, stats.ReadAmplificationAfter, stats.Level = lsmShape(db.Tables(false))
+	stats.DurationMs = uint64(time.Since(start) / time.Millisecond)
+	glog.Infof("Compacted the restored data in %s. Tables: %d -> %d. Read amplification: "+
+		"%d -> %d.", time.Since(start).Round(time.Millisecond), stats.TablesBefore,
+		stats.TablesAfter, stats.ReadAmplificationBefore, stats.ReadAmplificationAfter)
+	return stats, nil
+}
+
+// lsmShape returns the number of the given tables of an LSM tree, the read amplification of
+// the tree and the deepest level with tables. The read amplification is the number of tables
+// or levels that a lookup of a key may have to check: each table of level 0, as they overlap,
+// and each other level with tables.
+func lsmShape(tables []badger.TableInfo) (numTables, readAmp, level uint32) {
+	levels := make(map[int]struct{})
+	for _, t := range tables {
+		if t.Level == 0 {
+			readAmp++
+		} else if _, ok := levels[t.Level]; !ok {
+			levels[t.Level] = struct{}{}
+			readAmp++
+		}
+		if uint32(t.Level) > level {
+			level = uint32(t.Level)
+		}
+	}
+	return uint32(len(tables)), readAmp, level
+}
+
+// restoredTabletSizes returns the tablets of the given predicates with their sizes as of
+// readTs. The sizes are summed from the keys and values of the predicates, because the
+// restored data could still be in the memtables, which aren't counted by the sizes of the
+// tables used by calculateTabletSizes.
+func restoredTabletSizes(db *badger.DB, gid uint32, preds []string, readTs uint64) (
+	map[string]*pb.Tablet, error) {
+	txn := db.NewTransactionAt(readTs, false)
+	defer txn.Discard()
+
+	tablets := make(map[string]*pb.Tablet, len(preds))
+	for _, pred := range preds {
+		itOpt := badger.DefaultIteratorOptions
+		itOpt.PrefetchValues = false
+		itOpt.Prefix = x.PredicatePrefix(pred)
+		it := txn.NewIterator(itOpt)
+		var space int64
+		for it.Rewind(); it.Valid(); it.Next() {
+			space += it.Item().EstimatedSize()
+		}
+		it.Close()
+		tablets[pred] = &pb.Tablet{GroupId: gid, Predicate: pred, Space: space}
+	}
+	return tablets, nil
+}
+
+// rebalanceAfterRestore asks Zero to move tablets between the groups until they have about
+// the same size, and returns the moves it made.
+func rebalanceAfterRestore(ctx context.Context) ([]*pb.TabletMove, error) {
+	pl := groups().connToZeroLeader()
+	if pl == nil {
+		return nil, conn.ErrNoConnection
+	}
+	zc := pb.NewZeroClient(pl.Get())
+	resp, err := zc.Rebalance(ctx, &api.Payload{})
+	return resp.GetMoves(), err
+}
+
 // create a config object from the request for use with enc package.
 func getEncConfig(req *pb.RestoreRequest) (*viper.Viper, error) {
 	config := viper.New()
@@ -228,45 +2105,343 @@ func getEncConfig(req *pb.RestoreRequest) (*viper.Viper, error) {
 	return config, nil
 }
 
-func writeBackup(ctx context.Context, req *pb.RestoreRequest) error {
-	res := LoadBackup(req.Location, req.BackupId,
-		func(r io.Reader, groupId int, preds predicateSet) (uint64, error) {
-			cfg, err := getEncConfig(req)
-			if err != nil {
-				return 0, errors.Wrapf(err, "unable to get encryption config")
-			}
-			key, err := enc.ReadKey(cfg)
-			if err != nil {
-				return 0, errors.Wrapf(err, "unable to read key")
+// restoreGroupMap returns the group in the current cluster that should restore each of the
+// predicates in the given manifest. A predicate is kept in the group serving its tablet if
+// there's one. Otherwise, it's kept in the group it belonged to in the backup if that group
+// exists in the cluster. The predicates of the remaining backup groups are spread across the
+// current groups in order. The result only depends on the manifest and the state, but the
+// state seen by each alpha can differ, so it's computed once by the alpha that receives the
+// request and sent to the groups in the request.
+func restoreGroupMap(manifest *Manifest, state *pb.MembershipState) map[string]uint32 {
+	var currentGroups []uint32
+	tablets := make(map[string]uint32)
+	for gid, group := range state.GetGroups() {
+		currentGroups = append(currentGroups, gid)
+		for pred, tablet := range group.GetTablets() {
+			tablets[pred] = tablet.GetGroupId()
+		}
+	}
+	sort.Slice(currentGroups, func(i, j int) bool { return currentGroups[i] < currentGroups[j] })
+
+	var backupGroups []uint32
+	for gid := range manifest.Groups {
+		backupGroups = append(backupGroups, gid)
+	}
+	sort.Slice(backupGroups, func(i, j int) bool { return backupGroups[i] < backupGroups[j] })
+
+	predGroups := make(map[string]uint32)
+	if len(currentGroups) == 0 {
+		return predGroups
+	}
+	var next int
+	for _, backupGid := range backupGroups {
+		target := backupGid
+		if _, ok := state.GetGroups()[backupGid]; !ok {
+			target = currentGroups[next%len(currentGroups)]
+			next++
+		}
+		for _, pred := range manifest.Groups[backupGid] {
+			if gid, ok := tablets[pred]; ok {
+				predGroups[pred] = gid
+				continue
 			}
-			r, err = enc.GetReader(key, r)
-			if err != nil {
-				return 0, errors.Wrapf(err, "cannot get encrypted reader")
+			predGroups[pred] = target
+		}
+	}
+	return predGroups
+}
+
+// predicateGroupList returns the groups of the predicates in predGroups as sent in a restore
+// request, sorted by predicate.
+func predicateGroupList(predGroups map[string]uint32) []*pb.PredicateGroup {
+	list := make([]*pb.PredicateGroup, 0, len(predGroups))
+	for pred, gid := range predGroups {
+		list = append(list, &pb.PredicateGroup{Predicate: pred, GroupId: gid})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Predicate < list[j].Predicate })
+	return list
+}
+
+// requestGroupMap returns the group that restores each predicate, as assigned in the request.
+// The requests sent by alphas that don't assign the groups fall back to computing the map from
+// the membership state of this alpha.
+func requestGroupMap(req *pb.RestoreRequest, manifest *Manifest) map[string]uint32 {
+	if len(req.PredicateGroups) == 0 {
+		return restoreGroupMap(manifest, GetMembershipState())
+	}
+	predGroups := make(map[string]uint32, len(req.PredicateGroups))
+	for _, pg := range req.PredicateGroups {
+		predGroups[pg.Predicate] = pg.GroupId
+	}
+	return predGroups
+}
+
+// numBackupFiles returns the number of backup files that will be loaded from the manifests.
+func numBackupFiles(manifests []*Manifest) int {
+	var num int
+	for _, manifest := range manifests {
+		if manifest.Since == 0 {
+			continue
+		}
+		num += len(manifest.Groups)
+	}
+	return num
+}
+
+// backupFilePaths returns the paths of the backup files that would be loaded from the
+// manifests, in the order they would be loaded.
+func backupFilePaths(manifests []*Manifest) []string {
+	var paths []string
+	for _, manifest := range manifests {
+		if manifest.Since == 0 || len(manifest.Groups) == 0 {
+			continue
+		}
+		dir := filepath.Dir(manifest.Path)
+		gids := make([]uint32, 0, len(manifest.Groups))
+		for gid := range manifest.Groups {
+			gids = append(gids, gid)
+		}
+		sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
+		for _, gid := range gids {
+			paths = append(paths, filepath.Join(dir, backupName(manifest.Since, gid)))
+		}
+	}
+	return paths
+}
+
+// backupFileAlgorithms maps the paths of the backup files that would be loaded from the
+// manifests to the algorithm they were encrypted with, which can change within a series.
+func backupFileAlgorithms(manifests []*Manifest) map[string]string {
+	algs := make(map[string]string)
+	for _, manifest := range manifests {
+		for _, path := range backupFilePaths([]*Manifest{manifest}) {
+			algs[path] = manifest.Algorithm
+		}
+	}
+	return algs
+}
+
+// verifyBackupFiles reads the backup files at the given paths to verify the checksums of
+// their data, with up to concurrency files read at a time. The data of a backup file is
+// compressed with gzip, which checks the CRC-32 of the data once it's read to the end. All
+// the files are verified even if some of them fail, so that the error reports all the
+// damaged files at once.
+func verifyBackupFiles(ctx context.Context, h UriHandler, uri *url.URL, paths []string,
+	algs map[string]string, key x.SensitiveByteSlice, concurrency int) (*RestoreVerification, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	start := time.Now()
+
+	var mu sync.Mutex
+	var failures []string
+	var verified int
+	pathCh := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range pathCh {
+				err := verifyBackupFile(h, uri, path, algs[path], key)
+				mu.Lock()
+				if err != nil {
+					failures = append(failures, fmt.Sprintf("%s: %v", path, err))
+				} else {
+					verified++
+				}
+				mu.Unlock()
 			}
-			gzReader, err := gzip.NewReader(r)
-			if err != nil {
-				return 0, errors.Wrapf(err, "couldn't create gzip reader")
+		}()
+	}
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			break
+		}
+		pathCh <- path
+	}
+	close(pathCh)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrapf(err, "while verifying the backup files")
+	}
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return nil, errors.Errorf("%d of %d backup files failed the checksum verification: %s",
+			len(failures), len(paths), strings.Join(failures, "; "))
+	}
+	glog.Infof("Verified the checksums of %d backup files in %s", verified,
+		time.Since(start).Round(time.Millisecond))
+	return &RestoreVerification{FilesVerified: verified, Duration: time.Since(start)}, nil
+}
+
+// verifyBackupFile decrypts and decompresses the backup file at the given path to the end,
+// which fails if its data doesn't match its checksum.
+func verifyBackupFile(h UriHandler, uri *url.URL, path, alg string,
+	key x.SensitiveByteSlice) error {
+	fp, err := h.OpenBackupFile(uri, path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	r, err := enc.GetReaderFor(alg, key, fp)
+	if err != nil {
+		return errors.Wrapf(err, "cannot get encrypted reader")
+	}
+	gzReader, err := gzip.NewReader(r)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create gzip reader")
+	}
+	if _, err := io.Copy(ioutil.Discard, gzReader); err != nil {
+		return err
+	}
+	return gzReader.Close()
+}
+
+// indexesToSkip returns the predicates whose indexes must not be restored according to the
+// rebuildIndexes option of the restore request. It's "all" to restore all of them, which is
+// the default, "none" to restore none or a comma-separated list of the predicates to restore.
+func indexesToSkip(rebuildIndexes string, preds []string) (predicateSet, error) {
+	skip := make(predicateSet)
+	switch strings.TrimSpace(rebuildIndexes) {
+	case "", "all":
+		return skip, nil
+	case "none":
+		for _, pred := range preds {
+			skip[pred] = struct{}{}
+		}
+		return skip, nil
+	}
+
+	rebuild := make(predicateSet)
+	for _, pred := range strings.Split(rebuildIndexes, ",") {
+		pred = strings.TrimSpace(pred)
+		if pred == "" {
+			return nil, errors.Errorf("invalid list of predicates to rebuild indexes for: %q",
+				rebuildIndexes)
+		}
+		rebuild[pred] = struct{}{}
+	}
+	for _, pred := range preds {
+		if _, ok := rebuild[pred]; !ok {
+			skip[pred] = struct{}{}
+		}
+	}
+	return skip, nil
+}
+
+// dropSkippedIndexes removes the indexes, reverse edges and counts from the schema of the
+// predicates whose indexes were not restored, so that the queries that need them fail instead
+// of returning wrong results. It returns the original schema of the predicates that had any.
+// Applying it again with an alter operation rebuilds them.
+func dropSkippedIndexes(skip predicateSet) ([]*pb.SchemaUpdate, error) {
+	preds := make([]string, 0, len(skip))
+	for pred := range skip {
+		preds = append(preds, pred)
+	}
+	sort.Strings(preds)
+
+	var skipped []*pb.SchemaUpdate
+	for _, pred := range preds {
+		txn := pstore.NewTransactionAt(1, false)
+		item, err := txn.Get(x.SchemaKey(pred))
+		if err == badger.ErrKeyNotFound {
+			txn.Discard()
+			continue
+		}
+		if err != nil {
+			txn.Discard()
+			return nil, err
+		}
+		var update pb.SchemaUpdate
+		err = item.Value(func(val []byte) error {
+			return update.Unmarshal(val)
+		})
+		txn.Discard()
+		if err != nil {
+			return nil, err
+		}
+		if update.Directive == pb.SchemaUpdate_NONE && !update.Count {
+			continue
+		}
+
+		skipped = append(skipped, proto.Clone(&update).(*pb.SchemaUpdate))
+		update.Directive = pb.SchemaUpdate_NONE
+		update.Tokenizer = nil
+		update.Count = false
+		// Upserts need an index.
+		update.Upsert = false
+		if err := updateSchema(&update); err != nil {
+			return nil, err
+		}
+	}
+	return skipped, nil
+}
+
+// writeBackup loads the files of the backup into this group. If the request skips errors, the
+// predicates that can't be restored are skipped and returned instead of failing the restore.
+// A file that can't be read skips all the predicates of this group in it. The values of the
+// predicates coerced by coerce are converted as they're loaded, and the time taken to load
+// each predicate is recorded in stats.
+func writeBackup(ctx context.Context, req *pb.RestoreRequest, predGroups map[string]uint32,
+	skipIndexes predicateSet, coerce *typeCoercion, stats *ingestStats,
+	numFiles int) (predicateSet, error) {
+	progress := restoreProgressOf(req.RestoreId)
+	progress.setPhase("ingesting")
+	key, err := restoreEncKey(req)
+	if err != nil {
+		return nil, err
+	}
+	types, err := restoreTypeFilter(req)
+	if err != nil {
+		return nil, err
+	}
+	var skipped predicateSet
+	if req.SkipErrors {
+		skipped = make(predicateSet)
+	}
+
+	var loadedFiles int
+	res := LoadBackup(req.Location, req.BackupId,
+		func(r io.Reader, groupId int, preds predicateSet, manifest *Manifest) (uint64, error) {
+			defer func() {
+				loadedFiles++
+				progress.update(func(progress *pb.RestoreProgress) {
+					progress.Percent = uint32(loadedFiles * 100 / numFiles)
+				})
+			}()
+			if err := checkRestoreCancelled(req); err != nil {
+				return 0, err
 			}
 
-			maxUid, err := loadFromBackup(pstore, gzReader, req.RestoreTs, preds)
-			if err != nil {
-				return 0, errors.Wrapf(err, "cannot write backup")
+			// Only restore the predicates assigned to this group. The file is still read
+			// when none are since it contains a copy of the types.
+			groupPreds := make(predicateSet)
+			for pred := range preds {
+				if predGroups[pred] == req.GroupId {
+					groupPreds[pred] = struct{}{}
+				}
 			}
 
-			if maxUid == 0 {
-				// No need to update the lease, return here.
+			maxUid, err := loadBackupFile(r, key, manifest, req.RestoreTs, req.UidOffset,
+				groupPreds, skipIndexes, skipped, types, coerce, stats,
+				int64(req.BatchSizeMb)<<20, progress)
+			if err != nil {
+				if !req.SkipErrors {
+					return 0, errors.Wrapf(err, "cannot write backup")
+				}
+				glog.Errorf("Skipping the predicates of a backup file of group %d, which "+
+					"can't be restored: %v", groupId, err)
+				for pred := range groupPreds {
+					skipped[pred] = struct{}{}
+				}
 				return 0, nil
 			}
 
-			// Use the value of maxUid to update the uid lease.
-			pl := groups().connToZeroLeader()
-			if pl == nil {
-				return 0, errors.Errorf(
-					"cannot update uid lease due to no connection to zero leader")
-			}
-			zc := pb.NewZeroClient(pl.Get())
-			if _, err = zc.AssignUids(ctx, &pb.Num{Val: maxUid}); err != nil {
-				return 0, errors.Wrapf(err, "cannot update max uid lease after restore.")
+			if err := updateUidLease(ctx, maxUid); err != nil {
+				return 0, err
 			}
 
 			// We return the maxUid to enforce the signature of the method but it will
@@ -274,7 +2449,176 @@ func writeBackup(ctx context.Context, req *pb.RestoreRequest) error {
 			return maxUid, nil
 		})
 	if res.Err != nil {
-		return errors.Wrapf(res.Err, "cannot write backup")
+		return nil, errors.Wrapf(res.Err, "cannot write backup")
+	}
+	if err := dropSkippedPredicates(skipped); err != nil {
+		return nil, err
+	}
+	return skipped, nil
+}
+
+// loadBackupFile decrypts and decompresses a backup file and loads it into the p directory of
+// this alpha. The file is decrypted with the algorithm recorded in the manifest of its backup.
+func loadBackupFile(r io.Reader, key x.SensitiveByteSlice, manifest *Manifest,
+	restoreTs, uidOffset uint64, preds, skipIndexes, skipped predicateSet,
+	types *typeFilter, coerce *typeCoercion, stats *ingestStats, batchSize int64,
+	progress *restoreProgressTracker) (uint64, error) {
+	r, err := enc.GetReaderFor(manifest.Algorithm, key, r)
+	if err != nil {
+		return 0, errors.Wrapf(err, "cannot get encrypted reader")
+	}
+	gzReader, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, errors.Wrapf(err, "couldn't create gzip reader")
+	}
+	return loadFromBackup(pstore, gzReader, manifest.Version, restoreTs, uidOffset, preds, skipIndexes,
+		skipped, types, coerce, stats, batchSize, func(pred string) {
+			progress.update(func(progress *pb.RestoreProgress) {
+				progress.Predicate = pred
+			})
+		})
+}
+
+// restoreTypeFilter returns the filter of the types whose definitions are restored by the
+// request, or nil if all of them are. The types can either be included or excluded.
+func restoreTypeFilter(req *pb.RestoreRequest) (*typeFilter, error) {
+	if len(req.IncludeTypes) > 0 && len(req.ExcludeTypes) > 0 {
+		return nil, errors.Errorf("includeTypes and excludeTypes can't both be set")
+	}
+	toSet := func(types []string) (map[string]struct{}, error) {
+		set := make(map[string]struct{}, len(types))
+		for _, typ := range types {
+			typ = strings.TrimSpace(typ)
+			if typ == "" {
+				return nil, errors.Errorf("the names of the types to restore can't be empty")
+			}
+			set[typ] = struct{}{}
+		}
+		return set, nil
+	}
+	switch {
+	case len(req.IncludeTypes) > 0:
+		include, err := toSet(req.IncludeTypes)
+		if err != nil {
+			return nil, err
+		}
+		return &typeFilter{include: include}, nil
+	case len(req.ExcludeTypes) > 0:
+		exclude, err := toSet(req.ExcludeTypes)
+		if err != nil {
+			return nil, err
+		}
+		return &typeFilter{exclude: exclude}, nil
+	}
+	return nil, nil
+}
+
+// dropSkippedPredicates drops the data and the schema of the predicates skipped by a restore,
+// some of which may have been loaded before they failed, so that none of it is left behind.
+func dropSkippedPredicates(skipped predicateSet) error {
+	for pred := range skipped {
+		if err := pstore.DropPrefix(x.PredicatePrefix(pred)); err != nil {
+			return errors.Wrapf(err, "cannot drop the data of skipped predicate %s", pred)
+		}
+		if err := pstore.DropPrefix(x.SchemaKey(pred)); err != nil {
+			return errors.Wrapf(err, "cannot drop the schema of skipped predicate %s", pred)
+		}
+	}
+	return nil
+}
+
+func writeBulkOutput(ctx context.Context, req *pb.RestoreRequest, predGroups map[string]uint32,
+	skipIndexes predicateSet, pdirs []string, manifest *Manifest) (predicateSet, error) {
+	progress := restoreProgressOf(req.RestoreId)
+	progress.setPhase("ingesting")
+	key, err := restoreEncKey(req)
+	if err != nil {
+		return nil, err
+	}
+	types, err := restoreTypeFilter(req)
+	if err != nil {
+		return nil, err
+	}
+	groupPreds := make(predicateSet)
+	for pred, gid := range predGroups {
+		if gid == req.GroupId {
+			groupPreds[pred] = struct{}{}
+		}
+	}
+	var skipped predicateSet
+	if req.SkipErrors {
+		skipped = make(predicateSet)
+	}
+
+	// Every shard is read since each of them contains a copy of the types.
+	var maxUid uint64
+	for i, pdir := range pdirs {
+		if err := checkRestoreCancelled(req); err != nil {
+			return nil, err
+		}
+		uid, err := loadFromBulkOutput(pstore, pdir, key, req.RestoreTs, groupPreds,
+			skipIndexes, types, func(pred string) {
+				progress.update(func(progress *pb.RestoreProgress) {
+					progress.Predicate = pred
+				})
+			})
+		switch {
+		case err != nil && !req.SkipErrors:
+			return nil, err
+		case err != nil:
+			// Each predicate is in a single shard, so only the ones of this shard are skipped.
+			glog.Errorf("Skipping the predicates of bulk loader output at %s, which can't be "+
+				"restored: %v", pdir, err)
+			gid, gerr := x.ReadGroupIdFile(pdir)
+			if gerr != nil {
+				return nil, errors.Wrapf(gerr, "cannot read the group of bulk loader output "+
+					"at %s", pdir)
+			}
+			for _, pred := range manifest.Groups[gid] {
+				if _, ok := groupPreds[pred]; ok {
+					skipped[pred] = struct{}{}
+				}
+			}
+		case uid > maxUid:
+			maxUid = uid
+		}
+		progress.update(func(progress *pb.RestoreProgress) {
+			progress.Percent = uint32((i + 1) * 100 / len(pdirs))
+		})
+	}
+	if err := dropSkippedPredicates(skipped); err != nil {
+		return nil, err
+	}
+	return skipped, updateUidLease(ctx, maxUid)
+}
+
+// restoreEncKey reads the key to decrypt the data to restore with the encryption options of
+// the request.
+func restoreEncKey(req *pb.RestoreRequest) (x.SensitiveByteSlice, error) {
+	cfg, err := getEncConfig(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to get encryption config")
+	}
+	key, err := enc.ReadKey(cfg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read key")
+	}
+	return key, nil
+}
+
+// updateUidLease moves the uid lease of the cluster past the max uid of the restored data.
+func updateUidLease(ctx context.Context, maxUid uint64) error {
+	if maxUid == 0 {
+		// No need to update the lease.
+		return nil
+	}
+	pl := groups().connToZeroLeader()
+	if pl == nil {
+		return errors.Errorf("cannot update uid lease due to no connection to zero leader")
+	}
+	zc := pb.NewZeroClient(pl.Get())
+	if _, err := zc.AssignUids(ctx, &pb.Num{Val: maxUid}); err != nil {
+		return errors.Wrapf(err, "cannot update max uid lease after restore.")
 	}
 	return nil
 }
@@ -22,15 +22,23 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger/v2"
 	"github.com/dgraph-io/badger/v2/options"
 	bpb "github.com/dgraph-io/badger/v2/pb"
+	"github.com/dgryski/go-farm"
+	"github.com/golang/glog"
 	"github.com/pkg/errors"
 
 	"github.com/dgraph-io/dgraph/ee/enc"
 	"github.com/dgraph-io/dgraph/posting"
 	"github.com/dgraph-io/dgraph/protos/pb"
+	"github.com/dgraph-io/dgraph/tok"
+	"github.com/dgraph-io/dgraph/types"
 	"github.com/dgraph-io/dgraph/x"
 )
 
@@ -40,14 +48,19 @@ func RunRestore(pdir, location, backupId string, key x.SensitiveByteSlice) LoadR
 	if err := os.MkdirAll(pdir, 0700); err != nil {
 		return LoadResult{0, 0, err}
 	}
+	release, err := acquireBackupArchive(location)
+	if err != nil {
+		return LoadResult{0, 0, err}
+	}
+	defer release()
 
 	// Scan location for backup files and load them. Each file represents a node group,
 	// and we create a new p dir for each.
 	return LoadBackup(location, backupId,
-		func(r io.Reader, groupId int, preds predicateSet) (uint64, error) {
+		func(r io.Reader, groupId int, preds predicateSet, manifest *Manifest) (uint64, error) {
 
 			dir := filepath.Join(pdir, fmt.Sprintf("p%d", groupId))
-			r, err := enc.GetReader(key, r)
+			r, err := enc.GetReaderFor(manifest.Algorithm, key, r)
 			if err != nil {
 				return 0, err
 			}
@@ -75,7 +88,8 @@ func RunRestore(pdir, location, backupId string, key x.SensitiveByteSlice) LoadR
 			if !pathExist(dir) {
 				fmt.Println("Creating new db:", dir)
 			}
-			maxUid, err := loadFromBackup(db, gzReader, 0, preds)
+			maxUid, err := loadFromBackup(db, gzReader, manifest.Version, 0, 0, preds, nil, nil, nil, nil,
+				nil, 0, nil)
 			if err != nil {
 				return 0, err
 			}
@@ -83,27 +97,332 @@ func RunRestore(pdir, location, backupId string, key x.SensitiveByteSlice) LoadR
 		})
 }
 
+// typeFilter selects the types whose definitions are restored. A nil filter restores all of
+// them.
+type typeFilter struct {
+	// include holds the types that are restored. If it's nil, all the types but the ones in
+	// exclude are restored.
+	include map[string]struct{}
+	exclude map[string]struct{}
+}
+
+// restores returns whether the definition of the given type is restored.
+func (f *typeFilter) restores(typ string) bool {
+	if f == nil {
+		return true
+	}
+	if f.include != nil {
+		_, ok := f.include[typ]
+		return ok
+	}
+	_, ok := f.exclude[typ]
+	return !ok
+}
+
+// typeCoercion converts the values of some predicates to another type while they're
+// restored, e.g. so that a predicate stored as a string in the backup is restored as an int.
+// A nil coercion converts nothing.
+type typeCoercion struct {
+	// targets maps the coerced predicates to the types their values are converted to.
+	targets map[string]types.TypeID
+
+	sync.Mutex
+	// reports holds the number of values converted and skipped for each coerced predicate.
+	reports map[string]*pb.CoercionReport
+}
+
+// newTypeCoercion returns the coercion of the predicates of a restore request, or nil if none
+// is coerced. Only the scalar types can be coerced to, except for password.
+func newTypeCoercion(coercions []*pb.TypeCoercion) (*typeCoercion, error) {
+	if len(coercions) == 0 {
+		return nil, nil
+	}
+	c := &typeCoercion{
+		targets: make(map[string]types.TypeID, len(coercions)),
+		reports: make(map[string]*pb.CoercionReport, len(coercions)),
+	}
+	for _, coercion := range coercions {
+		pred := strings.TrimSpace(coercion.Predicate)
+		if pred == "" {
+			return nil, errors.Errorf("the predicates to coerce can't be empty")
+		}
+		if _, ok := c.targets[pred]; ok {
+			return nil, errors.Errorf("predicate %s can only be coerced once", pred)
+		}
+		typ, ok := types.TypeForName(strings.TrimSpace(coercion.Type))
+		if !ok || typ == types.UidID || typ == types.PasswordID {
+			return nil, errors.Errorf("cannot coerce predicate %s to type %q: only the scalar "+
+				"types other than password are supported", pred, coercion.Type)
+		}
+		c.targets[pred] = typ
+	}
+	return c, nil
+}
+
+// coerces returns whether the values of the given predicate are converted.
+func (c *typeCoercion) coerces(pred string) bool {
+	if c == nil {
+		return false
+	}
+	_, ok := c.targets[pred]
+	return ok
+}
+
+// coerceSchema changes the type in the schema of a coerced predicate. The index keys of the
+// predicate aren't restored since they were computed from the values before they were
+// converted, so the tokenizers that don't apply to the new type are dropped from its schema.
+// The other ones are dropped by the restore along with those of the skipped indexes.
+func (c *typeCoercion) coerceSchema(update *pb.SchemaUpdate) error {
+	typ := c.targets[update.Predicate]
+	if update.ValueType == pb.Posting_UID {
+		return errors.Errorf("cannot coerce predicate %s, which is a uid predicate, to type %s",
+			update.Predicate, typ.Name())
+	}
+	update.ValueType = pb.Posting_ValType(typ)
+	var tokenizers []string
+	for _, name := range update.Tokenizer {
+		if tokenizer, ok := tok.GetTokenizer(name); ok && tokenizer.Type() == typ.Name() {
+			tokenizers = append(tokenizers, name)
+			continue
+		}
+		glog.Warningf("Dropping the %s index of predicate %s, which doesn't apply to type %s",
+			name, update.Predicate, typ.Name())
+	}
+	update.Tokenizer = tokenizers
+	if len(tokenizers) == 0 {
+		update.Directive = pb.SchemaUpdate_NONE
+		update.Upsert = false
+	}
+	update.Lang = update.Lang && typ == types.StringID
+	return nil
+}
+
+// coercePostings converts the values in the posting list of a coerced predicate to its type.
+// The values that can't be converted are removed from the list. The values of list predicates
+// are identified by their fingerprint, which changes along with them.
+func (c *typeCoercion) coercePostings(pred string, pl *pb.BackupPostingList) {
+	typ := c.targets[pred]
+	var coerced, failed uint64
+	removed := make(map[uint64]struct{})
+	var added []uint64
+	postings := pl.Postings[:0]
+	for _, p := range pl.Postings {
+		isValue := p.PostingType != pb.Posting_REF || len(p.Value) > 0
+		if !isValue || p.ValType == pb.Posting_ValType(typ) {
+			postings = append(postings, p)
+			continue
+		}
+		hasLang := p.PostingType == pb.Posting_VALUE_LANG || len(p.LangTag) > 0
+		if err := coerceValue(p, typ); err != nil || (hasLang && typ != types.StringID) {
+			failed++
+			removed[p.Uid] = struct{}{}
+			continue
+		}
+		coerced++
+		if !hasLang && p.Uid != math.MaxUint64 {
+			removed[p.Uid] = struct{}{}
+			p.Uid = farm.Fingerprint64(p.Value)
+			added = append(added, p.Uid)
+		}
+		postings = append(postings, p)
+	}
+	pl.Postings = postings
+
+	if len(removed) > 0 {
+		uids := pl.Uids[:0]
+		for _, uid := range pl.Uids {
+			if _, ok := removed[uid]; !ok {
+				uids = append(uids, uid)
+			}
+		}
+		uids = append(uids, added...)
+		sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+		sort.SliceStable(pl.Postings, func(i, j int) bool {
+			return pl.Postings[i].Uid < pl.Postings[j].Uid
+		})
+		// Values that become equal once converted are only kept once.
+		pl.Uids = uids[:0]
+		for i, uid := range uids {
+			if i == 0 || uid != uids[i-1] {
+				pl.Uids = append(pl.Uids, uid)
+			}
+		}
+		postings := pl.Postings[:0]
+		for i, p := range pl.Postings {
+			if i == 0 || p.Uid != pl.Postings[i-1].Uid {
+				postings = append(postings, p)
+			}
+		}
+		pl.Postings = postings
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	report, ok := c.reports[pred]
+	if !ok {
+		report = &pb.CoercionReport{Predicate: pred}
+		c.reports[pred] = report
+	}
+	report.Coerced += coerced
+	report.Failed += failed
+}
+
+// coerceValue converts the value of the posting p to the type typ.
+func coerceValue(p *pb.Posting, typ types.TypeID) error {
+	val, err := types.Convert(types.Val{Tid: types.TypeID(p.ValType), Value: p.Value}, typ)
+	if err != nil {
+		return err
+	}
+	out := types.ValueForType(types.BinaryID)
+	if err := types.Marshal(val, &out); err != nil {
+		return err
+	}
+	p.Value = out.Value.([]byte)
+	p.ValType = pb.Posting_ValType(typ)
+	return nil
+}
+
+// report returns the number of values converted and skipped for each of the coerced
+// predicates restored so far, sorted by predicate.
+func (c *typeCoercion) report() []*pb.CoercionReport {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	reports := make([]*pb.CoercionReport, 0, len(c.reports))
+	for _, report := range c.reports {
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Predicate < reports[j].Predicate
+	})
+	return reports
+}
+
+// ingestStats measures the time taken to ingest each predicate of a backup and the size in
+// bytes of its keys and values, so that the predicates that make a restore slow can be found.
+// A nil ingestStats measures nothing.
+type ingestStats struct {
+	sync.Mutex
+	preds map[string]*pb.PredicateIngestion
+}
+
+func newIngestStats() *ingestStats {
+	return &ingestStats{preds: make(map[string]*pb.PredicateIngestion)}
+}
+
+// record adds the time taken to ingest some keys of the given predicate and their size. A
+// predicate is recorded once for each backup file it's in.
+func (s *ingestStats) record(pred string, size uint64, elapsed time.Duration) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	ingestion, ok := s.preds[pred]
+	if !ok {
+		ingestion = &pb.PredicateIngestion{Predicate: pred}
+		s.preds[pred] = ingestion
+	}
+	ingestion.Bytes += size
+	ingestion.DurationNs += uint64(elapsed)
+}
+
+// report returns the ingestion of each predicate restored so far, the slowest first.
+func (s *ingestStats) report() []*pb.PredicateIngestion {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	ingestions := make([]*pb.PredicateIngestion, 0, len(s.preds))
+	for _, ingestion := range s.preds {
+		ingestions = append(ingestions, ingestion)
+	}
+	sortIngestions(ingestions)
+	return ingestions
+}
+
+// sortIngestions sorts the ingestions of the predicates the slowest first. The ingestions that
+// took as long are sorted by size, the largest first, and then by predicate.
+func sortIngestions(ingestions []*pb.PredicateIngestion) {
+	sort.Slice(ingestions, func(i, j int) bool {
+		a, b := ingestions[i], ingestions[j]
+		switch {
+		case a.DurationNs != b.DurationNs:
+			return a.DurationNs > b.DurationNs
+		case a.Bytes != b.Bytes:
+			return a.Bytes > b.Bytes
+		}
+		return a.Predicate < b.Predicate
+	})
+}
+
 // loadFromBackup reads the backup, converts the keys and values to the required format,
 // and loads them to the given badger DB. The set of predicates is used to avoid restoring
 // values from predicates no longer assigned to this group.
+// The version is the version of the backup format the backup was written in. Backups written
+// in a newer version than backupVersion can't be loaded.
 // If restoreTs is greater than zero, the key-value pairs will be written with that timestamp.
 // Otherwise, the original value is used.
+// If uidOffset is greater than zero, all the uids in the keys and posting lists are shifted by
+// it, so that the references between the restored nodes are kept.
+// The index, reverse and count keys of the predicates in skipIndexes are not loaded, and
+// neither are the definitions of the types that aren't selected by types.
+// If skipped is not nil, the predicates whose key-value pairs can't be converted are added to it
+// instead of failing the load, and the rest of their keys are ignored. Some of their keys may
+// have been loaded already, so it's up to the caller to drop them.
+// The values of the predicates coerced by coerce are converted to their new type, and their
+// index, reverse and count keys are not loaded.
+// If stats is not nil, the time taken to load the keys of each predicate and their size are
+// recorded in it.
+// If batchSize is not zero, the keys are applied to the DB in batches of about that many bytes.
+// If onPredicate is not nil, it's called with the name of each predicate as it gets restored.
 // TODO(DGRAPH-1234): Check whether restoreTs can be removed.
-func loadFromBackup(db *badger.DB, r io.Reader, restoreTs uint64, preds predicateSet) (
-	uint64, error) {
+func loadFromBackup(db *badger.DB, r io.Reader, version int, restoreTs, uidOffset uint64,
+	preds, skipIndexes, skipped predicateSet, types *typeFilter, coerce *typeCoercion,
+	stats *ingestStats, batchSize int64, onPredicate func(pred string)) (maxUid uint64,
+	rerr error) {
+	if version > backupVersion {
+		return 0, errors.Errorf("cannot restore a backup written in version %d of the backup "+
+			"format. The latest supported version is %d", version, backupVersion)
+	}
 	br := bufio.NewReaderSize(r, 16<<10)
 	unmarshalBuf := make([]byte, 1<<10)
 
-	// Delete schemas and types. Each backup file should have a complete copy of the schema.
-	if err := db.DropPrefix([]byte{x.ByteSchema}); err != nil {
-		return 0, err
+	// Delete the schema of the predicates to restore and the types. Each backup file has a
+	// complete copy of the types, but only the schema of the predicates in its group. The
+	// files of several backup groups can be restored into the same DB, so the schema of the
+	// other predicates must be kept.
+	for pred := range preds {
+		if err := db.DropPrefix(x.SchemaKey(pred)); err != nil {
+			return 0, err
+		}
 	}
 	if err := db.DropPrefix([]byte{x.ByteType}); err != nil {
 		return 0, err
 	}
 
-	loader := db.NewKVLoader(16)
-	var maxUid uint64
+	loader := newRestoreLoader(db, batchSize)
+	defer func() {
+		// Wait for the pending writes even if the load failed, so that no write lands after
+		// the caller drops the data loaded so far.
+		if err := loader.finish(); rerr == nil {
+			rerr = err
+		}
+	}()
+	var lastPred string
+	// The keys of a predicate are contiguous in a backup, so the time taken to load them is
+	// measured from its first key to the first key of the next predicate.
+	var statPred string
+	var statSize uint64
+	var statStart time.Time
+	recordStats := func() {
+		if statPred != "" {
+			stats.record(statPred, statSize, time.Since(statStart))
+		}
+	}
 	for {
 		var sz uint64
 		err := binary.Read(br, binary.LittleEndian, &sz)
@@ -147,6 +466,37 @@ func loadFromBackup(db *badger.DB, r io.Reader, restoreTs uint64, preds predicat
 			if _, ok := preds[parsedKey.Attr]; !parsedKey.IsType() && !ok {
 				continue
 			}
+			_, skipIndex := skipIndexes[parsedKey.Attr]
+			skipIndex = skipIndex || coerce.coerces(parsedKey.Attr)
+			if skipIndex && (parsedKey.IsIndex() || parsedKey.IsReverse() ||
+				parsedKey.IsCountOrCountRev()) {
+				continue
+			}
+			if parsedKey.IsType() && !types.restores(parsedKey.Attr) {
+				continue
+			}
+			if _, ok := skipped[parsedKey.Attr]; ok && !parsedKey.IsType() {
+				continue
+			}
+			if onPredicate != nil && !parsedKey.IsType() && parsedKey.Attr != lastPred {
+				lastPred = parsedKey.Attr
+				onPredicate(lastPred)
+			}
+			if stats != nil && !parsedKey.IsType() {
+				if parsedKey.Attr != statPred {
+					recordStats()
+					statPred, statSize, statStart = parsedKey.Attr, 0, time.Now()
+				}
+				statSize += uint64(len(kv.Key) + len(kv.Value))
+			}
+			if uidOffset > 0 {
+				if restoreKey, err = offsetKey(parsedKey, restoreKey, uidOffset); err != nil {
+					return 0, err
+				}
+				if parsedKey, err = x.Parse(restoreKey); err != nil {
+					return 0, errors.Wrapf(err, "could not parse key %s", hex.Dump(restoreKey))
+				}
+			}
 
 			// Update the max id that has been seen while restoring this backup.
 			if parsedKey.Uid > maxUid {
@@ -159,67 +509,196 @@ func loadFromBackup(db *badger.DB, r io.Reader, restoreTs uint64, preds predicat
 				kv.Version = restoreTs
 			}
 
-			switch kv.GetUserMeta()[0] {
-			case posting.BitEmptyPosting, posting.BitCompletePosting, posting.BitDeltaPosting:
-				backupPl := &pb.BackupPostingList{}
-				if err := backupPl.Unmarshal(kv.Value); err != nil {
-					return 0, errors.Wrapf(err, "while reading backup posting list")
-				}
-				pl := posting.FromBackupPostingList(backupPl)
-				shouldSplit := pl.Size() >= (1<<20)/2 && len(pl.Pack.Blocks) > 1
-
-				if !shouldSplit || parsedKey.HasStartUid || len(pl.GetSplits()) > 0 {
-					// This covers two cases.
-					// 1. The list is not big enough to be split.
-					// 2. This key is storing part of a multi-part list. Write each individual
-					// part without rolling the key first. This part is here for backwards
-					// compatibility. New backups are not affected because there was a change
-					// to roll up lists into a single one.
-					restoreVal, err := pl.Marshal()
-					if err != nil {
-						return 0, errors.Wrapf(err, "while converting backup posting list")
-					}
-					kv.Key = restoreKey
-					kv.Value = restoreVal
-					if err := loader.Set(kv); err != nil {
-						return 0, err
-					}
-				} else {
-					// This is a complete list. It should be rolled up to avoid writing
-					// a list that is too big to be read back from disk.
-					l := posting.NewList(restoreKey, pl, kv.Version)
-					kvs, err := l.Rollup()
-					if err != nil {
-						// TODO: wrap errors in this file for easier debugging.
-						return 0, err
-					}
-					for _, kv := range kvs {
-						if err := loader.Set(kv); err != nil {
-							return 0, err
-						}
-					}
+			kvs, err := restoreKVs(kv, restoreKey, parsedKey, uidOffset, coerce)
+			if err != nil {
+				if skipped == nil || parsedKey.IsType() {
+					return 0, err
 				}
-
-			case posting.BitSchemaPosting:
-				// Schema and type keys are not stored in an intermediate format so their
-				// value can be written as is.
-				kv.Key = restoreKey
-				if err := loader.Set(kv); err != nil {
+				glog.Errorf("Skipping predicate %s, which can't be restored: %v",
+					parsedKey.Attr, err)
+				skipped[parsedKey.Attr] = struct{}{}
+				continue
+			}
+			for _, kv := range kvs {
+				if err := loader.set(kv); err != nil {
 					return 0, err
 				}
+			}
+		}
+	}
+	recordStats()
+	return maxUid, nil
+}
 
-			default:
-				return 0, errors.Errorf(
-					"Unexpected meta %d for key %s", kv.UserMeta[0], hex.Dump(kv.Key))
+// restoreLoader writes the key-value pairs restored from a backup to the DB in batches. The
+// pairs are buffered until they add up to the batch size, and the batch is then applied and its
+// writes waited for before the next one is buffered, so the batch size bounds the memory taken
+// by the pending writes. Badger caps the size of a transaction, so a batch larger than that is
+// applied as several transactions written in parallel. With a batch size of zero, all the
+// pairs are in the same batch and their writes are only waited for at the end.
+type restoreLoader struct {
+	db        *badger.DB
+	batchSize int64
+	loader    *badger.KVLoader
+	// size is the number of bytes of the keys and values in the current batch.
+	size int64
+}
+
+func newRestoreLoader(db *badger.DB, batchSize int64) *restoreLoader {
+	return &restoreLoader{db: db, batchSize: batchSize, loader: db.NewKVLoader(16)}
+}
+
+func (l *restoreLoader) set(kv *bpb.KV) error {
+	if err := l.loader.Set(kv); err != nil {
+		return err
+	}
+	if l.batchSize <= 0 {
+		return nil
+	}
+	if l.size += int64(len(kv.Key) + len(kv.Value)); l.size < l.batchSize {
+		return nil
+	}
+	// The loader can't be used once it's finished, even if it failed.
+	err := l.loader.Finish()
+	l.loader, l.size = l.db.NewKVLoader(16), 0
+	return err
+}
+
+// finish applies the last batch and waits for its writes.
+func (l *restoreLoader) finish() error {
+	return l.loader.Finish()
+}
+
+// restoreKVs converts a key-value pair read from a backup into the key-value pairs to write
+// to the restored DB. restoreKey is the key of the pair in the DB and parsedKey its parsed form.
+// The uids in posting lists are shifted by uidOffset, and the values and the schema of the
+// predicates coerced by coerce are converted to their new type.
+func restoreKVs(kv *bpb.KV, restoreKey []byte, parsedKey x.ParsedKey,
+	uidOffset uint64, coerce *typeCoercion) ([]*bpb.KV, error) {
+	switch kv.GetUserMeta()[0] {
+	case posting.BitEmptyPosting, posting.BitCompletePosting, posting.BitDeltaPosting:
+		backupPl := &pb.BackupPostingList{}
+		if err := backupPl.Unmarshal(kv.Value); err != nil {
+			return nil, errors.Wrapf(err, "while reading backup posting list")
+		}
+		if parsedKey.IsData() && coerce.coerces(parsedKey.Attr) {
+			coerce.coercePostings(parsedKey.Attr, backupPl)
+		}
+		if uidOffset > 0 {
+			if err := offsetPostingList(backupPl, uidOffset); err != nil {
+				return nil, errors.Wrapf(err, "while shifting the uids of key %s",
+					hex.Dump(restoreKey))
+			}
+		}
+		pl := posting.FromBackupPostingList(backupPl)
+		shouldSplit := pl.Size() >= (1<<20)/2 && len(pl.Pack.Blocks) > 1
+
+		if !shouldSplit || parsedKey.HasStartUid || len(pl.GetSplits()) > 0 {
+			// This covers two cases.
+			// 1. The list is not big enough to be split.
+			// 2. This key is storing part of a multi-part list. Write each individual
+			// part without rolling the key first. This part is here for backwards
+			// compatibility. New backups are not affected because there was a change
+			// to roll up lists into a single one.
+			restoreVal, err := pl.Marshal()
+			if err != nil {
+				return nil, errors.Wrapf(err, "while converting backup posting list")
 			}
+			kv.Key = restoreKey
+			kv.Value = restoreVal
+			return []*bpb.KV{kv}, nil
+		}
+		// This is a complete list. It should be rolled up to avoid writing
+		// a list that is too big to be read back from disk.
+		l := posting.NewList(restoreKey, pl, kv.Version)
+		kvs, err := l.Rollup()
+		if err != nil {
+			// TODO: wrap errors in this file for easier debugging.
+			return nil, err
+		}
+		return kvs, nil
+
+	case posting.BitSchemaPosting:
+		// Schema and type keys are not stored in an intermediate format so their
+		// value can be written as is.
+		kv.Key = restoreKey
+		if !parsedKey.IsSchema() || !coerce.coerces(parsedKey.Attr) {
+			return []*bpb.KV{kv}, nil
 		}
+		var update pb.SchemaUpdate
+		if err := update.Unmarshal(kv.Value); err != nil {
+			return nil, errors.Wrapf(err, "while reading the schema of %s", parsedKey.Attr)
+		}
+		update.Predicate = parsedKey.Attr
+		if err := coerce.coerceSchema(&update); err != nil {
+			return nil, err
+		}
+		val, err := update.Marshal()
+		if err != nil {
+			return nil, errors.Wrapf(err, "while writing the schema of %s", parsedKey.Attr)
+		}
+		kv.Value = val
+		return []*bpb.KV{kv}, nil
+
+	default:
+		return nil, errors.Errorf(
+			"Unexpected meta %d for key %s", kv.UserMeta[0], hex.Dump(kv.Key))
 	}
+}
 
-	if err := loader.Finish(); err != nil {
-		return 0, err
+// offsetUid shifts the given uid by offset.
+func offsetUid(uid, offset uint64) (uint64, error) {
+	if uid > math.MaxUint64-offset {
+		return 0, errors.Errorf("uid %#x shifted by %#x overflows the uid space", uid, offset)
 	}
+	return uid + offset, nil
+}
 
-	return maxUid, nil
+// offsetKey returns the key that the given key is restored to when the uids are shifted by
+// offset. Only the data and reverse keys hold a uid, so the other keys are returned as they are.
+func offsetKey(parsedKey x.ParsedKey, key []byte, offset uint64) ([]byte, error) {
+	if !parsedKey.IsData() && !parsedKey.IsReverse() {
+		return key, nil
+	}
+	if parsedKey.HasStartUid {
+		return nil, errors.Errorf("cannot shift the uids of a part of a multi-part list of "+
+			"predicate %s. Take a new backup to restore it with a uid offset", parsedKey.Attr)
+	}
+	uid, err := offsetUid(parsedKey.Uid, offset)
+	if err != nil {
+		return nil, err
+	}
+	if parsedKey.IsReverse() {
+		return x.ReverseKey(parsedKey.Attr, uid), nil
+	}
+	return x.DataKey(parsedKey.Attr, uid), nil
+}
+
+// offsetPostingList shifts the uids in a posting list read from a backup by offset. The uids
+// of the postings of a list of values are fingerprints of the values rather than uids of
+// nodes, so such a list, i.e. one with a posting that isn't a reference, is left as it is.
+func offsetPostingList(pl *pb.BackupPostingList, offset uint64) error {
+	for _, p := range pl.Postings {
+		if p.PostingType != pb.Posting_REF {
+			return nil
+		}
+	}
+	if len(pl.Splits) > 0 {
+		return errors.Errorf("cannot shift the uids of a multi-part list. Take a new backup " +
+			"to restore it with a uid offset")
+	}
+	var err error
+	for i, uid := range pl.Uids {
+		if pl.Uids[i], err = offsetUid(uid, offset); err != nil {
+			return err
+		}
+	}
+	for _, p := range pl.Postings {
+		if p.Uid, err = offsetUid(p.Uid, offset); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func fromBackupKey(key []byte) ([]byte, error) {
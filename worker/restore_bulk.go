@@ -0,0 +1,204 @@
+// +build !oss
+
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Dgraph Community License (the "License"); you
+ * may not use this file except in compliance with the License. You
+ * may obtain a copy of the License at
+ *
+ *     https://github.com/dgraph-io/dgraph/blob/master/licenses/DCL.txt
+ */
+
+package worker
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v2"
+	bpb "github.com/dgraph-io/badger/v2/pb"
+	"github.com/pkg/errors"
+
+	"github.com/dgraph-io/dgraph/x"
+)
+
+// bulkOutputDirs returns the p directories of the bulk loader output at the given location,
+// ordered by shard. The bulk loader writes one directory per reduce shard, named after the
+// number of the shard, and each of them holds a p directory with a group_id file. It returns
+// nil if the location is not a local directory with that layout.
+func bulkOutputDirs(location string) ([]string, error) {
+	uri, err := url.Parse(location)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse restore location")
+	}
+	if uri.Scheme != "" && uri.Scheme != "file" {
+		return nil, nil
+	}
+	entries, err := ioutil.ReadDir(uri.Path)
+	if err != nil {
+		// The location may not exist on this alpha. The backup handler reports the error.
+		return nil, nil
+	}
+
+	shards := make(map[int]string)
+	for _, entry := range entries {
+		shard, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		pdir := filepath.Join(uri.Path, entry.Name(), "p")
+		if _, err := os.Stat(filepath.Join(pdir, x.GroupIdFileName)); err != nil {
+			continue
+		}
+		shards[shard] = pdir
+	}
+	var nums []int
+	for shard := range shards {
+		nums = append(nums, shard)
+	}
+	sort.Ints(nums)
+	var dirs []string
+	for _, shard := range nums {
+		dirs = append(dirs, shards[shard])
+	}
+	return dirs, nil
+}
+
+// openBulkOutput opens the DB of a shard of the bulk loader output. It's opened read-only so
+// that several alphas can read the same output.
+func openBulkOutput(pdir string, key x.SensitiveByteSlice) (*badger.DB, error) {
+	db, err := badger.OpenManaged(badger.DefaultOptions(pdir).
+		WithReadOnly(true).
+		WithLogger(nil).
+		WithEncryptionKey(key))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open bulk loader output at %s", pdir)
+	}
+	return db, nil
+}
+
+// bulkOutputManifest builds the manifest of the bulk loader output in the given directories.
+// The bulk loader doesn't write one, so the groups are read from the group_id file of each
+// shard and their predicates from the schema stored in it.
+func bulkOutputManifest(pdirs []string, key x.SensitiveByteSlice) (*Manifest, error) {
+	manifest := &Manifest{Type: "full", Groups: make(map[uint32][]string)}
+	for _, pdir := range pdirs {
+		gid, err := x.ReadGroupIdFile(pdir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read the group of bulk loader output at %s",
+				pdir)
+		}
+		if _, ok := manifest.Groups[gid]; ok {
+			return nil, errors.Errorf("bulk loader output at %s has the same group %d as "+
+				"another shard", pdir, gid)
+		}
+
+		db, err := openBulkOutput(pdir, key)
+		if err != nil {
+			return nil, err
+		}
+		var preds []string
+		err = db.View(func(txn *badger.Txn) error {
+			opt := badger.DefaultIteratorOptions
+			opt.PrefetchValues = false
+			opt.Prefix = x.SchemaPrefix()
+			itr := txn.NewIterator(opt)
+			defer itr.Close()
+			for itr.Rewind(); itr.Valid(); itr.Next() {
+				pk, err := x.Parse(itr.Item().Key())
+				if err != nil {
+					return errors.Wrapf(err, "could not parse key %s",
+						hex.Dump(itr.Item().Key()))
+				}
+				preds = append(preds, pk.Attr)
+			}
+			return nil
+		})
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read the schema of bulk loader output at %s",
+				pdir)
+		}
+		manifest.Groups[gid] = preds
+	}
+	return manifest, nil
+}
+
+// loadFromBulkOutput copies the shard of the bulk loader output in the given directory to the
+// given badger DB. Its keys and values are already in the format of a p directory, so they're
+// written as they are with their version set to restoreTs. The version of schema and type
+// keys is kept. Only the predicates in preds are loaded, and the index, reverse and count keys
+// of the predicates in skipIndexes are left out, and so are the definitions of the types that
+// aren't selected by types. It returns the max uid in the output.
+func loadFromBulkOutput(db *badger.DB, pdir string, key x.SensitiveByteSlice, restoreTs uint64,
+	preds, skipIndexes predicateSet, types *typeFilter, onPredicate func(pred string)) (
+	uint64, error) {
+	bulkDb, err := openBulkOutput(pdir, key)
+	if err != nil {
+		return 0, err
+	}
+	defer bulkDb.Close()
+
+	loader := db.NewKVLoader(16)
+	var maxUid uint64
+	var lastPred string
+	txn := bulkDb.NewTransactionAt(math.MaxUint64, false)
+	defer txn.Discard()
+	itr := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer itr.Close()
+	for itr.Rewind(); itr.Valid(); itr.Next() {
+		item := itr.Item()
+		parsedKey, err := x.Parse(item.Key())
+		if err != nil {
+			return 0, errors.Wrapf(err, "could not parse key %s", hex.Dump(item.Key()))
+		}
+		if _, ok := preds[parsedKey.Attr]; !parsedKey.IsType() && !ok {
+			continue
+		}
+		if _, ok := skipIndexes[parsedKey.Attr]; ok && (parsedKey.IsIndex() ||
+			parsedKey.IsReverse() || parsedKey.IsCountOrCountRev()) {
+			continue
+		}
+		if parsedKey.IsType() && !types.restores(parsedKey.Attr) {
+			continue
+		}
+		if onPredicate != nil && !parsedKey.IsType() && parsedKey.Attr != lastPred {
+			lastPred = parsedKey.Attr
+			onPredicate(lastPred)
+		}
+		if parsedKey.Uid > maxUid {
+			maxUid = parsedKey.Uid
+		}
+
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return 0, errors.Wrapf(err, "cannot read value of key %s", hex.Dump(item.Key()))
+		}
+		kv := &bpb.KV{
+			Key:       item.KeyCopy(nil),
+			Value:     val,
+			UserMeta:  []byte{item.UserMeta()},
+			Version:   item.Version(),
+			ExpiresAt: item.ExpiresAt(),
+		}
+		if !parsedKey.IsSchema() && !parsedKey.IsType() {
+			kv.Version = restoreTs
+		}
+		if err := loader.Set(kv); err != nil {
+			return 0, err
+		}
+	}
+	if err := loader.Finish(); err != nil {
+		return 0, err
+	}
+	return maxUid, nil
+}
@@ -0,0 +1,212 @@
+// +build !oss
+
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Dgraph Community License (the "License"); you
+ * may not use this file except in compliance with the License. You
+ * may obtain a copy of the License at
+ *
+ *     https://github.com/dgraph-io/dgraph/blob/master/licenses/DCL.txt
+ */
+
+package worker
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/pkg/errors"
+
+	"github.com/dgraph-io/dgraph/protos/pb"
+	"github.com/dgraph-io/dgraph/x"
+)
+
+// predicateDigest summarizes the data of a predicate restored from a backup.
+type predicateDigest struct {
+	// count is the number of nodes that have the predicate.
+	count uint64
+	// checksum is the checksum of the schema and all the keys of the predicate.
+	checksum string
+}
+
+// checkDiffRequest returns an error if the request asks for an option that can't be used when
+// the backup is compared with a second one instead of being restored.
+func checkDiffRequest(req *pb.RestoreRequest, bulkDirs []string) error {
+	var option string
+	switch {
+	case len(bulkDirs) > 0:
+		option = "restoring the output of the bulk loader"
+	case req.DryRun:
+		option = "a dry run"
+	case req.UidOffset > 0:
+		option = "a uid offset"
+	case len(req.IncludeTypes) > 0 || len(req.ExcludeTypes) > 0:
+		option = "selecting the types"
+	case len(req.CoerceTypes) > 0:
+		option = "coercing the types of predicates"
+	case req.ReplayWal != "":
+		option = "replaying a write-ahead log"
+	case req.Rebalance:
+		option = "rebalancing"
+	case req.PostRestoreSchema != "":
+		option = "a post-restore schema"
+	case req.Snapshot:
+		option = "taking a snapshot"
+	case req.Compact:
+		option = "compacting the restored data"
+	case req.RebuildIndexes != "" && req.RebuildIndexes != "all":
+		option = "skipping indexes"
+	default:
+		return nil
+	}
+	return errors.Errorf("%s is not supported when comparing backups", option)
+}
+
+// restoreDiff restores the backup of the request and the one it's compared with into scratch
+// directories, and reports the predicates whose data differs between them. The data of the
+// cluster isn't changed. The scratch directories are created under the target directory of
+// the request, if it has one, and removed once the backups are compared.
+func restoreDiff(req *pb.RestoreRequest) (*RestoreResult, error) {
+	key, err := restoreEncKey(req)
+	if err != nil {
+		return nil, err
+	}
+	if req.TargetDir != "" {
+		if err := os.MkdirAll(req.TargetDir, 0700); err != nil {
+			return nil, errors.Wrapf(err, "cannot create target directory %s", req.TargetDir)
+		}
+	}
+	scratch, err := ioutil.TempDir(req.TargetDir, "restore-diff-")
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot create scratch directory")
+	}
+	defer os.RemoveAll(scratch)
+
+	restoreProgressOf(req.RestoreId).setPhase("ingesting")
+	digests, err := restoredDigests(filepath.Join(scratch, "backup"), req.Location,
+		req.BackupId, key)
+	if err != nil {
+		return nil, err
+	}
+	other, err := restoredDigests(filepath.Join(scratch, "other"), req.DiffAgainst,
+		req.DiffAgainstBackupId, key)
+	if err != nil {
+		return nil, err
+	}
+
+	restoreProgressOf(req.RestoreId).setPhase("comparing")
+	diff := diffDigests(digests, other)
+	diff.Location = req.DiffAgainst
+	return &RestoreResult{Location: req.Location, Diff: diff}, nil
+}
+
+// restoredDigests restores the backup at the given location into dir and returns the digests
+// of its predicates.
+func restoredDigests(dir, location, backupId string, key x.SensitiveByteSlice) (
+	map[string]*predicateDigest, error) {
+	if res := RunRestore(dir, location, backupId, key); res.Err != nil {
+		return nil, errors.Wrapf(res.Err, "cannot restore backup at %s", location)
+	}
+	// The backup is restored into a p directory for each of its groups.
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read restored backup at %s", dir)
+	}
+	digests := make(map[string]*predicateDigest)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		pdir := filepath.Join(dir, entry.Name())
+		db, err := badger.OpenManaged(badger.DefaultOptions(pdir).
+			WithEncryptionKey(key).
+			WithLogger(nil))
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot open restored backup at %s", pdir)
+		}
+		err = addPredicateDigests(db, digests)
+		db.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read restored backup at %s", pdir)
+		}
+	}
+	return digests, nil
+}
+
+// addPredicateDigests adds the digests of the predicates of the given DB to digests. The
+// definitions of the types aren't predicates, so they're left out.
+func addPredicateDigests(db *badger.DB, digests map[string]*predicateDigest) error {
+	txn := db.NewTransactionAt(math.MaxUint64, false)
+	defer txn.Discard()
+
+	var preds []string
+	itOpt := badger.DefaultIteratorOptions
+	itOpt.PrefetchValues = false
+	it := txn.NewIterator(itOpt)
+	for it.Rewind(); it.Valid(); it.Next() {
+		pk, err := x.Parse(it.Item().Key())
+		if err != nil {
+			it.Close()
+			return err
+		}
+		if pk.IsType() {
+			continue
+		}
+		digest, ok := digests[pk.Attr]
+		if !ok {
+			digest = &predicateDigest{}
+			digests[pk.Attr] = digest
+			preds = append(preds, pk.Attr)
+		}
+		// The parts of a split posting list belong to the node of the main list.
+		if pk.IsData() && !pk.HasStartUid {
+			digest.count++
+		}
+	}
+	it.Close()
+
+	for _, pred := range preds {
+		checksum, err := predicateChecksum(db, pred, math.MaxUint64)
+		if err != nil {
+			return errors.Wrapf(err, "cannot compute the checksum of %s", pred)
+		}
+		digests[pred].checksum = hex.EncodeToString(checksum)
+	}
+	return nil
+}
+
+// diffDigests compares the digests of the predicates of two backups and returns the
+// predicates whose data differs, ordered by name.
+func diffDigests(digests, other map[string]*predicateDigest) *RestoreDiff {
+	preds := make(map[string]struct{})
+	for pred := range digests {
+		preds[pred] = struct{}{}
+	}
+	for pred := range other {
+		preds[pred] = struct{}{}
+	}
+
+	diff := &RestoreDiff{PredicatesCompared: len(preds)}
+	for pred := range preds {
+		d := PredicateDiff{Predicate: pred}
+		if digest, ok := digests[pred]; ok {
+			d.Count, d.Checksum = digest.count, digest.checksum
+		}
+		if digest, ok := other[pred]; ok {
+			d.OtherCount, d.OtherChecksum = digest.count, digest.checksum
+		}
+		if d.Count != d.OtherCount || d.Checksum != d.OtherChecksum {
+			diff.Predicates = append(diff.Predicates, d)
+		}
+	}
+	sort.Slice(diff.Predicates, func(i, j int) bool {
+		return diff.Predicates[i].Predicate < diff.Predicates[j].Predicate
+	})
+	return diff
+}
@@ -0,0 +1,242 @@
+// +build !oss
+
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Dgraph Community License (the "License"); you
+ * may not use this file except in compliance with the License. You
+ * may obtain a copy of the License at
+ *
+ *     https://github.com/dgraph-io/dgraph/blob/master/licenses/DCL.txt
+ */
+
+package worker
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/raft/raftpb"
+
+	"github.com/dgraph-io/dgraph/protos/pb"
+	"github.com/dgraph-io/dgraph/raftwal"
+	"github.com/dgraph-io/dgraph/x"
+)
+
+// walTxn is a transaction read from an archived write-ahead log.
+type walTxn struct {
+	startTs  uint64
+	commitTs uint64
+	edges    []*pb.DirectedEdge
+}
+
+// walDirs returns the write-ahead logs under the given directory. It's either the w directory
+// of an alpha, or a directory holding one for each group of the cluster.
+func walDirs(dir string) ([]string, error) {
+	if _, err := os.Stat(filepath.Join(dir, badger.ManifestFilename)); err == nil {
+		return []string{dir}, nil
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read write-ahead log directory %s", dir)
+	}
+	var dirs []string
+	for _, entry := range entries {
+		sub := filepath.Join(dir, entry.Name())
+		if _, err := os.Stat(filepath.Join(sub, badger.ManifestFilename)); entry.IsDir() &&
+			err == nil {
+			dirs = append(dirs, sub)
+		}
+	}
+	if len(dirs) == 0 {
+		return nil, errors.Errorf("no write-ahead log found at %s", dir)
+	}
+	return dirs, nil
+}
+
+// readWALTxns returns the transactions of the write-ahead logs under dir that committed after
+// the given timestamp, ordered by commit timestamp. It fails if a log starts after since, as
+// the transactions committed in between are missing, or if the schema was altered or data was
+// dropped after since, which can't be replayed.
+func readWALTxns(dir string, key x.SensitiveByteSlice, since uint64) ([]*walTxn, error) {
+	dirs, err := walDirs(dir)
+	if err != nil {
+		return nil, err
+	}
+	// The mutations of a transaction can be proposed to several groups, and its commit is
+	// proposed to all of them, so the logs are merged by start timestamp.
+	edges := make(map[uint64][]*pb.DirectedEdge)
+	commits := make(map[uint64]uint64)
+	for _, wdir := range dirs {
+		if err := readWAL(wdir, key, since, edges, commits); err != nil {
+			return nil, errors.Wrapf(err, "cannot read write-ahead log at %s", wdir)
+		}
+	}
+
+	var txns []*walTxn
+	for startTs, commitTs := range commits {
+		if commitTs <= since || len(edges[startTs]) == 0 {
+			continue
+		}
+		txns = append(txns, &walTxn{startTs: startTs, commitTs: commitTs, edges: edges[startTs]})
+	}
+	sort.Slice(txns, func(i, j int) bool {
+		return txns[i].commitTs < txns[j].commitTs
+	})
+	return txns, nil
+}
+
+// readWAL adds the edges of the mutations and the commit timestamps of the transactions in the
+// write-ahead log at dir to the given maps. Aborted transactions have no commit timestamp.
+func readWAL(dir string, key x.SensitiveByteSlice, since uint64,
+	edges map[uint64][]*pb.DirectedEdge, commits map[uint64]uint64) error {
+	db, err := badger.Open(badger.LSMOnlyOptions(dir).
+		WithEncryptionKey(key).
+		WithLogger(nil))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	id, err := raftwal.RaftId(db)
+	if err != nil {
+		return err
+	}
+	gid, err := walGroupId(db, id)
+	if err != nil {
+		return err
+	}
+	store := raftwal.Init(db, id, gid)
+	defer store.Closer.SignalAndWait()
+
+	// The entries before the snapshot were discarded, so the log only has the transactions
+	// that committed after its read timestamp.
+	snap, err := store.Snapshot()
+	if err != nil {
+		return err
+	}
+	var ds pb.Snapshot
+	if err := ds.Unmarshal(snap.Data); err != nil {
+		return errors.Wrapf(err, "cannot read snapshot")
+	}
+	if ds.ReadTs > since {
+		return errors.Errorf("the log of group %d starts at timestamp %d, after the backup "+
+			"ends at timestamp %d, so the writes in between would be lost", gid, ds.ReadTs, since)
+	}
+
+	first, err := store.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := store.LastIndex()
+	if err != nil {
+		return err
+	}
+	for lo := first; lo <= last; {
+		entries, err := store.Entries(lo, last+1, 64<<20)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			lo = entry.Index + 1
+			if entry.Type != raftpb.EntryNormal || len(entry.Data) == 0 {
+				continue
+			}
+			var proposal pb.Proposal
+			if err := proposal.Unmarshal(entry.Data); err != nil {
+				return errors.Wrapf(err, "cannot read entry %d", entry.Index)
+			}
+			if err := addWALProposal(&proposal, since, edges, commits); err != nil {
+				return errors.Wrapf(err, "entry %d of group %d", entry.Index, gid)
+			}
+		}
+	}
+	return nil
+}
+
+// addWALProposal adds the edges and the commits of a proposal read from a write-ahead log to
+// the given maps.
+func addWALProposal(proposal *pb.Proposal, since uint64,
+	edges map[uint64][]*pb.DirectedEdge, commits map[uint64]uint64) error {
+	if m := proposal.Mutations; m != nil {
+		changesSchema := len(m.Schema) > 0 || len(m.Types) > 0 || m.DropOp != pb.Mutations_NONE
+		if changesSchema && m.StartTs > since {
+			return errors.Errorf("the schema was altered or data was dropped at timestamp %d, "+
+				"after the backup, which can't be replayed", m.StartTs)
+		}
+		edges[m.StartTs] = append(edges[m.StartTs], m.Edges...)
+	}
+	if proposal.Restore != nil && proposal.Restore.RestoreTs > since {
+		return errors.Errorf("a backup was restored at timestamp %d, after the backup, which "+
+			"can't be replayed", proposal.Restore.RestoreTs)
+	}
+	for _, txn := range proposal.GetDelta().GetTxns() {
+		if txn.CommitTs > 0 {
+			commits[txn.StartTs] = txn.CommitTs
+		}
+	}
+	return nil
+}
+
+// walGroupId returns the group of the write-ahead log with the given RAFT id.
+func walGroupId(db *badger.DB, id uint64) (uint32, error) {
+	var prefix [8]byte
+	binary.BigEndian.PutUint64(prefix[:], id)
+
+	var gid uint32
+	err := db.View(func(txn *badger.Txn) error {
+		opt := badger.DefaultIteratorOptions
+		opt.PrefetchValues = false
+		opt.Prefix = prefix[:]
+		itr := txn.NewIterator(opt)
+		defer itr.Close()
+
+		for itr.Rewind(); itr.Valid(); itr.Next() {
+			// Only the keys of the entries have the group right after the RAFT id.
+			if key := itr.Item().Key(); len(key) == 20 {
+				gid = binary.BigEndian.Uint32(key[8:12])
+				return nil
+			}
+		}
+		return errors.Errorf("no entries found")
+	})
+	return gid, err
+}
+
+// replayWALTxns applies the given transactions in order with apply and returns the number of
+// them that were applied.
+func replayWALTxns(ctx context.Context, txns []*walTxn,
+	apply func(context.Context, *walTxn) error) (int, error) {
+	for i, txn := range txns {
+		if err := ctx.Err(); err != nil {
+			return i, err
+		}
+		if err := apply(ctx, txn); err != nil {
+			return i, errors.Wrapf(err, "cannot replay transaction committed at timestamp %d",
+				txn.commitTs)
+		}
+	}
+	glog.Infof("Replayed %d transactions of the write-ahead log", len(txns))
+	return len(txns), nil
+}
+
+// applyWALTxn applies the edges of a transaction of the write-ahead log in a new transaction.
+func applyWALTxn(ctx context.Context, txn *walTxn) error {
+	m := &pb.Mutations{
+		StartTs: State.GetTimestamp(false),
+		Edges:   txn.edges,
+	}
+	tc, err := MutateOverNetwork(ctx, m)
+	if err != nil {
+		return err
+	}
+	_, err = CommitOverNetwork(ctx, tc)
+	return err
+}
@@ -13,9 +13,11 @@
 package worker
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
@@ -31,6 +33,7 @@ import (
 	minio "github.com/minio/minio-go/v6"
 	"github.com/minio/minio-go/v6/pkg/credentials"
 	"github.com/minio/minio-go/v6/pkg/s3utils"
+	"github.com/minio/minio-go/v6/pkg/signer"
 	"github.com/pkg/errors"
 )
 
@@ -44,6 +47,11 @@ const (
 	// s3AccelerateSubstr S3 acceleration is enabled if the S3 host is contains this substring.
 	// See http://docs.aws.amazon.com/AmazonS3/latest/dev/transfer-acceleration.html
 	s3AccelerateSubstr = "s3-accelerate"
+
+	// requesterPaysHeader is set on the requests to a requester-pays bucket to acknowledge
+	// that the requester is charged for them.
+	// See https://docs.aws.amazon.com/AmazonS3/latest/dev/ObjectsinRequesterPaysBuckets.html
+	requesterPaysHeader = "X-Amz-Request-Payer"
 )
 
 // FillRestoreCredentials fills the empty values with the default credentials so that
@@ -108,13 +116,88 @@ func (h *s3Handler) requestCreds() credentials.Value {
 func (h *s3Handler) newMinioClient(uri *url.URL) (*minio.Client, error) {
 	secure := uri.Query().Get("secure") != "false" // secure by default
 
+	var creds *credentials.Credentials
+	var mc *minio.Client
+	var err error
 	if h.creds.isAnonymous() {
-		return minio.New(uri.Host, "", "", secure)
+		mc, err = minio.New(uri.Host, "", "", secure)
+	} else {
+		creds = credentials.New(credentialsProvider(uri.Scheme, h.requestCreds()))
+		mc, err = minio.NewWithCredentials(uri.Host, creds, secure, "")
+	}
+	if err != nil || h.creds == nil || !h.creds.RequesterPays {
+		return mc, err
 	}
 
-	credsProvider := credentials.New(credentialsProvider(uri.Scheme, h.requestCreds()))
+	base, err := minio.DefaultTransport(secure)
+	if err != nil {
+		return nil, err
+	}
+	mc.SetCustomTransport(&requesterPaysTransport{base: base, creds: creds})
+	return mc, nil
+}
 
-	return minio.NewWithCredentials(uri.Host, credsProvider, secure, "")
+// requesterPaysTransport sets the requester-pays header on every request sent to the object
+// store. The requests are signed by the client before they get here and S3 rejects the
+// x-amz-* headers that aren't signed, so the requests are signed again with the header.
+type requesterPaysTransport struct {
+	base  http.RoundTripper
+	creds *credentials.Credentials
+}
+
+func (t *requesterPaysTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request, so the header is set on a copy.
+	r := *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	req = &r
+	req.Header.Set(requesterPaysHeader, "requester")
+
+	// Anonymous requests aren't signed. The payloads signed in chunks carry the signature of
+	// the headers in their chunks, so they can't be signed again.
+	auth := req.Header.Get("Authorization")
+	if t.creds == nil || !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") ||
+		strings.HasPrefix(req.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return t.base.RoundTrip(req)
+	}
+	value, err := t.creds.Get()
+	if err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(signer.SignV4(*req, value.AccessKeyID, value.SecretAccessKey,
+		value.SessionToken, signatureRegion(auth)))
+}
+
+// signatureRegion returns the region in the credential scope of a V4 signature, which looks
+// like "AWS4-HMAC-SHA256 Credential=<key>/<date>/<region>/s3/aws4_request, ...".
+func signatureRegion(auth string) string {
+	start := strings.Index(auth, "Credential=")
+	if start < 0 {
+		return ""
+	}
+	scope := strings.SplitN(auth[start+len("Credential="):], ",", 2)[0]
+	parts := strings.Split(scope, "/")
+	if len(parts) < 5 {
+		return ""
+	}
+	return parts[len(parts)-3]
+}
+
+// accessError explains why access to the bucket was denied. The object store doesn't tell a
+// request that was denied because the bucket is requester-pays from one that was denied because
+// the credentials lack the permissions, so the error says which requester-pays setting was used.
+func (h *s3Handler) accessError(err error) error {
+	if minio.ToErrorResponse(errors.Cause(err)).Code != "AccessDenied" {
+		return err
+	}
+	if h.creds == nil || !h.creds.RequesterPays {
+		return errors.Wrapf(err, "access denied to bucket %s: if the bucket is requester-pays, "+
+			"retry with requesterPays set", h.bucketName)
+	}
+	return errors.Wrapf(err, "access denied to bucket %s even though the requests were sent as "+
+		"requester-pays: check the permissions of the credentials", h.bucketName)
 }
 
 // setup creates a new session, checks valid bucket at uri.Path, and configures a minio client.
@@ -168,7 +251,7 @@ func (h *s3Handler) setup(uri *url.URL) (*minio.Client, error) {
 	// verify the requested bucket exists.
 	found, err := mc.BucketExists(h.bucketName)
 	if err != nil {
-		return nil, errors.Wrapf(err, "while looking for bucket %s at host %s",
+		return nil, errors.Wrapf(h.accessError(err), "while looking for bucket %s at host %s",
 			h.bucketName, uri.Host)
 	}
 	if !found {
@@ -266,42 +349,16 @@ func (h *s3Handler) readManifest(mc *minio.Client, object string, m *Manifest) e
 		return err
 	}
 	defer reader.Close()
-	return json.NewDecoder(reader).Decode(m)
+	return h.accessError(json.NewDecoder(reader).Decode(m))
 }
 
 func (h *s3Handler) GetManifests(uri *url.URL, backupId string) ([]*Manifest, error) {
-	mc, err := h.setup(uri)
-	if err != nil {
-		return nil, err
-	}
-
-	var paths []string
-	doneCh := make(chan struct{})
-	defer close(doneCh)
-
-	suffix := "/" + backupManifest
-	for object := range mc.ListObjects(h.bucketName, h.objectPrefix, true, doneCh) {
-		if strings.HasSuffix(object.Key, suffix) {
-			paths = append(paths, object.Key)
-		}
-	}
-	if len(paths) == 0 {
-		return nil, errors.Errorf("No manifests found at: %s", uri.String())
-	}
-	sort.Strings(paths)
+	// ReadManifest reads the manifests from the location of the handler.
+	h.uri = uri
 
 	// Read and filter the manifests to get the list of manifests to consider
 	// for this restore operation.
-	var manifests []*Manifest
-	for _, path := range paths {
-		var m Manifest
-		if err := h.readManifest(mc, path, &m); err != nil {
-			return nil, errors.Wrapf(err, "while reading %q", path)
-		}
-		m.Path = path
-		manifests = append(manifests, &m)
-	}
-	manifests, err = filterManifests(manifests, backupId)
+	manifests, err := seriesManifests(h, uri, backupId)
 	if err != nil {
 		return nil, err
 	}
@@ -351,7 +408,7 @@ func (h *s3Handler) Load(uri *url.URL, backupId string, fn loadFn) LoadResult {
 
 			st, err := reader.Stat()
 			if err != nil {
-				return LoadResult{0, 0, errors.Wrapf(err, "Stat failed %q", object)}
+				return LoadResult{0, 0, errors.Wrapf(h.accessError(err), "Stat failed %q", object)}
 			}
 			if st.Size <= 0 {
 				return LoadResult{0, 0,
@@ -362,7 +419,7 @@ func (h *s3Handler) Load(uri *url.URL, backupId string, fn loadFn) LoadResult {
 			// of the last backup.
 			predSet := manifests[len(manifests)-1].getPredsInGroup(gid)
 
-			groupMaxUid, err := fn(reader, int(gid), predSet)
+			groupMaxUid, err := fn(reader, int(gid), predSet, manifest)
 			if err != nil {
 				return LoadResult{0, 0, err}
 			}
@@ -376,6 +433,59 @@ func (h *s3Handler) Load(uri *url.URL, backupId string, fn loadFn) LoadResult {
 	return LoadResult{since, maxUid, nil}
 }
 
+// Size returns the total size of the backup objects that would be loaded.
+func (h *s3Handler) Size(uri *url.URL, backupId string) (int64, error) {
+	manifests, err := h.GetManifests(uri, backupId)
+	if err != nil {
+		return 0, errors.Wrapf(err, "while retrieving manifests")
+	}
+
+	mc, err := h.setup(uri)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, manifest := range manifests {
+		if manifest.Since == 0 || len(manifest.Groups) == 0 {
+			continue
+		}
+
+		path := filepath.Dir(manifest.Path)
+		for gid := range manifest.Groups {
+			object := filepath.Join(path, backupName(manifest.Since, gid))
+			st, err := mc.StatObject(h.bucketName, object, minio.StatObjectOptions{})
+			if err != nil {
+				return 0, errors.Wrapf(h.accessError(err), "Stat failed %q", object)
+			}
+			size += st.Size
+		}
+	}
+	return size, nil
+}
+
+// OpenBackupFile opens the backup object at the given path.
+func (h *s3Handler) OpenBackupFile(uri *url.URL, path string) (io.ReadCloser, error) {
+	mc, err := h.setup(uri)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := mc.GetObject(h.bucketName, path, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get %q", path)
+	}
+	st, err := reader.Stat()
+	if err != nil {
+		reader.Close()
+		return nil, errors.Wrapf(h.accessError(err), "Stat failed %q", path)
+	}
+	if st.Size <= 0 {
+		reader.Close()
+		return nil, errors.Errorf("Remote object is empty or inaccessible: %s", path)
+	}
+	return reader, nil
+}
+
 // Verify performs basic checks to decide whether the specified backup can be restored
 // to a live cluster.
 func (h *s3Handler) Verify(uri *url.URL, backupId string, currentGroups []uint32) error {
@@ -425,6 +535,86 @@ func (h *s3Handler) ReadManifest(path string, m *Manifest) error {
 	return h.readManifest(mc, path, m)
 }
 
+// ReadManifestIndex reads the index of the manifests from the object at the root of the
+// location.
+func (h *s3Handler) ReadManifestIndex(uri *url.URL) ([]byte, error) {
+	mc, err := h.setup(uri)
+	if err != nil {
+		return nil, err
+	}
+	object := filepath.Join(h.objectPrefix, backupManifestIndex)
+	reader, err := mc.GetObject(h.bucketName, object, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	b, err := ioutil.ReadAll(reader)
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil, nil
+	}
+	return b, err
+}
+
+// WriteManifestIndex writes the index of the manifests to the object at the root of the
+// location.
+func (h *s3Handler) WriteManifestIndex(uri *url.URL, b []byte) error {
+	mc, err := h.setup(uri)
+	if err != nil {
+		return err
+	}
+	object := filepath.Join(h.objectPrefix, backupManifestIndex)
+	_, err = mc.PutObject(h.bucketName, object, bytes.NewReader(b), int64(len(b)),
+		minio.PutObjectOptions{ContentType: "application/json"})
+	return err
+}
+
+// ReadLatestManifest reads the path of the manifest of the latest backup from the object at
+// the root of the location.
+func (h *s3Handler) ReadLatestManifest(uri *url.URL) (string, error) {
+	mc, err := h.setup(uri)
+	if err != nil {
+		return "", err
+	}
+	object := filepath.Join(h.objectPrefix, backupLatestManifest)
+	reader, err := mc.GetObject(h.bucketName, object, minio.GetObjectOptions{})
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	b, err := ioutil.ReadAll(reader)
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return "", nil
+	}
+	return string(b), err
+}
+
+// WriteLatestManifest writes the path of the manifest of the latest backup to the object at
+// the root of the location.
+func (h *s3Handler) WriteLatestManifest(uri *url.URL, path string) error {
+	mc, err := h.setup(uri)
+	if err != nil {
+		return err
+	}
+	object := filepath.Join(h.objectPrefix, backupLatestManifest)
+	_, err = mc.PutObject(h.bucketName, object, strings.NewReader(path), int64(len(path)),
+		minio.PutObjectOptions{ContentType: "text/plain"})
+	return err
+}
+
+// WriteFile writes b to the object named by the path of the URI after the bucket.
+func (h *s3Handler) WriteFile(uri *url.URL, b []byte) error {
+	mc, err := h.setup(uri)
+	if err != nil {
+		return err
+	}
+	if h.objectPrefix == "" {
+		return errors.Errorf("Invalid object: %q doesn't name an object in the bucket", uri.Path)
+	}
+	_, err = mc.PutObject(h.bucketName, h.objectPrefix, bytes.NewReader(b), int64(len(b)),
+		minio.PutObjectOptions{})
+	return err
+}
+
 // upload will block until it's done or an error occurs.
 func (h *s3Handler) upload(mc *minio.Client, object string) error {
 	start := time.Now()
@@ -246,8 +246,6 @@ func parseFuncTypeHelper(name string) (FuncType, string) {
 	switch f {
 	case "le", "ge", "lt", "gt", "eq":
 		return compareAttrFn, f
-	case "min", "max", "sum", "avg":
-		return aggregatorFn, f
 	case "checkpwd":
 		return passwordFn, f
 	case "regexp":
@@ -266,6 +264,9 @@ func parseFuncTypeHelper(name string) (FuncType, string) {
 		if types.IsGeoFunc(f) {
 			return geoFn, f
 		}
+		if types.IsAggregator(f) {
+			return aggregatorFn, f
+		}
 		return standardFn, f
 	}
 }
@@ -304,7 +305,11 @@ type funcArgs struct {
 // The function tells us whether we want to fetch value posting lists or uid posting lists.
 func (srcFn *functionContext) needsValuePostings(typ types.TypeID) (bool, error) {
 	switch srcFn.fnType {
-	case aggregatorFn, passwordFn:
+	case aggregatorFn:
+		// The aggregators applied to the edges of uid predicates, like countdistinct, get the
+		// uids of the edges.
+		return typ.IsScalar(), nil
+	case passwordFn:
 		return true, nil
 	case compareAttrFn:
 		if len(srcFn.tokens) > 0 {
@@ -701,7 +706,7 @@ func (qs *queryState) handleUidPostings(
 			}
 			var key []byte
 			switch srcFn.fnType {
-			case notAFunction, compareScalarFn, hasFn, uidInFn:
+			case notAFunction, aggregatorFn, compareScalarFn, hasFn, uidInFn:
 				if q.Reverse {
 					key = x.ReverseKey(q.Attr, q.UidList.Uids[i])
 				} else {
@@ -947,7 +952,8 @@ func (qs *queryState) helpProcessTask(ctx context.Context, q *pb.Query, gid uint
 		AfterUid: q.AfterUid,
 	}
 	// If we have srcFunc and Uids, it means its a filter. So we intersect.
-	if srcFn.fnType != notAFunction && q.UidList != nil && len(q.UidList.Uids) > 0 {
+	if srcFn.fnType != notAFunction && srcFn.fnType != aggregatorFn && q.UidList != nil &&
+		len(q.UidList.Uids) > 0 {
 		opts.Intersect = q.UidList
 	}
 
@@ -1644,7 +1650,7 @@ func parseSrcFn(ctx context.Context, q *pb.Query) (*functionContext, error) {
 		if err != nil {
 			return nil, errors.Errorf("Attribute %q is not scalar-type", attr)
 		}
-		if !couldApplyAggregatorOn(f, typ) {
+		if !types.CanAggregate(f, typ) {
 			return nil, errors.Errorf("Aggregator %q could not apply on %v",
 				f, attr)
 		}
@@ -30,6 +30,12 @@ type Options struct {
 	QueryEdgeLimit uint64
 	// NormalizeNodeLimit is the maximum number of nodes allowed in a normalize query.
 	NormalizeNodeLimit int
+	// AggregateBufferLimit is the maximum number of values that the aggregators of a groupby
+	// query can buffer across all of its groups. A value of zero disables the limit.
+	AggregateBufferLimit int
+	// GroupbyGroupLimit is the maximum number of groups that a groupby query is estimated to
+	// form before forming them. A value of zero disables the limit.
+	GroupbyGroupLimit int
 	// PollInterval is the polling interval for graphql subscription.
 	PollInterval time.Duration
 }
@@ -84,6 +90,9 @@ type WorkerOptions struct {
 	LudicrousMode bool
 	// EncryptionKey is the key used for encryption at rest, backups, exports. Enterprise only feature.
 	EncryptionKey SensitiveByteSlice
+	// BackupArchiveLimit is the maximum number of bytes that a backup archive restored by this
+	// alpha can take once extracted. A limit of zero only limits it to the free disk space.
+	BackupArchiveLimit int64
 	// LogRequest indicates whether alpha should log all query/mutation requests coming to it.
 	// Ideally LogRequest should be a bool value. But we are reading it using atomics across
 	// queries hence it has been kept as int32. LogRequest value 1 enables logging of requests